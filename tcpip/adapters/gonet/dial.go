@@ -0,0 +1,281 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gonet
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+)
+
+// DefaultFallbackDelay is the time a Dialer waits for a connection to the
+// first address family to be established before racing it with the other
+// family.
+const DefaultFallbackDelay = 300 * time.Millisecond
+
+var (
+	errNoAddress      = errors.New("no suitable address found")
+	errUnknownNetwork = errors.New("unknown network")
+	errNoResolver     = errors.New("host names require a resolver")
+	errInvalidPort    = errors.New("invalid port")
+	errMissingAddress = errors.New("missing address")
+	errDialerNoStack  = errors.New("dialer has no stack")
+)
+
+// Resolver resolves host names for a Dialer. It is implemented by
+// resolver.Resolver.
+type Resolver interface {
+	// LookupIP returns the IPv4 and IPv6 addresses of the given host.
+	LookupIP(ctx context.Context, host string) ([]tcpip.Address, error)
+}
+
+// Dialer dials connections through a stack. Its DialContext method can be
+// plugged in http.Transport, tls.Dialer and the like in place of the one of
+// net.Dialer.
+type Dialer struct {
+	// Stack is the stack the connections are made through.
+	Stack tcpip.Stack
+
+	// Resolver resolves host names. If it is nil, only addresses with IP
+	// literals can be dialed.
+	Resolver Resolver
+
+	// FallbackDelay is the time to wait for a TCP connection to the first
+	// address family before racing it with the other one, as in "Happy
+	// Eyeballs" (RFC 6555). If it is zero, DefaultFallbackDelay is used;
+	// if it is negative, the address families are tried one after the
+	// other.
+	FallbackDelay time.Duration
+}
+
+// DialContext connects to the given address on the named network, which must
+// be one of "tcp", "tcp4", "tcp6", "udp", "udp4" or "udp6". The address has
+// the form "host:port", where host is an IP literal or a name resolved by
+// d.Resolver.
+//
+// When the host has both IPv4 and IPv6 addresses, TCP connections are raced
+// across both families, so that a family without a route in the stack or with
+// a broken path doesn't delay the connection.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.Stack == nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errDialerNoStack}
+	}
+
+	var family int
+	switch network {
+	case "tcp", "udp":
+	case "tcp4", "udp4":
+		family = header.IPv4AddressSize
+	case "tcp6", "udp6":
+		family = header.IPv6AddressSize
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errUnknownNetwork}
+	}
+	tcp := network[:3] == "tcp"
+
+	addrs, err := d.resolve(ctx, address, family)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	if !tcp {
+		return d.dialSerial(ctx, addrs, false)
+	}
+
+	primaries, fallbacks := partition(addrs)
+	if len(fallbacks) == 0 || d.FallbackDelay < 0 {
+		return d.dialSerial(ctx, addrs, true)
+	}
+
+	return d.dialParallel(ctx, primaries, fallbacks)
+}
+
+// resolve returns the addresses the given "host:port" address resolves to,
+// keeping only those of the given size unless it is zero.
+func (d *Dialer) resolve(ctx context.Context, address string, family int) ([]tcpip.FullAddress, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, errInvalidPort
+	}
+
+	var ips []tcpip.Address
+	if host == "" {
+		return nil, errMissingAddress
+	} else if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			ips = []tcpip.Address{tcpip.Address(ip4)}
+		} else {
+			ips = []tcpip.Address{tcpip.Address(ip)}
+		}
+	} else if d.Resolver == nil {
+		return nil, errNoResolver
+	} else if ips, err = d.Resolver.LookupIP(ctx, host); err != nil {
+		return nil, err
+	}
+
+	var addrs []tcpip.FullAddress
+	for _, ip := range ips {
+		if family == 0 || len(ip) == family {
+			addrs = append(addrs, tcpip.FullAddress{Addr: ip, Port: uint16(port)})
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, errNoAddress
+	}
+
+	return addrs, nil
+}
+
+// partition splits addrs into those of the same family as the first one, and
+// the others.
+func partition(addrs []tcpip.FullAddress) (primaries, fallbacks []tcpip.FullAddress) {
+	for _, a := range addrs {
+		if len(a.Addr) == len(addrs[0].Addr) {
+			primaries = append(primaries, a)
+		} else {
+			fallbacks = append(fallbacks, a)
+		}
+	}
+	return primaries, fallbacks
+}
+
+// dialSerial connects to each address in turn, and returns the first
+// connection established. If none is, it returns the error of the first
+// attempt.
+func (d *Dialer) dialSerial(ctx context.Context, addrs []tcpip.FullAddress, tcp bool) (net.Conn, error) {
+	var firstErr error
+	for _, a := range addrs {
+		select {
+		case <-ctx.Done():
+			if firstErr == nil {
+				firstErr = &net.OpError{Op: "dial", Net: netName(tcp), Err: ctx.Err()}
+			}
+			return nil, firstErr
+		default:
+		}
+
+		c, err := d.dialSingle(ctx, a, tcp)
+		if err == nil {
+			return c, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return nil, firstErr
+}
+
+func (d *Dialer) dialSingle(ctx context.Context, addr tcpip.FullAddress, tcp bool) (net.Conn, error) {
+	network := header.IPv4ProtocolNumber
+	if len(addr.Addr) == header.IPv6AddressSize {
+		network = header.IPv6ProtocolNumber
+	}
+
+	// Avoid returning typed nil pointers as net.Conn.
+	if tcp {
+		c, err := DialContextTCP(ctx, d.Stack, addr, network)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+
+	c, err := DialUDP(d.Stack, nil, &addr, network)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// dialParallel races connections to the primary and fallback addresses. The
+// fallbacks are started after the fallback delay, or as soon as the primaries
+// fail. The first connection established is returned, and the other attempt is
+// canceled.
+func (d *Dialer) dialParallel(ctx context.Context, primaries, fallbacks []tcpip.FullAddress) (net.Conn, error) {
+	type result struct {
+		c       net.Conn
+		err     error
+		primary bool
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result)
+	returned := make(chan struct{})
+	defer close(returned)
+
+	race := func(addrs []tcpip.FullAddress, primary bool) {
+		c, err := d.dialSerial(ctx, addrs, true)
+		select {
+		case results <- result{c: c, err: err, primary: primary}:
+		case <-returned:
+			// The race is over, discard the connection.
+			if c != nil {
+				c.Close()
+			}
+		}
+	}
+
+	go race(primaries, true)
+
+	delay := d.FallbackDelay
+	if delay == 0 {
+		delay = DefaultFallbackDelay
+	}
+	fallbackTimer := time.NewTimer(delay)
+	defer fallbackTimer.Stop()
+
+	var primaryErr, fallbackErr error
+	fallbackStarted := false
+	for {
+		select {
+		case <-fallbackTimer.C:
+			fallbackStarted = true
+			go race(fallbacks, false)
+
+		case res := <-results:
+			if res.err == nil {
+				return res.c, nil
+			}
+
+			if res.primary {
+				primaryErr = res.err
+			} else {
+				fallbackErr = res.err
+			}
+
+			if primaryErr != nil && fallbackErr != nil {
+				return nil, primaryErr
+			}
+
+			if res.primary && !fallbackStarted {
+				// Start the fallbacks right away.
+				fallbackTimer.Stop()
+				fallbackStarted = true
+				go race(fallbacks, false)
+			}
+		}
+	}
+}
+
+func netName(tcp bool) string {
+	if tcp {
+		return "tcp"
+	}
+	return "udp"
+}
@@ -0,0 +1,120 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gonet
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/link/loopback"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/network/ipv6"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/google/netstack/tcpip/transport/udp"
+)
+
+const localAddrV6 = tcpip.Address("\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+
+// staticResolver resolves all names to the same addresses.
+type staticResolver []tcpip.Address
+
+func (r staticResolver) LookupIP(context.Context, string) ([]tcpip.Address, error) {
+	return r, nil
+}
+
+func newDualStack(t *testing.T) tcpip.Stack {
+	s := stack.New([]string{ipv4.ProtocolName, ipv6.ProtocolName}, []string{tcp.ProtocolName, udp.ProtocolName})
+
+	if err := s.CreateNIC(nicID, loopback.New()); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(nicID, ipv4.ProtocolNumber, localAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	if err := s.AddAddress(nicID, ipv6.ProtocolNumber, localAddrV6); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{
+		{
+			Destination: "\x00\x00\x00\x00",
+			Mask:        "\x00\x00\x00\x00",
+			NIC:         nicID,
+		},
+		{
+			Destination: "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+			Mask:        "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+			NIC:         nicID,
+		},
+	})
+
+	return s
+}
+
+func TestDialerHTTP(t *testing.T) {
+	s := newDualStack(t)
+
+	// The server only listens on IPv6, so the IPv4 attempt fails and the
+	// dialer falls back to IPv6.
+	l, err := NewListener(s, tcpip.FullAddress{nicID, localAddrV6, listenPort}, ipv6.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("NewListener failed: %v", err)
+	}
+	defer l.Close()
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	d := &Dialer{
+		Stack:    s,
+		Resolver: staticResolver{localAddr, localAddrV6},
+	}
+	tr := &http.Transport{DialContext: d.DialContext}
+	defer tr.CloseIdleConnections()
+
+	resp, err := (&http.Client{Transport: tr}).Get("http://example.com:8080/")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if string(body) != "hello" {
+		t.Errorf("Got body %q, want %q", body, "hello")
+	}
+}
+
+func TestDialerErrors(t *testing.T) {
+	s := newDualStack(t)
+	d := &Dialer{Stack: s}
+
+	tests := []struct {
+		network, address string
+	}{
+		{"tcp", "example.com:80"},
+		{"tcp", "127.0.0.1:http"},
+		{"tcp6", "127.0.0.1:80"},
+		{"sctp", "127.0.0.1:80"},
+	}
+
+	for _, test := range tests {
+		if c, err := d.DialContext(context.Background(), test.network, test.address); err == nil {
+			c.Close()
+			t.Errorf("DialContext(%q, %q) succeeded", test.network, test.address)
+		}
+	}
+}
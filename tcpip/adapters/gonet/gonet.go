@@ -0,0 +1,604 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package gonet provides net.Conn, net.Listener and net.PacketConn
+// implementations on top of netstack TCP and UDP endpoints, so that existing
+// Go code, e.g., net/http servers and clients or DNS resolvers, can run
+// unmodified over the userspace stack. Dialer.DialContext can be plugged in
+// http.Transport and similar types to make their connections through a stack.
+package gonet
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/waiter"
+)
+
+var errCanceled = errors.New("operation canceled")
+
+// timeoutError is the error returned by operations that time out because of a
+// deadline. It implements net.Error.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// deadlines implements the deadline methods of net.Conn with the deadline
+// options of an endpoint.
+type deadlines struct {
+	ep tcpip.Endpoint
+}
+
+// SetReadDeadline implements net.Conn.SetReadDeadline and
+// net.PacketConn.SetReadDeadline.
+func (d deadlines) SetReadDeadline(t time.Time) error {
+	if err := d.ep.SetSockOpt(tcpip.ReceiveDeadlineOption(t)); err != nil {
+		return errors.New(err.Error())
+	}
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn.SetWriteDeadline and
+// net.PacketConn.SetWriteDeadline.
+func (d deadlines) SetWriteDeadline(t time.Time) error {
+	if err := d.ep.SetSockOpt(tcpip.SendDeadlineOption(t)); err != nil {
+		return errors.New(err.Error())
+	}
+	return nil
+}
+
+// SetDeadline implements net.Conn.SetDeadline and net.PacketConn.SetDeadline.
+func (d deadlines) SetDeadline(t time.Time) error {
+	if err := d.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return d.SetWriteDeadline(t)
+}
+
+// opError converts an error returned by an endpoint to the error returned by
+// the adapters.
+func opError(err error) error {
+	if err == tcpip.ErrTimeout {
+		return timeoutError{}
+	}
+	return errors.New(err.Error())
+}
+
+// Conn is a net.Conn over a connected netstack TCP endpoint. Reads and writes
+// block until they complete, the deadline expires or the connection fails.
+type Conn struct {
+	deadlines
+
+	wq *waiter.Queue
+	ep tcpip.Endpoint
+
+	// readMu serializes reads and protects read, which holds the data
+	// read from the endpoint but not yet returned.
+	readMu sync.Mutex
+	read   buffer.View
+}
+
+// NewConn creates a new Conn from a connected endpoint and its wait queue.
+func NewConn(wq *waiter.Queue, ep tcpip.Endpoint) *Conn {
+	return &Conn{
+		deadlines: deadlines{ep},
+		wq:        wq,
+		ep:        ep,
+	}
+}
+
+// Read implements net.Conn.Read.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if len(c.read) == 0 {
+		var err error
+		c.read, err = c.readBlocking()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, c.read)
+	c.read.TrimFront(n)
+	if len(c.read) == 0 {
+		c.read = nil
+	}
+
+	return n, nil
+}
+
+// readBlocking reads from the endpoint, waiting for data to be available until
+// the read deadline expires.
+func (c *Conn) readBlocking() (buffer.View, error) {
+	b := tcpip.BlockingEndpoint{Endpoint: c.ep, Queue: c.wq}
+	v, err := b.ReadContext(context.Background(), nil)
+	if err == tcpip.ErrClosedForReceive {
+		return nil, io.EOF
+	}
+
+	if err != nil {
+		return nil, c.newOpError("read", opError(err))
+	}
+
+	return v, nil
+}
+
+// Write implements net.Conn.Write.
+func (c *Conn) Write(b []byte) (int, error) {
+	// The endpoint keeps the view until the data is acknowledged, so it
+	// can't share memory with b.
+	v := buffer.NewView(len(b))
+	copy(v, b)
+
+	be := tcpip.BlockingEndpoint{Endpoint: c.ep, Queue: c.wq}
+	if n, err := be.WriteContext(context.Background(), v, nil); err != nil {
+		return int(n), c.newOpError("write", opError(err))
+	}
+
+	return len(b), nil
+}
+
+// Close implements net.Conn.Close.
+func (c *Conn) Close() error {
+	c.ep.Close()
+	return nil
+}
+
+// CloseRead shuts down the reading side of the connection, like
+// net.TCPConn.CloseRead.
+func (c *Conn) CloseRead() error {
+	if err := c.ep.Shutdown(tcpip.ShutdownRead); err != nil {
+		return c.newOpError("close", errors.New(err.Error()))
+	}
+	return nil
+}
+
+// CloseWrite shuts down the writing side of the connection, like
+// net.TCPConn.CloseWrite.
+func (c *Conn) CloseWrite() error {
+	if err := c.ep.Shutdown(tcpip.ShutdownWrite); err != nil {
+		return c.newOpError("close", errors.New(err.Error()))
+	}
+	return nil
+}
+
+// LocalAddr implements net.Conn.LocalAddr.
+func (c *Conn) LocalAddr() net.Addr {
+	a, err := c.ep.GetLocalAddress()
+	if err != nil {
+		return nil
+	}
+	return fullToTCPAddr(a)
+}
+
+// RemoteAddr implements net.Conn.RemoteAddr.
+func (c *Conn) RemoteAddr() net.Addr {
+	a, err := c.ep.GetRemoteAddress()
+	if err != nil {
+		return nil
+	}
+	return fullToTCPAddr(a)
+}
+
+func (c *Conn) newOpError(op string, err error) *net.OpError {
+	return &net.OpError{
+		Op:     op,
+		Net:    "tcp",
+		Source: c.LocalAddr(),
+		Addr:   c.RemoteAddr(),
+		Err:    err,
+	}
+}
+
+// DialTCP creates a new TCP connection to the given address, using the given
+// network protocol, and waits until it is established.
+func DialTCP(s tcpip.Stack, addr tcpip.FullAddress, network tcpip.NetworkProtocolNumber) (*Conn, error) {
+	return DialContextTCP(context.Background(), s, addr, network)
+}
+
+// DialContextTCP is like DialTCP, but the handshake is aborted if ctx is
+// canceled or its deadline expires before the connection is established.
+func DialContextTCP(ctx context.Context, s tcpip.Stack, addr tcpip.FullAddress, network tcpip.NetworkProtocolNumber) (*Conn, error) {
+	// Check if the context is already done.
+	select {
+	case <-ctx.Done():
+		return nil, &net.OpError{
+			Op:   "connect",
+			Net:  "tcp",
+			Addr: fullToTCPAddr(addr),
+			Err:  ctx.Err(),
+		}
+	default:
+	}
+
+	// Create TCP endpoint, then connect.
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(tcp.ProtocolNumber, network, &wq)
+	if err != nil {
+		return nil, errors.New(err.Error())
+	}
+
+	// Create wait queue entry that notifies a channel.
+	//
+	// We do this unconditionally as Connect will always return an error.
+	waitEntry, notifyCh := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&waitEntry, waiter.EventOut)
+	defer wq.EventUnregister(&waitEntry)
+
+	err = ep.Connect(addr)
+	if err == tcpip.ErrConnectStarted {
+		select {
+		case <-ctx.Done():
+			// Closing the endpoint aborts the handshake.
+			ep.Close()
+			return nil, &net.OpError{
+				Op:   "connect",
+				Net:  "tcp",
+				Addr: fullToTCPAddr(addr),
+				Err:  ctx.Err(),
+			}
+		case <-notifyCh:
+		}
+
+		err = ep.GetSockOpt(tcpip.ErrorOption{})
+	}
+
+	if err != nil {
+		ep.Close()
+		return nil, &net.OpError{
+			Op:   "connect",
+			Net:  "tcp",
+			Addr: fullToTCPAddr(addr),
+			Err:  errors.New(err.Error()),
+		}
+	}
+
+	return NewConn(&wq, ep), nil
+}
+
+// Listener is a net.Listener over a listening netstack TCP endpoint.
+type Listener struct {
+	stack  tcpip.Stack
+	ep     tcpip.Endpoint
+	wq     *waiter.Queue
+	cancel chan struct{}
+	once   sync.Once
+}
+
+// NewListener creates a new TCP endpoint of the given network protocol, binds it
+// to the given address and makes it listen for connections.
+func NewListener(s tcpip.Stack, addr tcpip.FullAddress, network tcpip.NetworkProtocolNumber) (*Listener, error) {
+	// Create TCP endpoint, bind it, then start listening.
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(tcp.ProtocolNumber, network, &wq)
+	if err != nil {
+		return nil, errors.New(err.Error())
+	}
+
+	if err := ep.Bind(addr, nil); err != nil {
+		ep.Close()
+		return nil, &net.OpError{
+			Op:   "bind",
+			Net:  "tcp",
+			Addr: fullToTCPAddr(addr),
+			Err:  errors.New(err.Error()),
+		}
+	}
+
+	if err := ep.Listen(10); err != nil {
+		ep.Close()
+		return nil, &net.OpError{
+			Op:   "listen",
+			Net:  "tcp",
+			Addr: fullToTCPAddr(addr),
+			Err:  errors.New(err.Error()),
+		}
+	}
+
+	return &Listener{
+		stack:  s,
+		ep:     ep,
+		wq:     &wq,
+		cancel: make(chan struct{}),
+	}, nil
+}
+
+// Accept implements net.Listener.Accept. It waits until a connection is
+// established or the listener is closed.
+func (l *Listener) Accept() (net.Conn, error) {
+	n, wq, err := l.ep.Accept()
+	if err == tcpip.ErrWouldBlock {
+		var e waiter.ChannelEntry
+		e.Register(l.wq, waiter.EventIn)
+		defer e.Unregister(l.wq)
+
+		for {
+			n, wq, err = l.ep.Accept()
+			if err != tcpip.ErrWouldBlock {
+				break
+			}
+
+			select {
+			case <-l.cancel:
+				return nil, l.newOpError(errCanceled)
+			case <-e.C():
+			}
+		}
+	}
+
+	if err != nil {
+		return nil, l.newOpError(errors.New(err.Error()))
+	}
+
+	return NewConn(wq, n), nil
+}
+
+// Close implements net.Listener.Close. Blocked Accept calls return an error.
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		close(l.cancel)
+		l.ep.Close()
+	})
+	return nil
+}
+
+// Addr implements net.Listener.Addr.
+func (l *Listener) Addr() net.Addr {
+	a, err := l.ep.GetLocalAddress()
+	if err != nil {
+		return nil
+	}
+	return fullToTCPAddr(a)
+}
+
+func (l *Listener) newOpError(err error) *net.OpError {
+	return &net.OpError{
+		Op:   "accept",
+		Net:  "tcp",
+		Addr: l.Addr(),
+		Err:  err,
+	}
+}
+
+// PacketConn is a net.PacketConn over a netstack UDP endpoint. When the
+// endpoint is connected, e.g., one created by DialUDP, it is also a net.Conn.
+type PacketConn struct {
+	deadlines
+
+	stack tcpip.Stack
+	ep    tcpip.Endpoint
+	wq    *waiter.Queue
+
+	// closed is closed by Close to wake up blocked readers, as the
+	// endpoint doesn't notify its waiters when it is closed.
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewPacketConn creates a new UDP endpoint of the given network protocol and
+// binds it to the given address.
+func NewPacketConn(s tcpip.Stack, addr tcpip.FullAddress, network tcpip.NetworkProtocolNumber) (*PacketConn, error) {
+	// Create UDP endpoint and bind it.
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, network, &wq)
+	if err != nil {
+		return nil, errors.New(err.Error())
+	}
+
+	if err := ep.Bind(addr, nil); err != nil {
+		ep.Close()
+		return nil, &net.OpError{
+			Op:   "bind",
+			Net:  "udp",
+			Addr: fullToUDPAddr(addr),
+			Err:  errors.New(err.Error()),
+		}
+	}
+
+	return NewUDPConn(s, &wq, ep), nil
+}
+
+// DialUDP creates a new UDP endpoint of the given network protocol. If laddr
+// is not nil, the endpoint is bound to it; if raddr is not nil, the endpoint is
+// connected to it. Neither operation blocks.
+func DialUDP(s tcpip.Stack, laddr, raddr *tcpip.FullAddress, network tcpip.NetworkProtocolNumber) (*PacketConn, error) {
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, network, &wq)
+	if err != nil {
+		return nil, errors.New(err.Error())
+	}
+
+	if laddr != nil {
+		if err := ep.Bind(*laddr, nil); err != nil {
+			ep.Close()
+			return nil, &net.OpError{
+				Op:   "bind",
+				Net:  "udp",
+				Addr: fullToUDPAddr(*laddr),
+				Err:  errors.New(err.Error()),
+			}
+		}
+	}
+
+	if raddr != nil {
+		if err := ep.Connect(*raddr); err != nil {
+			ep.Close()
+			return nil, &net.OpError{
+				Op:   "connect",
+				Net:  "udp",
+				Addr: fullToUDPAddr(*raddr),
+				Err:  errors.New(err.Error()),
+			}
+		}
+	}
+
+	return NewUDPConn(s, &wq, ep), nil
+}
+
+// NewUDPConn creates a new PacketConn from an existing UDP endpoint and its
+// wait queue, e.g., one created by a udp.ForwarderRequest.
+func NewUDPConn(s tcpip.Stack, wq *waiter.Queue, ep tcpip.Endpoint) *PacketConn {
+	return &PacketConn{
+		deadlines: deadlines{ep},
+		stack:     s,
+		ep:        ep,
+		wq:        wq,
+		closed:    make(chan struct{}),
+	}
+}
+
+// ReadFrom implements net.PacketConn.ReadFrom. It waits until a datagram is
+// received, the read deadline expires or the connection is closed. If b is
+// too small for the datagram, the excess bytes are discarded.
+func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, _, _, addr, err := c.ReadFromTrunc(b)
+	return n, addr, err
+}
+
+// ReadFromTrunc is like ReadFrom, but it also returns the full length of the
+// datagram, and whether it was truncated because b is too small for it, i.e.,
+// whether length is larger than n, like recvmsg and MSG_TRUNC.
+func (c *PacketConn) ReadFromTrunc(b []byte) (n, length int, truncated bool, addr net.Addr, err error) {
+	var from tcpip.FullAddress
+	v, err := c.readBlocking(&from)
+	if err != nil {
+		return 0, 0, false, nil, err
+	}
+
+	n = copy(b, v)
+	return n, len(v), n < len(v), fullToUDPAddr(from), nil
+}
+
+// Read implements net.Conn.Read. It is like ReadFrom, but doesn't report the
+// sender's address.
+func (c *PacketConn) Read(b []byte) (int, error) {
+	v, err := c.readBlocking(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return copy(b, v), nil
+}
+
+// readBlocking reads a datagram from the endpoint, waiting for one to be
+// received until the deadline expires or the connection is closed.
+func (c *PacketConn) readBlocking(addr *tcpip.FullAddress) (buffer.View, error) {
+	v, err := c.ep.Read(addr)
+	if err == tcpip.ErrWouldBlock {
+		var e waiter.ChannelEntry
+		e.Register(c.wq, waiter.EventIn)
+		defer e.Unregister(c.wq)
+
+		for {
+			v, err = c.ep.Read(addr)
+			if err != tcpip.ErrWouldBlock {
+				break
+			}
+
+			select {
+			case <-c.closed:
+				return nil, c.newOpError("read", nil, errCanceled)
+			case <-e.C():
+			}
+		}
+	}
+
+	if err != nil {
+		return nil, c.newOpError("read", nil, opError(err))
+	}
+
+	return v, nil
+}
+
+// WriteTo implements net.PacketConn.WriteTo. addr must be a *net.UDPAddr.
+func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, c.newOpError("write", addr, errors.New("invalid address type"))
+	}
+
+	to := tcpip.FullAddress{Addr: tcpip.Address(ua.IP), Port: uint16(ua.Port)}
+	if ip4 := ua.IP.To4(); ip4 != nil {
+		to.Addr = tcpip.Address(ip4)
+	}
+
+	return c.write(b, &to, addr)
+}
+
+// Write implements net.Conn.Write. The connection must be connected.
+func (c *PacketConn) Write(b []byte) (int, error) {
+	return c.write(b, nil, c.RemoteAddr())
+}
+
+func (c *PacketConn) write(b []byte, to *tcpip.FullAddress, addr net.Addr) (int, error) {
+	// The datagram may be queued by the link endpoint, so it can't share
+	// memory with b.
+	v := buffer.NewView(len(b))
+	copy(v, b)
+
+	n, err := c.ep.Write(v, to)
+	if err != nil {
+		return int(n), c.newOpError("write", addr, opError(err))
+	}
+
+	return int(n), nil
+}
+
+// Close implements net.PacketConn.Close.
+func (c *PacketConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.ep.Close()
+	})
+	return nil
+}
+
+// LocalAddr implements net.PacketConn.LocalAddr.
+func (c *PacketConn) LocalAddr() net.Addr {
+	a, err := c.ep.GetLocalAddress()
+	if err != nil {
+		return nil
+	}
+	return fullToUDPAddr(a)
+}
+
+// RemoteAddr implements net.Conn.RemoteAddr. It returns nil if the connection
+// isn't connected.
+func (c *PacketConn) RemoteAddr() net.Addr {
+	a, err := c.ep.GetRemoteAddress()
+	if err != nil {
+		return nil
+	}
+	return fullToUDPAddr(a)
+}
+
+func (c *PacketConn) newOpError(op string, addr net.Addr, err error) *net.OpError {
+	return &net.OpError{
+		Op:     op,
+		Net:    "udp",
+		Source: c.LocalAddr(),
+		Addr:   addr,
+		Err:    err,
+	}
+}
+
+func fullToUDPAddr(addr tcpip.FullAddress) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IP(addr.Addr), Port: int(addr.Port)}
+}
+
+func fullToTCPAddr(addr tcpip.FullAddress) *net.TCPAddr {
+	return &net.TCPAddr{IP: net.IP(addr.Addr), Port: int(addr.Port)}
+}
@@ -0,0 +1,282 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gonet
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/link/loopback"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/google/netstack/tcpip/transport/udp"
+)
+
+const (
+	nicID      = 1
+	localAddr  = tcpip.Address("\x7f\x00\x00\x01")
+	listenPort = 8080
+)
+
+func newLoopbackStack(t *testing.T) tcpip.Stack {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName, udp.ProtocolName})
+
+	if err := s.CreateNIC(nicID, loopback.New()); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(nicID, ipv4.ProtocolNumber, localAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		Gateway:     "",
+		NIC:         nicID,
+	}})
+
+	return s
+}
+
+func TestConnEcho(t *testing.T) {
+	s := newLoopbackStack(t)
+	addr := tcpip.FullAddress{nicID, localAddr, listenPort}
+
+	l, err := NewListener(s, addr, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("NewListener failed: %v", err)
+	}
+	defer l.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer c.Close()
+		_, err = io.Copy(c, c)
+		done <- err
+	}()
+
+	c, err := DialTCP(s, addr, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("DialTCP failed: %v", err)
+	}
+	defer c.Close()
+
+	if got, want := c.RemoteAddr().String(), "127.0.0.1:8080"; got != want {
+		t.Errorf("RemoteAddr() = %v, want %v", got, want)
+	}
+
+	want := []byte("hello, netstack")
+	if _, err := c.Write(want); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatalf("ReadFull failed: %v", err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("Read %q, want %q", got, want)
+	}
+
+	if err := c.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite failed: %v", err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("Server failed: %v", err)
+	}
+
+	if n, err := c.Read(got); err != io.EOF {
+		t.Fatalf("Read after close = (%v, %v), want (0, EOF)", n, err)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	s := newLoopbackStack(t)
+	addr := tcpip.FullAddress{nicID, localAddr, listenPort}
+
+	l, err := NewListener(s, addr, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("NewListener failed: %v", err)
+	}
+	defer l.Close()
+
+	c, err := DialTCP(s, addr, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("DialTCP failed: %v", err)
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = c.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Read returned %v, want timeout", err)
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	s := newLoopbackStack(t)
+
+	l, err := NewListener(s, tcpip.FullAddress{nicID, localAddr, listenPort}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("NewListener failed: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		done <- err
+	}()
+
+	l.Close()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("Accept succeeded after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Accept didn't return after Close")
+	}
+}
+
+func TestPacketConn(t *testing.T) {
+	s := newLoopbackStack(t)
+
+	server, err := NewPacketConn(s, tcpip.FullAddress{nicID, localAddr, listenPort}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("NewPacketConn failed: %v", err)
+	}
+	defer server.Close()
+
+	client, err := NewPacketConn(s, tcpip.FullAddress{nicID, localAddr, listenPort + 1}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("NewPacketConn failed: %v", err)
+	}
+	defer client.Close()
+
+	if got, want := server.LocalAddr().String(), "127.0.0.1:8080"; got != want {
+		t.Errorf("LocalAddr() = %v, want %v", got, want)
+	}
+
+	want := "query"
+	if _, err := client.WriteTo([]byte(want), server.LocalAddr()); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+
+	b := make([]byte, 100)
+	n, from, err := server.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if got := string(b[:n]); got != want {
+		t.Errorf("ReadFrom read %q, want %q", got, want)
+	}
+	if got, want := from.String(), "127.0.0.1:8081"; got != want {
+		t.Errorf("ReadFrom address = %v, want %v", got, want)
+	}
+
+	// Truncation is reported along with the full length of the datagram.
+	for _, size := range []int{len(want), len(want) - 2} {
+		if _, err := client.WriteTo([]byte(want), server.LocalAddr()); err != nil {
+			t.Fatalf("WriteTo failed: %v", err)
+		}
+		n, length, truncated, _, err := server.ReadFromTrunc(b[:size])
+		if err != nil {
+			t.Fatalf("ReadFromTrunc failed: %v", err)
+		}
+		if n != size || length != len(want) || truncated != (size < len(want)) {
+			t.Errorf("ReadFromTrunc into %d bytes returned %d, %d, %t, want %d, %d, %t", size, n, length, truncated, size, len(want), size < len(want))
+		}
+		if got := string(b[:n]); got != want[:size] {
+			t.Errorf("ReadFromTrunc read %q, want %q", got, want[:size])
+		}
+	}
+
+	server.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, _, err = server.ReadFrom(b)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("ReadFrom returned %v, want timeout", err)
+	}
+}
+
+func TestDialContextTCPCanceled(t *testing.T) {
+	s := newLoopbackStack(t)
+	addr := tcpip.FullAddress{nicID, localAddr, listenPort}
+
+	l, err := NewListener(s, addr, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("NewListener failed: %v", err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	c, err := DialContextTCP(ctx, s, addr, ipv4.ProtocolNumber)
+	if err == nil {
+		c.Close()
+		t.Fatalf("DialContextTCP succeeded with a canceled context")
+	}
+	if oe, ok := err.(*net.OpError); !ok || oe.Err != context.Canceled {
+		t.Fatalf("DialContextTCP returned %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestDialUDP(t *testing.T) {
+	s := newLoopbackStack(t)
+
+	server, err := NewPacketConn(s, tcpip.FullAddress{nicID, localAddr, listenPort}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("NewPacketConn failed: %v", err)
+	}
+	defer server.Close()
+
+	c, err := DialUDP(s, nil, &tcpip.FullAddress{nicID, localAddr, listenPort}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("DialUDP failed: %v", err)
+	}
+	defer c.Close()
+
+	if got, want := c.RemoteAddr().String(), "127.0.0.1:8080"; got != want {
+		t.Errorf("RemoteAddr() = %v, want %v", got, want)
+	}
+
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	b := make([]byte, 100)
+	n, from, err := server.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if got := string(b[:n]); got != "ping" {
+		t.Fatalf("ReadFrom read %q, want %q", got, "ping")
+	}
+
+	if _, err := server.WriteTo([]byte("pong"), from); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+
+	n, err = c.Read(b)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if got := string(b[:n]); got != "pong" {
+		t.Fatalf("Read read %q, want %q", got, "pong")
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build gopacket
+// +build gopacket
+
+// Package gopacketconv converts between the packets of netstack, i.e., the
+// views of its header and buffer packages, and the layers of gopacket, so that
+// the traffic captured from a stack can be inspected with the decoders of
+// gopacket, and packets crafted with gopacket can be injected in a stack.
+//
+// The package depends on github.com/google/gopacket, which netstack itself
+// doesn't, so it is only built with the gopacket build tag.
+package gopacketconv
+
+import (
+	"errors"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+)
+
+var errUnknownNetworkLayer = errors.New("first layer isn't a known network layer")
+
+// LayerType returns the gopacket layer type of the headers of the given network
+// protocol, or gopacket.LayerTypeZero if gopacket doesn't know it.
+func LayerType(protocol tcpip.NetworkProtocolNumber) gopacket.LayerType {
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		return layers.LayerTypeIPv4
+	case header.IPv6ProtocolNumber:
+		return layers.LayerTypeIPv6
+	case header.VLANProtocolNumber:
+		return layers.LayerTypeDot1Q
+	}
+	return gopacket.LayerTypeZero
+}
+
+// NetworkProtocol returns the network protocol number of the given gopacket
+// network layer, or zero if netstack doesn't have one for it.
+func NetworkProtocol(l gopacket.Layer) tcpip.NetworkProtocolNumber {
+	switch l.(type) {
+	case *layers.IPv4:
+		return header.IPv4ProtocolNumber
+	case *layers.IPv6:
+		return header.IPv6ProtocolNumber
+	case *layers.Dot1Q:
+		return header.VLANProtocolNumber
+	}
+	return 0
+}
+
+// Decode decodes a packet of the given network protocol, starting at its
+// network header, as received or written by link endpoints.
+func Decode(protocol tcpip.NetworkProtocolNumber, v buffer.View, opts gopacket.DecodeOptions) gopacket.Packet {
+	return gopacket.NewPacket(v, LayerType(protocol), opts)
+}
+
+// DecodePacketInfo decodes a packet written to a channel endpoint. The capture
+// information of the packet holds the time it was written at.
+func DecodePacketInfo(p channel.PacketInfo) gopacket.Packet {
+	v := make(buffer.View, 0, len(p.Header)+len(p.Payload))
+	v = append(append(v, p.Header...), p.Payload...)
+
+	pkt := Decode(p.Proto, v, gopacket.NoCopy)
+	md := pkt.Metadata()
+	md.Timestamp = p.Timestamp
+	md.CaptureLength = len(v)
+	md.Length = len(v)
+	return pkt
+}
+
+// Serialize encodes the given layers into a packet that can be injected in a
+// link endpoint, and returns it along with its network protocol, which is that
+// of the first layer. Lengths and checksums are computed: the pseudo-headers of
+// TCP and UDP layers are those of the network layer preceding them, which is
+// set as theirs.
+func Serialize(ls ...gopacket.SerializableLayer) (tcpip.NetworkProtocolNumber, buffer.View, error) {
+	if len(ls) == 0 {
+		return 0, nil, errUnknownNetworkLayer
+	}
+	protocol := NetworkProtocol(ls[0])
+	if protocol == 0 {
+		return 0, nil, errUnknownNetworkLayer
+	}
+
+	var network gopacket.NetworkLayer
+	for _, l := range ls {
+		var err error
+		switch l := l.(type) {
+		case *layers.IPv4:
+			network = l
+		case *layers.IPv6:
+			network = l
+		case *layers.TCP:
+			if network != nil {
+				err = l.SetNetworkLayerForChecksum(network)
+			}
+		case *layers.UDP:
+			if network != nil {
+				err = l.SetNetworkLayerForChecksum(network)
+			}
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ls...); err != nil {
+		return 0, nil, err
+	}
+
+	return protocol, buffer.View(buf.Bytes()), nil
+}
+
+// Inject serializes the given layers, as Serialize does, and injects the
+// resulting packet in ep.
+func Inject(ep *channel.Endpoint, ls ...gopacket.SerializableLayer) error {
+	protocol, v, err := Serialize(ls...)
+	if err != nil {
+		return err
+	}
+	ep.Inject(protocol, v)
+	return nil
+}
+
+// IPv4Layer returns the gopacket layer of an IPv4 header, whose payload is the
+// rest of b.
+func IPv4Layer(b header.IPv4) (*layers.IPv4, error) {
+	var l layers.IPv4
+	if err := l.DecodeFromBytes(b, gopacket.NilDecodeFeedback); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// IPv6Layer returns the gopacket layer of an IPv6 header, whose payload is the
+// rest of b.
+func IPv6Layer(b header.IPv6) (*layers.IPv6, error) {
+	var l layers.IPv6
+	if err := l.DecodeFromBytes(b, gopacket.NilDecodeFeedback); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// TCPLayer returns the gopacket layer of a TCP header, whose payload is the
+// rest of b.
+func TCPLayer(b header.TCP) (*layers.TCP, error) {
+	var l layers.TCP
+	if err := l.DecodeFromBytes(b, gopacket.NilDecodeFeedback); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// UDPLayer returns the gopacket layer of a UDP header, whose payload is the
+// rest of b.
+func UDPLayer(b header.UDP) (*layers.UDP, error) {
+	var l layers.UDP
+	if err := l.DecodeFromBytes(b, gopacket.NilDecodeFeedback); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// ICMPv4Layer returns the gopacket layer of an ICMPv4 header, whose payload is
+// the rest of b.
+func ICMPv4Layer(b header.ICMPv4) (*layers.ICMPv4, error) {
+	var l layers.ICMPv4
+	if err := l.DecodeFromBytes(b, gopacket.NilDecodeFeedback); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
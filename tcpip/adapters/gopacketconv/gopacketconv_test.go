@@ -0,0 +1,165 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build gopacket
+// +build gopacket
+
+package gopacketconv
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/adapters/gonet"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/udp"
+)
+
+const (
+	nicID     = 1
+	stackAddr = tcpip.Address("\x0a\x00\x00\x01")
+	testAddr  = tcpip.Address("\x0a\x00\x00\x02")
+	stackPort = 1234
+	testPort  = 4096
+)
+
+func newStack(t *testing.T) (*stack.Stack, *channel.Endpoint, *gonet.PacketConn) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+	id, linkEP := channel.New(10, 1500)
+	if err := s.CreateNIC(nicID, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddressWithPrefix(nicID, ipv4.ProtocolNumber, tcpip.AddressWithPrefix{stackAddr, 24}); err != nil {
+		t.Fatalf("AddAddressWithPrefix failed: %v", err)
+	}
+
+	c, err := gonet.NewPacketConn(s, tcpip.FullAddress{NIC: nicID, Addr: stackAddr, Port: stackPort}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("NewPacketConn failed: %v", err)
+	}
+
+	return s, linkEP, c
+}
+
+func TestInject(t *testing.T) {
+	_, linkEP, c := newStack(t)
+	defer c.Close()
+
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IP(testAddr),
+		DstIP:    net.IP(stackAddr),
+	}
+	u := &layers.UDP{SrcPort: testPort, DstPort: stackPort}
+	if err := Inject(linkEP, ip, u, gopacket.Payload("hello")); err != nil {
+		t.Fatalf("Inject failed: %v", err)
+	}
+
+	// The packet is only delivered if its lengths and checksums are valid.
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 100)
+	n, from, err := c.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if got := string(buf[:n]); got != "hello" {
+		t.Errorf("got payload %q, want %q", got, "hello")
+	}
+	if want := (&net.UDPAddr{IP: net.IP(testAddr), Port: testPort}); from.String() != want.String() {
+		t.Errorf("got packet from %v, want %v", from, want)
+	}
+}
+
+func TestDecodePacketInfo(t *testing.T) {
+	_, linkEP, c := newStack(t)
+	defer c.Close()
+
+	if _, err := c.WriteTo([]byte("hello"), &net.UDPAddr{IP: net.IP(testAddr), Port: testPort}); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+
+	var p channel.PacketInfo
+	select {
+	case p = <-linkEP.C:
+	case <-time.After(time.Second):
+		t.Fatalf("no packet was written")
+	}
+
+	pkt := DecodePacketInfo(p)
+	if err := pkt.ErrorLayer(); err != nil {
+		t.Fatalf("decoding failed: %v", err.Error())
+	}
+	if got := pkt.Metadata().Timestamp; !got.Equal(p.Timestamp) {
+		t.Errorf("got timestamp %v, want %v", got, p.Timestamp)
+	}
+
+	ip, ok := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		t.Fatalf("packet has no IPv4 layer: %v", pkt)
+	}
+	if !ip.SrcIP.Equal(net.IP(stackAddr)) || !ip.DstIP.Equal(net.IP(testAddr)) {
+		t.Errorf("got packet from %v to %v, want from %v to %v", ip.SrcIP, ip.DstIP, net.IP(stackAddr), net.IP(testAddr))
+	}
+
+	u, ok := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok {
+		t.Fatalf("packet has no UDP layer: %v", pkt)
+	}
+	if u.SrcPort != stackPort || u.DstPort != testPort || string(u.Payload) != "hello" {
+		t.Errorf("got UDP layer %+v, want ports %d and %d and payload %q", u, stackPort, testPort, "hello")
+	}
+}
+
+func TestLayers(t *testing.T) {
+	protocol, v, err := Serialize(
+		&layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    net.IP(testAddr),
+			DstIP:    net.IP(stackAddr),
+		},
+		&layers.UDP{SrcPort: testPort, DstPort: stackPort},
+		gopacket.Payload("hello"),
+	)
+	if err != nil {
+		t.Fatalf("Serialize failed: %v", err)
+	}
+	if protocol != header.IPv4ProtocolNumber {
+		t.Errorf("got network protocol %d, want %d", protocol, header.IPv4ProtocolNumber)
+	}
+
+	h := header.IPv4(v)
+	if !h.IsValid() {
+		t.Fatalf("serialized packet isn't valid")
+	}
+	ip, err := IPv4Layer(h)
+	if err != nil {
+		t.Fatalf("IPv4Layer failed: %v", err)
+	}
+	if ip.TTL != 64 || !ip.SrcIP.Equal(net.IP(testAddr)) || int(ip.Length) != len(v) {
+		t.Errorf("got IPv4 layer %+v", ip)
+	}
+
+	u, err := UDPLayer(header.UDP(h.Payload()))
+	if err != nil {
+		t.Fatalf("UDPLayer failed: %v", err)
+	}
+	if u.SrcPort != testPort || u.DstPort != stackPort || string(u.Payload) != "hello" {
+		t.Errorf("got UDP layer %+v", u)
+	}
+
+	if _, _, err := Serialize(gopacket.Payload("hello")); err != errUnknownNetworkLayer {
+		t.Errorf("Serialize without a network layer returned %v, want %v", err, errUnknownNetworkLayer)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcpip
+
+import (
+	"context"
+
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/waiter"
+)
+
+// BlockingEndpoint wraps an endpoint along with its waiter queue, and provides
+// blocking variants of its non-blocking methods: instead of returning
+// ErrWouldBlock, they wait for the endpoint to become ready, until their
+// context is done, in which case they return the error of the context.
+//
+// The methods of the wrapped endpoint remain available, and can be used
+// concurrently with the blocking ones.
+type BlockingEndpoint struct {
+	Endpoint
+
+	// Queue is the waiter queue the endpoint notifies.
+	Queue *waiter.Queue
+}
+
+// NewBlockingEndpoint returns a blocking wrapper around ep, which notifies wq.
+func NewBlockingEndpoint(ep Endpoint, wq *waiter.Queue) *BlockingEndpoint {
+	return &BlockingEndpoint{Endpoint: ep, Queue: wq}
+}
+
+// ReadContext reads data from the endpoint, waiting for it to be available,
+// and optionally returns the sender.
+func (b *BlockingEndpoint) ReadContext(ctx context.Context, addr *FullAddress) (buffer.View, error) {
+	var v buffer.View
+	var err error
+	if cerr := b.Queue.WaitFor(ctx, waiter.EventIn, func() bool {
+		v, err = b.Read(addr)
+		return err != ErrWouldBlock
+	}); cerr != nil {
+		return nil, cerr
+	}
+
+	return v, err
+}
+
+// WriteContext writes all of v to the endpoint's peer, or to the provided
+// address if one is specified, waiting for room in the send buffer as needed.
+// It returns the number of bytes written, which is less than len(v) only if
+// an error is returned.
+func (b *BlockingEndpoint) WriteContext(ctx context.Context, v buffer.View, to *FullAddress) (uintptr, error) {
+	var total uintptr
+	var err error
+	if cerr := b.Queue.WaitFor(ctx, waiter.EventOut, func() bool {
+		for len(v) > 0 {
+			var n uintptr
+			n, err = b.Write(v, to)
+			if err != nil {
+				return err != ErrWouldBlock
+			}
+			total += n
+			v.TrimFront(int(n))
+		}
+		return true
+	}); cerr != nil {
+		return total, cerr
+	}
+
+	return total, err
+}
+
+// AcceptContext waits for a peer to establish a connection with the endpoint,
+// which must be listening, and returns a blocking wrapper around the new
+// endpoint.
+func (b *BlockingEndpoint) AcceptContext(ctx context.Context) (*BlockingEndpoint, error) {
+	var n Endpoint
+	var wq *waiter.Queue
+	var err error
+	if cerr := b.Queue.WaitFor(ctx, waiter.EventIn, func() bool {
+		n, wq, err = b.Accept()
+		return err != ErrWouldBlock
+	}); cerr != nil {
+		return nil, cerr
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewBlockingEndpoint(n, wq), nil
+}
+
+// ConnectContext connects the endpoint to its peer, waiting for the connection
+// to be established. If ctx is done first, the connection attempt goes on;
+// closing the endpoint aborts it.
+func (b *BlockingEndpoint) ConnectContext(ctx context.Context, addr FullAddress) error {
+	var e waiter.ChannelEntry
+	e.Register(b.Queue, waiter.EventOut)
+	defer e.Unregister(b.Queue)
+
+	err := b.Connect(addr)
+	if err != ErrConnectStarted {
+		return err
+	}
+
+	if err := e.Wait(ctx); err != nil {
+		return err
+	}
+
+	return b.GetSockOpt(ErrorOption{})
+}
@@ -0,0 +1,104 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcpip_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/link/loopback"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	nicID      = 1
+	localAddr  = tcpip.Address("\x7f\x00\x00\x01")
+	listenPort = 8080
+)
+
+func newEndpoint(t *testing.T, s tcpip.Stack) *tcpip.BlockingEndpoint {
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	return tcpip.NewBlockingEndpoint(ep, &wq)
+}
+
+func TestBlockingEndpoint(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName})
+	if err := s.CreateNIC(nicID, loopback.New()); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(nicID, ipv4.ProtocolNumber, localAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         nicID,
+	}})
+
+	l := newEndpoint(t, s)
+	defer l.Close()
+	addr := tcpip.FullAddress{nicID, localAddr, listenPort}
+	if err := l.Bind(addr, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := l.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	accepted := make(chan *tcpip.BlockingEndpoint, 1)
+	go func() {
+		n, err := l.AcceptContext(ctx)
+		if err != nil {
+			t.Errorf("AcceptContext failed: %v", err)
+		}
+		accepted <- n
+	}()
+
+	c := newEndpoint(t, s)
+	defer c.Close()
+	if err := c.ConnectContext(ctx, addr); err != nil {
+		t.Fatalf("ConnectContext failed: %v", err)
+	}
+
+	n := <-accepted
+	if n == nil {
+		t.FailNow()
+	}
+	defer n.Close()
+
+	// Nothing was written yet, so reads block until ctx is done.
+	short, shortCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer shortCancel()
+	if _, err := n.ReadContext(short, nil); err != context.DeadlineExceeded {
+		t.Fatalf("ReadContext returned %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	want := buffer.View("hello")
+	if m, err := c.WriteContext(ctx, append(buffer.View(nil), want...), nil); err != nil || m != uintptr(len(want)) {
+		t.Fatalf("WriteContext returned %d, %v, want %d, nil", m, err, len(want))
+	}
+
+	got, err := n.ReadContext(ctx, nil)
+	if err != nil {
+		t.Fatalf("ReadContext failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("ReadContext returned %q, want %q", got, want)
+	}
+}
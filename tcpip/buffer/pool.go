@@ -0,0 +1,77 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package buffer
+
+import (
+	"sync"
+)
+
+// sizeClass is a size class of pooled buffers. The pool holds pointers to
+// arrays of the size of the class, rather than views, since putting a pointer
+// in a sync.Pool doesn't allocate, while putting a slice does.
+type sizeClass struct {
+	size int
+	pool sync.Pool
+
+	// toArray returns a pointer to the array backing a view of the size
+	// of the class, and fromArray returns a view of all of such an array.
+	toArray   func(v View) interface{}
+	fromArray func(a interface{}) View
+}
+
+// sizeClasses are the size classes of pooled buffers, in increasing size.
+// Larger buffers aren't pooled.
+var sizeClasses = [...]*sizeClass{
+	{size: 128, toArray: func(v View) interface{} { return (*[128]byte)(v) }, fromArray: func(a interface{}) View { return a.(*[128]byte)[:] }},
+	{size: 256, toArray: func(v View) interface{} { return (*[256]byte)(v) }, fromArray: func(a interface{}) View { return a.(*[256]byte)[:] }},
+	{size: 512, toArray: func(v View) interface{} { return (*[512]byte)(v) }, fromArray: func(a interface{}) View { return a.(*[512]byte)[:] }},
+	{size: 1024, toArray: func(v View) interface{} { return (*[1024]byte)(v) }, fromArray: func(a interface{}) View { return a.(*[1024]byte)[:] }},
+	{size: 2048, toArray: func(v View) interface{} { return (*[2048]byte)(v) }, fromArray: func(a interface{}) View { return a.(*[2048]byte)[:] }},
+	{size: 4096, toArray: func(v View) interface{} { return (*[4096]byte)(v) }, fromArray: func(a interface{}) View { return a.(*[4096]byte)[:] }},
+	{size: 8192, toArray: func(v View) interface{} { return (*[8192]byte)(v) }, fromArray: func(a interface{}) View { return a.(*[8192]byte)[:] }},
+	{size: 16384, toArray: func(v View) interface{} { return (*[16384]byte)(v) }, fromArray: func(a interface{}) View { return a.(*[16384]byte)[:] }},
+	{size: 32768, toArray: func(v View) interface{} { return (*[32768]byte)(v) }, fromArray: func(a interface{}) View { return a.(*[32768]byte)[:] }},
+	{size: 65536, toArray: func(v View) interface{} { return (*[65536]byte)(v) }, fromArray: func(a interface{}) View { return a.(*[65536]byte)[:] }},
+}
+
+// findSizeClass returns the smallest size class that can hold size bytes, or
+// nil if there is none.
+func findSizeClass(size int) *sizeClass {
+	for _, c := range sizeClasses {
+		if size <= c.size {
+			return c
+		}
+	}
+	return nil
+}
+
+// NewPooledView returns a view of the given size, backed by a buffer of the
+// smallest size class that holds it, which is taken from a pool if one is
+// free. Unlike NewView, the contents of the view aren't zeroed.
+//
+// The buffer can be returned to its pool with ReleaseView once the view isn't
+// referenced anymore; if it isn't, it's simply garbage collected.
+func NewPooledView(size int) View {
+	c := findSizeClass(size)
+	if c == nil {
+		return NewView(size)
+	}
+
+	if a := c.pool.Get(); a != nil {
+		return c.fromArray(a)[:size]
+	}
+	return make(View, size, c.size)
+}
+
+// ReleaseView returns the buffer backing v to the pool of its size class. Neither
+// v nor any other view of the same buffer may be used afterwards. Views whose
+// capacity isn't that of a size class, e.g., trimmed views, aren't pooled.
+func ReleaseView(v View) {
+	c := findSizeClass(cap(v))
+	if c == nil || c.size != cap(v) {
+		return
+	}
+	c.pool.Put(c.toArray(v[:c.size]))
+}
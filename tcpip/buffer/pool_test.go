@@ -0,0 +1,69 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package buffer
+
+import (
+	"testing"
+)
+
+func TestPooledView(t *testing.T) {
+	for _, c := range []struct {
+		size    int
+		wantCap int
+	}{
+		{0, 128},
+		{100, 128},
+		{128, 128},
+		{1500, 2048},
+		{65536, 65536},
+		{65537, 65537},
+	} {
+		v := NewPooledView(c.size)
+		if len(v) != c.size || cap(v) != c.wantCap {
+			t.Errorf("NewPooledView(%d) returned a view of length %d and capacity %d, want %d and %d", c.size, len(v), cap(v), c.size, c.wantCap)
+		}
+		ReleaseView(v)
+	}
+}
+
+func TestPooledPrependable(t *testing.T) {
+	// Dirty pooled buffers, which are zeroed when reused by prependable
+	// buffers.
+	for i := 0; i < 10; i++ {
+		v := NewPooledView(64)
+		for j := range v {
+			v[j] = 0xff
+		}
+		ReleaseView(v)
+	}
+
+	p := NewPooledPrependable(64)
+	b := p.Prepend(20)
+	for i, c := range b {
+		if c != 0 {
+			t.Fatalf("byte %d of prepended space is %#x, want 0", i, c)
+		}
+	}
+	if got := p.UsedLength(); got != 20 {
+		t.Errorf("UsedLength() = %d, want 20", got)
+	}
+
+	p.Release()
+	if got := p.UsedLength(); got != 0 {
+		t.Errorf("UsedLength() = %d after Release, want 0", got)
+	}
+}
+
+func TestPooledViewAllocs(t *testing.T) {
+	// Fill the pool, so that the views below are taken from it.
+	ReleaseView(NewPooledView(1500))
+
+	allocs := testing.AllocsPerRun(100, func() {
+		ReleaseView(NewPooledView(1500))
+	})
+	if allocs != 0 {
+		t.Errorf("Got %v allocations to take a view from the pool and release it, want 0", allocs)
+	}
+}
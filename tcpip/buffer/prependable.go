@@ -15,6 +15,10 @@ type Prependable struct {
 
 	// usedIdx is the index where the used part of the buffer begins.
 	usedIdx int
+
+	// pooled indicates whether buf was taken from the pools of
+	// NewPooledView.
+	pooled bool
 }
 
 // NewPrependable allocates a new prependable buffer with the given size.
@@ -22,6 +26,31 @@ func NewPrependable(size int) Prependable {
 	return Prependable{buf: NewView(size), usedIdx: size}
 }
 
+// NewPooledPrependable returns a new prependable buffer with the given size,
+// whose backing buffer is taken from the pools of NewPooledView. It's meant for
+// the headers of outbound packets, and should be released with Release once
+// the packet has been written.
+func NewPooledPrependable(size int) Prependable {
+	v := NewPooledView(size)
+	for i := range v {
+		v[i] = 0
+	}
+	return Prependable{buf: v, usedIdx: size, pooled: true}
+}
+
+// Release empties the prependable buffer, returning its backing buffer to its
+// pool if it was allocated with NewPooledPrependable. Views of the buffer, such
+// as the ones returned by View and UsedBytes, must not be used afterwards.
+//
+// Link endpoints may not retain the header buffer of a packet once WritePacket
+// returns, so its writer can release it then.
+func (p *Prependable) Release() {
+	if p.pooled {
+		ReleaseView(p.buf)
+	}
+	*p = Prependable{}
+}
+
 // Prepend reserves the requested space in front of the buffer, returning a
 // slice that represents the reserved space.
 func (p *Prependable) Prepend(size int) []byte {
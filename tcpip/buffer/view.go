@@ -5,6 +5,10 @@
 // Package buffer provides the implementation of a buffer view.
 package buffer
 
+import (
+	"sync/atomic"
+)
+
 // View is a slice of a buffer, with convenience methods.
 type View []byte
 
@@ -30,17 +34,34 @@ func (v *View) CapLength(length int) {
 	*v = (*v)[:length:length]
 }
 
+// ToVectorisedView returns a vectorised view holding v only.
+func (v View) ToVectorisedView() VectorisedView {
+	if len(v) == 0 {
+		return VectorisedView{}
+	}
+	return NewVectorisedView(len(v), []View{v})
+}
+
 // VectorisedView is a vectorised version of View using non contigous memory.
 // It supports all the convenience methods supported by View.
+//
+// Packets are made of vectorised views so that their pieces, e.g., a buffer
+// read from a file descriptor and the headers prepended to it, never need to be
+// copied into a single view as they move through the stack. Copies of a
+// vectorised view share its views, so only one of them may be trimmed.
 type VectorisedView struct {
 	views []View
 	size  int
+
+	// refs, if not nil, is the number of vectorised views sharing the bytes
+	// of views, which are then read-only. See Clone.
+	refs *int32
 }
 
 // NewVectorisedView creates a new vectorised view from an already-allocated slice
 // of View and sets its size.
-func NewVectorisedView(size int, views []View) *VectorisedView {
-	return &VectorisedView{views: views, size: size}
+func NewVectorisedView(size int, views []View) VectorisedView {
+	return VectorisedView{views: views, size: size}
 }
 
 // TrimFront removes the first "count" bytes of the vectorised view.
@@ -103,6 +124,82 @@ func (vv *VectorisedView) Size() int {
 	return vv.size
 }
 
+// Views returns the views of the vectorised view, which must not be modified.
+func (vv *VectorisedView) Views() []View {
+	return vv.views
+}
+
+// ToView returns the contents of the vectorised view as a single view. The view
+// is the only one of the vectorised view if it has one, and a copy of its
+// views otherwise.
+func (vv *VectorisedView) ToView() View {
+	switch len(vv.views) {
+	case 0:
+		return nil
+	case 1:
+		return vv.views[0]
+	}
+
+	v := make(View, 0, vv.size)
+	for _, u := range vv.views {
+		v = append(v, u...)
+	}
+	return v
+}
+
+// Clone returns a vectorised view of the same contents as vv, which shares
+// their bytes but can be trimmed independently of vv. It lets a packet be handed
+// to several consumers without copying it for each of them.
+//
+// The bytes are reference counted: while they're shared, they must not be
+// modified. Consumers that are done with their vectorised view call Release,
+// and the ones that keep its contents get them with ToOwnedView, which copies
+// them only if other consumers still reference them.
+func (vv *VectorisedView) Clone() VectorisedView {
+	if vv.refs == nil {
+		vv.refs = new(int32)
+		*vv.refs = 1
+	}
+	atomic.AddInt32(vv.refs, 1)
+
+	views := make([]View, len(vv.views))
+	copy(views, vv.views)
+	return VectorisedView{views: views, size: vv.size, refs: vv.refs}
+}
+
+// Shared returns whether the bytes of the vectorised view are referenced by
+// other vectorised views, i.e., clones of it which haven't been released.
+func (vv *VectorisedView) Shared() bool {
+	return vv.refs != nil && atomic.LoadInt32(vv.refs) > 1
+}
+
+// Release releases the reference of the vectorised view to its bytes, and
+// empties it.
+func (vv *VectorisedView) Release() {
+	if vv.refs != nil {
+		atomic.AddInt32(vv.refs, -1)
+	}
+	*vv = VectorisedView{}
+}
+
+// ToOwnedView returns the contents of the vectorised view as a single view that
+// the caller may modify, and releases the vectorised view. The view is a copy
+// of the contents if they're still shared with other vectorised views, and the
+// same as returned by ToView otherwise.
+func (vv *VectorisedView) ToOwnedView() View {
+	var v View
+	if vv.refs != nil && atomic.AddInt32(vv.refs, -1) != 0 {
+		v = make(View, 0, vv.size)
+		for _, u := range vv.views {
+			v = append(v, u...)
+		}
+	} else {
+		v = vv.ToView()
+	}
+	*vv = VectorisedView{}
+	return v
+}
+
 // copy returns a deep-copy of the vectorised view.
 // It is an expensive method that should be used only in tests.
 func (vv *VectorisedView) copy() *VectorisedView {
@@ -17,7 +17,8 @@ func vv(size int, pieces ...string) *VectorisedView {
 		views[i] = []byte(p)
 	}
 
-	return NewVectorisedView(size, views)
+	v := NewVectorisedView(size, views)
+	return &v
 }
 
 var capLengthTestCases = []struct {
@@ -135,3 +136,54 @@ func TestTrimFront(t *testing.T) {
 		}
 	}
 }
+
+func TestToView(t *testing.T) {
+	for _, c := range []struct {
+		comment string
+		in      *VectorisedView
+		want    View
+	}{
+		{"Empty", vv(0), nil},
+		{"Single view", vv(2, "12"), View("12")},
+		{"Several views", vv(4, "12", "3", "4"), View("1234")},
+	} {
+		if got := c.in.ToView(); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Test \"%s\" failed: ToView() = %v, want %v", c.comment, got, c.want)
+		}
+	}
+
+	// Single views are returned without being copied.
+	v := View("12")
+	vv := v.ToVectorisedView()
+	if got := vv.ToView(); &got[0] != &v[0] {
+		t.Errorf("ToView copied the only view of the vectorised view")
+	}
+}
+
+func TestClone(t *testing.T) {
+	v := View("1234")
+	orig := v.ToVectorisedView()
+	clone := orig.Clone()
+
+	// Clones are trimmed independently.
+	clone.TrimFront(2)
+	if got := orig.ToView(); string(got) != "1234" {
+		t.Errorf("trimming a clone changed the original to %q", got)
+	}
+	if !orig.Shared() || !clone.Shared() {
+		t.Errorf("clones aren't shared")
+	}
+
+	// Owned views are copies while the bytes are still shared, and the
+	// bytes themselves once they aren't anymore.
+	owned := clone.ToOwnedView()
+	if string(owned) != "34" || &owned[0] == &v[2] {
+		t.Errorf("ToOwnedView() = %q of shared bytes, want a copy of %q", owned, "34")
+	}
+	if orig.Shared() {
+		t.Errorf("bytes still shared after the clone was released")
+	}
+	if owned := orig.ToOwnedView(); &owned[0] != &v[0] {
+		t.Errorf("ToOwnedView copied bytes that weren't shared")
+	}
+}
@@ -117,6 +117,22 @@ func TOS(tos uint8, label uint32) NetworkChecker {
 	}
 }
 
+// TTL creates a checker that checks the TTL (ipv4) or hop limit (ipv6) field.
+func TTL(ttl uint8) NetworkChecker {
+	return func(t *testing.T, h header.Network) {
+		var v uint8
+		switch ip := h.(type) {
+		case header.IPv4:
+			v = ip.TTL()
+		case header.IPv6:
+			v = ip.HopLimit()
+		}
+		if v != ttl {
+			t.Fatalf("Bad TTL, got %v, want %v", v, ttl)
+		}
+	}
+}
+
 // TCP creates a checker that checks that the transport protocol is TCP and
 // potentially additional transport header fields.
 func TCP(checkers ...TransportChecker) NetworkChecker {
@@ -249,3 +265,45 @@ func TCPFlagsMatch(flags, mask uint8) TransportChecker {
 		}
 	}
 }
+
+// TCPMSS creates a checker that checks the maximum segment size option of the
+// tcp segment.
+func TCPMSS(mss uint16) TransportChecker {
+	return func(t *testing.T, h header.Transport) {
+		tcp, ok := h.(header.TCP)
+		if !ok {
+			return
+		}
+
+		m, ok := header.ParseMSSOption(tcp.Options())
+		if !ok {
+			t.Fatalf("Missing MSS option")
+		}
+
+		if m != mss {
+			t.Fatalf("Bad MSS option, got %v, want %v", m, mss)
+		}
+	}
+}
+
+// TCPOption creates a checker that checks that the tcp segment carries an
+// option of the given kind, with the given data.
+func TCPOption(kind uint8, data []byte) TransportChecker {
+	return func(t *testing.T, h header.Transport) {
+		tcp, ok := h.(header.TCP)
+		if !ok {
+			return
+		}
+
+		found := false
+		header.ForEachTCPOption(tcp.Options(), func(k uint8, d []byte) {
+			if k == kind && string(d) == string(data) {
+				found = true
+			}
+		})
+
+		if !found {
+			t.Fatalf("Missing option of kind %v with data %v in %v", kind, data, tcp.Options())
+		}
+	}
+}
@@ -0,0 +1,534 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dhcpv6 implements a DHCPv6 client, per RFC 8415, which configures
+// the NICs of a netstack stack. It complements stateless address
+// autoconfiguration on links whose routers ask hosts to use DHCPv6.
+//
+// In stateful mode, the client leases an address from a server, adds it to the
+// NIC with the lease's valid lifetime, and renews the lease before it expires.
+// In stateless mode, it only requests other configuration, such as the DNS
+// servers of the link.
+package dhcpv6
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/adapters/gonet"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+const (
+	// ClientPort and ServerPort are the UDP ports of DHCPv6 clients and
+	// servers.
+	ClientPort = 546
+	ServerPort = 547
+
+	// AllServersAddress is the All_DHCP_Relay_Agents_and_Servers multicast
+	// address, ff02::1:2, which clients send their messages to.
+	AllServersAddress tcpip.Address = "\xff\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x02"
+
+	// DefaultInformationRefresh is how long the information obtained in
+	// stateless mode is valid for when the server doesn't say, per RFC
+	// 8415, section 21.23.
+	DefaultInformationRefresh = 24 * time.Hour
+
+	// initialTimeout and maxTimeout bound the time waited for a reply to
+	// a message before it is retransmitted, which doubles with each
+	// retransmission.
+	initialTimeout = time.Second
+	maxTimeout     = 2 * time.Minute
+
+	// retryDelay is the time Run waits before trying to acquire a lease
+	// again after failing to.
+	retryDelay = 10 * time.Second
+
+	// maxMessageSize is the size of the largest message accepted.
+	maxMessageSize = 1500
+
+	// duidUUID is the type of the DUIDs generated for clients without one,
+	// per RFC 6355.
+	duidUUID = 4
+)
+
+var (
+	errNoAddress = errors.New("no address leased")
+	errNoLease   = errors.New("no lease to renew or release")
+)
+
+// Config is the configuration of a Client.
+type Config struct {
+	// NIC is the NIC the client configures.
+	NIC tcpip.NICID
+
+	// DUID is the DHCP unique identifier of the client, which servers
+	// identify it with. If it is nil, a random one is generated, which
+	// should be saved and reused by clients that restart.
+	DUID []byte
+
+	// IAID is the identifier of the identity association the client leases
+	// its address for, which must be unique among the NICs of the client.
+	IAID uint32
+}
+
+// Lease is an address leased from a server, along with the configuration
+// received with it.
+type Lease struct {
+	// Addr is the leased address.
+	Addr tcpip.Address
+
+	// PreferredLifetime and ValidLifetime are the lifetimes of the
+	// address, or zero if they are infinite. The address is removed from
+	// the NIC once its valid lifetime expires.
+	PreferredLifetime time.Duration
+	ValidLifetime     time.Duration
+
+	// T1 and T2 are the times after which the lease is renewed with its
+	// server, and rebound with any server, or zero if it never needs to be.
+	T1 time.Duration
+	T2 time.Duration
+
+	// DNSServers are the DNS servers of the link.
+	DNSServers []tcpip.Address
+
+	// serverID is the DUID of the server of the lease.
+	serverID []byte
+}
+
+// Information is the configuration obtained in stateless mode.
+type Information struct {
+	// DNSServers are the DNS servers of the link.
+	DNSServers []tcpip.Address
+
+	// Refresh is how long the information is valid for.
+	Refresh time.Duration
+}
+
+// Client is a DHCPv6 client configuring a NIC. It is safe for concurrent use.
+type Client struct {
+	stack *stack.Stack
+	nic   tcpip.NICID
+	duid  []byte
+	iaid  uint32
+
+	mu    sync.Mutex
+	lease *Lease
+}
+
+// NewClient creates a client configuring the given NIC of s.
+func NewClient(s *stack.Stack, cfg Config) (*Client, error) {
+	duid := cfg.DUID
+	if duid == nil {
+		duid = make([]byte, 2+16)
+		binary.BigEndian.PutUint16(duid, duidUUID)
+		if _, err := rand.Read(duid[2:]); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Client{
+		stack: s,
+		nic:   cfg.NIC,
+		duid:  append([]byte(nil), duid...),
+		iaid:  cfg.IAID,
+	}, nil
+}
+
+// DUID returns the DHCP unique identifier of the client.
+func (c *Client) DUID() []byte {
+	return append([]byte(nil), c.duid...)
+}
+
+// Lease returns the current lease of the client, if any.
+func (c *Client) Lease() (Lease, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.lease == nil {
+		return Lease{}, false
+	}
+	return *c.lease, true
+}
+
+// Acquire leases an address from a server, by soliciting the servers of the
+// link and requesting the address offered by the first one to answer, and adds
+// it to the NIC. It blocks until the lease is acquired or ctx is done.
+func (c *Client) Acquire(ctx context.Context) (Lease, error) {
+	adv, err := c.exchange(ctx, msgSolicit, nil, c.requestOptions(nil), func(m *message) bool {
+		return m.typ == msgAdvertise && m.options.status() == statusSuccess && c.leaseOf(m) != nil
+	})
+	if err != nil {
+		return Lease{}, err
+	}
+
+	// Request the address the server offered.
+	offer := c.leaseOf(adv)
+	reply, err := c.exchange(ctx, msgRequest, offer.serverID, c.requestOptions(offer), isReply)
+	if err != nil {
+		return Lease{}, err
+	}
+
+	return c.bind(reply)
+}
+
+// Renew extends the current lease with its server, or with any server if
+// rebind is set, e.g., because the server didn't answer until T2.
+func (c *Client) Renew(ctx context.Context, rebind bool) (Lease, error) {
+	cur, ok := c.Lease()
+	if !ok {
+		return Lease{}, errNoLease
+	}
+
+	typ, serverID := msgRenew, cur.serverID
+	if rebind {
+		typ, serverID = msgRebind, nil
+	}
+	reply, err := c.exchange(ctx, typ, serverID, c.requestOptions(&cur), isReply)
+	if err != nil {
+		return Lease{}, err
+	}
+
+	return c.bind(reply)
+}
+
+// Release returns the current lease to its server, and removes its address from
+// the NIC, even if the server doesn't answer before ctx is done.
+func (c *Client) Release(ctx context.Context) error {
+	c.mu.Lock()
+	cur := c.lease
+	c.lease = nil
+	c.mu.Unlock()
+
+	if cur == nil {
+		return errNoLease
+	}
+	c.stack.RemoveAddress(c.nic, cur.Addr)
+
+	_, err := c.exchange(ctx, msgRelease, cur.serverID, c.iaOptions(cur), isReply)
+	return err
+}
+
+// Information requests the configuration of the link from the servers, without
+// leasing an address, and returns the first reply.
+func (c *Client) Information(ctx context.Context) (Information, error) {
+	reply, err := c.exchange(ctx, msgInformationRequest, nil, options{requestOption(optDNSServers, optInformationRefreshTime)}, isReply)
+	if err != nil {
+		return Information{}, err
+	}
+
+	info := Information{
+		DNSServers: dnsServers(reply),
+		Refresh:    DefaultInformationRefresh,
+	}
+	if b, ok := reply.options.get(optInformationRefreshTime); ok && len(b) >= 4 {
+		if v := binary.BigEndian.Uint32(b); v != infinity {
+			info.Refresh = time.Duration(v) * time.Second
+		}
+	}
+
+	return info, nil
+}
+
+// Run acquires a lease and keeps it until ctx is done: it is renewed with its
+// server at T1, rebound with any server at T2, and acquired again if it can't
+// be extended. The lease is released once ctx is done. onLease, if not nil, is
+// called with every lease acquired or extended.
+func (c *Client) Run(ctx context.Context, onLease func(Lease)) {
+	for ctx.Err() == nil {
+		lease, err := c.Acquire(ctx)
+		if err != nil {
+			sleep(ctx, c.stack.Clock(), retryDelay)
+			continue
+		}
+
+		for err == nil {
+			if onLease != nil {
+				onLease(lease)
+			}
+			lease, err = c.keep(ctx, lease)
+		}
+	}
+
+	releaseCtx, cancel := context.WithTimeout(context.Background(), initialTimeout)
+	c.Release(releaseCtx)
+	cancel()
+}
+
+// keep waits until T1 and extends the given lease, renewing it with its server
+// until T2, and then rebinding it with any server until it expires. It returns
+// an error if the lease can't be extended, or ctx is done first.
+func (c *Client) keep(ctx context.Context, lease Lease) (Lease, error) {
+	clock := c.stack.Clock()
+	start := clock.Now()
+	if lease.T1 == 0 {
+		// The lease never needs to be extended.
+		<-ctx.Done()
+		return Lease{}, ctx.Err()
+	}
+	if !sleep(ctx, clock, lease.T1) {
+		return Lease{}, ctx.Err()
+	}
+
+	var t2, expiry time.Time
+	if lease.T2 != 0 {
+		t2 = start.Add(lease.T2)
+	}
+	if lease.ValidLifetime != 0 {
+		expiry = start.Add(lease.ValidLifetime)
+	}
+
+	renewCtx, cancel := withClockDeadline(ctx, clock, t2)
+	next, err := c.Renew(renewCtx, false)
+	cancel()
+	if err == nil || ctx.Err() != nil {
+		return next, err
+	}
+
+	rebindCtx, cancel := withClockDeadline(ctx, clock, expiry)
+	defer cancel()
+	return c.Renew(rebindCtx, true)
+}
+
+// iaOptions returns the options holding the identity association of the
+// client, with the address of the given lease, or no address if it is nil.
+func (c *Client) iaOptions(lease *Lease) options {
+	ia := iana{iaid: c.iaid}
+	if lease != nil {
+		ia.addrs = []iaAddr{{addr: lease.Addr}}
+	}
+	return options{{optIANA, ia.marshal()}}
+}
+
+// requestOptions returns the options of the messages requesting the address of
+// the given lease, or any address if it is nil, along with the DNS servers.
+func (c *Client) requestOptions(lease *Lease) options {
+	return append(c.iaOptions(lease), requestOption(optDNSServers))
+}
+
+// leaseOf returns the lease of the address assigned to the client in m, or nil
+// if there is none.
+func (c *Client) leaseOf(m *message) *Lease {
+	serverID, ok := m.options.get(optServerID)
+	if !ok {
+		return nil
+	}
+
+	for _, opt := range m.options {
+		if opt.code != optIANA {
+			continue
+		}
+		ia, err := parseIANA(opt.data)
+		if err != nil || ia.iaid != c.iaid || ia.options.status() != statusSuccess {
+			continue
+		}
+		for _, a := range ia.addrs {
+			if a.valid == 0 {
+				continue
+			}
+
+			l := &Lease{
+				Addr:              a.addr,
+				PreferredLifetime: seconds(a.preferred),
+				ValidLifetime:     seconds(a.valid),
+				T1:                seconds(ia.t1),
+				T2:                seconds(ia.t2),
+				DNSServers:        dnsServers(m),
+				serverID:          append([]byte(nil), serverID...),
+			}
+
+			// Servers leave T1 and T2 to the client by setting them
+			// to zero; RFC 8415, section 21.4 recommends 0.5 and
+			// 0.8 times the preferred lifetime.
+			if ia.t1 == 0 {
+				l.T1 = l.PreferredLifetime / 2
+			}
+			if ia.t2 == 0 {
+				l.T2 = l.PreferredLifetime * 4 / 5
+			}
+			return l
+		}
+	}
+
+	return nil
+}
+
+// bind applies the lease in the reply of a server: its address is added to the
+// NIC, replacing the address of the previous lease, with its valid lifetime.
+func (c *Client) bind(reply *message) (Lease, error) {
+	if reply.options.status() != statusSuccess {
+		return Lease{}, errNoAddress
+	}
+	l := c.leaseOf(reply)
+	if l == nil {
+		return Lease{}, errNoAddress
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.stack.AddAddress(c.nic, header.IPv6ProtocolNumber, l.Addr); err != nil && err != tcpip.ErrDuplicateAddress {
+		return Lease{}, err
+	}
+	if err := c.stack.SetAddressLifetime(c.nic, l.Addr, l.ValidLifetime); err != nil {
+		return Lease{}, err
+	}
+
+	if c.lease != nil && c.lease.Addr != l.Addr {
+		c.stack.RemoveAddress(c.nic, c.lease.Addr)
+	}
+	c.lease = l
+
+	return *l, nil
+}
+
+// exchange sends a message of the given type to the servers of the link, and
+// retransmits it with exponential backoff until a reply accepted by accept is
+// received, or ctx is done. The message identifies the client, and the server
+// if serverID isn't nil.
+func (c *Client) exchange(ctx context.Context, typ messageType, serverID []byte, opts options, accept func(*message) bool) (*message, error) {
+	txID, err := newTransactionID()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := gonet.NewPacketConn(c.stack, tcpip.FullAddress{NIC: c.nic, Port: ClientPort}, header.IPv6ProtocolNumber)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Closing the connection makes the pending read or write fail once
+	// ctx is done.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	clock := c.stack.Clock()
+	start := clock.Now()
+	to := &net.UDPAddr{IP: net.IP(AllServersAddress), Port: ServerPort}
+	buf := make([]byte, maxMessageSize)
+	for timeout := initialTimeout; ; timeout *= 2 {
+		if timeout > maxTimeout {
+			timeout = maxTimeout
+		}
+
+		m := message{typ: typ, txID: txID, options: c.messageOptions(clock.Now().Sub(start), serverID, opts)}
+		if _, err := conn.WriteTo(m.pack(), to); err != nil {
+			return nil, contextError(ctx, err)
+		}
+
+		conn.SetReadDeadline(clock.Now().Add(timeout))
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			if err != nil {
+				return nil, contextError(ctx, err)
+			}
+
+			// Ignore the replies to other transactions and clients.
+			var reply message
+			if err := reply.unpack(append([]byte(nil), buf[:n]...)); err != nil || reply.txID != txID {
+				continue
+			}
+			if id, ok := reply.options.get(optClientID); !ok || string(id) != string(c.duid) {
+				continue
+			}
+			if accept(&reply) {
+				return &reply, nil
+			}
+		}
+	}
+}
+
+// messageOptions returns the options of a message sent by the client, given the
+// time elapsed since the first transmission of the message.
+func (c *Client) messageOptions(elapsed time.Duration, serverID []byte, opts options) options {
+	// The elapsed time is expressed in hundredths of a second.
+	cs := elapsed / (10 * time.Millisecond)
+	if cs > 0xffff {
+		cs = 0xffff
+	}
+
+	o := options{
+		{optClientID, c.duid},
+		uint16Option(optElapsedTime, uint16(cs)),
+	}
+	if serverID != nil {
+		o = append(o, option{optServerID, serverID})
+	}
+	return append(o, opts...)
+}
+
+// isReply returns whether m is a reply.
+func isReply(m *message) bool {
+	return m.typ == msgReply
+}
+
+// dnsServers returns the DNS servers in m.
+func dnsServers(m *message) []tcpip.Address {
+	b, _ := m.options.get(optDNSServers)
+	return parseAddresses(b)
+}
+
+func newTransactionID() (uint32, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]) & 0xffffff, nil
+}
+
+// sleep waits for d on clock, and returns false if ctx is done first.
+func sleep(ctx context.Context, clock tcpip.Clock, d time.Duration) bool {
+	t := clock.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C():
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// withClockDeadline returns a context that is done once ctx is, or once clock
+// reaches the given deadline, unless it is zero.
+func withClockDeadline(ctx context.Context, clock tcpip.Clock, deadline time.Time) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	if deadline.IsZero() {
+		return ctx, cancel
+	}
+
+	go func() {
+		if sleep(ctx, clock, deadline.Sub(clock.Now())) {
+			cancel()
+		}
+	}()
+	return ctx, cancel
+}
+
+// contextError returns the error of ctx if it is done, which is the cause of
+// the given I/O error, or err otherwise.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
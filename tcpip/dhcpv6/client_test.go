@@ -0,0 +1,297 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dhcpv6
+
+import (
+	"context"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/adapters/gonet"
+	"github.com/google/netstack/tcpip/faketime"
+	"github.com/google/netstack/tcpip/link/loopback"
+	"github.com/google/netstack/tcpip/network/ipv6"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/udp"
+)
+
+const (
+	nicID     = 1
+	linkAddr  = tcpip.Address("\xfe\x80\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+	leaseAddr = tcpip.Address("\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x10")
+	dnsAddr   = tcpip.Address("\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x53")
+)
+
+var serverDUID = []byte{0, duidUUID, 1, 2, 3, 4}
+
+// server is a fake DHCPv6 server, which leases leaseAddr for a minute.
+type server struct {
+	conn *gonet.PacketConn
+
+	// received are the types of the messages received by the server.
+	received chan messageType
+}
+
+// newTestStack returns a stack with a loopback NIC whose link-local address is
+// linkAddr, running a fake server on the same NIC.
+func newTestStack(t *testing.T) (*stack.Stack, *faketime.ManualClock, *server) {
+	clock := faketime.NewManualClock(time.Unix(0, 0))
+	s := stack.New([]string{ipv6.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+	s.SetClock(clock)
+	if err := s.CreateNIC(nicID, loopback.New()); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddressWithPrefix(nicID, ipv6.ProtocolNumber, tcpip.AddressWithPrefix{linkAddr, 64}); err != nil {
+		t.Fatalf("AddAddressWithPrefix failed: %v", err)
+	}
+	if err := s.JoinGroup(ipv6.ProtocolNumber, nicID, AllServersAddress); err != nil {
+		t.Fatalf("JoinGroup failed: %v", err)
+	}
+
+	conn, err := gonet.NewPacketConn(s, tcpip.FullAddress{NIC: nicID, Port: ServerPort}, ipv6.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("NewPacketConn failed: %v", err)
+	}
+	srv := &server{conn: conn, received: make(chan messageType, 10)}
+	go srv.serve()
+
+	return s, clock, srv
+}
+
+func (s *server) serve() {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		var m message
+		if err := m.unpack(append([]byte(nil), buf[:n]...)); err != nil {
+			continue
+		}
+		s.received <- m.typ
+
+		if resp := s.respond(&m); resp != nil {
+			s.conn.WriteTo(resp.pack(), from)
+		}
+	}
+}
+
+// respond returns the response of the server to m.
+func (s *server) respond(m *message) *message {
+	clientID, _ := m.options.get(optClientID)
+	resp := &message{
+		typ:  msgReply,
+		txID: m.txID,
+		options: options{
+			{optClientID, clientID},
+			{optServerID, serverDUID},
+		},
+	}
+
+	switch m.typ {
+	case msgSolicit, msgRequest, msgRenew, msgRebind:
+		if m.typ == msgSolicit {
+			resp.typ = msgAdvertise
+		}
+		b, _ := m.options.get(optIANA)
+		ia, err := parseIANA(b)
+		if err != nil {
+			return nil
+		}
+		ia.t1, ia.t2 = 0, 0
+		ia.addrs = []iaAddr{{addr: leaseAddr, preferred: 30, valid: 60}}
+		resp.options = append(resp.options, option{optIANA, ia.marshal()})
+	case msgRelease:
+		return resp
+	case msgInformationRequest:
+		var refresh [4]byte
+		binary.BigEndian.PutUint32(refresh[:], 3600)
+		resp.options = append(resp.options, option{optInformationRefreshTime, refresh[:]})
+	default:
+		return nil
+	}
+
+	resp.options = append(resp.options, option{optDNSServers, []byte(dnsAddr)})
+	return resp
+}
+
+// expect checks that the server received messages of the given types, in order.
+func (s *server) expect(t *testing.T, types ...messageType) {
+	t.Helper()
+
+	for _, want := range types {
+		select {
+		case got := <-s.received:
+			if got != want {
+				t.Errorf("server received message of type %d, want %d", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("server didn't receive message of type %d", want)
+		}
+	}
+}
+
+// hasAddress returns whether the NIC has the given address.
+func hasAddress(s *stack.Stack, addr tcpip.Address) bool {
+	for _, a := range s.NICInfo()[nicID].Addresses {
+		if a.Address == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAcquire(t *testing.T) {
+	s, clock, srv := newTestStack(t)
+	defer srv.conn.Close()
+
+	c, err := NewClient(s, Config{NIC: nicID, IAID: 7})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	lease, err := c.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	srv.expect(t, msgSolicit, msgRequest)
+
+	want := Lease{
+		Addr:              leaseAddr,
+		PreferredLifetime: 30 * time.Second,
+		ValidLifetime:     time.Minute,
+		T1:                15 * time.Second,
+		T2:                24 * time.Second,
+		DNSServers:        []tcpip.Address{dnsAddr},
+		serverID:          serverDUID,
+	}
+	if !reflect.DeepEqual(lease, want) {
+		t.Errorf("Acquire returned %+v, want %+v", lease, want)
+	}
+	if !hasAddress(s, leaseAddr) {
+		t.Fatalf("leased address wasn't added to the NIC")
+	}
+
+	// Renewing the lease extends the lifetime of the address.
+	clock.Advance(50 * time.Second)
+	if _, err := c.Renew(ctx, false); err != nil {
+		t.Fatalf("Renew failed: %v", err)
+	}
+	srv.expect(t, msgRenew)
+	clock.Advance(50 * time.Second)
+	if !hasAddress(s, leaseAddr) {
+		t.Fatalf("renewed address expired")
+	}
+
+	// The address is removed once its valid lifetime expires.
+	clock.Advance(10 * time.Second)
+	for deadline := time.Now().Add(5 * time.Second); hasAddress(s, leaseAddr); {
+		if time.Now().After(deadline) {
+			t.Fatalf("address wasn't removed once its lease expired")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	s, _, srv := newTestStack(t)
+	defer srv.conn.Close()
+
+	c, err := NewClient(s, Config{NIC: nicID})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := c.Release(ctx); err != errNoLease {
+		t.Errorf("Release without a lease returned %v, want %v", err, errNoLease)
+	}
+
+	if _, err := c.Acquire(ctx); err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	if err := c.Release(ctx); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	srv.expect(t, msgSolicit, msgRequest, msgRelease)
+
+	if hasAddress(s, leaseAddr) {
+		t.Errorf("released address is still on the NIC")
+	}
+	if _, ok := c.Lease(); ok {
+		t.Errorf("client still has a lease after releasing it")
+	}
+}
+
+func TestInformation(t *testing.T) {
+	s, _, srv := newTestStack(t)
+	defer srv.conn.Close()
+
+	c, err := NewClient(s, Config{NIC: nicID})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	info, err := c.Information(ctx)
+	if err != nil {
+		t.Fatalf("Information failed: %v", err)
+	}
+	srv.expect(t, msgInformationRequest)
+
+	want := Information{DNSServers: []tcpip.Address{dnsAddr}, Refresh: time.Hour}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("Information returned %+v, want %+v", info, want)
+	}
+	if hasAddress(s, leaseAddr) {
+		t.Errorf("address added in stateless mode")
+	}
+}
+
+func TestMessage(t *testing.T) {
+	ia := iana{iaid: 1, t1: 2, t2: 3, addrs: []iaAddr{{addr: leaseAddr, preferred: infinity, valid: infinity}}}
+	m := message{
+		typ:     msgRequest,
+		txID:    0xabcdef,
+		options: options{{optClientID, []byte{1, 2}}, {optIANA, ia.marshal()}},
+	}
+
+	var got message
+	if err := got.unpack(m.pack()); err != nil {
+		t.Fatalf("unpack failed: %v", err)
+	}
+	if got.typ != m.typ || got.txID != m.txID || !reflect.DeepEqual(got.options, m.options) {
+		t.Errorf("got message %+v, want %+v", got, m)
+	}
+
+	b, _ := got.options.get(optIANA)
+	gotIA, err := parseIANA(b)
+	if err != nil {
+		t.Fatalf("parseIANA failed: %v", err)
+	}
+	if gotIA.iaid != ia.iaid || gotIA.t1 != ia.t1 || gotIA.t2 != ia.t2 || !reflect.DeepEqual(gotIA.addrs, ia.addrs) {
+		t.Errorf("got IA_NA %+v, want %+v", gotIA, ia)
+	}
+	if seconds(infinity) != 0 {
+		t.Errorf("got infinite lifetime %v, want 0", seconds(infinity))
+	}
+
+	// Truncated messages are rejected.
+	if err := got.unpack(m.pack()[:12]); err != errShortMessage {
+		t.Errorf("unpack of a truncated message returned %v, want %v", err, errShortMessage)
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dhcpv6
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+)
+
+// messageType is the type of a DHCPv6 message.
+type messageType uint8
+
+// Message types used by the client, per RFC 8415, section 7.3.
+const (
+	msgSolicit            messageType = 1
+	msgAdvertise          messageType = 2
+	msgRequest            messageType = 3
+	msgRenew              messageType = 5
+	msgRebind             messageType = 6
+	msgReply              messageType = 7
+	msgRelease            messageType = 8
+	msgInformationRequest messageType = 11
+)
+
+// Option codes used by the client, per RFC 8415, section 21, and RFC 3646.
+const (
+	optClientID               = 1
+	optServerID               = 2
+	optIANA                   = 3
+	optIAAddr                 = 5
+	optORO                    = 6
+	optPreference             = 7
+	optElapsedTime            = 8
+	optStatusCode             = 13
+	optDNSServers             = 23
+	optInformationRefreshTime = 32
+)
+
+// statusSuccess is the status code of successful replies, which is implied
+// when a reply has no status code option.
+const statusSuccess = 0
+
+const (
+	// headerSize is the size of the message type and transaction id.
+	headerSize = 4
+
+	// ianaSize and iaAddrSize are the sizes of the fixed fields of IA_NA
+	// and IA Address options.
+	ianaSize   = 12
+	iaAddrSize = header.IPv6AddressSize + 8
+
+	// infinity is the lifetime value that never expires.
+	infinity = 0xffffffff
+)
+
+var errShortMessage = errors.New("message too short")
+
+// option is a DHCPv6 option.
+type option struct {
+	code uint16
+	data []byte
+}
+
+// options is a list of DHCPv6 options, in the order they appear.
+type options []option
+
+// get returns the data of the first option of the given code.
+func (o options) get(code uint16) ([]byte, bool) {
+	for _, opt := range o {
+		if opt.code == code {
+			return opt.data, true
+		}
+	}
+	return nil, false
+}
+
+// status returns the status code of the options, which is statusSuccess if
+// there is no status code option.
+func (o options) status() uint16 {
+	if b, ok := o.get(optStatusCode); ok && len(b) >= 2 {
+		return binary.BigEndian.Uint16(b)
+	}
+	return statusSuccess
+}
+
+// appendTo appends the wire encoding of the options to b.
+func (o options) appendTo(b []byte) []byte {
+	for _, opt := range o {
+		b = append(b, byte(opt.code>>8), byte(opt.code), byte(len(opt.data)>>8), byte(len(opt.data)))
+		b = append(b, opt.data...)
+	}
+	return b
+}
+
+// parseOptions decodes the wire encoding of a list of options.
+func parseOptions(b []byte) (options, error) {
+	var o options
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, errShortMessage
+		}
+		code := binary.BigEndian.Uint16(b)
+		n := int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+n {
+			return nil, errShortMessage
+		}
+		o = append(o, option{code, b[4 : 4+n]})
+		b = b[4+n:]
+	}
+	return o, nil
+}
+
+// message is a DHCPv6 message exchanged between a client and servers.
+type message struct {
+	typ     messageType
+	txID    uint32
+	options options
+}
+
+// pack returns the wire encoding of the message.
+func (m *message) pack() []byte {
+	b := []byte{byte(m.typ), byte(m.txID >> 16), byte(m.txID >> 8), byte(m.txID)}
+	return m.options.appendTo(b)
+}
+
+// unpack decodes the wire encoding of a message into m.
+func (m *message) unpack(b []byte) error {
+	if len(b) < headerSize {
+		return errShortMessage
+	}
+
+	o, err := parseOptions(b[headerSize:])
+	if err != nil {
+		return err
+	}
+
+	m.typ = messageType(b[0])
+	m.txID = uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	m.options = o
+	return nil
+}
+
+// iaAddr is an address assigned to an identity association.
+type iaAddr struct {
+	addr      tcpip.Address
+	preferred uint32
+	valid     uint32
+}
+
+// iana is an identity association for non-temporary addresses.
+type iana struct {
+	iaid    uint32
+	t1, t2  uint32
+	addrs   []iaAddr
+	options options
+}
+
+// marshal returns the data of the IA_NA option of ia.
+func (ia *iana) marshal() []byte {
+	b := make([]byte, ianaSize)
+	binary.BigEndian.PutUint32(b[0:], ia.iaid)
+	binary.BigEndian.PutUint32(b[4:], ia.t1)
+	binary.BigEndian.PutUint32(b[8:], ia.t2)
+
+	var o options
+	for _, a := range ia.addrs {
+		d := make([]byte, iaAddrSize)
+		copy(d, a.addr)
+		binary.BigEndian.PutUint32(d[16:], a.preferred)
+		binary.BigEndian.PutUint32(d[20:], a.valid)
+		o = append(o, option{optIAAddr, d})
+	}
+	return o.appendTo(b)
+}
+
+// parseIANA decodes the data of an IA_NA option. Addresses whose own status
+// isn't successful are skipped.
+func parseIANA(b []byte) (*iana, error) {
+	if len(b) < ianaSize {
+		return nil, errShortMessage
+	}
+
+	o, err := parseOptions(b[ianaSize:])
+	if err != nil {
+		return nil, err
+	}
+
+	ia := &iana{
+		iaid:    binary.BigEndian.Uint32(b[0:]),
+		t1:      binary.BigEndian.Uint32(b[4:]),
+		t2:      binary.BigEndian.Uint32(b[8:]),
+		options: o,
+	}
+	for _, opt := range o {
+		if opt.code != optIAAddr || len(opt.data) < iaAddrSize {
+			continue
+		}
+		ao, err := parseOptions(opt.data[iaAddrSize:])
+		if err != nil || ao.status() != statusSuccess {
+			continue
+		}
+		ia.addrs = append(ia.addrs, iaAddr{
+			addr:      tcpip.Address(opt.data[:header.IPv6AddressSize]),
+			preferred: binary.BigEndian.Uint32(opt.data[16:]),
+			valid:     binary.BigEndian.Uint32(opt.data[20:]),
+		})
+	}
+
+	return ia, nil
+}
+
+// parseAddresses decodes the data of an option holding a list of IPv6
+// addresses, e.g., DNS servers.
+func parseAddresses(b []byte) []tcpip.Address {
+	var addrs []tcpip.Address
+	for ; len(b) >= header.IPv6AddressSize; b = b[header.IPv6AddressSize:] {
+		addrs = append(addrs, tcpip.Address(b[:header.IPv6AddressSize]))
+	}
+	return addrs
+}
+
+// uint16Option returns the data of an option holding v.
+func uint16Option(code uint16, v uint16) option {
+	return option{code, []byte{byte(v >> 8), byte(v)}}
+}
+
+// requestOption returns the option requesting the options of the given codes
+// from servers.
+func requestOption(codes ...uint16) option {
+	b := make([]byte, 0, 2*len(codes))
+	for _, code := range codes {
+		b = append(b, byte(code>>8), byte(code))
+	}
+	return option{optORO, b}
+}
+
+// seconds returns the duration of a lifetime or timer value in seconds, which
+// is zero for infinity, as for the lifetimes of permanent addresses.
+func seconds(v uint32) time.Duration {
+	if v == infinity {
+		return 0
+	}
+	return time.Duration(v) * time.Second
+}
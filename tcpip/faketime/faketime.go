@@ -0,0 +1,118 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package faketime provides a clock whose time only moves forward when told
+// to, so that the timers of a stack can be driven deterministically.
+//
+// A manual clock is installed in a stack by calling Stack.SetClock() before
+// any endpoints are created.
+package faketime
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// ManualClock is a tcpip.Clock whose time only changes when Advance is called.
+type ManualClock struct {
+	// mu protects the fields below.
+	mu     sync.Mutex
+	now    time.Time
+	timers map[*manualTimer]struct{}
+}
+
+// NewManualClock creates a new manual clock that starts at the given time.
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{
+		now:    start,
+		timers: make(map[*manualTimer]struct{}),
+	}
+}
+
+// Now implements tcpip.Clock.Now.
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer implements tcpip.Clock.NewTimer.
+func (c *ManualClock) NewTimer(d time.Duration) tcpip.Timer {
+	t := &manualTimer{
+		clock: c,
+		c:     make(chan time.Time, 1),
+	}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the time of the clock forward by d and fires all the timers
+// that expire by then, in order of expiration.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		// Find the next timer to expire.
+		var next *manualTimer
+		for t := range c.timers {
+			if !t.deadline.After(end) && (next == nil || t.deadline.Before(next.deadline)) {
+				next = t
+			}
+		}
+
+		if next == nil {
+			break
+		}
+
+		delete(c.timers, next)
+		if next.deadline.After(c.now) {
+			c.now = next.deadline
+		}
+
+		// Like time.Timer, don't block if the previous expiration
+		// hasn't been consumed yet.
+		select {
+		case next.c <- c.now:
+		default:
+		}
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+// manualTimer is a tcpip.Timer created by a ManualClock. It is active while it
+// is in the timers map of its clock.
+type manualTimer struct {
+	clock    *ManualClock
+	c        chan time.Time
+	deadline time.Time
+}
+
+// C implements tcpip.Timer.C.
+func (t *manualTimer) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop implements tcpip.Timer.Stop.
+func (t *manualTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	_, active := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	return active
+}
+
+// Reset implements tcpip.Timer.Reset.
+func (t *manualTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	_, active := t.clock.timers[t]
+	t.deadline = t.clock.now.Add(d)
+	t.clock.timers[t] = struct{}{}
+	return active
+}
@@ -0,0 +1,61 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package faketime_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip/faketime"
+)
+
+func TestManualClock(t *testing.T) {
+	start := time.Unix(100, 0)
+	c := faketime.NewManualClock(start)
+
+	t1 := c.NewTimer(2 * time.Second)
+	t2 := c.NewTimer(time.Second)
+	t3 := c.NewTimer(time.Second)
+	if !t3.Stop() {
+		t.Errorf("Stop of active timer returned false")
+	}
+
+	c.Advance(time.Second)
+	if got, want := c.Now(), start.Add(time.Second); !got.Equal(want) {
+		t.Errorf("Now() = %v, want %v", got, want)
+	}
+
+	select {
+	case now := <-t2.C():
+		if want := start.Add(time.Second); !now.Equal(want) {
+			t.Errorf("t2 fired at %v, want %v", now, want)
+		}
+	default:
+		t.Errorf("t2 didn't fire")
+	}
+
+	select {
+	case <-t1.C():
+		t.Errorf("t1 fired early")
+	case <-t3.C():
+		t.Errorf("stopped timer fired")
+	default:
+	}
+
+	// Timers fire at their deadline even if the clock moves past it.
+	c.Advance(5 * time.Second)
+	select {
+	case now := <-t1.C():
+		if want := start.Add(2 * time.Second); !now.Equal(want) {
+			t.Errorf("t1 fired at %v, want %v", now, want)
+		}
+	default:
+		t.Errorf("t1 didn't fire")
+	}
+
+	if t1.Stop() {
+		t.Errorf("Stop of expired timer returned true")
+	}
+}
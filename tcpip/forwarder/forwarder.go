@@ -0,0 +1,644 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package forwarder proxies TCP connections and UDP datagrams between a netstack
+// stack and the network of the host, as gateways and "tun2socks"-like
+// applications do.
+//
+// Stack rules forward the connections and datagrams the stack receives to
+// addresses of the host network; with promiscuous mode enabled on the NIC,
+// they can transparently proxy traffic for any destination. Host rules forward
+// the connections and datagrams received on sockets of the host to addresses
+// reachable through the stack.
+package forwarder
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/adapters/gonet"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	// DefaultUDPIdleTimeout is the time after which UDP sessions without
+	// traffic in either direction are closed.
+	DefaultUDPIdleTimeout = time.Minute
+
+	// DefaultDialTimeout is the time given to connections to targets to
+	// be established.
+	DefaultDialTimeout = 30 * time.Second
+
+	// maxInFlight is the maximum number of TCP connections being
+	// established to targets at any time.
+	maxInFlight = 1024
+
+	// rcvWnd is the receive window of forwarded TCP connections, which is
+	// announced during the handshake.
+	rcvWnd = 64 << 10
+
+	// maxDatagramSize is the size of the largest UDP datagram forwarded.
+	maxDatagramSize = 64 << 10
+)
+
+var (
+	errUnknownNetwork = errors.New("unknown network")
+	errInvalidTarget  = errors.New("invalid target address")
+)
+
+// StackRule forwards the connections and datagrams received by the stack for a
+// destination address and port to an address of the host network.
+type StackRule struct {
+	// Network is "tcp" or "udp".
+	Network string
+
+	// Addr and Port are the destination address and port matched by the
+	// rule. The empty address and port zero match any.
+	Addr tcpip.Address
+	Port uint16
+
+	// Target is the "host:port" address of the host network traffic is
+	// forwarded to. If it is empty, traffic is forwarded to its original
+	// destination.
+	Target string
+}
+
+func (r *StackRule) matches(network string, id stack.TransportEndpointID) bool {
+	return r.Network == network && (r.Addr == "" || r.Addr == id.LocalAddress) && (r.Port == 0 || r.Port == id.LocalPort)
+}
+
+// HostRule forwards the connections and datagrams received on an address of
+// the host network to an address reachable through the stack.
+type HostRule struct {
+	// Network is "tcp" or "udp".
+	Network string
+
+	// Listen is the "host:port" address of the host network the rule
+	// listens on.
+	Listen string
+
+	// Target is the address traffic is forwarded to through the stack.
+	Target tcpip.FullAddress
+}
+
+// Forwarder forwards traffic between a stack and the network of the host,
+// according to its rules. It is safe for concurrent use.
+type Forwarder struct {
+	stack *stack.Stack
+
+	mu         sync.RWMutex
+	stackRules []*StackRule
+	closed     bool
+
+	// conns holds the forwarded TCP connections and UDP sessions, and the
+	// listeners of host rules, so that they are closed by Close.
+	conns map[io.Closer]struct{}
+
+	// wg tracks the goroutines of the forwarder.
+	wg sync.WaitGroup
+
+	// The following fields are configuration, which must be set before the
+	// forwarder is used.
+
+	// UDPIdleTimeout is the time after which UDP sessions without traffic
+	// are closed.
+	UDPIdleTimeout time.Duration
+
+	// DialTimeout is the time given to connections to targets to be
+	// established.
+	DialTimeout time.Duration
+}
+
+// New creates a new forwarder for the given stack, and installs it as the
+// handler of the TCP and UDP packets that don't match any endpoint of the
+// stack.
+func New(s *stack.Stack) *Forwarder {
+	f := &Forwarder{
+		stack:          s,
+		conns:          make(map[io.Closer]struct{}),
+		UDPIdleTimeout: DefaultUDPIdleTimeout,
+		DialTimeout:    DefaultDialTimeout,
+	}
+
+	tf := tcp.NewForwarder(s, rcvWnd, maxInFlight, f.handleTCP)
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tf.HandlePacket)
+
+	uf := udp.NewForwarder(s, f.handleUDP)
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, uf.HandlePacket)
+
+	return f
+}
+
+// AddStackRule adds a rule forwarding traffic received by the stack to the
+// host network. Rules are matched in the order they are added. Traffic that
+// matches no rule is refused. The returned function removes the rule.
+func (f *Forwarder) AddStackRule(r StackRule) (remove func(), err error) {
+	if r.Network != "tcp" && r.Network != "udp" {
+		return nil, errUnknownNetwork
+	}
+	if r.Target != "" {
+		if _, _, err := net.SplitHostPort(r.Target); err != nil {
+			return nil, errInvalidTarget
+		}
+	}
+
+	rule := &r
+	f.mu.Lock()
+	f.stackRules = append(f.stackRules, rule)
+	f.mu.Unlock()
+
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for i, sr := range f.stackRules {
+			if sr == rule {
+				f.stackRules = append(f.stackRules[:i], f.stackRules[i+1:]...)
+				break
+			}
+		}
+	}, nil
+}
+
+// AddHostRule starts listening on the host network for traffic to forward to
+// the stack. The returned function stops listening; the connections and
+// sessions already forwarded are left alone.
+func (f *Forwarder) AddHostRule(r HostRule) (remove func(), err error) {
+	network, err := networkProtocol(r.Target.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var l io.Closer
+	switch r.Network {
+	case "tcp":
+		tl, err := net.Listen("tcp", r.Listen)
+		if err != nil {
+			return nil, err
+		}
+		l = tl
+		if !f.track(l) || !f.goTracked(func() { f.serveHostTCP(tl, r.Target, network) }) {
+			tl.Close()
+			return nil, tcpip.ErrInvalidEndpointState
+		}
+
+	case "udp":
+		pc, err := net.ListenPacket("udp", r.Listen)
+		if err != nil {
+			return nil, err
+		}
+		l = pc
+		if !f.track(l) || !f.goTracked(func() { f.serveHostUDP(pc, r.Target, network) }) {
+			pc.Close()
+			return nil, tcpip.ErrInvalidEndpointState
+		}
+
+	default:
+		return nil, errUnknownNetwork
+	}
+
+	return func() {
+		f.untrack(l)
+		l.Close()
+	}, nil
+}
+
+// Close stops all host listeners and closes all forwarded connections and
+// sessions, then waits for the goroutines of the forwarder to exit. Traffic
+// received by the stack afterwards is refused.
+func (f *Forwarder) Close() {
+	f.mu.Lock()
+	f.closed = true
+	f.stackRules = nil
+	conns := f.conns
+	f.conns = make(map[io.Closer]struct{})
+	f.mu.Unlock()
+
+	for c := range conns {
+		c.Close()
+	}
+
+	f.wg.Wait()
+}
+
+// findStackRule returns the first stack rule matching the given network and
+// endpoint ID, or nil.
+func (f *Forwarder) findStackRule(network string, id stack.TransportEndpointID) *StackRule {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for _, r := range f.stackRules {
+		if r.matches(network, id) {
+			return r
+		}
+	}
+	return nil
+}
+
+// track records c to be closed by Close. It returns false if the forwarder is
+// already closed, in which case c isn't recorded.
+func (f *Forwarder) track(c io.Closer) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return false
+	}
+	f.conns[c] = struct{}{}
+	return true
+}
+
+func (f *Forwarder) untrack(c io.Closer) {
+	f.mu.Lock()
+	delete(f.conns, c)
+	f.mu.Unlock()
+}
+
+// goTracked runs fn on a new goroutine, which Close waits for. It returns false
+// if the forwarder is already closed, in which case fn isn't run.
+func (f *Forwarder) goTracked(fn func()) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return false
+	}
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		fn()
+	}()
+	return true
+}
+
+// stackTarget returns the host address traffic matching the given rule and
+// endpoint ID is forwarded to.
+func stackTarget(r *StackRule, id stack.TransportEndpointID) string {
+	if r.Target != "" {
+		return r.Target
+	}
+	return net.JoinHostPort(net.IP(id.LocalAddress).String(), strconv.Itoa(int(id.LocalPort)))
+}
+
+// handleTCP handles a connection request received by the stack. It runs on its
+// own goroutine.
+func (f *Forwarder) handleTCP(req *tcp.ForwarderRequest) {
+	id := req.ID()
+	r := f.findStackRule("tcp", id)
+	if r == nil {
+		req.Complete(true)
+		return
+	}
+
+	// Connect to the target first, so that the connection is refused if
+	// the target can't be reached.
+	hc, err := net.DialTimeout("tcp", stackTarget(r, id), f.DialTimeout)
+	if err != nil {
+		req.Complete(true)
+		return
+	}
+
+	var wq waiter.Queue
+	ep, err := req.CreateEndpoint(&wq)
+	req.Complete(err != nil)
+	if err != nil {
+		hc.Close()
+		return
+	}
+
+	f.proxyTCP(gonet.NewConn(&wq, ep), hc)
+}
+
+// serveHostTCP accepts connections on the given host listener and forwards
+// them to the target through the stack.
+func (f *Forwarder) serveHostTCP(l net.Listener, target tcpip.FullAddress, network tcpip.NetworkProtocolNumber) {
+	for {
+		hc, err := l.Accept()
+		if err != nil {
+			f.untrack(l)
+			return
+		}
+
+		if !f.goTracked(func() {
+			sc, err := gonet.DialTCP(f.stack, target, network)
+			if err != nil {
+				hc.Close()
+				return
+			}
+			f.proxyTCP(sc, hc)
+		}) {
+			hc.Close()
+		}
+	}
+}
+
+// proxyTCP copies data between two connections until both directions are
+// closed, then closes the connections.
+func (f *Forwarder) proxyTCP(a, b net.Conn) {
+	if !f.track(a) {
+		a.Close()
+		b.Close()
+		return
+	}
+	if !f.track(b) {
+		f.untrack(a)
+		a.Close()
+		b.Close()
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		copyAndCloseWrite(a, b)
+	}()
+	go func() {
+		defer wg.Done()
+		copyAndCloseWrite(b, a)
+	}()
+	wg.Wait()
+
+	f.untrack(a)
+	f.untrack(b)
+	a.Close()
+	b.Close()
+}
+
+// copyAndCloseWrite copies from src to dst until src is closed, then closes
+// the write side of dst, so that half-closed connections are forwarded.
+func copyAndCloseWrite(dst, src net.Conn) {
+	io.Copy(dst, src)
+
+	type closeWriter interface {
+		CloseWrite() error
+	}
+	if cw, ok := dst.(closeWriter); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
+
+// handleUDP handles a datagram received by the stack that doesn't match any
+// endpoint. It runs on the packet processing path, so the session is served
+// on another goroutine.
+func (f *Forwarder) handleUDP(req *udp.ForwarderRequest) {
+	id := req.ID()
+	r := f.findStackRule("udp", id)
+	if r == nil {
+		return
+	}
+
+	var wq waiter.Queue
+	ep, err := req.CreateEndpoint(&wq)
+	if err != nil {
+		return
+	}
+	sc := gonet.NewUDPConn(f.stack, &wq, ep)
+
+	target := stackTarget(r, id)
+	if !f.goTracked(func() {
+		hc, err := net.DialTimeout("udp", target, f.DialTimeout)
+		if err != nil {
+			sc.Close()
+			return
+		}
+		f.proxyUDP(sc, hc)
+	}) {
+		sc.Close()
+	}
+}
+
+// serveHostUDP reads datagrams on the given host socket, and forwards them to
+// the target through the stack, using one stack endpoint per sender.
+func (f *Forwarder) serveHostUDP(pc net.PacketConn, target tcpip.FullAddress, network tcpip.NetworkProtocolNumber) {
+	var mu sync.Mutex
+	sessions := make(map[string]*hostSession)
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			f.untrack(pc)
+			return
+		}
+
+		key := from.String()
+		mu.Lock()
+		hs := sessions[key]
+		if hs == nil {
+			sc, err := gonet.DialUDP(f.stack, nil, &target, network)
+			if err != nil {
+				mu.Unlock()
+				continue
+			}
+
+			hs = newHostSession(pc, from)
+			sessions[key] = hs
+			if !f.goTracked(func() {
+				f.proxyUDP(sc, hs)
+
+				mu.Lock()
+				delete(sessions, key)
+				mu.Unlock()
+			}) {
+				sc.Close()
+			}
+		}
+		mu.Unlock()
+
+		hs.deliver(append([]byte(nil), buf[:n]...))
+	}
+}
+
+// hostSession is the net.Conn of a UDP session accepted on a host socket. The
+// datagrams of the sender are delivered to it by the reader of the socket, and
+// it writes to the sender.
+type hostSession struct {
+	pc   net.PacketConn
+	addr net.Addr
+
+	in        chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func newHostSession(pc net.PacketConn, addr net.Addr) *hostSession {
+	return &hostSession{
+		pc:     pc,
+		addr:   addr,
+		in:     make(chan []byte, 64),
+		closed: make(chan struct{}),
+	}
+}
+
+// deliver queues a datagram of the sender for reading. It is dropped if the
+// queue is full.
+func (s *hostSession) deliver(b []byte) {
+	select {
+	case s.in <- b:
+	default:
+	}
+}
+
+// Read implements net.Conn.Read.
+func (s *hostSession) Read(b []byte) (int, error) {
+	s.mu.Lock()
+	d := s.readDeadline
+	s.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !d.IsZero() {
+		t := time.NewTimer(time.Until(d))
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case p := <-s.in:
+		return copy(b, p), nil
+	case <-s.closed:
+		return 0, io.EOF
+	case <-timeout:
+		return 0, timeoutError{}
+	}
+}
+
+// Write implements net.Conn.Write.
+func (s *hostSession) Write(b []byte) (int, error) {
+	return s.pc.WriteTo(b, s.addr)
+}
+
+// Close implements net.Conn.Close. The host socket is left open.
+func (s *hostSession) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
+
+// LocalAddr implements net.Conn.LocalAddr.
+func (s *hostSession) LocalAddr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// RemoteAddr implements net.Conn.RemoteAddr.
+func (s *hostSession) RemoteAddr() net.Addr {
+	return s.addr
+}
+
+// SetDeadline implements net.Conn.SetDeadline.
+func (s *hostSession) SetDeadline(t time.Time) error {
+	return s.SetReadDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn.SetReadDeadline.
+func (s *hostSession) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn.SetWriteDeadline. Writes don't block,
+// so it is ignored.
+func (s *hostSession) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// timeoutError is returned by reads of a hostSession that time out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// proxyUDP copies datagrams between two connections until neither has traffic
+// for the idle timeout, or one of them fails, then closes the connections.
+func (f *Forwarder) proxyUDP(a, b net.Conn) {
+	if !f.track(a) {
+		a.Close()
+		b.Close()
+		return
+	}
+	if !f.track(b) {
+		f.untrack(a)
+		a.Close()
+		b.Close()
+		return
+	}
+
+	var mu sync.Mutex
+	lastActive := time.Now()
+	active := func() {
+		mu.Lock()
+		lastActive = time.Now()
+		mu.Unlock()
+	}
+	idle := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return time.Since(lastActive) >= f.UDPIdleTimeout
+	}
+
+	copyDatagrams := func(dst, src net.Conn) {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			src.SetReadDeadline(time.Now().Add(f.UDPIdleTimeout))
+			n, err := src.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() && !idle() {
+					// The other direction is still active.
+					continue
+				}
+				break
+			}
+			active()
+			if _, err := dst.Write(buf[:n]); err != nil {
+				break
+			}
+		}
+
+		// Stop the other direction.
+		a.Close()
+		b.Close()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		copyDatagrams(a, b)
+	}()
+	go func() {
+		defer wg.Done()
+		copyDatagrams(b, a)
+	}()
+	wg.Wait()
+
+	f.untrack(a)
+	f.untrack(b)
+}
+
+// networkProtocol returns the network protocol of the given address.
+func networkProtocol(addr tcpip.Address) (tcpip.NetworkProtocolNumber, error) {
+	switch len(addr) {
+	case header.IPv4AddressSize:
+		return header.IPv4ProtocolNumber, nil
+	case header.IPv6AddressSize:
+		return header.IPv6ProtocolNumber, nil
+	}
+	return 0, errInvalidTarget
+}
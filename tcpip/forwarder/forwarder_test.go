@@ -0,0 +1,235 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package forwarder
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/adapters/gonet"
+	"github.com/google/netstack/tcpip/link/loopback"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/google/netstack/tcpip/transport/udp"
+)
+
+const (
+	nicID     = 1
+	stackAddr = tcpip.Address("\x7f\x00\x00\x01")
+)
+
+func newTestStack(t *testing.T) *stack.Stack {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName, udp.ProtocolName}).(*stack.Stack)
+
+	if err := s.CreateNIC(nicID, loopback.New()); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(nicID, ipv4.ProtocolNumber, stackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         nicID,
+	}})
+
+	return s
+}
+
+// echo writes back everything read from c, then closes it.
+func echo(c net.Conn) {
+	io.Copy(c, c)
+	c.Close()
+}
+
+// checkEcho checks that data written to c is echoed back.
+func checkEcho(t *testing.T, c net.Conn) {
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	want := "hello, forwarder"
+	if _, err := c.Write([]byte(want)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatalf("ReadFull failed: %v", err)
+	}
+	if string(got) != want {
+		t.Fatalf("Read %q, want %q", got, want)
+	}
+}
+
+func TestStackRuleTCP(t *testing.T) {
+	s := newTestStack(t)
+	f := New(s)
+	defer f.Close()
+
+	hl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer hl.Close()
+	go func() {
+		for {
+			c, err := hl.Accept()
+			if err != nil {
+				return
+			}
+			go echo(c)
+		}
+	}()
+
+	if _, err := f.AddStackRule(StackRule{Network: "tcp", Port: 80, Target: hl.Addr().String()}); err != nil {
+		t.Fatalf("AddStackRule failed: %v", err)
+	}
+
+	c, err := gonet.DialTCP(s, tcpip.FullAddress{nicID, stackAddr, 80}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("DialTCP failed: %v", err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c)
+
+	// Connections matching no rule are refused.
+	if c, err := gonet.DialTCP(s, tcpip.FullAddress{nicID, stackAddr, 81}, ipv4.ProtocolNumber); err == nil {
+		c.Close()
+		t.Fatalf("DialTCP to a port without a rule succeeded")
+	}
+}
+
+func TestStackRuleUDP(t *testing.T) {
+	s := newTestStack(t)
+	f := New(s)
+	defer f.Close()
+
+	hc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer hc.Close()
+	go func() {
+		buf := make([]byte, 100)
+		for {
+			n, from, err := hc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			hc.WriteTo(buf[:n], from)
+		}
+	}()
+
+	if _, err := f.AddStackRule(StackRule{Network: "udp", Port: 53, Target: hc.LocalAddr().String()}); err != nil {
+		t.Fatalf("AddStackRule failed: %v", err)
+	}
+
+	c, err := gonet.DialUDP(s, nil, &tcpip.FullAddress{nicID, stackAddr, 53}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("DialUDP failed: %v", err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c)
+}
+
+func TestHostRuleTCP(t *testing.T) {
+	s := newTestStack(t)
+	f := New(s)
+	defer f.Close()
+
+	target := tcpip.FullAddress{nicID, stackAddr, 8080}
+	l, err := gonet.NewListener(s, target, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("NewListener failed: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go echo(c)
+		}
+	}()
+
+	// Find a free port of the host.
+	hl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	addr := hl.Addr().String()
+	hl.Close()
+
+	remove, err := f.AddHostRule(HostRule{Network: "tcp", Listen: addr, Target: target})
+	if err != nil {
+		t.Fatalf("AddHostRule failed: %v", err)
+	}
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c)
+
+	// The host stops listening once the rule is removed.
+	remove()
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Fatalf("Dial succeeded after the rule was removed")
+	}
+}
+
+func TestHostRuleUDP(t *testing.T) {
+	s := newTestStack(t)
+	f := New(s)
+	defer f.Close()
+
+	target := tcpip.FullAddress{nicID, stackAddr, 5353}
+	pc, err := gonet.NewPacketConn(s, target, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("NewPacketConn failed: %v", err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 100)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], from)
+		}
+	}()
+
+	// Find a free port of the host.
+	hc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	addr := hc.LocalAddr().String()
+	hc.Close()
+
+	if _, err := f.AddHostRule(HostRule{Network: "udp", Listen: addr, Target: target}); err != nil {
+		t.Fatalf("AddHostRule failed: %v", err)
+	}
+
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	checkEcho(t, c)
+}
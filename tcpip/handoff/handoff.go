@@ -0,0 +1,120 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package handoff transfers transport endpoints between processes embedding
+// netstack, so that a program built on the stack, e.g., a proxy, can be
+// replaced by a new version of itself without dropping its connections.
+//
+// The old process detaches its endpoints from its stack and sends their state
+// over a connection, typically a unix socket, with Send. The new process
+// restores them in its own stack, which must have the same addresses and
+// routes, with Receive. Link endpoints aren't transferred: the file
+// descriptors backing them, if any, can be passed separately, e.g., with
+// net.UnixConn.WriteMsgUnix.
+package handoff
+
+import (
+	"encoding/gob"
+	"errors"
+	"net"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/waiter"
+)
+
+// transfer is the message sent by Send.
+type transfer struct {
+	Endpoints []stack.SavedEndpoint
+}
+
+// result is the message Receive answers with once it has restored the
+// endpoints, or failed to.
+type result struct {
+	Err string
+}
+
+// Send detaches the given endpoints from s, and sends their state over conn to
+// a process calling Receive. It returns once the receiver has restored them,
+// or failed to. The endpoints are closed in any case, without their peers
+// noticing, so they are lost if an error is returned after detaching them.
+//
+// Packets received by s for the endpoints once they are detached are dropped or
+// reset, so the link endpoints of s should be stopped beforehand, e.g., by
+// handing them off to the receiver too.
+func Send(conn net.Conn, s *stack.Stack, eps []tcpip.Endpoint) error {
+	// Check that all the endpoints can be detached before detaching any.
+	for _, ep := range eps {
+		if _, ok := ep.(stack.DetachableEndpoint); !ok {
+			return tcpip.ErrNotSupported
+		}
+	}
+
+	var t transfer
+	for _, ep := range eps {
+		saved, err := s.DetachEndpoint(ep)
+		if err != nil {
+			return err
+		}
+		t.Endpoints = append(t.Endpoints, saved)
+	}
+
+	if err := gob.NewEncoder(conn).Encode(&t); err != nil {
+		return err
+	}
+
+	var r result
+	if err := gob.NewDecoder(conn).Decode(&r); err != nil {
+		return err
+	}
+	if r.Err != "" {
+		return errors.New(r.Err)
+	}
+
+	return nil
+}
+
+// Receive receives the state of the endpoints sent over conn by Send, and
+// restores them in s. The endpoints are returned in the order they were sent,
+// along with the waiter queues they notify their readiness on.
+//
+// If an error is returned, the endpoints restored so far are closed, and the
+// error is reported to the sender.
+func Receive(conn net.Conn, s *stack.Stack) ([]tcpip.Endpoint, []*waiter.Queue, error) {
+	var t transfer
+	if err := gob.NewDecoder(conn).Decode(&t); err != nil {
+		return nil, nil, err
+	}
+
+	eps, wqs, err := restore(s, t.Endpoints)
+
+	// The restored endpoints are kept even if the sender can't be told.
+	var r result
+	if err != nil {
+		r.Err = err.Error()
+	}
+	gob.NewEncoder(conn).Encode(&r)
+
+	return eps, wqs, err
+}
+
+// restore restores the saved endpoints in s, or none of them if one fails to be.
+func restore(s *stack.Stack, saved []stack.SavedEndpoint) ([]tcpip.Endpoint, []*waiter.Queue, error) {
+	eps := make([]tcpip.Endpoint, 0, len(saved))
+	wqs := make([]*waiter.Queue, 0, len(saved))
+	for _, sep := range saved {
+		wq := &waiter.Queue{}
+		ep, err := s.RestoreEndpoint(sep, wq)
+		if err != nil {
+			for _, ep := range eps {
+				ep.Close()
+			}
+			return nil, nil, err
+		}
+		eps = append(eps, ep)
+		wqs = append(wqs, wq)
+	}
+
+	return eps, wqs, nil
+}
@@ -0,0 +1,275 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package handoff
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/adapters/gonet"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	nicID      = 1
+	serverAddr = tcpip.Address("\x0a\x00\x00\x01")
+	peerAddr   = tcpip.Address("\x0a\x00\x00\x02")
+	serverPort = 80
+)
+
+// link connects a peer stack to whichever server stack is current.
+type link struct {
+	peer *channel.Endpoint
+
+	mu     sync.Mutex
+	server *channel.Endpoint
+}
+
+func newStack(t *testing.T, addr tcpip.Address) (*stack.Stack, *channel.Endpoint) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName, udp.ProtocolName}).(*stack.Stack)
+	id, linkEP := channel.New(256, 1500)
+	if err := s.CreateNIC(nicID, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddressWithPrefix(nicID, ipv4.ProtocolNumber, tcpip.AddressWithPrefix{addr, 24}); err != nil {
+		t.Fatalf("AddAddressWithPrefix failed: %v", err)
+	}
+	return s, linkEP
+}
+
+// forward delivers the packets written to from to the endpoint returned by to,
+// if any.
+func forward(from *channel.Endpoint, to func() *channel.Endpoint) {
+	for p := range from.C {
+		if dst := to(); dst != nil {
+			dst.Inject(p.Proto, append(append(buffer.View(nil), p.Header...), p.Payload...))
+		}
+	}
+}
+
+func (l *link) current() *channel.Endpoint {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.server
+}
+
+// attach makes the link deliver the packets of the peer to server, and the
+// packets of server to the peer.
+func (l *link) attach(server *channel.Endpoint) {
+	l.mu.Lock()
+	l.server = server
+	l.mu.Unlock()
+
+	go forward(server, func() *channel.Endpoint {
+		if l.current() != server {
+			return nil
+		}
+		return l.peer
+	})
+}
+
+// detach stops the delivery of packets to and from the current server.
+func (l *link) detach() {
+	l.mu.Lock()
+	l.server = nil
+	l.mu.Unlock()
+}
+
+// accept accepts a connection on the listening endpoint ep.
+func accept(t *testing.T, ep tcpip.Endpoint, wq *waiter.Queue) (tcpip.Endpoint, *waiter.Queue) {
+	t.Helper()
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventIn)
+	defer wq.EventUnregister(&we)
+
+	for {
+		n, nwq, err := ep.Accept()
+		if err == tcpip.ErrWouldBlock {
+			select {
+			case <-ch:
+				continue
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for a connection")
+			}
+		}
+		if err != nil {
+			t.Fatalf("Accept failed: %v", err)
+		}
+		return n, nwq
+	}
+}
+
+// socketPair returns the two ends of a unix socket connection.
+func socketPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "handoff.sock"))
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+
+	a, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	b, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	return a, b
+}
+
+func echo(t *testing.T, peer net.Conn, server net.Conn, msg string) {
+	t.Helper()
+
+	if _, err := peer.Write([]byte(msg)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatalf("Read by the server failed: %v", err)
+	}
+	if _, err := server.Write(buf); err != nil {
+		t.Fatalf("Write by the server failed: %v", err)
+	}
+	if _, err := io.ReadFull(peer, buf); err != nil {
+		t.Fatalf("Read by the peer failed: %v", err)
+	}
+	if string(buf) != msg {
+		t.Errorf("got echo %q, want %q", buf, msg)
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	peer, peerEP := newStack(t, peerAddr)
+	oldServer, oldEP := newStack(t, serverAddr)
+	newServer, newEP := newStack(t, serverAddr)
+
+	l := &link{peer: peerEP}
+	go forward(peerEP, l.current)
+	l.attach(oldEP)
+
+	var wq waiter.Queue
+	listener, err := oldServer.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := listener.Bind(tcpip.FullAddress{Port: serverPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := listener.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	c, err := gonet.DialTCP(peer, tcpip.FullAddress{NIC: nicID, Addr: serverAddr, Port: serverPort}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("DialTCP failed: %v", err)
+	}
+	defer c.Close()
+
+	ep, ewq := accept(t, listener, &wq)
+	echo(t, c, gonet.NewConn(ewq, ep), "before")
+
+	// Data written by the peer during the handoff is retransmitted to the
+	// new server.
+	l.detach()
+	if _, err := c.Write([]byte("during")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	a, b := socketPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	type received struct {
+		eps []tcpip.Endpoint
+		wqs []*waiter.Queue
+		err error
+	}
+	ch := make(chan received, 1)
+	go func() {
+		eps, wqs, err := Receive(b, newServer)
+		ch <- received{eps, wqs, err}
+	}()
+
+	if err := Send(a, oldServer, []tcpip.Endpoint{listener, ep}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	r := <-ch
+	if r.err != nil {
+		t.Fatalf("Receive failed: %v", r.err)
+	}
+	if len(r.eps) != 2 || len(r.wqs) != 2 {
+		t.Fatalf("got %d endpoints and %d queues, want 2", len(r.eps), len(r.wqs))
+	}
+	l.attach(newEP)
+
+	conn := gonet.NewConn(r.wqs[1], r.eps[1])
+	defer conn.Close()
+	buf := make([]byte, len("during"))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(buf) != "during" {
+		t.Errorf("got %q, want %q", buf, "during")
+	}
+	echo(t, c, conn, "after")
+
+	// The restored listener accepts new connections.
+	c2, err := gonet.DialTCP(peer, tcpip.FullAddress{NIC: nicID, Addr: serverAddr, Port: serverPort}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("DialTCP failed: %v", err)
+	}
+	defer c2.Close()
+	ep2, ewq2 := accept(t, r.eps[0], r.wqs[0])
+	echo(t, c2, gonet.NewConn(ewq2, ep2), "new")
+
+	// The old server doesn't hold the port anymore.
+	var wq2 waiter.Queue
+	ep3, err := oldServer.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq2)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep3.Close()
+	if err := ep3.Bind(tcpip.FullAddress{Port: serverPort}, nil); err != nil {
+		t.Errorf("Bind to the port of the detached endpoints failed: %v", err)
+	}
+}
+
+func TestSendNotSupported(t *testing.T) {
+	s, _ := newStack(t, serverAddr)
+
+	a, b := socketPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	type endpoint struct{ tcpip.Endpoint }
+	if err := Send(a, s, []tcpip.Endpoint{ep, endpoint{ep}}); err != tcpip.ErrNotSupported {
+		t.Fatalf("Send returned %v, want %v", err, tcpip.ErrNotSupported)
+	}
+
+	// Nothing was detached.
+	if err := ep.Bind(tcpip.FullAddress{Port: serverPort}, nil); err != nil {
+		t.Errorf("Bind failed: %v", err)
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package header
+
+import (
+	"encoding/binary"
+
+	"github.com/google/netstack/tcpip"
+)
+
+const (
+	dccpSrcPort    = 0
+	dccpDstPort    = 2
+	dccpDataOffset = 4
+	dccpCsCov      = 5
+	dccpChecksum   = 6
+	dccpType       = 8
+	dccpSeqNum     = 10
+	dccpAckNum     = 18
+)
+
+const (
+	// DCCPMinimumSize is the size of the generic header of DCCP packets
+	// with 48-bit sequence numbers, the only ones the stack handles.
+	DCCPMinimumSize = 16
+
+	// DCCPAckSubheaderSize is the size of the acknowledgement number
+	// subheader that follows the generic header of all the packets but
+	// Request and Data packets.
+	DCCPAckSubheaderSize = 8
+
+	// DCCPProtocolNumber is DCCP's transport protocol number.
+	DCCPProtocolNumber tcpip.TransportProtocolNumber = 33
+)
+
+// DCCPPacketType is the type of a DCCP packet.
+type DCCPPacketType uint8
+
+// The following are the types of the DCCP packets of RFC 4340, section 5.1.
+const (
+	DCCPRequest  DCCPPacketType = 0
+	DCCPResponse DCCPPacketType = 1
+	DCCPData     DCCPPacketType = 2
+	DCCPAck      DCCPPacketType = 3
+	DCCPDataAck  DCCPPacketType = 4
+	DCCPCloseReq DCCPPacketType = 5
+	DCCPClose    DCCPPacketType = 6
+	DCCPReset    DCCPPacketType = 7
+	DCCPSync     DCCPPacketType = 8
+	DCCPSyncAck  DCCPPacketType = 9
+)
+
+// DCCPResetCode is the reason of a DCCP Reset packet.
+type DCCPResetCode uint8
+
+// The following are the reset codes of RFC 4340, section 5.6.
+const (
+	DCCPResetUnspecified       DCCPResetCode = 0
+	DCCPResetClosed            DCCPResetCode = 1
+	DCCPResetAborted           DCCPResetCode = 2
+	DCCPResetNoConnection      DCCPResetCode = 3
+	DCCPResetPacketError       DCCPResetCode = 4
+	DCCPResetOptionError       DCCPResetCode = 5
+	DCCPResetMandatoryError    DCCPResetCode = 6
+	DCCPResetConnectionRefused DCCPResetCode = 7
+	DCCPResetBadServiceCode    DCCPResetCode = 8
+	DCCPResetTooBusy           DCCPResetCode = 9
+)
+
+// Types of the DCCP options understood by the stack. Options of types below 32
+// are a single byte; the others have a length.
+const (
+	DCCPOptionPadding    = 0
+	DCCPOptionMandatory  = 1
+	DCCPOptionAckVector0 = 38
+	DCCPOptionAckVector1 = 39
+)
+
+// States of the packets described by the bytes of Ack Vector options, per RFC
+// 4340, section 11.4. The state is stored in the two high bits of each byte,
+// and the run length, the number of older packets in the same state, in the
+// six low bits.
+const (
+	DCCPAckVectorReceived      = 0
+	DCCPAckVectorReceivedECN   = 1
+	DCCPAckVectorNotReceived   = 3
+	DCCPAckVectorMaxRunLength  = 63
+	dccpAckVectorStateShift    = 6
+	dccpAckVectorRunLengthMask = 0x3f
+)
+
+// DCCPFields contains the fields of a DCCP packet. It is used to describe the
+// fields of a packet that needs to be encoded.
+type DCCPFields struct {
+	// SrcPort is the "source port" field of a DCCP packet.
+	SrcPort uint16
+
+	// DstPort is the "destination port" field of a DCCP packet.
+	DstPort uint16
+
+	// DataOffset is the size of the header of a DCCP packet, options
+	// included, in bytes. It must be a multiple of 4.
+	DataOffset int
+
+	// Type is the "type" field of a DCCP packet.
+	Type DCCPPacketType
+
+	// SeqNum is the 48-bit "sequence number" field of a DCCP packet.
+	SeqNum uint64
+
+	// AckNum is the 48-bit "acknowledgement number" field of the DCCP
+	// packets that have one.
+	AckNum uint64
+
+	// ServiceCode is the "service code" field of Request and Response
+	// packets.
+	ServiceCode uint32
+
+	// ResetCode is the "reset code" field of Reset packets.
+	ResetCode DCCPResetCode
+}
+
+// DCCP represents a DCCP packet stored in a byte array: its header, options
+// included, followed by its payload. The fields are described in RFC 4340,
+// section 5.
+type DCCP []byte
+
+// DCCPHeaderSize returns the size of the header of DCCP packets of type t,
+// options excluded.
+func DCCPHeaderSize(t DCCPPacketType) int {
+	switch t {
+	case DCCPRequest:
+		return DCCPMinimumSize + 4
+	case DCCPData:
+		return DCCPMinimumSize
+	case DCCPResponse, DCCPReset:
+		return DCCPMinimumSize + DCCPAckSubheaderSize + 4
+	default:
+		return DCCPMinimumSize + DCCPAckSubheaderSize
+	}
+}
+
+// SourcePort returns the "source port" field of the dccp header.
+func (b DCCP) SourcePort() uint16 {
+	return binary.BigEndian.Uint16(b[dccpSrcPort:])
+}
+
+// DestinationPort returns the "destination port" field of the dccp header.
+func (b DCCP) DestinationPort() uint16 {
+	return binary.BigEndian.Uint16(b[dccpDstPort:])
+}
+
+// DataOffset returns the size of the header, options included, in bytes.
+func (b DCCP) DataOffset() int {
+	return int(b[dccpDataOffset]) * 4
+}
+
+// ChecksumCoverage returns the "checksum coverage" field of the dccp header.
+func (b DCCP) ChecksumCoverage() int {
+	return int(b[dccpCsCov] & 0xf)
+}
+
+// Checksum returns the "checksum" field of the dccp header.
+func (b DCCP) Checksum() uint16 {
+	return binary.BigEndian.Uint16(b[dccpChecksum:])
+}
+
+// Type returns the "type" field of the dccp header.
+func (b DCCP) Type() DCCPPacketType {
+	return DCCPPacketType(b[dccpType]>>1) & 0xf
+}
+
+// ExtendedSequence returns whether the packet has 48-bit sequence numbers.
+func (b DCCP) ExtendedSequence() bool {
+	return b[dccpType]&1 != 0
+}
+
+// SequenceNumber returns the 48-bit "sequence number" field of the dccp
+// header.
+func (b DCCP) SequenceNumber() uint64 {
+	return getUint48(b[dccpSeqNum:])
+}
+
+// AckNumber returns the 48-bit "acknowledgement number" field of the dccp
+// header. Request and Data packets have none.
+func (b DCCP) AckNumber() uint64 {
+	return getUint48(b[dccpAckNum:])
+}
+
+// ServiceCode returns the "service code" field of Request and Response
+// packets.
+func (b DCCP) ServiceCode() uint32 {
+	if b.Type() == DCCPRequest {
+		return binary.BigEndian.Uint32(b[DCCPMinimumSize:])
+	}
+	return binary.BigEndian.Uint32(b[DCCPMinimumSize+DCCPAckSubheaderSize:])
+}
+
+// ResetCode returns the "reset code" field of Reset packets.
+func (b DCCP) ResetCode() DCCPResetCode {
+	return DCCPResetCode(b[DCCPMinimumSize+DCCPAckSubheaderSize])
+}
+
+// Options returns the options of the packet.
+func (b DCCP) Options() []byte {
+	return b[DCCPHeaderSize(b.Type()):b.DataOffset()]
+}
+
+// Payload returns the data carried by the packet.
+func (b DCCP) Payload() []byte {
+	return b[b.DataOffset():]
+}
+
+// IsValid returns whether b holds a complete header with 48-bit sequence
+// numbers, of a known type.
+func (b DCCP) IsValid() bool {
+	if len(b) < DCCPMinimumSize || !b.ExtendedSequence() || b.Type() > DCCPSyncAck {
+		return false
+	}
+	offset := b.DataOffset()
+	return offset >= DCCPHeaderSize(b.Type()) && offset <= len(b)
+}
+
+// SetChecksum sets the "checksum" field of the dccp header.
+func (b DCCP) SetChecksum(checksum uint16) {
+	binary.BigEndian.PutUint16(b[dccpChecksum:], checksum)
+}
+
+// CoveredLength returns the number of bytes of the packet its checksum covers:
+// the header and, depending on the checksum coverage, some or all of the
+// payload, per RFC 4340, section 9.2.
+func (b DCCP) CoveredLength() int {
+	cov := b.ChecksumCoverage()
+	if cov == 0 {
+		return len(b)
+	}
+	n := b.DataOffset() + (cov-1)*4
+	if n > len(b) {
+		return len(b)
+	}
+	return n
+}
+
+// CalculateChecksum calculates the checksum of the dccp packet, which must be
+// complete, given the checksum of the network-layer pseudo-header (excluding
+// the total length).
+func (b DCCP) CalculateChecksum(partialChecksum uint16) uint16 {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(b)))
+	xsum := Checksum(length[:], partialChecksum)
+
+	// The checksum field itself is skipped.
+	xsum = Checksum(b[:dccpChecksum], xsum)
+	return Checksum(b[dccpChecksum+2:b.CoveredLength()], xsum)
+}
+
+// Encode encodes the fields of the dccp header, with full checksum coverage and
+// a zero checksum. The options, if any, follow the fields of the header for
+// packets of type d.Type, up to d.DataOffset.
+func (b DCCP) Encode(d *DCCPFields) {
+	binary.BigEndian.PutUint16(b[dccpSrcPort:], d.SrcPort)
+	binary.BigEndian.PutUint16(b[dccpDstPort:], d.DstPort)
+	b[dccpDataOffset] = uint8(d.DataOffset / 4)
+	b[dccpCsCov] = 0
+	binary.BigEndian.PutUint16(b[dccpChecksum:], 0)
+	b[dccpType] = uint8(d.Type)<<1 | 1
+	b[dccpType+1] = 0
+	putUint48(b[dccpSeqNum:], d.SeqNum)
+
+	switch d.Type {
+	case DCCPRequest:
+		binary.BigEndian.PutUint32(b[DCCPMinimumSize:], d.ServiceCode)
+		return
+	case DCCPData:
+		return
+	}
+
+	binary.BigEndian.PutUint16(b[DCCPMinimumSize:], 0)
+	putUint48(b[dccpAckNum:], d.AckNum)
+
+	switch d.Type {
+	case DCCPResponse:
+		binary.BigEndian.PutUint32(b[DCCPMinimumSize+DCCPAckSubheaderSize:], d.ServiceCode)
+	case DCCPReset:
+		o := DCCPMinimumSize + DCCPAckSubheaderSize
+		b[o] = uint8(d.ResetCode)
+		b[o+1], b[o+2], b[o+3] = 0, 0, 0
+	}
+}
+
+// NextDCCPOption splits the first option off opts, and returns its type, its
+// value and the options that follow it. It returns false if the option is
+// malformed.
+func NextDCCPOption(opts []byte) (t uint8, value []byte, rest []byte, ok bool) {
+	if len(opts) == 0 {
+		return 0, nil, nil, false
+	}
+	t = opts[0]
+	if t < 32 {
+		return t, nil, opts[1:], true
+	}
+	if len(opts) < 2 {
+		return 0, nil, nil, false
+	}
+	length := int(opts[1])
+	if length < 2 || length > len(opts) {
+		return 0, nil, nil, false
+	}
+	return t, opts[2:length], opts[length:], true
+}
+
+// DCCPAckVectorByte returns the Ack Vector byte describing a run of the given
+// length of packets in the given state.
+func DCCPAckVectorByte(state, runLength uint8) uint8 {
+	return state<<dccpAckVectorStateShift | runLength&dccpAckVectorRunLengthMask
+}
+
+// ParseDCCPAckVectorByte returns the state and the run length the Ack Vector
+// byte v describes.
+func ParseDCCPAckVectorByte(v uint8) (state, runLength uint8) {
+	return v >> dccpAckVectorStateShift, v & dccpAckVectorRunLengthMask
+}
+
+func getUint48(b []byte) uint64 {
+	return uint64(binary.BigEndian.Uint16(b))<<32 | uint64(binary.BigEndian.Uint32(b[2:]))
+}
+
+func putUint48(b []byte, v uint64) {
+	binary.BigEndian.PutUint16(b, uint16(v>>32))
+	binary.BigEndian.PutUint32(b[2:], uint32(v))
+}
@@ -0,0 +1,124 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package header
+
+// This file contains entry points for coverage-guided fuzzers such as go-fuzz
+// and libFuzzer. Each of them takes arbitrary bytes, applies the same
+// validation the stack applies to received packets, and then reads every
+// field the stack may read. They return 1 when the input was accepted by the
+// validation, so that the fuzzer gives it priority, and 0 otherwise.
+//
+// The functions don't need a stack, and can be used with go-fuzz as, e.g.:
+//
+//	go-fuzz-build -func FuzzIPv4 github.com/google/netstack/tcpip/header
+
+// FuzzIPv4 parses data as an IPv4 packet.
+func FuzzIPv4(data []byte) int {
+	h := IPv4(data)
+	if !h.IsValid() {
+		return 0
+	}
+
+	_ = h.ID()
+	_ = h.TTL()
+	_ = h.TransportProtocol()
+	_ = h.FragmentOffset()
+	_ = h.Flags()
+	_, _ = h.TOS()
+	_ = h.SourceAddress()
+	_ = h.DestinationAddress()
+	_ = h.CalculateChecksum()
+	_ = h.Payload()
+
+	// This is the view of the transport packet handed up by the stack.
+	hlen := int(h.HeaderLength())
+	tlen := int(h.TotalLength())
+	_ = data[hlen:tlen]
+
+	return 1
+}
+
+// FuzzIPv6 parses data as an IPv6 packet.
+func FuzzIPv6(data []byte) int {
+	h := IPv6(data)
+	if !h.IsValid() {
+		return 0
+	}
+
+	_ = h.HopLimit()
+	_ = h.TransportProtocol()
+	_, _ = h.TOS()
+	_ = h.SourceAddress()
+	_ = h.DestinationAddress()
+	_ = h.Payload()
+
+	// This is the view of the transport packet handed up by the stack.
+	_ = data[IPv6MinimumSize:][:h.PayloadLength()]
+
+	return 1
+}
+
+// FuzzTCP parses data as a TCP segment. Segments are also parsed by
+// tcp.FuzzSegment, which goes through the code of the tcp package.
+func FuzzTCP(data []byte) int {
+	h := TCP(data)
+	if len(h) < TCPMinimumSize {
+		return 0
+	}
+
+	if offset := int(h.DataOffset()); offset < TCPMinimumSize || offset > len(h) {
+		return 0
+	}
+
+	_ = h.SourcePort()
+	_ = h.DestinationPort()
+	_ = h.SequenceNumber()
+	_ = h.AckNumber()
+	_ = h.Flags()
+	_ = h.WindowSize()
+	_ = h.Checksum()
+	_ = h.CalculateChecksum(0, uint16(len(h)))
+	_ = h.Payload()
+	_, _ = ParseMSSOption(h.Options())
+
+	return 1
+}
+
+// FuzzUDP parses data as a UDP datagram.
+func FuzzUDP(data []byte) int {
+	h := UDP(data)
+	if len(h) < UDPMinimumSize || int(h.Length()) > len(h) {
+		return 0
+	}
+
+	_ = h.SourcePort()
+	_ = h.DestinationPort()
+	_ = h.Checksum()
+	_ = Checksum(data[:h.Length()], 0)
+	_ = h.Payload()
+
+	return 1
+}
+
+// FuzzICMPv6 parses data as an ICMPv6 packet, including the neighbor discovery
+// messages handled by the stack.
+func FuzzICMPv6(data []byte) int {
+	h := ICMPv6(data)
+	if len(h) < ICMPv6MinimumSize {
+		return 0
+	}
+
+	_ = h.Code()
+	_ = h.Checksum()
+	switch h.Type() {
+	case ICMPv6NeighborSolicit, ICMPv6NeighborAdvert:
+		if len(h) < ICMPv6NeighborSolicitMinimumSize {
+			return 0
+		}
+		_ = h.NDPTargetAddress()
+	}
+
+	return 1
+}
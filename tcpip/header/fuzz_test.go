@@ -0,0 +1,105 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package header_test
+
+import (
+	"testing"
+
+	"github.com/google/netstack/tcpip/header"
+)
+
+// The fuzz tests below run the fuzzing entry points with go test -fuzz, and
+// otherwise check that they accept well-formed packets.
+
+func FuzzIPv4(f *testing.F) {
+	b := header.IPv4(make([]byte, header.IPv4MinimumSize+4))
+	b.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(b)),
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     "\x0a\x00\x00\x01",
+		DstAddr:     "\x0a\x00\x00\x02",
+	})
+	if header.FuzzIPv4(b) != 1 {
+		f.Fatalf("FuzzIPv4 rejected a valid packet")
+	}
+
+	f.Add([]byte(b))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		header.FuzzIPv4(data)
+	})
+}
+
+func FuzzIPv6(f *testing.F) {
+	b := header.IPv6(make([]byte, header.IPv6MinimumSize+4))
+	b.Encode(&header.IPv6Fields{
+		PayloadLength: 4,
+		NextHeader:    uint8(header.UDPProtocolNumber),
+		HopLimit:      64,
+		SrcAddr:       "\x0a\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01",
+		DstAddr:       "\x0a\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02",
+	})
+	if header.FuzzIPv6(b) != 1 {
+		f.Fatalf("FuzzIPv6 rejected a valid packet")
+	}
+
+	f.Add([]byte(b))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		header.FuzzIPv6(data)
+	})
+}
+
+func FuzzTCP(f *testing.F) {
+	b := header.TCP(make([]byte, header.TCPMinimumSize+header.TCPOptionMSSLength))
+	b.Encode(&header.TCPFields{
+		SrcPort:    1234,
+		DstPort:    80,
+		SeqNum:     1,
+		DataOffset: uint8(len(b)),
+		Flags:      header.TCPFlagSyn,
+		WindowSize: 0xffff,
+	})
+	header.EncodeMSSOption(1460, b[header.TCPMinimumSize:])
+	if header.FuzzTCP(b) != 1 {
+		f.Fatalf("FuzzTCP rejected a valid segment")
+	}
+
+	f.Add([]byte(b))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		header.FuzzTCP(data)
+	})
+}
+
+func FuzzUDP(f *testing.F) {
+	b := header.UDP(make([]byte, header.UDPMinimumSize+4))
+	b.Encode(&header.UDPFields{
+		SrcPort: 1234,
+		DstPort: 53,
+		Length:  uint16(len(b)),
+	})
+	if header.FuzzUDP(b) != 1 {
+		f.Fatalf("FuzzUDP rejected a valid datagram")
+	}
+
+	f.Add([]byte(b))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		header.FuzzUDP(data)
+	})
+}
+
+func FuzzICMPv6(f *testing.F) {
+	b := header.ICMPv6(make([]byte, header.ICMPv6NeighborSolicitMinimumSize))
+	b.SetType(header.ICMPv6NeighborSolicit)
+	b.SetNDPTargetAddress("\x0a\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+	if header.FuzzICMPv6(b) != 1 {
+		f.Fatalf("FuzzICMPv6 rejected a valid packet")
+	}
+
+	f.Add([]byte(b))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		header.FuzzICMPv6(data)
+	})
+}
@@ -0,0 +1,207 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package header
+
+import (
+	"encoding/binary"
+
+	"github.com/google/netstack/tcpip"
+)
+
+const (
+	geneveVerOptLen = 0
+	geneveFlags     = 1
+	geneveProtocol  = 2
+	geneveVNI       = 4
+	geneveOptions   = 8
+
+	geneveOptClass  = 0
+	geneveOptType   = 2
+	geneveOptLength = 3
+)
+
+// GeneveFields contains the fields of a Geneve header. It is used to describe
+// the fields of a header that needs to be encoded.
+type GeneveFields struct {
+	// OAM is the "O" flag of the header, set on control packets.
+	OAM bool
+
+	// Critical is the "C" flag of the header, set if any of the options
+	// is critical.
+	Critical bool
+
+	// Protocol is the "protocol type" field of the header, the EtherType
+	// of the encapsulated packet.
+	Protocol tcpip.NetworkProtocolNumber
+
+	// VNI is the "virtual network identifier" field of the header.
+	VNI uint32
+
+	// Options are the options of the header, in the encoding of
+	// EncodeGeneveOptions.
+	Options []byte
+}
+
+// Geneve represents a Geneve header stored in a byte array, per RFC 8926. It
+// is followed by the encapsulated packet.
+type Geneve []byte
+
+const (
+	// GeneveMinimumSize is the size of a Geneve header without options.
+	GeneveMinimumSize = 8
+
+	// GeneveMaxOptionsSize is the largest size of the options of a Geneve
+	// header.
+	GeneveMaxOptionsSize = 0x3f * 4
+
+	// GenevePort is the UDP port assigned to Geneve by IANA.
+	GenevePort = 6081
+
+	// GeneveMaxVNI is the largest Geneve virtual network identifier.
+	GeneveMaxVNI = 1<<24 - 1
+
+	// GeneveVersion is the version of the Geneve headers encoded.
+	GeneveVersion = 0
+
+	// GeneveOptionHeaderSize is the size of the header of Geneve options.
+	GeneveOptionHeaderSize = 4
+
+	// GeneveMaxOptionDataSize is the largest size of the data of a Geneve
+	// option.
+	GeneveMaxOptionDataSize = 0x1f * 4
+
+	// GeneveOptionCritical is the bit of the type of critical Geneve
+	// options, which must be dropped by receivers that don't understand
+	// them.
+	GeneveOptionCritical = 0x80
+
+	// TransparentEthernetProtocolNumber is the EtherType of encapsulated
+	// ethernet frames.
+	TransparentEthernetProtocolNumber tcpip.NetworkProtocolNumber = 0x6558
+)
+
+// Version returns the "version" field of the header.
+func (b Geneve) Version() uint8 {
+	return b[geneveVerOptLen] >> 6
+}
+
+// OptionsLength returns the length of the options of the header, in bytes.
+func (b Geneve) OptionsLength() int {
+	return int(b[geneveVerOptLen]&0x3f) * 4
+}
+
+// HeaderLength returns the length of the header, including its options.
+func (b Geneve) HeaderLength() int {
+	return GeneveMinimumSize + b.OptionsLength()
+}
+
+// OAM returns the "O" flag of the header.
+func (b Geneve) OAM() bool {
+	return b[geneveFlags]&0x80 != 0
+}
+
+// Critical returns the "C" flag of the header.
+func (b Geneve) Critical() bool {
+	return b[geneveFlags]&0x40 != 0
+}
+
+// Protocol returns the "protocol type" field of the header.
+func (b Geneve) Protocol() tcpip.NetworkProtocolNumber {
+	return tcpip.NetworkProtocolNumber(binary.BigEndian.Uint16(b[geneveProtocol:]))
+}
+
+// VNI returns the "virtual network identifier" field of the header.
+func (b Geneve) VNI() uint32 {
+	return binary.BigEndian.Uint32(b[geneveVNI:]) >> 8
+}
+
+// Options returns the options of the header.
+func (b Geneve) Options() []byte {
+	return b[geneveOptions:b.HeaderLength()]
+}
+
+// IsValid returns whether b holds a header of the version encoded, with its
+// options.
+func (b Geneve) IsValid() bool {
+	return len(b) >= GeneveMinimumSize && b.Version() == GeneveVersion && b.HeaderLength() <= len(b)
+}
+
+// Encode encodes all the fields of the Geneve header, which must be large
+// enough for its options. The reserved fields are zeroed.
+func (b Geneve) Encode(g *GeneveFields) {
+	b[geneveVerOptLen] = GeneveVersion<<6 | uint8(len(g.Options)/4)
+	b[geneveFlags] = 0
+	if g.OAM {
+		b[geneveFlags] |= 0x80
+	}
+	if g.Critical {
+		b[geneveFlags] |= 0x40
+	}
+	binary.BigEndian.PutUint16(b[geneveProtocol:], uint16(g.Protocol))
+	binary.BigEndian.PutUint32(b[geneveVNI:], g.VNI<<8)
+	copy(b[geneveOptions:], g.Options)
+}
+
+// GeneveOption is a Geneve option, a type-length-value.
+type GeneveOption struct {
+	// Class is the "option class" field of the option, the namespace of
+	// its type.
+	Class uint16
+
+	// Type is the "type" field of the option. Its high-order bit is
+	// GeneveOptionCritical.
+	Type uint8
+
+	// Data is the data of the option. Its length is a multiple of 4, up
+	// to GeneveMaxOptionDataSize.
+	Data []byte
+}
+
+// IsCritical returns whether the option is critical.
+func (o *GeneveOption) IsCritical() bool {
+	return o.Type&GeneveOptionCritical != 0
+}
+
+// EncodeGeneveOptions returns the encoding of opts, for GeneveFields.Options,
+// and whether any of them is critical. It returns false if an option is
+// malformed or if they don't fit in a header.
+func EncodeGeneveOptions(opts []GeneveOption) (b []byte, critical bool, ok bool) {
+	for _, o := range opts {
+		n := len(o.Data)
+		if n%4 != 0 || n > GeneveMaxOptionDataSize {
+			return nil, false, false
+		}
+		var h [GeneveOptionHeaderSize]byte
+		binary.BigEndian.PutUint16(h[geneveOptClass:], o.Class)
+		h[geneveOptType] = o.Type
+		h[geneveOptLength] = uint8(n / 4)
+		b = append(b, h[:]...)
+		b = append(b, o.Data...)
+		critical = critical || o.IsCritical()
+	}
+	if len(b) > GeneveMaxOptionsSize {
+		return nil, false, false
+	}
+	return b, critical, true
+}
+
+// NextGeneveOption splits the first option off opts, and returns it with the
+// options that follow it. It returns false if the option is malformed. The
+// option aliases opts.
+func NextGeneveOption(opts []byte) (o GeneveOption, rest []byte, ok bool) {
+	if len(opts) < GeneveOptionHeaderSize {
+		return GeneveOption{}, nil, false
+	}
+	length := GeneveOptionHeaderSize + int(opts[geneveOptLength]&0x1f)*4
+	if length > len(opts) {
+		return GeneveOption{}, nil, false
+	}
+	o = GeneveOption{
+		Class: binary.BigEndian.Uint16(opts[geneveOptClass:]),
+		Type:  opts[geneveOptType],
+		Data:  opts[GeneveOptionHeaderSize:length],
+	}
+	return o, opts[length:], true
+}
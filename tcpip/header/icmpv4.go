@@ -0,0 +1,102 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package header
+
+import (
+	"encoding/binary"
+
+	"github.com/google/netstack/tcpip"
+)
+
+const (
+	icmpv4Type     = 0
+	icmpv4Code     = 1
+	icmpv4Checksum = 2
+	icmpv4Ident    = 4
+	icmpv4Sequence = 6
+)
+
+// ICMPv4 represents an ICMPv4 header stored in a byte array.
+type ICMPv4 []byte
+
+// ICMPv4Type is the ICMP type field described in RFC 792.
+type ICMPv4Type byte
+
+// Values for the ICMPv4 type field.
+const (
+	ICMPv4EchoReply      ICMPv4Type = 0
+	ICMPv4DstUnreachable ICMPv4Type = 3
+	ICMPv4Echo           ICMPv4Type = 8
+	ICMPv4TimeExceeded   ICMPv4Type = 11
+	ICMPv4ParamProblem   ICMPv4Type = 12
+)
+
+const (
+	// ICMPv4MinimumSize is the minimum size of a valid ICMPv4 packet. All
+	// messages start with a header of this size, whose last four bytes
+	// depend on the type.
+	ICMPv4MinimumSize = 8
+
+	// ICMPv4ProtocolNumber is ICMPv4's transport protocol number.
+	ICMPv4ProtocolNumber tcpip.TransportProtocolNumber = 1
+)
+
+// Type returns the "type" field of the icmpv4 header.
+func (b ICMPv4) Type() ICMPv4Type {
+	return ICMPv4Type(b[icmpv4Type])
+}
+
+// SetType sets the "type" field of the icmpv4 header.
+func (b ICMPv4) SetType(t ICMPv4Type) {
+	b[icmpv4Type] = byte(t)
+}
+
+// Code returns the "code" field of the icmpv4 header.
+func (b ICMPv4) Code() byte {
+	return b[icmpv4Code]
+}
+
+// SetCode sets the "code" field of the icmpv4 header.
+func (b ICMPv4) SetCode(c byte) {
+	b[icmpv4Code] = c
+}
+
+// Checksum returns the "checksum" field of the icmpv4 header.
+func (b ICMPv4) Checksum() uint16 {
+	return binary.BigEndian.Uint16(b[icmpv4Checksum:])
+}
+
+// SetChecksum sets the "checksum" field of the icmpv4 header.
+func (b ICMPv4) SetChecksum(checksum uint16) {
+	binary.BigEndian.PutUint16(b[icmpv4Checksum:], checksum)
+}
+
+// Ident returns the "identifier" field of an echo request or reply.
+func (b ICMPv4) Ident() uint16 {
+	return binary.BigEndian.Uint16(b[icmpv4Ident:])
+}
+
+// SetIdent sets the "identifier" field of an echo request or reply.
+func (b ICMPv4) SetIdent(ident uint16) {
+	binary.BigEndian.PutUint16(b[icmpv4Ident:], ident)
+}
+
+// Sequence returns the "sequence number" field of an echo request or reply.
+func (b ICMPv4) Sequence() uint16 {
+	return binary.BigEndian.Uint16(b[icmpv4Sequence:])
+}
+
+// SetSequence sets the "sequence number" field of an echo request or reply.
+func (b ICMPv4) SetSequence(sequence uint16) {
+	binary.BigEndian.PutUint16(b[icmpv4Sequence:], sequence)
+}
+
+// ICMPv4Checksum calculates the checksum of the icmpv4 message b, which, unlike
+// those of other transport protocols, doesn't cover a pseudo-header. The
+// checksum field must be zero when calculating the checksum of a message to be
+// sent; a received message is valid if its checksum, calculated as is, is zero.
+func ICMPv4Checksum(b ICMPv4) uint16 {
+	return ^Checksum(b, 0)
+}
@@ -0,0 +1,142 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package header
+
+import (
+	"encoding/binary"
+
+	"github.com/google/netstack/tcpip"
+)
+
+const (
+	icmpv6Type     = 0
+	icmpv6Code     = 1
+	icmpv6Checksum = 2
+	icmpv6Ident    = 4
+	icmpv6Sequence = 6
+	ndpTarget      = 8
+)
+
+// ICMPv6 represents an ICMPv6 header stored in a byte array.
+type ICMPv6 []byte
+
+// ICMPv6Type is the ICMP type field described in RFC 4443.
+type ICMPv6Type byte
+
+// Values for the ICMPv6 type field of error and informational messages.
+const (
+	ICMPv6DstUnreachable ICMPv6Type = 1
+	ICMPv6PacketTooBig   ICMPv6Type = 2
+	ICMPv6TimeExceeded   ICMPv6Type = 3
+	ICMPv6ParamProblem   ICMPv6Type = 4
+	ICMPv6EchoRequest    ICMPv6Type = 128
+	ICMPv6EchoReply      ICMPv6Type = 129
+)
+
+// Values for the ICMPv6 type field used by the neighbor discovery protocol,
+// described in RFC 4861.
+const (
+	ICMPv6NeighborSolicit ICMPv6Type = 135
+	ICMPv6NeighborAdvert  ICMPv6Type = 136
+)
+
+const (
+	// ICMPv6MinimumSize is the minimum size of a valid ICMPv6 packet.
+	ICMPv6MinimumSize = 4
+
+	// ICMPv6EchoMinimumSize is the minimum size of a valid echo request
+	// or reply, and of the header of errors, which is followed by as much
+	// of the packet that caused them as fits.
+	ICMPv6EchoMinimumSize = 8
+
+	// ICMPv6NeighborSolicitMinimumSize is the minimum size of a valid
+	// neighbor solicitation, which has the same layout as a neighbor
+	// advertisement when options are left out.
+	ICMPv6NeighborSolicitMinimumSize = 24
+
+	// ICMPv6ProtocolNumber is ICMPv6's transport protocol number.
+	ICMPv6ProtocolNumber tcpip.TransportProtocolNumber = 58
+
+	// NDPHopLimit is the hop limit of the packets of the neighbor
+	// discovery protocol. Packets received with a different hop limit
+	// weren't sent by a neighbor and must be discarded.
+	NDPHopLimit = 255
+)
+
+// Type returns the "type" field of the icmpv6 header.
+func (b ICMPv6) Type() ICMPv6Type {
+	return ICMPv6Type(b[icmpv6Type])
+}
+
+// SetType sets the "type" field of the icmpv6 header.
+func (b ICMPv6) SetType(t ICMPv6Type) {
+	b[icmpv6Type] = byte(t)
+}
+
+// Code returns the "code" field of the icmpv6 header.
+func (b ICMPv6) Code() byte {
+	return b[icmpv6Code]
+}
+
+// SetCode sets the "code" field of the icmpv6 header.
+func (b ICMPv6) SetCode(c byte) {
+	b[icmpv6Code] = c
+}
+
+// Checksum returns the "checksum" field of the icmpv6 header.
+func (b ICMPv6) Checksum() uint16 {
+	return binary.BigEndian.Uint16(b[icmpv6Checksum:])
+}
+
+// SetChecksum sets the "checksum" field of the icmpv6 header.
+func (b ICMPv6) SetChecksum(checksum uint16) {
+	binary.BigEndian.PutUint16(b[icmpv6Checksum:], checksum)
+}
+
+// Ident returns the "identifier" field of an echo request or reply.
+func (b ICMPv6) Ident() uint16 {
+	return binary.BigEndian.Uint16(b[icmpv6Ident:])
+}
+
+// SetIdent sets the "identifier" field of an echo request or reply.
+func (b ICMPv6) SetIdent(ident uint16) {
+	binary.BigEndian.PutUint16(b[icmpv6Ident:], ident)
+}
+
+// Sequence returns the "sequence number" field of an echo request or reply.
+func (b ICMPv6) Sequence() uint16 {
+	return binary.BigEndian.Uint16(b[icmpv6Sequence:])
+}
+
+// SetSequence sets the "sequence number" field of an echo request or reply.
+func (b ICMPv6) SetSequence(sequence uint16) {
+	binary.BigEndian.PutUint16(b[icmpv6Sequence:], sequence)
+}
+
+// NDPTargetAddress returns the "target address" field of a neighbor
+// solicitation or advertisement.
+func (b ICMPv6) NDPTargetAddress() tcpip.Address {
+	return tcpip.Address(b[ndpTarget : ndpTarget+IPv6AddressSize])
+}
+
+// SetNDPTargetAddress sets the "target address" field of a neighbor
+// solicitation or advertisement.
+func (b ICMPv6) SetNDPTargetAddress(addr tcpip.Address) {
+	copy(b[ndpTarget:ndpTarget+IPv6AddressSize], addr)
+}
+
+// ICMPv6Checksum calculates the checksum of the icmpv6 message b, including the
+// IPv6 pseudo-header built from the given addresses. The checksum field must be
+// zero when calculating the checksum of a message to be sent; a received
+// message is valid if its checksum, calculated as is, is zero.
+func ICMPv6Checksum(b ICMPv6, src, dst tcpip.Address) uint16 {
+	xsum := PseudoHeaderChecksum(ICMPv6ProtocolNumber, src, dst)
+
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(b)))
+	xsum = Checksum(length[:], xsum)
+
+	return ^Checksum(b, xsum)
+}
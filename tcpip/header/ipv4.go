@@ -80,6 +80,10 @@ const (
 
 	// IPv4Version is the version of the ipv4 procotol.
 	IPv4Version = 4
+
+	// IPv4MinimumMTU is the minimum MTU required by IPv4, per RFC 791,
+	// section 3.2.
+	IPv4MinimumMTU = 68
 )
 
 // Flags that may be set in an IPv4 packet.
@@ -180,6 +184,11 @@ func (b IPv4) SetTotalLength(totalLength uint16) {
 	binary.BigEndian.PutUint16(b[totalLen:], totalLength)
 }
 
+// SetTTL sets the "TTL" field of the ipv4 header.
+func (b IPv4) SetTTL(v uint8) {
+	b[ttl] = v
+}
+
 // SetChecksum sets the checksum field of the ipv4 header.
 func (b IPv4) SetChecksum(v uint16) {
 	binary.BigEndian.PutUint16(b[checksum:], v)
@@ -246,3 +255,9 @@ func (b IPv4) IsValid() bool {
 
 	return true
 }
+
+// IsV4MulticastAddress returns whether addr is an IPv4 multicast address, that
+// is, belongs to 224.0.0.0/4.
+func IsV4MulticastAddress(addr tcpip.Address) bool {
+	return len(addr) == IPv4AddressSize && addr[0]&0xf0 == 0xe0
+}
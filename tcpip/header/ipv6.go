@@ -65,6 +65,30 @@ const (
 	IPv6MinimumMTU = 1280
 )
 
+const (
+	// IPv6Any is the unspecified IPv6 address, used as the source address
+	// of packets sent before an address is assigned.
+	IPv6Any tcpip.Address = "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+
+	// IPv6AllNodesMulticastAddress is the link-local multicast address of
+	// all IPv6 nodes, ff02::1.
+	IPv6AllNodesMulticastAddress tcpip.Address = "\xff\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"
+)
+
+// IsV6MulticastAddress returns whether addr is an IPv6 multicast address, that
+// is, belongs to ff00::/8.
+func IsV6MulticastAddress(addr tcpip.Address) bool {
+	return len(addr) == IPv6AddressSize && addr[0] == 0xff
+}
+
+// SolicitedNodeAddr returns the solicited-node multicast address of addr, which
+// is where neighbor solicitations for addr are sent, per RFC 4291, section
+// 2.7.1.
+func SolicitedNodeAddr(addr tcpip.Address) tcpip.Address {
+	const prefix = "\xff\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\xff"
+	return prefix + addr[len(addr)-3:]
+}
+
 // PayloadLength returns the value of the "payload length" field of the ipv6
 // header.
 func (b IPv6) PayloadLength() uint16 {
@@ -125,6 +149,11 @@ func (b IPv6) SetPayloadLength(payloadLength uint16) {
 	binary.BigEndian.PutUint16(b[payloadLen:], payloadLength)
 }
 
+// SetHopLimit sets the "hop limit" field of the ipv6 header.
+func (b IPv6) SetHopLimit(v uint8) {
+	b[hopLimit] = v
+}
+
 // SetSourceAddress sets the "source address" field of the ipv6 header.
 func (b IPv6) SetSourceAddress(addr tcpip.Address) {
 	copy(b[v6SrcAddr:v6SrcAddr+IPv6AddressSize], addr)
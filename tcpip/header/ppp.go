@@ -0,0 +1,147 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package header
+
+import (
+	"encoding/binary"
+)
+
+const (
+	pppControlCode   = 0
+	pppControlID     = 1
+	pppControlLength = 2
+
+	pppOptionType   = 0
+	pppOptionLength = 1
+)
+
+// PPPProtocolSize is the size of the "protocol" field of PPP packets, which
+// precedes their information field. PPP packets carried by PPPoE have no
+// address and control fields.
+const PPPProtocolSize = 2
+
+// The protocols of PPP packets.
+const (
+	PPPProtocolIPv4 = 0x0021
+	PPPProtocolIPv6 = 0x0057
+	PPPProtocolIPCP = 0x8021
+	PPPProtocolLCP  = 0xc021
+	PPPProtocolPAP  = 0xc023
+	PPPProtocolCHAP = 0xc223
+)
+
+// PPPControlFields contains the fields of the header of a PPP control packet,
+// that is, an LCP or NCP packet. It is used to describe the fields of a packet
+// that needs to be encoded.
+type PPPControlFields struct {
+	// Code is the "code" field of the packet.
+	Code uint8
+
+	// ID is the "identifier" field of the packet, which matches replies
+	// to requests.
+	ID uint8
+
+	// Length is the "length" field of the packet, the length of the packet
+	// including its header.
+	Length uint16
+}
+
+// PPPControl represents a PPP control packet stored in a byte array, per RFC
+// 1661, section 5.
+type PPPControl []byte
+
+const (
+	// PPPControlHeaderSize is the size of the header of PPP control
+	// packets.
+	PPPControlHeaderSize = 4
+
+	// PPPOptionHeaderSize is the size of the header of the configuration
+	// options of PPP control packets.
+	PPPOptionHeaderSize = 2
+
+	// PPPDefaultMRU is the MRU of PPP links whose MRU wasn't negotiated.
+	PPPDefaultMRU = 1500
+)
+
+// The codes of PPP control packets. The codes from Configure-Request to
+// Code-Reject are common to LCP and the NCPs, the other ones are LCP's.
+const (
+	PPPConfigureRequest = 1
+	PPPConfigureAck     = 2
+	PPPConfigureNak     = 3
+	PPPConfigureReject  = 4
+	PPPTerminateRequest = 5
+	PPPTerminateAck     = 6
+	PPPCodeReject       = 7
+	PPPProtocolReject   = 8
+	PPPEchoRequest      = 9
+	PPPEchoReply        = 10
+	PPPDiscardRequest   = 11
+)
+
+// The types of the configuration options of LCP, and of IPCP, including the
+// DNS options of RFC 1877.
+const (
+	LCPOptionMRU          = 1
+	LCPOptionAuthProtocol = 3
+	LCPOptionMagicNumber  = 5
+
+	IPCPOptionIPAddress    = 3
+	IPCPOptionPrimaryDNS   = 129
+	IPCPOptionSecondaryDNS = 131
+)
+
+// IsValid returns whether b holds a packet, which may be followed by padding.
+func (b PPPControl) IsValid() bool {
+	return len(b) >= PPPControlHeaderSize && int(b.Length()) >= PPPControlHeaderSize && int(b.Length()) <= len(b)
+}
+
+// Code returns the "code" field of the packet.
+func (b PPPControl) Code() uint8 {
+	return b[pppControlCode]
+}
+
+// ID returns the "identifier" field of the packet.
+func (b PPPControl) ID() uint8 {
+	return b[pppControlID]
+}
+
+// Length returns the "length" field of the packet.
+func (b PPPControl) Length() uint16 {
+	return binary.BigEndian.Uint16(b[pppControlLength:])
+}
+
+// Data returns the data of the packet, e.g., the configuration options of
+// Configure packets.
+func (b PPPControl) Data() []byte {
+	return b[PPPControlHeaderSize:b.Length()]
+}
+
+// Encode encodes all the fields of the header of the PPP control packet.
+func (b PPPControl) Encode(p *PPPControlFields) {
+	b[pppControlCode] = p.Code
+	b[pppControlID] = p.ID
+	binary.BigEndian.PutUint16(b[pppControlLength:], p.Length)
+}
+
+// AppendPPPOption appends the configuration option of type t with the given
+// value to opts.
+func AppendPPPOption(opts []byte, t uint8, value []byte) []byte {
+	return append(append(opts, t, uint8(PPPOptionHeaderSize+len(value))), value...)
+}
+
+// NextPPPOption splits the first configuration option off opts, and returns
+// its type, its value and the options that follow it. It returns false if the
+// option is malformed.
+func NextPPPOption(opts []byte) (t uint8, value []byte, rest []byte, ok bool) {
+	if len(opts) < PPPOptionHeaderSize {
+		return 0, nil, nil, false
+	}
+	length := int(opts[pppOptionLength])
+	if length < PPPOptionHeaderSize || length > len(opts) {
+		return 0, nil, nil, false
+	}
+	return opts[pppOptionType], opts[PPPOptionHeaderSize:length], opts[length:], true
+}
@@ -0,0 +1,141 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package header
+
+import (
+	"encoding/binary"
+
+	"github.com/google/netstack/tcpip"
+)
+
+const (
+	pppoeVerType   = 0
+	pppoeCode      = 1
+	pppoeSessionID = 2
+	pppoeLength    = 4
+
+	pppoeTagType   = 0
+	pppoeTagLength = 2
+)
+
+// PPPoEFields contains the fields of a PPPoE header. It is used to describe the
+// fields of a header that needs to be encoded.
+type PPPoEFields struct {
+	// Code is the "code" field of the header.
+	Code uint8
+
+	// SessionID is the "session ID" field of the header.
+	SessionID uint16
+
+	// Length is the "length" field of the header, the length of its
+	// payload.
+	Length uint16
+}
+
+// PPPoE represents a PPPoE header stored in a byte array, per RFC 2516. It is
+// followed by the tags of discovery packets, or by the PPP packet of session
+// packets.
+type PPPoE []byte
+
+const (
+	// PPPoESize is the size of a PPPoE header.
+	PPPoESize = 6
+
+	// PPPoEDiscoveryProtocolNumber and PPPoESessionProtocolNumber are the
+	// EtherTypes of PPPoE discovery and session packets.
+	PPPoEDiscoveryProtocolNumber tcpip.NetworkProtocolNumber = 0x8863
+	PPPoESessionProtocolNumber   tcpip.NetworkProtocolNumber = 0x8864
+
+	// PPPoEMaxPayload is the largest payload of PPPoE packets in ethernet
+	// frames of 1500 bytes.
+	PPPoEMaxPayload = 1500 - PPPoESize - PPPProtocolSize
+
+	// PPPoETagHeaderSize is the size of the header of PPPoE tags.
+	PPPoETagHeaderSize = 4
+
+	// pppoeVersionType is the version and type of the headers, both 1.
+	pppoeVersionType = 0x11
+)
+
+// The codes of PPPoE packets.
+const (
+	PPPoECodeSession = 0x00
+	PPPoECodePADO    = 0x07
+	PPPoECodePADI    = 0x09
+	PPPoECodePADR    = 0x19
+	PPPoECodePADS    = 0x65
+	PPPoECodePADT    = 0xa7
+)
+
+// The types of the tags of PPPoE discovery packets, including the
+// PPP-Max-Payload tag of RFC 4638.
+const (
+	PPPoETagEndOfList        = 0x0000
+	PPPoETagServiceName      = 0x0101
+	PPPoETagACName           = 0x0102
+	PPPoETagHostUniq         = 0x0103
+	PPPoETagACCookie         = 0x0104
+	PPPoETagRelaySessionID   = 0x0110
+	PPPoETagPPPMaxPayload    = 0x0120
+	PPPoETagServiceNameError = 0x0201
+	PPPoETagACSystemError    = 0x0202
+	PPPoETagGenericError     = 0x0203
+)
+
+// IsValid returns whether b holds a header of the version and type encoded,
+// with its payload.
+func (b PPPoE) IsValid() bool {
+	return len(b) >= PPPoESize && b[pppoeVerType] == pppoeVersionType && PPPoESize+int(b.Length()) <= len(b)
+}
+
+// Code returns the "code" field of the header.
+func (b PPPoE) Code() uint8 {
+	return b[pppoeCode]
+}
+
+// SessionID returns the "session ID" field of the header.
+func (b PPPoE) SessionID() uint16 {
+	return binary.BigEndian.Uint16(b[pppoeSessionID:])
+}
+
+// Length returns the "length" field of the header.
+func (b PPPoE) Length() uint16 {
+	return binary.BigEndian.Uint16(b[pppoeLength:])
+}
+
+// Payload returns the payload of the packet, without the padding of the frame.
+func (b PPPoE) Payload() []byte {
+	return b[PPPoESize:][:b.Length()]
+}
+
+// Encode encodes all the fields of the PPPoE header.
+func (b PPPoE) Encode(p *PPPoEFields) {
+	b[pppoeVerType] = pppoeVersionType
+	b[pppoeCode] = p.Code
+	binary.BigEndian.PutUint16(b[pppoeSessionID:], p.SessionID)
+	binary.BigEndian.PutUint16(b[pppoeLength:], p.Length)
+}
+
+// AppendPPPoETag appends the tag of type t with the given value to tags.
+func AppendPPPoETag(tags []byte, t uint16, value []byte) []byte {
+	var h [PPPoETagHeaderSize]byte
+	binary.BigEndian.PutUint16(h[pppoeTagType:], t)
+	binary.BigEndian.PutUint16(h[pppoeTagLength:], uint16(len(value)))
+	return append(append(tags, h[:]...), value...)
+}
+
+// NextPPPoETag splits the first tag off tags, and returns its type, its value
+// and the tags that follow it. It returns false if the tag is malformed.
+func NextPPPoETag(tags []byte) (t uint16, value []byte, rest []byte, ok bool) {
+	if len(tags) < PPPoETagHeaderSize {
+		return 0, nil, nil, false
+	}
+	t = binary.BigEndian.Uint16(tags[pppoeTagType:])
+	length := PPPoETagHeaderSize + int(binary.BigEndian.Uint16(tags[pppoeTagLength:]))
+	if length > len(tags) {
+		return 0, nil, nil, false
+	}
+	return t, tags[PPPoETagHeaderSize:length], tags[length:], true
+}
@@ -0,0 +1,345 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package header
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/google/netstack/tcpip"
+)
+
+const (
+	sctpSrcPort  = 0
+	sctpDstPort  = 2
+	sctpVerifTag = 4
+	sctpChecksum = 8
+)
+
+const (
+	// SCTPMinimumSize is the size of the common header of SCTP packets.
+	SCTPMinimumSize = 12
+
+	// SCTPChunkHeaderSize is the size of the header of SCTP chunks.
+	SCTPChunkHeaderSize = 4
+
+	// SCTPProtocolNumber is SCTP's transport protocol number.
+	SCTPProtocolNumber tcpip.TransportProtocolNumber = 132
+)
+
+// SCTPChunkType is the type of an SCTP chunk.
+type SCTPChunkType uint8
+
+// The following are the types of the SCTP chunks of RFC 4960, section 3.2.
+const (
+	SCTPChunkData             SCTPChunkType = 0
+	SCTPChunkInit             SCTPChunkType = 1
+	SCTPChunkInitAck          SCTPChunkType = 2
+	SCTPChunkSack             SCTPChunkType = 3
+	SCTPChunkHeartbeat        SCTPChunkType = 4
+	SCTPChunkHeartbeatAck     SCTPChunkType = 5
+	SCTPChunkAbort            SCTPChunkType = 6
+	SCTPChunkShutdown         SCTPChunkType = 7
+	SCTPChunkShutdownAck      SCTPChunkType = 8
+	SCTPChunkError            SCTPChunkType = 9
+	SCTPChunkCookieEcho       SCTPChunkType = 10
+	SCTPChunkCookieAck        SCTPChunkType = 11
+	SCTPChunkShutdownComplete SCTPChunkType = 14
+)
+
+// Flags of SCTP chunks.
+const (
+	// SCTPFlagEnd, SCTPFlagBeginning and SCTPFlagUnordered are the flags of
+	// DATA chunks holding the last and the first fragments of a message,
+	// and of messages delivered without regard to their stream sequence
+	// number.
+	SCTPFlagEnd       = 1 << 0
+	SCTPFlagBeginning = 1 << 1
+	SCTPFlagUnordered = 1 << 2
+
+	// SCTPFlagNoTCB is the "T" flag of ABORT and SHUTDOWN COMPLETE chunks,
+	// set when the sender had no association, so that the verification
+	// tag of the packet is the one of the packet it replies to.
+	SCTPFlagNoTCB = 1 << 0
+)
+
+// SCTPParamStateCookie is the type of the State Cookie parameter of INIT ACK
+// chunks.
+const SCTPParamStateCookie = 7
+
+// sctpCRC32C is the table of the CRC32c checksum of SCTP packets.
+var sctpCRC32C = crc32.MakeTable(crc32.Castagnoli)
+
+// SCTP represents an SCTP packet stored in a byte array: the common header,
+// followed by chunks. The fields are described in RFC 4960, section 3.
+type SCTP []byte
+
+// SourcePort returns the "source port" field of the sctp header.
+func (b SCTP) SourcePort() uint16 {
+	return binary.BigEndian.Uint16(b[sctpSrcPort:])
+}
+
+// DestinationPort returns the "destination port" field of the sctp header.
+func (b SCTP) DestinationPort() uint16 {
+	return binary.BigEndian.Uint16(b[sctpDstPort:])
+}
+
+// VerificationTag returns the "verification tag" field of the sctp header.
+func (b SCTP) VerificationTag() uint32 {
+	return binary.BigEndian.Uint32(b[sctpVerifTag:])
+}
+
+// Checksum returns the "checksum" field of the sctp header.
+func (b SCTP) Checksum() uint32 {
+	return binary.LittleEndian.Uint32(b[sctpChecksum:])
+}
+
+// Chunks returns the chunks of the packet.
+func (b SCTP) Chunks() []byte {
+	return b[SCTPMinimumSize:]
+}
+
+// EncodeHeader encodes the common header of the packet, whose checksum is left
+// zero until SetChecksum is called.
+func (b SCTP) EncodeHeader(srcPort, dstPort uint16, verificationTag uint32) {
+	binary.BigEndian.PutUint16(b[sctpSrcPort:], srcPort)
+	binary.BigEndian.PutUint16(b[sctpDstPort:], dstPort)
+	binary.BigEndian.PutUint32(b[sctpVerifTag:], verificationTag)
+	binary.BigEndian.PutUint32(b[sctpChecksum:], 0)
+}
+
+// CalculateChecksum returns the CRC32c checksum of the packet, which must be
+// complete.
+func (b SCTP) CalculateChecksum() uint32 {
+	var zero [4]byte
+	crc := crc32.Update(0, sctpCRC32C, b[:sctpChecksum])
+	crc = crc32.Update(crc, sctpCRC32C, zero[:])
+	return crc32.Update(crc, sctpCRC32C, b[sctpChecksum+4:])
+}
+
+// SetChecksum sets the "checksum" field of the sctp header. Unlike the other
+// fields, it's stored in little-endian byte order.
+func (b SCTP) SetChecksum(checksum uint32) {
+	binary.LittleEndian.PutUint32(b[sctpChecksum:], checksum)
+}
+
+// SCTPChunk represents an SCTP chunk stored in a byte array, starting with its
+// header.
+type SCTPChunk []byte
+
+// NextSCTPChunk splits the first chunk off chunks, and returns it and the
+// chunks that follow it, taking its padding into account. It returns false if
+// the chunk is malformed.
+func NextSCTPChunk(chunks []byte) (SCTPChunk, []byte, bool) {
+	if len(chunks) < SCTPChunkHeaderSize {
+		return nil, nil, false
+	}
+	length := int(binary.BigEndian.Uint16(chunks[2:]))
+	if length < SCTPChunkHeaderSize || length > len(chunks) {
+		return nil, nil, false
+	}
+
+	padded := (length + 3) &^ 3
+	if padded > len(chunks) {
+		padded = len(chunks)
+	}
+	return SCTPChunk(chunks[:length]), chunks[padded:], true
+}
+
+// Type returns the type of the chunk.
+func (c SCTPChunk) Type() SCTPChunkType {
+	return SCTPChunkType(c[0])
+}
+
+// Flags returns the flags of the chunk.
+func (c SCTPChunk) Flags() uint8 {
+	return c[1]
+}
+
+// Value returns the value of the chunk, that follows its header.
+func (c SCTPChunk) Value() []byte {
+	return c[SCTPChunkHeaderSize:]
+}
+
+// SCTPChunkSize returns the size a chunk with a value of the given size takes
+// in a packet, padding included.
+func SCTPChunkSize(valueSize int) int {
+	return (SCTPChunkHeaderSize + valueSize + 3) &^ 3
+}
+
+// EncodeSCTPChunk encodes the header of a chunk with a value of the given size
+// at the start of b, and returns the value, followed by its padding, which is
+// zeroed.
+func EncodeSCTPChunk(b []byte, t SCTPChunkType, flags uint8, valueSize int) []byte {
+	b[0] = byte(t)
+	b[1] = flags
+	binary.BigEndian.PutUint16(b[2:], uint16(SCTPChunkHeaderSize+valueSize))
+	v := b[SCTPChunkHeaderSize:SCTPChunkSize(valueSize)]
+	for i := valueSize; i < len(v); i++ {
+		v[i] = 0
+	}
+	return v
+}
+
+// SCTPInitSize is the size of the fixed fields of the value of INIT and INIT
+// ACK chunks.
+const SCTPInitSize = 16
+
+// SCTPInit represents the value of an INIT or INIT ACK chunk.
+type SCTPInit []byte
+
+// SCTPInitFields contains the fixed fields of INIT and INIT ACK chunks.
+type SCTPInitFields struct {
+	InitiateTag     uint32
+	Window          uint32
+	OutboundStreams uint16
+	InboundStreams  uint16
+	InitialTSN      uint32
+}
+
+// Fields returns the fixed fields of the chunk.
+func (b SCTPInit) Fields() SCTPInitFields {
+	return SCTPInitFields{
+		InitiateTag:     binary.BigEndian.Uint32(b[0:]),
+		Window:          binary.BigEndian.Uint32(b[4:]),
+		OutboundStreams: binary.BigEndian.Uint16(b[8:]),
+		InboundStreams:  binary.BigEndian.Uint16(b[10:]),
+		InitialTSN:      binary.BigEndian.Uint32(b[12:]),
+	}
+}
+
+// Encode encodes the fixed fields of the chunk.
+func (b SCTPInit) Encode(f *SCTPInitFields) {
+	binary.BigEndian.PutUint32(b[0:], f.InitiateTag)
+	binary.BigEndian.PutUint32(b[4:], f.Window)
+	binary.BigEndian.PutUint16(b[8:], f.OutboundStreams)
+	binary.BigEndian.PutUint16(b[10:], f.InboundStreams)
+	binary.BigEndian.PutUint32(b[12:], f.InitialTSN)
+}
+
+// Param returns the value of the first parameter of the given type of the
+// chunk, or false if it has none.
+func (b SCTPInit) Param(paramType uint16) ([]byte, bool) {
+	params := b[SCTPInitSize:]
+	for len(params) >= 4 {
+		t := binary.BigEndian.Uint16(params)
+		length := int(binary.BigEndian.Uint16(params[2:]))
+		if length < 4 || length > len(params) {
+			return nil, false
+		}
+		if t == paramType {
+			return params[4:length], true
+		}
+		padded := (length + 3) &^ 3
+		if padded > len(params) {
+			break
+		}
+		params = params[padded:]
+	}
+	return nil, false
+}
+
+// SCTPParamSize returns the size a parameter with a value of the given size
+// takes in a chunk, padding included.
+func SCTPParamSize(valueSize int) int {
+	return (4 + valueSize + 3) &^ 3
+}
+
+// EncodeSCTPParam encodes the header of a parameter with a value of the given
+// size at the start of b, and returns the value.
+func EncodeSCTPParam(b []byte, paramType uint16, valueSize int) []byte {
+	binary.BigEndian.PutUint16(b, paramType)
+	binary.BigEndian.PutUint16(b[2:], uint16(4+valueSize))
+	return b[4 : 4+valueSize]
+}
+
+// SCTPDataHeaderSize is the size of the fields of DATA chunks that precede the
+// user data.
+const SCTPDataHeaderSize = 12
+
+// SCTPData represents the value of a DATA chunk.
+type SCTPData []byte
+
+// TSN returns the transmission sequence number of the chunk.
+func (b SCTPData) TSN() uint32 {
+	return binary.BigEndian.Uint32(b[0:])
+}
+
+// StreamID returns the stream identifier of the chunk.
+func (b SCTPData) StreamID() uint16 {
+	return binary.BigEndian.Uint16(b[4:])
+}
+
+// StreamSequence returns the stream sequence number of the chunk.
+func (b SCTPData) StreamSequence() uint16 {
+	return binary.BigEndian.Uint16(b[6:])
+}
+
+// PayloadProtocol returns the payload protocol identifier of the chunk.
+func (b SCTPData) PayloadProtocol() uint32 {
+	return binary.BigEndian.Uint32(b[8:])
+}
+
+// UserData returns the user data of the chunk.
+func (b SCTPData) UserData() []byte {
+	return b[SCTPDataHeaderSize:]
+}
+
+// Encode encodes the fields of the chunk that precede the user data.
+func (b SCTPData) Encode(tsn uint32, stream, ssn uint16, ppid uint32) {
+	binary.BigEndian.PutUint32(b[0:], tsn)
+	binary.BigEndian.PutUint16(b[4:], stream)
+	binary.BigEndian.PutUint16(b[6:], ssn)
+	binary.BigEndian.PutUint32(b[8:], ppid)
+}
+
+// SCTPSackSize is the size of the fixed fields of SACK chunks.
+const SCTPSackSize = 12
+
+// SCTPSack represents the value of a SACK chunk.
+type SCTPSack []byte
+
+// CumulativeTSNAck returns the "cumulative TSN ack" field of the chunk.
+func (b SCTPSack) CumulativeTSNAck() uint32 {
+	return binary.BigEndian.Uint32(b[0:])
+}
+
+// Window returns the "advertised receiver window credit" field of the chunk.
+func (b SCTPSack) Window() uint32 {
+	return binary.BigEndian.Uint32(b[4:])
+}
+
+// GapBlocks returns the number of gap ack blocks of the chunk.
+func (b SCTPSack) GapBlocks() int {
+	return int(binary.BigEndian.Uint16(b[8:]))
+}
+
+// DuplicateTSNs returns the number of duplicate TSNs of the chunk.
+func (b SCTPSack) DuplicateTSNs() int {
+	return int(binary.BigEndian.Uint16(b[10:]))
+}
+
+// GapBlock returns the start and end offsets, relative to the cumulative TSN
+// ack, of the i-th gap ack block of the chunk.
+func (b SCTPSack) GapBlock(i int) (start, end uint16) {
+	o := SCTPSackSize + 4*i
+	return binary.BigEndian.Uint16(b[o:]), binary.BigEndian.Uint16(b[o+2:])
+}
+
+// Encode encodes the fixed fields of the chunk, for a chunk with the given
+// number of gap blocks and no duplicate TSNs.
+func (b SCTPSack) Encode(cumTSNAck, window uint32, gapBlocks int) {
+	binary.BigEndian.PutUint32(b[0:], cumTSNAck)
+	binary.BigEndian.PutUint32(b[4:], window)
+	binary.BigEndian.PutUint16(b[8:], uint16(gapBlocks))
+	binary.BigEndian.PutUint16(b[10:], 0)
+}
+
+// SetGapBlock sets the i-th gap ack block of the chunk.
+func (b SCTPSack) SetGapBlock(i int, start, end uint16) {
+	o := SCTPSackSize + 4*i
+	binary.BigEndian.PutUint16(b[o:], start)
+	binary.BigEndian.PutUint16(b[o+2:], end)
+}
@@ -74,6 +74,20 @@ const (
 	TCPProtocolNumber tcpip.TransportProtocolNumber = 6
 )
 
+// Kinds of the TCP options understood by the stack, and the length of the
+// maximum segment size option.
+const (
+	TCPOptionEOL = 0
+	TCPOptionNOP = 1
+	TCPOptionMSS = 2
+
+	TCPOptionMSSLength = 4
+
+	// TCPMaxOptionsLength is the maximum length of the options of a tcp
+	// header.
+	TCPMaxOptionsLength = 40
+)
+
 // SourcePort returns the "source port" field of the tcp header.
 func (b TCP) SourcePort() uint16 {
 	return binary.BigEndian.Uint16(b[srcPort:])
@@ -104,6 +118,12 @@ func (b TCP) Payload() []byte {
 	return b[b.DataOffset():]
 }
 
+// Options returns the options of the tcp header, that is, the bytes between
+// the fixed part of the header and the payload.
+func (b TCP) Options() []byte {
+	return b[TCPMinimumSize:b.DataOffset()]
+}
+
 // Flags returns the flags field of the tcp header.
 func (b TCP) Flags() uint8 {
 	return b[tcpFlags]
@@ -188,3 +208,68 @@ func (b TCP) EncodePartial(partialChecksum, length uint16, seqnum, acknum uint32
 	// Encode the checksum.
 	b.SetChecksum(^checksum)
 }
+
+// EncodeMSSOption encodes the maximum segment size option with the given value
+// into b, which must be at least TCPOptionMSSLength bytes long.
+func EncodeMSSOption(mss uint16, b []byte) {
+	b[0] = TCPOptionMSS
+	b[1] = TCPOptionMSSLength
+	binary.BigEndian.PutUint16(b[2:], mss)
+}
+
+// ParseMSSOption searches the given tcp options for the maximum segment size
+// option and returns its value. The boolean is false if opts doesn't contain a
+// well-formed MSS option.
+func ParseMSSOption(opts []byte) (uint16, bool) {
+	for len(opts) > 0 {
+		switch opts[0] {
+		case TCPOptionEOL:
+			return 0, false
+		case TCPOptionNOP:
+			opts = opts[1:]
+			continue
+		}
+
+		// All other options have a kind and a length byte.
+		if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+			return 0, false
+		}
+
+		if opts[0] == TCPOptionMSS {
+			if opts[1] != TCPOptionMSSLength {
+				return 0, false
+			}
+			return binary.BigEndian.Uint16(opts[2:]), true
+		}
+
+		opts = opts[opts[1]:]
+	}
+
+	return 0, false
+}
+
+// ForEachTCPOption calls f with the kind and the data, i.e., the bytes that
+// follow its kind and length bytes, of each option in opts other than EOL and
+// NOP. It returns false if opts is malformed, in which case f is only called
+// for the options that precede the malformed one.
+func ForEachTCPOption(opts []byte, f func(kind uint8, data []byte)) bool {
+	for len(opts) > 0 {
+		switch opts[0] {
+		case TCPOptionEOL:
+			return true
+		case TCPOptionNOP:
+			opts = opts[1:]
+			continue
+		}
+
+		// All other options have a kind and a length byte.
+		if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+			return false
+		}
+
+		f(opts[0], opts[2:opts[1]])
+		opts = opts[opts[1]:]
+	}
+
+	return true
+}
@@ -0,0 +1,77 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package header
+
+import (
+	"encoding/binary"
+
+	"github.com/google/netstack/tcpip"
+)
+
+const (
+	vlanTCI       = 0
+	vlanEtherType = 2
+)
+
+// VLANFields contains the fields of an 802.1Q tag. It is used to describe the
+// fields of a tag that needs to be encoded.
+type VLANFields struct {
+	// Priority is the "priority code point" field of the tag.
+	Priority uint8
+
+	// DropEligible is the "drop eligible indicator" field of the tag.
+	DropEligible bool
+
+	// ID is the "VLAN identifier" field of the tag.
+	ID uint16
+
+	// EtherType is the type of the encapsulated packet.
+	EtherType tcpip.NetworkProtocolNumber
+}
+
+// VLAN represents an 802.1Q tag stored in a byte array, that is, the tag
+// control information followed by the EtherType of the encapsulated packet.
+type VLAN []byte
+
+const (
+	// VLANSize is the size of an 802.1Q tag.
+	VLANSize = 4
+
+	// VLANProtocolNumber is the EtherType of 802.1Q tagged packets.
+	VLANProtocolNumber tcpip.NetworkProtocolNumber = 0x8100
+
+	// VLANMaxID is the largest valid VLAN identifier; 0xfff is reserved.
+	VLANMaxID = 0xffe
+)
+
+// Priority returns the "priority code point" field of the tag.
+func (b VLAN) Priority() uint8 {
+	return uint8(binary.BigEndian.Uint16(b[vlanTCI:]) >> 13)
+}
+
+// DropEligible returns the "drop eligible indicator" field of the tag.
+func (b VLAN) DropEligible() bool {
+	return binary.BigEndian.Uint16(b[vlanTCI:])&0x1000 != 0
+}
+
+// ID returns the "VLAN identifier" field of the tag.
+func (b VLAN) ID() uint16 {
+	return binary.BigEndian.Uint16(b[vlanTCI:]) & 0xfff
+}
+
+// EtherType returns the type of the encapsulated packet.
+func (b VLAN) EtherType() tcpip.NetworkProtocolNumber {
+	return tcpip.NetworkProtocolNumber(binary.BigEndian.Uint16(b[vlanEtherType:]))
+}
+
+// Encode encodes all the fields of the 802.1Q tag.
+func (b VLAN) Encode(v *VLANFields) {
+	tci := uint16(v.Priority)<<13 | v.ID&0xfff
+	if v.DropEligible {
+		tci |= 0x1000
+	}
+	binary.BigEndian.PutUint16(b[vlanTCI:], tci)
+	binary.BigEndian.PutUint16(b[vlanEtherType:], uint16(v.EtherType))
+}
@@ -0,0 +1,53 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package header_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/netstack/tcpip/header"
+)
+
+func TestVLANEncode(t *testing.T) {
+	for _, test := range []struct {
+		fields header.VLANFields
+		want   []byte
+	}{
+		{header.VLANFields{ID: 1, EtherType: header.IPv4ProtocolNumber}, []byte{0x00, 0x01, 0x08, 0x00}},
+		{header.VLANFields{Priority: 5, ID: 100, EtherType: header.IPv6ProtocolNumber}, []byte{0xa0, 0x64, 0x86, 0xdd}},
+		{header.VLANFields{DropEligible: true, ID: header.VLANMaxID, EtherType: header.IPv4ProtocolNumber}, []byte{0x1f, 0xfe, 0x08, 0x00}},
+		{header.VLANFields{Priority: 7, DropEligible: true, ID: 0xabc, EtherType: header.IPv4ProtocolNumber}, []byte{0xfa, 0xbc, 0x08, 0x00}},
+	} {
+		b := header.VLAN(make([]byte, header.VLANSize))
+		b.Encode(&test.fields)
+		if !bytes.Equal(b, test.want) {
+			t.Errorf("Encode(%+v) = %x, want %x", test.fields, []byte(b), test.want)
+		}
+
+		if got := b.Priority(); got != test.fields.Priority {
+			t.Errorf("Priority() = %d, want %d", got, test.fields.Priority)
+		}
+		if got := b.DropEligible(); got != test.fields.DropEligible {
+			t.Errorf("DropEligible() = %t, want %t", got, test.fields.DropEligible)
+		}
+		if got := b.ID(); got != test.fields.ID {
+			t.Errorf("ID() = %d, want %d", got, test.fields.ID)
+		}
+		if got := b.EtherType(); got != test.fields.EtherType {
+			t.Errorf("EtherType() = %#x, want %#x", got, test.fields.EtherType)
+		}
+	}
+}
+
+func TestVLANIDMasked(t *testing.T) {
+	// Bits of the identifier beyond its 12 bits must not leak into the
+	// drop eligible indicator or the priority.
+	b := header.VLAN(make([]byte, header.VLANSize))
+	b.Encode(&header.VLANFields{ID: 0xffff})
+	if b.Priority() != 0 || b.DropEligible() || b.ID() != 0xfff {
+		t.Errorf("Got priority %d, drop eligible %t and id %#x, want 0, false and 0xfff", b.Priority(), b.DropEligible(), b.ID())
+	}
+}
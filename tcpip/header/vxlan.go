@@ -0,0 +1,57 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package header
+
+import (
+	"encoding/binary"
+)
+
+const (
+	vxlanFlags = 0
+	vxlanVNI   = 4
+)
+
+// VXLANFields contains the fields of a VXLAN header. It is used to describe the
+// fields of a header that needs to be encoded.
+type VXLANFields struct {
+	// VNI is the "VXLAN network identifier" field of the header.
+	VNI uint32
+}
+
+// VXLAN represents a VXLAN header stored in a byte array, per RFC 7348. It is
+// followed by the encapsulated ethernet frame.
+type VXLAN []byte
+
+const (
+	// VXLANSize is the size of a VXLAN header.
+	VXLANSize = 8
+
+	// VXLANPort is the UDP port assigned to VXLAN by IANA.
+	VXLANPort = 4789
+
+	// VXLANMaxVNI is the largest VXLAN network identifier.
+	VXLANMaxVNI = 1<<24 - 1
+
+	// vxlanValidVNI is the flag that must be set in valid headers.
+	vxlanValidVNI = 0x08
+)
+
+// IsValid returns whether the "I" flag of the header is set, which makes the
+// VNI valid.
+func (b VXLAN) IsValid() bool {
+	return b[vxlanFlags]&vxlanValidVNI != 0
+}
+
+// VNI returns the "VXLAN network identifier" field of the header.
+func (b VXLAN) VNI() uint32 {
+	return binary.BigEndian.Uint32(b[vxlanVNI:]) >> 8
+}
+
+// Encode encodes all the fields of the VXLAN header, and sets the "I" flag. The
+// reserved fields are zeroed.
+func (b VXLAN) Encode(v *VXLANFields) {
+	binary.BigEndian.PutUint32(b[vxlanFlags:], vxlanValidVNI<<24)
+	binary.BigEndian.PutUint32(b[vxlanVNI:], v.VNI<<8)
+}
@@ -0,0 +1,288 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package bond provides the implementation of data-link layer endpoints that
+// aggregate multiple underlying endpoints into one, either for redundancy
+// (active-backup mode) or to spread flows across all of them (hash mode).
+//
+// Bond endpoints can be used in the networking stack by calling New(mode,
+// eIDs...) to create a new endpoint, where eIDs are the IDs of the member
+// endpoints, and then passing it as an argument to Stack.CreateNIC(). Members
+// start out up, and traffic fails over to the remaining members when they
+// report that their carrier is down. SetMemberUp() can also be called to
+// change the state of a member manually, e.g., based on link monitoring done
+// outside of netstack.
+package bond
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// ErrNoMemberUp is returned when a packet is written to a bond none of whose
+// members is up.
+var ErrNoMemberUp = errors.New("bond: no member link is up")
+
+// Mode is the mode of operation of a bond.
+type Mode int
+
+const (
+	// ActiveBackup sends and receives all traffic through a single active
+	// member; the other members are only used if the active one goes down.
+	// Packets received on the backup members are dropped.
+	ActiveBackup Mode = iota
+
+	// Hash spreads outbound traffic across all members that are up
+	// according to a hash of the addresses and ports of each packet, so
+	// that packets of the same flow always use the same member. Inbound
+	// packets are accepted on all members.
+	Hash
+)
+
+type member struct {
+	ep stack.LinkEndpoint
+	up bool
+}
+
+// Endpoint is a bond link-layer endpoint.
+type Endpoint struct {
+	mode       Mode
+	dispatcher stack.NetworkDispatcher
+
+	// mu protects the fields below.
+	mu      sync.RWMutex
+	members []member
+
+	// active is the index of the active member in active-backup mode, or
+	// -1 if no member is up.
+	active int
+
+	// up holds the indices of the members that are up, in hash mode.
+	up []int
+}
+
+// New creates a new bond endpoint in the given mode, with the given members.
+// In active-backup mode, the first member is the initially active one.
+func New(mode Mode, members ...tcpip.LinkEndpointID) (tcpip.LinkEndpointID, *Endpoint) {
+	e := &Endpoint{mode: mode}
+	for _, id := range members {
+		e.members = append(e.members, member{ep: stack.FindLinkEndpoint(id), up: true})
+	}
+	e.updateLocked()
+
+	return stack.RegisterLinkEndpoint(e), e
+}
+
+// SetMemberUp reports whether the i-th member of the bond is up. Traffic is
+// moved away from members that go down; in active-backup mode, a member that
+// comes back up doesn't preempt the current active member. The bond itself is
+// reported as down when all its members are.
+func (e *Endpoint) SetMemberUp(i int, up bool) {
+	e.mu.Lock()
+	if i < 0 || i >= len(e.members) {
+		e.mu.Unlock()
+		return
+	}
+
+	wasUp := len(e.up) != 0
+	e.members[i].up = up
+	e.updateLocked()
+	isUp := len(e.up) != 0
+	d := e.dispatcher
+	e.mu.Unlock()
+
+	if d != nil && wasUp != isUp {
+		d.LinkStateChanged(e, isUp)
+	}
+}
+
+// Active returns the index of the active member in active-backup mode, or -1 if
+// no member is up.
+func (e *Endpoint) Active() int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.active
+}
+
+// updateLocked recomputes the active member and the list of members that are
+// up. It must be called with e.mu held for writing.
+func (e *Endpoint) updateLocked() {
+	e.up = e.up[:0]
+	for i := range e.members {
+		if e.members[i].up {
+			e.up = append(e.up, i)
+		}
+	}
+
+	if e.active >= 0 && e.active < len(e.members) && e.members[e.active].up {
+		return
+	}
+
+	e.active = -1
+	if len(e.up) != 0 {
+		e.active = e.up[0]
+	}
+}
+
+// DeliverNetworkPacket implements the stack.NetworkDispatcher interface. It is
+// called by the member endpoints when a packet arrives, and forwards it to the
+// actual dispatcher unless it arrived on a backup member.
+func (e *Endpoint) DeliverNetworkPacket(linkEP stack.LinkEndpoint, protocol tcpip.NetworkProtocolNumber, v buffer.View) {
+	if e.mode == ActiveBackup {
+		e.mu.RLock()
+		ok := e.active >= 0 && e.members[e.active].ep == linkEP
+		e.mu.RUnlock()
+
+		if !ok {
+			return
+		}
+	}
+
+	e.dispatcher.DeliverNetworkPacket(e, protocol, v)
+}
+
+// LinkStateChanged implements the stack.NetworkDispatcher interface. It updates
+// the state of the member that reported the change.
+func (e *Endpoint) LinkStateChanged(linkEP stack.LinkEndpoint, up bool) {
+	for i, m := range e.members {
+		if m.ep == linkEP {
+			e.SetMemberUp(i, up)
+			return
+		}
+	}
+}
+
+// Attach implements the stack.LinkEndpoint interface. It saves the dispatcher
+// and registers with all the members as their dispatcher so that "e" is called
+// for inbound packets.
+func (e *Endpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.mu.Lock()
+	e.dispatcher = dispatcher
+	e.mu.Unlock()
+
+	for _, m := range e.members {
+		m.ep.Attach(e)
+	}
+}
+
+// MTU implements stack.LinkEndpoint.MTU. It returns the smallest MTU of all
+// members, so that packets fit whichever member they're sent on.
+func (e *Endpoint) MTU() uint32 {
+	var mtu uint32
+	for i, m := range e.members {
+		if v := m.ep.MTU(); i == 0 || v < mtu {
+			mtu = v
+		}
+	}
+	return mtu
+}
+
+// MaxHeaderLength implements the stack.LinkEndpoint interface. It returns the
+// largest header length of all members.
+func (e *Endpoint) MaxHeaderLength() uint16 {
+	var n uint16
+	for _, m := range e.members {
+		if v := m.ep.MaxHeaderLength(); v > n {
+			n = v
+		}
+	}
+	return n
+}
+
+// Capabilities implements stack.LinkEndpoint.Capabilities. It returns the
+// capabilities supported by all members, since packets may be sent and received
+// on any of them.
+func (e *Endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	if len(e.members) == 0 {
+		return 0
+	}
+
+	caps := ^stack.LinkEndpointCapabilities(0)
+	for _, m := range e.members {
+		caps &= m.ep.Capabilities()
+	}
+	return caps
+}
+
+// Close implements stack.ClosableLinkEndpoint.Close. It closes all the members
+// that can be closed.
+func (e *Endpoint) Close() {
+	for _, m := range e.members {
+		if cep, ok := m.ep.(stack.ClosableLinkEndpoint); ok {
+			cep.Close()
+		}
+	}
+}
+
+// WritePacket implements the stack.LinkEndpoint interface. It selects a member
+// according to the mode of the bond and writes the packet to it.
+func (e *Endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) error {
+	var ep stack.LinkEndpoint
+
+	e.mu.RLock()
+	switch {
+	case e.mode == ActiveBackup && e.active >= 0:
+		ep = e.members[e.active].ep
+	case e.mode == Hash && len(e.up) != 0:
+		h := flowHash(protocol, hdr.UsedBytes())
+		ep = e.members[e.up[h%uint32(len(e.up))]].ep
+	}
+	e.mu.RUnlock()
+
+	if ep == nil {
+		return ErrNoMemberUp
+	}
+
+	return ep.WritePacket(r, hdr, payload, protocol)
+}
+
+// flowHash computes a hash of the addresses and, for TCP and UDP, the ports of
+// the given packet, which starts with its network-layer header.
+func flowHash(protocol tcpip.NetworkProtocolNumber, b []byte) uint32 {
+	var key []byte
+	var transProto uint8
+	var transOff int
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		if len(b) < header.IPv4MinimumSize {
+			return 0
+		}
+		ipv4 := header.IPv4(b)
+		key = b[12:20] // Source and destination addresses.
+		transProto = ipv4.Protocol()
+		transOff = int(ipv4.HeaderLength())
+
+	case header.IPv6ProtocolNumber:
+		if len(b) < header.IPv6MinimumSize {
+			return 0
+		}
+		key = b[8:40] // Source and destination addresses.
+		transProto = header.IPv6(b).NextHeader()
+		transOff = header.IPv6MinimumSize
+
+	default:
+		return 0
+	}
+
+	h := uint32(2166136261)
+	for _, c := range key {
+		h = (h ^ uint32(c)) * 16777619
+	}
+
+	switch tcpip.TransportProtocolNumber(transProto) {
+	case header.TCPProtocolNumber, header.UDPProtocolNumber:
+		if len(b) >= transOff+4 {
+			for _, c := range b[transOff : transOff+4] {
+				h = (h ^ uint32(c)) * 16777619
+			}
+		}
+	}
+
+	return h
+}
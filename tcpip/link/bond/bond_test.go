@@ -0,0 +1,196 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bond_test
+
+import (
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/bond"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// recordingDispatcher is a network dispatcher that counts the packets delivered
+// to it and records the link state changes.
+type recordingDispatcher struct {
+	delivered int
+	states    []bool
+}
+
+func (d *recordingDispatcher) DeliverNetworkPacket(stack.LinkEndpoint, tcpip.NetworkProtocolNumber, buffer.View) {
+	d.delivered++
+}
+
+func (d *recordingDispatcher) LinkStateChanged(_ stack.LinkEndpoint, up bool) {
+	d.states = append(d.states, up)
+}
+
+// newTestBond creates a bond of n channel endpoints in the given mode, and
+// attaches a recording dispatcher to it.
+func newTestBond(mode bond.Mode, n int) (*bond.Endpoint, []*channel.Endpoint, *recordingDispatcher) {
+	var ids []tcpip.LinkEndpointID
+	var members []*channel.Endpoint
+	for i := 0; i < n; i++ {
+		id, c := channel.New(256, 1500)
+		ids = append(ids, id)
+		members = append(members, c)
+	}
+	_, e := bond.New(mode, ids...)
+	d := &recordingDispatcher{}
+	e.Attach(d)
+	return e, members, d
+}
+
+// write writes a UDP packet from the given source port through e.
+func write(t *testing.T, e *bond.Endpoint, srcPort uint16) error {
+	t.Helper()
+
+	hdr := buffer.NewPrependable(int(e.MaxHeaderLength()) + header.IPv4MinimumSize + header.UDPMinimumSize)
+	header.UDP(hdr.Prepend(header.UDPMinimumSize)).Encode(&header.UDPFields{
+		SrcPort: srcPort,
+		DstPort: 80,
+		Length:  header.UDPMinimumSize,
+	})
+	header.IPv4(hdr.Prepend(header.IPv4MinimumSize)).Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: header.IPv4MinimumSize + header.UDPMinimumSize,
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     "\x0a\x00\x00\x01",
+		DstAddr:     "\x0a\x00\x00\x02",
+	})
+	return e.WritePacket(&stack.Route{}, &hdr, buffer.VectorisedView{}, header.IPv4ProtocolNumber)
+}
+
+// writtenTo writes a packet through e and returns the index of the member it
+// was written to.
+func writtenTo(t *testing.T, e *bond.Endpoint, members []*channel.Endpoint, srcPort uint16) int {
+	t.Helper()
+
+	if err := write(t, e, srcPort); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+	got := -1
+	for i, c := range members {
+		if n := c.Drain(); n != 0 {
+			if got != -1 || n != 1 {
+				t.Fatalf("Packet written more than once")
+			}
+			got = i
+		}
+	}
+	if got == -1 {
+		t.Fatalf("Packet not written to any member")
+	}
+	return got
+}
+
+func TestActiveBackupFailover(t *testing.T) {
+	e, members, d := newTestBond(bond.ActiveBackup, 2)
+	if got := writtenTo(t, e, members, 1000); got != 0 {
+		t.Fatalf("Packet written to member %d, want the first member", got)
+	}
+
+	// Packets received on the backup member are dropped.
+	members[0].Inject(header.IPv4ProtocolNumber, buffer.View("active"))
+	members[1].Inject(header.IPv4ProtocolNumber, buffer.View("backup"))
+	if d.delivered != 1 {
+		t.Errorf("Got %d packets delivered, want 1", d.delivered)
+	}
+	d.delivered = 0
+
+	// The active member reports that its carrier is down: the bond fails
+	// over to the backup, and stays up.
+	e.LinkStateChanged(members[0], false)
+	if got := e.Active(); got != 1 {
+		t.Fatalf("Got active member %d after failover, want 1", got)
+	}
+	if got := writtenTo(t, e, members, 1000); got != 1 {
+		t.Errorf("Packet written to member %d after failover, want 1", got)
+	}
+	members[0].Inject(header.IPv4ProtocolNumber, buffer.View("old active"))
+	members[1].Inject(header.IPv4ProtocolNumber, buffer.View("new active"))
+	if d.delivered != 1 {
+		t.Errorf("Got %d packets delivered after failover, want 1", d.delivered)
+	}
+	if len(d.states) != 0 {
+		t.Errorf("Got link state changes %v, want none", d.states)
+	}
+
+	// The first member coming back up doesn't preempt the active one.
+	e.LinkStateChanged(members[0], true)
+	if got := e.Active(); got != 1 {
+		t.Errorf("Got active member %d after recovery, want 1", got)
+	}
+
+	// With all members down, the bond is down.
+	e.SetMemberUp(1, false)
+	e.SetMemberUp(0, false)
+	if got := e.Active(); got != -1 {
+		t.Errorf("Got active member %d with all members down, want -1", got)
+	}
+	if err := write(t, e, 1000); err != bond.ErrNoMemberUp {
+		t.Errorf("Got WritePacket = %v with all members down, want %v", err, bond.ErrNoMemberUp)
+	}
+	e.SetMemberUp(1, true)
+	if got, want := d.states, []bool{false, true}; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Got link state changes %v, want %v", got, want)
+	}
+}
+
+func TestHashDistribution(t *testing.T) {
+	const flows = 64
+	e, members, d := newTestBond(bond.Hash, 3)
+
+	// Packets of a flow always use the same member, and flows use all of
+	// them.
+	memberOf := make(map[uint16]int)
+	used := make(map[int]bool)
+	for port := uint16(1000); port < 1000+flows; port++ {
+		m := writtenTo(t, e, members, port)
+		memberOf[port] = m
+		used[m] = true
+	}
+	for port := uint16(1000); port < 1000+flows; port++ {
+		if got := writtenTo(t, e, members, port); got != memberOf[port] {
+			t.Errorf("Packet of flow %d written to member %d, want %d like the previous one", port, got, memberOf[port])
+		}
+	}
+	if len(used) != len(members) {
+		t.Errorf("Flows spread over %d members, want %d", len(used), len(members))
+	}
+
+	// Flows move away from a member that goes down.
+	e.SetMemberUp(1, false)
+	used = make(map[int]bool)
+	for port := uint16(1000); port < 1000+flows; port++ {
+		used[writtenTo(t, e, members, port)] = true
+	}
+	if used[1] || len(used) != 2 {
+		t.Errorf("Got members %v used with member 1 down, want 0 and 2", used)
+	}
+
+	// Inbound packets are accepted on all members.
+	for _, c := range members {
+		c.Inject(header.IPv4ProtocolNumber, buffer.View("packet"))
+	}
+	if d.delivered != len(members) {
+		t.Errorf("Got %d packets delivered, want %d", d.delivered, len(members))
+	}
+}
+
+func TestCloseMembers(t *testing.T) {
+	id, closable := channel.NewClosable(1, 1500)
+	other, _ := channel.New(1, 1500)
+	_, e := bond.New(bond.ActiveBackup, id, other)
+
+	e.Close()
+	if !closable.Closed() {
+		t.Errorf("Closable member wasn't closed with the bond")
+	}
+}
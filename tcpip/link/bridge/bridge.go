@@ -0,0 +1,230 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package bridge provides the implementation of a software ethernet bridge
+// that forwards frames among its member ports, learning which port each MAC
+// address lives behind and flooding frames to unknown, multicast and broadcast
+// destinations, much like a Linux bridge.
+//
+// A bridge is created by calling New(), and ports are added to it by calling
+// AddFD() with the file descriptor of a TAP device (see tun.OpenTAP()) or of a
+// datagram socket carrying ethernet frames, or by calling AddPort() with a
+// custom Port implementation, which must then pass the frames it receives to
+// DeliverFrame().
+//
+// The bridge operates on ethernet frames only; netstack NICs exchange network
+// layer packets and have no ethernet or ARP support, so they can't be members
+// of a bridge.
+package bridge
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/rawfile"
+)
+
+// DefaultAgeingTime is the default amount of time after which learned
+// addresses are forgotten if no frames are received from them.
+const DefaultAgeingTime = 5 * time.Minute
+
+// MaxAddresses is the maximum number of addresses a bridge learns. Once it's
+// reached, and none of the learned addresses has expired, new addresses aren't
+// learned, and frames sent to them are flooded.
+const MaxAddresses = 4096
+
+// Port is a member of a bridge.
+type Port interface {
+	// WriteFrame writes an ethernet frame to the port. The port must not
+	// retain the frame after WriteFrame returns.
+	WriteFrame(frame []byte) error
+}
+
+// fdbEntry is an entry in the forwarding database of a bridge.
+type fdbEntry struct {
+	port     Port
+	lastSeen time.Time
+}
+
+// Bridge is a software ethernet bridge.
+type Bridge struct {
+	ageing time.Duration
+	clock  tcpip.Clock
+
+	mu    sync.RWMutex
+	ports map[Port]struct{}
+	fdb   map[tcpip.LinkAddress]fdbEntry
+}
+
+// New creates a new bridge with no ports. Learned addresses are forgotten after
+// ageing time without frames from them; a value of zero selects
+// DefaultAgeingTime. The age of addresses is measured with clock, e.g., the
+// clock of a stack, or with the real time if clock is nil.
+func New(ageing time.Duration, clock tcpip.Clock) *Bridge {
+	if ageing == 0 {
+		ageing = DefaultAgeingTime
+	}
+	if clock == nil {
+		clock = tcpip.StdClock{}
+	}
+
+	return &Bridge{
+		ageing: ageing,
+		clock:  clock,
+		ports:  make(map[Port]struct{}),
+		fdb:    make(map[tcpip.LinkAddress]fdbEntry),
+	}
+}
+
+// AddPort adds the given port to the bridge.
+func (b *Bridge) AddPort(p Port) {
+	b.mu.Lock()
+	b.ports[p] = struct{}{}
+	b.mu.Unlock()
+}
+
+// RemovePort removes the given port from the bridge, along with all the
+// addresses learned on it.
+func (b *Bridge) RemovePort(p Port) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.ports, p)
+	for addr, entry := range b.fdb {
+		if entry.port == p {
+			delete(b.fdb, addr)
+		}
+	}
+}
+
+// DeliverFrame is called by ports when they receive a frame. It learns the
+// source address of the frame and forwards it towards its destination.
+func (b *Bridge) DeliverFrame(from Port, frame []byte) {
+	if len(frame) < header.EthernetMinimumSize {
+		return
+	}
+
+	eth := header.Ethernet(frame)
+	src := eth.SourceAddress()
+	dst := eth.DestinationAddress()
+	now := b.clock.Now()
+
+	// Learn where the source lives. Only unicast addresses can be learned.
+	// Entries are refreshed at most once a second to avoid taking the write
+	// lock for every frame.
+	if !header.IsMulticastEthernetAddress(src) {
+		b.mu.RLock()
+		entry, ok := b.fdb[src]
+		b.mu.RUnlock()
+
+		if !ok || entry.port != from || now.Sub(entry.lastSeen) > time.Second {
+			b.mu.Lock()
+			b.learnLocked(from, src, now)
+			b.mu.Unlock()
+		}
+	}
+
+	b.mu.RLock()
+	if !header.IsMulticastEthernetAddress(dst) {
+		if entry, ok := b.fdb[dst]; ok {
+			if now.Sub(entry.lastSeen) <= b.ageing {
+				if entry.port != from {
+					entry.port.WriteFrame(frame)
+				}
+				b.mu.RUnlock()
+				return
+			}
+
+			// The entry expired; forget it before flooding the
+			// frame, unless it was refreshed in the meantime.
+			b.mu.RUnlock()
+			b.mu.Lock()
+			if entry, ok := b.fdb[dst]; ok && now.Sub(entry.lastSeen) > b.ageing {
+				delete(b.fdb, dst)
+			}
+			b.mu.Unlock()
+			b.mu.RLock()
+		}
+	}
+	defer b.mu.RUnlock()
+
+	// Flood the frame to all ports except the one it came from.
+	for p := range b.ports {
+		if p != from {
+			p.WriteFrame(frame)
+		}
+	}
+}
+
+// learnLocked records that addr lives behind the given port, which must be a
+// member of the bridge. If the forwarding database is full, the expired entries
+// are deleted first; if none has, addr isn't learned.
+//
+// b.mu must be held for writing.
+func (b *Bridge) learnLocked(p Port, addr tcpip.LinkAddress, now time.Time) {
+	if _, ok := b.ports[p]; !ok {
+		return
+	}
+
+	if _, ok := b.fdb[addr]; !ok && len(b.fdb) >= MaxAddresses {
+		for a, entry := range b.fdb {
+			if now.Sub(entry.lastSeen) > b.ageing {
+				delete(b.fdb, a)
+			}
+		}
+		if len(b.fdb) >= MaxAddresses {
+			return
+		}
+	}
+
+	// The address is copied so that it doesn't alias the frame.
+	b.fdb[tcpip.LinkAddress([]byte(addr))] = fdbEntry{port: p, lastSeen: now}
+}
+
+// fdPort is a bridge port backed by a boundary-preserving file descriptor.
+type fdPort struct {
+	fd int
+}
+
+// WriteFrame implements Port.WriteFrame. If the file descriptor is not
+// currently writable, the frame is dropped.
+func (p *fdPort) WriteFrame(frame []byte) error {
+	return rawfile.NonBlockingWrite(p.fd, frame)
+}
+
+// AddFD adds a port backed by the given file descriptor to the bridge, and
+// launches the goroutine that reads frames from it. The closed function, if
+// not nil, is called when reading from the file descriptor fails; the port is
+// removed from the bridge at that point.
+func (b *Bridge) AddFD(fd int, closed func(error)) Port {
+	syscall.SetNonblock(fd, true)
+
+	p := &fdPort{fd: fd}
+	b.AddPort(p)
+	go b.readLoop(p, closed)
+
+	return p
+}
+
+// readLoop reads frames from the port's file descriptor in a loop and delivers
+// them to the bridge.
+func (b *Bridge) readLoop(p *fdPort, closed func(error)) {
+	v := buffer.NewView(header.MaxIPPacketSize + header.EthernetMinimumSize)
+	for {
+		n, err := rawfile.BlockingRead(p.fd, v)
+		if err != nil || n <= 0 {
+			b.RemovePort(p)
+			if closed != nil {
+				closed(err)
+			}
+			return
+		}
+
+		b.DeliverFrame(p, v[:n])
+	}
+}
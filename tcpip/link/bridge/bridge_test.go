@@ -0,0 +1,193 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bridge_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/faketime"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/bridge"
+)
+
+const (
+	addrA     = tcpip.LinkAddress("\x02\x00\x00\x00\x00\x0a")
+	addrB     = tcpip.LinkAddress("\x02\x00\x00\x00\x00\x0b")
+	addrC     = tcpip.LinkAddress("\x02\x00\x00\x00\x00\x0c")
+	broadcast = tcpip.LinkAddress("\xff\xff\xff\xff\xff\xff")
+)
+
+// recordingPort is a bridge port that records the frames written to it.
+type recordingPort struct {
+	frames [][]byte
+}
+
+func (p *recordingPort) WriteFrame(frame []byte) error {
+	p.frames = append(p.frames, append([]byte(nil), frame...))
+	return nil
+}
+
+// take returns the number of frames written to the port since the last call.
+func (p *recordingPort) take() int {
+	n := len(p.frames)
+	p.frames = nil
+	return n
+}
+
+func frame(src, dst tcpip.LinkAddress) []byte {
+	b := make([]byte, header.EthernetMinimumSize+4)
+	header.Ethernet(b).Encode(&header.EthernetFields{
+		SrcAddr: src,
+		DstAddr: dst,
+		Type:    header.IPv4ProtocolNumber,
+	})
+	return b
+}
+
+// newTestBridge creates a bridge with three ports, behind which live addrA,
+// addrB and addrC, respectively.
+func newTestBridge(ageing time.Duration) (*bridge.Bridge, *faketime.ManualClock, [3]*recordingPort) {
+	clock := faketime.NewManualClock(time.Unix(0, 0))
+	b := bridge.New(ageing, clock)
+	var ports [3]*recordingPort
+	for i := range ports {
+		ports[i] = &recordingPort{}
+		b.AddPort(ports[i])
+	}
+	return b, clock, ports
+}
+
+// checkFrames checks that each port got the wanted number of frames.
+func checkFrames(t *testing.T, name string, ports [3]*recordingPort, want [3]int) {
+	t.Helper()
+	for i, p := range ports {
+		if got := p.take(); got != want[i] {
+			t.Errorf("%s: port %d got %d frames, want %d", name, i, got, want[i])
+		}
+	}
+}
+
+func TestLearning(t *testing.T) {
+	b, _, ports := newTestBridge(0)
+
+	// B is unknown, so the frame is flooded, except to the ingress port.
+	b.DeliverFrame(ports[0], frame(addrA, addrB))
+	checkFrames(t, "unknown destination", ports, [3]int{0, 1, 1})
+
+	// A was learned on port 0.
+	b.DeliverFrame(ports[1], frame(addrB, addrA))
+	checkFrames(t, "learned destination", ports, [3]int{1, 0, 0})
+
+	// And B on port 1.
+	b.DeliverFrame(ports[2], frame(addrC, addrB))
+	checkFrames(t, "learned destination", ports, [3]int{0, 1, 0})
+
+	// An address moving to another port is learned again. C is behind the
+	// ingress port, so the first frame isn't forwarded at all.
+	b.DeliverFrame(ports[2], frame(addrA, addrC))
+	b.DeliverFrame(ports[1], frame(addrB, addrA))
+	checkFrames(t, "moved address", ports, [3]int{0, 0, 1})
+}
+
+func TestFlooding(t *testing.T) {
+	b, _, ports := newTestBridge(0)
+
+	// Learn all addresses first; broadcast frames are flooded anyway.
+	for i, addr := range []tcpip.LinkAddress{addrA, addrB, addrC} {
+		b.DeliverFrame(ports[i], frame(addr, broadcast))
+	}
+	checkFrames(t, "broadcast", ports, [3]int{2, 2, 2})
+
+	b.DeliverFrame(ports[1], frame(addrB, "\x01\x00\x5e\x00\x00\x01"))
+	checkFrames(t, "multicast", ports, [3]int{1, 0, 1})
+
+	// Frames with a multicast source address aren't learned from.
+	b.DeliverFrame(ports[0], frame(broadcast, addrB))
+	b.DeliverFrame(ports[1], frame(addrB, broadcast))
+	checkFrames(t, "multicast source", ports, [3]int{1, 1, 1})
+
+	// Runt frames are dropped.
+	b.DeliverFrame(ports[0], frame(addrA, broadcast)[:header.EthernetMinimumSize-1])
+	checkFrames(t, "runt", ports, [3]int{0, 0, 0})
+}
+
+func TestNoEcho(t *testing.T) {
+	b, _, ports := newTestBridge(0)
+
+	b.DeliverFrame(ports[0], frame(addrA, broadcast))
+	b.DeliverFrame(ports[0], frame(addrB, broadcast))
+	checkFrames(t, "learning", ports, [3]int{0, 2, 2})
+
+	// A and B are both behind port 0, so frames between them must not be
+	// sent back to it, nor anywhere else.
+	b.DeliverFrame(ports[0], frame(addrA, addrB))
+	checkFrames(t, "same port", ports, [3]int{0, 0, 0})
+}
+
+func TestAgeing(t *testing.T) {
+	const ageing = 10 * time.Second
+	b, clock, ports := newTestBridge(ageing)
+
+	b.DeliverFrame(ports[0], frame(addrA, broadcast))
+	checkFrames(t, "learning", ports, [3]int{0, 1, 1})
+
+	clock.Advance(ageing)
+	b.DeliverFrame(ports[1], frame(addrB, addrA))
+	checkFrames(t, "before ageing", ports, [3]int{1, 0, 0})
+
+	clock.Advance(time.Second)
+	b.DeliverFrame(ports[1], frame(addrB, addrA))
+	checkFrames(t, "after ageing", ports, [3]int{1, 0, 1})
+
+	// Frames from A refresh its entry.
+	b.DeliverFrame(ports[0], frame(addrA, addrB))
+	clock.Advance(ageing)
+	b.DeliverFrame(ports[2], frame(addrC, addrA))
+	checkFrames(t, "refreshed", ports, [3]int{1, 1, 0})
+}
+
+func TestRemovePort(t *testing.T) {
+	b, _, ports := newTestBridge(0)
+
+	b.DeliverFrame(ports[0], frame(addrA, broadcast))
+	b.DeliverFrame(ports[1], frame(addrB, broadcast))
+	ports[0].take()
+	ports[1].take()
+	ports[2].take()
+
+	b.RemovePort(ports[0])
+	b.DeliverFrame(ports[1], frame(addrB, addrA))
+	checkFrames(t, "removed port", ports, [3]int{0, 0, 1})
+
+	// Frames from the removed port are forwarded, but not learned.
+	b.DeliverFrame(ports[0], frame(addrA, addrB))
+	b.DeliverFrame(ports[1], frame(addrB, addrA))
+	checkFrames(t, "from removed port", ports, [3]int{0, 1, 1})
+}
+
+func TestMaxAddresses(t *testing.T) {
+	const ageing = 10 * time.Second
+	b, clock, ports := newTestBridge(ageing)
+
+	// Fill the forwarding database with addresses behind port 0.
+	for i := 0; i < bridge.MaxAddresses; i++ {
+		src := tcpip.LinkAddress([]byte{0x02, 0x01, byte(i >> 24), byte(i >> 16), byte(i >> 8), byte(i)})
+		b.DeliverFrame(ports[0], frame(src, broadcast))
+	}
+	checkFrames(t, "learning", ports, [3]int{0, bridge.MaxAddresses, bridge.MaxAddresses})
+
+	// B isn't learned, so frames to it are still flooded.
+	b.DeliverFrame(ports[1], frame(addrB, broadcast))
+	b.DeliverFrame(ports[2], frame(addrC, addrB))
+	checkFrames(t, "full", ports, [3]int{2, 1, 1})
+
+	// Once the learned addresses expire, they make room for new ones.
+	clock.Advance(ageing + time.Second)
+	b.DeliverFrame(ports[1], frame(addrB, broadcast))
+	b.DeliverFrame(ports[2], frame(addrC, addrB))
+	checkFrames(t, "expired", ports, [3]int{1, 1, 1})
+}
@@ -5,9 +5,18 @@
 // Package channel provides the implemention of channel-based data-link layer
 // endpoints. Such endpoints allow injection of inbound packets and store
 // outbound packets in a channel.
+//
+// They are mostly used by protocol tests and simulations: packets can be
+// injected right away or at a given time of the endpoint's clock, and outbound
+// packets can be read without blocking, waited for, or selected on.
 package channel
 
 import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/stack"
@@ -18,6 +27,18 @@ type PacketInfo struct {
 	Header  buffer.View
 	Payload buffer.View
 	Proto   tcpip.NetworkProtocolNumber
+
+	// Timestamp is the time, according to the clock of the endpoint, at
+	// which the packet was written.
+	Timestamp time.Time
+}
+
+// scheduledPacket is an inbound packet injected with InjectAt that hasn't been
+// delivered yet.
+type scheduledPacket struct {
+	at    time.Time
+	proto tcpip.NetworkProtocolNumber
+	v     buffer.View
 }
 
 // Endpoint is link layer endpoint that stores outbound packets in a channel
@@ -28,18 +49,109 @@ type Endpoint struct {
 
 	// C is where outbound packets are queued.
 	C chan PacketInfo
+
+	// mu protects the fields below.
+	mu         sync.Mutex
+	clock      tcpip.Clock
+	scheduled  []scheduledPacket
+	delivering int
+
+	// deliverMu serializes the delivery of scheduled packets, so that they
+	// are delivered in order.
+	deliverMu sync.Mutex
+}
+
+func newEndpoint(size int, mtu uint32) *Endpoint {
+	return &Endpoint{
+		C:     make(chan PacketInfo, size),
+		mtu:   mtu,
+		clock: tcpip.StdClock{},
+	}
 }
 
 // New creates a new channel endpoint.
 func New(size int, mtu uint32) (tcpip.LinkEndpointID, *Endpoint) {
-	e := &Endpoint{
-		C:   make(chan PacketInfo, size),
-		mtu: mtu,
-	}
+	e := newEndpoint(size, mtu)
+	return stack.RegisterLinkEndpoint(e), e
+}
+
+// ClosableEndpoint is a channel endpoint that also implements
+// stack.ClosableLinkEndpoint, and records whether it was closed. It is used to
+// test the endpoints and stacks that close the link endpoints they own.
+type ClosableEndpoint struct {
+	*Endpoint
+
+	// closed is protected by the mutex of the channel endpoint.
+	closed bool
+}
 
+// NewClosable creates a new closable channel endpoint.
+func NewClosable(size int, mtu uint32) (tcpip.LinkEndpointID, *ClosableEndpoint) {
+	e := &ClosableEndpoint{Endpoint: newEndpoint(size, mtu)}
 	return stack.RegisterLinkEndpoint(e), e
 }
 
+// Close implements stack.ClosableLinkEndpoint.Close. It only records that the
+// endpoint was closed: packets can still be written and injected afterwards.
+func (e *ClosableEndpoint) Close() {
+	e.mu.Lock()
+	e.closed = true
+	e.mu.Unlock()
+}
+
+// Closed returns whether Close was called.
+func (e *ClosableEndpoint) Closed() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.closed
+}
+
+// SetClock replaces the clock used to timestamp outbound packets and to
+// deliver packets injected with InjectAt, e.g., with the manual clock of the
+// stack. It must be called before the endpoint is used.
+func (e *Endpoint) SetClock(c tcpip.Clock) {
+	e.mu.Lock()
+	e.clock = c
+	e.mu.Unlock()
+}
+
+func (e *Endpoint) getClock() tcpip.Clock {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.clock
+}
+
+// Read returns the next outbound packet, if there is one, without blocking.
+func (e *Endpoint) Read() (PacketInfo, bool) {
+	select {
+	case p := <-e.C:
+		return p, true
+	default:
+		return PacketInfo{}, false
+	}
+}
+
+// ReadContext returns the next outbound packet, waiting for one to be written
+// until ctx is done. It returns false if ctx is done first.
+func (e *Endpoint) ReadContext(ctx context.Context) (PacketInfo, bool) {
+	select {
+	case p := <-e.C:
+		return p, true
+	case <-ctx.Done():
+		return PacketInfo{}, false
+	}
+}
+
+// NumQueued returns the number of outbound packets waiting to be read.
+func (e *Endpoint) NumQueued() int {
+	return len(e.C)
+}
+
+// Empty returns whether no outbound packets are waiting to be read.
+func (e *Endpoint) Empty() bool {
+	return len(e.C) == 0
+}
+
 // Drain removes all outbound packets from the channel and counts them.
 func (e *Endpoint) Drain() int {
 	c := 0
@@ -58,6 +170,71 @@ func (e *Endpoint) Inject(protocol tcpip.NetworkProtocolNumber, v buffer.View) {
 	e.dispatcher.DeliverNetworkPacket(e, protocol, v)
 }
 
+// SetLinkUp reports to the dispatcher that the carrier of the endpoint went up
+// or down, as link endpoints backed by real devices do.
+func (e *Endpoint) SetLinkUp(up bool) {
+	e.dispatcher.LinkStateChanged(e, up)
+}
+
+// InjectAt injects an inbound packet when the clock of the endpoint reaches the
+// given time, or right away if it already has. Packets are delivered in order
+// of their time, and in order of injection for equal times.
+func (e *Endpoint) InjectAt(t time.Time, protocol tcpip.NetworkProtocolNumber, v buffer.View) {
+	e.mu.Lock()
+	clock := e.clock
+	i := sort.Search(len(e.scheduled), func(i int) bool {
+		return e.scheduled[i].at.After(t)
+	})
+	e.scheduled = append(e.scheduled, scheduledPacket{})
+	copy(e.scheduled[i+1:], e.scheduled[i:])
+	e.scheduled[i] = scheduledPacket{at: t, proto: protocol, v: v}
+	e.mu.Unlock()
+
+	d := t.Sub(clock.Now())
+	if d <= 0 {
+		e.deliverScheduled()
+		return
+	}
+
+	timer := clock.NewTimer(d)
+	go func() {
+		<-timer.C()
+		e.deliverScheduled()
+	}()
+}
+
+// NumScheduled returns the number of packets injected with InjectAt whose
+// delivery isn't complete yet.
+func (e *Endpoint) NumScheduled() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.scheduled) + e.delivering
+}
+
+// deliverScheduled delivers the scheduled packets whose time has come.
+func (e *Endpoint) deliverScheduled() {
+	e.deliverMu.Lock()
+	defer e.deliverMu.Unlock()
+
+	for {
+		e.mu.Lock()
+		if len(e.scheduled) == 0 || e.scheduled[0].at.After(e.clock.Now()) {
+			e.mu.Unlock()
+			return
+		}
+		p := e.scheduled[0]
+		e.scheduled = e.scheduled[1:]
+		e.delivering++
+		e.mu.Unlock()
+
+		e.dispatcher.DeliverNetworkPacket(e, p.proto, p.v)
+
+		e.mu.Lock()
+		e.delivering--
+		e.mu.Unlock()
+	}
+}
+
 // Attach saves the stack network-layer dispatcher for use later when packets
 // are injected.
 func (e *Endpoint) Attach(dispatcher stack.NetworkDispatcher) {
@@ -76,15 +253,19 @@ func (*Endpoint) MaxHeaderLength() uint16 {
 	return 0
 }
 
+// Capabilities implements stack.LinkEndpoint.Capabilities. Channel endpoints
+// don't support any capabilities.
+func (*Endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return 0
+}
+
 // WritePacket stores outbound packets into the channel.
-func (e *Endpoint) WritePacket(_ *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) error {
+func (e *Endpoint) WritePacket(_ *stack.Route, hdr *buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) error {
 	p := PacketInfo{
-		Header: hdr.View(),
-		Proto:  protocol,
-	}
-
-	if payload != nil {
-		p.Payload = payload
+		Header:    append(buffer.View(nil), hdr.UsedBytes()...),
+		Payload:   payload.ToView(),
+		Proto:     protocol,
+		Timestamp: e.getClock().Now(),
 	}
 
 	select {
@@ -0,0 +1,109 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package channel_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/faketime"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// recorder is a stack.NetworkDispatcher that records the first byte of the
+// packets delivered to it.
+type recorder struct {
+	mu        sync.Mutex
+	delivered []byte
+}
+
+func (r *recorder) DeliverNetworkPacket(_ stack.LinkEndpoint, _ tcpip.NetworkProtocolNumber, v buffer.View) {
+	r.mu.Lock()
+	r.delivered = append(r.delivered, v[0])
+	r.mu.Unlock()
+}
+
+func (*recorder) LinkStateChanged(stack.LinkEndpoint, bool) {}
+
+func (r *recorder) get() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return string(r.delivered)
+}
+
+func TestInjectAt(t *testing.T) {
+	_, e := channel.New(1, 1500)
+	clock := faketime.NewManualClock(time.Unix(0, 0))
+	e.SetClock(clock)
+
+	var r recorder
+	e.Attach(&r)
+
+	start := clock.Now()
+	e.InjectAt(start.Add(2*time.Second), header.IPv4ProtocolNumber, buffer.View("c"))
+	e.InjectAt(start.Add(time.Second), header.IPv4ProtocolNumber, buffer.View("a"))
+	e.InjectAt(start.Add(time.Second), header.IPv4ProtocolNumber, buffer.View("b"))
+
+	// Packets whose time has come are delivered right away.
+	e.InjectAt(start, header.IPv4ProtocolNumber, buffer.View("0"))
+	if got := r.get(); got != "0" {
+		t.Fatalf("Delivered %q before the clock was advanced, want %q", got, "0")
+	}
+
+	clock.Advance(2 * time.Second)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for e.NumScheduled() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if got, want := r.get(), "0abc"; got != want {
+		t.Errorf("Delivered %q, want %q", got, want)
+	}
+}
+
+func TestRead(t *testing.T) {
+	id, e := channel.New(2, 1500)
+	clock := faketime.NewManualClock(time.Unix(100, 0))
+	e.SetClock(clock)
+	ep := stack.FindLinkEndpoint(id)
+
+	if !e.Empty() {
+		t.Fatalf("New endpoint isn't empty")
+	}
+	if _, ok := e.Read(); ok {
+		t.Fatalf("Read succeeded on an empty endpoint")
+	}
+
+	hdr := buffer.NewPrependable(1)
+	hdr.Prepend(1)[0] = 42
+	if err := ep.WritePacket(&stack.Route{}, &hdr, buffer.VectorisedView{}, header.IPv4ProtocolNumber); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+
+	if n := e.NumQueued(); n != 1 {
+		t.Fatalf("NumQueued returned %d, want 1", n)
+	}
+
+	p, ok := e.ReadContext(context.Background())
+	if !ok {
+		t.Fatalf("ReadContext failed")
+	}
+	if p.Header[0] != 42 || !p.Timestamp.Equal(clock.Now()) {
+		t.Errorf("Read packet %v at %v, want %v at %v", p.Header, p.Timestamp, []byte{42}, clock.Now())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, ok := e.ReadContext(ctx); ok {
+		t.Fatalf("ReadContext succeeded on an empty endpoint")
+	}
+}
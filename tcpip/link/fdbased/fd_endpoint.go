@@ -12,6 +12,8 @@
 package fdbased
 
 import (
+	"errors"
+	"sync"
 	"syscall"
 
 	"github.com/google/netstack/tcpip/buffer"
@@ -21,6 +23,10 @@ import (
 	"github.com/google/netstack/tcpip"
 )
 
+// errClosed is used internally to indicate that the file descriptor's peer
+// closed its end of the communication pipe.
+var errClosed = errors.New("fd closed")
+
 type endpoint struct {
 	// fd is the file descriptor used to send and receive packets.
 	fd int
@@ -31,23 +37,73 @@ type endpoint struct {
 	// closed is a function to be called when the FD's peer (if any) closes
 	// its end of the communication pipe.
 	closed func(error)
+
+	// stopFDs are the two ends of the pipe used to stop the dispatch loop;
+	// they are -1 if the pipe couldn't be created, in which case the loop
+	// can't be stopped.
+	stopFDs [2]int
+
+	// mu protects the fields below.
+	mu       sync.Mutex
+	attached bool
+	stopped  bool
+
+	// done is closed when the dispatch loop exits.
+	done chan struct{}
 }
 
 // New creates a new fd-based endpoint.
 func New(fd int, mtu int, closed func(error)) tcpip.LinkEndpointID {
 	syscall.SetNonblock(fd, true)
 
-	return stack.RegisterLinkEndpoint(&endpoint{
-		fd:     fd,
-		mtu:    mtu,
-		closed: closed,
-	})
+	e := &endpoint{
+		fd:      fd,
+		mtu:     mtu,
+		closed:  closed,
+		stopFDs: [2]int{-1, -1},
+		done:    make(chan struct{}),
+	}
+
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err == nil {
+		e.stopFDs = p
+	}
+
+	return stack.RegisterLinkEndpoint(e)
 }
 
 // Attach launches the goroutine that reads packets from the file descriptor and
 // dispatches them via the provided dispatcher.
 func (e *endpoint) Attach(dispatcher stack.NetworkDispatcher) {
-	go e.dispatchLoop(dispatcher)
+	e.mu.Lock()
+	e.attached = true
+	e.mu.Unlock()
+
+	go func() {
+		defer close(e.done)
+		e.dispatchLoop(dispatcher)
+	}()
+}
+
+// Close implements stack.ClosableLinkEndpoint.Close. It stops the dispatch loop
+// and waits for it to exit; the file descriptor is left open.
+func (e *endpoint) Close() {
+	e.mu.Lock()
+	if e.stopped || e.stopFDs[1] < 0 {
+		e.mu.Unlock()
+		return
+	}
+	e.stopped = true
+	attached := e.attached
+	e.mu.Unlock()
+
+	if attached {
+		syscall.Write(e.stopFDs[1], []byte{0})
+		<-e.done
+	}
+
+	syscall.Close(e.stopFDs[0])
+	syscall.Close(e.stopFDs[1])
 }
 
 // MTU implements stack.LinkEndpoint.MTU. It returns the value initialized
@@ -62,55 +118,194 @@ func (*endpoint) MaxHeaderLength() uint16 {
 	return 0
 }
 
+// Capabilities implements stack.LinkEndpoint.Capabilities. The peer of the file
+// descriptor may be anything, so checksums are always computed and verified in
+// software.
+func (*endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return 0
+}
+
 // WritePacket writes outbound packets to the file descriptor. If it is not
 // currently writable, the packet is dropped.
-func (e *endpoint) WritePacket(_ *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) error {
-	if payload == nil {
+func (e *endpoint) WritePacket(_ *stack.Route, hdr *buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) error {
+	views := payload.Views()
+	switch len(views) {
+	case 0:
 		return rawfile.NonBlockingWrite(e.fd, hdr.UsedBytes())
+	case 1:
+		return rawfile.NonBlockingWrite2(e.fd, hdr.UsedBytes(), views[0])
+	}
 
+	bufs := make([][]byte, 0, 1+len(views))
+	bufs = append(bufs, hdr.UsedBytes())
+	for _, v := range views {
+		bufs = append(bufs, v)
 	}
+	return rawfile.NonBlockingWriteN(e.fd, bufs...)
+}
 
-	return rawfile.NonBlockingWrite2(e.fd, hdr.UsedBytes(), payload)
+// maxBatchSize is the maximum number of packets read from the file descriptor
+// before they're dispatched as a batch.
+const maxBatchSize = 32
+
+// handoffSlack bounds the part of the read buffer a packet may leave unused and
+// still be handed up the stack in it: at most 1/handoffSlack. Shorter packets
+// are copied into a buffer of their own size, since the receive buffer limits
+// of the endpoints they're queued on count their length, not their capacity.
+const handoffSlack = 8
+
+// packetReader reads the packets of an endpoint. Packets are read into a buffer
+// that can hold packets of the size of the MTU. Packets that (nearly) fill it
+// are handed up the stack in it, and it's replaced by a new one, so that their
+// bytes aren't copied; other packets are copied into a buffer of their own
+// size, as are larger packets, whose bytes spill over into a spare buffer.
+type packetReader struct {
+	e      *endpoint
+	views  [2]buffer.View
+	iovecs [2]syscall.Iovec
 }
 
-// dispatch reads one packet from the file descriptor and dispatches it.
-func (e *endpoint) dispatch(d stack.NetworkDispatcher, largeV buffer.View) (bool, error) {
-	n, err := rawfile.BlockingRead(e.fd, largeV)
+func newPacketReader(e *endpoint) *packetReader {
+	r := &packetReader{e: e}
+	r.takeBuffer()
+	if spare := header.MaxIPPacketSize - len(r.views[0]); spare > 0 {
+		r.views[1] = buffer.NewView(spare)
+		r.iovecs[1] = syscall.Iovec{Base: &r.views[1][0]}
+		r.iovecs[1].SetLen(spare)
+	}
+	return r
+}
+
+// takeBuffer allocates a new buffer to read packets into.
+func (r *packetReader) takeBuffer() {
+	r.views[0] = buffer.NewView(r.e.mtu)
+	r.iovecs[0] = syscall.Iovec{Base: &r.views[0][0]}
+	r.iovecs[0].SetLen(len(r.views[0]))
+}
+
+// readPacket reads one packet from the file descriptor, blocking if requested
+// until one is available. It returns a nil view for packets that are neither
+// IPv4 nor IPv6.
+func (r *packetReader) readPacket(block bool) (buffer.View, tcpip.NetworkProtocolNumber, error) {
+	iovecs := r.iovecs[:]
+	if len(r.views[1]) == 0 {
+		iovecs = iovecs[:1]
+	}
+
+	e := r.e
+	var n int
+	var err error
+	if block && e.stopFDs[0] >= 0 {
+		n, err = rawfile.BlockingReadvUntilStopped(e.fd, e.stopFDs[0], iovecs)
+	} else if block {
+		n, err = rawfile.BlockingReadv(e.fd, iovecs)
+	} else {
+		n, err = rawfile.NonBlockingReadv(e.fd, iovecs)
+	}
 	if err != nil {
-		return false, err
+		return nil, 0, err
 	}
 
 	if n <= 0 {
-		return false, nil
+		return nil, 0, errClosed
 	}
 
-	v := buffer.NewView(n)
-	copy(v, largeV)
-
 	// We don't get any indication of what the packet is, so try to guess
-	// if it's an IPv4 or IPv6 packet.
+	// if it's an IPv4 or IPv6 packet. Its first bytes are always in the
+	// first buffer, even if the rest spilled over into the spare one.
+	first := r.views[0]
+	if n < len(first) {
+		first = first[:n]
+	}
 	var p tcpip.NetworkProtocolNumber
-	switch header.IPVersion(v) {
+	switch header.IPVersion(first) {
 	case header.IPv4Version:
 		p = header.IPv4ProtocolNumber
 	case header.IPv6Version:
 		p = header.IPv6ProtocolNumber
 	default:
-		return true, nil
+		return nil, 0, nil
+	}
+
+	if n <= len(r.views[0]) && len(r.views[0])-n <= len(r.views[0])/handoffSlack {
+		v := r.views[0][:n]
+		r.takeBuffer()
+		return v, p, nil
+	}
+
+	v := buffer.NewView(n)
+	m := copy(v, r.views[0])
+	copy(v[m:], r.views[1])
+
+	return v, p, nil
+}
+
+// dispatch reads one packet from the file descriptor and dispatches it.
+func (e *endpoint) dispatch(d stack.NetworkDispatcher, r *packetReader) error {
+	v, p, err := r.readPacket(true)
+	if err != nil {
+		return err
 	}
 
-	d.DeliverNetworkPacket(e, p, v)
+	if v != nil {
+		d.DeliverNetworkPacket(e, p, v)
+	}
 
-	return true, nil
+	return nil
+}
+
+// dispatchBatch reads all packets available in the file descriptor, blocking
+// until at least one is, up to maxBatchSize, and dispatches them as a batch.
+func (e *endpoint) dispatchBatch(d stack.BatchNetworkDispatcher, r *packetReader, batch []stack.InboundPacket) error {
+	batch = batch[:0]
+	for len(batch) < maxBatchSize {
+		v, p, err := r.readPacket(len(batch) == 0)
+		if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK {
+			break
+		}
+		if err != nil {
+			if len(batch) != 0 {
+				d.DeliverNetworkPackets(e, batch)
+			}
+			return err
+		}
+
+		if v != nil {
+			batch = append(batch, stack.InboundPacket{Protocol: p, Data: v})
+		}
+	}
+
+	if len(batch) != 0 {
+		d.DeliverNetworkPackets(e, batch)
+	}
+
+	return nil
 }
 
 // dispatchLoop reads packets from the file descriptor in a loop and dispatches
-// them to the network stack.
+// them to the network stack. Packets are dispatched in batches if the
+// dispatcher supports it.
 func (e *endpoint) dispatchLoop(d stack.NetworkDispatcher) error {
-	v := buffer.NewView(header.MaxIPPacketSize)
+	r := newPacketReader(e)
+	bd, _ := d.(stack.BatchNetworkDispatcher)
+	batch := make([]stack.InboundPacket, 0, maxBatchSize)
 	for {
-		cont, err := e.dispatch(d, v)
-		if err != nil || !cont {
+		var err error
+		if bd != nil {
+			err = e.dispatchBatch(bd, r, batch)
+		} else {
+			err = e.dispatch(d, r)
+		}
+
+		if err == rawfile.ErrStopped {
+			return nil
+		}
+
+		if err != nil {
+			if err == errClosed {
+				err = nil
+			}
+			d.LinkStateChanged(e, false)
 			if e.closed != nil {
 				e.closed(err)
 			}
@@ -0,0 +1,114 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fdbased
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+const testMTU = 1000
+
+// newTestReader creates an endpoint on one end of a seqpacket socket pair, and
+// a reader of its packets. It returns the reader, the other end of the pair,
+// and a function that closes them.
+func newTestReader(t *testing.T) (*packetReader, int, func()) {
+	t.Helper()
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair failed: %v", err)
+	}
+	e := stack.FindLinkEndpoint(New(fds[0], testMTU, nil)).(*endpoint)
+
+	return newPacketReader(e), fds[1], func() {
+		e.Close()
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+	}
+}
+
+// ipv4Packet returns a packet of the given size that looks like an IPv4 one.
+func ipv4Packet(size int) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	b[0] = header.IPv4Version << 4
+	return b
+}
+
+func TestReadPacket(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		size    int
+		handoff bool
+	}{
+		{name: "small packet copied", size: 300, handoff: false},
+		{name: "packet short of the slack copied", size: testMTU - testMTU/handoffSlack - 1, handoff: false},
+		{name: "packet within the slack handed off", size: testMTU - testMTU/handoffSlack, handoff: true},
+		{name: "MTU-sized packet handed off", size: testMTU, handoff: true},
+		{name: "oversized packet spilled and copied", size: testMTU + 500, handoff: false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r, peer, closeFDs := newTestReader(t)
+			defer closeFDs()
+
+			want := ipv4Packet(test.size)
+			if _, err := syscall.Write(peer, want); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+
+			buf := &r.views[0][0]
+			v, p, err := r.readPacket(true)
+			if err != nil {
+				t.Fatalf("readPacket failed: %v", err)
+			}
+			if p != header.IPv4ProtocolNumber {
+				t.Errorf("Got protocol %d, want %d", p, header.IPv4ProtocolNumber)
+			}
+			if !bytes.Equal(v, want) {
+				t.Fatalf("Got packet of %d bytes different from the %d bytes written", len(v), len(want))
+			}
+
+			// A packet handed off keeps the buffer it was read into,
+			// and the reader moves on to a new one; a copied packet
+			// has its own buffer, and the reader keeps its own.
+			if handoff := &v[0] == buf; handoff != test.handoff {
+				t.Errorf("Got packet in the read buffer = %t, want %t", handoff, test.handoff)
+			}
+			if replaced := &r.views[0][0] != buf; replaced != test.handoff {
+				t.Errorf("Got read buffer replaced = %t, want %t", replaced, test.handoff)
+			}
+			if len(r.views[0]) != testMTU {
+				t.Errorf("Got read buffer of %d bytes, want %d", len(r.views[0]), testMTU)
+			}
+		})
+	}
+}
+
+func TestReadPacketNotIP(t *testing.T) {
+	r, peer, closeFDs := newTestReader(t)
+	defer closeFDs()
+
+	if _, err := syscall.Write(peer, make([]byte, 500)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	buf := &r.views[0][0]
+	v, _, err := r.readPacket(true)
+	if err != nil {
+		t.Fatalf("readPacket failed: %v", err)
+	}
+	if v != nil {
+		t.Errorf("Got a packet of %d bytes that is neither IPv4 nor IPv6, want none", len(v))
+	}
+	if &r.views[0][0] != buf {
+		t.Errorf("Read buffer replaced after a packet that was dropped")
+	}
+}
@@ -0,0 +1,392 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Instruction classes, sizes, modes and operations of classic BPF. The values
+// match the ones used by the Linux kernel and libpcap, so programs compiled by
+// tools such as "tcpdump -dd" can be used as is.
+const (
+	ClassLD   = 0x00
+	ClassLDX  = 0x01
+	ClassST   = 0x02
+	ClassSTX  = 0x03
+	ClassALU  = 0x04
+	ClassJMP  = 0x05
+	ClassRET  = 0x06
+	ClassMISC = 0x07
+
+	SizeW = 0x00
+	SizeH = 0x08
+	SizeB = 0x10
+
+	ModeIMM = 0x00
+	ModeABS = 0x20
+	ModeIND = 0x40
+	ModeMEM = 0x60
+	ModeLEN = 0x80
+	ModeMSH = 0xa0
+
+	ALUAdd = 0x00
+	ALUSub = 0x10
+	ALUMul = 0x20
+	ALUDiv = 0x30
+	ALUOr  = 0x40
+	ALUAnd = 0x50
+	ALULsh = 0x60
+	ALURsh = 0x70
+	ALUNeg = 0x80
+	ALUMod = 0x90
+	ALUXor = 0xa0
+
+	JumpA   = 0x00
+	JumpEQ  = 0x10
+	JumpGT  = 0x20
+	JumpGE  = 0x30
+	JumpSet = 0x40
+
+	SrcK = 0x00
+	SrcX = 0x08
+
+	RetA = 0x10
+
+	MiscTAX = 0x00
+	MiscTXA = 0x80
+)
+
+const (
+	// memWords is the number of words of scratch memory available to
+	// programs.
+	memWords = 16
+
+	// maxProgramLength is the maximum number of instructions in a program,
+	// the same limit as the one imposed by Linux.
+	maxProgramLength = 4096
+)
+
+// Errors returned when compiling programs.
+var (
+	ErrEmptyProgram    = errors.New("bpf: empty program")
+	ErrProgramTooLarge = errors.New("bpf: program too large")
+	ErrBadInstruction  = errors.New("bpf: invalid instruction")
+	ErrBadJump         = errors.New("bpf: jump out of bounds")
+	ErrBadMemoryIndex  = errors.New("bpf: scratch memory index out of bounds")
+	ErrDivisionByZero  = errors.New("bpf: division by constant zero")
+	ErrMissingReturn   = errors.New("bpf: program doesn't end with a return")
+)
+
+// Errors that cause a running program to reject the packet.
+var (
+	errOutOfBoundsLoad = errors.New("bpf: load out of bounds")
+	errDivisionByZero  = errors.New("bpf: division by zero")
+)
+
+// Instruction is a classic BPF instruction, with the same layout as the
+// sock_filter struct.
+type Instruction struct {
+	Code uint16
+	Jt   uint8
+	Jf   uint8
+	K    uint32
+}
+
+// Program is a validated classic BPF program. Programs run against packets
+// that start with the network-layer header, that is, the same as the DLT_RAW
+// link type in libpcap.
+type Program struct {
+	insns []Instruction
+}
+
+// Compile validates the given instructions and returns a program that can be
+// run against packets.
+func Compile(insns []Instruction) (*Program, error) {
+	if len(insns) == 0 {
+		return nil, ErrEmptyProgram
+	}
+
+	if len(insns) > maxProgramLength {
+		return nil, ErrProgramTooLarge
+	}
+
+	for pc, i := range insns {
+		switch i.Code & 0x07 {
+		case ClassLD, ClassLDX:
+			if !validLoad(i.Code) {
+				return nil, ErrBadInstruction
+			}
+			if i.Code&0xe0 == ModeMEM && i.K >= memWords {
+				return nil, ErrBadMemoryIndex
+			}
+
+		case ClassST, ClassSTX:
+			if i.K >= memWords {
+				return nil, ErrBadMemoryIndex
+			}
+
+		case ClassALU:
+			op := i.Code & 0xf0
+			if op > ALUXor {
+				return nil, ErrBadInstruction
+			}
+			if (op == ALUDiv || op == ALUMod) && i.Code&SrcX == 0 && i.K == 0 {
+				return nil, ErrDivisionByZero
+			}
+
+		case ClassJMP:
+			next := pc + 1
+			if i.Code&0xf0 == JumpA {
+				if uint64(next)+uint64(i.K) >= uint64(len(insns)) {
+					return nil, ErrBadJump
+				}
+			} else if next+int(i.Jt) >= len(insns) || next+int(i.Jf) >= len(insns) {
+				return nil, ErrBadJump
+			}
+
+		case ClassRET, ClassMISC:
+		}
+	}
+
+	if insns[len(insns)-1].Code&0x07 != ClassRET {
+		return nil, ErrMissingReturn
+	}
+
+	p := &Program{insns: make([]Instruction, len(insns))}
+	copy(p.insns, insns)
+	return p, nil
+}
+
+// packet is the packet that a program runs against. It's made of two parts
+// so that outbound packets don't need to be flattened.
+type packet struct {
+	hdr     []byte
+	payload []byte
+}
+
+func (p *packet) len() uint32 {
+	return uint32(len(p.hdr) + len(p.payload))
+}
+
+// load loads size bytes from the given offset of the packet. The offset is
+// 64-bit so that offsets computed from 32-bit values don't wrap around.
+func (p *packet) load(off uint64, size int) (uint32, error) {
+	if off+uint64(size) > uint64(p.len()) {
+		return 0, errOutOfBoundsLoad
+	}
+
+	var buf [4]byte
+	b := buf[:size]
+	for i := range b {
+		o := int(off) + i
+		if o < len(p.hdr) {
+			b[i] = p.hdr[o]
+		} else {
+			b[i] = p.payload[o-len(p.hdr)]
+		}
+	}
+
+	switch size {
+	case 1:
+		return uint32(b[0]), nil
+	case 2:
+		return uint32(binary.BigEndian.Uint16(b)), nil
+	default:
+		return binary.BigEndian.Uint32(b), nil
+	}
+}
+
+// validLoad returns whether the addressing mode and size of the given LD or LDX
+// instruction are valid, as in the Linux kernel: LD loads packet data of any
+// size with ModeABS and ModeIND, LDX loads the header length of IPv4 packets
+// with ModeMSH and a byte size, and both load words with ModeIMM, ModeMEM and
+// ModeLEN.
+func validLoad(code uint16) bool {
+	mode, size := code&0xe0, code&0x18
+	switch mode {
+	case ModeIMM, ModeMEM, ModeLEN:
+		return size == SizeW
+	case ModeABS, ModeIND:
+		return code&0x07 == ClassLD && size != 0x18
+	case ModeMSH:
+		return code&0x07 == ClassLDX && size == SizeB
+	default:
+		return false
+	}
+}
+
+// loadSize returns the number of bytes loaded by an instruction with the given
+// code.
+func loadSize(code uint16) int {
+	switch code & 0x18 {
+	case SizeH:
+		return 2
+	case SizeB:
+		return 1
+	default:
+		return 4
+	}
+}
+
+// Run runs the program against the packet formed by the concatenation of hdr
+// and payload, and returns the program's return value. By convention, zero
+// means the packet must be rejected, and non-zero values are the number of
+// bytes of the packet to accept. Out of bounds loads cause the program to
+// return zero.
+func (p *Program) Run(hdr, payload []byte) uint32 {
+	pkt := packet{hdr: hdr, payload: payload}
+
+	var a, x uint32
+	var mem [memWords]uint32
+	for pc := 0; pc < len(p.insns); pc++ {
+		i := &p.insns[pc]
+		switch i.Code & 0x07 {
+		case ClassLD:
+			v, err := p.loadValue(&pkt, i, x, &mem)
+			if err != nil {
+				return 0
+			}
+			a = v
+
+		case ClassLDX:
+			if i.Code&0xe0 == ModeMSH {
+				v, err := pkt.load(uint64(i.K), 1)
+				if err != nil {
+					return 0
+				}
+				x = (v & 0xf) << 2
+				break
+			}
+
+			v, err := p.loadValue(&pkt, i, 0, &mem)
+			if err != nil {
+				return 0
+			}
+			x = v
+
+		case ClassST:
+			mem[i.K] = a
+
+		case ClassSTX:
+			mem[i.K] = x
+
+		case ClassALU:
+			v := i.K
+			if i.Code&SrcX != 0 {
+				v = x
+			}
+
+			r, err := alu(i.Code&0xf0, a, v)
+			if err != nil {
+				return 0
+			}
+			a = r
+
+		case ClassJMP:
+			v := i.K
+			if i.Code&SrcX != 0 {
+				v = x
+			}
+
+			var cond bool
+			switch i.Code & 0xf0 {
+			case JumpA:
+				pc += int(i.K)
+				continue
+			case JumpEQ:
+				cond = a == v
+			case JumpGT:
+				cond = a > v
+			case JumpGE:
+				cond = a >= v
+			case JumpSet:
+				cond = a&v != 0
+			default:
+				return 0
+			}
+
+			if cond {
+				pc += int(i.Jt)
+			} else {
+				pc += int(i.Jf)
+			}
+
+		case ClassRET:
+			switch i.Code & 0x18 {
+			case RetA:
+				return a
+			case SrcX:
+				return x
+			default:
+				return i.K
+			}
+
+		case ClassMISC:
+			if i.Code&0xf8 == MiscTXA {
+				a = x
+			} else {
+				x = a
+			}
+		}
+	}
+
+	return 0
+}
+
+// loadValue returns the value loaded by a LD or LDX instruction.
+func (p *Program) loadValue(pkt *packet, i *Instruction, x uint32, mem *[memWords]uint32) (uint32, error) {
+	switch i.Code & 0xe0 {
+	case ModeIMM:
+		return i.K, nil
+	case ModeABS:
+		return pkt.load(uint64(i.K), loadSize(i.Code))
+	case ModeIND:
+		return pkt.load(uint64(x)+uint64(i.K), loadSize(i.Code))
+	case ModeMEM:
+		return mem[i.K], nil
+	case ModeLEN:
+		return pkt.len(), nil
+	}
+
+	return 0, ErrBadInstruction
+}
+
+// alu performs the given ALU operation on a and v.
+func alu(op uint16, a, v uint32) (uint32, error) {
+	switch op {
+	case ALUAdd:
+		return a + v, nil
+	case ALUSub:
+		return a - v, nil
+	case ALUMul:
+		return a * v, nil
+	case ALUDiv:
+		if v == 0 {
+			return 0, errDivisionByZero
+		}
+		return a / v, nil
+	case ALUMod:
+		if v == 0 {
+			return 0, errDivisionByZero
+		}
+		return a % v, nil
+	case ALUOr:
+		return a | v, nil
+	case ALUAnd:
+		return a & v, nil
+	case ALULsh:
+		return a << v, nil
+	case ALURsh:
+		return a >> v, nil
+	case ALUNeg:
+		return -a, nil
+	case ALUXor:
+		return a ^ v, nil
+	}
+
+	return 0, ErrBadInstruction
+}
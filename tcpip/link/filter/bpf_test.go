@@ -0,0 +1,154 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter_test
+
+import (
+	"testing"
+
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/filter"
+)
+
+// tcpOnly is the program generated by "tcpdump -y RAW -dd ip proto tcp".
+var tcpOnly = []filter.Instruction{
+	{Code: filter.ClassLD | filter.SizeB | filter.ModeABS, K: 9},
+	{Code: filter.ClassJMP | filter.JumpEQ | filter.SrcK, Jt: 0, Jf: 1, K: 6},
+	{Code: filter.ClassRET | filter.SrcK, K: 0xffff},
+	{Code: filter.ClassRET | filter.SrcK, K: 0},
+}
+
+func ipv4Packet(proto uint8) []byte {
+	b := make([]byte, header.IPv4MinimumSize)
+	header.IPv4(b).Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: header.IPv4MinimumSize,
+		Protocol:    proto,
+	})
+	return b
+}
+
+func TestRun(t *testing.T) {
+	p, err := filter.Compile(tcpOnly)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+
+	if v := p.Run(ipv4Packet(uint8(header.TCPProtocolNumber)), nil); v != 0xffff {
+		t.Errorf("Run(tcp) = %d, want %d", v, 0xffff)
+	}
+
+	if v := p.Run(ipv4Packet(uint8(header.UDPProtocolNumber)), nil); v != 0 {
+		t.Errorf("Run(udp) = %d, want %d", v, 0)
+	}
+
+	// The protocol field is in the second part of a split packet.
+	b := ipv4Packet(uint8(header.TCPProtocolNumber))
+	if v := p.Run(b[:5], b[5:]); v != 0xffff {
+		t.Errorf("Run(split tcp) = %d, want %d", v, 0xffff)
+	}
+
+	// Loads beyond the end of the packet reject it.
+	if v := p.Run(b[:9], nil); v != 0 {
+		t.Errorf("Run(short) = %d, want %d", v, 0)
+	}
+}
+
+func TestIndirectLoadOverflow(t *testing.T) {
+	// Load the byte at X+K, with X+K wrapping around to the protocol
+	// field in 32 bits, and return it.
+	p, err := filter.Compile([]filter.Instruction{
+		{Code: filter.ClassLDX | filter.SizeW | filter.ModeIMM, K: 10},
+		{Code: filter.ClassLD | filter.SizeB | filter.ModeIND, K: 0xffffffff},
+		{Code: filter.ClassRET | filter.RetA},
+	})
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+
+	if v := p.Run(ipv4Packet(uint8(header.TCPProtocolNumber)), nil); v != 0 {
+		t.Errorf("Run with an overflowing offset = %d, want %d", v, 0)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		comment string
+		insns   []filter.Instruction
+		want    error
+	}{
+		{"Empty", nil, filter.ErrEmptyProgram},
+		{"No return", tcpOnly[:1], filter.ErrMissingReturn},
+		{
+			"Jump past the end",
+			[]filter.Instruction{
+				{Code: filter.ClassJMP | filter.JumpA, K: 1},
+				{Code: filter.ClassRET | filter.SrcK},
+			},
+			filter.ErrBadJump,
+		},
+		{
+			"Bad memory index",
+			[]filter.Instruction{
+				{Code: filter.ClassST, K: 16},
+				{Code: filter.ClassRET | filter.SrcK},
+			},
+			filter.ErrBadMemoryIndex,
+		},
+		{
+			"LDX with absolute mode",
+			[]filter.Instruction{
+				{Code: filter.ClassLDX | filter.SizeW | filter.ModeABS, K: 0},
+				{Code: filter.ClassRET | filter.SrcK},
+			},
+			filter.ErrBadInstruction,
+		},
+		{
+			"LDX with indirect mode",
+			[]filter.Instruction{
+				{Code: filter.ClassLDX | filter.SizeB | filter.ModeIND, K: 0},
+				{Code: filter.ClassRET | filter.SrcK},
+			},
+			filter.ErrBadInstruction,
+		},
+		{
+			"LD with MSH mode",
+			[]filter.Instruction{
+				{Code: filter.ClassLD | filter.SizeB | filter.ModeMSH, K: 0},
+				{Code: filter.ClassRET | filter.SrcK},
+			},
+			filter.ErrBadInstruction,
+		},
+		{
+			"LDX with MSH mode and word size",
+			[]filter.Instruction{
+				{Code: filter.ClassLDX | filter.SizeW | filter.ModeMSH, K: 0},
+				{Code: filter.ClassRET | filter.SrcK},
+			},
+			filter.ErrBadInstruction,
+		},
+		{
+			"LD immediate with byte size",
+			[]filter.Instruction{
+				{Code: filter.ClassLD | filter.SizeB | filter.ModeIMM, K: 0},
+				{Code: filter.ClassRET | filter.SrcK},
+			},
+			filter.ErrBadInstruction,
+		},
+		{
+			"Division by zero",
+			[]filter.Instruction{
+				{Code: filter.ClassALU | filter.ALUDiv | filter.SrcK, K: 0},
+				{Code: filter.ClassRET | filter.SrcK},
+			},
+			filter.ErrDivisionByZero,
+		},
+	}
+
+	for _, test := range tests {
+		if _, err := filter.Compile(test.insns); err != test.want {
+			t.Errorf("%s: Compile returned %v, want %v", test.comment, err, test.want)
+		}
+	}
+}
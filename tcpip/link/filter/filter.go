@@ -0,0 +1,146 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package filter provides the implementation of data-link layer endpoints that
+// wrap another endpoint and drop packets that don't match classic BPF
+// programs, as well as the BPF interpreter itself, which can also be used by
+// other endpoints (e.g., the sniffer) to select packets.
+//
+// Filter endpoints can be used in the networking stack by calling New(eID,
+// in, out) to create a new endpoint, where eID is the ID of the endpoint being
+// wrapped, and then passing it as an argument to Stack.CreateNIC().
+package filter
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// Endpoint is a link layer endpoint that only lets through the packets that
+// are accepted by its programs.
+type Endpoint struct {
+	dispatcher stack.NetworkDispatcher
+	lower      stack.LinkEndpoint
+
+	// mu protects the programs below. A nil program accepts all packets.
+	mu       sync.RWMutex
+	inbound  *Program
+	outbound *Program
+
+	// The following fields count the dropped packets; they are only
+	// accessed atomically.
+	droppedInbound  uint64
+	droppedOutbound uint64
+}
+
+// New creates a new filter link-layer endpoint. It wraps around another
+// endpoint and drops inbound packets rejected by the inbound program before
+// they enter the stack, and outbound packets rejected by the outbound program
+// before they reach the lower endpoint. Either program may be nil, in which
+// case all packets in that direction are accepted.
+func New(lower tcpip.LinkEndpointID, inbound, outbound *Program) (tcpip.LinkEndpointID, *Endpoint) {
+	e := &Endpoint{
+		lower:    stack.FindLinkEndpoint(lower),
+		inbound:  inbound,
+		outbound: outbound,
+	}
+
+	return stack.RegisterLinkEndpoint(e), e
+}
+
+// SetPrograms replaces the programs used to filter inbound and outbound
+// packets. It can be called while the endpoint is in use.
+func (e *Endpoint) SetPrograms(inbound, outbound *Program) {
+	e.mu.Lock()
+	e.inbound = inbound
+	e.outbound = outbound
+	e.mu.Unlock()
+}
+
+// Dropped returns the number of inbound and outbound packets dropped so far.
+func (e *Endpoint) Dropped() (inbound, outbound uint64) {
+	return atomic.LoadUint64(&e.droppedInbound), atomic.LoadUint64(&e.droppedOutbound)
+}
+
+// accept determines if the given program accepts the packet. A nil program
+// accepts all packets.
+func accept(p *Program, hdr, payload []byte) bool {
+	return p == nil || p.Run(hdr, payload) != 0
+}
+
+// DeliverNetworkPacket implements the stack.NetworkDispatcher interface. It is
+// called by the link-layer endpoint being wrapped when a packet arrives, and
+// only forwards it to the actual dispatcher if the inbound program accepts it.
+func (e *Endpoint) DeliverNetworkPacket(linkEP stack.LinkEndpoint, protocol tcpip.NetworkProtocolNumber, v buffer.View) {
+	e.mu.RLock()
+	ok := accept(e.inbound, v, nil)
+	e.mu.RUnlock()
+
+	if !ok {
+		atomic.AddUint64(&e.droppedInbound, 1)
+		return
+	}
+
+	e.dispatcher.DeliverNetworkPacket(e, protocol, v)
+}
+
+// LinkStateChanged implements the stack.NetworkDispatcher interface. It just
+// forwards the notification to the actual dispatcher.
+func (e *Endpoint) LinkStateChanged(linkEP stack.LinkEndpoint, up bool) {
+	e.dispatcher.LinkStateChanged(e, up)
+}
+
+// Attach implements the stack.LinkEndpoint interface. It saves the dispatcher
+// and registers with the lower endpoint as its dispatcher so that "e" is called
+// for inbound packets.
+func (e *Endpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.dispatcher = dispatcher
+	e.lower.Attach(e)
+}
+
+// MTU implements stack.LinkEndpoint.MTU. It just forwards the request to the
+// lower endpoint.
+func (e *Endpoint) MTU() uint32 {
+	return e.lower.MTU()
+}
+
+// MaxHeaderLength implements the stack.LinkEndpoint interface. It just forwards
+// the request to the lower endpoint.
+func (e *Endpoint) MaxHeaderLength() uint16 {
+	return e.lower.MaxHeaderLength()
+}
+
+// Capabilities implements stack.LinkEndpoint.Capabilities. It just forwards the
+// request to the lower endpoint.
+func (e *Endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return e.lower.Capabilities()
+}
+
+// Close implements stack.ClosableLinkEndpoint.Close. It just forwards the
+// request to the lower endpoint, if it can be closed.
+func (e *Endpoint) Close() {
+	if cep, ok := e.lower.(stack.ClosableLinkEndpoint); ok {
+		cep.Close()
+	}
+}
+
+// WritePacket implements the stack.LinkEndpoint interface. It drops the packet
+// if the outbound program rejects it, and otherwise forwards the request to the
+// lower endpoint.
+func (e *Endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) error {
+	e.mu.RLock()
+	ok := accept(e.outbound, hdr.UsedBytes(), payload.ToView())
+	e.mu.RUnlock()
+
+	if !ok {
+		atomic.AddUint64(&e.droppedOutbound, 1)
+		return nil
+	}
+
+	return e.lower.WritePacket(r, hdr, payload, protocol)
+}
@@ -0,0 +1,197 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package geneve provides the implementation of Geneve virtual NICs, which
+// exchange ethernet frames with remote tunnel endpoints (VTEPs) over UDP, per
+// RFC 8926, to build overlay networks. Unlike VXLAN headers, Geneve headers
+// carry options, which convey metadata about the frames.
+//
+// Geneve endpoints can be used in the networking stack by calling New(s,
+// config) to create a new endpoint, where s is the stack the encapsulated
+// frames are sent and received through, and then passing it as an argument to
+// Stack.CreateNIC(), possibly of another stack. The endpoint binds a UDP
+// endpoint of s to the local address and port of the configuration.
+//
+// The endpoints are tunnel endpoints; see the tunnel package for how the
+// destinations of the frames are found.
+package geneve
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/tunnel"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+const (
+	// DefaultMTU is the MTU of endpoints whose configuration doesn't set
+	// one, and has no options: the MTU of ethernet, minus the size of the
+	// encapsulation headers of IPv4 underlays. The size of the options is
+	// subtracted from it too.
+	DefaultMTU = 1500 - header.IPv4MinimumSize - header.UDPMinimumSize - header.GeneveMinimumSize - header.EthernetMinimumSize
+
+	// DefaultAgeingTime is the default amount of time after which learned
+	// entries are forgotten if no frames are received from them.
+	DefaultAgeingTime = tunnel.DefaultAgeingTime
+)
+
+// Errors returned when creating endpoints, adding entries to their tables, and
+// writing packets.
+var (
+	ErrBadVNI         = errors.New("geneve: invalid vni")
+	ErrBadOptions     = errors.New("geneve: invalid options")
+	ErrBadLinkAddress = tunnel.ErrBadLinkAddress
+	ErrNoLinkAddress  = tunnel.ErrNoLinkAddress
+)
+
+// Config describes a Geneve endpoint.
+type Config struct {
+	// VNI is the virtual network identifier of the overlay network.
+	VNI uint32
+
+	// Options are the options sent with every frame.
+	Options []header.GeneveOption
+
+	// HandleOptions is called with the options of every frame received,
+	// by the goroutine that receives them, and returns false if the frame
+	// must be dropped, e.g., because it has a critical option it doesn't
+	// understand. The options alias the frame, so they must be copied to
+	// be retained. If it's nil, the frames with critical options are
+	// dropped, and the others are received.
+	HandleOptions func(opts []header.GeneveOption) bool
+
+	// LocalAddress is the address of the underlay stack that frames are
+	// sent from and received on. Its length selects IPv4 or IPv6.
+	LocalAddress tcpip.Address
+
+	// NIC is the NIC of the underlay stack that frames are sent and
+	// received through, or zero for any.
+	NIC tcpip.NICID
+
+	// Port is the UDP port that frames are sent from and to, and received
+	// on, or zero for header.GenevePort.
+	Port uint16
+
+	// LinkAddress is the ethernet address of the endpoint.
+	LinkAddress tcpip.LinkAddress
+
+	// MTU is the MTU of the endpoint, or zero for DefaultMTU minus the
+	// size of the options.
+	MTU uint32
+
+	// Remotes are the addresses of the remote VTEPs that broadcast and
+	// multicast frames, and frames to unknown destinations, are flooded
+	// to.
+	Remotes []tcpip.Address
+
+	// Learning enables the learning of the forwarding database and the
+	// neighbor table from inbound frames.
+	Learning bool
+
+	// AgeingTime is the amount of time after which learned entries are
+	// forgotten if no frames are received from them, or zero for
+	// DefaultAgeingTime.
+	AgeingTime time.Duration
+}
+
+// Endpoint is a Geneve link-layer endpoint. Its methods are the ones of tunnel
+// endpoints.
+type Endpoint struct {
+	*tunnel.Endpoint
+}
+
+// New creates a new Geneve link-layer endpoint, which sends and receives the
+// encapsulated frames through the stack s.
+func New(s *stack.Stack, cfg Config) (tcpip.LinkEndpointID, *Endpoint, error) {
+	if cfg.VNI > header.GeneveMaxVNI {
+		return 0, nil, ErrBadVNI
+	}
+	opts, critical, ok := header.EncodeGeneveOptions(cfg.Options)
+	if !ok {
+		return 0, nil, ErrBadOptions
+	}
+	if cfg.Port == 0 {
+		cfg.Port = header.GenevePort
+	}
+	if cfg.MTU == 0 {
+		cfg.MTU = DefaultMTU - uint32(len(opts))
+	}
+
+	id, e, err := tunnel.New(s, tunnel.Config{
+		LocalAddress: cfg.LocalAddress,
+		NIC:          cfg.NIC,
+		Port:         cfg.Port,
+		LinkAddress:  cfg.LinkAddress,
+		MTU:          cfg.MTU,
+		Remotes:      cfg.Remotes,
+		Learning:     cfg.Learning,
+		AgeingTime:   cfg.AgeingTime,
+	}, &encapsulation{
+		vni:           cfg.VNI,
+		options:       opts,
+		critical:      critical,
+		handleOptions: cfg.HandleOptions,
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, &Endpoint{e}, nil
+}
+
+// encapsulation implements tunnel.Encapsulation for a Geneve network.
+type encapsulation struct {
+	vni uint32
+
+	// options and critical are the encoded options sent, and whether any
+	// of them is critical.
+	options  []byte
+	critical bool
+
+	handleOptions func(opts []header.GeneveOption) bool
+}
+
+// HeaderLength implements tunnel.Encapsulation.HeaderLength.
+func (c *encapsulation) HeaderLength() int {
+	return header.GeneveMinimumSize + len(c.options)
+}
+
+// Encapsulate implements tunnel.Encapsulation.Encapsulate.
+func (c *encapsulation) Encapsulate(hdr *buffer.Prependable) {
+	header.Geneve(hdr.Prepend(c.HeaderLength())).Encode(&header.GeneveFields{
+		Critical: c.critical,
+		Protocol: header.TransparentEthernetProtocolNumber,
+		VNI:      c.vni,
+		Options:  c.options,
+	})
+}
+
+// Decapsulate implements tunnel.Encapsulation.Decapsulate. Frames of other
+// Geneve networks, control frames, and frames that don't carry ethernet frames
+// are dropped, as well as the ones whose options are rejected.
+func (c *encapsulation) Decapsulate(v buffer.View) (int, bool) {
+	h := header.Geneve(v)
+	if !h.IsValid() || h.VNI() != c.vni || h.OAM() || h.Protocol() != header.TransparentEthernetProtocolNumber {
+		return 0, false
+	}
+
+	if c.handleOptions == nil {
+		// The flag spares parsing the options.
+		return h.HeaderLength(), !h.Critical()
+	}
+
+	var opts []header.GeneveOption
+	for b := h.Options(); len(b) > 0; {
+		o, rest, ok := header.NextGeneveOption(b)
+		if !ok {
+			return 0, false
+		}
+		opts = append(opts, o)
+		b = rest
+	}
+	return h.HeaderLength(), c.handleOptions(opts)
+}
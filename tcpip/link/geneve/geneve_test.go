@@ -0,0 +1,246 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package geneve_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/geneve"
+	"github.com/google/netstack/tcpip/link/loopback"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	// The underlay addresses of the VTEPs.
+	vtepAddr1 = "\x0a\x00\x00\x01"
+	vtepAddr2 = "\x0a\x00\x00\x02"
+	vtepAddr3 = "\x0a\x00\x00\x03"
+
+	// The overlay addresses and link addresses of the Geneve NICs.
+	addr1     = "\xc0\xa8\x00\x01"
+	addr2     = "\xc0\xa8\x00\x02"
+	linkAddr1 = tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01")
+	linkAddr2 = tcpip.LinkAddress("\x02\x00\x00\x00\x00\x02")
+
+	port = 1234
+	vni  = 42
+)
+
+// newUnderlay returns a stack with a loopback NIC that has the addresses of
+// all the VTEPs.
+func newUnderlay(t *testing.T) *stack.Stack {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+	if err := s.CreateNIC(1, loopback.New()); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	for _, addr := range []tcpip.Address{vtepAddr1, vtepAddr2, vtepAddr3} {
+		if err := s.AddAddress(1, ipv4.ProtocolNumber, addr); err != nil {
+			t.Fatalf("AddAddress failed: %v", err)
+		}
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         1,
+	}})
+	return s
+}
+
+// overlay is a stack with a Geneve NIC, and a UDP endpoint bound to port.
+type overlay struct {
+	s  *stack.Stack
+	gn *geneve.Endpoint
+	ep tcpip.Endpoint
+	wq waiter.Queue
+}
+
+// close closes the endpoint and the stack, which closes the Geneve NIC.
+func (o *overlay) close() {
+	o.ep.Close()
+	o.s.Close()
+}
+
+// newOverlay returns an overlay stack whose Geneve NIC has the address addr.
+func newOverlay(t *testing.T, underlay *stack.Stack, cfg geneve.Config, addr tcpip.Address) *overlay {
+	id, linkEP, err := geneve.New(underlay, cfg)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, addr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         1,
+	}})
+
+	o := &overlay{s: s, gn: linkEP}
+	o.ep, err = s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &o.wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := o.ep.Bind(tcpip.FullAddress{Port: port}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	return o
+}
+
+// send sends the datagram v to port of addr.
+func (o *overlay) send(v string, addr tcpip.Address) error {
+	_, err := o.ep.Write(buffer.View(v), &tcpip.FullAddress{Addr: addr, Port: port})
+	return err
+}
+
+// recv waits for the next datagram, and returns it with its source address.
+func (o *overlay) recv(t *testing.T) (string, tcpip.Address) {
+	t.Helper()
+
+	we, ch := waiter.NewChannelEntry(nil)
+	o.wq.EventRegister(&we, waiter.EventIn)
+	defer o.wq.EventUnregister(&we)
+
+	for {
+		var from tcpip.FullAddress
+		v, err := o.ep.Read(&from)
+		if err == tcpip.ErrWouldBlock {
+			select {
+			case <-ch:
+				continue
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for a datagram")
+			}
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		return string(v), from.Addr
+	}
+}
+
+func TestOptions(t *testing.T) {
+	underlay := newUnderlay(t)
+
+	critical := header.GeneveOption{Class: 0x0102, Type: header.GeneveOptionCritical | 1, Data: []byte{1, 2, 3, 4}}
+	other := header.GeneveOption{Class: 0x0102, Type: 2}
+
+	o1 := newOverlay(t, underlay, geneve.Config{
+		VNI:          vni,
+		Options:      []header.GeneveOption{other, critical},
+		LocalAddress: vtepAddr1,
+		LinkAddress:  linkAddr1,
+		Remotes:      []tcpip.Address{vtepAddr3, vtepAddr2},
+	}, addr1)
+	defer o1.close()
+	if err := o1.gn.AddNeighbor(addr2, linkAddr2); err != nil {
+		t.Fatalf("AddNeighbor failed: %v", err)
+	}
+	if got, want := o1.s.NICInfo()[1].MTU, uint32(geneve.DefaultMTU-2*header.GeneveOptionHeaderSize-len(critical.Data)); got != want {
+		t.Errorf("got MTU %d, want %d", got, want)
+	}
+
+	// The second NIC understands the options, and the third one drops
+	// the frames with critical options.
+	var got []header.GeneveOption
+	o2 := newOverlay(t, underlay, geneve.Config{
+		VNI: vni,
+		HandleOptions: func(opts []header.GeneveOption) bool {
+			for _, o := range opts {
+				got = append(got, header.GeneveOption{Class: o.Class, Type: o.Type, Data: append([]byte(nil), o.Data...)})
+			}
+			return true
+		},
+		LocalAddress: vtepAddr2,
+		LinkAddress:  linkAddr2,
+	}, addr2)
+	defer o2.close()
+	o3 := newOverlay(t, underlay, geneve.Config{
+		VNI:          vni,
+		LocalAddress: vtepAddr3,
+		LinkAddress:  linkAddr2,
+	}, addr2)
+	defer o3.close()
+
+	we, ch := waiter.NewChannelEntry(nil)
+	o3.wq.EventRegister(&we, waiter.EventIn)
+	defer o3.wq.EventUnregister(&we)
+
+	if err := o1.send("options", addr2); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if v, _ := o2.recv(t); v != "options" {
+		t.Fatalf("got datagram %q, want %q", v, "options")
+	}
+	if len(got) != 2 || got[0].Class != other.Class || got[0].Type != other.Type || len(got[0].Data) != 0 ||
+		got[1].Class != critical.Class || got[1].Type != critical.Type || string(got[1].Data) != string(critical.Data) {
+		t.Fatalf("got options %+v, want %+v", got, []header.GeneveOption{other, critical})
+	}
+
+	select {
+	case <-ch:
+		v, _ := o3.ep.Read(nil)
+		t.Fatalf("got datagram %q with a critical option", v)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Malformed options are rejected.
+	_, _, err := geneve.New(underlay, geneve.Config{
+		Options:     []header.GeneveOption{{Data: []byte{1}}},
+		LinkAddress: linkAddr1,
+	})
+	if err != geneve.ErrBadOptions {
+		t.Fatalf("New returned %v, want %v", err, geneve.ErrBadOptions)
+	}
+}
+
+func TestLearning(t *testing.T) {
+	underlay := newUnderlay(t)
+
+	o1 := newOverlay(t, underlay, geneve.Config{
+		VNI:          vni,
+		LocalAddress: vtepAddr1,
+		LinkAddress:  linkAddr1,
+	}, addr1)
+	defer o1.close()
+	if err := o1.gn.AddNeighbor(addr2, linkAddr2); err != nil {
+		t.Fatalf("AddNeighbor failed: %v", err)
+	}
+	if err := o1.gn.AddFDBEntry(linkAddr2, vtepAddr2); err != nil {
+		t.Fatalf("AddFDBEntry failed: %v", err)
+	}
+	o2 := newOverlay(t, underlay, geneve.Config{
+		VNI:          vni,
+		LocalAddress: vtepAddr2,
+		LinkAddress:  linkAddr2,
+		Learning:     true,
+	}, addr2)
+	defer o2.close()
+
+	if err := o1.send("ping", addr2); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if v, from := o2.recv(t); v != "ping" || from != addr1 {
+		t.Fatalf("got datagram %q from %q, want %q from %q", v, from, "ping", addr1)
+	}
+
+	if err := o2.send("pong", addr1); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if v, from := o1.recv(t); v != "pong" || from != addr2 {
+		t.Fatalf("got datagram %q from %q, want %q from %q", v, from, "pong", addr2)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package loopback provides the implemention of loopback data-link layer
+// endpoints. Such endpoints just turn outbound packets into inbound ones.
+//
+// Loopback endpoints can be used in the networking stack by calling New() to
+// create a new endpoint, and then passing it as an argument to
+// Stack.CreateNIC(). Any number of addresses, e.g., 127.0.0.1 and ::1, can then
+// be added to the NIC.
+package loopback
+
+import (
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// mtu is the MTU of loopback endpoints. It matches the MTU of loopback
+// interfaces on linux systems.
+const mtu = 65536
+
+type endpoint struct {
+	dispatcher stack.NetworkDispatcher
+}
+
+// New creates a new loopback endpoint. This link-layer endpoint just turns
+// outbound packets into inbound packets.
+func New() tcpip.LinkEndpointID {
+	return stack.RegisterLinkEndpoint(&endpoint{})
+}
+
+// Attach implements stack.LinkEndpoint.Attach. It just saves the stack network-
+// layer dispatcher for later use when packets need to be dispatched.
+func (e *endpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.dispatcher = dispatcher
+}
+
+// MTU implements stack.LinkEndpoint.MTU. It returns a constant that matches the
+// linux loopback interface.
+func (*endpoint) MTU() uint32 {
+	return mtu
+}
+
+// MaxHeaderLength implements stack.LinkEndpoint.MaxHeaderLength. Given that the
+// loopback interface doesn't have a header, it just returns 0.
+func (*endpoint) MaxHeaderLength() uint16 {
+	return 0
+}
+
+// Capabilities implements stack.LinkEndpoint.Capabilities. Packets never leave
+// the host, so checksums are neither computed nor verified, and the NIC accepts
+// packets to any destination, which delivers multicast and broadcast packets
+// locally.
+func (*endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return stack.CapabilityTXChecksumOffload | stack.CapabilityRXChecksumOffload | stack.CapabilityLoopback
+}
+
+// WritePacket implements stack.LinkEndpoint.WritePacket. It delivers outbound
+// packets to the network-layer dispatcher.
+func (e *endpoint) WritePacket(_ *stack.Route, hdr *buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) error {
+	// The header and payload are owned by the caller, which may reuse them
+	// (e.g., for retransmissions), so the packet is copied into a new view.
+	h := hdr.UsedBytes()
+	v := make(buffer.View, 0, len(h)+payload.Size())
+	v = append(v, h...)
+	for _, u := range payload.Views() {
+		v = append(v, u...)
+	}
+
+	e.dispatcher.DeliverNetworkPacket(e, protocol, v)
+
+	return nil
+}
@@ -0,0 +1,294 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package netem provides the implementation of data-link layer endpoints that
+// wrap another endpoint and emulate adverse network conditions: packet loss,
+// fixed or jittered delay, reordering and duplication, much like Linux's
+// netem queueing discipline.
+//
+// Netem endpoints can be used in the networking stack by calling New(eID,
+// out, in, seed, clock) to create a new endpoint, where eID is the ID of the
+// endpoint being wrapped, and then passing it as an argument to
+// Stack.CreateNIC(). Random decisions are taken from a source initialized with
+// the given seed, and delays are measured with the given clock, usually the one
+// of the stack, so that tests can reproduce the same sequence of drops, delays
+// and duplicates.
+package netem
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// Config describes the conditions emulated in one direction.
+type Config struct {
+	// Loss is the probability that a packet is dropped.
+	Loss float64
+
+	// Delay is the amount of time packets are held before being passed
+	// on.
+	Delay time.Duration
+
+	// Jitter is the maximum amount of time randomly added to or subtracted
+	// from Delay for each packet. Since packets are delayed independently,
+	// jitter also causes reordering.
+	Jitter time.Duration
+
+	// Reorder is the probability that a packet skips the delay and is
+	// passed on right away, ahead of the packets being delayed.
+	Reorder float64
+
+	// Duplicate is the probability that a packet is passed on twice.
+	Duplicate float64
+}
+
+// Endpoint is a link layer endpoint that emulates adverse network conditions.
+type Endpoint struct {
+	dispatcher stack.NetworkDispatcher
+	lower      stack.LinkEndpoint
+	clock      tcpip.Clock
+
+	// stop is closed when the endpoint is closed, to drop the packets
+	// being delayed, and pending tracks the goroutines delaying them.
+	stop    chan struct{}
+	pending sync.WaitGroup
+
+	// mu protects the fields below.
+	mu     sync.Mutex
+	rnd    *rand.Rand
+	out    Config
+	in     Config
+	closed bool
+}
+
+// New creates a new netem link-layer endpoint. It wraps around another
+// endpoint and applies the out configuration to outbound packets, and the in
+// configuration to inbound ones. Packets are delayed according to clock, or
+// according to the real time if clock is nil.
+func New(lower tcpip.LinkEndpointID, out, in Config, seed int64, clock tcpip.Clock) (tcpip.LinkEndpointID, *Endpoint) {
+	if clock == nil {
+		clock = tcpip.StdClock{}
+	}
+
+	e := &Endpoint{
+		lower: stack.FindLinkEndpoint(lower),
+		clock: clock,
+		stop:  make(chan struct{}),
+		rnd:   rand.New(rand.NewSource(seed)),
+		out:   out,
+		in:    in,
+	}
+
+	return stack.RegisterLinkEndpoint(e), e
+}
+
+// SetConfig replaces the configurations of the endpoint. It can be called
+// while the endpoint is in use; packets already being delayed aren't affected.
+func (e *Endpoint) SetConfig(out, in Config) {
+	e.mu.Lock()
+	e.out = out
+	e.in = in
+	e.mu.Unlock()
+}
+
+// decide determines what to do with a packet: the number of copies to pass on
+// (zero if it's lost), and how long to delay them.
+func (e *Endpoint) decide(outbound bool) (int, time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	cfg := &e.in
+	if outbound {
+		cfg = &e.out
+	}
+
+	if cfg.Loss > 0 && e.rnd.Float64() < cfg.Loss {
+		return 0, 0
+	}
+
+	n := 1
+	if cfg.Duplicate > 0 && e.rnd.Float64() < cfg.Duplicate {
+		n = 2
+	}
+
+	if cfg.Reorder > 0 && e.rnd.Float64() < cfg.Reorder {
+		return n, 0
+	}
+
+	d := cfg.Delay
+	if cfg.Jitter > 0 {
+		d += time.Duration(e.rnd.Int63n(2*int64(cfg.Jitter)+1)) - cfg.Jitter
+	}
+	if d < 0 {
+		d = 0
+	}
+
+	return n, d
+}
+
+// after calls f from its own goroutine once d has elapsed on the clock of the
+// endpoint, unless the endpoint is closed first. In both cases, release, if
+// not nil, is called last.
+func (e *Endpoint) after(d time.Duration, f, release func()) {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		if release != nil {
+			release()
+		}
+		return
+	}
+	e.pending.Add(1)
+	e.mu.Unlock()
+
+	timer := e.clock.NewTimer(d)
+	go func() {
+		defer e.pending.Done()
+
+		select {
+		case <-timer.C():
+			f()
+		case <-e.stop:
+			timer.Stop()
+		}
+		if release != nil {
+			release()
+		}
+	}()
+}
+
+// DeliverNetworkPacket implements the stack.NetworkDispatcher interface. It is
+// called by the link-layer endpoint being wrapped when a packet arrives, and
+// forwards it to the actual dispatcher according to the inbound configuration.
+func (e *Endpoint) DeliverNetworkPacket(linkEP stack.LinkEndpoint, protocol tcpip.NetworkProtocolNumber, v buffer.View) {
+	n, d := e.decide(false)
+	for i := 0; i < n; i++ {
+		// Each copy gets its own buffer because upper layers may hold
+		// on to it.
+		c := v
+		if i > 0 {
+			c = append(buffer.View(nil), v...)
+		}
+
+		if d == 0 {
+			e.dispatcher.DeliverNetworkPacket(e, protocol, c)
+			continue
+		}
+
+		e.after(d, func() {
+			e.dispatcher.DeliverNetworkPacket(e, protocol, c)
+		}, nil)
+	}
+}
+
+// LinkStateChanged implements the stack.NetworkDispatcher interface. It just
+// forwards the notification to the actual dispatcher.
+func (e *Endpoint) LinkStateChanged(linkEP stack.LinkEndpoint, up bool) {
+	e.dispatcher.LinkStateChanged(e, up)
+}
+
+// Attach implements the stack.LinkEndpoint interface. It saves the dispatcher
+// and registers with the lower endpoint as its dispatcher so that "e" is called
+// for inbound packets.
+func (e *Endpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.dispatcher = dispatcher
+	e.lower.Attach(e)
+}
+
+// MTU implements stack.LinkEndpoint.MTU. It just forwards the request to the
+// lower endpoint.
+func (e *Endpoint) MTU() uint32 {
+	return e.lower.MTU()
+}
+
+// MaxHeaderLength implements the stack.LinkEndpoint interface. It just forwards
+// the request to the lower endpoint.
+func (e *Endpoint) MaxHeaderLength() uint16 {
+	return e.lower.MaxHeaderLength()
+}
+
+// Capabilities implements stack.LinkEndpoint.Capabilities. It just forwards the
+// request to the lower endpoint.
+func (e *Endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return e.lower.Capabilities()
+}
+
+// Close implements stack.ClosableLinkEndpoint.Close. It drops the packets being
+// delayed, waits for the goroutines delaying them to exit, and then closes the
+// lower endpoint, if it can be closed. Packets written afterwards are
+// rejected.
+func (e *Endpoint) Close() {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+	e.closed = true
+	e.mu.Unlock()
+
+	close(e.stop)
+	e.pending.Wait()
+
+	if cep, ok := e.lower.(stack.ClosableLinkEndpoint); ok {
+		cep.Close()
+	}
+}
+
+// WritePacket implements the stack.LinkEndpoint interface. It forwards the
+// packet to the lower endpoint according to the outbound configuration.
+// Dropped packets are reported as successfully written, as they would be by a
+// real network.
+func (e *Endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) error {
+	if e.isClosed() {
+		return tcpip.ErrClosedForSend
+	}
+
+	n, d := e.decide(true)
+	if n == 0 {
+		return nil
+	}
+
+	if d == 0 {
+		if n > 1 {
+			h := e.copyHeader(hdr)
+			e.lower.WritePacket(r, &h, payload, protocol)
+		}
+		return e.lower.WritePacket(r, hdr, payload, protocol)
+	}
+
+	for i := 0; i < n; i++ {
+		// Lower endpoints may prepend their own headers, so each copy
+		// needs its own header buffer. Delayed packets also hold their
+		// own reference to the route, as they're written after
+		// WritePacket returns.
+		h := e.copyHeader(hdr)
+		route := r.Clone()
+		e.after(d, func() {
+			e.lower.WritePacket(&route, &h, payload, protocol)
+		}, route.Release)
+	}
+
+	return nil
+}
+
+// isClosed returns whether the endpoint was closed.
+func (e *Endpoint) isClosed() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.closed
+}
+
+// copyHeader returns a copy of the given header buffer, with room for the
+// headers of the lower endpoint.
+func (e *Endpoint) copyHeader(hdr *buffer.Prependable) buffer.Prependable {
+	used := hdr.UsedBytes()
+	h := buffer.NewPrependable(int(e.lower.MaxHeaderLength()) + len(used))
+	copy(h.Prepend(len(used)), used)
+	return h
+}
@@ -0,0 +1,191 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netem_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/faketime"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/link/netem"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+func writePackets(t *testing.T, cfg netem.Config, n int, clock tcpip.Clock) *channel.Endpoint {
+	id, c := channel.New(2*n, 1500)
+	if clock != nil {
+		c.SetClock(clock)
+	}
+	nid, _ := netem.New(id, cfg, netem.Config{}, 1, clock)
+	ep := stack.FindLinkEndpoint(nid)
+
+	for i := 0; i < n; i++ {
+		hdr := buffer.NewPrependable(int(ep.MaxHeaderLength()) + 1)
+		hdr.Prepend(1)[0] = byte(i)
+		if err := ep.WritePacket(&stack.Route{}, &hdr, buffer.VectorisedView{}, header.IPv4ProtocolNumber); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+	}
+
+	return c
+}
+
+func TestLoss(t *testing.T) {
+	if n := writePackets(t, netem.Config{Loss: 1}, 10, nil).Drain(); n != 0 {
+		t.Errorf("Got %d packets with full loss, want 0", n)
+	}
+
+	if n := writePackets(t, netem.Config{}, 10, nil).Drain(); n != 10 {
+		t.Errorf("Got %d packets with no loss, want 10", n)
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	if n := writePackets(t, netem.Config{Duplicate: 1}, 10, nil).Drain(); n != 20 {
+		t.Errorf("Got %d packets with full duplication, want 20", n)
+	}
+}
+
+// readPacket waits for a packet to be written to c.
+func readPacket(t *testing.T, c *channel.Endpoint) channel.PacketInfo {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p, ok := c.ReadContext(ctx)
+	if !ok {
+		t.Fatalf("Timed out waiting for a packet")
+	}
+	return p
+}
+
+func TestDelay(t *testing.T) {
+	const delay = 50 * time.Millisecond
+
+	clock := faketime.NewManualClock(time.Unix(0, 0))
+	start := clock.Now()
+	c := writePackets(t, netem.Config{Delay: delay}, 1, clock)
+
+	clock.Advance(delay - time.Millisecond)
+	if n := c.Drain(); n != 0 {
+		t.Fatalf("Got %d packets before the delay elapsed, want 0", n)
+	}
+
+	clock.Advance(time.Millisecond)
+	if d := readPacket(t, c).Timestamp.Sub(start); d != delay {
+		t.Errorf("Packet was delayed by %v, want %v", d, delay)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	const (
+		delay  = 50 * time.Millisecond
+		jitter = 10 * time.Millisecond
+		n      = 20
+	)
+
+	clock := faketime.NewManualClock(time.Unix(0, 0))
+	start := clock.Now()
+	c := writePackets(t, netem.Config{Delay: delay, Jitter: jitter}, n, clock)
+
+	clock.Advance(delay - jitter - time.Millisecond)
+	if n := c.Drain(); n != 0 {
+		t.Fatalf("Got %d packets before the minimum delay elapsed, want 0", n)
+	}
+	clock.Advance(time.Millisecond)
+
+	// Every packet has been sent once the maximum delay has elapsed.
+	clock.Advance(2 * jitter)
+	for i := 0; i < n; i++ {
+		if d := readPacket(t, c).Timestamp.Sub(start); d > delay+jitter {
+			t.Errorf("Packet was delayed by %v, want at most %v", d, delay+jitter)
+		}
+	}
+}
+
+// recordingDispatcher is a network dispatcher that sends the packets delivered
+// to it on a channel.
+type recordingDispatcher struct {
+	c chan buffer.View
+}
+
+func (d *recordingDispatcher) DeliverNetworkPacket(_ stack.LinkEndpoint, _ tcpip.NetworkProtocolNumber, v buffer.View) {
+	d.c <- v
+}
+
+func (*recordingDispatcher) LinkStateChanged(stack.LinkEndpoint, bool) {}
+
+func TestInboundDelay(t *testing.T) {
+	const delay = 50 * time.Millisecond
+
+	clock := faketime.NewManualClock(time.Unix(0, 0))
+	id, c := channel.New(1, 1500)
+	nid, _ := netem.New(id, netem.Config{}, netem.Config{Delay: delay}, 1, clock)
+	d := &recordingDispatcher{c: make(chan buffer.View, 1)}
+	stack.FindLinkEndpoint(nid).Attach(d)
+
+	c.Inject(header.IPv4ProtocolNumber, buffer.View("packet"))
+	clock.Advance(delay - time.Millisecond)
+	select {
+	case <-d.c:
+		t.Fatalf("Packet delivered before the delay elapsed")
+	default:
+	}
+
+	clock.Advance(time.Millisecond)
+	select {
+	case v := <-d.c:
+		if string(v) != "packet" {
+			t.Errorf("Got packet %q, want %q", v, "packet")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the packet to be delivered")
+	}
+}
+
+func TestClose(t *testing.T) {
+	const delay = 50 * time.Millisecond
+
+	clock := faketime.NewManualClock(time.Unix(0, 0))
+	id, c := channel.NewClosable(10, 1500)
+	nid, e := netem.New(id, netem.Config{Delay: delay}, netem.Config{Delay: delay}, 1, clock)
+	ep := stack.FindLinkEndpoint(nid)
+	d := &recordingDispatcher{c: make(chan buffer.View, 1)}
+	ep.Attach(d)
+
+	// Leave a packet being delayed in each direction.
+	hdr := buffer.NewPrependable(int(ep.MaxHeaderLength()) + 1)
+	hdr.Prepend(1)
+	if err := ep.WritePacket(&stack.Route{}, &hdr, buffer.VectorisedView{}, header.IPv4ProtocolNumber); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+	c.Inject(header.IPv4ProtocolNumber, buffer.View("packet"))
+
+	e.Close()
+	if !c.Closed() {
+		t.Errorf("Lower endpoint wasn't closed")
+	}
+
+	// The delayed packets were dropped, and new ones are rejected.
+	clock.Advance(delay)
+	if n := c.Drain(); n != 0 {
+		t.Errorf("Got %d packets written after Close, want 0", n)
+	}
+	select {
+	case <-d.c:
+		t.Errorf("Packet delivered after Close")
+	default:
+	}
+	hdr = buffer.NewPrependable(int(ep.MaxHeaderLength()) + 1)
+	hdr.Prepend(1)
+	if err := ep.WritePacket(&stack.Route{}, &hdr, buffer.VectorisedView{}, header.IPv4ProtocolNumber); err != tcpip.ErrClosedForSend {
+		t.Errorf("Got WritePacket(...) = %v after Close, want %v", err, tcpip.ErrClosedForSend)
+	}
+}
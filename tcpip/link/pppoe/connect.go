@@ -0,0 +1,571 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pppoe
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+)
+
+const (
+	// initialTimeout and maxTimeout bound the time waited for the AC to
+	// answer discovery packets, which doubles with every retransmission.
+	initialTimeout = time.Second
+	maxTimeout     = 30 * time.Second
+
+	// restartTime and maxConfigure are the restart timer of PPP control
+	// protocols, and the number of Configure-Requests sent without being
+	// acknowledged before giving up, per RFC 1661, section 4.6.
+	restartTime  = 3 * time.Second
+	maxConfigure = 10
+
+	// hostUniqSize is the size of the Host-Uniq tags sent.
+	hostUniqSize = 8
+)
+
+// unspecifiedAddress is the unspecified IPv4 address, which asks the peer for
+// an address in IPCP options.
+const unspecifiedAddress = tcpip.Address("\x00\x00\x00\x00")
+
+// Connect discovers an AC, opens a session with it, and negotiates LCP and IPCP
+// over it. It blocks until the session is up or ctx is done. The carrier of the
+// endpoint is reported down until the session is up.
+func (e *Endpoint) Connect(ctx context.Context) (Session, error) {
+	e.mu.Lock()
+	switch {
+	case e.connecting:
+		e.mu.Unlock()
+		return Session{}, tcpip.ErrAlreadyConnecting
+	case e.state != stateIdle:
+		e.mu.Unlock()
+		return Session{}, tcpip.ErrAlreadyConnected
+	}
+	e.connecting = true
+	e.mu.Unlock()
+
+	defer func() {
+		e.mu.Lock()
+		e.connecting = false
+		e.mu.Unlock()
+	}()
+
+	e.setLinkUp(false)
+	for len(e.control) > 0 {
+		<-e.control
+	}
+
+	s, maxPayload, err := e.discover(ctx)
+	if err != nil {
+		return Session{}, err
+	}
+	magic, err := randomUint32()
+	if err != nil {
+		return Session{}, err
+	}
+
+	e.mu.Lock()
+	e.session = s
+	e.state = stateSession
+	e.magic = magic
+	down := make(chan struct{})
+	e.down = down
+	e.mu.Unlock()
+
+	mru := e.cfg.MRU
+	if mru > maxPayload {
+		mru = maxPayload
+	}
+	lcp := &lcpNegotiator{mru: mru, magic: magic}
+	if err := e.negotiate(ctx, down, header.PPPProtocolLCP, lcp); err != nil {
+		e.terminate()
+		return Session{}, err
+	}
+
+	mtu := uint32(lcp.peerMRU)
+	if mtu > uint32(maxPayload) {
+		mtu = uint32(maxPayload)
+	}
+	e.mu.Lock()
+	e.state = stateLCPOpened
+	e.magic = lcp.magic
+	e.mtu = mtu
+	e.mu.Unlock()
+
+	ipcp := &ipcpNegotiator{
+		local:      unspecifiedAddress,
+		dns:        [2]tcpip.Address{unspecifiedAddress, unspecifiedAddress},
+		requestDNS: [2]bool{true, true},
+	}
+	if err := e.negotiate(ctx, down, header.PPPProtocolIPCP, ipcp); err != nil {
+		e.terminate()
+		return Session{}, err
+	}
+	if ipcp.local == unspecifiedAddress {
+		e.terminate()
+		return Session{}, tcpip.ErrConnectionRefused
+	}
+
+	s.LocalAddress = ipcp.local
+	s.RemoteAddress = ipcp.remote
+	for i, a := range ipcp.dns {
+		if ipcp.requestDNS[i] && a != unspecifiedAddress {
+			s.DNSServers = append(s.DNSServers, a)
+		}
+	}
+	s.MTU = mtu
+
+	e.mu.Lock()
+	if e.state != stateLCPOpened {
+		// The session ended since IPCP was negotiated.
+		e.mu.Unlock()
+		return Session{}, tcpip.ErrConnectionReset
+	}
+	e.session = s
+	e.state = stateUp
+	e.mu.Unlock()
+
+	e.setLinkUp(true)
+	return s, nil
+}
+
+// discover discovers an AC and opens a session with it. It returns the session,
+// and the largest payload of the PPPoE packets of the session.
+func (e *Endpoint) discover(ctx context.Context) (Session, uint16, error) {
+	hostUniq := make([]byte, hostUniqSize)
+	if _, err := rand.Read(hostUniq); err != nil {
+		return Session{}, 0, err
+	}
+
+	tags := header.AppendPPPoETag(nil, header.PPPoETagServiceName, []byte(e.cfg.ServiceName))
+	tags = header.AppendPPPoETag(tags, header.PPPoETagHostUniq, hostUniq)
+	if e.cfg.MRU > header.PPPoEMaxPayload {
+		var v [2]byte
+		binary.BigEndian.PutUint16(v[:], e.cfg.MRU)
+		tags = header.AppendPPPoETag(tags, header.PPPoETagPPPMaxPayload, v[:])
+	}
+
+	var acName string
+	var cookie, relayID []byte
+	pado, err := e.exchange(ctx, broadcastAddress, header.PPPoECodePADI, tags, func(p *packet) bool {
+		if p.pppoe.Code() != header.PPPoECodePADO {
+			return false
+		}
+		t := parseTags(p.pppoe.Payload())
+		if !bytes.Equal(t[header.PPPoETagHostUniq], hostUniq) || t.hasError() {
+			return false
+		}
+		if name, ok := t[header.PPPoETagServiceName]; !ok || (e.cfg.ServiceName != "" && string(name) != e.cfg.ServiceName) {
+			return false
+		}
+		acName = string(t[header.PPPoETagACName])
+		if e.cfg.ACName != "" && acName != e.cfg.ACName {
+			return false
+		}
+		cookie, relayID = t[header.PPPoETagACCookie], t[header.PPPoETagRelaySessionID]
+		return true
+	})
+	if err != nil {
+		return Session{}, 0, err
+	}
+
+	// The AC-Cookie and Relay-Session-Id tags of the offer are echoed.
+	if cookie != nil {
+		tags = header.AppendPPPoETag(tags, header.PPPoETagACCookie, cookie)
+	}
+	if relayID != nil {
+		tags = header.AppendPPPoETag(tags, header.PPPoETagRelaySessionID, relayID)
+	}
+
+	var refused bool
+	maxPayload := uint16(header.PPPoEMaxPayload)
+	pads, err := e.exchange(ctx, pado.src, header.PPPoECodePADR, tags, func(p *packet) bool {
+		if p.pppoe.Code() != header.PPPoECodePADS || p.src != pado.src {
+			return false
+		}
+		t := parseTags(p.pppoe.Payload())
+		if !bytes.Equal(t[header.PPPoETagHostUniq], hostUniq) {
+			return false
+		}
+		refused = t.hasError() || p.pppoe.SessionID() == 0
+		// The AC acknowledges larger payloads by echoing the
+		// PPP-Max-Payload tag, per RFC 4638, section 4.
+		if v := t[header.PPPoETagPPPMaxPayload]; e.cfg.MRU > header.PPPoEMaxPayload && len(v) == 2 {
+			if n := binary.BigEndian.Uint16(v); n > header.PPPoEMaxPayload {
+				maxPayload = n
+				if maxPayload > e.cfg.MRU {
+					maxPayload = e.cfg.MRU
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return Session{}, 0, err
+	}
+	if refused {
+		return Session{}, 0, tcpip.ErrConnectionRefused
+	}
+
+	return Session{
+		ID:        pads.pppoe.SessionID(),
+		ACAddress: pado.src,
+		ACName:    acName,
+	}, maxPayload, nil
+}
+
+// exchange sends a discovery packet with the given code and tags to dst, and
+// retransmits it until a packet is accepted or ctx is done.
+func (e *Endpoint) exchange(ctx context.Context, dst tcpip.LinkAddress, code uint8, tags []byte, accept func(*packet) bool) (*packet, error) {
+	timer := time.NewTimer(initialTimeout)
+	defer timer.Stop()
+
+	for timeout := initialTimeout; ; timeout *= 2 {
+		if timeout > maxTimeout {
+			timeout = maxTimeout
+		}
+		if err := e.writePacket(dst, header.PPPoEDiscoveryProtocolNumber, code, 0, tags); err != nil {
+			return nil, err
+		}
+		timer.Reset(timeout)
+
+	wait:
+		for {
+			select {
+			case p := <-e.control:
+				if p.ctl == nil && accept(p) {
+					return p, nil
+				}
+			case <-timer.C:
+				break wait
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+}
+
+// tags maps the types of the tags of a discovery packet to their values.
+type tags map[uint16][]byte
+
+// parseTags parses the tags of a discovery packet, up to the first malformed
+// one or the End-Of-List tag.
+func parseTags(b []byte) tags {
+	t := make(tags)
+	for len(b) > 0 {
+		typ, v, rest, ok := header.NextPPPoETag(b)
+		if !ok || typ == header.PPPoETagEndOfList {
+			break
+		}
+		if _, ok := t[typ]; !ok {
+			t[typ] = v
+		}
+		b = rest
+	}
+	return t
+}
+
+// hasError returns whether the tags include an error tag.
+func (t tags) hasError() bool {
+	for _, typ := range []uint16{header.PPPoETagServiceNameError, header.PPPoETagACSystemError, header.PPPoETagGenericError} {
+		if _, ok := t[typ]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiator negotiates the configuration options of a PPP control protocol.
+type negotiator interface {
+	// request returns the options of the next Configure-Request.
+	request() []byte
+
+	// nak adjusts the options requested per the ones of a Configure-Nak.
+	nak(opts []byte)
+
+	// reject drops the options of a Configure-Reject from the options
+	// requested. It returns false if one of them is required.
+	reject(opts []byte) bool
+
+	// check checks the options of a Configure-Request of the peer, and
+	// returns the ones to reject, or else the ones to nak. The options are
+	// acknowledged if it returns none, and are then recorded.
+	check(opts []byte) (rej, nak []byte)
+}
+
+// negotiate negotiates the configuration options of the PPP control protocol
+// proto with n, per the option negotiation automaton of RFC 1661, section 4,
+// until both ends acknowledged the options of the other one. The automaton is
+// abridged: the peer is expected to be configured to negotiate.
+func (e *Endpoint) negotiate(ctx context.Context, down <-chan struct{}, proto uint16, n negotiator) error {
+	e.mu.Lock()
+	s := e.session
+	e.mu.Unlock()
+
+	id := e.nextID()
+	if err := e.writeControl(proto, header.PPPConfigureRequest, id, n.request()); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(restartTime)
+	defer timer.Stop()
+
+	acked, ackSent := false, false
+	for count := 1; !acked || !ackSent; {
+		select {
+		case p := <-e.control:
+			if p.proto != proto || p.pppoe.SessionID() != s.ID || p.src != s.ACAddress {
+				continue
+			}
+			switch c := p.ctl; c.Code() {
+			case header.PPPConfigureRequest:
+				opts := c.Data()
+				switch rej, nak := n.check(opts); {
+				case len(rej) > 0:
+					e.writeControl(proto, header.PPPConfigureReject, c.ID(), rej)
+				case len(nak) > 0:
+					e.writeControl(proto, header.PPPConfigureNak, c.ID(), nak)
+				default:
+					e.writeControl(proto, header.PPPConfigureAck, c.ID(), opts)
+					ackSent = true
+				}
+
+			case header.PPPConfigureAck:
+				if c.ID() == id {
+					acked = true
+				}
+
+			case header.PPPConfigureNak, header.PPPConfigureReject:
+				if c.ID() != id || acked {
+					continue
+				}
+				if c.Code() == header.PPPConfigureNak {
+					n.nak(c.Data())
+				} else if !n.reject(c.Data()) {
+					return tcpip.ErrConnectionRefused
+				}
+				id = e.nextID()
+				if err := e.writeControl(proto, header.PPPConfigureRequest, id, n.request()); err != nil {
+					return err
+				}
+
+			case header.PPPTerminateRequest:
+				e.writeControl(proto, header.PPPTerminateAck, c.ID(), nil)
+				return tcpip.ErrConnectionReset
+			}
+
+		case <-timer.C:
+			if count == maxConfigure {
+				return tcpip.ErrTimeout
+			}
+			count++
+			if !acked {
+				id = e.nextID()
+				if err := e.writeControl(proto, header.PPPConfigureRequest, id, n.request()); err != nil {
+					return err
+				}
+			}
+			timer.Reset(restartTime)
+
+		case <-down:
+			return tcpip.ErrConnectionReset
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// lcpNegotiator negotiates the options of LCP: the MRUs, and the magic numbers.
+// Authentication is refused.
+type lcpNegotiator struct {
+	// mru and magic are the MRU and magic number requested, or zero if the
+	// peer rejected them.
+	mru   uint16
+	magic uint32
+
+	// peerMRU is the MRU of the peer.
+	peerMRU uint16
+}
+
+// request implements negotiator.request.
+func (l *lcpNegotiator) request() []byte {
+	var opts []byte
+	if l.mru != 0 {
+		var v [2]byte
+		binary.BigEndian.PutUint16(v[:], l.mru)
+		opts = header.AppendPPPOption(opts, header.LCPOptionMRU, v[:])
+	}
+	if l.magic != 0 {
+		var v [4]byte
+		binary.BigEndian.PutUint32(v[:], l.magic)
+		opts = header.AppendPPPOption(opts, header.LCPOptionMagicNumber, v[:])
+	}
+	return opts
+}
+
+// nak implements negotiator.nak. Smaller MRUs are adopted, and a new magic
+// number is chosen if the peer suggests one, i.e., if the link may be looped
+// back.
+func (l *lcpNegotiator) nak(opts []byte) {
+	forEachOption(opts, func(t uint8, v []byte) {
+		switch {
+		case t == header.LCPOptionMRU && len(v) == 2:
+			if mru := binary.BigEndian.Uint16(v); mru < l.mru {
+				l.mru = mru
+			}
+		case t == header.LCPOptionMagicNumber && len(v) == 4:
+			if magic, err := randomUint32(); err == nil && magic != 0 {
+				l.magic = magic
+			}
+		}
+	})
+}
+
+// reject implements negotiator.reject.
+func (l *lcpNegotiator) reject(opts []byte) bool {
+	forEachOption(opts, func(t uint8, v []byte) {
+		switch t {
+		case header.LCPOptionMRU:
+			l.mru = 0
+		case header.LCPOptionMagicNumber:
+			l.magic = 0
+		}
+	})
+	return true
+}
+
+// check implements negotiator.check. The MRU and magic number of the peer are
+// acknowledged, unless the magic number is the one requested, and the other
+// options are rejected, including the authentication protocol.
+func (l *lcpNegotiator) check(opts []byte) (rej, nak []byte) {
+	mru := uint16(header.PPPDefaultMRU)
+	malformed := forEachOption(opts, func(t uint8, v []byte) {
+		switch {
+		case t == header.LCPOptionMRU && len(v) == 2:
+			mru = binary.BigEndian.Uint16(v)
+		case t == header.LCPOptionMagicNumber && len(v) == 4:
+			if m := binary.BigEndian.Uint32(v); m == l.magic && m != 0 {
+				var s [4]byte
+				if r, err := randomUint32(); err == nil {
+					binary.BigEndian.PutUint32(s[:], r)
+				}
+				nak = header.AppendPPPOption(nak, t, s[:])
+			}
+		default:
+			rej = header.AppendPPPOption(rej, t, v)
+		}
+	})
+	rej = append(rej, malformed...)
+	if len(rej) == 0 && len(nak) == 0 {
+		l.peerMRU = mru
+	}
+	return rej, nak
+}
+
+// ipcpNegotiator negotiates the options of IPCP: the IPv4 addresses of both
+// ends of the link, and the DNS servers.
+type ipcpNegotiator struct {
+	// local is the address requested, initially unspecifiedAddress to ask
+	// the peer for one.
+	local tcpip.Address
+
+	// dns are the primary and secondary DNS servers, initially
+	// unspecifiedAddress, which are requested while requestDNS is set.
+	dns        [2]tcpip.Address
+	requestDNS [2]bool
+
+	// remote is the address of the peer.
+	remote tcpip.Address
+}
+
+// dnsOptions are the types of the options of the DNS servers.
+var dnsOptions = [2]uint8{header.IPCPOptionPrimaryDNS, header.IPCPOptionSecondaryDNS}
+
+// request implements negotiator.request.
+func (c *ipcpNegotiator) request() []byte {
+	opts := header.AppendPPPOption(nil, header.IPCPOptionIPAddress, []byte(c.local))
+	for i, t := range dnsOptions {
+		if c.requestDNS[i] {
+			opts = header.AppendPPPOption(opts, t, []byte(c.dns[i]))
+		}
+	}
+	return opts
+}
+
+// nak implements negotiator.nak. The addresses suggested by the peer are
+// adopted.
+func (c *ipcpNegotiator) nak(opts []byte) {
+	forEachOption(opts, func(t uint8, v []byte) {
+		if len(v) != header.IPv4AddressSize {
+			return
+		}
+		a := tcpip.Address(v)
+		switch t {
+		case header.IPCPOptionIPAddress:
+			c.local = a
+		case header.IPCPOptionPrimaryDNS:
+			c.dns[0] = a
+		case header.IPCPOptionSecondaryDNS:
+			c.dns[1] = a
+		}
+	})
+}
+
+// reject implements negotiator.reject. The address of the link is required.
+func (c *ipcpNegotiator) reject(opts []byte) bool {
+	ok := true
+	forEachOption(opts, func(t uint8, v []byte) {
+		switch t {
+		case header.IPCPOptionIPAddress:
+			ok = false
+		case header.IPCPOptionPrimaryDNS:
+			c.requestDNS[0] = false
+		case header.IPCPOptionSecondaryDNS:
+			c.requestDNS[1] = false
+		}
+	})
+	return ok
+}
+
+// check implements negotiator.check. The address of the peer is acknowledged,
+// unless it asks for one, which the endpoint can't assign, and the other
+// options are rejected.
+func (c *ipcpNegotiator) check(opts []byte) (rej, nak []byte) {
+	var remote tcpip.Address
+	malformed := forEachOption(opts, func(t uint8, v []byte) {
+		if t == header.IPCPOptionIPAddress && len(v) == header.IPv4AddressSize && tcpip.Address(v) != unspecifiedAddress {
+			remote = tcpip.Address(v)
+		} else {
+			rej = header.AppendPPPOption(rej, t, v)
+		}
+	})
+	rej = append(rej, malformed...)
+	if len(rej) == 0 {
+		c.remote = remote
+	}
+	return rej, nil
+}
+
+// forEachOption calls f with the type and value of every configuration option
+// of opts. If an option is malformed, it returns the options from it on, which
+// are to be rejected.
+func forEachOption(opts []byte, f func(t uint8, v []byte)) []byte {
+	for len(opts) > 0 {
+		t, v, rest, ok := header.NextPPPOption(opts)
+		if !ok {
+			return opts
+		}
+		f(t, v)
+		opts = rest
+	}
+	return nil
+}
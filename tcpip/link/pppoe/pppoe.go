@@ -0,0 +1,482 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package pppoe provides the implementation of data-link layer endpoints that
+// terminate PPPoE sessions, per RFC 2516, the way DSL links are set up: the
+// endpoint discovers an access concentrator (AC) on an ethernet link, opens a
+// session with it, and negotiates PPP over the session with LCP and IPCP, per
+// RFC 1661 and RFC 1332, to exchange IPv4 packets.
+//
+// PPPoE endpoints can be used in the networking stack by calling New(link,
+// config) to create a new endpoint, where link writes the ethernet frames of
+// the endpoint and passes the ones it receives to Endpoint.DeliverFrame(), and
+// then passing it as an argument to Stack.CreateNIC(). Endpoint.Connect() then
+// sets a session up, and returns the addresses IPCP assigned, which the caller
+// adds to the NIC. The MTU of the NIC is the MRU the AC negotiated, and its
+// carrier is reported down when the session ends.
+//
+// Authentication isn't supported, nor are IPv6 and the renegotiation of open
+// sessions: the ACs asking for them are turned down.
+package pppoe
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// broadcastAddress is the ethernet broadcast address.
+const broadcastAddress = tcpip.LinkAddress("\xff\xff\xff\xff\xff\xff")
+
+// controlQueueSize is the number of received packets queued for Connect.
+const controlQueueSize = 16
+
+// Link is the ethernet link that PPPoE frames are exchanged on, e.g., a TAP
+// device or a packet socket. It passes the frames it receives to
+// Endpoint.DeliverFrame.
+type Link interface {
+	// WriteFrame writes an ethernet frame to the link. The link must not
+	// retain the frame after WriteFrame returns.
+	WriteFrame(frame []byte) error
+}
+
+// Config describes a PPPoE endpoint.
+type Config struct {
+	// LinkAddress is the ethernet address of the endpoint.
+	LinkAddress tcpip.LinkAddress
+
+	// ServiceName is the service requested from ACs, or empty for any.
+	ServiceName string
+
+	// ACName is the name of the AC to open sessions with, or empty for
+	// the first one to answer.
+	ACName string
+
+	// MRU is the MRU requested, or zero for header.PPPoEMaxPayload. Larger
+	// MRUs need the AC to support the PPP-Max-Payload tag of RFC 4638,
+	// and jumbo frames.
+	MRU uint16
+}
+
+// Session is a PPPoE session, and the configuration negotiated over it.
+type Session struct {
+	// ID is the session ID the AC assigned.
+	ID uint16
+
+	// ACAddress and ACName are the ethernet address and the name of the
+	// AC.
+	ACAddress tcpip.LinkAddress
+	ACName    string
+
+	// LocalAddress and RemoteAddress are the IPv4 addresses of both ends
+	// of the link, per IPCP.
+	LocalAddress  tcpip.Address
+	RemoteAddress tcpip.Address
+
+	// DNSServers are the DNS servers the AC advertised, if any.
+	DNSServers []tcpip.Address
+
+	// MTU is the MTU of the link: the MRU of the AC, up to the largest
+	// payload of the PPPoE packets.
+	MTU uint32
+}
+
+// state is the state of the session of an endpoint.
+type state int
+
+const (
+	// stateIdle is the state of endpoints without a session.
+	stateIdle state = iota
+
+	// stateSession is the state of endpoints whose session is open, but
+	// whose LCP negotiation isn't complete.
+	stateSession
+
+	// stateLCPOpened is the state of endpoints negotiating IPCP.
+	stateLCPOpened
+
+	// stateUp is the state of endpoints exchanging IPv4 packets.
+	stateUp
+)
+
+// packet is a PPPoE packet received for Connect: a discovery packet, or a PPP
+// control packet.
+type packet struct {
+	src   tcpip.LinkAddress
+	pppoe header.PPPoE
+
+	// proto and ctl are the protocol and the packet of PPP control
+	// packets.
+	proto uint16
+	ctl   header.PPPControl
+}
+
+// Endpoint is a PPPoE link-layer endpoint.
+type Endpoint struct {
+	link Link
+	cfg  Config
+
+	// control receives the packets Connect waits for.
+	control chan *packet
+
+	// mu protects the fields below.
+	mu         sync.Mutex
+	dispatcher stack.NetworkDispatcher
+	connecting bool
+	state      state
+	session    Session
+	mtu        uint32
+	magic      uint32
+	lastID     uint8
+
+	// down is closed once the session ends.
+	down chan struct{}
+
+	// linkUp is the state of the carrier last reported to the dispatcher.
+	// NICs start up.
+	linkUp bool
+}
+
+// New creates a new PPPoE link-layer endpoint, which exchanges ethernet frames
+// through link.
+func New(link Link, cfg Config) (tcpip.LinkEndpointID, *Endpoint) {
+	if cfg.MRU == 0 {
+		cfg.MRU = header.PPPoEMaxPayload
+	}
+
+	e := &Endpoint{
+		link:    link,
+		cfg:     cfg,
+		control: make(chan *packet, controlQueueSize),
+		mtu:     header.PPPoEMaxPayload,
+		linkUp:  true,
+	}
+
+	return stack.RegisterLinkEndpoint(e), e
+}
+
+// Session returns the session of the endpoint, if it's up.
+func (e *Endpoint) Session() (Session, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.state != stateUp {
+		return Session{}, false
+	}
+	return e.session, true
+}
+
+// Attach implements stack.LinkEndpoint.Attach.
+func (e *Endpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.mu.Lock()
+	e.dispatcher = dispatcher
+	e.mu.Unlock()
+}
+
+// MTU implements stack.LinkEndpoint.MTU. It returns the MTU of the session, or
+// the largest payload of the PPPoE packets if it isn't up.
+func (e *Endpoint) MTU() uint32 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.mtu
+}
+
+// MaxHeaderLength implements stack.LinkEndpoint.MaxHeaderLength. It returns the
+// size of the ethernet, PPPoE and PPP headers.
+func (*Endpoint) MaxHeaderLength() uint16 {
+	return header.EthernetMinimumSize + header.PPPoESize + header.PPPProtocolSize
+}
+
+// Capabilities implements stack.LinkEndpoint.Capabilities. The AC may be
+// anywhere beyond the link, so checksums are always computed and verified in
+// software.
+func (*Endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return 0
+}
+
+// LinkAddress implements stack.LinkAddresser.LinkAddress. It returns the
+// ethernet address of the configuration.
+func (e *Endpoint) LinkAddress() tcpip.LinkAddress {
+	return e.cfg.LinkAddress
+}
+
+// WritePacket implements stack.LinkEndpoint.WritePacket. It sends IPv4 packets
+// over the session, once it's up.
+func (e *Endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) error {
+	if protocol != header.IPv4ProtocolNumber {
+		return tcpip.ErrNotSupported
+	}
+
+	e.mu.Lock()
+	if e.state != stateUp {
+		e.mu.Unlock()
+		return tcpip.ErrLinkDown
+	}
+	s := e.session
+	e.mu.Unlock()
+
+	length := header.PPPProtocolSize + hdr.UsedLength() + payload.Size()
+	binary.BigEndian.PutUint16(hdr.Prepend(header.PPPProtocolSize), header.PPPProtocolIPv4)
+	e.encodeHeaders(hdr, s.ACAddress, header.PPPoESessionProtocolNumber, header.PPPoECodeSession, s.ID, length)
+
+	frame := make([]byte, 0, hdr.UsedLength()+payload.Size())
+	frame = append(frame, hdr.View()...)
+	for _, v := range payload.Views() {
+		frame = append(frame, v...)
+	}
+	return e.link.WriteFrame(frame)
+}
+
+// encodeHeaders prepends the ethernet and PPPoE headers of a packet to hdr.
+func (e *Endpoint) encodeHeaders(hdr *buffer.Prependable, dst tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, code uint8, sessionID uint16, length int) {
+	header.PPPoE(hdr.Prepend(header.PPPoESize)).Encode(&header.PPPoEFields{
+		Code:      code,
+		SessionID: sessionID,
+		Length:    uint16(length),
+	})
+	header.Ethernet(hdr.Prepend(header.EthernetMinimumSize)).Encode(&header.EthernetFields{
+		SrcAddr: e.cfg.LinkAddress,
+		DstAddr: dst,
+		Type:    protocol,
+	})
+}
+
+// writePacket writes a PPPoE packet with the given payload.
+func (e *Endpoint) writePacket(dst tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, code uint8, sessionID uint16, payload []byte) error {
+	hdr := buffer.NewPrependable(header.EthernetMinimumSize + header.PPPoESize)
+	e.encodeHeaders(&hdr, dst, protocol, code, sessionID, len(payload))
+	return e.link.WriteFrame(append(hdr.View(), payload...))
+}
+
+// writeControl writes a PPP control packet of protocol proto over the session.
+func (e *Endpoint) writeControl(proto uint16, code, id uint8, data []byte) error {
+	e.mu.Lock()
+	s := e.session
+	e.mu.Unlock()
+
+	b := make([]byte, header.PPPProtocolSize+header.PPPControlHeaderSize+len(data))
+	binary.BigEndian.PutUint16(b, proto)
+	header.PPPControl(b[header.PPPProtocolSize:]).Encode(&header.PPPControlFields{
+		Code:   code,
+		ID:     id,
+		Length: uint16(header.PPPControlHeaderSize + len(data)),
+	})
+	copy(b[header.PPPProtocolSize+header.PPPControlHeaderSize:], data)
+	return e.writePacket(s.ACAddress, header.PPPoESessionProtocolNumber, header.PPPoECodeSession, s.ID, b)
+}
+
+// nextID returns the identifier of the next PPP control packet sent.
+func (e *Endpoint) nextID() uint8 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lastID++
+	return e.lastID
+}
+
+// DeliverFrame is called by the link when it receives an ethernet frame. The
+// frame isn't retained after DeliverFrame returns.
+func (e *Endpoint) DeliverFrame(frame []byte) {
+	if len(frame) < header.EthernetMinimumSize+header.PPPoESize {
+		return
+	}
+	eth := header.Ethernet(frame)
+	if eth.DestinationAddress() != e.cfg.LinkAddress {
+		return
+	}
+	p := header.PPPoE(frame[header.EthernetMinimumSize:])
+	if !p.IsValid() {
+		return
+	}
+	src := eth.SourceAddress()
+
+	switch eth.Type() {
+	case header.PPPoEDiscoveryProtocolNumber:
+		switch p.Code() {
+		case header.PPPoECodePADO, header.PPPoECodePADS:
+			e.queue(&packet{src: src, pppoe: p})
+
+		case header.PPPoECodePADT:
+			e.mu.Lock()
+			ours := e.state != stateIdle && p.SessionID() == e.session.ID && src == e.session.ACAddress
+			e.mu.Unlock()
+			if ours {
+				e.sessionDown()
+			}
+		}
+
+	case header.PPPoESessionProtocolNumber:
+		if p.Code() == header.PPPoECodeSession {
+			e.deliverSessionPacket(src, p)
+		}
+	}
+}
+
+// queue queues a copy of the packet p for Connect, unless the queue is full.
+func (e *Endpoint) queue(p *packet) {
+	b := append([]byte(nil), p.pppoe[:header.PPPoESize+int(p.pppoe.Length())]...)
+	c := &packet{
+		src:   p.src,
+		pppoe: header.PPPoE(b),
+		proto: p.proto,
+	}
+	if p.ctl != nil {
+		c.ctl = header.PPPControl(b[header.PPPoESize+header.PPPProtocolSize:])
+	}
+
+	select {
+	case e.control <- c:
+	default:
+	}
+}
+
+// deliverSessionPacket handles the packet p of the session, received from src.
+func (e *Endpoint) deliverSessionPacket(src tcpip.LinkAddress, p header.PPPoE) {
+	e.mu.Lock()
+	st := e.state
+	ours := st != stateIdle && p.SessionID() == e.session.ID && src == e.session.ACAddress
+	// The AC may send its first LCP packets before Connect gets the PADS,
+	// so the packets received while connecting are queued until then, for
+	// Connect to pick its session's.
+	early := st == stateIdle && e.connecting
+	d := e.dispatcher
+	e.mu.Unlock()
+	if !ours && !early {
+		return
+	}
+
+	payload := p.Payload()
+	if len(payload) < header.PPPProtocolSize {
+		return
+	}
+	proto := binary.BigEndian.Uint16(payload)
+	info := payload[header.PPPProtocolSize:]
+
+	switch proto {
+	case header.PPPProtocolIPv4:
+		if st == stateUp && d != nil {
+			d.DeliverNetworkPacket(e, header.IPv4ProtocolNumber, append(buffer.View(nil), info...))
+		}
+
+	case header.PPPProtocolLCP, header.PPPProtocolIPCP:
+		ctl := header.PPPControl(info)
+		if !ctl.IsValid() {
+			return
+		}
+		if proto == header.PPPProtocolLCP && st >= stateLCPOpened && e.handleLCP(st, ctl) {
+			return
+		}
+		e.queue(&packet{src: src, pppoe: p, proto: proto, ctl: ctl})
+
+	default:
+		// Reject the other protocols, e.g., IPV6CP, once LCP is
+		// opened, per RFC 1661, section 5.7.
+		if st >= stateLCPOpened {
+			data := append(append([]byte(nil), payload[:header.PPPProtocolSize]...), info...)
+			if max := int(e.MTU()) - header.PPPControlHeaderSize; len(data) > max {
+				data = data[:max]
+			}
+			e.writeControl(header.PPPProtocolLCP, header.PPPProtocolReject, e.nextID(), data)
+		}
+	}
+}
+
+// handleLCP handles the LCP packet ctl received once LCP is opened, when the
+// endpoint is in state st. It returns false if the packet is for Connect.
+func (e *Endpoint) handleLCP(st state, ctl header.PPPControl) bool {
+	switch ctl.Code() {
+	case header.PPPEchoRequest:
+		data := ctl.Data()
+		if len(data) < 4 {
+			return true
+		}
+		reply := make([]byte, len(data))
+		e.mu.Lock()
+		binary.BigEndian.PutUint32(reply, e.magic)
+		e.mu.Unlock()
+		copy(reply[4:], data[4:])
+		e.writeControl(header.PPPProtocolLCP, header.PPPEchoReply, ctl.ID(), reply)
+		return true
+
+	case header.PPPEchoReply, header.PPPDiscardRequest:
+		return true
+
+	case header.PPPTerminateRequest:
+		e.writeControl(header.PPPProtocolLCP, header.PPPTerminateAck, ctl.ID(), nil)
+		e.sessionDown()
+		return true
+
+	case header.PPPConfigureRequest:
+		// Renegotiation isn't supported.
+		e.terminate()
+		return true
+	}
+	return false
+}
+
+// sessionDown marks the session as ended, and reports that the carrier is
+// down.
+func (e *Endpoint) sessionDown() {
+	e.mu.Lock()
+	if e.state == stateIdle {
+		e.mu.Unlock()
+		return
+	}
+	e.state = stateIdle
+	e.mtu = header.PPPoEMaxPayload
+	close(e.down)
+	e.mu.Unlock()
+
+	e.setLinkUp(false)
+}
+
+// terminate ends the session: LCP is terminated, without waiting for the
+// acknowledgement, and the AC is told that the session is over.
+func (e *Endpoint) terminate() {
+	e.mu.Lock()
+	st := e.state
+	s := e.session
+	e.mu.Unlock()
+	if st == stateIdle {
+		return
+	}
+
+	if st >= stateLCPOpened {
+		e.writeControl(header.PPPProtocolLCP, header.PPPTerminateRequest, e.nextID(), nil)
+	}
+	e.writePacket(s.ACAddress, header.PPPoEDiscoveryProtocolNumber, header.PPPoECodePADT, s.ID, nil)
+	e.sessionDown()
+}
+
+// Disconnect ends the session of the endpoint, if any.
+func (e *Endpoint) Disconnect() {
+	e.terminate()
+}
+
+// setLinkUp reports the state of the carrier to the dispatcher, if it changed.
+func (e *Endpoint) setLinkUp(up bool) {
+	e.mu.Lock()
+	d := e.dispatcher
+	if d == nil || e.linkUp == up {
+		e.mu.Unlock()
+		return
+	}
+	e.linkUp = up
+	e.mu.Unlock()
+
+	d.LinkStateChanged(e, up)
+}
+
+// randomUint32 returns a random number.
+func randomUint32() (uint32, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
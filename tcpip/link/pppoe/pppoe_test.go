@@ -0,0 +1,467 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pppoe_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/pppoe"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	clientLinkAddr = tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01")
+	acLinkAddr     = tcpip.LinkAddress("\x02\x00\x00\x00\x00\x02")
+
+	acName    = "test-ac"
+	cookie    = "cookie"
+	sessionID = 0x1234
+	acMRU     = 1400
+	acMagic   = 0x0a0a0a0a
+
+	// The addresses IPCP assigns.
+	clientAddr = "\x0a\x00\x00\x02"
+	acAddr     = "\x0a\x00\x00\x01"
+	dnsAddr    = "\x0a\x00\x00\x35"
+
+	port = 1234
+)
+
+// ac is a fake access concentrator, which answers the discovery packets of the
+// client, and negotiates LCP and IPCP with it.
+type ac struct {
+	t  *testing.T
+	ep *pppoe.Endpoint
+
+	// frames receives the frames written by the client.
+	frames chan []byte
+
+	// ipv4 and echoReplies receive the IPv4 packets and the LCP
+	// Echo-Replies sent by the client. padt is signaled when it ends the
+	// session.
+	ipv4        chan []byte
+	echoReplies chan []byte
+	padt        chan struct{}
+
+	// The state of the negotiations, only accessed by the goroutine of
+	// the AC.
+	clientMRU            uint16
+	lcpAcked, lcpAckSent bool
+}
+
+func newAC(t *testing.T) *ac {
+	return &ac{
+		t:           t,
+		frames:      make(chan []byte, 64),
+		ipv4:        make(chan []byte, 16),
+		echoReplies: make(chan []byte, 16),
+		padt:        make(chan struct{}, 1),
+	}
+}
+
+// WriteFrame implements pppoe.Link.WriteFrame.
+func (a *ac) WriteFrame(frame []byte) error {
+	a.frames <- append([]byte(nil), frame...)
+	return nil
+}
+
+// start starts the goroutine of the AC, which answers ep.
+func (a *ac) start(ep *pppoe.Endpoint) {
+	a.ep = ep
+	go func() {
+		for f := range a.frames {
+			a.handleFrame(f)
+		}
+	}()
+}
+
+// close stops the goroutine of the AC.
+func (a *ac) close() {
+	close(a.frames)
+}
+
+// send sends a PPPoE packet to the client.
+func (a *ac) send(protocol tcpip.NetworkProtocolNumber, code uint8, sid uint16, payload []byte) {
+	b := make([]byte, header.EthernetMinimumSize+header.PPPoESize+len(payload))
+	header.Ethernet(b).Encode(&header.EthernetFields{
+		SrcAddr: acLinkAddr,
+		DstAddr: clientLinkAddr,
+		Type:    protocol,
+	})
+	header.PPPoE(b[header.EthernetMinimumSize:]).Encode(&header.PPPoEFields{
+		Code:      code,
+		SessionID: sid,
+		Length:    uint16(len(payload)),
+	})
+	copy(b[header.EthernetMinimumSize+header.PPPoESize:], payload)
+	a.ep.DeliverFrame(b)
+}
+
+// sendPPP sends a PPP packet of protocol proto to the client.
+func (a *ac) sendPPP(proto uint16, info []byte) {
+	b := make([]byte, header.PPPProtocolSize, header.PPPProtocolSize+len(info))
+	binary.BigEndian.PutUint16(b, proto)
+	a.send(header.PPPoESessionProtocolNumber, header.PPPoECodeSession, sessionID, append(b, info...))
+}
+
+// sendControl sends a PPP control packet of protocol proto to the client.
+func (a *ac) sendControl(proto uint16, code, id uint8, data []byte) {
+	b := make([]byte, header.PPPControlHeaderSize+len(data))
+	header.PPPControl(b).Encode(&header.PPPControlFields{
+		Code:   code,
+		ID:     id,
+		Length: uint16(len(b)),
+	})
+	copy(b[header.PPPControlHeaderSize:], data)
+	a.sendPPP(proto, b)
+}
+
+// lcpRequest sends the Configure-Request of the AC, which asks for PAP if pap
+// is set.
+func (a *ac) lcpRequest(id uint8, pap bool) {
+	var v [4]byte
+	binary.BigEndian.PutUint16(v[:], acMRU)
+	opts := header.AppendPPPOption(nil, header.LCPOptionMRU, v[:2])
+	binary.BigEndian.PutUint32(v[:], acMagic)
+	opts = header.AppendPPPOption(opts, header.LCPOptionMagicNumber, v[:])
+	if pap {
+		binary.BigEndian.PutUint16(v[:], header.PPPProtocolPAP)
+		opts = header.AppendPPPOption(opts, header.LCPOptionAuthProtocol, v[:2])
+	}
+	a.sendControl(header.PPPProtocolLCP, header.PPPConfigureRequest, id, opts)
+}
+
+// lcpOpened starts IPCP once both ends acknowledged LCP.
+func (a *ac) lcpOpened() {
+	if a.lcpAcked && a.lcpAckSent {
+		opts := header.AppendPPPOption(nil, header.IPCPOptionIPAddress, []byte(acAddr))
+		a.sendControl(header.PPPProtocolIPCP, header.PPPConfigureRequest, 1, opts)
+	}
+}
+
+func (a *ac) handleFrame(f []byte) {
+	eth := header.Ethernet(f)
+	p := header.PPPoE(f[header.EthernetMinimumSize:])
+	if !p.IsValid() {
+		a.t.Errorf("invalid PPPoE packet: %x", f)
+		return
+	}
+
+	switch eth.Type() {
+	case header.PPPoEDiscoveryProtocolNumber:
+		tags := make(map[uint16][]byte)
+		for b := p.Payload(); len(b) > 0; {
+			typ, v, rest, ok := header.NextPPPoETag(b)
+			if !ok {
+				a.t.Errorf("malformed tags: %x", p.Payload())
+				return
+			}
+			tags[typ] = v
+			b = rest
+		}
+
+		switch p.Code() {
+		case header.PPPoECodePADI:
+			if eth.DestinationAddress() != "\xff\xff\xff\xff\xff\xff" {
+				a.t.Errorf("PADI sent to %v, want broadcast", eth.DestinationAddress())
+			}
+			offer := header.AppendPPPoETag(nil, header.PPPoETagServiceName, tags[header.PPPoETagServiceName])
+			offer = header.AppendPPPoETag(offer, header.PPPoETagACName, []byte(acName))
+			offer = header.AppendPPPoETag(offer, header.PPPoETagHostUniq, tags[header.PPPoETagHostUniq])
+			offer = header.AppendPPPoETag(offer, header.PPPoETagACCookie, []byte(cookie))
+			a.send(header.PPPoEDiscoveryProtocolNumber, header.PPPoECodePADO, 0, offer)
+
+		case header.PPPoECodePADR:
+			if got := string(tags[header.PPPoETagACCookie]); got != cookie {
+				a.t.Errorf("got AC-Cookie %q in PADR, want %q", got, cookie)
+			}
+			confirm := header.AppendPPPoETag(nil, header.PPPoETagServiceName, tags[header.PPPoETagServiceName])
+			confirm = header.AppendPPPoETag(confirm, header.PPPoETagHostUniq, tags[header.PPPoETagHostUniq])
+			a.send(header.PPPoEDiscoveryProtocolNumber, header.PPPoECodePADS, sessionID, confirm)
+			a.lcpRequest(1, true)
+
+		case header.PPPoECodePADT:
+			if p.SessionID() != sessionID {
+				a.t.Errorf("got PADT for session %#x, want %#x", p.SessionID(), sessionID)
+			}
+			a.padt <- struct{}{}
+		}
+
+	case header.PPPoESessionProtocolNumber:
+		if p.SessionID() != sessionID {
+			a.t.Errorf("got packet of session %#x, want %#x", p.SessionID(), sessionID)
+			return
+		}
+		payload := p.Payload()
+		proto := binary.BigEndian.Uint16(payload)
+		info := payload[header.PPPProtocolSize:]
+		switch proto {
+		case header.PPPProtocolIPv4:
+			a.ipv4 <- info
+		case header.PPPProtocolLCP:
+			a.handleLCP(header.PPPControl(info))
+		case header.PPPProtocolIPCP:
+			a.handleIPCP(header.PPPControl(info))
+		default:
+			a.t.Errorf("got packet of protocol %#x", proto)
+		}
+	}
+}
+
+func (a *ac) handleLCP(c header.PPPControl) {
+	switch c.Code() {
+	case header.PPPConfigureRequest:
+		for b := c.Data(); len(b) > 0; {
+			typ, v, rest, ok := header.NextPPPOption(b)
+			if !ok {
+				a.t.Errorf("malformed LCP options: %x", c.Data())
+				return
+			}
+			if typ == header.LCPOptionMRU {
+				a.clientMRU = binary.BigEndian.Uint16(v)
+			}
+			b = rest
+		}
+		a.sendControl(header.PPPProtocolLCP, header.PPPConfigureAck, c.ID(), c.Data())
+		a.lcpAckSent = true
+		a.lcpOpened()
+
+	case header.PPPConfigureAck:
+		a.lcpAcked = true
+		a.lcpOpened()
+
+	case header.PPPConfigureReject:
+		typ, _, _, ok := header.NextPPPOption(c.Data())
+		if !ok || typ != header.LCPOptionAuthProtocol {
+			a.t.Errorf("got Configure-Reject of %x, want the authentication protocol", c.Data())
+		}
+		a.lcpRequest(c.ID()+1, false)
+
+	case header.PPPEchoReply:
+		a.echoReplies <- c.Data()
+
+	case header.PPPTerminateRequest:
+		a.sendControl(header.PPPProtocolLCP, header.PPPTerminateAck, c.ID(), nil)
+
+	default:
+		a.t.Errorf("got LCP packet %x", c)
+	}
+}
+
+// handleIPCP rejects the secondary DNS server, and then naks the address of the
+// client and the primary DNS server.
+func (a *ac) handleIPCP(c header.PPPControl) {
+	if c.Code() != header.PPPConfigureRequest {
+		return
+	}
+
+	var rej, nak []byte
+	for b := c.Data(); len(b) > 0; {
+		typ, v, rest, ok := header.NextPPPOption(b)
+		if !ok {
+			a.t.Errorf("malformed IPCP options: %x", c.Data())
+			return
+		}
+		switch typ {
+		case header.IPCPOptionIPAddress:
+			if string(v) != clientAddr {
+				nak = header.AppendPPPOption(nak, typ, []byte(clientAddr))
+			}
+		case header.IPCPOptionPrimaryDNS:
+			if string(v) != dnsAddr {
+				nak = header.AppendPPPOption(nak, typ, []byte(dnsAddr))
+			}
+		default:
+			rej = header.AppendPPPOption(rej, typ, v)
+		}
+		b = rest
+	}
+
+	switch {
+	case len(rej) > 0:
+		a.sendControl(header.PPPProtocolIPCP, header.PPPConfigureReject, c.ID(), rej)
+	case len(nak) > 0:
+		a.sendControl(header.PPPProtocolIPCP, header.PPPConfigureNak, c.ID(), nak)
+	default:
+		a.sendControl(header.PPPProtocolIPCP, header.PPPConfigureAck, c.ID(), c.Data())
+	}
+}
+
+// udpPacket builds an IPv4 packet carrying a UDP datagram with the given
+// payload, without a UDP checksum.
+func udpPacket(src, dst tcpip.Address, srcPort, dstPort uint16, payload []byte) []byte {
+	buf := make([]byte, header.IPv4MinimumSize+header.UDPMinimumSize+len(payload))
+	copy(buf[header.IPv4MinimumSize+header.UDPMinimumSize:], payload)
+
+	ip := header.IPv4(buf)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(buf)),
+		TTL:         65,
+		Protocol:    uint8(udp.ProtocolNumber),
+		SrcAddr:     src,
+		DstAddr:     dst,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	header.UDP(buf[header.IPv4MinimumSize:]).Encode(&header.UDPFields{
+		SrcPort: srcPort,
+		DstPort: dstPort,
+		Length:  uint16(header.UDPMinimumSize + len(payload)),
+	})
+
+	return buf
+}
+
+func TestSession(t *testing.T) {
+	a := newAC(t)
+	defer a.close()
+
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+	id, linkEP := pppoe.New(a, pppoe.Config{LinkAddress: clientLinkAddr})
+	a.start(linkEP)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sess, err := linkEP.Connect(ctx)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	if sess.ID != sessionID || sess.ACAddress != acLinkAddr || sess.ACName != acName {
+		t.Errorf("got session %#x with %v (%q), want %#x with %v (%q)", sess.ID, sess.ACAddress, sess.ACName, sessionID, acLinkAddr, acName)
+	}
+	if sess.LocalAddress != clientAddr || sess.RemoteAddress != acAddr {
+		t.Errorf("got addresses %v and %v, want %v and %v", sess.LocalAddress, sess.RemoteAddress, tcpip.Address(clientAddr), tcpip.Address(acAddr))
+	}
+	if len(sess.DNSServers) != 1 || sess.DNSServers[0] != dnsAddr {
+		t.Errorf("got DNS servers %v, want [%v]", sess.DNSServers, tcpip.Address(dnsAddr))
+	}
+	if a.clientMRU != header.PPPoEMaxPayload {
+		t.Errorf("got MRU %d requested, want %d", a.clientMRU, header.PPPoEMaxPayload)
+	}
+
+	// The MTU of the NIC is the MRU of the AC.
+	if sess.MTU != acMRU {
+		t.Errorf("got MTU %d, want %d", sess.MTU, acMRU)
+	}
+	info := s.NICInfo()[1]
+	if info.MTU != acMRU || !info.Flags.Running {
+		t.Errorf("got NIC MTU %d, running %t, want %d, running", info.MTU, info.Flags.Running, acMRU)
+	}
+
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, sess.LocalAddress); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         1,
+	}})
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Port: port}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	// Datagrams are exchanged over the session.
+	if _, err := ep.Write(buffer.View("ping"), &tcpip.FullAddress{Addr: acAddr, Port: port}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	select {
+	case pkt := <-a.ipv4:
+		ip := header.IPv4(pkt)
+		if ip.SourceAddress() != clientAddr || ip.DestinationAddress() != acAddr || !bytes.HasSuffix(pkt, []byte("ping")) {
+			t.Errorf("got packet %x, want a datagram from %v to %v", pkt, tcpip.Address(clientAddr), tcpip.Address(acAddr))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a packet")
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventIn)
+	defer wq.EventUnregister(&we)
+	a.sendPPP(header.PPPProtocolIPv4, udpPacket(acAddr, clientAddr, port, port, []byte("pong")))
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a datagram")
+	}
+	if v, err := ep.Read(nil); err != nil || string(v) != "pong" {
+		t.Errorf("got Read() = %q, %v, want \"pong\", nil", v, err)
+	}
+
+	// Echo-Requests are answered with the magic number of the client.
+	a.sendControl(header.PPPProtocolLCP, header.PPPEchoRequest, 7, []byte("\x0a\x0a\x0a\x0adata"))
+	select {
+	case data := <-a.echoReplies:
+		if len(data) != 8 || string(data[4:]) != "data" || binary.BigEndian.Uint32(data) == acMagic {
+			t.Errorf("got Echo-Reply %x", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for an Echo-Reply")
+	}
+
+	// The session ends with the PADT of the AC.
+	a.send(header.PPPoEDiscoveryProtocolNumber, header.PPPoECodePADT, sessionID, nil)
+	if _, ok := linkEP.Session(); ok {
+		t.Errorf("session still up after PADT")
+	}
+	if s.NICInfo()[1].Flags.Running {
+		t.Errorf("NIC still running after PADT")
+	}
+	if _, err := ep.Write(buffer.View("ping"), &tcpip.FullAddress{Addr: acAddr, Port: port}); err == nil {
+		t.Errorf("Write succeeded after PADT")
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	a := newAC(t)
+	defer a.close()
+
+	id, linkEP := pppoe.New(a, pppoe.Config{LinkAddress: clientLinkAddr, ServiceName: "internet"})
+	a.start(linkEP)
+	s := stack.New([]string{ipv4.ProtocolName}, nil).(*stack.Stack)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := linkEP.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if _, err := linkEP.Connect(ctx); err != tcpip.ErrAlreadyConnected {
+		t.Errorf("got Connect() = %v, want %v", err, tcpip.ErrAlreadyConnected)
+	}
+
+	linkEP.Disconnect()
+	select {
+	case <-a.padt:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a PADT")
+	}
+	if info := s.NICInfo()[1]; info.Flags.Running || info.MTU != header.PPPoEMaxPayload {
+		t.Errorf("got NIC MTU %d, running %t, want %d, not running", info.MTU, info.Flags.Running, header.PPPoEMaxPayload)
+	}
+}
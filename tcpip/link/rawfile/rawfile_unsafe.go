@@ -5,12 +5,24 @@
 package rawfile
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"syscall"
 	"unsafe"
 )
 
+// ErrStopped is returned by BlockingReadUntilStopped when the read is stopped
+// before any data is available.
+var ErrStopped = errors.New("read stopped")
+
+// pollEvent is the pollfd struct used by the poll() syscall.
+type pollEvent struct {
+	fd      int32
+	events  int16
+	revents int16
+}
+
 // GetMTU determines the MTU of a network interface device.
 func GetMTU(name string) (int, error) {
 	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
@@ -88,6 +100,38 @@ func NonBlockingWrite2(fd int, b1, b2 []byte) error {
 	return nil
 }
 
+// NonBlockingWriteN writes any number of byte slices to a file descriptor in a
+// single syscall. It fails if partial data is written.
+func NonBlockingWriteN(fd int, bufs ...[]byte) error {
+	iovec := make([]syscall.Iovec, 0, len(bufs))
+	length := 0
+	for _, b := range bufs {
+		if len(b) == 0 {
+			continue
+		}
+		iovec = append(iovec, syscall.Iovec{
+			Base: &b[0],
+			Len:  uint64(len(b)),
+		})
+		length += len(b)
+	}
+
+	if len(iovec) == 0 {
+		return NonBlockingWrite(fd, nil)
+	}
+
+	n, _, e := syscall.RawSyscall(syscall.SYS_WRITEV, uintptr(fd), uintptr(unsafe.Pointer(&iovec[0])), uintptr(len(iovec)))
+	if e != 0 {
+		return e
+	}
+
+	if n != uintptr(length) {
+		return fmt.Errorf("wrong number of bytes written: expected %d, got %d", length, n)
+	}
+
+	return nil
+}
+
 // BlockingRead reads from a file descriptor that is set up as non-blocking. If
 // no data is available, it will block in a poll() syscall until the file
 // descirptor becomes readable.
@@ -113,3 +157,103 @@ func BlockingRead(fd int, b []byte) (int, error) {
 		}
 	}
 }
+
+// BlockingReadUntilStopped is like BlockingRead, except that it returns
+// ErrStopped when stopFD becomes readable while it is waiting for data.
+func BlockingReadUntilStopped(fd, stopFD int, b []byte) (int, error) {
+	for {
+		n, _, e := syscall.RawSyscall(syscall.SYS_READ, uintptr(fd), uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)))
+		if e == 0 {
+			return int(n), nil
+		}
+
+		events := [2]pollEvent{
+			{fd: int32(fd), events: 1},     // POLLIN
+			{fd: int32(stopFD), events: 1}, // POLLIN
+		}
+
+		_, _, e = syscall.Syscall(syscall.SYS_POLL, uintptr(unsafe.Pointer(&events[0])), 2, uintptr(math.MaxUint64))
+		if e != 0 && e != syscall.EINTR {
+			return 0, e
+		}
+
+		if events[1].revents != 0 {
+			return 0, ErrStopped
+		}
+	}
+}
+
+// NonBlockingRead reads from a file descriptor that is set up as non-blocking.
+// If no data is available, it returns syscall.EAGAIN immediately.
+func NonBlockingRead(fd int, b []byte) (int, error) {
+	n, _, e := syscall.RawSyscall(syscall.SYS_READ, uintptr(fd), uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)))
+	if e != 0 {
+		return 0, e
+	}
+
+	return int(n), nil
+}
+
+// readv reads from a file descriptor into the buffers described by iovecs, in
+// order, in a single syscall.
+func readv(fd int, iovecs []syscall.Iovec) (int, syscall.Errno) {
+	n, _, e := syscall.RawSyscall(syscall.SYS_READV, uintptr(fd), uintptr(unsafe.Pointer(&iovecs[0])), uintptr(len(iovecs)))
+	return int(n), e
+}
+
+// BlockingReadvUntilStopped is like BlockingReadUntilStopped, except that it
+// reads into the buffers described by iovecs, in order, like readv().
+func BlockingReadvUntilStopped(fd, stopFD int, iovecs []syscall.Iovec) (int, error) {
+	for {
+		n, e := readv(fd, iovecs)
+		if e == 0 {
+			return n, nil
+		}
+
+		events := [2]pollEvent{
+			{fd: int32(fd), events: 1},     // POLLIN
+			{fd: int32(stopFD), events: 1}, // POLLIN
+		}
+
+		_, _, e = syscall.Syscall(syscall.SYS_POLL, uintptr(unsafe.Pointer(&events[0])), 2, uintptr(math.MaxUint64))
+		if e != 0 && e != syscall.EINTR {
+			return 0, e
+		}
+
+		if events[1].revents != 0 {
+			return 0, ErrStopped
+		}
+	}
+}
+
+// BlockingReadv is like BlockingRead, except that it reads into the buffers
+// described by iovecs, in order, like readv().
+func BlockingReadv(fd int, iovecs []syscall.Iovec) (int, error) {
+	for {
+		n, e := readv(fd, iovecs)
+		if e == 0 {
+			return n, nil
+		}
+
+		event := pollEvent{
+			fd:     int32(fd),
+			events: 1, // POLLIN
+		}
+
+		_, _, e = syscall.Syscall(syscall.SYS_POLL, uintptr(unsafe.Pointer(&event)), 1, uintptr(math.MaxUint64))
+		if e != 0 && e != syscall.EINTR {
+			return 0, e
+		}
+	}
+}
+
+// NonBlockingReadv is like NonBlockingRead, except that it reads into the
+// buffers described by iovecs, in order, like readv().
+func NonBlockingReadv(fd int, iovecs []syscall.Iovec) (int, error) {
+	n, e := readv(fd, iovecs)
+	if e != 0 {
+		return 0, e
+	}
+
+	return n, nil
+}
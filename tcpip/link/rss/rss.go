@@ -0,0 +1,178 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package rss provides the implementation of data-link layer endpoints that
+// wrap another endpoint and spread the processing of inbound packets across
+// multiple receive queues, each served by its own dispatch goroutine. Packets
+// are steered to queues by a hash of their addresses and ports (RSS-style), so
+// the packets of a flow are always processed in order by the same goroutine,
+// while different flows are processed in parallel.
+//
+// RSS endpoints can be used in the networking stack by calling New(eID, n,
+// size) to create a new endpoint, where eID is the ID of the endpoint being
+// wrapped, and then passing it as an argument to Stack.CreateNIC(). The
+// worker-pool mode of NICs, see Stack.SetNICWorkers, does the same within the
+// stack, for NICs whose link endpoint can't be wrapped.
+package rss
+
+import (
+	"sync"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// maxBatchSize is the maximum number of packets a queue hands to the
+// dispatcher at once, when the dispatcher supports batches.
+const maxBatchSize = 32
+
+type endpoint struct {
+	dispatcher stack.NetworkDispatcher
+	lower      stack.LinkEndpoint
+	queues     []chan stack.InboundPacket
+
+	// mu protects closed below. It is held for reading while packets are
+	// queued, so that queues aren't closed under a delivering goroutine.
+	mu     sync.RWMutex
+	closed bool
+
+	// loops tracks the goroutines serving the receive queues.
+	loops sync.WaitGroup
+}
+
+// New creates a new RSS link-layer endpoint with n receive queues, each
+// holding up to size packets. It wraps around another endpoint; when a queue
+// is full, the goroutine delivering packets from the lower endpoint blocks
+// until there is room in it.
+func New(lower tcpip.LinkEndpointID, n, size int) tcpip.LinkEndpointID {
+	if n < 1 {
+		n = 1
+	}
+
+	e := &endpoint{
+		lower:  stack.FindLinkEndpoint(lower),
+		queues: make([]chan stack.InboundPacket, n),
+	}
+	for i := range e.queues {
+		e.queues[i] = make(chan stack.InboundPacket, size)
+	}
+
+	return stack.RegisterLinkEndpoint(e)
+}
+
+// DeliverNetworkPacket implements the stack.NetworkDispatcher interface. It is
+// called by the link-layer endpoint being wrapped when a packet arrives, and
+// queues the packet in the receive queue selected by its flow.
+func (e *endpoint) DeliverNetworkPacket(linkEP stack.LinkEndpoint, protocol tcpip.NetworkProtocolNumber, v buffer.View) {
+	q := stack.FlowHash(protocol, v) % uint32(len(e.queues))
+
+	e.mu.RLock()
+	if !e.closed {
+		e.queues[q] <- stack.InboundPacket{Protocol: protocol, Data: v}
+	}
+	e.mu.RUnlock()
+}
+
+// DeliverNetworkPackets implements the stack.BatchNetworkDispatcher interface.
+// It queues each packet in the receive queue selected by its flow.
+func (e *endpoint) DeliverNetworkPackets(linkEP stack.LinkEndpoint, pkts []stack.InboundPacket) {
+	for i := range pkts {
+		e.DeliverNetworkPacket(linkEP, pkts[i].Protocol, pkts[i].Data)
+	}
+}
+
+// LinkStateChanged implements the stack.NetworkDispatcher interface. It just
+// forwards the notification to the actual dispatcher.
+func (e *endpoint) LinkStateChanged(linkEP stack.LinkEndpoint, up bool) {
+	e.dispatcher.LinkStateChanged(e, up)
+}
+
+// Attach implements the stack.LinkEndpoint interface. It saves the dispatcher,
+// starts the goroutines serving the receive queues, and registers with the
+// lower endpoint as its dispatcher so that "e" is called for inbound packets.
+func (e *endpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.dispatcher = dispatcher
+	for _, q := range e.queues {
+		e.loops.Add(1)
+		go func(q chan stack.InboundPacket) {
+			defer e.loops.Done()
+			e.dispatchLoop(q)
+		}(q)
+	}
+	e.lower.Attach(e)
+}
+
+// Close implements stack.ClosableLinkEndpoint.Close. It closes the lower
+// endpoint if it can be closed, then drops the packets delivered from then on
+// and waits for the goroutines serving the receive queues to exit, once they
+// have dispatched the packets already queued.
+func (e *endpoint) Close() {
+	if cep, ok := e.lower.(stack.ClosableLinkEndpoint); ok {
+		cep.Close()
+	}
+
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+	e.closed = true
+	for _, q := range e.queues {
+		close(q)
+	}
+	e.mu.Unlock()
+
+	e.loops.Wait()
+}
+
+// dispatchLoop hands the packets of the given queue over to the dispatcher, in
+// batches if the dispatcher supports them.
+func (e *endpoint) dispatchLoop(q chan stack.InboundPacket) {
+	bd, _ := e.dispatcher.(stack.BatchNetworkDispatcher)
+	batch := make([]stack.InboundPacket, 0, maxBatchSize)
+	for p := range q {
+		if bd == nil {
+			e.dispatcher.DeliverNetworkPacket(e, p.Protocol, p.Data)
+			continue
+		}
+
+		batch = append(batch[:0], p)
+	drain:
+		for len(batch) < maxBatchSize {
+			select {
+			case p := <-q:
+				batch = append(batch, p)
+			default:
+				break drain
+			}
+		}
+
+		bd.DeliverNetworkPackets(e, batch)
+	}
+}
+
+// MTU implements stack.LinkEndpoint.MTU. It just forwards the request to the
+// lower endpoint.
+func (e *endpoint) MTU() uint32 {
+	return e.lower.MTU()
+}
+
+// MaxHeaderLength implements the stack.LinkEndpoint interface. It just forwards
+// the request to the lower endpoint.
+func (e *endpoint) MaxHeaderLength() uint16 {
+	return e.lower.MaxHeaderLength()
+}
+
+// Capabilities implements stack.LinkEndpoint.Capabilities. It just forwards the
+// request to the lower endpoint.
+func (e *endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return e.lower.Capabilities()
+}
+
+// WritePacket implements the stack.LinkEndpoint interface. It just forwards the
+// request to the lower endpoint.
+func (e *endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) error {
+	return e.lower.WritePacket(r, hdr, payload, protocol)
+}
@@ -0,0 +1,140 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rss
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// udpPacket builds an IPv4 packet carrying a UDP datagram from the given source
+// port, whose payload is the single byte seq.
+func udpPacket(srcPort uint16, seq byte) buffer.View {
+	v := buffer.NewView(header.IPv4MinimumSize + header.UDPMinimumSize + 1)
+	header.IPv4(v).Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(v)),
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     "\x0a\x00\x00\x02",
+		DstAddr:     "\x0a\x00\x00\x01",
+	})
+	header.UDP(v[header.IPv4MinimumSize:]).Encode(&header.UDPFields{
+		SrcPort: srcPort,
+		DstPort: 53,
+		Length:  header.UDPMinimumSize + 1,
+	})
+	v[len(v)-1] = seq
+	return v
+}
+
+// recordingDispatcher is a network dispatcher that calls deliver for each
+// packet, from the goroutines of the queues.
+type recordingDispatcher struct {
+	deliver func(v buffer.View)
+}
+
+func (d *recordingDispatcher) DeliverNetworkPacket(_ stack.LinkEndpoint, _ tcpip.NetworkProtocolNumber, v buffer.View) {
+	d.deliver(v)
+}
+
+func (*recordingDispatcher) LinkStateChanged(stack.LinkEndpoint, bool) {}
+
+func newTestEndpoint(n int, deliver func(v buffer.View)) (*channel.Endpoint, *endpoint) {
+	lowerID, lower := channel.New(0, 1500)
+	e := stack.FindLinkEndpoint(New(lowerID, n, 16)).(*endpoint)
+	e.Attach(&recordingDispatcher{deliver: deliver})
+	return lower, e
+}
+
+func TestFlowOrder(t *testing.T) {
+	const (
+		flows   = 16
+		packets = 100
+	)
+
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		got = make(map[uint16][]byte)
+	)
+	wg.Add(flows * packets)
+	lower, _ := newTestEndpoint(4, func(v buffer.View) {
+		port := header.UDP(v[header.IPv4MinimumSize:]).SourcePort()
+		mu.Lock()
+		got[port] = append(got[port], v[len(v)-1])
+		mu.Unlock()
+		wg.Done()
+	})
+
+	for i := 0; i < packets; i++ {
+		for port := uint16(1000); port < 1000+flows; port++ {
+			lower.Inject(header.IPv4ProtocolNumber, udpPacket(port, byte(i)))
+		}
+	}
+
+	wg.Wait()
+
+	if len(got) != flows {
+		t.Fatalf("got packets of %d flows, want %d", len(got), flows)
+	}
+	for port, seqs := range got {
+		if len(seqs) != packets {
+			t.Fatalf("got %d packets of flow %d, want %d", len(seqs), port, packets)
+		}
+		for i, seq := range seqs {
+			if seq != byte(i) {
+				t.Fatalf("packet %d of flow %d is %d, want %d", i, port, seq, i)
+			}
+		}
+	}
+}
+
+func TestParallelQueues(t *testing.T) {
+	const n = 4
+
+	// Find two flows processed by different queues.
+	blockedPort := uint16(1000)
+	otherPort := blockedPort + 1
+	for stack.FlowHash(header.IPv4ProtocolNumber, udpPacket(otherPort, 0))%n == stack.FlowHash(header.IPv4ProtocolNumber, udpPacket(blockedPort, 0))%n {
+		otherPort++
+	}
+
+	unblock := make(chan struct{})
+	delivered := make(chan uint16, 2)
+	lower, _ := newTestEndpoint(n, func(v buffer.View) {
+		port := header.UDP(v[header.IPv4MinimumSize:]).SourcePort()
+		if port == blockedPort {
+			<-unblock
+		}
+		delivered <- port
+	})
+
+	// The packets of the other flow are dispatched while the queue of the
+	// first one is blocked.
+	lower.Inject(header.IPv4ProtocolNumber, udpPacket(blockedPort, 0))
+	lower.Inject(header.IPv4ProtocolNumber, udpPacket(otherPort, 0))
+
+	select {
+	case port := <-delivered:
+		if port != otherPort {
+			t.Fatalf("got packet of flow %d first, want %d", port, otherPort)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("packet of flow %d wasn't dispatched", otherPort)
+	}
+
+	close(unblock)
+	if port := <-delivered; port != blockedPort {
+		t.Fatalf("got packet of flow %d, want %d", port, blockedPort)
+	}
+}
@@ -0,0 +1,419 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package shaper provides the implementation of data-link layer endpoints that
+// wrap another endpoint and limit the rate of outbound packets with token
+// buckets, both for the endpoint as a whole and for individual traffic classes.
+//
+// Shaper endpoints can be used in the networking stack by calling New(eID,
+// root, classes, classify, clock) to create a new endpoint, where eID is the ID
+// of the endpoint being wrapped and clock is usually the clock of the stack, and
+// then passing it as an argument to Stack.CreateNIC().
+//
+// Outbound packets are assigned to a class by the classifier, and queued if
+// either the class or the root bucket doesn't have enough tokens to send them
+// right away; packets that don't fit in their class queue are dropped. When
+// several classes have packets eligible to be sent, lower-numbered classes
+// are served first, so class numbers double as priorities.
+package shaper
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// Class describes the token bucket of a traffic class, or of the endpoint as a
+// whole.
+type Class struct {
+	// Rate is the rate at which tokens are added to the bucket, in bytes
+	// per second. Zero means the rate is unlimited.
+	Rate uint64
+
+	// Burst is the size of the bucket, in bytes, that is, the number of
+	// bytes that can be sent at once after a period of inactivity. If it
+	// is zero, the size of the largest IP packet is used.
+	Burst uint64
+
+	// Limit is the maximum number of packets of the class that can be
+	// queued waiting for tokens. It is ignored for the root class.
+	Limit int
+}
+
+// Classifier returns the class of an outbound packet, given its network header
+// (and any headers already prepended by upper layers), its payload and its
+// network protocol. Out of range values select the last class.
+type Classifier func(hdr, payload []byte, protocol tcpip.NetworkProtocolNumber) int
+
+// bucket is a token bucket.
+type bucket struct {
+	rate   uint64
+	burst  uint64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(c Class, now time.Time) bucket {
+	burst := c.Burst
+	if burst == 0 {
+		burst = header.MaxIPPacketSize
+	}
+
+	return bucket{
+		rate:   c.Rate,
+		burst:  burst,
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+// refill adds the tokens accumulated since the last refill.
+func (b *bucket) refill(now time.Time) {
+	if b.rate == 0 {
+		return
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+	b.last = now
+}
+
+// wait returns how long it will take for the bucket to have enough tokens to
+// send a packet of the given size. Packets larger than the bucket only need a
+// full bucket.
+func (b *bucket) wait(size int) time.Duration {
+	if b.rate == 0 {
+		return 0
+	}
+
+	need := float64(size)
+	if need > float64(b.burst) {
+		need = float64(b.burst)
+	}
+
+	if b.tokens >= need {
+		return 0
+	}
+
+	return time.Duration((need - b.tokens) / float64(b.rate) * float64(time.Second))
+}
+
+// take removes the tokens needed to send a packet of the given size.
+func (b *bucket) take(size int) {
+	if b.rate != 0 {
+		b.tokens -= float64(size)
+	}
+}
+
+// packet is an outbound packet waiting for tokens.
+type packet struct {
+	route    stack.Route
+	hdr      buffer.Prependable
+	payload  buffer.VectorisedView
+	protocol tcpip.NetworkProtocolNumber
+	size     int
+}
+
+// class is the state of a traffic class.
+type class struct {
+	bucket  bucket
+	limit   int
+	queue   []*packet
+	dropped uint64
+}
+
+// Endpoint is a link layer endpoint that shapes outbound traffic.
+type Endpoint struct {
+	lower    stack.LinkEndpoint
+	classify Classifier
+	clock    tcpip.Clock
+
+	// wakeup is used to tell the goroutine that sends queued packets that
+	// new packets were queued.
+	wakeup chan struct{}
+
+	// stop is closed to tell that goroutine to exit, and done is closed
+	// by it when it does; done is nil if the goroutine wasn't started.
+	stop chan struct{}
+	done chan struct{}
+
+	// mu protects the fields below.
+	mu      sync.Mutex
+	root    bucket
+	classes []class
+	closed  bool
+}
+
+// New creates a new shaper link-layer endpoint. It wraps around another
+// endpoint and limits the rate of outbound packets according to the root
+// bucket, and to the bucket of the class selected for each packet by the
+// classifier. If classes is empty, a single class without a rate limit and
+// with a queue of 1000 packets is used; classify may be nil if there's only
+// one class.
+//
+// Tokens are added to the buckets as time passes according to clock, e.g., the
+// clock of the stack, or according to the real time if clock is nil.
+func New(lower tcpip.LinkEndpointID, root Class, classes []Class, classify Classifier, clock tcpip.Clock) (tcpip.LinkEndpointID, *Endpoint) {
+	e := newEndpoint(stack.FindLinkEndpoint(lower), root, classes, classify, clock)
+	e.done = make(chan struct{})
+	go func() {
+		defer close(e.done)
+		e.run()
+	}()
+
+	return stack.RegisterLinkEndpoint(e), e
+}
+
+// newEndpoint creates a new shaper endpoint, without starting the goroutine
+// that sends queued packets.
+func newEndpoint(lower stack.LinkEndpoint, root Class, classes []Class, classify Classifier, clock tcpip.Clock) *Endpoint {
+	if len(classes) == 0 {
+		classes = []Class{{Limit: 1000}}
+	}
+	if clock == nil {
+		clock = tcpip.StdClock{}
+	}
+
+	now := clock.Now()
+	e := &Endpoint{
+		lower:    lower,
+		classify: classify,
+		clock:    clock,
+		wakeup:   make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		root:     newBucket(root, now),
+		classes:  make([]class, len(classes)),
+	}
+
+	for i, c := range classes {
+		e.classes[i] = class{
+			bucket: newBucket(c, now),
+			limit:  c.Limit,
+		}
+	}
+
+	return e
+}
+
+// Dropped returns the number of packets of the given class dropped because
+// its queue was full.
+func (e *Endpoint) Dropped(c int) uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if c < 0 || c >= len(e.classes) {
+		return 0
+	}
+
+	return e.classes[c].dropped
+}
+
+// Attach implements the stack.LinkEndpoint interface. Inbound packets aren't
+// shaped, so it just attaches the dispatcher to the lower endpoint directly.
+func (e *Endpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.lower.Attach(dispatcher)
+}
+
+// MTU implements stack.LinkEndpoint.MTU. It just forwards the request to the
+// lower endpoint.
+func (e *Endpoint) MTU() uint32 {
+	return e.lower.MTU()
+}
+
+// MaxHeaderLength implements the stack.LinkEndpoint interface. It just forwards
+// the request to the lower endpoint.
+func (e *Endpoint) MaxHeaderLength() uint16 {
+	return e.lower.MaxHeaderLength()
+}
+
+// Capabilities implements stack.LinkEndpoint.Capabilities. It just forwards the
+// request to the lower endpoint.
+func (e *Endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return e.lower.Capabilities()
+}
+
+// Close implements stack.ClosableLinkEndpoint.Close. It stops the goroutine
+// that sends queued packets, drops the packets still queued, and then closes
+// the lower endpoint, if it can be closed. Packets written afterwards are
+// rejected.
+func (e *Endpoint) Close() {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+	e.closed = true
+	e.mu.Unlock()
+
+	close(e.stop)
+	if e.done != nil {
+		<-e.done
+	}
+
+	e.mu.Lock()
+	for i := range e.classes {
+		cl := &e.classes[i]
+		for _, p := range cl.queue {
+			p.route.Release()
+		}
+		cl.queue = nil
+	}
+	e.mu.Unlock()
+
+	if cep, ok := e.lower.(stack.ClosableLinkEndpoint); ok {
+		cep.Close()
+	}
+}
+
+// WritePacket implements the stack.LinkEndpoint interface. It writes the packet
+// to the lower endpoint right away if there are enough tokens and no packets
+// of the same class are already waiting; otherwise, it queues the packet to be
+// sent later, or drops it if the class queue is full.
+func (e *Endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) error {
+	size := hdr.UsedLength() + payload.Size()
+
+	c := 0
+	if e.classify != nil {
+		c = e.classify(hdr.UsedBytes(), payload.ToView(), protocol)
+	}
+
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return tcpip.ErrClosedForSend
+	}
+	if c < 0 || c >= len(e.classes) {
+		c = len(e.classes) - 1
+	}
+	cl := &e.classes[c]
+
+	now := e.clock.Now()
+	e.root.refill(now)
+	cl.bucket.refill(now)
+
+	if len(cl.queue) == 0 && e.root.wait(size) == 0 && cl.bucket.wait(size) == 0 {
+		e.root.take(size)
+		cl.bucket.take(size)
+		e.mu.Unlock()
+		return e.lower.WritePacket(r, hdr, payload, protocol)
+	}
+
+	if len(cl.queue) >= cl.limit {
+		cl.dropped++
+		e.mu.Unlock()
+		return nil
+	}
+
+	// The packet will be written after WritePacket returns, so it holds
+	// its own reference to the route and its own copy of the header,
+	// which its writer may release.
+	cl.queue = append(cl.queue, &packet{
+		route:    r.Clone(),
+		hdr:      e.copyHeader(hdr),
+		payload:  payload,
+		protocol: protocol,
+		size:     size,
+	})
+	e.mu.Unlock()
+
+	select {
+	case e.wakeup <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// copyHeader returns a copy of the given header buffer, with room for the
+// headers of the lower endpoint.
+func (e *Endpoint) copyHeader(hdr *buffer.Prependable) buffer.Prependable {
+	used := hdr.UsedBytes()
+	h := buffer.NewPrependable(int(e.lower.MaxHeaderLength()) + len(used))
+	copy(h.Prepend(len(used)), used)
+	return h
+}
+
+// dequeue returns the next queued packet that can be sent, taking the tokens it
+// needs. If there is none, it returns how long to wait before trying again, or
+// zero if there are no queued packets.
+func (e *Endpoint) dequeue() (*packet, time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := e.clock.Now()
+	e.root.refill(now)
+
+	var wait time.Duration
+	for i := range e.classes {
+		cl := &e.classes[i]
+		if len(cl.queue) == 0 {
+			continue
+		}
+
+		cl.bucket.refill(now)
+		p := cl.queue[0]
+
+		w := cl.bucket.wait(p.size)
+		if rw := e.root.wait(p.size); rw > w {
+			w = rw
+		}
+
+		if w == 0 {
+			cl.queue[0] = nil
+			cl.queue = cl.queue[1:]
+			e.root.take(p.size)
+			cl.bucket.take(p.size)
+			return p, 0
+		}
+
+		if wait == 0 || w < wait {
+			wait = w
+		}
+	}
+
+	return nil, wait
+}
+
+// run writes queued packets to the lower endpoint as tokens become available,
+// until the endpoint is closed.
+func (e *Endpoint) run() {
+	timer := e.clock.NewTimer(time.Hour)
+	timer.Stop()
+
+	for {
+		p, wait := e.dequeue()
+		if p != nil {
+			e.lower.WritePacket(&p.route, &p.hdr, p.payload, p.protocol)
+			p.route.Release()
+			continue
+		}
+
+		if wait == 0 {
+			select {
+			case <-e.wakeup:
+			case <-e.stop:
+				return
+			}
+			continue
+		}
+
+		timer.Reset(wait)
+		select {
+		case <-timer.C():
+		case <-e.wakeup:
+			if !timer.Stop() {
+				<-timer.C()
+			}
+		case <-e.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package shaper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/faketime"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// classifyByFirstByte selects the class given by the first byte of the header.
+func classifyByFirstByte(hdr, payload []byte, protocol tcpip.NetworkProtocolNumber) int {
+	return int(hdr[0])
+}
+
+// newTestEndpoint creates a shaper endpoint on top of a channel endpoint, with
+// a manual clock, and without the goroutine that sends queued packets so that
+// tests can dequeue them themselves.
+func newTestEndpoint(root Class, classes []Class) (*Endpoint, *channel.Endpoint, *faketime.ManualClock) {
+	clock := faketime.NewManualClock(time.Unix(0, 0))
+	_, lower := channel.New(100, 1500)
+	lower.SetClock(clock)
+	return newEndpoint(lower, root, classes, classifyByFirstByte, clock), lower, clock
+}
+
+// write writes a packet of the given size and class through e.
+func write(t *testing.T, e *Endpoint, size int, class byte) {
+	t.Helper()
+
+	hdr := buffer.NewPrependable(int(e.MaxHeaderLength()) + size)
+	hdr.Prepend(size)[0] = class
+	if err := e.WritePacket(&stack.Route{}, &hdr, buffer.VectorisedView{}, header.IPv4ProtocolNumber); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+}
+
+// checkDequeue checks that the next packet that can be sent is of the given
+// size and class, or, if size is zero, that no packet can be sent before wait.
+func checkDequeue(t *testing.T, e *Endpoint, size int, class byte, wait time.Duration) {
+	t.Helper()
+
+	p, w := e.dequeue()
+	if size == 0 {
+		if p != nil {
+			t.Fatalf("Got a packet of %d bytes, want none", p.size)
+		}
+		if w != wait {
+			t.Fatalf("Got wait %v, want %v", w, wait)
+		}
+		return
+	}
+
+	if p == nil {
+		t.Fatalf("Got no packet, want one of %d bytes after waiting %v", size, w)
+	}
+	if p.size != size || p.hdr.UsedBytes()[0] != class {
+		t.Fatalf("Got a packet of %d bytes of class %d, want %d bytes of class %d", p.size, p.hdr.UsedBytes()[0], size, class)
+	}
+	p.route.Release()
+}
+
+func TestRateLimit(t *testing.T) {
+	e, lower, clock := newTestEndpoint(Class{Rate: 1000, Burst: 1000}, nil)
+
+	// The burst is sent right away, the rest is queued.
+	for i := 0; i < 4; i++ {
+		write(t, e, 500, 0)
+	}
+	if n := lower.Drain(); n != 2 {
+		t.Fatalf("Got %d packets sent right away, want 2", n)
+	}
+	checkDequeue(t, e, 0, 0, 500*time.Millisecond)
+
+	clock.Advance(250 * time.Millisecond)
+	checkDequeue(t, e, 0, 0, 250*time.Millisecond)
+
+	clock.Advance(250 * time.Millisecond)
+	checkDequeue(t, e, 500, 0, 0)
+	checkDequeue(t, e, 0, 0, 500*time.Millisecond)
+
+	clock.Advance(500 * time.Millisecond)
+	checkDequeue(t, e, 500, 0, 0)
+	checkDequeue(t, e, 0, 0, 0)
+
+	// Tokens don't accumulate beyond the burst.
+	clock.Advance(10 * time.Second)
+	for i := 0; i < 3; i++ {
+		write(t, e, 500, 0)
+	}
+	if n := lower.Drain(); n != 2 {
+		t.Fatalf("Got %d packets sent right away after a long pause, want 2", n)
+	}
+	checkDequeue(t, e, 0, 0, 500*time.Millisecond)
+}
+
+func TestClassPriority(t *testing.T) {
+	class := Class{Rate: 1000, Burst: 1000, Limit: 10}
+	e, lower, clock := newTestEndpoint(Class{Rate: 1000, Burst: 1000}, []Class{class, class})
+
+	// Empty the root bucket, then queue a packet of class 1 before one of
+	// class 0.
+	write(t, e, 1000, 1)
+	write(t, e, 500, 1)
+	write(t, e, 500, 0)
+	if n := lower.Drain(); n != 1 {
+		t.Fatalf("Got %d packets sent right away, want 1", n)
+	}
+
+	// Class 0 is served first once the root bucket allows it.
+	clock.Advance(500 * time.Millisecond)
+	checkDequeue(t, e, 500, 0, 0)
+	checkDequeue(t, e, 0, 0, 500*time.Millisecond)
+
+	clock.Advance(500 * time.Millisecond)
+	checkDequeue(t, e, 500, 1, 0)
+
+	// Without a root limit, a class whose own bucket is empty doesn't hold
+	// back the others.
+	e, lower, clock = newTestEndpoint(Class{}, []Class{class, class})
+	write(t, e, 1000, 0)
+	write(t, e, 250, 0)
+	write(t, e, 250, 1)
+	if n := lower.Drain(); n != 2 {
+		t.Fatalf("Got %d packets sent right away, want 2", n)
+	}
+	checkDequeue(t, e, 0, 0, 250*time.Millisecond)
+	clock.Advance(250 * time.Millisecond)
+	checkDequeue(t, e, 250, 0, 0)
+}
+
+func TestQueueLimit(t *testing.T) {
+	e, lower, _ := newTestEndpoint(Class{}, []Class{
+		{Rate: 1000, Burst: 1000, Limit: 2},
+		{Rate: 1000, Burst: 1000, Limit: 1},
+	})
+
+	write(t, e, 1000, 0)
+	for i := 0; i < 5; i++ {
+		write(t, e, 100, 0)
+	}
+	if n := lower.Drain(); n != 1 {
+		t.Fatalf("Got %d packets sent right away, want 1", n)
+	}
+	if got := e.Dropped(0); got != 3 {
+		t.Errorf("Got %d packets of class 0 dropped, want 3", got)
+	}
+
+	// Out of range classes select the last class.
+	write(t, e, 1000, 7)
+	write(t, e, 100, 7)
+	write(t, e, 100, 1)
+	if n := lower.Drain(); n != 1 {
+		t.Fatalf("Got %d packets sent right away, want 1", n)
+	}
+	if got := e.Dropped(1); got != 1 {
+		t.Errorf("Got %d packets of class 1 dropped, want 1", got)
+	}
+	if got := e.Dropped(0); got != 3 {
+		t.Errorf("Got %d packets of class 0 dropped, want still 3", got)
+	}
+	if got := e.Dropped(2); got != 0 {
+		t.Errorf("Got %d packets of an unknown class dropped, want 0", got)
+	}
+}
+
+func TestQueuedPacketsSent(t *testing.T) {
+	clock := faketime.NewManualClock(time.Unix(0, 0))
+	lowerID, lower := channel.New(100, 1500)
+	lower.SetClock(clock)
+	_, e := New(lowerID, Class{Rate: 1000, Burst: 1000}, nil, nil, clock)
+
+	write(t, e, 1000, 0)
+	write(t, e, 500, 0)
+	if n := lower.Drain(); n != 1 {
+		t.Fatalf("Got %d packets sent right away, want 1", n)
+	}
+
+	// The queued packet is sent by the goroutine of the endpoint once the
+	// clock of the endpoint says there are enough tokens, and not before.
+	start := clock.Now()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if p, ok := lower.Read(); ok {
+			if d := p.Timestamp.Sub(start); d < 500*time.Millisecond {
+				t.Fatalf("Queued packet sent after %v, want at least 500ms", d)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the queued packet")
+		}
+		clock.Advance(10 * time.Millisecond)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStackCloseClosesLowerEndpoint(t *testing.T) {
+	clock := faketime.NewManualClock(time.Unix(0, 0))
+	lowerID, lower := channel.NewClosable(100, 1500)
+	id, e := New(lowerID, Class{Rate: 1000, Burst: 1000}, nil, nil, clock)
+
+	s := stack.New(nil, nil).(*stack.Stack)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	// Leave a packet queued, waiting for tokens.
+	write(t, e, 1000, 0)
+	write(t, e, 500, 0)
+	if n := lower.Drain(); n != 1 {
+		t.Fatalf("Got %d packets sent right away, want 1", n)
+	}
+
+	s.Close()
+	s.Wait()
+
+	if !lower.Closed() {
+		t.Errorf("Lower endpoint wasn't closed with the stack")
+	}
+	select {
+	case <-e.done:
+	default:
+		t.Errorf("Goroutine that sends queued packets still running after Close")
+	}
+
+	// The queued packet was dropped, and new ones are rejected.
+	clock.Advance(time.Second)
+	if n := lower.Drain(); n != 0 {
+		t.Errorf("Got %d packets sent after Close, want 0", n)
+	}
+	hdr := buffer.NewPrependable(int(e.MaxHeaderLength()) + 100)
+	hdr.Prepend(100)
+	if err := e.WritePacket(&stack.Route{}, &hdr, buffer.VectorisedView{}, header.IPv4ProtocolNumber); err != tcpip.ErrClosedForSend {
+		t.Errorf("Got WritePacket(...) = %v after Close, want %v", err, tcpip.ErrClosedForSend)
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sniffer
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+const (
+	// linkTypeRaw is the pcap link type for packets that start with an
+	// IPv4 or IPv6 header and have no link-layer header, which is what the
+	// stack hands to link endpoints.
+	linkTypeRaw = 101
+
+	// pcapMagicNano is the magic number of pcap files whose timestamps have
+	// nanosecond resolution.
+	pcapMagicNano = 0xa1b23c4d
+
+	// pcapngByteOrderMagic is written in the section header block of
+	// pcapng files so that readers can detect the byte order.
+	pcapngByteOrderMagic = 0x1a2b3c4d
+
+	// Types of the pcapng blocks written by the sniffer.
+	pcapngSectionHeaderBlock    = 0x0a0d0d0a
+	pcapngInterfaceDescBlock    = 0x00000001
+	pcapngEnhancedPacketBlock   = 0x00000006
+	pcapngOptEndOfOpt           = 0
+	pcapngOptIfName             = 2
+	pcapngOptIfTSResol          = 9
+	pcapngNanosecondsResolution = 9
+)
+
+// captureWriter is implemented by the capture file formats supported by the
+// sniffer.
+type captureWriter interface {
+	// writePacket writes a record containing the packet formed by the
+	// concatenation of b and plb, received or sent at time t.
+	writePacket(t time.Time, b, plb []byte) error
+}
+
+// snapLength returns the number of bytes of a packet of the given length that
+// are written to a capture file with the given snapshot length.
+func snapLength(length int, snapLen uint32) int {
+	if snapLen != 0 && uint32(length) > snapLen {
+		return int(snapLen)
+	}
+	return length
+}
+
+// writeData writes the first n bytes of the concatenation of b and plb to w.
+func writeData(w io.Writer, b, plb []byte, n int) error {
+	if n <= len(b) {
+		_, err := w.Write(b[:n])
+		return err
+	}
+
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+
+	_, err := w.Write(plb[:n-len(b)])
+	return err
+}
+
+// pcapWriter writes packets in the libpcap file format, with nanosecond
+// timestamps.
+type pcapWriter struct {
+	w       io.Writer
+	snapLen uint32
+}
+
+// NewWithPCAP creates a new sniffer link-layer endpoint. It wraps around
+// another endpoint and writes the packets that traverse it to w in the pcap
+// file format. Packets larger than snapLen bytes are truncated; a snapLen of
+// zero means packets are never truncated.
+//
+// The pcap file header is written before NewWithPCAP returns.
+func NewWithPCAP(lower tcpip.LinkEndpointID, w io.Writer, snapLen uint32) (tcpip.LinkEndpointID, error) {
+	c := &pcapWriter{w: w, snapLen: snapLen}
+	if err := c.writeHeader(); err != nil {
+		return 0, err
+	}
+
+	return stack.RegisterLinkEndpoint(&endpoint{
+		lower:   stack.FindLinkEndpoint(lower),
+		capture: c,
+	}), nil
+}
+
+// writeHeader writes the pcap global header.
+func (c *pcapWriter) writeHeader() error {
+	snapLen := c.snapLen
+	if snapLen == 0 {
+		snapLen = 0xffff
+	}
+
+	var hdr [24]byte
+	binary.LittleEndian.PutUint32(hdr[0:], pcapMagicNano)
+	binary.LittleEndian.PutUint16(hdr[4:], 2) // Major version.
+	binary.LittleEndian.PutUint16(hdr[6:], 4) // Minor version.
+	binary.LittleEndian.PutUint32(hdr[16:], snapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], linkTypeRaw)
+
+	_, err := c.w.Write(hdr[:])
+	return err
+}
+
+// writePacket implements captureWriter.writePacket.
+func (c *pcapWriter) writePacket(t time.Time, b, plb []byte) error {
+	length := len(b) + len(plb)
+	n := snapLength(length, c.snapLen)
+
+	var hdr [16]byte
+	binary.LittleEndian.PutUint32(hdr[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(t.Nanosecond()))
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(n))
+	binary.LittleEndian.PutUint32(hdr[12:], uint32(length))
+
+	if _, err := c.w.Write(hdr[:]); err != nil {
+		return err
+	}
+
+	return writeData(c.w, b, plb, n)
+}
+
+// pcapngWriter writes packets in the pcapng file format. All packets are
+// associated with a single interface, described when the file is created.
+type pcapngWriter struct {
+	w       io.Writer
+	snapLen uint32
+}
+
+// NewWithPCAPNG creates a new sniffer link-layer endpoint. It wraps around
+// another endpoint and writes the packets that traverse it to w in the pcapng
+// file format, with nanosecond timestamps. The interface described in the
+// capture file is named ifName. Packets larger than snapLen bytes are
+// truncated; a snapLen of zero means packets are never truncated.
+//
+// The section header and interface description blocks are written before
+// NewWithPCAPNG returns.
+func NewWithPCAPNG(lower tcpip.LinkEndpointID, w io.Writer, snapLen uint32, ifName string) (tcpip.LinkEndpointID, error) {
+	c := &pcapngWriter{w: w, snapLen: snapLen}
+	if err := c.writeHeader(ifName); err != nil {
+		return 0, err
+	}
+
+	return stack.RegisterLinkEndpoint(&endpoint{
+		lower:   stack.FindLinkEndpoint(lower),
+		capture: c,
+	}), nil
+}
+
+// pad4 returns n rounded up to a multiple of 4.
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// appendOption appends a pcapng option with the given code and value to b.
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	var hdr [4]byte
+	binary.LittleEndian.PutUint16(hdr[0:], code)
+	binary.LittleEndian.PutUint16(hdr[2:], uint16(len(value)))
+	b = append(b, hdr[:]...)
+	b = append(b, value...)
+	return append(b, make([]byte, pad4(len(value))-len(value))...)
+}
+
+// writeBlock writes a pcapng block of the given type, whose body is the
+// concatenation of body and the first n bytes of data.
+func (c *pcapngWriter) writeBlock(blockType uint32, body []byte, b, plb []byte, n int) error {
+	total := 12 + len(body) + pad4(n)
+
+	var hdr [8]byte
+	binary.LittleEndian.PutUint32(hdr[0:], blockType)
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(total))
+	if _, err := c.w.Write(hdr[:]); err != nil {
+		return err
+	}
+
+	if _, err := c.w.Write(body); err != nil {
+		return err
+	}
+
+	if n > 0 {
+		if err := writeData(c.w, b, plb, n); err != nil {
+			return err
+		}
+	}
+
+	var trailer [7]byte
+	binary.LittleEndian.PutUint32(trailer[pad4(n)-n:], uint32(total))
+	_, err := c.w.Write(trailer[:pad4(n)-n+4])
+	return err
+}
+
+// writeHeader writes the section header block and the interface description
+// block.
+func (c *pcapngWriter) writeHeader(ifName string) error {
+	var shb [16]byte
+	binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1) // Major version.
+	binary.LittleEndian.PutUint16(shb[6:], 0) // Minor version.
+	binary.LittleEndian.PutUint64(shb[8:], ^uint64(0))
+	if err := c.writeBlock(pcapngSectionHeaderBlock, shb[:], nil, nil, 0); err != nil {
+		return err
+	}
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], linkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[4:], c.snapLen)
+	if ifName != "" {
+		idb = appendOption(idb, pcapngOptIfName, []byte(ifName))
+	}
+	idb = appendOption(idb, pcapngOptIfTSResol, []byte{pcapngNanosecondsResolution})
+	idb = appendOption(idb, pcapngOptEndOfOpt, nil)
+
+	return c.writeBlock(pcapngInterfaceDescBlock, idb, nil, nil, 0)
+}
+
+// writePacket implements captureWriter.writePacket.
+func (c *pcapngWriter) writePacket(t time.Time, b, plb []byte) error {
+	length := len(b) + len(plb)
+	n := snapLength(length, c.snapLen)
+	ts := uint64(t.UnixNano())
+
+	var epb [20]byte
+	binary.LittleEndian.PutUint32(epb[0:], 0) // Interface ID.
+	binary.LittleEndian.PutUint32(epb[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(epb[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(epb[12:], uint32(n))
+	binary.LittleEndian.PutUint32(epb[16:], uint32(length))
+
+	return c.writeBlock(pcapngEnhancedPacketBlock, epb[:], b, plb, n)
+}
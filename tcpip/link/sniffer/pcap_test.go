@@ -0,0 +1,191 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sniffer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+var (
+	// packetTime is the time the test packets are captured at.
+	packetTime = time.Unix(1234, 5678)
+
+	// The test packets are split in a header and a payload, like the ones
+	// written by the stack.
+	packetHdr     = []byte{1, 2, 3, 4, 5}
+	packetPayload = []byte{6, 7, 8, 9, 10}
+)
+
+func TestPCAP(t *testing.T) {
+	for _, test := range []struct {
+		snapLen     uint32
+		wantSnapLen uint32
+		wantData    []byte
+	}{
+		{snapLen: 0, wantSnapLen: 0xffff, wantData: append(append([]byte(nil), packetHdr...), packetPayload...)},
+		{snapLen: 7, wantSnapLen: 7, wantData: []byte{1, 2, 3, 4, 5, 6, 7}},
+		{snapLen: 3, wantSnapLen: 3, wantData: []byte{1, 2, 3}},
+	} {
+		var buf bytes.Buffer
+		c := &pcapWriter{w: &buf, snapLen: test.snapLen}
+		if err := c.writeHeader(); err != nil {
+			t.Fatalf("writeHeader failed: %v", err)
+		}
+		if err := c.writePacket(packetTime, packetHdr, packetPayload); err != nil {
+			t.Fatalf("writePacket failed: %v", err)
+		}
+
+		b := buf.Bytes()
+		if len(b) != 24+16+len(test.wantData) {
+			t.Fatalf("snapLen %d: got %d bytes, want %d", test.snapLen, len(b), 24+16+len(test.wantData))
+		}
+
+		// Global header.
+		le := binary.LittleEndian
+		if got := le.Uint32(b[0:]); got != pcapMagicNano {
+			t.Errorf("snapLen %d: got magic %#x, want %#x", test.snapLen, got, pcapMagicNano)
+		}
+		if major, minor := le.Uint16(b[4:]), le.Uint16(b[6:]); major != 2 || minor != 4 {
+			t.Errorf("snapLen %d: got version %d.%d, want 2.4", test.snapLen, major, minor)
+		}
+		if got := le.Uint32(b[16:]); got != test.wantSnapLen {
+			t.Errorf("snapLen %d: got snaplen %d, want %d", test.snapLen, got, test.wantSnapLen)
+		}
+		if got := le.Uint32(b[20:]); got != linkTypeRaw {
+			t.Errorf("snapLen %d: got link type %d, want %d", test.snapLen, got, linkTypeRaw)
+		}
+
+		// Record.
+		rec := b[24:]
+		if sec, nsec := le.Uint32(rec[0:]), le.Uint32(rec[4:]); sec != 1234 || nsec != 5678 {
+			t.Errorf("snapLen %d: got timestamp %d.%09d, want 1234.000005678", test.snapLen, sec, nsec)
+		}
+		if incl, orig := le.Uint32(rec[8:]), le.Uint32(rec[12:]); incl != uint32(len(test.wantData)) || orig != 10 {
+			t.Errorf("snapLen %d: got lengths %d/%d, want %d/10", test.snapLen, incl, orig, len(test.wantData))
+		}
+		if got := rec[16:]; !bytes.Equal(got, test.wantData) {
+			t.Errorf("snapLen %d: got data %v, want %v", test.snapLen, got, test.wantData)
+		}
+	}
+}
+
+// pcapngBlock is a block read from a pcapng file.
+type pcapngBlock struct {
+	typ  uint32
+	body []byte
+}
+
+// readPCAPNGBlocks splits b into pcapng blocks, checking their lengths.
+func readPCAPNGBlocks(t *testing.T, b []byte) []pcapngBlock {
+	t.Helper()
+
+	var blocks []pcapngBlock
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("truncated block: %v", b)
+		}
+		total := int(binary.LittleEndian.Uint32(b[4:]))
+		if total%4 != 0 || total < 12 || total > len(b) {
+			t.Fatalf("bad block total length %d, with %d bytes left", total, len(b))
+		}
+		if trailer := int(binary.LittleEndian.Uint32(b[total-4:])); trailer != total {
+			t.Fatalf("got trailing block length %d, want %d", trailer, total)
+		}
+		blocks = append(blocks, pcapngBlock{
+			typ:  binary.LittleEndian.Uint32(b),
+			body: b[8 : total-4],
+		})
+		b = b[total:]
+	}
+	return blocks
+}
+
+func TestPCAPNG(t *testing.T) {
+	for _, test := range []struct {
+		snapLen  uint32
+		wantData []byte
+	}{
+		{snapLen: 0, wantData: append(append([]byte(nil), packetHdr...), packetPayload...)},
+		{snapLen: 7, wantData: []byte{1, 2, 3, 4, 5, 6, 7}},
+		{snapLen: 4, wantData: []byte{1, 2, 3, 4}},
+	} {
+		var buf bytes.Buffer
+		c := &pcapngWriter{w: &buf, snapLen: test.snapLen}
+		if err := c.writeHeader("eth0"); err != nil {
+			t.Fatalf("writeHeader failed: %v", err)
+		}
+		if err := c.writePacket(packetTime, packetHdr, packetPayload); err != nil {
+			t.Fatalf("writePacket failed: %v", err)
+		}
+
+		blocks := readPCAPNGBlocks(t, buf.Bytes())
+		if len(blocks) != 3 {
+			t.Fatalf("snapLen %d: got %d blocks, want 3", test.snapLen, len(blocks))
+		}
+		le := binary.LittleEndian
+
+		// Section header block.
+		shb := blocks[0]
+		if shb.typ != pcapngSectionHeaderBlock || len(shb.body) != 16 {
+			t.Fatalf("snapLen %d: got block %#x with %d bytes, want a section header block with 16 bytes", test.snapLen, shb.typ, len(shb.body))
+		}
+		if got := le.Uint32(shb.body[0:]); got != pcapngByteOrderMagic {
+			t.Errorf("snapLen %d: got byte order magic %#x, want %#x", test.snapLen, got, pcapngByteOrderMagic)
+		}
+		if major, minor := le.Uint16(shb.body[4:]), le.Uint16(shb.body[6:]); major != 1 || minor != 0 {
+			t.Errorf("snapLen %d: got version %d.%d, want 1.0", test.snapLen, major, minor)
+		}
+
+		// Interface description block, with the if_name and
+		// if_tsresol options, each padded to 4 bytes.
+		idb := blocks[1]
+		if idb.typ != pcapngInterfaceDescBlock {
+			t.Fatalf("snapLen %d: got block %#x, want an interface description block", test.snapLen, idb.typ)
+		}
+		if got := le.Uint16(idb.body[0:]); got != linkTypeRaw {
+			t.Errorf("snapLen %d: got link type %d, want %d", test.snapLen, got, linkTypeRaw)
+		}
+		if got := le.Uint32(idb.body[4:]); got != test.snapLen {
+			t.Errorf("snapLen %d: got snaplen %d, want %d", test.snapLen, got, test.snapLen)
+		}
+		wantOpts := []byte{
+			pcapngOptIfName, 0, 4, 0, 'e', 't', 'h', '0',
+			pcapngOptIfTSResol, 0, 1, 0, pcapngNanosecondsResolution, 0, 0, 0,
+			pcapngOptEndOfOpt, 0, 0, 0,
+		}
+		if got := idb.body[8:]; !bytes.Equal(got, wantOpts) {
+			t.Errorf("snapLen %d: got options %v, want %v", test.snapLen, got, wantOpts)
+		}
+
+		// Enhanced packet block, whose data is padded to 4 bytes.
+		epb := blocks[2]
+		if epb.typ != pcapngEnhancedPacketBlock {
+			t.Fatalf("snapLen %d: got block %#x, want an enhanced packet block", test.snapLen, epb.typ)
+		}
+		ts := uint64(le.Uint32(epb.body[4:]))<<32 | uint64(le.Uint32(epb.body[8:]))
+		if want := uint64(packetTime.UnixNano()); ts != want {
+			t.Errorf("snapLen %d: got timestamp %d, want %d", test.snapLen, ts, want)
+		}
+		if capLen, origLen := le.Uint32(epb.body[12:]), le.Uint32(epb.body[16:]); capLen != uint32(len(test.wantData)) || origLen != 10 {
+			t.Errorf("snapLen %d: got lengths %d/%d, want %d/10", test.snapLen, capLen, origLen, len(test.wantData))
+		}
+		data := epb.body[20:]
+		if len(data) != pad4(len(test.wantData)) {
+			t.Fatalf("snapLen %d: got %d bytes of padded data, want %d", test.snapLen, len(data), pad4(len(test.wantData)))
+		}
+		if got := data[:len(test.wantData)]; !bytes.Equal(got, test.wantData) {
+			t.Errorf("snapLen %d: got data %v, want %v", test.snapLen, got, test.wantData)
+		}
+		for _, c := range data[len(test.wantData):] {
+			if c != 0 {
+				t.Errorf("snapLen %d: got padding %v, want zeros", test.snapLen, data[len(test.wantData):])
+				break
+			}
+		}
+	}
+}
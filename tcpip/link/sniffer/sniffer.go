@@ -8,21 +8,44 @@
 // Sniffer endpoints can be used in the networking stack by calling New(eID) to
 // create a new endpoint, where eID is the ID of the endpoint being wrapped,
 // and then passing it as an argument to Stack.CreateNIC().
+//
+// Alternatively, NewWithPCAP() and NewWithPCAPNG() create endpoints that write
+// the packets to an io.Writer in the pcap or pcapng file formats, which can be
+// read by tools such as Wireshark and tcpdump.
+//
+// SetFilter() can be used to restrict the packets that are logged or captured
+// to the ones accepted by a classic BPF program.
 package sniffer
 
 import (
 	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/filter"
 	"github.com/google/netstack/tcpip/stack"
 )
 
 type endpoint struct {
 	dispatcher stack.NetworkDispatcher
 	lower      stack.LinkEndpoint
+
+	// capture is the capture file packets are written to. If it is nil,
+	// packets are logged instead. It is set when the endpoint is created.
+	capture captureWriter
+
+	// captureMu is held while writing packets to the capture file so that
+	// records from concurrent senders and the dispatcher don't interleave.
+	captureMu sync.Mutex
+
+	// filterMu protects filter, which, if not nil, selects the packets
+	// that are logged or captured.
+	filterMu sync.RWMutex
+	filter   *filter.Program
 }
 
 // New creates a new sniffer link-layer endpoint. It wraps around another
@@ -37,10 +60,16 @@ func New(lower tcpip.LinkEndpointID) tcpip.LinkEndpointID {
 // called by the link-layer endpoint being wrapped when a packet arrives, and
 // logs the packet before forwarding to the actual dispatcher.
 func (e *endpoint) DeliverNetworkPacket(linkEP stack.LinkEndpoint, protocol tcpip.NetworkProtocolNumber, v buffer.View) {
-	logPacket("recv", protocol, v, nil)
+	e.dumpPacket("recv", protocol, v, nil)
 	e.dispatcher.DeliverNetworkPacket(e, protocol, v)
 }
 
+// LinkStateChanged implements the stack.NetworkDispatcher interface. It just
+// forwards the notification to the actual dispatcher.
+func (e *endpoint) LinkStateChanged(linkEP stack.LinkEndpoint, up bool) {
+	e.dispatcher.LinkStateChanged(e, up)
+}
+
 // Attach implements the stack.LinkEndpoint interface. It saves the dispatcher
 // and registers with the lower endpoint as its dispatcher so that "e" is called
 // for inbound packets.
@@ -61,14 +90,68 @@ func (e *endpoint) MaxHeaderLength() uint16 {
 	return e.lower.MaxHeaderLength()
 }
 
+// Capabilities implements stack.LinkEndpoint.Capabilities. It just forwards the
+// request to the lower endpoint.
+func (e *endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return e.lower.Capabilities()
+}
+
+// Close implements stack.ClosableLinkEndpoint.Close. It just forwards the
+// request to the lower endpoint, if it can be closed.
+func (e *endpoint) Close() {
+	if cep, ok := e.lower.(stack.ClosableLinkEndpoint); ok {
+		cep.Close()
+	}
+}
+
 // WritePacket implements the stack.LinkEndpoint interface. It is called by
 // higher-level protocols to write packets; it just logs the packet and forwards
 // the request to the lower endpoint.
-func (e *endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) error {
-	logPacket("send", protocol, hdr.UsedBytes(), payload)
+func (e *endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) error {
+	e.dumpPacket("send", protocol, hdr.UsedBytes(), payload.ToView())
 	return e.lower.WritePacket(r, hdr, payload, protocol)
 }
 
+// SetFilter sets the program used by the sniffer endpoint with the given ID to
+// select which packets are logged or captured; packets rejected by the program
+// still traverse the endpoint. A nil program selects all packets.
+func SetFilter(id tcpip.LinkEndpointID, p *filter.Program) error {
+	e, ok := stack.FindLinkEndpoint(id).(*endpoint)
+	if !ok {
+		return tcpip.ErrBadLinkEndpoint
+	}
+
+	e.filterMu.Lock()
+	e.filter = p
+	e.filterMu.Unlock()
+
+	return nil
+}
+
+// dumpPacket either logs the given packet or writes it to the capture file if
+// one was configured. Packets not selected by the filter are ignored.
+func (e *endpoint) dumpPacket(prefix string, protocol tcpip.NetworkProtocolNumber, b, plb []byte) {
+	e.filterMu.RLock()
+	p := e.filter
+	e.filterMu.RUnlock()
+	if p != nil && p.Run(b, plb) == 0 {
+		return
+	}
+
+	if e.capture == nil {
+		logPacket(prefix, protocol, b, plb)
+		return
+	}
+
+	e.captureMu.Lock()
+	err := e.capture.writePacket(time.Now(), b, plb)
+	e.captureMu.Unlock()
+
+	if err != nil {
+		log.Printf("%s failed to write packet to capture file: %v", prefix, err)
+	}
+}
+
 // logPacket logs the given packet.
 func logPacket(prefix string, protocol tcpip.NetworkProtocolNumber, b, plb []byte) {
 	// Figure out the network layer info.
@@ -0,0 +1,471 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tunnel provides the parts of the implementation of the virtual NICs
+// that tunnel ethernet frames to remote tunnel endpoints (VTEPs) over UDP that
+// are common to the encapsulations, e.g., VXLAN and Geneve; see the vxlan and
+// geneve packages.
+//
+// An endpoint binds a UDP endpoint of the stack the encapsulated frames are
+// sent and received through to the local address and port of its
+// configuration. It can be passed as an argument to Stack.CreateNIC(), possibly
+// of another stack.
+//
+// Netstack has no Ethernet layer nor ARP, so the endpoint adds and strips the
+// ethernet headers itself. The link address of the destination of outbound
+// packets is looked up in its neighbor table, which holds the entries added
+// with AddNeighbor() and, if learning is enabled, the source addresses of the
+// inbound packets. Frames are then sent to the VTEP their destination lives
+// behind, per the forwarding database, which holds the entries added with
+// AddFDBEntry() and, if learning is enabled, the VTEPs inbound frames come
+// from. Broadcast and multicast frames, and frames to unknown destinations,
+// are flooded to the remote VTEPs of the configuration.
+package tunnel
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/waiter"
+)
+
+// DefaultAgeingTime is the default amount of time after which learned entries
+// are forgotten if no frames are received from them.
+const DefaultAgeingTime = 5 * time.Minute
+
+// broadcastAddress is the ethernet broadcast address.
+const broadcastAddress = tcpip.LinkAddress("\xff\xff\xff\xff\xff\xff")
+
+// Errors returned when creating endpoints, adding entries to their tables, and
+// writing packets.
+var (
+	ErrBadLinkAddress = errors.New("tunnel: invalid link address")
+	ErrNoLinkAddress  = errors.New("tunnel: unknown link address")
+)
+
+// Encapsulation adds and strips the headers of a tunnel protocol, which
+// precede the ethernet header of the frames.
+type Encapsulation interface {
+	// HeaderLength returns the length of the headers Encapsulate adds.
+	HeaderLength() int
+
+	// Encapsulate prepends the headers to the ethernet frame in hdr.
+	Encapsulate(hdr *buffer.Prependable)
+
+	// Decapsulate returns the length of the headers of the received frame
+	// v, or false if it must be dropped, e.g., because it belongs to
+	// another overlay network.
+	Decapsulate(v buffer.View) (int, bool)
+}
+
+// Config describes a tunnel endpoint.
+type Config struct {
+	// LocalAddress is the address of the underlay stack that frames are
+	// sent from and received on. Its length selects IPv4 or IPv6.
+	LocalAddress tcpip.Address
+
+	// NIC is the NIC of the underlay stack that frames are sent and
+	// received through, or zero for any.
+	NIC tcpip.NICID
+
+	// Port is the UDP port that frames are sent from and to, and received
+	// on.
+	Port uint16
+
+	// LinkAddress is the ethernet address of the endpoint.
+	LinkAddress tcpip.LinkAddress
+
+	// MTU is the MTU of the endpoint.
+	MTU uint32
+
+	// Remotes are the addresses of the remote VTEPs that broadcast and
+	// multicast frames, and frames to unknown destinations, are flooded
+	// to.
+	Remotes []tcpip.Address
+
+	// Learning enables the learning of the forwarding database and the
+	// neighbor table from inbound frames.
+	Learning bool
+
+	// AgeingTime is the amount of time after which learned entries are
+	// forgotten if no frames are received from them, or zero for
+	// DefaultAgeingTime.
+	AgeingTime time.Duration
+}
+
+// entry is an entry of the forwarding database, or of the neighbor table.
+type entry struct {
+	// vtep is the address of the remote VTEP of a forwarding database
+	// entry, and linkAddr the link address of a neighbor table entry.
+	vtep     tcpip.Address
+	linkAddr tcpip.LinkAddress
+
+	// static is set for the entries that were added explicitly, which
+	// never expire.
+	static   bool
+	lastSeen time.Time
+}
+
+// Endpoint is a tunnel link-layer endpoint.
+type Endpoint struct {
+	cfg        Config
+	encap      Encapsulation
+	dispatcher stack.NetworkDispatcher
+
+	// clock is the clock of the underlay stack, which times the learned
+	// entries out.
+	clock tcpip.Clock
+
+	// ep is the UDP endpoint of the underlay stack, and wq its waiter
+	// queue.
+	ep tcpip.Endpoint
+	wq waiter.Queue
+
+	// stop is closed by Close to stop the dispatch loop, which closes
+	// done when it exits.
+	stop chan struct{}
+	done chan struct{}
+
+	// mu protects the fields below.
+	mu        sync.RWMutex
+	attached  bool
+	closed    bool
+	fdb       map[tcpip.LinkAddress]entry
+	neighbors map[tcpip.Address]entry
+}
+
+// New creates a new tunnel link-layer endpoint, which sends and receives the
+// frames encapsulated by encap through the stack s.
+func New(s *stack.Stack, cfg Config, encap Encapsulation) (tcpip.LinkEndpointID, *Endpoint, error) {
+	if len(cfg.LinkAddress) != header.EthernetAddressSize || header.IsMulticastEthernetAddress(cfg.LinkAddress) {
+		return 0, nil, ErrBadLinkAddress
+	}
+	if cfg.AgeingTime == 0 {
+		cfg.AgeingTime = DefaultAgeingTime
+	}
+	cfg.Remotes = append([]tcpip.Address(nil), cfg.Remotes...)
+
+	e := &Endpoint{
+		cfg:       cfg,
+		encap:     encap,
+		clock:     s.Clock(),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		fdb:       make(map[tcpip.LinkAddress]entry),
+		neighbors: make(map[tcpip.Address]entry),
+	}
+
+	netProto := header.IPv4ProtocolNumber
+	if len(cfg.LocalAddress) == header.IPv6AddressSize {
+		netProto = header.IPv6ProtocolNumber
+	}
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, netProto, &e.wq)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := ep.Bind(tcpip.FullAddress{NIC: cfg.NIC, Addr: cfg.LocalAddress, Port: cfg.Port}, nil); err != nil {
+		ep.Close()
+		return 0, nil, err
+	}
+	e.ep = ep
+
+	return stack.RegisterLinkEndpoint(e), e, nil
+}
+
+// AddFDBEntry adds a static entry to the forwarding database, so that the
+// frames to linkAddr are sent to the remote VTEP vtep. It replaces any entry
+// of linkAddr.
+func (e *Endpoint) AddFDBEntry(linkAddr tcpip.LinkAddress, vtep tcpip.Address) error {
+	if len(linkAddr) != header.EthernetAddressSize || header.IsMulticastEthernetAddress(linkAddr) {
+		return ErrBadLinkAddress
+	}
+
+	e.mu.Lock()
+	e.fdb[linkAddr] = entry{vtep: vtep, static: true}
+	e.mu.Unlock()
+	return nil
+}
+
+// RemoveFDBEntry removes the entry of linkAddr from the forwarding database,
+// whether it was added or learned.
+func (e *Endpoint) RemoveFDBEntry(linkAddr tcpip.LinkAddress) {
+	e.mu.Lock()
+	delete(e.fdb, linkAddr)
+	e.mu.Unlock()
+}
+
+// AddNeighbor adds a static entry to the neighbor table, so that the packets
+// to addr are sent in frames to linkAddr. It replaces any entry of addr.
+func (e *Endpoint) AddNeighbor(addr tcpip.Address, linkAddr tcpip.LinkAddress) error {
+	if len(linkAddr) != header.EthernetAddressSize {
+		return ErrBadLinkAddress
+	}
+
+	e.mu.Lock()
+	e.neighbors[addr] = entry{linkAddr: linkAddr, static: true}
+	e.mu.Unlock()
+	return nil
+}
+
+// RemoveNeighbor removes the entry of addr from the neighbor table, whether it
+// was added or learned.
+func (e *Endpoint) RemoveNeighbor(addr tcpip.Address) {
+	e.mu.Lock()
+	delete(e.neighbors, addr)
+	e.mu.Unlock()
+}
+
+// Attach implements stack.LinkEndpoint.Attach. It launches the goroutine that
+// reads frames from the UDP endpoint and dispatches their packets via the
+// provided dispatcher.
+func (e *Endpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return
+	}
+	e.dispatcher = dispatcher
+	e.attached = true
+
+	go func() {
+		defer close(e.done)
+		e.dispatchLoop()
+	}()
+}
+
+// Close implements stack.ClosableLinkEndpoint.Close. It stops the dispatch loop
+// and waits for it to exit, and closes the UDP endpoint.
+func (e *Endpoint) Close() {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+	e.closed = true
+	attached := e.attached
+	e.mu.Unlock()
+
+	close(e.stop)
+	if attached {
+		<-e.done
+	}
+	e.ep.Close()
+}
+
+// MTU implements stack.LinkEndpoint.MTU. It returns the value of the
+// configuration.
+func (e *Endpoint) MTU() uint32 {
+	return e.cfg.MTU
+}
+
+// MaxHeaderLength implements stack.LinkEndpoint.MaxHeaderLength. It returns the
+// size of the ethernet and tunnel headers; the UDP endpoint allocates its own
+// headers.
+func (e *Endpoint) MaxHeaderLength() uint16 {
+	return uint16(e.encap.HeaderLength() + header.EthernetMinimumSize)
+}
+
+// Capabilities implements stack.LinkEndpoint.Capabilities. Frames go through
+// the underlay network, so checksums are always computed and verified in
+// software.
+func (*Endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return 0
+}
+
+// LinkAddress implements stack.LinkAddresser.LinkAddress. It returns the
+// ethernet address of the configuration.
+func (e *Endpoint) LinkAddress() tcpip.LinkAddress {
+	return e.cfg.LinkAddress
+}
+
+// WritePacket implements stack.LinkEndpoint.WritePacket. It encapsulates the
+// packet in an ethernet frame to the link address of its next hop, and sends
+// it to the remote VTEP the address lives behind, or floods it.
+func (e *Endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) error {
+	addr := r.NextHop
+	if addr == "" {
+		addr = r.RemoteAddress
+	}
+	dst, ok := e.resolve(addr)
+	if !ok {
+		return ErrNoLinkAddress
+	}
+
+	header.Ethernet(hdr.Prepend(header.EthernetMinimumSize)).Encode(&header.EthernetFields{
+		SrcAddr: e.cfg.LinkAddress,
+		DstAddr: dst,
+		Type:    protocol,
+	})
+	e.encap.Encapsulate(hdr)
+
+	frame := make(buffer.View, 0, hdr.UsedLength()+payload.Size())
+	frame = append(frame, hdr.View()...)
+	for _, v := range payload.Views() {
+		frame = append(frame, v...)
+	}
+
+	var vteps []tcpip.Address
+	if vtep, ok := e.lookupFDB(dst); ok {
+		vteps = []tcpip.Address{vtep}
+	} else {
+		vteps = e.cfg.Remotes
+	}
+
+	var err error
+	for _, vtep := range vteps {
+		if _, werr := e.ep.Write(frame, &tcpip.FullAddress{NIC: e.cfg.NIC, Addr: vtep, Port: e.cfg.Port}); werr != nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// resolve returns the link address of the neighbor addr: the address mapped
+// from multicast and broadcast addresses, or the one of the neighbor table.
+func (e *Endpoint) resolve(addr tcpip.Address) (tcpip.LinkAddress, bool) {
+	switch {
+	case header.IsV4MulticastAddress(addr):
+		return tcpip.LinkAddress([]byte{0x01, 0x00, 0x5e, addr[1] & 0x7f, addr[2], addr[3]}), true
+
+	case header.IsV6MulticastAddress(addr):
+		return tcpip.LinkAddress([]byte{0x33, 0x33, addr[12], addr[13], addr[14], addr[15]}), true
+
+	case addr == "\xff\xff\xff\xff":
+		return broadcastAddress, true
+	}
+
+	e.mu.RLock()
+	n, ok := e.neighbors[addr]
+	e.mu.RUnlock()
+	if !ok || !n.static && e.clock.Now().Sub(n.lastSeen) > e.cfg.AgeingTime {
+		return "", false
+	}
+	return n.linkAddr, true
+}
+
+// lookupFDB returns the remote VTEP the unicast address linkAddr lives behind,
+// if it's known.
+func (e *Endpoint) lookupFDB(linkAddr tcpip.LinkAddress) (tcpip.Address, bool) {
+	if header.IsMulticastEthernetAddress(linkAddr) {
+		return "", false
+	}
+
+	e.mu.RLock()
+	f, ok := e.fdb[linkAddr]
+	e.mu.RUnlock()
+	if !ok || !f.static && e.clock.Now().Sub(f.lastSeen) > e.cfg.AgeingTime {
+		return "", false
+	}
+	return f.vtep, true
+}
+
+// dispatchLoop reads frames from the UDP endpoint and dispatches them until
+// the endpoint is closed.
+func (e *Endpoint) dispatchLoop() {
+	we, ch := waiter.NewChannelEntry(nil)
+	e.wq.EventRegister(&we, waiter.EventIn)
+	defer e.wq.EventUnregister(&we)
+
+	for {
+		var from tcpip.FullAddress
+		v, err := e.ep.Read(&from)
+		if err == tcpip.ErrWouldBlock {
+			select {
+			case <-ch:
+				continue
+			case <-e.stop:
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+
+		e.deliverFrame(from.Addr, v)
+	}
+}
+
+// deliverFrame decapsulates the frame v received from the remote VTEP vtep, and
+// delivers its packet if it's addressed to the endpoint.
+func (e *Endpoint) deliverFrame(vtep tcpip.Address, v buffer.View) {
+	n, ok := e.encap.Decapsulate(v)
+	if !ok || len(v) < n+header.EthernetMinimumSize {
+		return
+	}
+	v.TrimFront(n)
+
+	eth := header.Ethernet(v)
+	src := eth.SourceAddress()
+	dst := eth.DestinationAddress()
+	protocol := eth.Type()
+	if dst != e.cfg.LinkAddress && !header.IsMulticastEthernetAddress(dst) {
+		return
+	}
+	v.TrimFront(header.EthernetMinimumSize)
+
+	if e.cfg.Learning && !header.IsMulticastEthernetAddress(src) {
+		e.learn(vtep, src, protocol, v)
+	}
+
+	e.dispatcher.DeliverNetworkPacket(e, protocol, v)
+}
+
+// learn records that the link address src lives behind the remote VTEP vtep,
+// and, if the packet v is an IP packet, that its source address is src.
+// Entries are refreshed at most once a second to avoid taking the write lock
+// for every frame, and addresses are copied so that they don't alias the
+// frame.
+func (e *Endpoint) learn(vtep tcpip.Address, src tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, v buffer.View) {
+	var addr tcpip.Address
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		if len(v) >= header.IPv4MinimumSize {
+			addr = header.IPv4(v).SourceAddress()
+		}
+	case header.IPv6ProtocolNumber:
+		if len(v) >= header.IPv6MinimumSize {
+			addr = header.IPv6(v).SourceAddress()
+		}
+	}
+	if addr == "\x00\x00\x00\x00" || addr == header.IPv6Any {
+		addr = ""
+	}
+
+	now := e.clock.Now()
+	fresh := func(m entry, ok bool) bool {
+		return ok && (m.static || now.Sub(m.lastSeen) <= time.Second)
+	}
+
+	e.mu.RLock()
+	f, fok := e.fdb[src]
+	n, nok := e.neighbors[addr]
+	e.mu.RUnlock()
+
+	fdbFresh := fresh(f, fok) && (f.static || f.vtep == vtep)
+	neighborFresh := addr == "" || fresh(n, nok) && (n.static || n.linkAddr == src)
+	if fdbFresh && neighborFresh {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	src = tcpip.LinkAddress([]byte(src))
+	if f, ok := e.fdb[src]; !ok || !f.static {
+		e.fdb[src] = entry{vtep: tcpip.Address([]byte(vtep)), lastSeen: now}
+	}
+	if addr != "" {
+		addr = tcpip.Address([]byte(addr))
+		if n, ok := e.neighbors[addr]; !ok || !n.static {
+			e.neighbors[addr] = entry{linkAddr: src, lastSeen: now}
+		}
+	}
+}
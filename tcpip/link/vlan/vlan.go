@@ -0,0 +1,224 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package vlan provides the implementation of 802.1Q VLAN sub-interfaces,
+// which allow one link-layer endpoint to back multiple tagged NICs.
+//
+// A Mux is created by calling NewMux(eID), where eID is the ID of the endpoint
+// carrying the tagged traffic. Sub-interfaces are then created by calling
+// Mux.New(vid, priority), and the returned IDs are passed as arguments to
+// Stack.CreateNIC(). Sub-interface 0 is special: it sends and receives
+// untagged packets.
+//
+// Netstack has no Ethernet layer, so the 802.1Q tag is carried in the
+// protocol number and the packet itself: the lower endpoint must deliver
+// tagged packets with protocol header.VLANProtocolNumber and the 4-byte tag
+// (the tag control information followed by the encapsulated EtherType) at the
+// start of the packet. Outbound packets are written in the same form.
+//
+// Sub-interfaces implement stack.ClosableLinkEndpoint. Closing one detaches it
+// from the mux, which frees its VLAN ID; the lower endpoint is closed, if it can
+// be, when the last sub-interface is.
+package vlan
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// Errors returned when creating sub-interfaces.
+var (
+	ErrBadID       = errors.New("vlan: invalid vlan id")
+	ErrDuplicateID = errors.New("vlan: duplicate vlan id")
+)
+
+// Mux demultiplexes the packets received by a link-layer endpoint to the
+// sub-interfaces created on it, according to their VLAN tags.
+type Mux struct {
+	lower      stack.LinkEndpoint
+	attachOnce sync.Once
+
+	mu   sync.RWMutex
+	subs map[uint16]*endpoint
+}
+
+// NewMux creates a new VLAN multiplexer on top of the given link-layer
+// endpoint. The lower endpoint is attached when the first sub-interface is
+// attached to a NIC.
+func NewMux(lower tcpip.LinkEndpointID) *Mux {
+	return &Mux{
+		lower: stack.FindLinkEndpoint(lower),
+		subs:  make(map[uint16]*endpoint),
+	}
+}
+
+// New creates a new sub-interface for the given VLAN ID. Outbound packets are
+// tagged with vid and priority, and only inbound packets tagged with vid are
+// delivered to it. A vid of 0 creates the untagged sub-interface.
+func (m *Mux) New(vid uint16, priority uint8) (tcpip.LinkEndpointID, error) {
+	if vid > header.VLANMaxID || priority > 7 {
+		return 0, ErrBadID
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.subs[vid]; ok {
+		return 0, ErrDuplicateID
+	}
+
+	e := &endpoint{
+		mux:      m,
+		vid:      vid,
+		priority: priority,
+	}
+	m.subs[vid] = e
+
+	return stack.RegisterLinkEndpoint(e), nil
+}
+
+// DeliverNetworkPacket implements the stack.NetworkDispatcher interface. It is
+// called by the lower endpoint when a packet arrives; it strips the VLAN tag,
+// if there is one, and delivers the packet to the matching sub-interface.
+// Packets for unknown VLANs are dropped.
+func (m *Mux) DeliverNetworkPacket(linkEP stack.LinkEndpoint, protocol tcpip.NetworkProtocolNumber, v buffer.View) {
+	vid := uint16(0)
+	if protocol == header.VLANProtocolNumber {
+		if len(v) < header.VLANSize {
+			return
+		}
+
+		tag := header.VLAN(v)
+		vid = tag.ID()
+		protocol = tag.EtherType()
+		v.TrimFront(header.VLANSize)
+	}
+
+	var d stack.NetworkDispatcher
+	m.mu.RLock()
+	e := m.subs[vid]
+	if e != nil {
+		d = e.dispatcher
+	}
+	m.mu.RUnlock()
+
+	if d == nil {
+		return
+	}
+
+	d.DeliverNetworkPacket(e, protocol, v)
+}
+
+// LinkStateChanged implements the stack.NetworkDispatcher interface. It forwards
+// the notification to all sub-interfaces, since they share the lower endpoint.
+func (m *Mux) LinkStateChanged(linkEP stack.LinkEndpoint, up bool) {
+	m.mu.RLock()
+	subs := make([]*endpoint, 0, len(m.subs))
+	for _, e := range m.subs {
+		if e.dispatcher != nil {
+			subs = append(subs, e)
+		}
+	}
+	m.mu.RUnlock()
+
+	for _, e := range subs {
+		e.dispatcher.LinkStateChanged(e, up)
+	}
+}
+
+// endpoint is a VLAN sub-interface.
+type endpoint struct {
+	mux        *Mux
+	dispatcher stack.NetworkDispatcher
+	vid        uint16
+	priority   uint8
+}
+
+// Attach implements the stack.LinkEndpoint interface. It saves the dispatcher
+// and makes sure the mux is registered with the lower endpoint as its
+// dispatcher.
+func (e *endpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.mux.mu.Lock()
+	e.dispatcher = dispatcher
+	e.mux.mu.Unlock()
+
+	e.mux.attachOnce.Do(func() {
+		e.mux.lower.Attach(e.mux)
+	})
+}
+
+// MTU implements stack.LinkEndpoint.MTU. It returns the MTU of the lower
+// endpoint, minus the size of the tag for tagged sub-interfaces.
+func (e *endpoint) MTU() uint32 {
+	mtu := e.mux.lower.MTU()
+	if e.vid == 0 {
+		return mtu
+	}
+	if mtu < header.VLANSize {
+		return 0
+	}
+	return mtu - header.VLANSize
+}
+
+// Close implements stack.ClosableLinkEndpoint.Close. It detaches the
+// sub-interface from the mux, so that no more packets are delivered to it, and
+// closes the lower endpoint, if it can be closed, once no sub-interfaces are
+// left.
+func (e *endpoint) Close() {
+	m := e.mux
+	m.mu.Lock()
+	if m.subs[e.vid] != e {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.subs, e.vid)
+	last := len(m.subs) == 0
+	m.mu.Unlock()
+
+	if !last {
+		return
+	}
+	if cep, ok := m.lower.(stack.ClosableLinkEndpoint); ok {
+		cep.Close()
+	}
+}
+
+// MaxHeaderLength implements the stack.LinkEndpoint interface. It returns the
+// maximum header length of the lower endpoint, plus the size of the tag for
+// tagged sub-interfaces.
+func (e *endpoint) MaxHeaderLength() uint16 {
+	n := e.mux.lower.MaxHeaderLength()
+	if e.vid == 0 {
+		return n
+	}
+	return n + header.VLANSize
+}
+
+// Capabilities implements stack.LinkEndpoint.Capabilities. It just forwards the
+// request to the lower endpoint.
+func (e *endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return e.mux.lower.Capabilities()
+}
+
+// WritePacket implements the stack.LinkEndpoint interface. It inserts the VLAN
+// tag of the sub-interface, if it has one, and writes the packet to the lower
+// endpoint.
+func (e *endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) error {
+	if e.vid == 0 {
+		return e.mux.lower.WritePacket(r, hdr, payload, protocol)
+	}
+
+	header.VLAN(hdr.Prepend(header.VLANSize)).Encode(&header.VLANFields{
+		Priority:  e.priority,
+		ID:        e.vid,
+		EtherType: protocol,
+	})
+
+	return e.mux.lower.WritePacket(r, hdr, payload, header.VLANProtocolNumber)
+}
@@ -0,0 +1,239 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vlan_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/link/vlan"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// packet is a packet delivered to a sub-interface.
+type packet struct {
+	linkEP   stack.LinkEndpoint
+	protocol tcpip.NetworkProtocolNumber
+	data     buffer.View
+}
+
+// recordingDispatcher is a network dispatcher that records the packets
+// delivered to it.
+type recordingDispatcher struct {
+	packets []packet
+}
+
+func (d *recordingDispatcher) DeliverNetworkPacket(linkEP stack.LinkEndpoint, protocol tcpip.NetworkProtocolNumber, v buffer.View) {
+	d.packets = append(d.packets, packet{linkEP, protocol, append(buffer.View(nil), v...)})
+}
+
+func (*recordingDispatcher) LinkStateChanged(stack.LinkEndpoint, bool) {}
+
+// newSub creates a sub-interface of m and attaches a recording dispatcher to
+// it.
+func newSub(t *testing.T, m *vlan.Mux, vid uint16, priority uint8) (stack.LinkEndpoint, *recordingDispatcher) {
+	t.Helper()
+
+	id, err := m.New(vid, priority)
+	if err != nil {
+		t.Fatalf("New(%d, %d) failed: %v", vid, priority, err)
+	}
+	ep := stack.FindLinkEndpoint(id)
+	d := &recordingDispatcher{}
+	ep.Attach(d)
+	return ep, d
+}
+
+func TestNewErrors(t *testing.T) {
+	lowerID, _ := channel.New(1, 1500)
+	m := vlan.NewMux(lowerID)
+
+	if _, err := m.New(header.VLANMaxID+1, 0); err != vlan.ErrBadID {
+		t.Errorf("Got New with a reserved id = %v, want %v", err, vlan.ErrBadID)
+	}
+	if _, err := m.New(10, 8); err != vlan.ErrBadID {
+		t.Errorf("Got New with priority 8 = %v, want %v", err, vlan.ErrBadID)
+	}
+	if _, err := m.New(10, 0); err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if _, err := m.New(10, 3); err != vlan.ErrDuplicateID {
+		t.Errorf("Got New with a duplicate id = %v, want %v", err, vlan.ErrDuplicateID)
+	}
+}
+
+func TestWriteTagged(t *testing.T) {
+	lowerID, lower := channel.New(1, 1500)
+	m := vlan.NewMux(lowerID)
+	ep, _ := newSub(t, m, 100, 5)
+
+	payload := buffer.View("payload")
+	hdr := buffer.NewPrependable(int(ep.MaxHeaderLength()) + 2)
+	copy(hdr.Prepend(2), "ip")
+	if err := ep.WritePacket(&stack.Route{}, &hdr, payload.ToVectorisedView(), header.IPv4ProtocolNumber); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+
+	p, ok := lower.Read()
+	if !ok {
+		t.Fatalf("No packet written to the lower endpoint")
+	}
+	if p.Proto != header.VLANProtocolNumber {
+		t.Errorf("Got protocol %#x, want %#x", p.Proto, header.VLANProtocolNumber)
+	}
+	if len(p.Header) != header.VLANSize+2 {
+		t.Fatalf("Got header of %d bytes, want %d", len(p.Header), header.VLANSize+2)
+	}
+	tag := header.VLAN(p.Header)
+	if tag.ID() != 100 || tag.Priority() != 5 || tag.DropEligible() || tag.EtherType() != header.IPv4ProtocolNumber {
+		t.Errorf("Got tag with id %d, priority %d, drop eligible %t and type %#x, want 100, 5, false and %#x", tag.ID(), tag.Priority(), tag.DropEligible(), tag.EtherType(), header.IPv4ProtocolNumber)
+	}
+	if got := p.Header[header.VLANSize:]; string(got) != "ip" {
+		t.Errorf("Got network header %q, want %q", got, "ip")
+	}
+	if !bytes.Equal(p.Payload, payload) {
+		t.Errorf("Got payload %q, want %q", p.Payload, payload)
+	}
+}
+
+func TestWriteUntagged(t *testing.T) {
+	lowerID, lower := channel.New(1, 1500)
+	m := vlan.NewMux(lowerID)
+	ep, _ := newSub(t, m, 0, 0)
+
+	hdr := buffer.NewPrependable(int(ep.MaxHeaderLength()) + 2)
+	copy(hdr.Prepend(2), "ip")
+	if err := ep.WritePacket(&stack.Route{}, &hdr, buffer.VectorisedView{}, header.IPv6ProtocolNumber); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+
+	p, ok := lower.Read()
+	if !ok {
+		t.Fatalf("No packet written to the lower endpoint")
+	}
+	if p.Proto != header.IPv6ProtocolNumber {
+		t.Errorf("Got protocol %#x, want %#x", p.Proto, header.IPv6ProtocolNumber)
+	}
+	if string(p.Header) != "ip" {
+		t.Errorf("Got header %q, want %q", p.Header, "ip")
+	}
+}
+
+// tagged builds a tagged packet with the given id and encapsulated payload.
+func tagged(vid uint16, protocol tcpip.NetworkProtocolNumber, payload string) buffer.View {
+	v := buffer.NewView(header.VLANSize + len(payload))
+	header.VLAN(v).Encode(&header.VLANFields{
+		Priority:  3,
+		ID:        vid,
+		EtherType: protocol,
+	})
+	copy(v[header.VLANSize:], payload)
+	return v
+}
+
+func TestDeliver(t *testing.T) {
+	lowerID, lower := channel.New(1, 1500)
+	m := vlan.NewMux(lowerID)
+	untaggedEP, untagged := newSub(t, m, 0, 0)
+	ep10, sub10 := newSub(t, m, 10, 0)
+	ep20, sub20 := newSub(t, m, 20, 0)
+
+	lower.Inject(header.VLANProtocolNumber, tagged(10, header.IPv4ProtocolNumber, "ten"))
+	lower.Inject(header.VLANProtocolNumber, tagged(20, header.IPv6ProtocolNumber, "twenty"))
+	lower.Inject(header.VLANProtocolNumber, tagged(30, header.IPv4ProtocolNumber, "thirty"))
+	lower.Inject(header.IPv4ProtocolNumber, buffer.View("untagged"))
+
+	// A truncated tag is dropped.
+	lower.Inject(header.VLANProtocolNumber, buffer.View{0, 10})
+
+	for _, test := range []struct {
+		name     string
+		d        *recordingDispatcher
+		ep       stack.LinkEndpoint
+		protocol tcpip.NetworkProtocolNumber
+		data     string
+	}{
+		{"untagged", untagged, untaggedEP, header.IPv4ProtocolNumber, "untagged"},
+		{"vlan 10", sub10, ep10, header.IPv4ProtocolNumber, "ten"},
+		{"vlan 20", sub20, ep20, header.IPv6ProtocolNumber, "twenty"},
+	} {
+		if len(test.d.packets) != 1 {
+			t.Errorf("%s: got %d packets, want 1", test.name, len(test.d.packets))
+			continue
+		}
+		p := test.d.packets[0]
+		if p.linkEP != test.ep {
+			t.Errorf("%s: packet delivered from %v, want the sub-interface %v", test.name, p.linkEP, test.ep)
+		}
+		if p.protocol != test.protocol {
+			t.Errorf("%s: got protocol %#x, want %#x", test.name, p.protocol, test.protocol)
+		}
+		if string(p.data) != test.data {
+			t.Errorf("%s: got data %q, want the tag stripped off %q", test.name, p.data, test.data)
+		}
+	}
+}
+
+func TestMTUAndHeaderLength(t *testing.T) {
+	lowerID, _ := channel.New(1, 1500)
+	m := vlan.NewMux(lowerID)
+	untagged, _ := newSub(t, m, 0, 0)
+	sub, _ := newSub(t, m, 10, 0)
+
+	if got := untagged.MTU(); got != 1500 {
+		t.Errorf("Got MTU %d for the untagged sub-interface, want 1500", got)
+	}
+	if got := untagged.MaxHeaderLength(); got != 0 {
+		t.Errorf("Got MaxHeaderLength %d for the untagged sub-interface, want 0", got)
+	}
+	if got, want := sub.MTU(), uint32(1500-header.VLANSize); got != want {
+		t.Errorf("Got MTU %d for a tagged sub-interface, want %d", got, want)
+	}
+	if got := sub.MaxHeaderLength(); got != header.VLANSize {
+		t.Errorf("Got MaxHeaderLength %d for a tagged sub-interface, want %d", got, header.VLANSize)
+	}
+
+	// A lower MTU smaller than the tag leaves no room for packets.
+	tinyID, _ := channel.New(1, 2)
+	sub, _ = newSub(t, vlan.NewMux(tinyID), 10, 0)
+	if got := sub.MTU(); got != 0 {
+		t.Errorf("Got MTU %d with a lower MTU of 2, want 0", got)
+	}
+}
+
+func TestClose(t *testing.T) {
+	id, lower := channel.NewClosable(10, 1500)
+	m := vlan.NewMux(id)
+	ep10, d10 := newSub(t, m, 10, 0)
+	ep20, d20 := newSub(t, m, 20, 0)
+
+	// Closing a sub-interface stops deliveries to it, but the lower
+	// endpoint is still used by the other one.
+	ep10.(stack.ClosableLinkEndpoint).Close()
+	if lower.Closed() {
+		t.Fatalf("Lower endpoint closed while a sub-interface is left")
+	}
+	lower.Inject(header.VLANProtocolNumber, tagged(10, header.IPv4ProtocolNumber, "ten"))
+	lower.Inject(header.VLANProtocolNumber, tagged(20, header.IPv4ProtocolNumber, "twenty"))
+	if len(d10.packets) != 0 {
+		t.Errorf("Got %d packets delivered to a closed sub-interface, want 0", len(d10.packets))
+	}
+	if len(d20.packets) != 1 {
+		t.Errorf("Got %d packets delivered to the open sub-interface, want 1", len(d20.packets))
+	}
+
+	// The lower endpoint is closed with the last sub-interface.
+	ep20.(stack.ClosableLinkEndpoint).Close()
+	if !lower.Closed() {
+		t.Errorf("Lower endpoint wasn't closed with the last sub-interface")
+	}
+	if _, err := m.New(10, 0); err != nil {
+		t.Errorf("New with the id of a closed sub-interface failed: %v", err)
+	}
+}
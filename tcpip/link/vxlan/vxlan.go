@@ -0,0 +1,147 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package vxlan provides the implementation of VXLAN virtual NICs, which
+// exchange ethernet frames with remote tunnel endpoints (VTEPs) over UDP, per
+// RFC 7348, to build overlay networks.
+//
+// VXLAN endpoints can be used in the networking stack by calling New(s,
+// config) to create a new endpoint, where s is the stack the encapsulated
+// frames are sent and received through, and then passing it as an argument to
+// Stack.CreateNIC(), possibly of another stack. The endpoint binds a UDP
+// endpoint of s to the local address and port of the configuration.
+//
+// The endpoints are tunnel endpoints; see the tunnel package for how the
+// destinations of the frames are found.
+package vxlan
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/tunnel"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+const (
+	// DefaultMTU is the MTU of endpoints whose configuration doesn't set
+	// one: the MTU of ethernet, minus the size of the encapsulation
+	// headers of IPv4 underlays.
+	DefaultMTU = 1500 - header.IPv4MinimumSize - header.UDPMinimumSize - header.VXLANSize - header.EthernetMinimumSize
+
+	// DefaultAgeingTime is the default amount of time after which learned
+	// entries are forgotten if no frames are received from them.
+	DefaultAgeingTime = tunnel.DefaultAgeingTime
+)
+
+// Errors returned when creating endpoints, adding entries to their tables, and
+// writing packets.
+var (
+	ErrBadVNI         = errors.New("vxlan: invalid vni")
+	ErrBadLinkAddress = tunnel.ErrBadLinkAddress
+	ErrNoLinkAddress  = tunnel.ErrNoLinkAddress
+)
+
+// Config describes a VXLAN endpoint.
+type Config struct {
+	// VNI is the VXLAN network identifier of the overlay network.
+	VNI uint32
+
+	// LocalAddress is the address of the underlay stack that frames are
+	// sent from and received on. Its length selects IPv4 or IPv6.
+	LocalAddress tcpip.Address
+
+	// NIC is the NIC of the underlay stack that frames are sent and
+	// received through, or zero for any.
+	NIC tcpip.NICID
+
+	// Port is the UDP port that frames are sent from and to, and received
+	// on, or zero for header.VXLANPort.
+	Port uint16
+
+	// LinkAddress is the ethernet address of the endpoint.
+	LinkAddress tcpip.LinkAddress
+
+	// MTU is the MTU of the endpoint, or zero for DefaultMTU.
+	MTU uint32
+
+	// Remotes are the addresses of the remote VTEPs that broadcast and
+	// multicast frames, and frames to unknown destinations, are flooded
+	// to.
+	Remotes []tcpip.Address
+
+	// Learning enables the learning of the forwarding database and the
+	// neighbor table from inbound frames.
+	Learning bool
+
+	// AgeingTime is the amount of time after which learned entries are
+	// forgotten if no frames are received from them, or zero for
+	// DefaultAgeingTime.
+	AgeingTime time.Duration
+}
+
+// Endpoint is a VXLAN link-layer endpoint. Its methods are the ones of tunnel
+// endpoints.
+type Endpoint struct {
+	*tunnel.Endpoint
+}
+
+// New creates a new VXLAN link-layer endpoint, which sends and receives the
+// encapsulated frames through the stack s.
+func New(s *stack.Stack, cfg Config) (tcpip.LinkEndpointID, *Endpoint, error) {
+	if cfg.VNI > header.VXLANMaxVNI {
+		return 0, nil, ErrBadVNI
+	}
+	if cfg.Port == 0 {
+		cfg.Port = header.VXLANPort
+	}
+	if cfg.MTU == 0 {
+		cfg.MTU = DefaultMTU
+	}
+
+	id, e, err := tunnel.New(s, tunnel.Config{
+		LocalAddress: cfg.LocalAddress,
+		NIC:          cfg.NIC,
+		Port:         cfg.Port,
+		LinkAddress:  cfg.LinkAddress,
+		MTU:          cfg.MTU,
+		Remotes:      cfg.Remotes,
+		Learning:     cfg.Learning,
+		AgeingTime:   cfg.AgeingTime,
+	}, &encapsulation{vni: cfg.VNI})
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, &Endpoint{e}, nil
+}
+
+// encapsulation implements tunnel.Encapsulation for a VXLAN network.
+type encapsulation struct {
+	vni uint32
+}
+
+// HeaderLength implements tunnel.Encapsulation.HeaderLength.
+func (*encapsulation) HeaderLength() int {
+	return header.VXLANSize
+}
+
+// Encapsulate implements tunnel.Encapsulation.Encapsulate.
+func (c *encapsulation) Encapsulate(hdr *buffer.Prependable) {
+	header.VXLAN(hdr.Prepend(header.VXLANSize)).Encode(&header.VXLANFields{
+		VNI: c.vni,
+	})
+}
+
+// Decapsulate implements tunnel.Encapsulation.Decapsulate. Frames of other VXLAN
+// networks are dropped.
+func (c *encapsulation) Decapsulate(v buffer.View) (int, bool) {
+	if len(v) < header.VXLANSize {
+		return 0, false
+	}
+	h := header.VXLAN(v)
+	return header.VXLANSize, h.IsValid() && h.VNI() == c.vni
+}
@@ -0,0 +1,414 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package mdns implements Multicast DNS, per RFC 6762, over a netstack stack,
+// so that devices embedding the stack can be found by name on their local
+// link, and find the other hosts of the link, without a nameserver.
+//
+// A Responder joins the mDNS groups on a NIC and answers the queries for the
+// names it is configured with, e.g., "device.local". Lookup sends one-shot
+// queries for the addresses of the other hosts.
+package mdns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/adapters/gonet"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	// Port is the port mDNS messages are sent to.
+	Port = 5353
+
+	// IPv4Group is the IPv4 multicast group of mDNS, 224.0.0.251.
+	IPv4Group tcpip.Address = "\xe0\x00\x00\xfb"
+
+	// IPv6Group is the IPv6 multicast group of mDNS, ff02::fb.
+	IPv6Group tcpip.Address = "\xff\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xfb"
+
+	// DefaultTTL is the TTL of the records of a Responder when Config.TTL
+	// is zero, which RFC 6762 recommends for address records.
+	DefaultTTL = 120 * time.Second
+
+	// messageTTL is the IP TTL of the messages of responders, per RFC
+	// 6762, section 11.
+	messageTTL = 255
+
+	// legacyTTL is the maximum TTL of the records of the responses to
+	// legacy unicast queries.
+	legacyTTL = 10
+
+	// queryInterval is the time between the retransmissions of the queries
+	// of Lookup.
+	queryInterval = time.Second
+
+	// maxMessageSize is the size of the largest message accepted, which
+	// is the limit of RFC 6762, section 17.
+	maxMessageSize = 9000
+)
+
+var errInvalidNetwork = errors.New("invalid network protocol")
+
+// groups are the mDNS groups of each network protocol, in the order they are
+// joined by responders.
+var groups = []struct {
+	network tcpip.NetworkProtocolNumber
+	addr    tcpip.Address
+}{
+	{header.IPv4ProtocolNumber, IPv4Group},
+	{header.IPv6ProtocolNumber, IPv6Group},
+}
+
+// Config is the configuration of a Responder.
+type Config struct {
+	// NIC is the NIC the responder joins the mDNS groups on, and answers
+	// the queries received from.
+	NIC tcpip.NICID
+
+	// Names maps the names the responder answers for, e.g.,
+	// "device.local", to their IPv4 and IPv6 addresses. Names without
+	// addresses are answered with the addresses of the NIC.
+	Names map[string][]tcpip.Address
+
+	// TTL is the TTL of the records, or DefaultTTL if it is zero.
+	TTL time.Duration
+}
+
+// Responder answers the mDNS queries for a set of names received by a NIC.
+type Responder struct {
+	stack *stack.Stack
+	nic   tcpip.NICID
+	ttl   uint32
+
+	// names maps the canonical form of the names the responder answers
+	// for to their addresses.
+	names map[string][]tcpip.Address
+
+	joined []tcpip.Address
+	conns  []*gonet.PacketConn
+	wg     sync.WaitGroup
+}
+
+// NewResponder creates a responder that joins the mDNS groups of the network
+// protocols of s on the configured NIC, and answers the queries for the
+// configured names until it is closed. It fails with tcpip.ErrUnknownProtocol
+// if s has neither IPv4 nor IPv6. Port 5353 must be free on the NIC.
+func NewResponder(s *stack.Stack, cfg Config) (*Responder, error) {
+	ttl := cfg.TTL
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+
+	r := &Responder{
+		stack: s,
+		nic:   cfg.NIC,
+		ttl:   uint32(ttl / time.Second),
+		names: make(map[string][]tcpip.Address),
+	}
+	for name, addrs := range cfg.Names {
+		if _, err := appendName(nil, name); err != nil {
+			return nil, err
+		}
+		r.names[canonicalName(name)] = append([]tcpip.Address(nil), addrs...)
+	}
+
+	for _, g := range groups {
+		err := s.JoinGroup(g.network, cfg.NIC, g.addr)
+		if err == tcpip.ErrUnknownProtocol {
+			continue
+		}
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.joined = append(r.joined, g.addr)
+
+		c, err := listen(s, cfg.NIC, g.network)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.conns = append(r.conns, c)
+
+		r.wg.Add(1)
+		go r.serve(c, g.addr)
+	}
+
+	if len(r.conns) == 0 {
+		return nil, tcpip.ErrUnknownProtocol
+	}
+
+	return r, nil
+}
+
+// Close stops the responder, and leaves the mDNS groups it joined.
+func (r *Responder) Close() {
+	for _, c := range r.conns {
+		c.Close()
+	}
+	r.wg.Wait()
+
+	for _, addr := range r.joined {
+		r.stack.LeaveGroup(r.nic, addr)
+	}
+}
+
+// listen returns a connection bound to the mDNS port of the given NIC, sending
+// with the TTL of mDNS messages, so that receivers can check that they come
+// from the local link.
+func listen(s *stack.Stack, nic tcpip.NICID, network tcpip.NetworkProtocolNumber) (*gonet.PacketConn, error) {
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, network, &wq)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ep.SetSockOpt(tcpip.TTLOption(messageTTL)); err != nil {
+		ep.Close()
+		return nil, err
+	}
+
+	if err := ep.Bind(tcpip.FullAddress{NIC: nic, Port: Port}, nil); err != nil {
+		ep.Close()
+		return nil, err
+	}
+
+	return gonet.NewUDPConn(s, &wq, ep), nil
+}
+
+// serve answers the queries received by c, which is bound to the mDNS port of
+// the given group, until c is closed.
+func (r *Responder) serve(c *gonet.PacketConn, group tcpip.Address) {
+	defer r.wg.Done()
+
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, from, err := c.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		if resp, to := r.respond(buf[:n], from.(*net.UDPAddr), group); resp != nil {
+			c.WriteTo(resp, to)
+		}
+	}
+}
+
+// respond returns the response to the query b received from the given address,
+// along with the address to send it to, or nil if the responder has no answers
+// to it. Responses are multicast to the group, unless the query requests a
+// unicast response or is a legacy unicast one, i.e., wasn't sent from the mDNS
+// port.
+func (r *Responder) respond(b []byte, from *net.UDPAddr, group tcpip.Address) ([]byte, *net.UDPAddr) {
+	var q message
+	if err := q.unpack(b); err != nil || q.flags&(flagResponse|opcodeMask) != 0 {
+		return nil, nil
+	}
+
+	legacy := from.Port != Port
+	unicast := legacy
+	var answers []resource
+	for _, qq := range q.questions {
+		if qq.class&classUnicastResponse != 0 {
+			unicast = true
+		}
+		answers = append(answers, r.answer(qq)...)
+	}
+
+	// mDNS has no negative responses.
+	if len(answers) == 0 {
+		return nil, nil
+	}
+
+	resp := message{flags: flagResponse | flagAuthoritative, answers: answers}
+	if legacy {
+		// Legacy queriers aren't mDNS implementations: the response
+		// must look like a unicast DNS one, and its records must not
+		// be cached for long, per RFC 6762, section 6.7.
+		resp.id = q.id
+		resp.questions = q.questions
+		for i := range resp.answers {
+			if resp.answers[i].ttl > legacyTTL {
+				resp.answers[i].ttl = legacyTTL
+			}
+		}
+	} else {
+		// The responder owns the names, so their records replace the
+		// ones cached by the queriers.
+		for i := range resp.answers {
+			resp.answers[i].class |= classCacheFlush
+		}
+	}
+
+	out, err := resp.pack()
+	if err != nil {
+		return nil, nil
+	}
+
+	if unicast {
+		return out, from
+	}
+	return out, &net.UDPAddr{IP: net.IP(group), Port: Port}
+}
+
+// answer returns the records of the responder that answer the question q.
+func (r *Responder) answer(q question) []resource {
+	if class := q.class & classMask; class != classINET && class != classANY {
+		return nil
+	}
+
+	addrs, ok := r.names[canonicalName(q.name)]
+	if !ok {
+		return nil
+	}
+	if len(addrs) == 0 {
+		addrs = r.nicAddresses()
+	}
+
+	var answers []resource
+	for _, addr := range addrs {
+		rtype := addressType(addr)
+		if rtype == 0 || q.qtype != rtype && q.qtype != typeANY {
+			continue
+		}
+		answers = append(answers, resource{
+			name:  q.name,
+			rtype: rtype,
+			class: classINET,
+			ttl:   r.ttl,
+			data:  []byte(addr),
+		})
+	}
+
+	return answers
+}
+
+// nicAddresses returns the addresses of the NIC of the responder.
+func (r *Responder) nicAddresses() []tcpip.Address {
+	var addrs []tcpip.Address
+	for _, a := range r.stack.NICInfo()[r.nic].Addresses {
+		addrs = append(addrs, a.Address)
+	}
+	return addrs
+}
+
+// addressType returns the type of the records of the given address, or zero if
+// it is neither an IPv4 nor an IPv6 address.
+func addressType(addr tcpip.Address) uint16 {
+	switch len(addr) {
+	case header.IPv4AddressSize:
+		return typeA
+	case header.IPv6AddressSize:
+		return typeAAAA
+	}
+	return 0
+}
+
+// Lookup returns the IPv4 and IPv6 addresses of the given name, e.g.,
+// "printer.local", by sending a one-shot query for its A and AAAA records to the
+// mDNS group of the given network protocol through the given NIC. The addresses
+// are those of the first response answering the query, which is retransmitted
+// every second until then, or until ctx is done.
+func Lookup(ctx context.Context, s tcpip.Stack, nic tcpip.NICID, name string, network tcpip.NetworkProtocolNumber) ([]tcpip.Address, error) {
+	var group tcpip.Address
+	for _, g := range groups {
+		if g.network == network {
+			group = g.addr
+		}
+	}
+	if group == "" {
+		return nil, errInvalidNetwork
+	}
+
+	req := message{questions: []question{
+		{name: name, qtype: typeA, class: classINET},
+		{name: name, qtype: typeAAAA, class: classINET},
+	}}
+	b, err := req.pack()
+	if err != nil {
+		return nil, err
+	}
+
+	// Queries sent from a port other than the mDNS one are answered
+	// directly to it, so the lookup doesn't have to join the group.
+	c, err := gonet.NewPacketConn(s, tcpip.FullAddress{NIC: nic}, network)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	// Closing the connection makes the pending read or write fail once
+	// ctx is done.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-stop:
+		}
+	}()
+
+	to := &net.UDPAddr{IP: net.IP(group), Port: Port}
+	buf := make([]byte, maxMessageSize)
+	for {
+		if _, err := c.WriteTo(b, to); err != nil {
+			return nil, contextError(ctx, err)
+		}
+
+		c.SetReadDeadline(time.Now().Add(queryInterval))
+		for {
+			n, _, err := c.ReadFrom(buf)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			if err != nil {
+				return nil, contextError(ctx, err)
+			}
+
+			if addrs := answerAddresses(buf[:n], name); len(addrs) != 0 {
+				return addrs, nil
+			}
+		}
+	}
+}
+
+// answerAddresses returns the addresses of name in the response b, if any.
+func answerAddresses(b []byte, name string) []tcpip.Address {
+	var m message
+	if err := m.unpack(b); err != nil || m.flags&flagResponse == 0 {
+		return nil
+	}
+
+	name = canonicalName(name)
+	var addrs []tcpip.Address
+	for _, a := range m.answers {
+		if a.class&classMask != classINET || canonicalName(a.name) != name {
+			continue
+		}
+		if rtype := addressType(tcpip.Address(a.data)); rtype != 0 && rtype == a.rtype {
+			addrs = append(addrs, tcpip.Address(a.data))
+		}
+	}
+
+	return addrs
+}
+
+// contextError returns the error of ctx if it is done, which is the cause of
+// the given I/O error, or err otherwise.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
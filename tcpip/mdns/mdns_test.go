@@ -0,0 +1,222 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mdns
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/link/loopback"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/udp"
+)
+
+const (
+	nicID     = 1
+	stackAddr = tcpip.Address("\x0a\x00\x00\x01")
+	testAddr  = tcpip.Address("\x0a\x00\x00\x02")
+)
+
+func TestLookup(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+	if err := s.CreateNIC(nicID, loopback.New()); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	const loopbackAddr = tcpip.Address("\x7f\x00\x00\x01")
+	if err := s.AddAddress(nicID, ipv4.ProtocolNumber, loopbackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x7f\x00\x00\x00",
+		Mask:        "\xff\x00\x00\x00",
+		NIC:         nicID,
+	}})
+
+	deviceAddrs := []tcpip.Address{
+		"\x0a\x00\x00\x05",
+		"\xfe\x80\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x05",
+	}
+	r, err := NewResponder(s, Config{
+		NIC: nicID,
+		Names: map[string][]tcpip.Address{
+			"device.local": deviceAddrs,
+			"host.local.":  nil,
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewResponder failed: %v", err)
+	}
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, test := range []struct {
+		name string
+		want []tcpip.Address
+	}{
+		{"device.local", deviceAddrs},
+		{"HOST.local.", []tcpip.Address{loopbackAddr}},
+	} {
+		addrs, err := Lookup(ctx, s, nicID, test.name, ipv4.ProtocolNumber)
+		if err != nil {
+			t.Fatalf("Lookup(%q) failed: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(addrs, test.want) {
+			t.Errorf("Lookup(%q) = %v, want %v", test.name, addrs, test.want)
+		}
+	}
+
+	// Names the responder doesn't own go unanswered.
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := Lookup(ctx, s, nicID, "other.local", ipv4.ProtocolNumber); err != context.DeadlineExceeded {
+		t.Errorf("Lookup of an unknown name returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// newChannelStack returns a stack with a channel NIC, whose address is
+// stackAddr in a /24 subnet, and a responder for "device.local" on it.
+func newChannelStack(t *testing.T) (*stack.Stack, *channel.Endpoint, *Responder) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+	id, linkEP := channel.New(256, 1500)
+	if err := s.CreateNIC(nicID, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddressWithPrefix(nicID, ipv4.ProtocolNumber, tcpip.AddressWithPrefix{stackAddr, 24}); err != nil {
+		t.Fatalf("AddAddressWithPrefix failed: %v", err)
+	}
+
+	r, err := NewResponder(s, Config{
+		NIC:   nicID,
+		Names: map[string][]tcpip.Address{"device.local": nil},
+	})
+	if err != nil {
+		t.Fatalf("NewResponder failed: %v", err)
+	}
+
+	return s, linkEP, r
+}
+
+// injectQuery injects a query for the A records of name, sent from
+// testAddr:5353 to the IPv4 mDNS group.
+func injectQuery(t *testing.T, linkEP *channel.Endpoint, name string, class uint16) {
+	t.Helper()
+
+	q := message{questions: []question{{name: name, qtype: typeA, class: class}}}
+	b, err := q.pack()
+	if err != nil {
+		t.Fatalf("pack failed: %v", err)
+	}
+
+	const hlen = header.IPv4MinimumSize + header.UDPMinimumSize
+	buf := buffer.NewView(hlen + len(b))
+	copy(buf[hlen:], b)
+
+	ip := header.IPv4(buf)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(buf)),
+		TTL:         255,
+		Protocol:    uint8(udp.ProtocolNumber),
+		SrcAddr:     testAddr,
+		DstAddr:     IPv4Group,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	header.UDP(buf[header.IPv4MinimumSize:]).Encode(&header.UDPFields{
+		SrcPort: Port,
+		DstPort: Port,
+		Length:  uint16(header.UDPMinimumSize + len(b)),
+	})
+
+	linkEP.Inject(ipv4.ProtocolNumber, buf)
+}
+
+// readResponse reads the response written to linkEP, and returns its
+// destination address and the message it carries.
+func readResponse(t *testing.T, linkEP *channel.Endpoint) (tcpip.Address, *message) {
+	t.Helper()
+
+	select {
+	case p := <-linkEP.C:
+		b := append(append(buffer.View(nil), p.Header...), p.Payload...)
+		ip := header.IPv4(b)
+		u := header.UDP(b[ip.HeaderLength():])
+		if ip.SourceAddress() != stackAddr || u.SourcePort() != Port || u.DestinationPort() != Port {
+			t.Fatalf("got response from %v:%d to port %d, want from %v:%d to port %d", ip.SourceAddress(), u.SourcePort(), u.DestinationPort(), stackAddr, Port, Port)
+		}
+		if ip.TTL() != messageTTL {
+			t.Errorf("got response with TTL %d, want %d", ip.TTL(), messageTTL)
+		}
+
+		var m message
+		if err := m.unpack(u.Payload()); err != nil {
+			t.Fatalf("unpack failed: %v", err)
+		}
+		return ip.DestinationAddress(), &m
+	case <-time.After(time.Second):
+		t.Fatalf("no response was written")
+	}
+	return "", nil
+}
+
+func TestResponder(t *testing.T) {
+	_, linkEP, r := newChannelStack(t)
+	defer r.Close()
+
+	// Queries from the mDNS port are answered to the group, with records
+	// flushing the caches.
+	injectQuery(t, linkEP, "Device.local.", classINET)
+	dst, m := readResponse(t, linkEP)
+	if dst != IPv4Group {
+		t.Errorf("got response to %v, want %v", dst, IPv4Group)
+	}
+	want := []resource{{
+		name:  "Device.local.",
+		rtype: typeA,
+		class: classINET | classCacheFlush,
+		ttl:   uint32(DefaultTTL / time.Second),
+		data:  []byte(stackAddr),
+	}}
+	if m.id != 0 || m.flags != flagResponse|flagAuthoritative || len(m.questions) != 0 || !reflect.DeepEqual(m.answers, want) {
+		t.Errorf("got response %+v, want one with answers %+v", m, want)
+	}
+
+	// Unicast responses are requested with the top bit of the class.
+	injectQuery(t, linkEP, "device.local", classINET|classUnicastResponse)
+	if dst, _ := readResponse(t, linkEP); dst != testAddr {
+		t.Errorf("got response to %v, want %v", dst, testAddr)
+	}
+
+	// Other names aren't answered.
+	injectQuery(t, linkEP, "other.local", classINET)
+	select {
+	case <-linkEP.C:
+		t.Errorf("query for another name was answered")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestResponderClose(t *testing.T) {
+	s, linkEP, r := newChannelStack(t)
+	r.Close()
+
+	// The responder left the group, so queries aren't even received.
+	injectQuery(t, linkEP, "device.local", classINET)
+	if got := s.Stats().UnknownNetworkEndpointRcvdPackets; got != 1 {
+		t.Errorf("got %d packets received for unknown network endpoints, want 1", got)
+	}
+	if n := len(linkEP.C); n != 0 {
+		t.Errorf("got %d packets written after closing the responder", n)
+	}
+}
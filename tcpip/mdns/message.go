@@ -0,0 +1,249 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// DNS record types and classes used by mDNS.
+const (
+	typeA    = 1
+	typeAAAA = 28
+	typeANY  = 255
+
+	classINET = 1
+	classANY  = 255
+
+	// classMask extracts the class from the class field of questions and
+	// records, whose top bit has a different meaning in mDNS: it requests
+	// a unicast response in questions, and flushes the caches of the
+	// record's name and type in answers, per RFC 6762, sections 5.4 and
+	// 10.2.
+	classMask            = 0x7fff
+	classUnicastResponse = 0x8000
+	classCacheFlush      = 0x8000
+)
+
+// Flags and masks of the DNS message header.
+const (
+	flagResponse      = 1 << 15
+	flagAuthoritative = 1 << 10
+	opcodeMask        = 0xf << 11
+)
+
+const (
+	headerSize   = 12
+	maxLabelSize = 63
+	maxNameSize  = 255
+
+	// maxPointers is the maximum number of compression pointers followed
+	// while reading a name, to protect against loops.
+	maxPointers = 10
+)
+
+var (
+	errInvalidName    = errors.New("invalid domain name")
+	errShortMessage   = errors.New("message too short")
+	errInvalidPointer = errors.New("invalid compression pointer")
+)
+
+// question is an entry of the question section of a message.
+type question struct {
+	name  string
+	qtype uint16
+	class uint16
+}
+
+// resource is a resource record of the answer section of a message.
+type resource struct {
+	name  string
+	rtype uint16
+	class uint16
+	ttl   uint32
+	data  []byte
+}
+
+// message is an mDNS message. The authority and additional sections are
+// ignored when a message is unpacked, and left empty when it is packed.
+type message struct {
+	id        uint16
+	flags     uint16
+	questions []question
+	answers   []resource
+}
+
+// pack returns the wire encoding of the message. Names aren't compressed.
+func (m *message) pack() ([]byte, error) {
+	b := make([]byte, headerSize, 512)
+	binary.BigEndian.PutUint16(b[0:], m.id)
+	binary.BigEndian.PutUint16(b[2:], m.flags)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.answers)))
+
+	var err error
+	for _, q := range m.questions {
+		if b, err = appendName(b, q.name); err != nil {
+			return nil, err
+		}
+		b = appendUint16(b, q.qtype)
+		b = appendUint16(b, q.class)
+	}
+
+	for _, r := range m.answers {
+		if b, err = appendName(b, r.name); err != nil {
+			return nil, err
+		}
+		b = appendUint16(b, r.rtype)
+		b = appendUint16(b, r.class)
+		b = append(b, byte(r.ttl>>24), byte(r.ttl>>16), byte(r.ttl>>8), byte(r.ttl))
+		b = appendUint16(b, uint16(len(r.data)))
+		b = append(b, r.data...)
+	}
+
+	return b, nil
+}
+
+// unpack decodes the wire encoding of a message into m.
+func (m *message) unpack(b []byte) error {
+	if len(b) < headerSize {
+		return errShortMessage
+	}
+
+	m.id = binary.BigEndian.Uint16(b[0:])
+	m.flags = binary.BigEndian.Uint16(b[2:])
+	qdcount := int(binary.BigEndian.Uint16(b[4:]))
+	ancount := int(binary.BigEndian.Uint16(b[6:]))
+
+	off := headerSize
+	m.questions = nil
+	for i := 0; i < qdcount; i++ {
+		var q question
+		var err error
+		if q.name, off, err = readName(b, off); err != nil {
+			return err
+		}
+		if len(b) < off+4 {
+			return errShortMessage
+		}
+		q.qtype = binary.BigEndian.Uint16(b[off:])
+		q.class = binary.BigEndian.Uint16(b[off+2:])
+		off += 4
+		m.questions = append(m.questions, q)
+	}
+
+	m.answers = nil
+	for i := 0; i < ancount; i++ {
+		var r resource
+		var err error
+		if r.name, off, err = readName(b, off); err != nil {
+			return err
+		}
+		if len(b) < off+10 {
+			return errShortMessage
+		}
+		r.rtype = binary.BigEndian.Uint16(b[off:])
+		r.class = binary.BigEndian.Uint16(b[off+2:])
+		r.ttl = binary.BigEndian.Uint32(b[off+4:])
+		n := int(binary.BigEndian.Uint16(b[off+8:]))
+		off += 10
+		if len(b) < off+n {
+			return errShortMessage
+		}
+		r.data = b[off : off+n]
+		off += n
+		m.answers = append(m.answers, r)
+	}
+
+	return nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// appendName appends the wire encoding of the given domain name, which may or
+// may not be fully qualified, to b.
+func appendName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name)+2 > maxNameSize {
+		return nil, errInvalidName
+	}
+
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > maxLabelSize {
+				return nil, errInvalidName
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+
+	return append(b, 0), nil
+}
+
+// readName reads the domain name at the given offset of msg, following
+// compression pointers. It returns the fully qualified name and the offset
+// right after the name.
+func readName(msg []byte, off int) (string, int, error) {
+	var name []byte
+	end := -1
+	pointers := 0
+
+	for {
+		if off >= len(msg) {
+			return "", 0, errShortMessage
+		}
+
+		c := int(msg[off])
+		switch c & 0xc0 {
+		case 0x00:
+			if c == 0 {
+				off++
+				if end < 0 {
+					end = off
+				}
+				if len(name) == 0 {
+					return ".", end, nil
+				}
+				return string(name), end, nil
+			}
+
+			if off+1+c > len(msg) {
+				return "", 0, errShortMessage
+			}
+			name = append(name, msg[off+1:off+1+c]...)
+			name = append(name, '.')
+			if len(name) > maxNameSize {
+				return "", 0, errInvalidName
+			}
+			off += 1 + c
+
+		case 0xc0:
+			if off+2 > len(msg) {
+				return "", 0, errShortMessage
+			}
+			if pointers++; pointers > maxPointers {
+				return "", 0, errInvalidPointer
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+
+		default:
+			return "", 0, errInvalidName
+		}
+	}
+}
+
+// canonicalName returns the form of name used to compare names, which are case
+// insensitive, e.g., "host.local." for "Host.local".
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+}
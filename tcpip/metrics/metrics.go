@@ -0,0 +1,164 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package metrics exports the statistics of a netstack stack: the counters of
+// the stack and its protocols, as returned by Stack.Stats, and those of its
+// NICs, as returned by Stack.NICInfo.
+//
+// The statistics can be published as an expvar variable, which is served as
+// JSON at /debug/vars by the expvar package, or scraped by Prometheus through
+// the handler returned by Handler. Both read a fresh snapshot of the counters
+// each time they are served.
+package metrics
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"unicode"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// DefaultNamespace is the prefix of the names of the Prometheus metrics when
+// Handler is given an empty namespace.
+const DefaultNamespace = "netstack"
+
+// Var returns an expvar variable holding the statistics of s. Its value is an
+// object with a "stack" member holding the fields of tcpip.Stats, and a "nics"
+// member holding the stack.NICStats of each NIC indexed by its id.
+func Var(s *stack.Stack) expvar.Var {
+	return expvar.Func(func() interface{} {
+		nics := make(map[string]stack.NICStats)
+		for id, info := range s.NICInfo() {
+			nics[strconv.Itoa(int(id))] = info.Stats
+		}
+
+		return map[string]interface{}{
+			"stack": s.Stats(),
+			"nics":  nics,
+		}
+	})
+}
+
+// Publish publishes the statistics of s as the expvar variable with the given
+// name. Like expvar.Publish, it panics if the name is already in use.
+func Publish(name string, s *stack.Stack) {
+	expvar.Publish(name, Var(s))
+}
+
+// Handler returns an HTTP handler that serves the statistics of s in the text
+// exposition format of Prometheus. The names of the metrics start with the
+// given namespace, or DefaultNamespace if it is empty, and are derived from the
+// fields of tcpip.Stats, e.g., tcpip.Stats.TCP.SegmentsSent is exported as
+// netstack_tcp_segments_sent_total. NIC metrics have a "nic" label holding the
+// id of the NIC.
+func Handler(s *stack.Stack, namespace string) http.Handler {
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		bw := bufio.NewWriter(w)
+		writeMetrics(bw, namespace, s)
+		bw.Flush()
+	})
+}
+
+// nicMetric describes a metric holding a value of the NICs.
+type nicMetric struct {
+	name  string
+	typ   string
+	help  string
+	value func(*stack.NICInfo) uint64
+}
+
+var nicMetrics = []nicMetric{
+	{"nic_rx_packets_total", "counter", "Packets received by the NIC.", func(i *stack.NICInfo) uint64 { return i.Stats.Rx.Packets }},
+	{"nic_rx_bytes_total", "counter", "Bytes received by the NIC.", func(i *stack.NICInfo) uint64 { return i.Stats.Rx.Bytes }},
+	{"nic_tx_packets_total", "counter", "Packets sent by the NIC.", func(i *stack.NICInfo) uint64 { return i.Stats.Tx.Packets }},
+	{"nic_tx_bytes_total", "counter", "Bytes sent by the NIC.", func(i *stack.NICInfo) uint64 { return i.Stats.Tx.Bytes }},
+	{"nic_rx_errors_total", "counter", "Received packets that couldn't be handled by the NIC.", func(i *stack.NICInfo) uint64 { return i.Stats.RxErrors }},
+	{"nic_tx_errors_total", "counter", "Packets that couldn't be sent by the NIC.", func(i *stack.NICInfo) uint64 { return i.Stats.TxErrors }},
+	{"nic_mtu", "gauge", "MTU of the NIC.", func(i *stack.NICInfo) uint64 { return uint64(i.MTU) }},
+	{"nic_up", "gauge", "Whether the NIC is enabled.", func(i *stack.NICInfo) uint64 { return boolValue(i.Flags.Up) }},
+	{"nic_running", "gauge", "Whether the carrier of the NIC is up.", func(i *stack.NICInfo) uint64 { return boolValue(i.Flags.Running) }},
+}
+
+func boolValue(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// writeMetrics writes a snapshot of the statistics of s to w.
+func writeMetrics(w *bufio.Writer, namespace string, s *stack.Stack) {
+	stats := s.Stats()
+	writeCounters(w, namespace+"_", "tcpip.Stats.", reflect.ValueOf(&stats).Elem())
+
+	infos := s.NICInfo()
+	ids := make([]tcpip.NICID, 0, len(infos))
+	for id := range infos {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	if len(ids) == 0 {
+		return
+	}
+
+	for _, m := range nicMetrics {
+		name := namespace + "_" + m.name
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, m.help, name, m.typ)
+		for _, id := range ids {
+			info := infos[id]
+			fmt.Fprintf(w, "%s{nic=\"%d\"} %d\n", name, id, m.value(&info))
+		}
+	}
+}
+
+// writeCounters writes the uint64 counters of v, a struct that may contain
+// other structs of counters, as Prometheus counters. The names of the metrics
+// start with prefix, and their help strings give the path of the fields, which
+// starts with path.
+func writeCounters(w *bufio.Writer, prefix, path string, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		name := prefix + snakeCase(t.Field(i).Name)
+		field := path + t.Field(i).Name
+		if f.Kind() == reflect.Struct {
+			writeCounters(w, name+"_", field+".", f)
+			continue
+		}
+
+		name += "_total"
+		fmt.Fprintf(w, "# HELP %s Counter %s.\n# TYPE %s counter\n%s %d\n", name, field, name, name, f.Uint())
+	}
+}
+
+// snakeCase converts a Go identifier such as "TCPStats" to "tcp_stats".
+func snakeCase(s string) string {
+	r := []rune(s)
+	var b []rune
+	for i, c := range r {
+		if unicode.IsUpper(c) && i > 0 {
+			prevLower := unicode.IsLower(r[i-1]) || unicode.IsDigit(r[i-1])
+			nextLower := i+1 < len(r) && unicode.IsLower(r[i+1])
+			if prevLower || (unicode.IsUpper(r[i-1]) && nextLower) {
+				b = append(b, '_')
+			}
+		}
+		b = append(b, unicode.ToLower(c))
+	}
+	return string(b)
+}
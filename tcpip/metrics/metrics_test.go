@@ -0,0 +1,88 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/netstack/tcpip/link/loopback"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/udp"
+)
+
+func newStack(t *testing.T) *stack.Stack {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+	if err := s.CreateNIC(1, loopback.New()); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	return s
+}
+
+func TestSnakeCase(t *testing.T) {
+	for _, test := range []struct {
+		in, want string
+	}{
+		{"TCP", "tcp"},
+		{"SegmentsSent", "segments_sent"},
+		{"UnknownProtocolRcvdPackets", "unknown_protocol_rcvd_packets"},
+		{"HTTPServer", "http_server"},
+	} {
+		if got := snakeCase(test.in); got != test.want {
+			t.Errorf("snakeCase(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	s := newStack(t)
+
+	rec := httptest.NewRecorder()
+	Handler(s, "").ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := ioutil.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+
+	for _, want := range []string{
+		"# TYPE netstack_unknown_protocol_rcvd_packets_total counter\n",
+		"# HELP netstack_tcp_segments_sent_total Counter tcpip.Stats.TCP.SegmentsSent.\n",
+		"netstack_udp_packets_sent_total 0\n",
+		"# TYPE netstack_nic_mtu gauge\n",
+		"netstack_nic_up{nic=\"1\"} 1\n",
+		"netstack_nic_rx_packets_total{nic=\"1\"} 0\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics don't contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestVar(t *testing.T) {
+	s := newStack(t)
+
+	var v struct {
+		Stack struct {
+			TCP struct {
+				SegmentsSent *uint64
+			}
+		} `json:"stack"`
+		NICs map[string]stack.NICStats `json:"nics"`
+	}
+	if err := json.Unmarshal([]byte(Var(s).String()), &v); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+
+	if v.Stack.TCP.SegmentsSent == nil {
+		t.Errorf("TCP.SegmentsSent missing from %s", Var(s))
+	}
+	if _, ok := v.NICs["1"]; !ok {
+		t.Errorf("NIC 1 missing from %s", Var(s))
+	}
+}
@@ -62,8 +62,8 @@ func (t *testObject) checkValues(protocol tcpip.TransportProtocolNumber, v buffe
 // DeliverTransportPacket is called by network endpoints after parsing incoming
 // packets. This is used by the test object to verify that the results of the
 // parsing are expected.
-func (t *testObject) DeliverTransportPacket(r *stack.Route, protocol tcpip.TransportProtocolNumber, v buffer.View) {
-	t.checkValues(protocol, v, r.RemoteAddress, r.LocalAddress)
+func (t *testObject) DeliverTransportPacket(r *stack.Route, protocol tcpip.TransportProtocolNumber, vv buffer.VectorisedView) {
+	t.checkValues(protocol, vv.ToView(), r.RemoteAddress, r.LocalAddress)
 }
 
 // Attach is only implemented to satisfy the LinkEndpoint interface.
@@ -80,10 +80,15 @@ func (*testObject) MaxHeaderLength() uint16 {
 	return 0
 }
 
+// Capabilities is only implemented to satisfy the LinkEndpoint interface.
+func (*testObject) Capabilities() stack.LinkEndpointCapabilities {
+	return 0
+}
+
 // WritePacket is called by network endpoints after producing a packet and
 // writing it to the link endpoint. This is used by the test object to verify
 // that the produced packet is as expected.
-func (t *testObject) WritePacket(_ *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) error {
+func (t *testObject) WritePacket(_ *stack.Route, hdr *buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) error {
 	var prot tcpip.TransportProtocolNumber
 	var srcAddr tcpip.Address
 	var dstAddr tcpip.Address
@@ -100,7 +105,7 @@ func (t *testObject) WritePacket(_ *stack.Route, hdr *buffer.Prependable, payloa
 		srcAddr = h.SourceAddress()
 		dstAddr = h.DestinationAddress()
 	}
-	t.checkValues(prot, payload, srcAddr, dstAddr)
+	t.checkValues(prot, payload.ToView(), srcAddr, dstAddr)
 	return nil
 }
 
@@ -131,7 +136,7 @@ func TestIPv4Send(t *testing.T) {
 		RemoteAddress: o.dstAddr,
 		LocalAddress:  o.srcAddr,
 	}
-	if err := ep.WritePacket(&r, &hdr, payload, 123); err != nil {
+	if err := ep.WritePacket(&r, &hdr, payload.ToVectorisedView(), 123); err != nil {
 		t.Fatalf("WritePacket failed: %v", err)
 	}
 }
@@ -171,7 +176,7 @@ func TestIPv4Receive(t *testing.T) {
 		LocalAddress:  o.dstAddr,
 		RemoteAddress: o.srcAddr,
 	}
-	ep.HandlePacket(&r, view)
+	ep.HandlePacket(&r, view.ToVectorisedView())
 }
 
 func TestIPv6Send(t *testing.T) {
@@ -201,7 +206,7 @@ func TestIPv6Send(t *testing.T) {
 		RemoteAddress: o.dstAddr,
 		LocalAddress:  o.srcAddr,
 	}
-	if err := ep.WritePacket(&r, &hdr, payload, 123); err != nil {
+	if err := ep.WritePacket(&r, &hdr, payload.ToVectorisedView(), 123); err != nil {
 		t.Fatalf("WritePacket failed: %v", err)
 	}
 }
@@ -240,5 +245,5 @@ func TestIPv6Receive(t *testing.T) {
 		LocalAddress:  o.dstAddr,
 		RemoteAddress: o.srcAddr,
 	}
-	ep.HandlePacket(&r, view)
+	ep.HandlePacket(&r, view.ToVectorisedView())
 }
@@ -84,9 +84,9 @@ func (e *endpoint) MaxHeaderLength() uint16 {
 }
 
 // WritePacket writes a packet to the given destination address and protocol.
-func (e *endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.TransportProtocolNumber) error {
+func (e *endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.TransportProtocolNumber) error {
 	ip := header.IPv4(hdr.Prepend(header.IPv4MinimumSize))
-	length := uint16(hdr.UsedLength() + len(payload))
+	length := uint16(hdr.UsedLength() + payload.Size())
 	id := uint32(0)
 	if length > header.IPv4MaximumHeaderSize+8 {
 		// Packets of 68 bytes or less are required by RFC 791 to not be
@@ -95,9 +95,10 @@ func (e *endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload
 	}
 	ip.Encode(&header.IPv4Fields{
 		IHL:         header.IPv4MinimumSize,
+		TOS:         r.TOS,
 		TotalLength: length,
 		ID:          uint16(id),
-		TTL:         65,
+		TTL:         r.DefaultTTL(),
 		Protocol:    uint8(protocol),
 		SrcAddr:     tcpip.Address(e.address[:]),
 		DstAddr:     r.RemoteAddress,
@@ -109,22 +110,25 @@ func (e *endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload
 
 // HandlePacket is called by the link layer when new ipv4 packets arrive for
 // this endpoint.
-func (e *endpoint) HandlePacket(r *stack.Route, v buffer.View) {
-	h := header.IPv4(v)
+func (e *endpoint) HandlePacket(r *stack.Route, vv buffer.VectorisedView) {
+	h := header.IPv4(vv.ToView())
 	if !h.IsValid() {
+		atomic.AddUint64(&r.Stats().IP.MalformedPacketsReceived, 1)
 		return
 	}
 
 	// For now we don't support fragmentation, so reject fragmented packets.
 	if h.FragmentOffset() != 0 || (h.Flags()&header.IPv4FlagMoreFragments) != 0 {
+		atomic.AddUint64(&r.Stats().IP.PacketsDropped, 1)
 		return
 	}
 
 	hlen := int(h.HeaderLength())
 	tlen := int(h.TotalLength())
-	v.TrimFront(hlen)
-	v.CapLength(tlen - hlen)
-	e.dispatcher.DeliverTransportPacket(r, tcpip.TransportProtocolNumber(h.Protocol()), v)
+	r.NetworkHeader = buffer.View(h[:hlen])
+	vv.TrimFront(hlen)
+	vv.CapLength(tlen - hlen)
+	e.dispatcher.DeliverTransportPacket(r, tcpip.TransportProtocolNumber(h.Protocol()), vv)
 }
 
 type protocol struct{}
@@ -153,6 +157,21 @@ func (*protocol) ParseAddresses(v buffer.View) (src, dst tcpip.Address) {
 	return h.SourceAddress(), h.DestinationAddress()
 }
 
+// PrepareForward implements stack.ForwardingNetworkProtocol.PrepareForward. It
+// decrements the TTL of the packet and updates its checksum.
+func (*protocol) PrepareForward(v buffer.View) bool {
+	h := header.IPv4(v)
+	if !h.IsValid() || h.TTL() <= 1 {
+		return false
+	}
+
+	h.SetTTL(h.TTL() - 1)
+	h.SetChecksum(0)
+	h.SetChecksum(^h.CalculateChecksum())
+
+	return true
+}
+
 // NewEndpoint creates a new ipv4 endpoint.
 func (p *protocol) NewEndpoint(nicid tcpip.NICID, addr tcpip.Address, dispatcher stack.TransportDispatcher, linkEP stack.LinkEndpoint) (stack.NetworkEndpoint, error) {
 	return newEndpoint(nicid, addr, dispatcher, linkEP), nil
@@ -11,6 +11,8 @@
 package ipv6
 
 import (
+	"sync/atomic"
+
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip/stack"
@@ -73,16 +75,15 @@ func (e *endpoint) MaxHeaderLength() uint16 {
 }
 
 // WritePacket writes a packet to the given destination address and protocol.
-func (e *endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.TransportProtocolNumber) error {
+func (e *endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.TransportProtocolNumber) error {
 	length := uint16(hdr.UsedLength())
-	if payload != nil {
-		length += uint16(len(payload))
-	}
+	length += uint16(payload.Size())
 	ip := header.IPv6(hdr.Prepend(header.IPv6MinimumSize))
 	ip.Encode(&header.IPv6Fields{
 		PayloadLength: length,
+		TrafficClass:  r.TOS,
 		NextHeader:    uint8(protocol),
-		HopLimit:      65,
+		HopLimit:      r.DefaultTTL(),
 		SrcAddr:       tcpip.Address(e.address[:]),
 		DstAddr:       r.RemoteAddress,
 	})
@@ -92,15 +93,17 @@ func (e *endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload
 
 // HandlePacket is called by the link layer when new ipv6 packets arrive for
 // this endpoint.
-func (e *endpoint) HandlePacket(r *stack.Route, v buffer.View) {
-	h := header.IPv6(v)
+func (e *endpoint) HandlePacket(r *stack.Route, vv buffer.VectorisedView) {
+	h := header.IPv6(vv.ToView())
 	if !h.IsValid() {
+		atomic.AddUint64(&r.Stats().IP.MalformedPacketsReceived, 1)
 		return
 	}
 
-	v.TrimFront(header.IPv6MinimumSize)
-	v.CapLength(int(h.PayloadLength()))
-	e.dispatcher.DeliverTransportPacket(r, tcpip.TransportProtocolNumber(h.NextHeader()), v)
+	r.NetworkHeader = buffer.View(h[:header.IPv6MinimumSize])
+	vv.TrimFront(header.IPv6MinimumSize)
+	vv.CapLength(int(h.PayloadLength()))
+	e.dispatcher.DeliverTransportPacket(r, tcpip.TransportProtocolNumber(h.NextHeader()), vv)
 }
 
 type protocol struct{}
@@ -129,6 +132,19 @@ func (*protocol) ParseAddresses(v buffer.View) (src, dst tcpip.Address) {
 	return h.SourceAddress(), h.DestinationAddress()
 }
 
+// PrepareForward implements stack.ForwardingNetworkProtocol.PrepareForward. It
+// decrements the hop limit of the packet.
+func (*protocol) PrepareForward(v buffer.View) bool {
+	h := header.IPv6(v)
+	if !h.IsValid() || h.HopLimit() <= 1 {
+		return false
+	}
+
+	h.SetHopLimit(h.HopLimit() - 1)
+
+	return true
+}
+
 // NewEndpoint creates a new ipv6 endpoint.
 func (p *protocol) NewEndpoint(nicid tcpip.NICID, addr tcpip.Address, dispatcher stack.TransportDispatcher, linkEP stack.LinkEndpoint) (stack.NetworkEndpoint, error) {
 	return newEndpoint(nicid, addr, dispatcher, linkEP), nil
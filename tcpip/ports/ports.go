@@ -6,15 +6,20 @@
 package ports
 
 import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
 	"math"
-	"math/rand"
+	"math/bits"
+	mathrand "math/rand"
 	"sync"
+	"sync/atomic"
 
 	"github.com/google/netstack/tcpip"
 )
 
 const (
-	// firstEphemeral is the first ephemeral port.
+	// firstEphemeral is the default first ephemeral port.
 	firstEphemeral uint16 = 16000
 )
 
@@ -24,15 +29,166 @@ type portDescriptor struct {
 	port      uint16
 }
 
+// addressKey identifies the reservations of the ports of a protocol for an
+// address.
+type addressKey struct {
+	network   tcpip.NetworkProtocolNumber
+	transport tcpip.TransportProtocolNumber
+	addr      tcpip.Address
+}
+
+// portBitmap is a set of ports, with a bit for each of them.
+type portBitmap [(math.MaxUint16 + 1) / 64]uint64
+
+func (b *portBitmap) set(p uint16) {
+	b[p/64] |= 1 << (p % 64)
+}
+
+func (b *portBitmap) clear(p uint16) {
+	b[p/64] &^= 1 << (p % 64)
+}
+
+// word returns the word of the bitmap that holds the bit of p, or zero if b is
+// nil.
+func (b *portBitmap) word(p uint16) uint64 {
+	if b == nil {
+		return 0
+	}
+	return b[p/64]
+}
+
+// reservedPorts holds the ports reserved for an address, as a bitmap, and
+// their count.
+type reservedPorts struct {
+	ports portBitmap
+	count int
+}
+
+// Flags describe how a port reservation may be shared with others.
+type Flags struct {
+	// ReuseAddr allows the port to be shared between reservations for a
+	// specific address and for all addresses, like SO_REUSEADDR on BSD.
+	// All the reservations involved must have it set.
+	ReuseAddr bool
+
+	// ReusePort allows the port to be shared between reservations for
+	// the same address, like SO_REUSEPORT. All the reservations involved
+	// must have it set.
+	ReusePort bool
+}
+
+// reservation is a reservation of a port for an address. It may be held by
+// multiple endpoints if its flags allow it.
+type reservation struct {
+	flags Flags
+	refs  int
+}
+
+// bindAddresses holds the reservations of a port, indexed by the address the
+// port is reserved for. The empty address stands for all addresses.
+type bindAddresses map[tcpip.Address]*reservation
+
+// isAvailable checks if the port can be reserved for addr with the given
+// flags, that is, if no existing reservation of an overlapping address
+// conflicts with it.
+func (b bindAddresses) isAvailable(addr tcpip.Address, flags Flags) bool {
+	for a, r := range b {
+		if a != addr && a != "" && addr != "" {
+			// The addresses don't overlap.
+			continue
+		}
+
+		if r.flags.ReusePort && flags.ReusePort {
+			continue
+		}
+
+		if a != addr && r.flags.ReuseAddr && flags.ReuseAddr {
+			continue
+		}
+
+		return false
+	}
+
+	return true
+}
+
 // PortManager manages allocating, reserving and releasing ports.
 type PortManager struct {
 	mu             sync.RWMutex
-	allocatedPorts map[portDescriptor]struct{}
+	allocatedPorts map[portDescriptor]bindAddresses
+
+	// reserved indexes the reservations of allocatedPorts by address, so
+	// that searches for ephemeral ports can skip the reserved ones a word
+	// of a bitmap at a time. It's protected by mu.
+	reserved map[addressKey]*reservedPorts
+
+	// ephemeralMu protects the ephemeral port configuration below. It is
+	// separate from mu because ephemeral ports are picked while mu is
+	// held.
+	ephemeralMu    sync.RWMutex
+	firstEphemeral uint16
+	lastEphemeral  uint16
+	excluded       *portBitmap
+
+	// secret is the key of the hash used to pick the starting point of the
+	// search for ephemeral ports for a destination, and nextEphemeral is
+	// incremented on every such search. nextEphemeral is only accessed
+	// atomically.
+	secret        [16]byte
+	nextEphemeral uint32
 }
 
 // NewPortManager creates new PortManager.
 func NewPortManager() *PortManager {
-	return &PortManager{allocatedPorts: make(map[portDescriptor]struct{})}
+	s := &PortManager{
+		allocatedPorts: make(map[portDescriptor]bindAddresses),
+		reserved:       make(map[addressKey]*reservedPorts),
+		firstEphemeral: firstEphemeral,
+		lastEphemeral:  math.MaxUint16,
+	}
+	rand.Read(s.secret[:])
+	return s
+}
+
+// SetEphemeralPortRange sets the range of ports, first and last included, that
+// are picked as ephemeral ports, like Linux's ip_local_port_range. It applies
+// to ports picked from then on.
+func (s *PortManager) SetEphemeralPortRange(first, last uint16) error {
+	if first == 0 || first > last {
+		return tcpip.ErrInvalidPortRange
+	}
+
+	s.ephemeralMu.Lock()
+	s.firstEphemeral = first
+	s.lastEphemeral = last
+	s.ephemeralMu.Unlock()
+
+	return nil
+}
+
+// EphemeralPortRange returns the range of ports, first and last included, that
+// are picked as ephemeral ports.
+func (s *PortManager) EphemeralPortRange() (first, last uint16) {
+	s.ephemeralMu.RLock()
+	defer s.ephemeralMu.RUnlock()
+	return s.firstEphemeral, s.lastEphemeral
+}
+
+// SetExcludedEphemeralPorts sets the ports of the ephemeral range that must
+// never be picked, like Linux's ip_local_reserved_ports. They can still be
+// reserved explicitly.
+func (s *PortManager) SetExcludedEphemeralPorts(ports []uint16) {
+	var excluded *portBitmap
+	if len(ports) != 0 {
+		excluded = new(portBitmap)
+		for _, p := range ports {
+			excluded.set(p)
+		}
+	}
+
+	s.ephemeralMu.Lock()
+	s.excluded = excluded
+	s.ephemeralMu.Unlock()
 }
 
 // PickEphemeralPort randomly chooses a starting point and iterates over all
@@ -40,11 +196,100 @@ func NewPortManager() *PortManager {
 // is suitable for its needs, and stopping when a port is found or an error
 // occurs.
 func (s *PortManager) PickEphemeralPort(testPort func(p uint16) (bool, error)) (port uint16, err error) {
-	count := uint16(math.MaxUint16 - firstEphemeral + 1)
-	offset := uint16(rand.Int31n(int32(count)))
+	return s.pickEphemeralPort(uint32(mathrand.Int63()), testPort)
+}
+
+// PickEphemeralPortForDestination is like PickEphemeralPort, but the starting
+// point is chosen with the "simple hash-based" algorithm of RFC 6056, section
+// 3.3.3: it is derived from a keyed hash of the given addresses and remote
+// port, plus a counter incremented on every call. Connections to the same
+// destination thus use ports that are spread apart, while the ports used for
+// different destinations can't be predicted from each other.
+func (s *PortManager) PickEphemeralPortForDestination(local, remote tcpip.Address, remotePort uint16, testPort func(p uint16) (bool, error)) (port uint16, err error) {
+	return s.pickEphemeralPort(s.destinationOffset(local, remote, remotePort), testPort)
+}
+
+// destinationOffset returns the offset of the range at which the search for an
+// ephemeral port for the given destination starts, as described by
+// PickEphemeralPortForDestination.
+func (s *PortManager) destinationOffset(local, remote tcpip.Address, remotePort uint16) uint32 {
+	h := sha1.New()
+	h.Write(s.secret[:])
+	h.Write([]byte(local))
+	h.Write([]byte(remote))
+
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], remotePort)
+	h.Write(b[:])
+
+	offset := binary.BigEndian.Uint32(h.Sum(nil))
+	next := atomic.AddUint32(&s.nextEphemeral, 1)
+
+	return offset + next
+}
+
+// ephemeralSearch iterates over the ephemeral ports that aren't excluded,
+// starting at an offset of the range and wrapping around at its end.
+type ephemeralSearch struct {
+	first    uint16
+	count    uint32
+	offset   uint32
+	i        uint32
+	excluded *portBitmap
+}
+
+// newEphemeralSearch starts a search at the given offset of the ephemeral
+// range, which is taken modulo its size.
+func (s *PortManager) newEphemeralSearch(offset uint32) ephemeralSearch {
+	s.ephemeralMu.RLock()
+	defer s.ephemeralMu.RUnlock()
+
+	count := uint32(s.lastEphemeral) - uint32(s.firstEphemeral) + 1
+	return ephemeralSearch{
+		first:    s.firstEphemeral,
+		count:    count,
+		offset:   offset % count,
+		excluded: s.excluded,
+	}
+}
+
+// next returns the next port of the search that isn't in skip, which may be
+// nil, or false once all the ports have been returned. Runs of ports that
+// can't be returned are skipped a word of the bitmaps at a time.
+func (e *ephemeralSearch) next(skip *portBitmap) (uint16, bool) {
+	for e.i < e.count {
+		idx := (e.offset + e.i) % e.count
+		port := e.first + uint16(idx)
+
+		w := (e.excluded.word(port) | skip.word(port)) >> (port % 64)
+		n := uint32(bits.TrailingZeros64(^w))
+		if n == 0 {
+			e.i++
+			return port, true
+		}
+
+		// Don't skip past the end of the range, where the search wraps
+		// around.
+		if rest := e.count - idx; n > rest {
+			n = rest
+		}
+		e.i += n
+	}
+
+	return 0, false
+}
+
+// pickEphemeralPort iterates over all the ephemeral ports that aren't excluded,
+// starting at the given offset of the range, until testPort accepts one or
+// returns an error.
+func (s *PortManager) pickEphemeralPort(offset uint32, testPort func(p uint16) (bool, error)) (port uint16, err error) {
+	search := s.newEphemeralSearch(offset)
+	for {
+		port, ok := search.next(nil)
+		if !ok {
+			return 0, tcpip.ErrNoPortAvailable
+		}
 
-	for i := uint16(0); i < count; i++ {
-		port = firstEphemeral + (offset+i)%count
 		ok, err := testPort(port)
 		if err != nil {
 			return 0, err
@@ -54,46 +299,171 @@ func (s *PortManager) PickEphemeralPort(testPort func(p uint16) (bool, error)) (
 			return port, nil
 		}
 	}
+}
+
+// ReserveEphemeralPort picks an ephemeral port, reserves it for addr with the
+// given flags, and returns it once testPort accepts it, e.g., once an endpoint
+// is registered with it. Ports that testPort rejects are released, and the
+// search goes on. The search starts like PickEphemeralPortForDestination's if
+// remote isn't empty, and at a random point of the range otherwise.
+//
+// Unlike PickEphemeralPort's, the search skips the ports reserved for addr that
+// can't be shared with the reservation without trying them, so that it stays
+// fast even when most of the range is in use.
+func (s *PortManager) ReserveEphemeralPort(network tcpip.NetworkProtocolNumber, transport tcpip.TransportProtocolNumber, addr tcpip.Address, flags Flags, remote tcpip.Address, remotePort uint16, testPort func(p uint16) (bool, error)) (port uint16, err error) {
+	offset := uint32(mathrand.Int63())
+	if remote != "" {
+		offset = s.destinationOffset(addr, remote, remotePort)
+	}
 
-	return 0, tcpip.ErrNoPortAvailable
+	search := s.newEphemeralSearch(offset)
+	key := addressKey{network, transport, addr}
+	for {
+		// testPort is called without holding mu, as it may release
+		// ports.
+		s.mu.Lock()
+		port, ok := s.reserveNextLocked(&search, key, flags)
+		s.mu.Unlock()
+		if !ok {
+			return 0, tcpip.ErrNoPortAvailable
+		}
+
+		ok, err := testPort(port)
+		if !ok || err != nil {
+			s.ReleasePort(network, transport, addr, port)
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		if ok {
+			return port, nil
+		}
+	}
 }
 
-// ReservePort marks a port as reserved so that it cannot be reserved by another
-// endpoint. If port is zero, ReservePort will search for an unreserved
-// ephemeral port and reserve it, returning its value in the "port" return value.
-func (s *PortManager) ReservePort(network tcpip.NetworkProtocolNumber, transport tcpip.TransportProtocolNumber, port uint16) (reservedPort uint16, err error) {
+// reserveNextLocked reserves the next port of search that's available for the
+// address of key with the given flags, and returns it, or false if there's
+// none left.
+func (s *PortManager) reserveNextLocked(search *ephemeralSearch, key addressKey, flags Flags) (uint16, bool) {
+	// Ports reserved for the same address can only be shared if both
+	// reservations have ReusePort set.
+	var skip *portBitmap
+	if r := s.reserved[key]; r != nil && !flags.ReusePort {
+		skip = &r.ports
+	}
+
+	for {
+		port, ok := search.next(skip)
+		if !ok {
+			return 0, false
+		}
+
+		if s.reserveLocked(portDescriptor{key.network, key.transport, port}, key.addr, flags) {
+			return port, true
+		}
+	}
+}
+
+// ReservePort marks a port as reserved for the given local address, which may
+// be empty to mean all addresses, so that it cannot be reserved by another
+// endpoint unless their flags allow it. If port is zero, ReservePort will
+// search for an ephemeral port available for the address and reserve it,
+// returning its value in the "port" return value.
+func (s *PortManager) ReservePort(network tcpip.NetworkProtocolNumber, transport tcpip.TransportProtocolNumber, addr tcpip.Address, port uint16, flags Flags) (reservedPort uint16, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	desc := portDescriptor{network, transport, port}
-
 	// If a port is specified, just try to reserve it.
 	if port != 0 {
-		if _, ok := s.allocatedPorts[desc]; ok {
+		if !s.reserveLocked(portDescriptor{network, transport, port}, addr, flags) {
 			return 0, tcpip.ErrPortInUse
 		}
-
-		s.allocatedPorts[desc] = struct{}{}
 		return port, nil
 	}
 
 	// A port wasn't specified, so try to find one.
-	return s.PickEphemeralPort(func(p uint16) (bool, error) {
-		desc.port = p
-		if _, ok := s.allocatedPorts[desc]; ok {
-			return false, nil
-		}
+	search := s.newEphemeralSearch(uint32(mathrand.Int63()))
+	port, ok := s.reserveNextLocked(&search, addressKey{network, transport, addr}, flags)
+	if !ok {
+		return 0, tcpip.ErrNoPortAvailable
+	}
+	return port, nil
+}
+
+// TryReservePort is like ReservePort for a non-zero port, except that it
+// returns false instead of an error if the port is not available. It is
+// meant to be used by the testPort functions passed to PickEphemeralPort and
+// PickEphemeralPortForDestination; ReserveEphemeralPort reserves the ports
+// itself, and skips the reserved ones faster.
+func (s *PortManager) TryReservePort(network tcpip.NetworkProtocolNumber, transport tcpip.TransportProtocolNumber, addr tcpip.Address, port uint16, flags Flags) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.reserveLocked(portDescriptor{network, transport, port}, addr, flags)
+}
+
+// reserveLocked reserves the port described by desc for addr if none of its
+// existing reservations conflict. It returns false if one does.
+func (s *PortManager) reserveLocked(desc portDescriptor, addr tcpip.Address, flags Flags) bool {
+	b := s.allocatedPorts[desc]
+	if !b.isAvailable(addr, flags) {
+		return false
+	}
 
-		s.allocatedPorts[desc] = struct{}{}
-		return true, nil
-	})
+	if b == nil {
+		b = make(bindAddresses)
+		s.allocatedPorts[desc] = b
+	}
+
+	if r, ok := b[addr]; ok {
+		r.refs++
+		return true
+	}
+
+	b[addr] = &reservation{flags: flags, refs: 1}
+
+	key := addressKey{desc.network, desc.transport, addr}
+	r := s.reserved[key]
+	if r == nil {
+		r = &reservedPorts{}
+		s.reserved[key] = r
+	}
+	r.ports.set(desc.port)
+	r.count++
+
+	return true
 }
 
-// ReleasePort releases the reservation on a port so that it can be reserved by
-// other endpoints.
-func (s *PortManager) ReleasePort(network tcpip.NetworkProtocolNumber, transport tcpip.TransportProtocolNumber, port uint16) {
+// ReleasePort releases a reservation on a port so that it can be reserved by
+// other endpoints. The address must be the one the port was reserved for.
+func (s *PortManager) ReleasePort(network tcpip.NetworkProtocolNumber, transport tcpip.TransportProtocolNumber, addr tcpip.Address, port uint16) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	delete(s.allocatedPorts, portDescriptor{network, transport, port})
+	desc := portDescriptor{network, transport, port}
+	b := s.allocatedPorts[desc]
+	r, ok := b[addr]
+	if !ok {
+		return
+	}
+
+	r.refs--
+	if r.refs > 0 {
+		return
+	}
+
+	delete(b, addr)
+	if len(b) == 0 {
+		delete(s.allocatedPorts, desc)
+	}
+
+	key := addressKey{network, transport, addr}
+	rp := s.reserved[key]
+	rp.ports.clear(port)
+	rp.count--
+	if rp.count == 0 {
+		delete(s.reserved, key)
+	}
 }
@@ -0,0 +1,177 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ports
+
+import (
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+)
+
+func TestEphemeralPortRange(t *testing.T) {
+	pm := NewPortManager()
+	if err := pm.SetEphemeralPortRange(100, 99); err != tcpip.ErrInvalidPortRange {
+		t.Fatalf("SetEphemeralPortRange(100, 99) returned %v, want %v", err, tcpip.ErrInvalidPortRange)
+	}
+
+	if err := pm.SetEphemeralPortRange(100, 103); err != nil {
+		t.Fatalf("SetEphemeralPortRange failed: %v", err)
+	}
+	pm.SetExcludedEphemeralPorts([]uint16{101})
+
+	// All the ports of the range except the excluded one are picked, and
+	// then the range is exhausted.
+	picked := make(map[uint16]bool)
+	for i := 0; i < 3; i++ {
+		p, err := pm.ReservePort(0, 0, "", 0, Flags{})
+		if err != nil {
+			t.Fatalf("ReservePort failed: %v", err)
+		}
+		picked[p] = true
+	}
+
+	for _, p := range []uint16{100, 102, 103} {
+		if !picked[p] {
+			t.Errorf("port %d wasn't picked, picked ports are %v", p, picked)
+		}
+	}
+
+	if _, err := pm.ReservePort(0, 0, "", 0, Flags{}); err != tcpip.ErrNoPortAvailable {
+		t.Fatalf("ReservePort returned %v, want %v", err, tcpip.ErrNoPortAvailable)
+	}
+
+	// Excluded ports can still be reserved explicitly.
+	if _, err := pm.ReservePort(0, 0, "", 101, Flags{}); err != nil {
+		t.Fatalf("ReservePort(101) failed: %v", err)
+	}
+}
+
+func TestPickEphemeralPortForDestination(t *testing.T) {
+	pm := NewPortManager()
+	accept := func(uint16) (bool, error) { return true, nil }
+
+	// Consecutive picks for the same destination use consecutive ports.
+	p1, err := pm.PickEphemeralPortForDestination("\x01", "\x02", 80, accept)
+	if err != nil {
+		t.Fatalf("PickEphemeralPortForDestination failed: %v", err)
+	}
+
+	p2, err := pm.PickEphemeralPortForDestination("\x01", "\x02", 80, accept)
+	if err != nil {
+		t.Fatalf("PickEphemeralPortForDestination failed: %v", err)
+	}
+
+	first, last := pm.EphemeralPortRange()
+	want := p1 + 1
+	if p1 == last {
+		want = first
+	}
+	if p2 != want {
+		t.Errorf("second pick = %d, want %d", p2, want)
+	}
+}
+
+func TestReserveEphemeralPort(t *testing.T) {
+	pm := NewPortManager()
+	if err := pm.SetEphemeralPortRange(1000, 50999); err != nil {
+		t.Fatalf("SetEphemeralPortRange failed: %v", err)
+	}
+
+	// Reserve all the ports of the range but one for an address.
+	const free = 27183
+	for p := uint16(1000); p <= 50999; p++ {
+		if p == free {
+			continue
+		}
+		if _, err := pm.ReservePort(0, 0, "\x01", p, Flags{}); err != nil {
+			t.Fatalf("ReservePort(%d) failed: %v", p, err)
+		}
+	}
+
+	// The free port is found without trying any of the reserved ones.
+	tried := 0
+	accept := func(uint16) (bool, error) {
+		tried++
+		return true, nil
+	}
+	p, err := pm.ReserveEphemeralPort(0, 0, "\x01", Flags{}, "\x02", 80, accept)
+	if err != nil {
+		t.Fatalf("ReserveEphemeralPort failed: %v", err)
+	}
+	if p != free || tried != 1 {
+		t.Fatalf("ReserveEphemeralPort returned %d after %d tries, want %d after 1", p, tried, free)
+	}
+
+	if _, err := pm.ReserveEphemeralPort(0, 0, "\x01", Flags{}, "", 0, accept); err != tcpip.ErrNoPortAvailable {
+		t.Fatalf("ReserveEphemeralPort returned %v, want %v", err, tcpip.ErrNoPortAvailable)
+	}
+
+	// Released ports can be picked again, and ports rejected by testPort are
+	// released.
+	pm.ReleasePort(0, 0, "\x01", 1234)
+	reject := func(uint16) (bool, error) { return false, nil }
+	if _, err := pm.ReserveEphemeralPort(0, 0, "\x01", Flags{}, "", 0, reject); err != tcpip.ErrNoPortAvailable {
+		t.Fatalf("ReserveEphemeralPort returned %v, want %v", err, tcpip.ErrNoPortAvailable)
+	}
+	if p, err := pm.ReservePort(0, 0, "\x01", 0, Flags{}); err != nil || p != 1234 {
+		t.Fatalf("ReservePort returned %d, %v, want 1234, nil", p, err)
+	}
+
+	// Other addresses still have all the ports.
+	if _, err := pm.ReserveEphemeralPort(0, 0, "\x03", Flags{}, "", 0, accept); err != nil {
+		t.Fatalf("ReserveEphemeralPort failed: %v", err)
+	}
+}
+
+func TestPortReservationConflicts(t *testing.T) {
+	const port = 80
+	reuseAddr := Flags{ReuseAddr: true}
+	reusePort := Flags{ReusePort: true}
+	tests := []struct {
+		comment string
+		first   tcpip.Address
+		flags1  Flags
+		second  tcpip.Address
+		flags2  Flags
+		want    error
+	}{
+		{"Same address", "\x01", Flags{}, "\x01", Flags{}, tcpip.ErrPortInUse},
+		{"Different addresses", "\x01", Flags{}, "\x02", Flags{}, nil},
+		{"Specific then wildcard", "\x01", Flags{}, "", Flags{}, tcpip.ErrPortInUse},
+		{"Wildcard then specific", "", Flags{}, "\x01", Flags{}, tcpip.ErrPortInUse},
+		{"Wildcard twice", "", Flags{}, "", Flags{}, tcpip.ErrPortInUse},
+		{"Wildcard and specific with REUSEADDR", "", reuseAddr, "\x01", reuseAddr, nil},
+		{"REUSEADDR on one side only", "", reuseAddr, "\x01", Flags{}, tcpip.ErrPortInUse},
+		{"Same address with REUSEADDR", "\x01", reuseAddr, "\x01", reuseAddr, tcpip.ErrPortInUse},
+		{"Same address with REUSEPORT", "\x01", reusePort, "\x01", reusePort, nil},
+		{"Wildcard twice with REUSEPORT", "", reusePort, "", reusePort, nil},
+	}
+
+	for _, test := range tests {
+		pm := NewPortManager()
+		if _, err := pm.ReservePort(0, 0, test.first, port, test.flags1); err != nil {
+			t.Fatalf("%s: first ReservePort failed: %v", test.comment, err)
+		}
+
+		if _, err := pm.ReservePort(0, 0, test.second, port, test.flags2); err != test.want {
+			t.Errorf("%s: second ReservePort returned %v, want %v", test.comment, err, test.want)
+		}
+	}
+
+	// Shared reservations are only released when all their holders release
+	// them.
+	pm := NewPortManager()
+	pm.ReservePort(0, 0, "", port, reusePort)
+	pm.ReservePort(0, 0, "", port, reusePort)
+	pm.ReleasePort(0, 0, "", port)
+	if pm.TryReservePort(0, 0, "", port, Flags{}) {
+		t.Errorf("TryReservePort succeeded while the port is still reserved")
+	}
+
+	pm.ReleasePort(0, 0, "", port)
+	if !pm.TryReservePort(0, 0, "", port, Flags{}) {
+		t.Errorf("TryReservePort failed after all reservations were released")
+	}
+}
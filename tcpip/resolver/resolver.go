@@ -0,0 +1,434 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package resolver provides a stub DNS resolver that sends its queries through
+// a netstack stack, so that applications embedding the stack can resolve names
+// without going through the resolver of the host.
+//
+// Queries are sent over UDP and retried over TCP when the response is
+// truncated. Nameservers are configured explicitly, e.g., with the servers
+// learned from DHCP, and tried in order until one of them answers.
+package resolver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/adapters/gonet"
+	"github.com/google/netstack/tcpip/header"
+)
+
+const (
+	// DefaultPort is the port used for nameservers whose port is zero.
+	DefaultPort = 53
+
+	// queryTimeout is the time a nameserver is given to answer a query,
+	// unless the context expires earlier.
+	queryTimeout = 5 * time.Second
+
+	// maxUDPSize is the size of the largest response accepted over UDP.
+	maxUDPSize = 512
+)
+
+var (
+	errNoNameservers  = errors.New("no nameservers configured")
+	errNoSuchHost     = errors.New("no such host")
+	errServerFailure  = errors.New("server misbehaving")
+	errInvalidAddress = errors.New("invalid address")
+)
+
+// Resolver is a stub DNS resolver that sends its queries through a stack. It
+// is safe for concurrent use.
+type Resolver struct {
+	stack tcpip.Stack
+
+	mu      sync.RWMutex
+	servers []tcpip.FullAddress
+}
+
+// New creates a new resolver that sends its queries through the given stack,
+// to the given nameservers.
+func New(s tcpip.Stack, servers []tcpip.FullAddress) *Resolver {
+	r := &Resolver{stack: s}
+	r.SetNameservers(servers)
+	return r
+}
+
+// SetNameservers replaces the nameservers queried by the resolver. Servers
+// whose port is zero are queried on DefaultPort.
+func (r *Resolver) SetNameservers(servers []tcpip.FullAddress) {
+	s := make([]tcpip.FullAddress, len(servers))
+	for i, a := range servers {
+		if a.Port == 0 {
+			a.Port = DefaultPort
+		}
+		s[i] = a
+	}
+
+	r.mu.Lock()
+	r.servers = s
+	r.mu.Unlock()
+}
+
+// Nameservers returns the nameservers queried by the resolver.
+func (r *Resolver) Nameservers() []tcpip.FullAddress {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]tcpip.FullAddress(nil), r.servers...)
+}
+
+// LookupIP returns the IPv4 and IPv6 addresses of the given host, looking up
+// its A and AAAA records. If host is an IP address literal, it is returned as
+// is.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]tcpip.Address, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return []tcpip.Address{tcpip.Address(ip4)}, nil
+		}
+		return []tcpip.Address{tcpip.Address(ip)}, nil
+	}
+
+	var addrs []tcpip.Address
+	var lastErr error
+	for _, qtype := range []uint16{typeA, typeAAAA} {
+		answers, err := r.lookup(ctx, host, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, a := range answers {
+			addrs = append(addrs, tcpip.Address(a.data))
+		}
+	}
+
+	if len(addrs) == 0 {
+		if lastErr == nil {
+			lastErr = &net.DNSError{Err: errNoSuchHost.Error(), Name: host, IsNotFound: true}
+		}
+		return nil, lastErr
+	}
+
+	return addrs, nil
+}
+
+// LookupIPv4 returns the IPv4 addresses of the given host, looking up its A
+// records.
+func (r *Resolver) LookupIPv4(ctx context.Context, host string) ([]tcpip.Address, error) {
+	return r.lookupAddrs(ctx, host, typeA)
+}
+
+// LookupIPv6 returns the IPv6 addresses of the given host, looking up its AAAA
+// records.
+func (r *Resolver) LookupIPv6(ctx context.Context, host string) ([]tcpip.Address, error) {
+	return r.lookupAddrs(ctx, host, typeAAAA)
+}
+
+func (r *Resolver) lookupAddrs(ctx context.Context, host string, qtype uint16) ([]tcpip.Address, error) {
+	answers, err := r.lookup(ctx, host, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]tcpip.Address, 0, len(answers))
+	for _, a := range answers {
+		addrs = append(addrs, tcpip.Address(a.data))
+	}
+	return addrs, nil
+}
+
+// LookupAddr returns the names of the given IPv4 or IPv6 address, looking up
+// its PTR records. The names are fully qualified, i.e., end with a dot.
+func (r *Resolver) LookupAddr(ctx context.Context, addr tcpip.Address) ([]string, error) {
+	name, err := reverseName(addr)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: string(addr)}
+	}
+
+	answers, err := r.lookup(ctx, name, typePTR)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(answers))
+	for _, a := range answers {
+		names = append(names, a.target)
+	}
+	return names, nil
+}
+
+// lookup queries the nameservers, in order, for the records of the given type
+// and name. It returns the answers of that type, or an error if none were
+// found. CNAME records in the answers are skipped, as recursive nameservers
+// include the records of their target.
+func (r *Resolver) lookup(ctx context.Context, name string, qtype uint16) ([]resource, error) {
+	servers := r.Nameservers()
+	if len(servers) == 0 {
+		return nil, &net.DNSError{Err: errNoNameservers.Error(), Name: name}
+	}
+
+	q := question{name: name, qtype: qtype, class: classINET}
+	if _, err := appendName(nil, name); err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name}
+	}
+
+	var lastErr error
+	for _, server := range servers {
+		m, err := r.exchange(ctx, server, q)
+		if err != nil {
+			lastErr = newDNSError(err, name, server)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		switch m.rcode() {
+		case rcodeSuccess:
+		case rcodeNameError:
+			return nil, &net.DNSError{Err: errNoSuchHost.Error(), Name: name, Server: serverString(server), IsNotFound: true}
+		default:
+			// Try the next server.
+			lastErr = &net.DNSError{Err: errServerFailure.Error(), Name: name, Server: serverString(server), IsTemporary: true}
+			continue
+		}
+
+		var answers []resource
+		for _, a := range m.answers {
+			if a.rtype != qtype || a.class != classINET {
+				continue
+			}
+			if (qtype == typeA && len(a.data) != header.IPv4AddressSize) || (qtype == typeAAAA && len(a.data) != header.IPv6AddressSize) {
+				continue
+			}
+			answers = append(answers, a)
+		}
+
+		if len(answers) == 0 {
+			return nil, &net.DNSError{Err: errNoSuchHost.Error(), Name: name, Server: serverString(server), IsNotFound: true}
+		}
+		return answers, nil
+	}
+
+	return nil, lastErr
+}
+
+// exchange sends a query to the given server and returns its response. The
+// query is sent over UDP and retried over TCP if the response is truncated.
+func (r *Resolver) exchange(ctx context.Context, server tcpip.FullAddress, q question) (*message, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	network, err := networkProtocol(server.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	req := message{id: id, flags: flagRecursion, questions: []question{q}}
+	b, err := req.pack()
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := r.exchangeUDP(ctx, server, network, b, &req)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.flags&flagTruncated != 0 {
+		return r.exchangeTCP(ctx, server, network, b, &req)
+	}
+
+	return m, nil
+}
+
+func (r *Resolver) exchangeUDP(ctx context.Context, server tcpip.FullAddress, network tcpip.NetworkProtocolNumber, b []byte, req *message) (*message, error) {
+	c, err := gonet.DialUDP(r.stack, nil, &server, network)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	stop := watchContext(ctx, c)
+	defer stop()
+
+	if _, err := c.Write(b); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+
+		// Ignore responses that don't match the query, which may be
+		// late answers to previous queries or spoofed.
+		var m message
+		if err := m.unpack(buf[:n]); err != nil {
+			continue
+		}
+		if isResponse(req, &m) {
+			return &m, nil
+		}
+	}
+}
+
+func (r *Resolver) exchangeTCP(ctx context.Context, server tcpip.FullAddress, network tcpip.NetworkProtocolNumber, b []byte, req *message) (*message, error) {
+	c, err := gonet.DialContextTCP(ctx, r.stack, server, network)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	stop := watchContext(ctx, c)
+	defer stop()
+
+	// Messages are prefixed with their length over TCP.
+	msg := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(msg, uint16(len(b)))
+	copy(msg[2:], b)
+	if _, err := c.Write(msg); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	var l [2]byte
+	if _, err := io.ReadFull(c, l[:]); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	var m message
+	if err := m.unpack(buf); err != nil {
+		return nil, err
+	}
+	if !isResponse(req, &m) {
+		return nil, errServerFailure
+	}
+
+	return &m, nil
+}
+
+// watchContext makes the I/O on c fail once ctx is done. The returned function
+// must be called when the I/O is done.
+func watchContext(ctx context.Context, c interface{ SetDeadline(time.Time) error }) (stop func()) {
+	if d, ok := ctx.Deadline(); ok {
+		c.SetDeadline(d)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Expire the deadline now.
+			c.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// contextError returns the error of ctx if it is done, which is the cause of
+// the given I/O error, or err otherwise.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// isResponse returns whether m is a response to req.
+func isResponse(req, m *message) bool {
+	if m.id != req.id || m.flags&flagResponse == 0 || len(m.questions) != 1 {
+		return false
+	}
+
+	q, rq := m.questions[0], req.questions[0]
+	return q.qtype == rq.qtype && q.class == rq.class && strings.EqualFold(strings.TrimSuffix(q.name, "."), strings.TrimSuffix(rq.name, "."))
+}
+
+func newID() (uint16, error) {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b[:]), nil
+}
+
+// networkProtocol returns the network protocol of the given address.
+func networkProtocol(addr tcpip.Address) (tcpip.NetworkProtocolNumber, error) {
+	switch len(addr) {
+	case header.IPv4AddressSize:
+		return header.IPv4ProtocolNumber, nil
+	case header.IPv6AddressSize:
+		return header.IPv6ProtocolNumber, nil
+	}
+	return 0, errInvalidAddress
+}
+
+// reverseName returns the name of the PTR records of the given address, e.g.,
+// "4.3.2.1.in-addr.arpa." for 1.2.3.4.
+func reverseName(addr tcpip.Address) (string, error) {
+	var b strings.Builder
+	switch len(addr) {
+	case header.IPv4AddressSize:
+		for i := len(addr) - 1; i >= 0; i-- {
+			b.WriteString(strconv.Itoa(int(addr[i])))
+			b.WriteByte('.')
+		}
+		b.WriteString("in-addr.arpa.")
+
+	case header.IPv6AddressSize:
+		const hex = "0123456789abcdef"
+		for i := len(addr) - 1; i >= 0; i-- {
+			b.WriteByte(hex[addr[i]&0xf])
+			b.WriteByte('.')
+			b.WriteByte(hex[addr[i]>>4])
+			b.WriteByte('.')
+		}
+		b.WriteString("ip6.arpa.")
+
+	default:
+		return "", errInvalidAddress
+	}
+
+	return b.String(), nil
+}
+
+func serverString(server tcpip.FullAddress) string {
+	return net.JoinHostPort(net.IP(server.Addr).String(), strconv.Itoa(int(server.Port)))
+}
+
+// newDNSError wraps an error that occurred while querying the given server.
+func newDNSError(err error, name string, server tcpip.FullAddress) *net.DNSError {
+	e := &net.DNSError{Err: err.Error(), Name: name, Server: serverString(server)}
+	if err == context.DeadlineExceeded {
+		e.IsTimeout = true
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		e.IsTimeout = true
+	}
+	if e.IsTimeout {
+		e.Err = "i/o timeout"
+	}
+	return e
+}
@@ -0,0 +1,244 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/adapters/gonet"
+	"github.com/google/netstack/tcpip/link/loopback"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/google/netstack/tcpip/transport/udp"
+)
+
+const (
+	nicID      = 1
+	serverAddr = tcpip.Address("\x7f\x00\x00\x01")
+)
+
+// records maps the names and types of the records known to the fake server to
+// their answers.
+type records map[question][]resource
+
+// fakeServer is a nameserver answering the queries sent to it over UDP and
+// TCP from a fixed set of records.
+type fakeServer struct {
+	records records
+
+	// truncate makes the server truncate its UDP responses.
+	truncate bool
+}
+
+func (f *fakeServer) respond(b []byte) []byte {
+	var req message
+	if err := req.unpack(b); err != nil || len(req.questions) != 1 {
+		return nil
+	}
+
+	q := req.questions[0]
+	resp := message{
+		id:        req.id,
+		flags:     flagResponse | flagRecursion,
+		questions: req.questions,
+	}
+
+	if answers, ok := f.records[question{name: q.name, qtype: q.qtype, class: q.class}]; ok {
+		resp.answers = answers
+	} else {
+		resp.flags |= rcodeNameError
+	}
+
+	out, err := resp.pack()
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+func (f *fakeServer) serveUDP(c *gonet.PacketConn) {
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, from, err := c.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		resp := f.respond(buf[:n])
+		if f.truncate {
+			var m message
+			m.unpack(resp)
+			m.flags |= flagTruncated
+			m.answers = nil
+			resp, _ = m.pack()
+		}
+		c.WriteTo(resp, from)
+	}
+}
+
+func (f *fakeServer) serveTCP(l *gonet.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		var lb [2]byte
+		if _, err := io.ReadFull(c, lb[:]); err == nil {
+			b := make([]byte, binary.BigEndian.Uint16(lb[:]))
+			if _, err := io.ReadFull(c, b); err == nil {
+				resp := f.respond(b)
+				out := make([]byte, 2+len(resp))
+				binary.BigEndian.PutUint16(out, uint16(len(resp)))
+				copy(out[2:], resp)
+				c.Write(out)
+			}
+		}
+		c.Close()
+	}
+}
+
+func newTestResolver(t *testing.T, f *fakeServer) (*Resolver, func()) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName, udp.ProtocolName})
+
+	if err := s.CreateNIC(nicID, loopback.New()); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(nicID, ipv4.ProtocolNumber, serverAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         nicID,
+	}})
+
+	addr := tcpip.FullAddress{nicID, serverAddr, DefaultPort}
+
+	pc, err := gonet.NewPacketConn(s, addr, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("NewPacketConn failed: %v", err)
+	}
+	go f.serveUDP(pc)
+
+	l, err := gonet.NewListener(s, addr, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("NewListener failed: %v", err)
+	}
+	go f.serveTCP(l)
+
+	r := New(s, []tcpip.FullAddress{{Addr: serverAddr}})
+	return r, func() {
+		pc.Close()
+		l.Close()
+	}
+}
+
+var testRecords = records{
+	{"www.example.com.", typeA, classINET}: {
+		{name: "www.example.com.", rtype: typeA, class: classINET, ttl: 60, data: []byte{10, 0, 0, 1}},
+		{name: "www.example.com.", rtype: typeA, class: classINET, ttl: 60, data: []byte{10, 0, 0, 2}},
+	},
+	{"www.example.com.", typeAAAA, classINET}: {
+		{name: "www.example.com.", rtype: typeAAAA, class: classINET, ttl: 60, data: []byte("\xfe\x80\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")},
+	},
+	{"1.0.0.10.in-addr.arpa.", typePTR, classINET}: {
+		{name: "1.0.0.10.in-addr.arpa.", rtype: typePTR, class: classINET, ttl: 60, target: "www.example.com."},
+	},
+}
+
+func TestLookupIP(t *testing.T) {
+	for _, truncate := range []bool{false, true} {
+		r, cleanup := newTestResolver(t, &fakeServer{records: testRecords, truncate: truncate})
+
+		got, err := r.LookupIP(context.Background(), "www.example.com")
+		if err != nil {
+			t.Fatalf("LookupIP failed (truncate=%t): %v", truncate, err)
+		}
+
+		want := []tcpip.Address{
+			"\x0a\x00\x00\x01",
+			"\x0a\x00\x00\x02",
+			"\xfe\x80\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01",
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("LookupIP returned %v, want %v (truncate=%t)", got, want, truncate)
+		}
+
+		cleanup()
+	}
+}
+
+func TestLookupNotFound(t *testing.T) {
+	r, cleanup := newTestResolver(t, &fakeServer{records: testRecords})
+	defer cleanup()
+
+	_, err := r.LookupIPv4(context.Background(), "nonexistent.example.com")
+	if de, ok := err.(*net.DNSError); !ok || !de.IsNotFound {
+		t.Fatalf("LookupIPv4 returned %v, want a not found error", err)
+	}
+}
+
+func TestLookupAddr(t *testing.T) {
+	r, cleanup := newTestResolver(t, &fakeServer{records: testRecords})
+	defer cleanup()
+
+	got, err := r.LookupAddr(context.Background(), "\x0a\x00\x00\x01")
+	if err != nil {
+		t.Fatalf("LookupAddr failed: %v", err)
+	}
+
+	if want := []string{"www.example.com."}; !reflect.DeepEqual(got, want) {
+		t.Errorf("LookupAddr returned %v, want %v", got, want)
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	tests := []struct {
+		addr tcpip.Address
+		want string
+	}{
+		{"\x01\x02\x03\x04", "4.3.2.1.in-addr.arpa."},
+		{"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."},
+	}
+
+	for _, test := range tests {
+		got, err := reverseName(test.addr)
+		if err != nil {
+			t.Errorf("reverseName(%q) failed: %v", test.addr, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("reverseName(%q) = %q, want %q", test.addr, got, test.want)
+		}
+	}
+}
+
+func TestReadCompressedName(t *testing.T) {
+	// "example.com." at offset 0, and "www" followed by a pointer to it.
+	msg := []byte("\x07example\x03com\x00\x03www\xc0\x00")
+
+	name, off, err := readName(msg, 13)
+	if err != nil {
+		t.Fatalf("readName failed: %v", err)
+	}
+	if name != "www.example.com." || off != len(msg) {
+		t.Errorf("readName returned (%q, %d), want (%q, %d)", name, off, "www.example.com.", len(msg))
+	}
+
+	// A pointer to itself must not loop forever.
+	if _, _, err := readName([]byte("\xc0\x00"), 0); err != errInvalidPointer {
+		t.Errorf("readName of a looping pointer returned %v, want %v", err, errInvalidPointer)
+	}
+}
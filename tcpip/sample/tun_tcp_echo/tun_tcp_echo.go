@@ -8,6 +8,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"math/rand"
 	"net"
@@ -27,27 +28,16 @@ import (
 	"github.com/google/netstack/waiter"
 )
 
-func echo(wq *waiter.Queue, ep tcpip.Endpoint) {
+func echo(ep *tcpip.BlockingEndpoint) {
 	defer ep.Close()
 
-	// Create wait queue entry that notifies a channel.
-	waitEntry, notifyCh := waiter.NewChannelEntry(nil)
-
-	wq.EventRegister(&waitEntry, waiter.EventIn)
-	defer wq.EventUnregister(&waitEntry)
-
 	for {
-		v, err := ep.Read(nil)
+		v, err := ep.ReadContext(context.Background(), nil)
 		if err != nil {
-			if err == tcpip.ErrWouldBlock {
-				<-notifyCh
-				continue
-			}
-
 			return
 		}
 
-		ep.Write(v, nil)
+		ep.WriteContext(context.Background(), v, nil)
 	}
 }
 
@@ -136,21 +126,13 @@ func main() {
 	}
 
 	// Wait for connections to appear.
-	waitEntry, notifyCh := waiter.NewChannelEntry(nil)
-	wq.EventRegister(&waitEntry, waiter.EventIn)
-	defer wq.EventUnregister(&waitEntry)
-
+	l := tcpip.NewBlockingEndpoint(ep, &wq)
 	for {
-		n, wq, err := ep.Accept()
+		n, err := l.AcceptContext(context.Background())
 		if err != nil {
-			if err == tcpip.ErrWouldBlock {
-				<-notifyCh
-				continue
-			}
-
 			log.Fatal("Accept() failed:", err)
 		}
 
-		go echo(wq, n)
+		go echo(n)
 	}
 }
@@ -0,0 +1,258 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+)
+
+// DefaultDADRetransmitTimer is the time waited after each neighbor solicitation
+// sent by duplicate address detection unless NICConfig.DADRetransmitTimer is
+// set. It is the default RetransTimer of RFC 4861, section 10.
+const DefaultDADRetransmitTimer = time.Second
+
+// AddressState is the state of an address assigned to a NIC.
+type AddressState int
+
+// The following are the states an address can be in.
+const (
+	// AddressAssigned indicates that the address can be used.
+	AddressAssigned AddressState = iota
+
+	// AddressTentative indicates that duplicate address detection is in
+	// progress for the address, which can't be used until it completes.
+	AddressTentative
+
+	// AddressDuplicated indicates that duplicate address detection found
+	// that the address is used by another node. It can't be used, and
+	// must be removed before it is added again.
+	AddressDuplicated
+)
+
+// String implements fmt.Stringer.String.
+func (s AddressState) String() string {
+	switch s {
+	case AddressAssigned:
+		return "assigned"
+	case AddressTentative:
+		return "tentative"
+	case AddressDuplicated:
+		return "duplicated"
+	default:
+		return "unknown"
+	}
+}
+
+// needsDADLocked returns whether duplicate address detection must be performed
+// for addresses of the given protocol added to n. Loopback NICs don't perform it,
+// as they would receive their own solicitations.
+func (n *NIC) needsDADLocked(protocol tcpip.NetworkProtocolNumber) bool {
+	return protocol == header.IPv6ProtocolNumber &&
+		n.config.DADTransmits > 0 &&
+		n.linkEP.Capabilities()&CapabilityLoopback == 0
+}
+
+// startDADLocked marks the address of r as tentative and starts duplicate
+// address detection for it.
+func (n *NIC) startDADLocked(r *referencedNetworkEndpoint) {
+	r.state = AddressTentative
+	r.dadStop = make(chan struct{})
+	n.tentative++
+
+	transmits := int(n.config.DADTransmits)
+	interval := n.config.DADRetransmitTimer
+	if interval <= 0 {
+		interval = DefaultDADRetransmitTimer
+	}
+
+	r.incRef()
+	stop := r.dadStop
+	n.stack.Go(func() {
+		defer r.decRef()
+		n.runDAD(r, stop, transmits, interval)
+	})
+}
+
+// runDAD sends the neighbor solicitations of the duplicate address detection of
+// r, per RFC 4862, section 5.4. If no conflict is found once they have all been
+// answered, the address becomes assigned.
+func (n *NIC) runDAD(r *referencedNetworkEndpoint, stop <-chan struct{}, transmits int, interval time.Duration) {
+	clock := n.stack.Clock()
+	for i := 0; i < transmits; i++ {
+		n.sendDADSolicitation(r)
+
+		t := clock.NewTimer(interval)
+		select {
+		case <-t.C():
+		case <-stop:
+			t.Stop()
+			return
+		}
+	}
+
+	n.completeDAD(r, AddressAssigned)
+}
+
+// sendDADSolicitation sends a neighbor solicitation for the tentative address of
+// r, from the unspecified address to its solicited-node multicast address.
+func (n *NIC) sendDADSolicitation(r *referencedNetworkEndpoint) {
+	addr := r.ep.ID().LocalAddress
+	dst := header.SolicitedNodeAddr(addr)
+
+	payload := buffer.NewView(header.ICMPv6NeighborSolicitMinimumSize)
+	icmp := header.ICMPv6(payload)
+	icmp.SetType(header.ICMPv6NeighborSolicit)
+	icmp.SetNDPTargetAddress(addr)
+	icmp.SetChecksum(header.ICMPv6Checksum(icmp, header.IPv6Any, dst))
+
+	hdr := buffer.NewPrependable(header.IPv6MinimumSize + int(n.linkEP.MaxHeaderLength()))
+	ip := header.IPv6(hdr.Prepend(header.IPv6MinimumSize))
+	ip.Encode(&header.IPv6Fields{
+		PayloadLength: uint16(len(payload)),
+		NextHeader:    uint8(header.ICMPv6ProtocolNumber),
+		HopLimit:      header.NDPHopLimit,
+		SrcAddr:       header.IPv6Any,
+		DstAddr:       dst,
+	})
+
+	rt := makeRoute(header.IPv6ProtocolNumber, header.IPv6Any, dst, r)
+	rt.writeLinkPacket(&hdr, payload)
+}
+
+// completeDAD ends the duplicate address detection of r, if it is still in
+// progress, moving its address to the given state, and notifies the stack.
+func (n *NIC) completeDAD(r *referencedNetworkEndpoint, state AddressState) {
+	n.mu.Lock()
+	ok := n.stopDADLocked(r, state)
+	n.mu.Unlock()
+
+	if ok {
+		addr := r.ep.ID().LocalAddress
+		if state == AddressDuplicated {
+			n.stack.Log(LogWarning, "duplicate address detected", "nic", n.id, "addr", addr)
+		}
+		n.stack.routes.invalidate()
+		n.stack.dadCompleted(n.id, addr, state)
+		n.stack.emit(Event{
+			Type:    EventAddressStateChanged,
+			NIC:     n.id,
+			Address: ProtocolAddress{r.protocol, addr, r.prefixLen},
+			State:   state,
+		})
+	}
+}
+
+// stopDADLocked stops the duplicate address detection of r and moves its address
+// to the given state. It returns false if it wasn't in progress.
+func (n *NIC) stopDADLocked(r *referencedNetworkEndpoint, state AddressState) bool {
+	if r.dadStop == nil {
+		return false
+	}
+
+	close(r.dadStop)
+	r.dadStop = nil
+	r.state = state
+	n.tentative--
+
+	return true
+}
+
+// checkDADConflict checks whether v, an IPv6 packet received by n, shows that a
+// tentative address of n is used by another node: that is, whether it is a
+// neighbor advertisement for the address, or a neighbor solicitation for it
+// sent by a node performing duplicate address detection as well.
+func (n *NIC) checkDADConflict(v buffer.View) {
+	h := header.IPv6(v)
+	if !h.IsValid() || h.NextHeader() != uint8(header.ICMPv6ProtocolNumber) || h.HopLimit() != header.NDPHopLimit {
+		return
+	}
+
+	icmp := header.ICMPv6(h.Payload())
+	if len(icmp) < header.ICMPv6NeighborSolicitMinimumSize || icmp.Code() != 0 {
+		return
+	}
+
+	switch icmp.Type() {
+	case header.ICMPv6NeighborAdvert:
+	case header.ICMPv6NeighborSolicit:
+		if h.SourceAddress() != header.IPv6Any {
+			return
+		}
+	default:
+		return
+	}
+
+	if header.ICMPv6Checksum(icmp, h.SourceAddress(), h.DestinationAddress()) != 0 {
+		return
+	}
+
+	n.mu.RLock()
+	r := n.endpoints[NetworkEndpointID{icmp.NDPTargetAddress()}]
+	n.mu.RUnlock()
+
+	if r != nil {
+		n.completeDAD(r, AddressDuplicated)
+	}
+}
+
+// SubscribeDAD registers h to be called whenever duplicate address detection
+// completes for an address, with AddressAssigned if the address can now be
+// used, or AddressDuplicated if another node uses it. It returns a function
+// that unregisters h.
+//
+// Handlers are called synchronously, so they must not block.
+func (s *Stack) SubscribeDAD(h func(nicID tcpip.NICID, addr tcpip.Address, state AddressState)) (cancel func()) {
+	s.dadMu.Lock()
+	id := s.nextDADID
+	s.nextDADID++
+	s.dadHandlers[id] = h
+	s.dadMu.Unlock()
+
+	return func() {
+		s.dadMu.Lock()
+		delete(s.dadHandlers, id)
+		s.dadMu.Unlock()
+	}
+}
+
+// dadCompleted notifies the subscribers that duplicate address detection
+// completed for the given address.
+func (s *Stack) dadCompleted(nicID tcpip.NICID, addr tcpip.Address, state AddressState) {
+	s.dadMu.Lock()
+	handlers := make([]func(tcpip.NICID, tcpip.Address, AddressState), 0, len(s.dadHandlers))
+	for _, h := range s.dadHandlers {
+		handlers = append(handlers, h)
+	}
+	s.dadMu.Unlock()
+
+	for _, h := range handlers {
+		h(nicID, addr, state)
+	}
+}
+
+// AddressState returns the state of the given address of the given NIC.
+func (s *Stack) AddressState(nicID tcpip.NICID, addr tcpip.Address) (AddressState, error) {
+	s.mu.RLock()
+	nic := s.nics[nicID]
+	s.mu.RUnlock()
+
+	if nic == nil {
+		return 0, tcpip.ErrUnknownNICID
+	}
+
+	nic.mu.RLock()
+	defer nic.mu.RUnlock()
+
+	r := nic.endpoints[NetworkEndpointID{addr}]
+	if r == nil || !r.holdsInsertRef {
+		return 0, tcpip.ErrBadLocalAddress
+	}
+
+	return r.state, nil
+}
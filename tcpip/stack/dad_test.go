@@ -0,0 +1,170 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/network/ipv6"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+const (
+	dadAddr  = tcpip.Address("\xfe\x80\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+	peerAddr = tcpip.Address("\xfe\x80\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02")
+)
+
+type dadResult struct {
+	nicID tcpip.NICID
+	addr  tcpip.Address
+	state stack.AddressState
+}
+
+// newDADStack creates a stack with an IPv6 NIC that performs duplicate address
+// detection with the given settings, and subscribes to its results.
+func newDADStack(t *testing.T, transmits uint8, timer time.Duration) (*stack.Stack, *channel.Endpoint, chan dadResult) {
+	s := stack.New([]string{ipv6.ProtocolName}, nil).(*stack.Stack)
+
+	id, linkEP := channel.New(10, defaultMTU)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.SetNICConfig(1, stack.NICConfig{DADTransmits: transmits, DADRetransmitTimer: timer}); err != nil {
+		t.Fatalf("SetNICConfig failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{{header.IPv6Any, header.IPv6Any, "", 1}})
+
+	results := make(chan dadResult, 1)
+	s.SubscribeDAD(func(nicID tcpip.NICID, addr tcpip.Address, state stack.AddressState) {
+		results <- dadResult{nicID, addr, state}
+	})
+
+	return s, linkEP, results
+}
+
+// checkSolicitation checks that linkEP sent a DAD neighbor solicitation for
+// addr.
+func checkSolicitation(t *testing.T, linkEP *channel.Endpoint, addr tcpip.Address) {
+	var p channel.PacketInfo
+	select {
+	case p = <-linkEP.C:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no neighbor solicitation sent")
+	}
+
+	h := header.IPv6(p.Header)
+	if h.SourceAddress() != header.IPv6Any || h.DestinationAddress() != header.SolicitedNodeAddr(addr) || h.HopLimit() != header.NDPHopLimit {
+		t.Fatalf("solicitation sent from %v to %v with hop limit %d, want from %v to %v with hop limit %d", h.SourceAddress(), h.DestinationAddress(), h.HopLimit(), header.IPv6Any, header.SolicitedNodeAddr(addr), header.NDPHopLimit)
+	}
+
+	icmp := header.ICMPv6(p.Payload)
+	if icmp.Type() != header.ICMPv6NeighborSolicit || icmp.NDPTargetAddress() != addr {
+		t.Fatalf("got ICMPv6 type %d for %v, want neighbor solicitation for %v", icmp.Type(), icmp.NDPTargetAddress(), addr)
+	}
+
+	if xsum := header.ICMPv6Checksum(icmp, h.SourceAddress(), h.DestinationAddress()); xsum != 0 {
+		t.Fatalf("bad ICMPv6 checksum")
+	}
+}
+
+func TestDADAssigned(t *testing.T) {
+	s, linkEP, results := newDADStack(t, 2, time.Millisecond)
+
+	if err := s.AddAddress(1, ipv6.ProtocolNumber, dadAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	checkSolicitation(t, linkEP, dadAddr)
+	checkSolicitation(t, linkEP, dadAddr)
+
+	select {
+	case r := <-results:
+		if r != (dadResult{1, dadAddr, stack.AddressAssigned}) {
+			t.Fatalf("got DAD result %+v, want %v assigned on NIC 1", r, dadAddr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("DAD didn't complete")
+	}
+
+	if state, err := s.AddressState(1, dadAddr); err != nil || state != stack.AddressAssigned {
+		t.Fatalf("AddressState = %v, %v, want %v", state, err, stack.AddressAssigned)
+	}
+
+	r, err := s.FindRoute(0, dadAddr, peerAddr, ipv6.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("FindRoute failed: %v", err)
+	}
+	r.Release()
+}
+
+func TestDADDuplicated(t *testing.T) {
+	s, linkEP, results := newDADStack(t, 1, time.Hour)
+
+	if err := s.AddAddress(1, ipv6.ProtocolNumber, dadAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	checkSolicitation(t, linkEP, dadAddr)
+
+	// The address can't be used while it is tentative.
+	if state, err := s.AddressState(1, dadAddr); err != nil || state != stack.AddressTentative {
+		t.Fatalf("AddressState = %v, %v, want %v", state, err, stack.AddressTentative)
+	}
+
+	if _, err := s.FindRoute(0, dadAddr, peerAddr, ipv6.ProtocolNumber); err != tcpip.ErrNoRoute {
+		t.Fatalf("FindRoute returned %v, want %v", err, tcpip.ErrNoRoute)
+	}
+
+	// Another node advertises the address.
+	buf := buffer.NewView(header.IPv6MinimumSize + header.ICMPv6NeighborSolicitMinimumSize)
+	icmp := header.ICMPv6(buf[header.IPv6MinimumSize:])
+	icmp.SetType(header.ICMPv6NeighborAdvert)
+	icmp.SetNDPTargetAddress(dadAddr)
+	icmp.SetChecksum(header.ICMPv6Checksum(icmp, peerAddr, header.IPv6AllNodesMulticastAddress))
+	header.IPv6(buf).Encode(&header.IPv6Fields{
+		PayloadLength: header.ICMPv6NeighborSolicitMinimumSize,
+		NextHeader:    uint8(header.ICMPv6ProtocolNumber),
+		HopLimit:      header.NDPHopLimit,
+		SrcAddr:       peerAddr,
+		DstAddr:       header.IPv6AllNodesMulticastAddress,
+	})
+	linkEP.Inject(ipv6.ProtocolNumber, buf)
+
+	select {
+	case r := <-results:
+		if r != (dadResult{1, dadAddr, stack.AddressDuplicated}) {
+			t.Fatalf("got DAD result %+v, want %v duplicated on NIC 1", r, dadAddr)
+		}
+	default:
+		t.Fatalf("conflict wasn't detected")
+	}
+
+	if state, err := s.AddressState(1, dadAddr); err != nil || state != stack.AddressDuplicated {
+		t.Fatalf("AddressState = %v, %v, want %v", state, err, stack.AddressDuplicated)
+	}
+
+	if _, err := s.FindRoute(0, dadAddr, peerAddr, ipv6.ProtocolNumber); err != tcpip.ErrNoRoute {
+		t.Fatalf("FindRoute returned %v, want %v", err, tcpip.ErrNoRoute)
+	}
+
+	// The address can be added again once removed.
+	if err := s.RemoveAddress(1, dadAddr); err != nil {
+		t.Fatalf("RemoveAddress failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, ipv6.ProtocolNumber, dadAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.Close()
+	s.Wait()
+}
@@ -0,0 +1,109 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// Deadline implements a read or write deadline of a transport endpoint. Once
+// the deadline expires, the endpoint returns tcpip.ErrTimeout instead of
+// tcpip.ErrWouldBlock from the operations it applies to, and its waiters are
+// notified so that blocked callers can observe the timeout.
+//
+// The zero value is a deadline that is not set.
+type Deadline struct {
+	mu       sync.Mutex
+	deadline time.Time
+
+	// expired is set, to 1, once the deadline expires. It is modified with
+	// mu held, but read atomically, so that checking the deadline on each
+	// operation doesn't contend for mu.
+	expired uint32
+
+	// stop is closed to stop the goroutine waiting for the current
+	// deadline to expire.
+	stop chan struct{}
+}
+
+// Set sets the deadline to t, measured with the given clock. The zero time
+// removes the deadline. notify is called without any locks held when the
+// deadline expires, including when t is already in the past.
+func (d *Deadline) Set(clock tcpip.Clock, t time.Time, notify func()) {
+	d.mu.Lock()
+	d.stopLocked()
+	d.deadline = t
+	atomic.StoreUint32(&d.expired, 0)
+
+	if t.IsZero() {
+		d.mu.Unlock()
+		return
+	}
+
+	timeout := t.Sub(clock.Now())
+	if timeout <= 0 {
+		atomic.StoreUint32(&d.expired, 1)
+		d.mu.Unlock()
+		notify()
+		return
+	}
+
+	stop := make(chan struct{})
+	d.stop = stop
+	d.mu.Unlock()
+
+	timer := clock.NewTimer(timeout)
+	go func() {
+		select {
+		case <-timer.C():
+		case <-stop:
+			timer.Stop()
+			return
+		}
+
+		d.mu.Lock()
+		if d.stop != stop {
+			// The deadline was changed in the meantime.
+			d.mu.Unlock()
+			return
+		}
+		d.stop = nil
+		atomic.StoreUint32(&d.expired, 1)
+		d.mu.Unlock()
+
+		notify()
+	}()
+}
+
+// Get returns the deadline, or the zero time if it is not set.
+func (d *Deadline) Get() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.deadline
+}
+
+// Expired returns whether the deadline has expired.
+func (d *Deadline) Expired() bool {
+	return atomic.LoadUint32(&d.expired) != 0
+}
+
+// Stop releases the resources held by a pending deadline. It must be called
+// when the endpoint is closed.
+func (d *Deadline) Stop() {
+	d.mu.Lock()
+	d.stopLocked()
+	d.mu.Unlock()
+}
+
+func (d *Deadline) stopLocked() {
+	if d.stop != nil {
+		close(d.stop)
+		d.stop = nil
+	}
+}
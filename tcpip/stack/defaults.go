@@ -0,0 +1,134 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// DefaultTTL is the TTL, or hop limit, of the packets sent by the stack unless
+// it is changed with Stack.SetDefaultTTL.
+const DefaultTTL = 65
+
+// BufferSizeRange is the range of sizes of the send or receive buffer of
+// endpoints. Default is the size new endpoints start with, and sizes set with
+// tcpip.SendBufferSizeOption or tcpip.ReceiveBufferSizeOption are clamped to
+// [Min, Max].
+type BufferSizeRange struct {
+	Min     int
+	Default int
+	Max     int
+}
+
+// Clamp returns size limited to the range r.
+func (r BufferSizeRange) Clamp(size int) int {
+	if size < r.Min {
+		return r.Min
+	}
+	if size > r.Max {
+		return r.Max
+	}
+	return size
+}
+
+// valid returns whether r is a well-formed range.
+func (r BufferSizeRange) valid() bool {
+	return 0 < r.Min && r.Min <= r.Default && r.Default <= r.Max
+}
+
+// EndpointDefaults are the settings new endpoints of a transport protocol are
+// created with. Protocols fall back to their own defaults unless they're set
+// with Stack.SetEndpointDefaults.
+type EndpointDefaults struct {
+	SendBufferSize    BufferSizeRange
+	ReceiveBufferSize BufferSizeRange
+
+	// NoDelay and ReuseAddress are the initial values of
+	// tcpip.NoDelayOption and tcpip.ReuseAddressOption, for the protocols
+	// that support them.
+	NoDelay      bool
+	ReuseAddress bool
+
+	// SynRcvdTimeout is how long connections opened by listening
+	// endpoints may stay in the SYN-RCVD state before they're dropped,
+	// and MaxSynRcvd is the maximum number of such connections a
+	// listening endpoint may hold at once, for the protocols that have a
+	// handshake. Zero means the protocol default and no limit,
+	// respectively.
+	SynRcvdTimeout time.Duration
+	MaxSynRcvd     int
+
+	// CloseTimeout is how long connections closed by their user may take
+	// to complete their close sequence before they're reset, and
+	// FinWait2Timeout is how long they may wait for the peer to close its
+	// side once it acknowledged theirs, i.e., in the FIN_WAIT_2 state, for
+	// the protocols that have them. Zero means the protocol default and
+	// CloseTimeout, respectively.
+	CloseTimeout    time.Duration
+	FinWait2Timeout time.Duration
+
+	// SynRetries is the number of times the opening segment of connection
+	// attempts is retransmitted, with exponential backoff, before they
+	// fail, and ConnectTimeout is how long they may take regardless, for
+	// the protocols that have a handshake. Zero means the protocol default
+	// and no timeout, respectively.
+	SynRetries     int
+	ConnectTimeout time.Duration
+}
+
+// SetEndpointDefaults sets the settings that new endpoints of the given
+// transport protocol are created with. Existing endpoints are left unchanged.
+func (s *Stack) SetEndpointDefaults(p tcpip.TransportProtocolNumber, d EndpointDefaults) error {
+	t, ok := s.transportProtocols[p]
+	if !ok {
+		return tcpip.ErrUnknownProtocol
+	}
+
+	if !d.SendBufferSize.valid() || !d.ReceiveBufferSize.valid() || d.SynRcvdTimeout < 0 || d.MaxSynRcvd < 0 || d.CloseTimeout < 0 || d.FinWait2Timeout < 0 || d.SynRetries < 0 || d.ConnectTimeout < 0 {
+		return tcpip.ErrInvalidOptionValue
+	}
+
+	s.mu.Lock()
+	t.defaults = &d
+	s.mu.Unlock()
+
+	return nil
+}
+
+// EndpointDefaults returns the settings set with SetEndpointDefaults for the
+// given transport protocol. If none were set, it returns false, and protocols
+// should use their own defaults.
+func (s *Stack) EndpointDefaults(p tcpip.TransportProtocolNumber) (EndpointDefaults, bool) {
+	t, ok := s.transportProtocols[p]
+	if !ok {
+		return EndpointDefaults{}, false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if t.defaults == nil {
+		return EndpointDefaults{}, false
+	}
+
+	return *t.defaults, true
+}
+
+// SetDefaultTTL sets the TTL, or hop limit, of the packets sent by the stack. A
+// TTL of zero restores DefaultTTL.
+func (s *Stack) SetDefaultTTL(ttl uint8) {
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
+	atomic.StoreUint32(&s.defaultTTL, uint32(ttl))
+}
+
+// DefaultTTL returns the TTL, or hop limit, of the packets sent by the stack.
+func (s *Stack) DefaultTTL() uint8 {
+	return uint8(atomic.LoadUint32(&s.defaultTTL))
+}
@@ -0,0 +1,131 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"github.com/google/netstack/tcpip"
+)
+
+// EventType is the type of a configuration event of a stack.
+type EventType int
+
+// The following are the types of events reported to the subscribers of a stack.
+const (
+	// EventNICAdded is reported when a NIC is created.
+	EventNICAdded EventType = iota
+
+	// EventNICEnabled is reported when a NIC is attached to its link
+	// endpoint, either when created or by EnableNIC.
+	EventNICEnabled
+
+	// EventNICRemoved is reported after a NIC is removed.
+	EventNICRemoved
+
+	// EventLinkUp and EventLinkDown are reported when the carrier of the
+	// link endpoint of a NIC goes up or down.
+	EventLinkUp
+	EventLinkDown
+
+	// EventAddressAdded is reported when an address is added to a NIC.
+	// Its state is AddressTentative if duplicate address detection was
+	// started for it.
+	EventAddressAdded
+
+	// EventAddressRemoved is reported after an address is removed from
+	// a NIC.
+	EventAddressRemoved
+
+	// EventAddressStateChanged is reported when duplicate address
+	// detection completes for an address.
+	EventAddressStateChanged
+
+	// EventPrimaryAddressChanged is reported when SetPrimaryAddress
+	// changes the preference order of the addresses of a NIC. The
+	// primary address may also change when addresses are added, removed
+	// or change state, so subscribers interested in it should call
+	// GetMainNICAddress on those events too.
+	EventPrimaryAddressChanged
+
+	// EventRouteTableChanged is reported after the route table changes.
+	EventRouteTableChanged
+)
+
+// String implements fmt.Stringer.String.
+func (t EventType) String() string {
+	switch t {
+	case EventNICAdded:
+		return "nic-added"
+	case EventNICEnabled:
+		return "nic-enabled"
+	case EventNICRemoved:
+		return "nic-removed"
+	case EventLinkUp:
+		return "link-up"
+	case EventLinkDown:
+		return "link-down"
+	case EventAddressAdded:
+		return "address-added"
+	case EventAddressRemoved:
+		return "address-removed"
+	case EventAddressStateChanged:
+		return "address-state-changed"
+	case EventPrimaryAddressChanged:
+		return "primary-address-changed"
+	case EventRouteTableChanged:
+		return "route-table-changed"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is a configuration event of a stack.
+type Event struct {
+	Type EventType
+
+	// NIC is the NIC the event is about. It is zero for route table
+	// events.
+	NIC tcpip.NICID
+
+	// Address and State are the address the event is about and its
+	// state, for address events.
+	Address ProtocolAddress
+	State   AddressState
+}
+
+// Subscribe registers h to be called on every configuration event of s, so that
+// management code can react to changes without polling. It returns a function
+// that unregisters h.
+//
+// Handlers are called synchronously from the goroutine that caused the event,
+// after the change, so they must not block; handlers that need to do more work
+// can forward the events to a buffered channel.
+func (s *Stack) Subscribe(h func(Event)) (cancel func()) {
+	s.eventMu.Lock()
+	id := s.nextEventID
+	s.nextEventID++
+	s.eventHandlers[id] = h
+	s.eventMu.Unlock()
+
+	return func() {
+		s.eventMu.Lock()
+		delete(s.eventHandlers, id)
+		s.eventMu.Unlock()
+	}
+}
+
+// emit reports e to the subscribers of s. It must be called without holding
+// the locks of s or its NICs, so that handlers can call back into the stack.
+func (s *Stack) emit(e Event) {
+	s.eventMu.Lock()
+	handlers := make([]func(Event), 0, len(s.eventHandlers))
+	for _, h := range s.eventHandlers {
+		handlers = append(handlers, h)
+	}
+	s.eventMu.Unlock()
+
+	for _, h := range handlers {
+		h(e)
+	}
+}
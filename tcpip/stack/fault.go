@@ -0,0 +1,231 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+)
+
+// FaultAction is what is done to the packets a fault applies to.
+type FaultAction int
+
+// The following are the actions of faults.
+const (
+	// FaultDrop drops the packet. Outbound packets are reported as sent
+	// successfully to the layer above, as if they were lost on the way.
+	FaultDrop FaultAction = iota
+
+	// FaultDelay holds the packet for Fault.Delay, according to the
+	// stack's clock, before passing it on.
+	FaultDelay
+
+	// FaultCorrupt flips the bits of the byte at Fault.CorruptOffset of
+	// the packet before passing it on.
+	FaultCorrupt
+)
+
+// Fault describes a fault injected into a stack with InjectFault. Faults are a
+// debugging facility, meant to reproduce rare loss patterns in tests; they cost
+// little when none are injected.
+type Fault struct {
+	// Point is where the fault is applied. Faults can be applied at
+	// TraceLinkIn, TraceTransportIn, TraceTransportOut and TraceLinkOut.
+	// At TraceLinkIn, they are applied before the packets are traced or
+	// counted by the NIC, as if they had happened on the wire.
+	Point TracePoint
+
+	// Filter selects the packets the fault applies to, or all of them if
+	// it is nil. It is given the metadata of the packets, as described by
+	// TracePacket; Verdict, Err and Time aren't set. Like trace hooks, it
+	// must not block, nor retain its argument.
+	Filter func(*TracePacket) bool
+
+	// Nth is the number of the packet, among those matched by Filter,
+	// that the fault applies to. Zero is treated as one. If Repeat is
+	// set, the fault applies to every Nth matching packet.
+	Nth    uint64
+	Repeat bool
+
+	// Action is what is done to the packets the fault applies to.
+	Action FaultAction
+
+	// Delay is how long FaultDelay holds packets.
+	Delay time.Duration
+
+	// CorruptOffset is the offset of the byte FaultCorrupt corrupts, from
+	// the start of the headers the packets have at the fault point.
+	// Offsets beyond the end of packets corrupt their last byte.
+	CorruptOffset int
+}
+
+// fault is a Fault injected into a stack.
+type fault struct {
+	Fault
+
+	// matched is the number of packets matched so far. It is only
+	// accessed atomically.
+	matched uint64
+}
+
+// InjectFault injects f into the stack. Faults can be injected and removed at
+// any time; calling the returned function removes f. When several faults apply
+// to a packet, one of them is chosen arbitrarily.
+func (s *Stack) InjectFault(f Fault) (remove func(), err error) {
+	switch f.Point {
+	case TraceLinkIn, TraceTransportIn, TraceTransportOut, TraceLinkOut:
+	default:
+		return nil, tcpip.ErrNotSupported
+	}
+
+	switch f.Action {
+	case FaultDrop, FaultDelay, FaultCorrupt:
+	default:
+		return nil, tcpip.ErrInvalidOptionValue
+	}
+
+	if f.Nth == 0 {
+		f.Nth = 1
+	}
+
+	s.faultMu.Lock()
+	id := s.nextFaultID
+	s.nextFaultID++
+	s.faults[id] = &fault{Fault: f}
+	s.updateFaultsLocked()
+	s.faultMu.Unlock()
+
+	return func() {
+		s.faultMu.Lock()
+		delete(s.faults, id)
+		s.updateFaultsLocked()
+		s.faultMu.Unlock()
+	}, nil
+}
+
+// updateFaultsLocked publishes the current faults, so that they can be read
+// without locking by findFault.
+func (s *Stack) updateFaultsLocked() {
+	faults := make([]*fault, 0, len(s.faults))
+	for _, f := range s.faults {
+		faults = append(faults, f)
+	}
+	s.faultSnapshot.Store(faults)
+}
+
+// faulting returns whether any faults are injected. Callers should check it
+// before describing packets to findFault.
+func (s *Stack) faulting() bool {
+	faults, _ := s.faultSnapshot.Load().([]*fault)
+	return len(faults) != 0
+}
+
+// findFault returns the fault that applies to the packet described by p, or
+// nil if there is none.
+func (s *Stack) findFault(p *TracePacket) *fault {
+	faults, _ := s.faultSnapshot.Load().([]*fault)
+	var found *fault
+	for _, f := range faults {
+		if f.Point != p.Point || (f.Filter != nil && !f.Filter(p)) {
+			continue
+		}
+
+		n := atomic.AddUint64(&f.matched, 1)
+		if found == nil && (n == f.Nth || (f.Repeat && n%f.Nth == 0)) {
+			found = f
+		}
+	}
+	return found
+}
+
+// faultIn applies the faults at the point of p to the received packet it
+// describes. It returns the packet to deliver, which may be a corrupted copy,
+// and false if the packet was dropped or delayed. When it is delayed, delayed
+// is called right away, and the function it returns is called with a copy of
+// the packet once the delay has elapsed.
+func (s *Stack) faultIn(p *TracePacket, delayed func() func(buffer.View)) (buffer.View, bool) {
+	f := s.findFault(p)
+	if f == nil {
+		return p.Data, true
+	}
+
+	switch f.Action {
+	case FaultDelay:
+		v := append(buffer.View(nil), p.Data...)
+		deliver := delayed()
+		s.after(f.Delay, func() { deliver(v) })
+		return nil, false
+
+	case FaultCorrupt:
+		_, v := copyPacket(nil, p.Data, 0)
+		corrupt(v, f.CorruptOffset)
+		return v, true
+
+	default:
+		return nil, false
+	}
+}
+
+// faultOut applies the faults at the point of p to the outbound packet it
+// describes, made of hdr and payload. It returns the packet to write, which may
+// be a corrupted copy with the given headroom for the headers of the layers
+// below, and false if the packet was dropped or delayed. When it is delayed,
+// delayed is called right away, and the function it returns is called with a
+// copy of the packet once the delay has elapsed.
+func (s *Stack) faultOut(p *TracePacket, hdr *buffer.Prependable, payload buffer.VectorisedView, headroom int, delayed func() func(*buffer.Prependable, buffer.VectorisedView)) (*buffer.Prependable, buffer.VectorisedView, bool) {
+	f := s.findFault(p)
+	if f == nil {
+		return hdr, payload, true
+	}
+
+	switch f.Action {
+	case FaultDelay:
+		h, v := copyPacket(hdr.View(), p.Data, headroom)
+		write := delayed()
+		s.after(f.Delay, func() { write(&h, v.ToVectorisedView()) })
+		return nil, buffer.VectorisedView{}, false
+
+	case FaultCorrupt:
+		h, v := copyPacket(hdr.View(), p.Data, headroom)
+		corrupt(v, f.CorruptOffset)
+		return &h, v.ToVectorisedView(), true
+
+	default:
+		return nil, buffer.VectorisedView{}, false
+	}
+}
+
+// after calls fn once d has elapsed on the stack's clock.
+func (s *Stack) after(d time.Duration, fn func()) {
+	t := s.clock.NewTimer(d)
+	s.Go(func() {
+		<-t.C()
+		fn()
+	})
+}
+
+// copyPacket returns a copy of the packet made of hdr and payload, with all of
+// it in the returned payload, and a header with the given headroom.
+func copyPacket(hdr, payload buffer.View, headroom int) (buffer.Prependable, buffer.View) {
+	v := make(buffer.View, 0, len(hdr)+len(payload))
+	v = append(v, hdr...)
+	v = append(v, payload...)
+	return buffer.NewPrependable(headroom), v
+}
+
+// corrupt flips the bits of the byte of v at the given offset, or of its last
+// byte if v is shorter.
+func corrupt(v buffer.View, offset int) {
+	if len(v) == 0 {
+		return
+	}
+	if offset < 0 || offset >= len(v) {
+		offset = len(v) - 1
+	}
+	v[offset] ^= 0xff
+}
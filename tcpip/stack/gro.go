@@ -0,0 +1,244 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"bytes"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+)
+
+// groSegment holds the state of a TCP segment that other segments may be
+// coalesced into.
+type groSegment struct {
+	pkt *InboundPacket
+
+	// netHdrLen is the length of the network header, and tcpHdrLen is the
+	// length of the TCP header, including options.
+	netHdrLen int
+	tcpHdrLen int
+
+	// nextSeq is the sequence number of the segment that can be appended
+	// to this one.
+	nextSeq uint32
+
+	// merged is the number of segments coalesced into this one.
+	merged int
+
+	// owned indicates whether pkt.Data was allocated by the coalescing
+	// code, so it can be appended to.
+	owned bool
+}
+
+// parseGROSegment determines if the given packet is a TCP segment that can take
+// part in coalescing, and if so, returns its state. Only plain ACK segments
+// (possibly with the PSH flag) carrying data, with no IPv4 options or IPv6
+// extension headers, are considered.
+//
+// If verify is true, segments whose IPv4 header or TCP checksum is wrong are
+// not considered either: coalescing recomputes the checksums, which would hide
+// the corruption from the transport layer.
+func parseGROSegment(p *InboundPacket, verify bool) (groSegment, bool) {
+	v := p.Data
+	var netHdrLen int
+	var src, dst tcpip.Address
+	switch p.Protocol {
+	case header.IPv4ProtocolNumber:
+		h := header.IPv4(v)
+		if !h.IsValid() || h.HeaderLength() != header.IPv4MinimumSize || h.TransportProtocol() != header.TCPProtocolNumber {
+			return groSegment{}, false
+		}
+
+		if h.FragmentOffset() != 0 || h.Flags()&header.IPv4FlagMoreFragments != 0 {
+			return groSegment{}, false
+		}
+
+		if verify && h.CalculateChecksum() != 0xffff {
+			return groSegment{}, false
+		}
+
+		netHdrLen = header.IPv4MinimumSize
+		v = v[:h.TotalLength()]
+		src, dst = h.SourceAddress(), h.DestinationAddress()
+
+	case header.IPv6ProtocolNumber:
+		h := header.IPv6(v)
+		if !h.IsValid() || h.TransportProtocol() != header.TCPProtocolNumber {
+			return groSegment{}, false
+		}
+
+		netHdrLen = header.IPv6MinimumSize
+		v = v[:header.IPv6MinimumSize+int(h.PayloadLength())]
+		src, dst = h.SourceAddress(), h.DestinationAddress()
+
+	default:
+		return groSegment{}, false
+	}
+
+	if len(v) < netHdrLen+header.TCPMinimumSize {
+		return groSegment{}, false
+	}
+
+	tcp := header.TCP(v[netHdrLen:])
+	tcpHdrLen := int(tcp.DataOffset())
+	if tcpHdrLen < header.TCPMinimumSize || tcpHdrLen >= len(tcp) {
+		return groSegment{}, false
+	}
+
+	if tcp.Flags()&^header.TCPFlagPsh != header.TCPFlagAck {
+		return groSegment{}, false
+	}
+
+	if verify {
+		xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, src, dst)
+		xsum = header.ChecksumCombine(xsum, uint16(len(tcp)))
+		if header.Checksum(tcp, xsum) != 0xffff {
+			return groSegment{}, false
+		}
+	}
+
+	p.Data = v
+	return groSegment{
+		pkt:       p,
+		netHdrLen: netHdrLen,
+		tcpHdrLen: tcpHdrLen,
+		nextSeq:   tcp.SequenceNumber() + uint32(len(tcp)-tcpHdrLen),
+		merged:    1,
+	}, true
+}
+
+// canAppend determines if segment s can be appended to g. This is the case if
+// s immediately follows g in the same flow, the headers of both are identical
+// except for the fields that depend on the length, and the result isn't larger
+// than the largest IP packet.
+func (g *groSegment) canAppend(s *groSegment) bool {
+	if g.pkt.Protocol != s.pkt.Protocol || g.netHdrLen != s.netHdrLen || g.tcpHdrLen != s.tcpHdrLen {
+		return false
+	}
+
+	// The length fields of both IPv4 and IPv6 are 16 bits wide; keep the
+	// whole packet within that limit, which is conservative for IPv6.
+	a, b := g.pkt.Data, s.pkt.Data
+	if len(a)+len(b)-g.netHdrLen-g.tcpHdrLen > 0xffff {
+		return false
+	}
+
+	switch g.pkt.Protocol {
+	case header.IPv4ProtocolNumber:
+		// Compare everything except the total length, ID and checksum.
+		if !bytes.Equal(a[0:2], b[0:2]) || !bytes.Equal(a[6:10], b[6:10]) || !bytes.Equal(a[12:20], b[12:20]) {
+			return false
+		}
+
+	case header.IPv6ProtocolNumber:
+		// Compare everything except the payload length.
+		if !bytes.Equal(a[0:4], b[0:4]) || !bytes.Equal(a[6:header.IPv6MinimumSize], b[6:header.IPv6MinimumSize]) {
+			return false
+		}
+	}
+
+	ta, tb := header.TCP(a[g.netHdrLen:]), header.TCP(b[g.netHdrLen:])
+
+	// The PSH flag ends coalescing, so g must not have it.
+	if ta.Flags() != header.TCPFlagAck || tb.SequenceNumber() != g.nextSeq {
+		return false
+	}
+
+	// Compare the ports, acknowledgement number, data offset, window size
+	// and options.
+	return bytes.Equal(ta[0:4], tb[0:4]) &&
+		bytes.Equal(ta[8:13], tb[8:13]) &&
+		bytes.Equal(ta[14:16], tb[14:16]) &&
+		bytes.Equal(ta[header.TCPMinimumSize:g.tcpHdrLen], tb[header.TCPMinimumSize:g.tcpHdrLen])
+}
+
+// appendSegment appends the payload of segment s to g, which must have been
+// checked with canAppend.
+func (g *groSegment) appendSegment(s *groSegment) {
+	if !g.owned {
+		v := make(buffer.View, len(g.pkt.Data), 0xffff)
+		copy(v, g.pkt.Data)
+		g.pkt.Data = v
+		g.owned = true
+	}
+
+	tcp := header.TCP(s.pkt.Data[s.netHdrLen:])
+	payload := tcp[s.tcpHdrLen:]
+	g.pkt.Data = append(g.pkt.Data, payload...)
+	g.nextSeq += uint32(len(payload))
+	g.merged++
+
+	// Carry the PSH flag over so that the receiver doesn't delay the data.
+	if tcp.Flags()&header.TCPFlagPsh != 0 {
+		g.pkt.Data[g.netHdrLen+13] |= header.TCPFlagPsh // Flags byte.
+	}
+}
+
+// finalize updates the length and checksum fields of the headers of g if other
+// segments were coalesced into it.
+func (g *groSegment) finalize() {
+	if g.merged <= 1 {
+		return
+	}
+
+	v := g.pkt.Data
+	var src, dst tcpip.Address
+	switch g.pkt.Protocol {
+	case header.IPv4ProtocolNumber:
+		h := header.IPv4(v)
+		h.SetTotalLength(uint16(len(v)))
+		h.SetChecksum(0)
+		h.SetChecksum(^h.CalculateChecksum())
+		src, dst = h.SourceAddress(), h.DestinationAddress()
+
+	case header.IPv6ProtocolNumber:
+		h := header.IPv6(v)
+		h.SetPayloadLength(uint16(len(v) - header.IPv6MinimumSize))
+		src, dst = h.SourceAddress(), h.DestinationAddress()
+	}
+
+	tcp := header.TCP(v[g.netHdrLen:])
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, src, dst)
+	xsum = header.Checksum(tcp[g.tcpHdrLen:], xsum)
+	tcp.SetChecksum(0)
+	tcp.SetChecksum(^tcp.CalculateChecksum(xsum, uint16(len(tcp))))
+}
+
+// coalesceTCPSegments coalesces consecutive segments of the same TCP flow in
+// the given batch of packets. The returned batch reuses the storage of pkts.
+// The checksums of the segments are verified before they are coalesced if
+// verify is true, i.e., unless the link endpoint already verified them.
+func coalesceTCPSegments(pkts []InboundPacket, verify bool) []InboundPacket {
+	out := pkts[:0]
+
+	var cur groSegment
+	for i := range pkts {
+		p := pkts[i]
+		s, ok := parseGROSegment(&p, verify)
+		if ok && cur.pkt != nil && cur.canAppend(&s) {
+			cur.appendSegment(&s)
+			continue
+		}
+
+		if cur.pkt != nil {
+			cur.finalize()
+		}
+
+		out = append(out, p)
+		cur = groSegment{}
+		if ok {
+			s.pkt = &out[len(out)-1]
+			cur = s
+		}
+	}
+
+	if cur.pkt != nil {
+		cur.finalize()
+	}
+
+	return out
+}
@@ -0,0 +1,313 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/network/ipv6"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+const (
+	groLocalV4  = tcpip.Address("\x0a\x00\x00\x01")
+	groRemoteV4 = tcpip.Address("\x0a\x00\x00\x02")
+	groLocalV6  = tcpip.Address("\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+	groRemoteV6 = tcpip.Address("\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02")
+)
+
+// batchEndpoint is a channel endpoint that gives access to the dispatcher of
+// the NIC, so that tests can deliver batches of packets.
+type batchEndpoint struct {
+	*channel.Endpoint
+	dispatcher stack.BatchNetworkDispatcher
+}
+
+func (e *batchEndpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.Endpoint.Attach(dispatcher)
+	e.dispatcher = dispatcher.(stack.BatchNetworkDispatcher)
+}
+
+// tcpSegment builds an IPv4 or IPv6 packet, according to the length of the
+// addresses, carrying a TCP segment from srcPort to port 80 with the given
+// sequence number, flags and payload, and valid checksums.
+func tcpSegment(src, dst tcpip.Address, srcPort uint16, seq uint32, flags uint8, payload string) stack.InboundPacket {
+	protocol := header.IPv4ProtocolNumber
+	netHdrLen := header.IPv4MinimumSize
+	if len(src) == header.IPv6AddressSize {
+		protocol = header.IPv6ProtocolNumber
+		netHdrLen = header.IPv6MinimumSize
+	}
+
+	v := buffer.NewView(netHdrLen + header.TCPMinimumSize + len(payload))
+	copy(v[netHdrLen+header.TCPMinimumSize:], payload)
+
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		ip := header.IPv4(v)
+		ip.Encode(&header.IPv4Fields{
+			IHL:         header.IPv4MinimumSize,
+			TotalLength: uint16(len(v)),
+			TTL:         64,
+			Protocol:    uint8(header.TCPProtocolNumber),
+			SrcAddr:     src,
+			DstAddr:     dst,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+
+	case header.IPv6ProtocolNumber:
+		header.IPv6(v).Encode(&header.IPv6Fields{
+			PayloadLength: uint16(len(v) - header.IPv6MinimumSize),
+			NextHeader:    uint8(header.TCPProtocolNumber),
+			HopLimit:      64,
+			SrcAddr:       src,
+			DstAddr:       dst,
+		})
+	}
+
+	tcp := header.TCP(v[netHdrLen:])
+	tcp.Encode(&header.TCPFields{
+		SrcPort:    srcPort,
+		DstPort:    80,
+		SeqNum:     seq,
+		AckNum:     1,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      flags,
+		WindowSize: 0xffff,
+	})
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, src, dst)
+	xsum = header.Checksum([]byte(payload), xsum)
+	tcp.SetChecksum(^tcp.CalculateChecksum(xsum, uint16(len(tcp))))
+
+	return stack.InboundPacket{Protocol: protocol, Data: v}
+}
+
+// groPacket is a packet seen by the network layer.
+type groPacket struct {
+	protocol tcpip.NetworkProtocolNumber
+	data     buffer.View
+}
+
+// deliverGROBatch delivers pkts in a single batch to a NIC with GRO enabled,
+// and returns the packets handed to the network layer.
+func deliverGROBatch(t *testing.T, pkts ...stack.InboundPacket) []groPacket {
+	t.Helper()
+
+	s := stack.New([]string{ipv4.ProtocolName, ipv6.ProtocolName}, nil).(*stack.Stack)
+	_, linkEP := channel.New(0, defaultMTU)
+	e := &batchEndpoint{Endpoint: linkEP}
+	if err := s.CreateNIC(1, stack.RegisterLinkEndpoint(e)); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, groLocalV4); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv6.ProtocolNumber, groLocalV6); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	if err := s.SetGRO(1, true); err != nil {
+		t.Fatalf("SetGRO failed: %v", err)
+	}
+
+	var got []groPacket
+	defer s.AddTraceHook(func(p *stack.TracePacket) {
+		if p.Point == stack.TraceNetworkIn {
+			got = append(got, groPacket{p.NetProto, append(buffer.View(nil), p.Data...)})
+		}
+	})()
+
+	e.dispatcher.DeliverNetworkPackets(e, pkts)
+	return got
+}
+
+// checkSegment checks that p is a valid TCP segment with the given sequence
+// number, flags and payload.
+func checkSegment(t *testing.T, p groPacket, seq uint32, flags uint8, payload string) {
+	t.Helper()
+
+	var src, dst tcpip.Address
+	var tcp header.TCP
+	switch p.protocol {
+	case header.IPv4ProtocolNumber:
+		ip := header.IPv4(p.data)
+		if int(ip.TotalLength()) != len(p.data) {
+			t.Errorf("Got total length %d, want %d", ip.TotalLength(), len(p.data))
+		}
+		if ip.CalculateChecksum() != 0xffff {
+			t.Errorf("Bad IPv4 header checksum")
+		}
+		src, dst = ip.SourceAddress(), ip.DestinationAddress()
+		tcp = header.TCP(p.data[header.IPv4MinimumSize:])
+
+	case header.IPv6ProtocolNumber:
+		ip := header.IPv6(p.data)
+		if int(ip.PayloadLength()) != len(p.data)-header.IPv6MinimumSize {
+			t.Errorf("Got payload length %d, want %d", ip.PayloadLength(), len(p.data)-header.IPv6MinimumSize)
+		}
+		src, dst = ip.SourceAddress(), ip.DestinationAddress()
+		tcp = header.TCP(p.data[header.IPv6MinimumSize:])
+	}
+
+	if got := tcp.SequenceNumber(); got != seq {
+		t.Errorf("Got sequence number %d, want %d", got, seq)
+	}
+	if got := tcp.Flags(); got != flags {
+		t.Errorf("Got flags %#x, want %#x", got, flags)
+	}
+	if got := string(tcp.Payload()); got != payload {
+		t.Errorf("Got payload %q, want %q", got, payload)
+	}
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, src, dst)
+	xsum = header.ChecksumCombine(xsum, uint16(len(tcp)))
+	if header.Checksum(tcp, xsum) != 0xffff {
+		t.Errorf("Bad TCP checksum")
+	}
+}
+
+func TestGROMergesInOrderSegments(t *testing.T) {
+	for _, test := range []struct {
+		name             string
+		remote, local    tcpip.Address
+		protocol         tcpip.NetworkProtocolNumber
+		wantHeaderLength int
+	}{
+		{"IPv4", groRemoteV4, groLocalV4, header.IPv4ProtocolNumber, header.IPv4MinimumSize},
+		{"IPv6", groRemoteV6, groLocalV6, header.IPv6ProtocolNumber, header.IPv6MinimumSize},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := deliverGROBatch(t,
+				tcpSegment(test.remote, test.local, 1000, 100, header.TCPFlagAck, "abc"),
+				tcpSegment(test.remote, test.local, 1000, 103, header.TCPFlagAck, "def"),
+				tcpSegment(test.remote, test.local, 1000, 106, header.TCPFlagAck|header.TCPFlagPsh, "gh"),
+			)
+			if len(got) != 1 {
+				t.Fatalf("Got %d packets, want the segments coalesced into 1", len(got))
+			}
+			if got[0].protocol != test.protocol {
+				t.Errorf("Got protocol %d, want %d", got[0].protocol, test.protocol)
+			}
+			if want := test.wantHeaderLength + header.TCPMinimumSize + 8; len(got[0].data) != want {
+				t.Errorf("Got a packet of %d bytes, want %d", len(got[0].data), want)
+			}
+			checkSegment(t, got[0], 100, header.TCPFlagAck|header.TCPFlagPsh, "abcdefgh")
+		})
+	}
+}
+
+func TestGRODoesNotMerge(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		pkts []stack.InboundPacket
+	}{
+		{
+			"different flows",
+			[]stack.InboundPacket{
+				tcpSegment(groRemoteV4, groLocalV4, 1000, 100, header.TCPFlagAck, "abc"),
+				tcpSegment(groRemoteV4, groLocalV4, 1001, 103, header.TCPFlagAck, "def"),
+			},
+		},
+		{
+			"different protocols",
+			[]stack.InboundPacket{
+				tcpSegment(groRemoteV4, groLocalV4, 1000, 100, header.TCPFlagAck, "abc"),
+				tcpSegment(groRemoteV6, groLocalV6, 1000, 103, header.TCPFlagAck, "def"),
+			},
+		},
+		{
+			"gap",
+			[]stack.InboundPacket{
+				tcpSegment(groRemoteV4, groLocalV4, 1000, 100, header.TCPFlagAck, "abc"),
+				tcpSegment(groRemoteV4, groLocalV4, 1000, 104, header.TCPFlagAck, "def"),
+			},
+		},
+		{
+			"PSH ends coalescing",
+			[]stack.InboundPacket{
+				tcpSegment(groRemoteV4, groLocalV4, 1000, 100, header.TCPFlagAck|header.TCPFlagPsh, "abc"),
+				tcpSegment(groRemoteV4, groLocalV4, 1000, 103, header.TCPFlagAck, "def"),
+			},
+		},
+		{
+			"FIN",
+			[]stack.InboundPacket{
+				tcpSegment(groRemoteV4, groLocalV4, 1000, 100, header.TCPFlagAck, "abc"),
+				tcpSegment(groRemoteV4, groLocalV4, 1000, 103, header.TCPFlagAck|header.TCPFlagFin, "def"),
+			},
+		},
+		{
+			"no payload",
+			[]stack.InboundPacket{
+				tcpSegment(groRemoteV4, groLocalV4, 1000, 100, header.TCPFlagAck, ""),
+				tcpSegment(groRemoteV4, groLocalV4, 1000, 100, header.TCPFlagAck, ""),
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			want := make([][]byte, len(test.pkts))
+			for i, p := range test.pkts {
+				want[i] = append([]byte(nil), p.Data...)
+			}
+
+			got := deliverGROBatch(t, test.pkts...)
+			if len(got) != len(want) {
+				t.Fatalf("Got %d packets, want %d", len(got), len(want))
+			}
+			for i := range got {
+				if !bytes.Equal(got[i].data, want[i]) {
+					t.Errorf("Packet %d was modified: got %x, want %x", i, got[i].data, want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGROBadChecksum(t *testing.T) {
+	badTCP := tcpSegment(groRemoteV4, groLocalV4, 1000, 103, header.TCPFlagAck, "def")
+	badTCP.Data[len(badTCP.Data)-1] ^= 0xff
+
+	badIP := tcpSegment(groRemoteV4, groLocalV4, 1000, 103, header.TCPFlagAck, "def")
+	header.IPv4(badIP.Data).SetChecksum(header.IPv4(badIP.Data).Checksum() + 1)
+
+	badTCPv6 := tcpSegment(groRemoteV6, groLocalV6, 1000, 103, header.TCPFlagAck, "def")
+	badTCPv6.Data[len(badTCPv6.Data)-1] ^= 0xff
+
+	for _, test := range []struct {
+		name   string
+		remote tcpip.Address
+		local  tcpip.Address
+		bad    stack.InboundPacket
+	}{
+		{"TCP checksum", groRemoteV4, groLocalV4, badTCP},
+		{"IPv4 header checksum", groRemoteV4, groLocalV4, badIP},
+		{"IPv6 TCP checksum", groRemoteV6, groLocalV6, badTCPv6},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			bad := append([]byte(nil), test.bad.Data...)
+			got := deliverGROBatch(t,
+				tcpSegment(test.remote, test.local, 1000, 100, header.TCPFlagAck, "abc"),
+				test.bad,
+				tcpSegment(test.remote, test.local, 1000, 106, header.TCPFlagAck, "ghi"),
+			)
+
+			// The corrupted segment is passed through unmodified, so
+			// that the transport layer drops it, and ends
+			// coalescing.
+			if len(got) != 3 {
+				t.Fatalf("Got %d packets, want 3", len(got))
+			}
+			checkSegment(t, got[0], 100, header.TCPFlagAck, "abc")
+			if !bytes.Equal(got[1].data, bad) {
+				t.Errorf("Corrupted segment was modified: got %x, want %x", got[1].data, bad)
+			}
+			checkSegment(t, got[2], 106, header.TCPFlagAck, "ghi")
+		})
+	}
+}
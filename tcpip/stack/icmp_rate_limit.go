@@ -0,0 +1,141 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+)
+
+// ICMPType identifies the ICMP messages of a type: ICMPv4 messages if NetProto
+// is header.IPv4ProtocolNumber, and ICMPv6 messages if it's
+// header.IPv6ProtocolNumber.
+type ICMPType struct {
+	NetProto tcpip.NetworkProtocolNumber
+	Type     uint8
+}
+
+// ICMPRateLimit is the token bucket limiting the rate at which the stack sends
+// the ICMP messages of a type: Burst messages may be sent at once, and the
+// bucket refills at Rate messages per second. The zero value means no limit.
+type ICMPRateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// limitableICMPTypes are the types of the ICMP messages the stack generates, and
+// whose rate can therefore be limited: echo replies. The stack doesn't generate
+// ICMP errors yet.
+var limitableICMPTypes = map[ICMPType]struct{}{
+	{header.IPv4ProtocolNumber, uint8(header.ICMPv4EchoReply)}: {},
+	{header.IPv6ProtocolNumber, uint8(header.ICMPv6EchoReply)}: {},
+}
+
+// icmpBucket is the token bucket of an ICMP type.
+type icmpBucket struct {
+	limit  ICMPRateLimit
+	tokens float64
+	last   time.Time
+}
+
+// take removes a token from the bucket, after adding the tokens accumulated
+// since the last call, and returns whether there was one.
+func (b *icmpBucket) take(now time.Time) bool {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+		if max := float64(b.limit.Burst); b.tokens > max {
+			b.tokens = max
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// icmpRateLimiter holds the token buckets of the ICMP types whose rate is
+// limited.
+type icmpRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[ICMPType]*icmpBucket
+}
+
+// set sets the limit of t, with a full bucket, or removes it if l is the zero
+// value.
+func (l *icmpRateLimiter) set(t ICMPType, limit ICMPRateLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if limit == (ICMPRateLimit{}) {
+		delete(l.buckets, t)
+		return
+	}
+
+	if l.buckets == nil {
+		l.buckets = make(map[ICMPType]*icmpBucket)
+	}
+	l.buckets[t] = &icmpBucket{limit: limit, tokens: float64(limit.Burst)}
+}
+
+// get returns the limit of t.
+func (l *icmpRateLimiter) get(t ICMPType) ICMPRateLimit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if b, ok := l.buckets[t]; ok {
+		return b.limit
+	}
+	return ICMPRateLimit{}
+}
+
+// allow returns whether a message of type t may be sent at time now.
+func (l *icmpRateLimiter) allow(t ICMPType, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[t]
+	return !ok || b.take(now)
+}
+
+// SetICMPRateLimit sets the limit of the rate at which the stack sends the ICMP
+// messages of type t. The zero value of ICMPRateLimit removes the limit. Only
+// echo replies can be limited, as the stack doesn't send other messages;
+// tcpip.ErrNotSupported is returned for the other types.
+func (s *Stack) SetICMPRateLimit(t ICMPType, l ICMPRateLimit) error {
+	if _, ok := limitableICMPTypes[t]; !ok {
+		return tcpip.ErrNotSupported
+	}
+	if l.Rate < 0 || l.Burst < 0 || (l.Burst == 0) != (l.Rate == 0) {
+		return tcpip.ErrInvalidOptionValue
+	}
+
+	s.icmpLimiter.set(t, l)
+	return nil
+}
+
+// ICMPRateLimit returns the limit of the rate at which the stack sends the ICMP
+// messages of type t, or the zero value if there is none.
+func (s *Stack) ICMPRateLimit(t ICMPType) ICMPRateLimit {
+	return s.icmpLimiter.get(t)
+}
+
+// AllowICMP is called by the protocols that generate ICMP messages before they
+// send one of type t, which they must only do if it returns true. The messages
+// that exceed the limit of their type are counted in the ICMP statistics.
+func (s *Stack) AllowICMP(t ICMPType) bool {
+	if s.icmpLimiter.allow(t, s.Clock().Now()) {
+		return true
+	}
+
+	atomic.AddUint64(&s.stats.ICMP.RateLimited, 1)
+	return false
+}
@@ -0,0 +1,78 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"time"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// SetAddressLifetime sets the valid lifetime of an address of the specified
+// NIC: once it elapses on the clock of the stack, the address is removed, as if
+// by RemoveAddress. It is meant for addresses leased from a server, e.g., by
+// DHCPv6, whose leases are extended by setting their lifetime again. A lifetime
+// of zero makes the address permanent again.
+func (s *Stack) SetAddressLifetime(id tcpip.NICID, addr tcpip.Address, lifetime time.Duration) error {
+	if lifetime < 0 {
+		return tcpip.ErrInvalidOptionValue
+	}
+
+	s.mu.RLock()
+	nic := s.nics[id]
+	s.mu.RUnlock()
+
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	return nic.setAddressLifetime(addr, lifetime)
+}
+
+// setAddressLifetime implements SetAddressLifetime, replacing the previous
+// lifetime of the address, if any.
+func (n *NIC) setAddressLifetime(addr tcpip.Address, lifetime time.Duration) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	r := n.endpoints[NetworkEndpointID{addr}]
+	if r == nil || !r.holdsInsertRef || r.group {
+		return tcpip.ErrBadLocalAddress
+	}
+
+	n.stopExpiryLocked(r)
+	if lifetime == 0 {
+		return nil
+	}
+
+	// The timer is started right away, so that the lifetime is measured
+	// from now even if the clock is advanced before the goroutine runs.
+	t := n.stack.Clock().NewTimer(lifetime)
+	stop := make(chan struct{})
+	r.expiryStop = stop
+
+	r.incRef()
+	n.stack.Go(func() {
+		defer r.decRef()
+
+		select {
+		case <-t.C():
+			n.stack.removeAddress(n, addr, stop)
+		case <-stop:
+			t.Stop()
+		}
+	})
+
+	return nil
+}
+
+// stopExpiryLocked stops the expiry of the address of r, if its lifetime was
+// set.
+func (n *NIC) stopExpiryLocked(r *referencedNetworkEndpoint) {
+	if r.expiryStop != nil {
+		close(r.expiryStop)
+		r.expiryStop = nil
+	}
+}
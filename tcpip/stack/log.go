@@ -0,0 +1,127 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// LogLevel is the severity of a log record.
+type LogLevel int
+
+// The following are the levels of the records logged by a stack.
+const (
+	// LogDebug is used for events that may happen for every packet, e.g.,
+	// drops due to full queues, resets sent or SYN cookies sent during
+	// SYN floods.
+	LogDebug LogLevel = iota
+
+	// LogInfo is used for noteworthy events that don't indicate a problem
+	// of the stack.
+	LogInfo
+
+	// LogWarning is used for events that likely need the attention of an
+	// operator, e.g., duplicate addresses.
+	LogWarning
+
+	// LogError is used for failures of the stack.
+	LogError
+)
+
+// String implements fmt.Stringer.String.
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarning:
+		return "warning"
+	case LogError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// Logger receives the log records of a stack, as set with Stack.SetLogger.
+type Logger interface {
+	// Log records an event. fields holds alternating keys, which are
+	// strings, and values, e.g., "nic", tcpip.NICID(1).
+	//
+	// Log is called from the goroutines of the protocols, sometimes with
+	// locks held, so it must not block or call back into the stack.
+	Log(level LogLevel, msg string, fields ...interface{})
+}
+
+// loggerState holds the logger of a stack and the minimum level of the records
+// it receives.
+type loggerState struct {
+	logger Logger
+	level  LogLevel
+}
+
+// SetLogger sets the logger that receives the records of the stack whose level
+// is at least the given one. A nil logger, the default, disables logging. It
+// may be called at any time.
+func (s *Stack) SetLogger(l Logger, level LogLevel) {
+	if l == nil {
+		s.logger.Store(&loggerState{})
+		return
+	}
+	s.logger.Store(&loggerState{logger: l, level: level})
+}
+
+// LogEnabled returns whether records of the given level are logged. Protocols
+// should check it before building the fields of records logged on hot paths.
+func (s *Stack) LogEnabled(level LogLevel) bool {
+	st, _ := s.logger.Load().(*loggerState)
+	return st != nil && st.logger != nil && level >= st.level
+}
+
+// Log sends a record to the logger of the stack if its level is enabled. See
+// Logger.Log for the format of fields.
+func (s *Stack) Log(level LogLevel, msg string, fields ...interface{}) {
+	st, _ := s.logger.Load().(*loggerState)
+	if st != nil && st.logger != nil && level >= st.level {
+		st.logger.Log(level, msg, fields...)
+	}
+}
+
+// stdLogger is a Logger that writes records with a log.Logger.
+type stdLogger struct {
+	l *log.Logger
+}
+
+// NewStdLogger returns a Logger that writes records with l, or with the standard
+// logger of the log package if l is nil, one per line, e.g.:
+//
+//	warning: duplicate address detected nic=1 addr=fe80::1
+func NewStdLogger(l *log.Logger) Logger {
+	return stdLogger{l}
+}
+
+// Log implements Logger.Log.
+func (sl stdLogger) Log(level LogLevel, msg string, fields ...interface{}) {
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteString(": ")
+	b.WriteString(msg)
+	for i := 0; i < len(fields); i += 2 {
+		if i+1 < len(fields) {
+			fmt.Fprintf(&b, " %v=%v", fields[i], fields[i+1])
+		} else {
+			fmt.Fprintf(&b, " %v", fields[i])
+		}
+	}
+
+	if sl.l == nil {
+		log.Print(b.String())
+		return
+	}
+	sl.l.Print(b.String())
+}
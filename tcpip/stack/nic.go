@@ -5,44 +5,132 @@
 package stack
 
 import (
+	"context"
+	"reflect"
+	"runtime/pprof"
+	"runtime/trace"
 	"sync"
 	"sync/atomic"
 
 	"github.com/google/netstack/ilist"
 	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip"
 )
 
 // NIC represents a "network interface card" to which the networking stack is
 // attached.
 type NIC struct {
-	stack  *Stack
-	id     tcpip.NICID
-	linkEP LinkEndpoint
+	stack    *Stack
+	id       tcpip.NICID
+	linkEPID tcpip.LinkEndpointID
+	linkEP   LinkEndpoint
+
+	// sender is the link endpoint given to network endpoints; it allows
+	// the MTU to be changed at runtime.
+	sender nicLinkEndpoint
 
 	demux *transportDemuxer
 
+	// linkDown is 1 if the link endpoint reported that its carrier is
+	// down, 0 otherwise. It is only accessed atomically.
+	linkDown uint32
+
+	// removed is 1 once the NIC has been removed from the stack, 0
+	// otherwise. It is only accessed atomically.
+	removed uint32
+
+	// stats holds the NIC's counters. They are only accessed atomically.
+	stats NICStats
+
+	// profileCtxs holds the contexts with the pprof labels of the packets
+	// of each network protocol received from the NIC. It's immutable.
+	profileCtxs map[tcpip.NetworkProtocolNumber]context.Context
+
 	mu          sync.RWMutex
+	enabled     bool
 	promiscuous bool
+	spoofing    bool
+	gro         bool
+	config      NICConfig
+	workers     *workerPool
+	tentative   int
 	primary     map[tcpip.NetworkProtocolNumber]*ilist.List
 	endpoints   map[NetworkEndpointID]*referencedNetworkEndpoint
+
+	// groups holds the number of times each multicast group joined by the
+	// NIC was joined. It is protected by mu.
+	groups map[NetworkEndpointID]int
 }
 
-func newNIC(stack *Stack, id tcpip.NICID, ep LinkEndpoint) *NIC {
+func newNIC(stack *Stack, id tcpip.NICID, epID tcpip.LinkEndpointID, ep LinkEndpoint) *NIC {
 	return &NIC{
 		stack:     stack,
 		id:        id,
+		linkEPID:  epID,
 		linkEP:    ep,
+		sender:    nicLinkEndpoint{LinkEndpoint: ep},
 		demux:     newTransportDemuxer(stack),
 		primary:   make(map[tcpip.NetworkProtocolNumber]*ilist.List),
 		endpoints: make(map[NetworkEndpointID]*referencedNetworkEndpoint),
+		groups:    make(map[NetworkEndpointID]int),
+
+		profileCtxs: makeProfileContexts(stack, id),
 	}
 }
 
 // attachLinkEndpoint attaches the NIC to the endpoint, which will enable it
 // to start delivering packets.
 func (n *NIC) attachLinkEndpoint() {
-	n.linkEP.Attach(n)
+	n.mu.Lock()
+	n.enabled = true
+	w := n.workers
+	n.mu.Unlock()
+
+	if w != nil {
+		w.start()
+		n.linkEP.Attach(w)
+	} else {
+		n.linkEP.Attach(n)
+	}
+	n.stack.routes.invalidate()
+}
+
+// remove marks n as removed, so that packets delivered by its link endpoint
+// are dropped and routes through it can't be used anymore, and removes all of
+// its addresses and stops its workers. Network endpoints still referenced by
+// routes are released when the routes are.
+func (n *NIC) remove() {
+	atomic.StoreUint32(&n.removed, 1)
+
+	n.mu.RLock()
+	w := n.workers
+	n.mu.RUnlock()
+	if w != nil {
+		w.close()
+	}
+
+	n.mu.Lock()
+	var refs []*referencedNetworkEndpoint
+	for _, r := range n.endpoints {
+		if r.holdsInsertRef {
+			r.holdsInsertRef = false
+			r.markRemoved()
+			n.stopDADLocked(r, AddressTentative)
+			n.stopExpiryLocked(r)
+			refs = append(refs, r)
+		}
+	}
+	n.mu.Unlock()
+
+	for _, r := range refs {
+		r.decRef()
+	}
+}
+
+// isRemoved returns whether n has been removed from the stack.
+func (n *NIC) isRemoved() bool {
+	return atomic.LoadUint32(&n.removed) != 0
 }
 
 // setPromiscuousMode enables or disables promiscuous mode.
@@ -52,6 +140,67 @@ func (n *NIC) setPromiscuousMode(enable bool) {
 	n.mu.Unlock()
 }
 
+// setSpoofing enables or disables address spoofing.
+func (n *NIC) setSpoofing(enable bool) {
+	n.mu.Lock()
+	n.spoofing = enable
+	n.mu.Unlock()
+
+	n.stack.routes.invalidate()
+}
+
+// isSpoofing returns whether n is in spoofing mode.
+func (n *NIC) isSpoofing() bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.spoofing
+}
+
+// setGRO enables or disables generic receive offload.
+func (n *NIC) setGRO(enable bool) {
+	n.mu.Lock()
+	n.gro = enable
+	n.mu.Unlock()
+}
+
+// setWorkers enables the worker-pool mode of n, which must not be enabled yet.
+func (n *NIC) setWorkers(workers, queueSize int) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.enabled {
+		return tcpip.ErrInvalidEndpointState
+	}
+	n.workers = newWorkerPool(n, workers, queueSize)
+	return nil
+}
+
+// setConfig replaces the settings of n.
+func (n *NIC) setConfig(config NICConfig) {
+	n.mu.Lock()
+	n.config = config
+	n.mu.Unlock()
+}
+
+// getConfig returns the settings of n.
+func (n *NIC) getConfig() NICConfig {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.config
+}
+
+// setMTU overrides the MTU of n's link endpoint. A value of zero removes the
+// override. Other values can't exceed the MTU of the link endpoint, nor be
+// smaller than the minimum MTU of the network protocols of the stack.
+func (n *NIC) setMTU(mtu uint32) error {
+	if mtu != 0 && (mtu > n.linkEP.MTU() || mtu < n.stack.minimumMTU()) {
+		return tcpip.ErrInvalidOptionValue
+	}
+
+	atomic.StoreUint32(&n.sender.mtu, mtu)
+	return nil
+}
+
 // primaryEndpoint returns the primary endpoint of n for the given network
 // protocol.
 func (n *NIC) primaryEndpoint(protocol tcpip.NetworkProtocolNumber) *referencedNetworkEndpoint {
@@ -65,7 +214,7 @@ func (n *NIC) primaryEndpoint(protocol tcpip.NetworkProtocolNumber) *referencedN
 
 	for e := list.Front(); e != nil; e = e.Next() {
 		r := e.(*referencedNetworkEndpoint)
-		if r.tryIncRef() {
+		if r.state == AddressAssigned && r.tryIncRef() {
 			return r
 		}
 	}
@@ -73,34 +222,186 @@ func (n *NIC) primaryEndpoint(protocol tcpip.NetworkProtocolNumber) *referencedN
 	return nil
 }
 
-// findEndpoint finds the endpoint, if any, with the given address.
+// mainAddress returns the primary address of n for the given protocol, which is
+// the first assigned one in the preference order, along with its prefix.
+func (n *NIC) mainAddress(protocol tcpip.NetworkProtocolNumber) (tcpip.AddressWithPrefix, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	list := n.primary[protocol]
+	if list == nil {
+		return tcpip.AddressWithPrefix{}, false
+	}
+
+	for e := list.Front(); e != nil; e = e.Next() {
+		r := e.(*referencedNetworkEndpoint)
+		if r.holdsInsertRef && r.state == AddressAssigned {
+			return r.subnet(), true
+		}
+	}
+
+	return tcpip.AddressWithPrefix{}, false
+}
+
+// setPrimaryAddress moves addr to the front of the preference order of the
+// addresses of its protocol, so that it becomes the primary one.
+func (n *NIC) setPrimaryAddress(addr tcpip.Address) error {
+	n.mu.Lock()
+	r := n.endpoints[NetworkEndpointID{addr}]
+	if r == nil || !r.holdsInsertRef || r.group {
+		n.mu.Unlock()
+		return tcpip.ErrBadLocalAddress
+	}
+
+	l := n.primary[r.protocol]
+	l.Remove(r)
+	l.PushFront(r)
+	n.mu.Unlock()
+
+	n.stack.routes.invalidate()
+
+	return nil
+}
+
+// findEndpoint finds the endpoint, if any, with the given address. Addresses
+// that were removed, but are still referenced by routes, aren't found.
 func (n *NIC) findEndpoint(address tcpip.Address) *referencedNetworkEndpoint {
 	n.mu.RLock()
 	defer n.mu.RUnlock()
 
 	ref := n.endpoints[NetworkEndpointID{address}]
-	if ref == nil || !ref.tryIncRef() {
+	if ref == nil || ref.state != AddressAssigned || ref.isRemoved() || !ref.tryIncRef() {
+		return nil
+	}
+
+	return ref
+}
+
+// subnetEndpoint returns the assigned endpoint of the given protocol, if any,
+// whose subnet includes addr. Addresses without a subnet, i.e., whose prefix is
+// as long as the address, are ignored. If there are several, the one with the
+// longest prefix is picked, and then the first one that was added.
+func (n *NIC) subnetEndpoint(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) *referencedNetworkEndpoint {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	list := n.primary[protocol]
+	if list == nil {
+		return nil
+	}
+
+	var best *referencedNetworkEndpoint
+	for e := list.Front(); e != nil; e = e.Next() {
+		r := e.(*referencedNetworkEndpoint)
+		if r.state != AddressAssigned || !r.holdsInsertRef || !r.hasSubnet() || !r.subnet().Contains(addr) {
+			continue
+		}
+
+		if best == nil || r.prefixLen > best.prefixLen {
+			best = r
+		}
+	}
+
+	if best == nil || !best.tryIncRef() {
+		return nil
+	}
+
+	return best
+}
+
+// directedBroadcastEndpoint returns the assigned endpoint, if any, whose subnet
+// has addr as its directed broadcast address. IPv6 has no broadcast addresses,
+// and neither do subnets with fewer than two host bits.
+func (n *NIC) directedBroadcastEndpoint(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) *referencedNetworkEndpoint {
+	if protocol == header.IPv6ProtocolNumber {
 		return nil
 	}
 
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	list := n.primary[protocol]
+	if list == nil {
+		return nil
+	}
+
+	for e := list.Front(); e != nil; e = e.Next() {
+		r := e.(*referencedNetworkEndpoint)
+		if r.state != AddressAssigned || !r.holdsInsertRef || r.prefixLen > len(addr)*8-2 {
+			continue
+		}
+
+		if r.subnet().Broadcast() == addr && r.tryIncRef() {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// getRefOrCreateTemp returns the endpoint with the given address, creating a
+// "temporary" one if there isn't one already. Temporary endpoints don't hold
+// an insert reference, so they are removed once the last route through them
+// is released.
+func (n *NIC) getRefOrCreateTemp(protocol tcpip.NetworkProtocolNumber, address tcpip.Address) *referencedNetworkEndpoint {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	ref := n.endpoints[NetworkEndpointID{address}]
+	if ref != nil && ref.state != AddressAssigned {
+		// Addresses that aren't assigned can't be used, not even by
+		// promiscuous or spoofing NICs, until they are removed.
+		if ref.holdsInsertRef {
+			return nil
+		}
+	} else if ref != nil && ref.tryIncRef() {
+		return ref
+	}
+
+	ref, _ = n.addAddressLocked(protocol, tcpip.AddressWithPrefix{address, len(address) * 8}, true)
+	if ref != nil {
+		ref.holdsInsertRef = false
+	}
+
 	return ref
 }
 
-func (n *NIC) addAddressLocked(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address, replace bool) (*referencedNetworkEndpoint, error) {
+func (n *NIC) addAddressLocked(protocol tcpip.NetworkProtocolNumber, addr tcpip.AddressWithPrefix, replace bool) (*referencedNetworkEndpoint, error) {
+	ref, err := n.addEndpointLocked(protocol, addr, replace)
+	if err != nil {
+		return nil, err
+	}
+
+	l, ok := n.primary[protocol]
+	if !ok {
+		l = &ilist.List{}
+		n.primary[protocol] = l
+	}
+
+	l.PushBack(ref)
+
+	return ref, nil
+}
+
+// addEndpointLocked creates the endpoint of the given address, without adding
+// it to the primary list of its protocol.
+func (n *NIC) addEndpointLocked(protocol tcpip.NetworkProtocolNumber, addr tcpip.AddressWithPrefix, replace bool) (*referencedNetworkEndpoint, error) {
 	netProto, ok := n.stack.networkProtocols[protocol]
 	if !ok {
 		return nil, tcpip.ErrUnknownProtocol
 	}
 
 	// Create the new network endpoint.
-	ep, err := netProto.NewEndpoint(n.id, addr, n, n.linkEP)
+	ep, err := netProto.NewEndpoint(n.id, addr.Address, n, &n.sender)
 	if err != nil {
 		return nil, err
 	}
 
+	// Endpoints of addresses that were removed but are still referenced
+	// by routes, and temporary ones, can always be replaced.
 	id := *ep.ID()
 	if ref, ok := n.endpoints[id]; ok {
-		if !replace {
+		if !replace && ref.holdsInsertRef {
 			return nil, tcpip.ErrDuplicateAddress
 		}
 
@@ -108,29 +409,53 @@ func (n *NIC) addAddressLocked(protocol tcpip.NetworkProtocolNumber, addr tcpip.
 	}
 
 	ref := newReferencedNetworkEndpoint(ep, protocol, n)
+	ref.prefixLen = addr.PrefixLen
 
 	n.endpoints[id] = ref
 
-	l, ok := n.primary[protocol]
-	if !ok {
-		l = &ilist.List{}
-		n.primary[protocol] = l
-	}
-
-	l.PushBack(ref)
-
 	return ref, nil
 }
 
 // AddAddress adds a new address to n, so that it starts accepting packets
-// targeted at the given address (and network protocol).
+// targeted at the given address (and network protocol). It can be called at
+// any time, including to add back an address that was removed. IPv6 addresses
+// are tentative until duplicate address detection completes, if it is enabled
+// in n's configuration.
 func (n *NIC) AddAddress(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) error {
+	return n.AddAddressWithPrefix(protocol, tcpip.AddressWithPrefix{addr, len(addr) * 8})
+}
+
+// AddAddressWithPrefix adds a new address to n, like AddAddress, along with the
+// prefix of its subnet.
+func (n *NIC) AddAddressWithPrefix(protocol tcpip.NetworkProtocolNumber, addr tcpip.AddressWithPrefix) error {
+	_, err := n.addAddress(protocol, addr)
+	return err
+}
+
+// addAddress implements AddAddressWithPrefix. It also returns the initial state
+// of the address.
+func (n *NIC) addAddress(protocol tcpip.NetworkProtocolNumber, addr tcpip.AddressWithPrefix) (AddressState, error) {
+	if addr.PrefixLen < 0 || addr.PrefixLen > len(addr.Address)*8 {
+		return 0, tcpip.ErrInvalidPrefix
+	}
+
 	// Add the endpoint.
 	n.mu.Lock()
-	_, err := n.addAddressLocked(protocol, addr, false)
+	ref, err := n.addAddressLocked(protocol, addr, false)
+	if err != nil {
+		n.mu.Unlock()
+		return 0, err
+	}
+
+	if n.needsDADLocked(protocol) {
+		n.startDADLocked(ref)
+	}
+	state := ref.state
 	n.mu.Unlock()
 
-	return err
+	n.stack.routes.invalidate()
+
+	return state, nil
 }
 
 func (n *NIC) removeEndpointLocked(r *referencedNetworkEndpoint) {
@@ -147,7 +472,9 @@ func (n *NIC) removeEndpointLocked(r *referencedNetworkEndpoint) {
 	}
 
 	delete(n.endpoints, id)
-	n.primary[r.protocol].Remove(r)
+	if !r.group {
+		n.primary[r.protocol].Remove(r)
+	}
 }
 
 func (n *NIC) removeEndpoint(r *referencedNetworkEndpoint) {
@@ -156,16 +483,82 @@ func (n *NIC) removeEndpoint(r *referencedNetworkEndpoint) {
 	n.mu.Unlock()
 }
 
-// RemoveAddress removes an address from n.
+// RemoveAddress removes an address from n. Routes that use the address can't be
+// used to send packets anymore, but the address keeps receiving packets until
+// they are released.
 func (n *NIC) RemoveAddress(addr tcpip.Address) error {
+	_, _, err := n.removeAddress(addr, nil)
+	return err
+}
+
+// removeAddress implements RemoveAddress. It also returns the protocol of the
+// address and the length of its prefix. If expiry isn't nil, the address is
+// only removed if expiry is the stop channel of its expiry.
+func (n *NIC) removeAddress(addr tcpip.Address, expiry chan struct{}) (tcpip.NetworkProtocolNumber, int, error) {
 	n.mu.Lock()
 	r := n.endpoints[NetworkEndpointID{addr}]
-	if r == nil || !r.holdsInsertRef {
+	if r == nil || !r.holdsInsertRef || r.group || expiry != nil && r.expiryStop != expiry {
+		n.mu.Unlock()
+		return 0, 0, tcpip.ErrBadLocalAddress
+	}
+
+	r.holdsInsertRef = false
+	r.markRemoved()
+	n.stopDADLocked(r, AddressTentative)
+	n.stopExpiryLocked(r)
+	n.mu.Unlock()
+
+	r.decRef()
+	n.stack.routes.invalidate()
+
+	return r.protocol, r.prefixLen, nil
+}
+
+// joinGroup joins the multicast group addr, so that n starts accepting packets
+// targeted at it. The endpoint of the group is added the first time it is
+// joined; it isn't in the primary list, so that it is never used as a source
+// address.
+func (n *NIC) joinGroup(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	id := NetworkEndpointID{addr}
+	if n.groups[id] > 0 {
+		n.groups[id]++
+		return nil
+	}
+
+	ref, err := n.addEndpointLocked(protocol, tcpip.AddressWithPrefix{addr, len(addr) * 8}, false)
+	if err != nil {
+		return err
+	}
+	ref.group = true
+	n.groups[id] = 1
+
+	return nil
+}
+
+// leaveGroup leaves the multicast group addr. Its endpoint is removed once it
+// has been left as many times as it was joined.
+func (n *NIC) leaveGroup(addr tcpip.Address) error {
+	n.mu.Lock()
+	id := NetworkEndpointID{addr}
+	joins := n.groups[id]
+	if joins == 0 {
 		n.mu.Unlock()
 		return tcpip.ErrBadLocalAddress
 	}
 
+	if joins > 1 {
+		n.groups[id]--
+		n.mu.Unlock()
+		return nil
+	}
+
+	delete(n.groups, id)
+	r := n.endpoints[id]
 	r.holdsInsertRef = false
+	r.markRemoved()
 	n.mu.Unlock()
 
 	r.decRef()
@@ -173,87 +566,346 @@ func (n *NIC) RemoveAddress(addr tcpip.Address) error {
 	return nil
 }
 
+// loopMulticast delivers a copy of an outbound packet sent to the multicast
+// group addr to n, as if it had been received, if n joined the group.
+func (n *NIC) loopMulticast(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address, hdr *buffer.Prependable, payload buffer.VectorisedView) {
+	n.mu.RLock()
+	joined := n.groups[NetworkEndpointID{addr}] > 0
+	n.mu.RUnlock()
+
+	if !joined {
+		return
+	}
+
+	v := make(buffer.View, 0, hdr.UsedLength()+payload.Size())
+	v = append(v, hdr.UsedBytes()...)
+	for _, p := range payload.Views() {
+		v = append(v, p...)
+	}
+
+	n.DeliverNetworkPacket(n.linkEP, protocol, v)
+}
+
 // DeliverNetworkPacket finds the appropriate network protocol endpoint and
 // hands the packet over for further processing. This function is called when
 // the NIC receives a packet from the physical interface.
 func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, protocol tcpip.NetworkProtocolNumber, v buffer.View) {
+	if n.isRemoved() {
+		return
+	}
+
+	if n.stack.faulting() {
+		var ok bool
+		p := TracePacket{Point: TraceLinkIn, NIC: n.id, NetProto: protocol, Data: v}
+		if v, ok = n.stack.faultIn(&p, n.delayedPacketDeliverer(protocol)); !ok {
+			return
+		}
+	}
+
+	if n.stack.Profiling() {
+		ctx := n.profileContext(protocol)
+		pprof.SetGoroutineLabels(ctx)
+		defer pprof.SetGoroutineLabels(context.Background())
+		if trace.IsEnabled() {
+			defer trace.StartRegion(ctx, "netstack.DeliverNetworkPacket").End()
+		}
+	}
+
+	n.countReceived(len(v))
+	n.traceLinkIn(protocol, v)
+	n.deliverNetworkPacket(protocol, v)
+}
+
+// delayedPacketDeliverer returns a function for Stack.faultIn that returns the
+// function delivering packets of the given protocol delayed by a fault injected
+// at TraceLinkIn.
+func (n *NIC) delayedPacketDeliverer(protocol tcpip.NetworkProtocolNumber) func() func(buffer.View) {
+	return func() func(buffer.View) {
+		return func(v buffer.View) {
+			if n.isRemoved() {
+				return
+			}
+
+			n.countReceived(len(v))
+			n.traceLinkIn(protocol, v)
+			n.deliverNetworkPacket(protocol, v)
+		}
+	}
+}
+
+// traceLinkIn reports a packet delivered by the link endpoint of n to the trace
+// hooks.
+func (n *NIC) traceLinkIn(protocol tcpip.NetworkProtocolNumber, v buffer.View) {
+	t := n.stack.startTrace(TraceLinkIn, n.id, protocol, nil, v.ToVectorisedView())
+	t.done(VerdictAccepted)
+}
+
+// countReceived updates the receive counters of n for a packet of the given
+// size.
+func (n *NIC) countReceived(size int) {
+	atomic.AddUint64(&n.stats.Rx.Packets, 1)
+	atomic.AddUint64(&n.stats.Rx.Bytes, uint64(size))
+}
+
+// deliverNetworkPacket implements DeliverNetworkPacket, without updating the
+// receive counters.
+func (n *NIC) deliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, v buffer.View) {
+	t := n.stack.startTrace(TraceNetworkIn, n.id, protocol, nil, v.ToVectorisedView())
+
 	netProto, ok := n.stack.networkProtocols[protocol]
 	if !ok {
 		atomic.AddUint64(&n.stack.stats.UnknownProtocolRcvdPackets, 1)
+		atomic.AddUint64(&n.stats.RxErrors, 1)
+		t.done(VerdictUnknownProtocol)
 		return
 	}
 
+	atomic.AddUint64(&n.stack.stats.IP.PacketsReceived, 1)
+
 	if len(v) < netProto.MinimumPacketSize() {
 		atomic.AddUint64(&n.stack.stats.MalformedRcvdPackets, 1)
+		atomic.AddUint64(&n.stats.RxErrors, 1)
+		t.done(VerdictMalformed)
 		return
 	}
 
 	src, dst := netProto.ParseAddresses(v)
+	t.setAddresses(src, dst)
 	id := NetworkEndpointID{dst}
 
 	n.mu.RLock()
 	ref := n.endpoints[id]
-	if ref != nil && !ref.tryIncRef() {
+	if ref != nil && (ref.state != AddressAssigned || !ref.tryIncRef()) {
 		ref = nil
 	}
-	promiscuous := n.promiscuous
+	promiscuous := n.promiscuous || n.linkEP.Capabilities()&CapabilityLoopback != 0
+	forwarding := n.config.Forwarding
+	dad := n.tentative > 0
 	n.mu.RUnlock()
 
+	if dad && protocol == header.IPv6ProtocolNumber {
+		n.checkDADConflict(v)
+	}
+
+	if ref == nil {
+		ref = n.directedBroadcastEndpoint(protocol, dst)
+	}
+
+	if ref == nil && forwarding {
+		t.done(VerdictForwarded)
+		n.forwardPacket(netProto, src, dst, v)
+		return
+	}
+
 	if ref == nil && promiscuous {
 		// Try again with the lock in exclusive mode. If we still can't
 		// get the endpoint, create a new "temporary" one. It will only
 		// exist while there's a route through it.
-		n.mu.Lock()
-		ref = n.endpoints[id]
-		if ref == nil || !ref.tryIncRef() {
-			ref, _ = n.addAddressLocked(protocol, dst, true)
-			if ref != nil {
-				ref.holdsInsertRef = false
-			}
-		}
-		n.mu.Unlock()
+		ref = n.getRefOrCreateTemp(protocol, dst)
 	}
 
 	if ref == nil {
 		atomic.AddUint64(&n.stack.stats.UnknownNetworkEndpointRcvdPackets, 1)
+		atomic.AddUint64(&n.stats.RxErrors, 1)
+		t.done(VerdictNoEndpoint)
 		return
 	}
 
+	t.done(VerdictAccepted)
 	r := makeRoute(protocol, dst, src, ref)
-	ref.ep.HandlePacket(&r, v)
+	ref.ep.HandlePacket(&r, v.ToVectorisedView())
 	ref.decRef()
 }
 
+// forwardPacket handles a packet received by n, which has forwarding enabled,
+// that isn't addressed to any of its addresses. Packets addressed to other NICs
+// of the stack are delivered to them; the others are forwarded according to the
+// route table.
+func (n *NIC) forwardPacket(netProto NetworkProtocol, src, dst tcpip.Address, v buffer.View) {
+	if ref := n.stack.findLocalEndpoint(dst); ref != nil {
+		r := makeRoute(netProto.Number(), dst, src, ref)
+		ref.ep.HandlePacket(&r, v.ToVectorisedView())
+		ref.decRef()
+		return
+	}
+
+	fwd, ok := netProto.(ForwardingNetworkProtocol)
+	if !ok {
+		atomic.AddUint64(&n.stack.stats.IP.PacketsDropped, 1)
+		return
+	}
+
+	r, err := n.stack.FindRoute(0, "", dst, netProto.Number())
+	if err != nil {
+		atomic.AddUint64(&n.stack.stats.IP.PacketsDropped, 1)
+		return
+	}
+	defer r.Release()
+
+	// Packets are neither fragmented nor answered with ICMP errors, so
+	// the ones that are too big or expired are dropped silently.
+	if uint32(len(v)) > r.ref.nic.sender.MTU() || !fwd.PrepareForward(v) {
+		atomic.AddUint64(&n.stack.stats.IP.PacketsDropped, 1)
+		return
+	}
+
+	if err := r.writeForwardedPacket(v); err == nil {
+		atomic.AddUint64(&n.stack.stats.IP.PacketsForwarded, 1)
+	}
+}
+
+// DeliverNetworkPackets implements BatchNetworkDispatcher.DeliverNetworkPackets.
+// If generic receive offload is enabled, consecutive segments of the same TCP
+// flow are coalesced before being handed over for further processing.
+func (n *NIC) DeliverNetworkPackets(linkEP LinkEndpoint, pkts []InboundPacket) {
+	if n.isRemoved() {
+		return
+	}
+
+	if n.stack.faulting() {
+		pkts = n.faultPackets(pkts)
+	}
+
+	for i := range pkts {
+		n.countReceived(len(pkts[i].Data))
+		n.traceLinkIn(pkts[i].Protocol, pkts[i].Data)
+	}
+
+	n.mu.RLock()
+	gro := n.gro
+	n.mu.RUnlock()
+
+	if gro {
+		pkts = coalesceTCPSegments(pkts, n.linkEP.Capabilities()&CapabilityRXChecksumOffload == 0)
+	}
+
+	if !n.stack.Profiling() {
+		for i := range pkts {
+			n.deliverNetworkPacket(pkts[i].Protocol, pkts[i].Data)
+		}
+		return
+	}
+
+	for i := range pkts {
+		ctx := n.profileContext(pkts[i].Protocol)
+		pprof.SetGoroutineLabels(ctx)
+		region := trace.StartRegion(ctx, "netstack.DeliverNetworkPacket")
+		n.deliverNetworkPacket(pkts[i].Protocol, pkts[i].Data)
+		region.End()
+	}
+	pprof.SetGoroutineLabels(context.Background())
+}
+
+// faultPackets applies the faults injected at TraceLinkIn to a batch of packets,
+// returning those that must be delivered now.
+func (n *NIC) faultPackets(pkts []InboundPacket) []InboundPacket {
+	kept := make([]InboundPacket, 0, len(pkts))
+	for _, pkt := range pkts {
+		p := TracePacket{Point: TraceLinkIn, NIC: n.id, NetProto: pkt.Protocol, Data: pkt.Data}
+		v, ok := n.stack.faultIn(&p, n.delayedPacketDeliverer(pkt.Protocol))
+		if ok {
+			pkt.Data = v
+			kept = append(kept, pkt)
+		}
+	}
+	return kept
+}
+
+// LinkStateChanged implements NetworkDispatcher.LinkStateChanged. It records the
+// new state and, when it changes, notifies the stack.
+func (n *NIC) LinkStateChanged(linkEP LinkEndpoint, up bool) {
+	if n.isRemoved() {
+		return
+	}
+
+	var v uint32
+	if !up {
+		v = 1
+	}
+
+	if atomic.SwapUint32(&n.linkDown, v) == v {
+		return
+	}
+
+	n.stack.linkStateChanged(n, up)
+}
+
+// isLinkUp returns whether the carrier of n's link endpoint is up.
+func (n *NIC) isLinkUp() bool {
+	return atomic.LoadUint32(&n.linkDown) == 0
+}
+
 // DeliverTransportPacket delivers the packets to the appropriate transport
 // protocol endpoint.
-func (n *NIC) DeliverTransportPacket(r *Route, protocol tcpip.TransportProtocolNumber, v buffer.View) {
+//
+// The packet is reported to the TraceTransportIn hooks once it has been
+// handled, so after any packets sent in response to it.
+func (n *NIC) DeliverTransportPacket(r *Route, protocol tcpip.TransportProtocolNumber, vv buffer.VectorisedView) {
+	if n.stack.faulting() {
+		p := TracePacket{Point: TraceTransportIn, NIC: n.id, NetProto: r.NetProto, TransProto: protocol, Src: r.RemoteAddress, Dst: r.LocalAddress, Data: vv.ToView()}
+		v, ok := n.stack.faultIn(&p, func() func(buffer.View) {
+			rc := r.Clone()
+			return func(v buffer.View) {
+				if !n.isRemoved() {
+					n.deliverTransportPacket(&rc, protocol, v.ToVectorisedView())
+				}
+				rc.Release()
+			}
+		})
+		if !ok {
+			return
+		}
+		vv = v.ToVectorisedView()
+	}
+
+	n.deliverTransportPacket(r, protocol, vv)
+}
+
+// deliverTransportPacket implements DeliverTransportPacket, once faults have
+// been applied.
+func (n *NIC) deliverTransportPacket(r *Route, protocol tcpip.TransportProtocolNumber, vv buffer.VectorisedView) {
+	atomic.AddUint64(&n.stack.stats.IP.PacketsDelivered, 1)
+
+	t := n.stack.startTrace(TraceTransportIn, n.id, r.NetProto, nil, vv)
+	t.p.TransProto = protocol
+	t.setAddresses(r.RemoteAddress, r.LocalAddress)
+
 	state, ok := n.stack.transportProtocols[protocol]
 	if !ok {
 		atomic.AddUint64(&n.stack.stats.UnknownProtocolRcvdPackets, 1)
+		t.done(VerdictUnknownProtocol)
 		return
 	}
 
+	// The headers are parsed from a single view, which is the only view of
+	// the packet, as delivered by link endpoints, without copying it.
+	v := vv.ToView()
 	transProto := state.proto
 	if len(v) < transProto.MinimumPacketSize() {
 		atomic.AddUint64(&n.stack.stats.MalformedRcvdPackets, 1)
+		t.done(VerdictMalformed)
 		return
 	}
 
 	srcPort, dstPort, err := transProto.ParsePorts(v)
 	if err != nil {
 		atomic.AddUint64(&n.stack.stats.MalformedRcvdPackets, 1)
+		t.done(VerdictMalformed)
 		return
 	}
 
 	id := TransportEndpointID{dstPort, r.LocalAddress, srcPort, r.RemoteAddress}
-	if n.demux.deliverPacket(r, protocol, v, id) ||
-		n.stack.demux.deliverPacket(r, protocol, v, id) {
+	if n.demux.deliverPacket(r, protocol, vv, id) ||
+		n.stack.demux.deliverPacket(r, protocol, vv, id) {
+		t.setOwner(n, protocol, id)
+		t.done(VerdictAccepted)
 		return
 	}
 
 	// Try to deliver to per-stack default handler.
 	if state.defaultHandler != nil {
 		if state.defaultHandler(r, id, v) {
+			t.done(VerdictAccepted)
 			return
 		}
 	}
@@ -261,6 +913,7 @@ func (n *NIC) DeliverTransportPacket(r *Route, protocol tcpip.TransportProtocolN
 	// We could not find an appropriate destination for this packet, so
 	// deliver it to the global handler.
 	transProto.HandleUnknownDestinationPacket(r, id, v)
+	t.done(VerdictNoEndpoint)
 }
 
 // ID returns the identifier of n.
@@ -268,6 +921,89 @@ func (n *NIC) ID() tcpip.NICID {
 	return n.id
 }
 
+// info returns the interface information of n.
+func (n *NIC) info() NICInfo {
+	var info NICInfo
+	if la, ok := n.linkEP.(LinkAddresser); ok {
+		info.LinkAddress = la.LinkAddress()
+	}
+	info.MTU = n.sender.MTU()
+	info.Flags.Running = n.isLinkUp()
+	info.Flags.Loopback = n.linkEP.Capabilities()&CapabilityLoopback != 0
+
+	n.mu.RLock()
+	info.Flags.Up = n.enabled
+	info.Flags.Promiscuous = n.promiscuous
+	info.Flags.Spoofing = n.spoofing
+	info.Flags.GRO = n.gro
+	info.Config = n.config
+	for id, r := range n.endpoints {
+		if r.holdsInsertRef && !r.group {
+			info.Addresses = append(info.Addresses, ProtocolAddress{r.protocol, id.LocalAddress, r.prefixLen})
+		}
+	}
+	n.mu.RUnlock()
+
+	loadCounters(reflect.ValueOf(&info.Stats).Elem(), reflect.ValueOf(&n.stats).Elem())
+
+	return info
+}
+
+// nicLinkEndpoint wraps the link endpoint of a NIC so that its MTU can be
+// overridden at runtime.
+type nicLinkEndpoint struct {
+	LinkEndpoint
+
+	// mtu, if not zero, overrides the MTU of the link endpoint. It is only
+	// accessed atomically.
+	mtu uint32
+}
+
+// MTU implements LinkEndpoint.MTU.
+func (e *nicLinkEndpoint) MTU() uint32 {
+	if mtu := atomic.LoadUint32(&e.mtu); mtu != 0 {
+		return mtu
+	}
+	return e.LinkEndpoint.MTU()
+}
+
+// WritePacket implements LinkEndpoint.WritePacket. It reports the packet to the
+// TraceLinkOut hooks of the stack.
+func (e *nicLinkEndpoint) WritePacket(r *Route, hdr *buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) error {
+	if s := r.ref.nic.stack; s.faulting() {
+		var ok bool
+		p := TracePacket{Point: TraceLinkOut, NIC: r.ref.nic.id, NetProto: protocol, Src: r.LocalAddress, Dst: r.RemoteAddress, Header: hdr.View(), Data: payload.ToView()}
+		if hdr, payload, ok = s.faultOut(&p, hdr, payload, int(e.LinkEndpoint.MaxHeaderLength()), func() func(*buffer.Prependable, buffer.VectorisedView) {
+			rc := r.Clone()
+			return func(hdr *buffer.Prependable, payload buffer.VectorisedView) {
+				e.write(&rc, hdr, payload, protocol)
+				rc.Release()
+			}
+		}); !ok {
+			return nil
+		}
+	}
+
+	return e.write(r, hdr, payload, protocol)
+}
+
+// write writes a packet to the link endpoint, once faults have been applied.
+func (e *nicLinkEndpoint) write(r *Route, hdr *buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) error {
+	nic := r.ref.nic
+	t := nic.stack.startTrace(TraceLinkOut, nic.id, protocol, hdr.View(), payload)
+	t.setAddresses(r.LocalAddress, r.RemoteAddress)
+
+	err := e.LinkEndpoint.WritePacket(r, hdr, payload, protocol)
+	t.sent(err)
+
+	// Loopback endpoints already deliver the packets they send.
+	if err == nil && r.MulticastLoop && isMulticastAddress(r.RemoteAddress) && e.Capabilities()&CapabilityLoopback == 0 {
+		nic.loopMulticast(protocol, r.RemoteAddress, hdr, payload)
+	}
+
+	return err
+}
+
 type referencedNetworkEndpoint struct {
 	ilist.Entry
 
@@ -281,6 +1017,29 @@ type referencedNetworkEndpoint struct {
 	// endpoint. It is reset to false when RemoveAddress is called on the
 	// NIC.
 	holdsInsertRef bool
+
+	// removed is 1 once the address of the endpoint has been removed from
+	// the NIC, 0 otherwise. It is only accessed atomically.
+	removed uint32
+
+	// state is the state of the address of the endpoint, and dadStop is
+	// closed to stop its duplicate address detection, if it is in
+	// progress. They are protected by the NIC's mutex.
+	state   AddressState
+	dadStop chan struct{}
+
+	// expiryStop is closed to stop the expiry of the endpoint's address,
+	// if its lifetime was set. It is protected by the NIC's mutex.
+	expiryStop chan struct{}
+
+	// prefixLen is the length of the prefix of the subnet of the
+	// endpoint's address. It doesn't change once the endpoint is added.
+	prefixLen int
+
+	// group is set if the endpoint's address is a multicast group joined
+	// by the NIC, rather than one of its addresses. It doesn't change once
+	// the endpoint is added.
+	group bool
 }
 
 func newReferencedNetworkEndpoint(ep NetworkEndpoint, protocol tcpip.NetworkProtocolNumber, nic *NIC) *referencedNetworkEndpoint {
@@ -293,6 +1052,17 @@ func newReferencedNetworkEndpoint(ep NetworkEndpoint, protocol tcpip.NetworkProt
 	}
 }
 
+// subnet returns the address of r along with the prefix of its subnet.
+func (r *referencedNetworkEndpoint) subnet() tcpip.AddressWithPrefix {
+	return tcpip.AddressWithPrefix{r.ep.ID().LocalAddress, r.prefixLen}
+}
+
+// hasSubnet returns whether the address of r belongs to a subnet with other
+// addresses.
+func (r *referencedNetworkEndpoint) hasSubnet() bool {
+	return r.prefixLen < len(r.ep.ID().LocalAddress)*8
+}
+
 func (r *referencedNetworkEndpoint) decRef() {
 	if atomic.AddInt32(&r.refs, -1) == 0 {
 		r.nic.removeEndpoint(r)
@@ -303,6 +1073,17 @@ func (r *referencedNetworkEndpoint) incRef() {
 	atomic.AddInt32(&r.refs, 1)
 }
 
+// markRemoved records that the address of r has been removed, so that routes
+// using it fail.
+func (r *referencedNetworkEndpoint) markRemoved() {
+	atomic.StoreUint32(&r.removed, 1)
+}
+
+// isRemoved returns whether the address of r has been removed.
+func (r *referencedNetworkEndpoint) isRemoved() bool {
+	return atomic.LoadUint32(&r.removed) != 0
+}
+
 func (r *referencedNetworkEndpoint) tryIncRef() bool {
 	for {
 		v := atomic.LoadInt32(&r.refs)
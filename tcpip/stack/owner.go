@@ -0,0 +1,147 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"reflect"
+	"sync/atomic"
+)
+
+// OwnerStats holds the counters of the transport endpoints attributed to an
+// owner.
+type OwnerStats struct {
+	// Rx counts the packets and bytes received by the endpoints.
+	Rx NICDirectionStats
+
+	// Tx counts the packets and bytes sent by the endpoints.
+	Tx NICDirectionStats
+}
+
+// Owner is an opaque label that transport endpoints are attributed to, e.g., a
+// tenant of a multi-tenant application. It accounts for the traffic and memory
+// of its endpoints, and can limit the memory they use. A nil *Owner stands for
+// endpoints that aren't attributed to anyone; it accounts for nothing.
+type Owner struct {
+	name string
+
+	// The following fields are only accessed atomically.
+	stats    OwnerStats
+	memUsed  int64
+	memLimit int64
+}
+
+// Owner returns the owner with the given name, creating it if needed. Endpoints
+// are attributed to owners by setting tcpip.OwnerOption on them.
+func (s *Stack) Owner(name string) *Owner {
+	s.ownersMu.Lock()
+	defer s.ownersMu.Unlock()
+
+	o := s.owners[name]
+	if o == nil {
+		o = &Owner{name: name}
+		s.owners[name] = o
+	}
+
+	return o
+}
+
+// Owners returns all the owners endpoints were attributed to, indexed by name.
+func (s *Stack) Owners() map[string]*Owner {
+	s.ownersMu.Lock()
+	defer s.ownersMu.Unlock()
+
+	owners := make(map[string]*Owner, len(s.owners))
+	for name, o := range s.owners {
+		owners[name] = o
+	}
+
+	return owners
+}
+
+// Name returns the name of o, or an empty string if o is nil.
+func (o *Owner) Name() string {
+	if o == nil {
+		return ""
+	}
+	return o.name
+}
+
+// Stats returns a snapshot of the counters of o.
+func (o *Owner) Stats() OwnerStats {
+	var stats OwnerStats
+	loadCounters(reflect.ValueOf(&stats).Elem(), reflect.ValueOf(&o.stats).Elem())
+	return stats
+}
+
+// SetMemoryLimit limits the number of bytes held in the receive and send queues
+// of the endpoints attributed to o, on top of the stack's limit. A limit of zero
+// removes the limit.
+func (o *Owner) SetMemoryLimit(limit int) {
+	atomic.StoreInt64(&o.memLimit, int64(limit))
+}
+
+// MemoryUsage returns the number of bytes currently held in the receive and
+// send queues of the endpoints attributed to o.
+func (o *Owner) MemoryUsage() int {
+	return int(atomic.LoadInt64(&o.memUsed))
+}
+
+// CountReceived is called by endpoints attributed to o when they receive a
+// packet of the given size.
+func (o *Owner) CountReceived(size int) {
+	if o != nil {
+		atomic.AddUint64(&o.stats.Rx.Packets, 1)
+		atomic.AddUint64(&o.stats.Rx.Bytes, uint64(size))
+	}
+}
+
+// CountSent is called by endpoints attributed to o when they send a packet of
+// the given size.
+func (o *Owner) CountSent(size int) {
+	if o != nil {
+		atomic.AddUint64(&o.stats.Tx.Packets, 1)
+		atomic.AddUint64(&o.stats.Tx.Bytes, uint64(size))
+	}
+}
+
+// ReserveMemoryFor is like ReserveMemory, but it also reserves the memory from
+// the given owner, and fails if that would exceed the owner's limit.
+func (s *Stack) ReserveMemoryFor(o *Owner, n int) bool {
+	if o == nil {
+		if !s.ReserveMemory(n) {
+			s.logMemoryLimit(o, n)
+			return false
+		}
+		return true
+	}
+
+	if !reserveMemory(&o.memUsed, &o.memLimit, n) {
+		s.logMemoryLimit(o, n)
+		return false
+	}
+
+	if !s.ReserveMemory(n) {
+		atomic.AddInt64(&o.memUsed, -int64(n))
+		s.logMemoryLimit(o, n)
+		return false
+	}
+
+	return true
+}
+
+// logMemoryLimit logs that n bytes couldn't be reserved for o.
+func (s *Stack) logMemoryLimit(o *Owner, n int) {
+	if s.LogEnabled(LogDebug) {
+		s.Log(LogDebug, "memory limit reached", "owner", o.Name(), "bytes", n, "usage", s.MemoryUsage())
+	}
+}
+
+// ReleaseMemoryFor releases n bytes previously reserved with ReserveMemoryFor.
+func (s *Stack) ReleaseMemoryFor(o *Owner, n int) {
+	if o != nil {
+		atomic.AddInt64(&o.memUsed, -int64(n))
+	}
+	s.ReleaseMemory(n)
+}
@@ -0,0 +1,106 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"context"
+	"fmt"
+	"runtime/pprof"
+	"sync/atomic"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// The following are the keys of the pprof labels set by a stack when profiling
+// is enabled with SetProfiling.
+const (
+	// ProfileLabelNIC holds the id of the NIC a packet was received from,
+	// while the stack handles it.
+	ProfileLabelNIC = "netstack.nic"
+
+	// ProfileLabelProtocol holds the name of the network protocol of a
+	// packet while the stack handles it, or the name of the transport
+	// protocol of the endpoint a goroutine serves.
+	ProfileLabelProtocol = "netstack.protocol"
+
+	// ProfileLabelFlow holds the addresses and ports of the endpoint a
+	// goroutine serves, e.g., "10.0.0.1:80->10.0.0.2:4096", or only the
+	// local ones for listening endpoints.
+	ProfileLabelFlow = "netstack.flow"
+)
+
+// SetProfiling enables or disables the profiling annotations of the stack. When
+// they're enabled, packets received from NICs are handled with pprof labels
+// naming the NIC and their network protocol, and the goroutines that serve
+// endpoints run with labels naming their transport protocol and flow, so that
+// CPU profiles of the embedding application attribute the cost of the stack to
+// them. While the execution is traced, the handling of received packets is also
+// recorded as runtime/trace regions.
+//
+// The labels of the goroutines of link endpoints are replaced while they
+// deliver packets, and cleared afterwards. Goroutines started before profiling
+// is enabled aren't labelled.
+func (s *Stack) SetProfiling(enabled bool) {
+	var v uint32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreUint32(&s.profiling, v)
+}
+
+// Profiling returns whether the profiling annotations of the stack are enabled.
+func (s *Stack) Profiling() bool {
+	return atomic.LoadUint32(&s.profiling) != 0
+}
+
+// GoWithLabels is like Go, but if profiling is enabled, f runs with the pprof
+// labels returned by labels, which alternates keys and values like the
+// arguments of pprof.Labels. labels is only called then.
+func (s *Stack) GoWithLabels(labels func() []string, f func()) {
+	if !s.Profiling() {
+		s.Go(f)
+		return
+	}
+
+	l := pprof.Labels(labels()...)
+	s.Go(func() {
+		pprof.Do(context.Background(), l, func(context.Context) {
+			f()
+		})
+	})
+}
+
+// FlowLabel returns the value of ProfileLabelFlow for an endpoint with the
+// given id.
+func FlowLabel(id TransportEndpointID) string {
+	if id.RemoteAddress == "" {
+		return fmt.Sprintf("%v:%d", id.LocalAddress, id.LocalPort)
+	}
+	return fmt.Sprintf("%v:%d->%v:%d", id.LocalAddress, id.LocalPort, id.RemoteAddress, id.RemotePort)
+}
+
+// makeProfileContexts returns the contexts holding the pprof labels of the
+// packets of each network protocol of s received from the NIC with the given
+// id.
+func makeProfileContexts(s *Stack, id tcpip.NICID) map[tcpip.NetworkProtocolNumber]context.Context {
+	ctxs := make(map[tcpip.NetworkProtocolNumber]context.Context, len(s.networkProtocols))
+	for number := range s.networkProtocols {
+		name, ok := s.networkProtocolNames[number]
+		if !ok {
+			name = fmt.Sprintf("%#x", number)
+		}
+		ctxs[number] = pprof.WithLabels(context.Background(), pprof.Labels(ProfileLabelNIC, fmt.Sprint(id), ProfileLabelProtocol, name))
+	}
+	return ctxs
+}
+
+// profileContext returns the context holding the pprof labels of the packets of
+// the given protocol received from n.
+func (n *NIC) profileContext(protocol tcpip.NetworkProtocolNumber) context.Context {
+	if ctx, ok := n.profileCtxs[protocol]; ok {
+		return ctx
+	}
+	return context.Background()
+}
@@ -5,6 +5,7 @@
 package stack
 
 import (
+	"sort"
 	"sync"
 
 	"github.com/google/netstack/tcpip"
@@ -41,7 +42,132 @@ type TransportEndpointID struct {
 type TransportEndpoint interface {
 	// HandlePacket is called by the stack when new packets arrive to
 	// this transport endpoint.
-	HandlePacket(r *Route, id TransportEndpointID, v buffer.View)
+	HandlePacket(r *Route, id TransportEndpointID, vv buffer.VectorisedView)
+}
+
+// LinkStateAwareEndpoint is implemented by transport endpoints that want to be
+// notified when the link of a NIC goes down, so that they can fail right away
+// instead of waiting for timeouts.
+type LinkStateAwareEndpoint interface {
+	TransportEndpoint
+
+	// HandleLinkDown is called by the stack when the link of the given
+	// NIC goes down.
+	HandleLinkDown(nicID tcpip.NICID)
+}
+
+// MTUAwareEndpoint is implemented by transport endpoints that want to be
+// notified when the MTU of a NIC is changed at runtime.
+type MTUAwareEndpoint interface {
+	TransportEndpoint
+
+	// HandleMTUChange is called by the stack after the MTU of the given
+	// NIC changes.
+	HandleMTUChange(nicID tcpip.NICID)
+}
+
+// NICRemovalAwareEndpoint is implemented by transport endpoints that want to be
+// notified when a NIC is removed from the stack, so that they can abort if they
+// were using it.
+type NICRemovalAwareEndpoint interface {
+	TransportEndpoint
+
+	// HandleNICRemoved is called by the stack when the NIC with the given
+	// id is removed.
+	HandleNICRemoved(nicID tcpip.NICID)
+}
+
+// AbortableEndpoint is implemented by transport endpoints that can be aborted
+// when the stack is closed, so that the goroutines serving them exit.
+type AbortableEndpoint interface {
+	TransportEndpoint
+
+	// Abort is called by the stack when it is closed. The endpoint must
+	// drop its connection, if any, without waiting for the peer.
+	Abort()
+}
+
+// AddressRemovalAwareEndpoint is implemented by transport endpoints that want to
+// be notified when an address is removed from a NIC, so that they can fail if
+// they were bound to it or connected through it.
+type AddressRemovalAwareEndpoint interface {
+	TransportEndpoint
+
+	// HandleAddressRemoved is called by the stack after the given address
+	// is removed from the given NIC.
+	HandleAddressRemoved(nicID tcpip.NICID, addr tcpip.Address)
+}
+
+// TransportEndpointState describes the state of a transport endpoint.
+type TransportEndpointState struct {
+	// State is a human readable description of the protocol state of the
+	// endpoint, e.g., "connected".
+	State string
+
+	// RcvQueued is the number of bytes received but not yet read or, for
+	// listening endpoints, the number of connections waiting to be
+	// accepted.
+	RcvQueued int
+
+	// SndQueued is the number of bytes written but not yet acknowledged
+	// by the peer.
+	SndQueued int
+
+	// Owner is the name of the owner the endpoint is attributed to, if
+	// any.
+	Owner string
+}
+
+// SaveableEndpoint is implemented by transport endpoints whose state can be
+// saved by Stack.SaveState, so that they can later be recreated in another
+// stack by a RestorableTransportProtocol.
+type SaveableEndpoint interface {
+	tcpip.Endpoint
+
+	// SaveState returns a snapshot of the state of the endpoint.
+	SaveState() (SavedEndpoint, error)
+}
+
+// DetachableEndpoint is implemented by saveable transport endpoints that can be
+// detached from their stack, so that they can be handed off to another stack,
+// e.g., in another process, without their peers noticing.
+type DetachableEndpoint interface {
+	SaveableEndpoint
+
+	// Detach returns a snapshot of the state of the endpoint, and closes
+	// the endpoint without notifying its peers: connections aren't reset
+	// or shut down, and nothing is sent on behalf of the endpoint anymore.
+	// The endpoint must not be used afterwards.
+	Detach() (SavedEndpoint, error)
+}
+
+// RestorableTransportProtocol is implemented by transport protocols that can
+// recreate endpoints from the state saved by their SaveableEndpoint
+// implementation.
+type RestorableTransportProtocol interface {
+	TransportProtocol
+
+	// RestoreEndpoint creates a new endpoint in the given stack from the
+	// saved state. The endpoint uses waiterQueue to notify its readiness.
+	RestoreEndpoint(stack *Stack, saved SavedEndpoint, waiterQueue *waiter.Queue) (tcpip.Endpoint, error)
+}
+
+// InspectableEndpoint is implemented by transport endpoints that can describe
+// their state, so that it can be reported by Stack.TransportEndpoints.
+type InspectableEndpoint interface {
+	TransportEndpoint
+
+	// Inspect returns the current state of the endpoint.
+	Inspect() TransportEndpointState
+}
+
+// OwnedEndpoint is implemented by transport endpoints that can be attributed to
+// owners, so that their owner can be reported in packet traces.
+type OwnedEndpoint interface {
+	TransportEndpoint
+
+	// Owner returns the owner the endpoint is attributed to, or nil.
+	Owner() *Owner
 }
 
 // TransportProtocol is the interface that needs to be implemented by transport
@@ -74,7 +200,7 @@ type TransportProtocol interface {
 type TransportDispatcher interface {
 	// DeliverTransportPacket delivers the packets to the appropriate
 	// transport protocol endpoint.
-	DeliverTransportPacket(r *Route, protocol tcpip.TransportProtocolNumber, v buffer.View)
+	DeliverTransportPacket(r *Route, protocol tcpip.TransportProtocolNumber, vv buffer.VectorisedView)
 }
 
 // NetworkEndpoint is the interface that needs to be implemented by endpoints
@@ -93,7 +219,7 @@ type NetworkEndpoint interface {
 
 	// WritePacket writes a packet to the given destination address and
 	// protocol.
-	WritePacket(r *Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.TransportProtocolNumber) error
+	WritePacket(r *Route, hdr *buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.TransportProtocolNumber) error
 
 	// ID returns the network protocol endpoint ID.
 	ID() *NetworkEndpointID
@@ -103,7 +229,7 @@ type NetworkEndpoint interface {
 
 	// HandlePacket is called by the link layer when new packets arrive to
 	// this network endpoint.
-	HandlePacket(r *Route, v buffer.View)
+	HandlePacket(r *Route, vv buffer.VectorisedView)
 }
 
 // NetworkProtocol is the interface that needs to be implemented by network
@@ -132,6 +258,61 @@ type NetworkDispatcher interface {
 	// DeliverNetworkPacket finds the appropriate network protocol
 	// endpoint and hands the packet over for further processing.
 	DeliverNetworkPacket(linkEP LinkEndpoint, protocol tcpip.NetworkProtocolNumber, v buffer.View)
+
+	// LinkStateChanged is called by link endpoints when their carrier
+	// goes up or down. Link endpoints are considered to be up until they
+	// report otherwise.
+	LinkStateChanged(linkEP LinkEndpoint, up bool)
+}
+
+// InboundPacket is a packet received by a link layer endpoint, along with its
+// network protocol.
+type InboundPacket struct {
+	Protocol tcpip.NetworkProtocolNumber
+	Data     buffer.View
+}
+
+// BatchNetworkDispatcher is implemented by network dispatchers that can handle
+// batches of packets more efficiently than one packet at a time; for example,
+// by coalescing segments of the same TCP flow. Link layer endpoints that
+// receive packets in batches check if their dispatcher implements it.
+type BatchNetworkDispatcher interface {
+	NetworkDispatcher
+
+	// DeliverNetworkPackets is equivalent to calling
+	// DeliverNetworkPacket for each packet in the batch, in order.
+	DeliverNetworkPackets(linkEP LinkEndpoint, pkts []InboundPacket)
+}
+
+// LinkEndpointCapabilities is the type associated with the capabilities
+// supported by a link-layer endpoint. It is a set of bitfields.
+type LinkEndpointCapabilities uint
+
+// The following are the supported link endpoint capabilities.
+const (
+	// CapabilityTXChecksumOffload indicates that the link endpoint doesn't
+	// need outbound packets to carry valid transport checksums, either
+	// because it computes them itself or because the packets never leave
+	// the host, so transport protocols can skip computing them.
+	CapabilityTXChecksumOffload LinkEndpointCapabilities = 1 << iota
+
+	// CapabilityRXChecksumOffload indicates that the link endpoint
+	// guarantees that inbound packets have valid transport checksums, so
+	// transport protocols can skip verifying them.
+	CapabilityRXChecksumOffload
+
+	// CapabilityLoopback indicates that the link endpoint loops outbound
+	// packets back to the stack. NICs attached to such endpoints accept
+	// packets to any destination, including multicast and broadcast
+	// addresses, as if they were in promiscuous mode.
+	CapabilityLoopback
+)
+
+// LinkAddresser is implemented by link endpoints that have a link address, e.g.,
+// an ethernet MAC address.
+type LinkAddresser interface {
+	// LinkAddress returns the link address of the endpoint.
+	LinkAddress() tcpip.LinkAddress
 }
 
 // LinkEndpoint is the interface implemented by data link layer protocols (e.g.,
@@ -150,18 +331,89 @@ type LinkEndpoint interface {
 	// building.
 	MaxHeaderLength() uint16
 
+	// Capabilities returns the set of capabilities supported by the
+	// endpoint.
+	Capabilities() LinkEndpointCapabilities
+
 	// WritePacket writes a packet with the given protocol through the given
 	// route.
-	WritePacket(r *Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) error
+	WritePacket(r *Route, hdr *buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) error
 
 	// Attach attaches the data link layer endpoint to the network-layer
 	// dispatcher of the stack.
 	Attach(dispatcher NetworkDispatcher)
 }
 
+// ClosableLinkEndpoint is implemented by link endpoints that run goroutines to
+// dispatch inbound packets, so that they can be stopped when their NIC is
+// removed or the stack is closed.
+type ClosableLinkEndpoint interface {
+	LinkEndpoint
+
+	// Close stops delivering packets to the dispatcher and waits for the
+	// goroutines of the endpoint to exit. It doesn't close the resources
+	// given to the endpoint when it was created, e.g., file descriptors.
+	Close()
+}
+
+// TransportProtocolFactory returns the instance of a transport protocol used by
+// the given stack. Protocols that keep per-stack state, e.g., options set with
+// Stack.SetTransportProtocolOption, return a new instance for every stack.
+type TransportProtocolFactory func(s *Stack) TransportProtocol
+
+// ConfigurableTransportProtocol is implemented by transport protocols that have
+// options, which are set and read with Stack.SetTransportProtocolOption and
+// Stack.TransportProtocolOption.
+type ConfigurableTransportProtocol interface {
+	TransportProtocol
+
+	// SetOption sets the given option, whose type is defined by the
+	// protocol. It returns tcpip.ErrUnknownProtocolOption if the protocol
+	// doesn't support the option.
+	SetOption(option interface{}) error
+
+	// Option reads the given option, which is a pointer to an option type
+	// defined by the protocol, like with tcpip.Endpoint.GetSockOpt.
+	Option(option interface{}) error
+}
+
+// NetworkProtocolFactory returns the instance of a network protocol used by the
+// given stack. Protocols that keep per-stack state, e.g., options set with
+// Stack.SetNetworkProtocolOption, return a new instance for every stack.
+type NetworkProtocolFactory func(s *Stack) NetworkProtocol
+
+// ConfigurableNetworkProtocol is implemented by network protocols that have
+// options, which are set and read with Stack.SetNetworkProtocolOption and
+// Stack.NetworkProtocolOption.
+type ConfigurableNetworkProtocol interface {
+	NetworkProtocol
+
+	// SetOption sets the given option, whose type is defined by the
+	// protocol. It returns tcpip.ErrUnknownProtocolOption if the protocol
+	// doesn't support the option.
+	SetOption(option interface{}) error
+
+	// Option reads the given option, which is a pointer to an option type
+	// defined by the protocol.
+	Option(option interface{}) error
+}
+
+// ForwardingNetworkProtocol is implemented by network protocols whose packets
+// can be forwarded by NICs with forwarding enabled.
+type ForwardingNetworkProtocol interface {
+	NetworkProtocol
+
+	// PrepareForward updates the header of a packet before it is
+	// forwarded, e.g., by decrementing its TTL. It returns false if the
+	// packet must be dropped instead.
+	PrepareForward(v buffer.View) bool
+}
+
 var (
-	transportProtocols = make(map[string]TransportProtocol)
-	networkProtocols   = make(map[string]NetworkProtocol)
+	// protocolsMu protects the protocol registries below.
+	protocolsMu        sync.RWMutex
+	transportProtocols = make(map[string]TransportProtocolFactory)
+	networkProtocols   = make(map[string]NetworkProtocolFactory)
 
 	linkEPMu           sync.RWMutex
 	nextLinkEndpointID tcpip.LinkEndpointID = 1
@@ -170,16 +422,107 @@ var (
 
 // RegisterTransportProtocol registers a new transport protocol with the stack
 // so that it becomes available to users of the stack. This function is intended
-// to be called by init() functions of the protocols.
+// to be called by init() functions of the protocols. The same instance of the
+// protocol is shared by all stacks.
 func RegisterTransportProtocol(name string, p TransportProtocol) {
-	transportProtocols[name] = p
+	RegisterTransportProtocolFactory(name, func(*Stack) TransportProtocol {
+		return p
+	})
+}
+
+// RegisterTransportProtocolFactory registers a new transport protocol with the
+// stack, like RegisterTransportProtocol, but f is called to create the instance
+// of the protocol of every stack that uses it. It can be used by protocols that
+// live outside of this repository as well as by the ones in it.
+//
+// It panics if a transport protocol with the same name is already registered.
+func RegisterTransportProtocolFactory(name string, f TransportProtocolFactory) {
+	protocolsMu.Lock()
+	defer protocolsMu.Unlock()
+
+	if _, ok := transportProtocols[name]; ok {
+		panic("stack: transport protocol " + name + " registered twice")
+	}
+
+	transportProtocols[name] = f
+}
+
+// RegisteredTransportProtocols returns the names of the registered transport
+// protocols, which can be passed to New, in increasing order.
+func RegisteredTransportProtocols() []string {
+	protocolsMu.RLock()
+	defer protocolsMu.RUnlock()
+
+	names := make([]string, 0, len(transportProtocols))
+	for name := range transportProtocols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// findTransportProtocolFactory returns the factory of the transport protocol
+// with the given name, if any.
+func findTransportProtocolFactory(name string) (TransportProtocolFactory, bool) {
+	protocolsMu.RLock()
+	defer protocolsMu.RUnlock()
+
+	f, ok := transportProtocols[name]
+	return f, ok
 }
 
 // RegisterNetworkProtocol registers a new network protocol with the stack so
 // that it becomes available to users of the stack. This function is intended
-// to be called by init() functions of the protocols.
+// to be called by init() functions of the protocols. The same instance of the
+// protocol is shared by all stacks.
 func RegisterNetworkProtocol(name string, p NetworkProtocol) {
-	networkProtocols[name] = p
+	RegisterNetworkProtocolFactory(name, func(*Stack) NetworkProtocol {
+		return p
+	})
+}
+
+// RegisterNetworkProtocolFactory registers a new network protocol with the
+// stack, like RegisterNetworkProtocol, but f is called to create the instance of
+// the protocol of every stack that uses it. NICs deliver inbound packets of the
+// protocol's number to the endpoints it creates, and routes through them write
+// with NetworkEndpoint.WritePacket.
+//
+// It panics if a network protocol with the same name is already registered.
+func RegisterNetworkProtocolFactory(name string, f NetworkProtocolFactory) {
+	protocolsMu.Lock()
+	defer protocolsMu.Unlock()
+
+	if _, ok := networkProtocols[name]; ok {
+		panic("stack: network protocol " + name + " registered twice")
+	}
+
+	networkProtocols[name] = f
+}
+
+// RegisteredNetworkProtocols returns the names of the registered network
+// protocols, which can be passed to New, in increasing order.
+func RegisteredNetworkProtocols() []string {
+	protocolsMu.RLock()
+	defer protocolsMu.RUnlock()
+
+	names := make([]string, 0, len(networkProtocols))
+	for name := range networkProtocols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// findNetworkProtocolFactory returns the factory of the network protocol with
+// the given name, if any.
+func findNetworkProtocolFactory(name string) (NetworkProtocolFactory, bool) {
+	protocolsMu.RLock()
+	defer protocolsMu.RUnlock()
+
+	f, ok := networkProtocols[name]
+	return f, ok
 }
 
 // RegisterLinkEndpoint register a link-layer protocol endpoint and returns an
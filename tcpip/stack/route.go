@@ -5,6 +5,8 @@
 package stack
 
 import (
+	"sync/atomic"
+
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip"
@@ -24,9 +26,42 @@ type Route struct {
 	// NetProto is the network-layer protocol.
 	NetProto tcpip.NetworkProtocolNumber
 
+	// TTL is the TTL, or hop limit, of the packets sent through the route,
+	// or zero to use the default TTL of the stack. Endpoints set it to
+	// implement tcpip.TTLOption.
+	TTL uint8
+
+	// MulticastTTL is the TTL, or hop limit, of the multicast packets sent
+	// through the route, or zero to use the same as other packets.
+	// Endpoints set it to implement tcpip.MulticastTTLOption.
+	MulticastTTL uint8
+
+	// TOS is the type of service, or traffic class, of the packets sent
+	// through the route, including their ECN codepoint. Endpoints set it
+	// to implement tcpip.TOSOption.
+	TOS uint8
+
+	// MulticastLoop is set if the multicast packets sent through the route
+	// are looped back to the NIC when it joined their group, as if they had
+	// been received. Endpoints set it to implement
+	// tcpip.MulticastLoopOption.
+	MulticastLoop bool
+
+	// NetworkHeader is the network header of the packet, for the routes of
+	// received packets, so that endpoints can report its fields. It's set
+	// by network endpoints before they deliver the packet, and is only
+	// valid until HandlePacket returns.
+	NetworkHeader buffer.View
+
 	// ref a reference to the network endpoint through which the route
 	// starts.
 	ref *referencedNetworkEndpoint
+
+	// gen is the generation of the route cache of the stack when the route
+	// was found by FindRoute, or zero for routes made otherwise. The cache
+	// is invalidated when NICs are created, so generations of found routes
+	// are never zero.
+	gen uint64
 }
 
 // makeRoute initializes a new route. It takes ownership of the provided
@@ -50,22 +85,159 @@ func (r *Route) MaxHeaderLength() uint16 {
 	return r.ref.ep.MaxHeaderLength()
 }
 
+// Capabilities returns the link-layer capabilities of the route.
+func (r *Route) Capabilities() LinkEndpointCapabilities {
+	return r.ref.nic.linkEP.Capabilities()
+}
+
 // PseudoHeaderChecksum forwards the call to the network endpoint's
 // implementation.
 func (r *Route) PseudoHeaderChecksum(protocol tcpip.TransportProtocolNumber) uint16 {
 	return header.PseudoHeaderChecksum(protocol, r.LocalAddress, r.RemoteAddress)
 }
 
+// Stats returns the statistics of the stack the route belongs to. Counters must
+// only be updated atomically.
+func (r *Route) Stats() *tcpip.Stats {
+	return &r.ref.nic.stack.stats
+}
+
+// Stack returns the stack the route belongs to.
+func (r *Route) Stack() *Stack {
+	return r.ref.nic.stack
+}
+
+// DefaultTTL returns the TTL, or hop limit, of the packets sent through the
+// route: r.MulticastTTL if set and the route leads to a multicast group, r.TTL
+// if set, or the TTL set with Stack.SetDefaultTTL. Routes that weren't created
+// by a stack, e.g., in tests that short-circuit it, use DefaultTTL.
+func (r *Route) DefaultTTL() uint8 {
+	if r.MulticastTTL != 0 && isMulticastAddress(r.RemoteAddress) {
+		return r.MulticastTTL
+	}
+	if r.TTL != 0 {
+		return r.TTL
+	}
+	if r.ref == nil {
+		return DefaultTTL
+	}
+	return r.ref.nic.stack.DefaultTTL()
+}
+
 // WritePacket writes the packet through the given route.
-func (r *Route) WritePacket(hdr *buffer.Prependable, payload buffer.View, protocol tcpip.TransportProtocolNumber) error {
+func (r *Route) WritePacket(hdr *buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.TransportProtocolNumber) error {
+	if s := r.ref.nic.stack; s.faulting() {
+		var ok bool
+		p := TracePacket{Point: TraceTransportOut, NIC: r.ref.nic.id, NetProto: r.NetProto, TransProto: protocol, Src: r.LocalAddress, Dst: r.RemoteAddress, Header: hdr.View(), Data: payload.ToView()}
+		if hdr, payload, ok = s.faultOut(&p, hdr, payload, int(r.MaxHeaderLength()), func() func(*buffer.Prependable, buffer.VectorisedView) {
+			rc := r.Clone()
+			return func(hdr *buffer.Prependable, payload buffer.VectorisedView) {
+				rc.write(hdr, payload, protocol)
+				rc.Release()
+			}
+		}); !ok {
+			return nil
+		}
+	}
+
+	return r.write(hdr, payload, protocol)
+}
+
+// write implements WritePacket, once faults have been applied.
+func (r *Route) write(hdr *buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.TransportProtocolNumber) error {
+	t := r.ref.nic.stack.startTrace(TraceTransportOut, r.ref.nic.id, r.NetProto, hdr.View(), payload)
+	t.p.TransProto = protocol
+	t.setAddresses(r.LocalAddress, r.RemoteAddress)
+	if t.s != nil {
+		// The sending endpoint is the one that the replies to the
+		// packet would be delivered to.
+		if state, ok := t.s.transportProtocols[protocol]; ok {
+			if srcPort, dstPort, err := state.proto.ParsePorts(hdr.View()); err == nil {
+				t.setOwner(r.ref.nic, protocol, TransportEndpointID{srcPort, r.LocalAddress, dstPort, r.RemoteAddress})
+			}
+		}
+	}
+
+	err := r.writePacket(hdr, payload, protocol)
+	t.sent(err)
+	if err != nil {
+		atomic.AddUint64(&r.Stats().IP.OutgoingPacketErrors, 1)
+		atomic.AddUint64(&r.ref.nic.stats.TxErrors, 1)
+		return err
+	}
+
+	// The header now includes the ones added by the network and link
+	// layers.
+	atomic.AddUint64(&r.Stats().IP.PacketsSent, 1)
+	atomic.AddUint64(&r.ref.nic.stats.Tx.Packets, 1)
+	atomic.AddUint64(&r.ref.nic.stats.Tx.Bytes, uint64(hdr.UsedLength()+payload.Size()))
+
+	return nil
+}
+
+func (r *Route) writePacket(hdr *buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.TransportProtocolNumber) error {
+	if r.ref.nic.isRemoved() {
+		return tcpip.ErrNoRoute
+	}
+
+	if r.ref.isRemoved() {
+		return tcpip.ErrBadLocalAddress
+	}
+
+	if !r.ref.nic.isLinkUp() {
+		return tcpip.ErrLinkDown
+	}
+
 	return r.ref.ep.WritePacket(r, hdr, payload, protocol)
 }
 
+// writeForwardedPacket writes a packet that was received by another NIC through
+// the route. The packet already includes its network header, so it is written
+// directly to the link endpoint.
+func (r *Route) writeForwardedPacket(v buffer.View) error {
+	hdr := buffer.NewPooledPrependable(int(r.ref.nic.linkEP.MaxHeaderLength()))
+	defer hdr.Release()
+
+	err := r.writeLinkPacket(&hdr, v)
+	if err != nil {
+		atomic.AddUint64(&r.Stats().IP.OutgoingPacketErrors, 1)
+		atomic.AddUint64(&r.ref.nic.stats.TxErrors, 1)
+		return err
+	}
+
+	atomic.AddUint64(&r.ref.nic.stats.Tx.Packets, 1)
+	atomic.AddUint64(&r.ref.nic.stats.Tx.Bytes, uint64(hdr.UsedLength()+len(v)))
+
+	return nil
+}
+
+func (r *Route) writeLinkPacket(hdr *buffer.Prependable, v buffer.View) error {
+	if r.ref.nic.isRemoved() {
+		return tcpip.ErrNoRoute
+	}
+
+	if !r.ref.nic.isLinkUp() {
+		return tcpip.ErrLinkDown
+	}
+
+	return r.ref.nic.sender.WritePacket(r, hdr, v.ToVectorisedView(), r.NetProto)
+}
+
 // MTU returns the MTU of the underlying network endpoint.
 func (r *Route) MTU() uint32 {
 	return r.ref.ep.MTU()
 }
 
+// Stale returns whether the route may no longer be the one FindRoute returns,
+// because the route table, the addresses or the NICs of the stack changed since
+// it was found. Endpoints that keep a route call it before using it, and find
+// the route again if it's stale, so that they follow those changes. Routes that
+// weren't found by FindRoute, e.g., the routes of received packets, are never
+// stale. It doesn't take any locks.
+func (r *Route) Stale() bool {
+	return r.gen != 0 && r.gen != r.ref.nic.stack.routes.generation()
+}
+
 // Release frees all resources associated with the route.
 func (r *Route) Release() {
 	if r.ref != nil {
@@ -75,8 +247,10 @@ func (r *Route) Release() {
 }
 
 // Clone Clone a route such that the original one can be released and the new
-// one will remain valid.
+// one will remain valid. Cloning an empty route returns another empty route.
 func (r *Route) Clone() Route {
-	r.ref.incRef()
+	if r.ref != nil {
+		r.ref.incRef()
+	}
 	return *r
 }
@@ -0,0 +1,110 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// maxCachedRoutes is the maximum number of routes held by a route cache. The
+// cache is flushed when it is full, so that it doesn't grow without bounds
+// when, e.g., an unconnected endpoint sends to many destinations.
+const maxCachedRoutes = 1024
+
+// routeCacheKey identifies the arguments of a FindRoute call.
+type routeCacheKey struct {
+	nicID      tcpip.NICID
+	localAddr  tcpip.Address
+	remoteAddr tcpip.Address
+	netProto   tcpip.NetworkProtocolNumber
+}
+
+// routeCache caches the routes returned by FindRoute, so that the route table
+// isn't scanned again every time a packet is sent to the same destination.
+//
+// The cache is invalidated whenever the route table, the addresses, or the
+// state of the NICs change. Invalidating it increments its generation, so that
+// routes computed before the change, but inserted after it, are discarded, and
+// so that endpoints holding routes can tell that they're stale.
+type routeCache struct {
+	mu sync.Mutex
+
+	// gen is modified with mu held, but read atomically.
+	gen     uint64
+	entries map[routeCacheKey]Route
+}
+
+// generation returns the current generation of c. It must be read before
+// computing a route to be inserted.
+func (c *routeCache) generation() uint64 {
+	return atomic.LoadUint64(&c.gen)
+}
+
+// lookup returns a new reference to the cached route for key, if any.
+func (c *routeCache) lookup(key routeCacheKey) (Route, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r, ok := c.entries[key]
+	if !ok {
+		return Route{}, false
+	}
+
+	return r.Clone(), true
+}
+
+// insert caches a clone of r for key, unless c was invalidated since gen was
+// read.
+func (c *routeCache) insert(key routeCacheKey, gen uint64, r *Route) {
+	c.mu.Lock()
+	if gen != c.gen {
+		c.mu.Unlock()
+		return
+	}
+
+	var stale []Route
+	if old, ok := c.entries[key]; ok {
+		stale = append(stale, old)
+	} else if len(c.entries) >= maxCachedRoutes {
+		for _, old := range c.entries {
+			stale = append(stale, old)
+		}
+		c.entries = nil
+	}
+
+	if c.entries == nil {
+		c.entries = make(map[routeCacheKey]Route)
+	}
+	c.entries[key] = r.Clone()
+	c.mu.Unlock()
+
+	releaseRoutes(stale)
+}
+
+// invalidate drops all the cached routes and increments the generation of c.
+func (c *routeCache) invalidate() {
+	c.mu.Lock()
+	atomic.AddUint64(&c.gen, 1)
+	stale := make([]Route, 0, len(c.entries))
+	for _, r := range c.entries {
+		stale = append(stale, r)
+	}
+	c.entries = nil
+	c.mu.Unlock()
+
+	releaseRoutes(stale)
+}
+
+// releaseRoutes releases the given routes. It is called without holding the
+// cache's mutex, as releasing the last reference to a network endpoint removes
+// it from its NIC.
+func releaseRoutes(routes []Route) {
+	for i := range routes {
+		routes[i].Release()
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"strings"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// RouteTable returns a copy of the route table of s.
+func (s *Stack) RouteTable() []tcpip.Route {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]tcpip.Route(nil), s.routeTable...)
+}
+
+// AddRoute adds r to the route table. It is inserted before the routes that are
+// less specific, i.e., that have shorter masks, so that it takes precedence
+// over them, and after the others.
+func (s *Stack) AddRoute(r tcpip.Route) error {
+	if len(r.Mask) != len(r.Destination) {
+		return tcpip.ErrInvalidRoute
+	}
+
+	s.updateRouteTable(func(table []tcpip.Route) []tcpip.Route {
+		bits := prefixLength(r.Mask)
+		for i := range table {
+			if len(table[i].Destination) == len(r.Destination) && prefixLength(table[i].Mask) < bits {
+				table = append(table[:i], append([]tcpip.Route{r}, table[i:]...)...)
+				return table
+			}
+		}
+		return append(table, r)
+	})
+
+	return nil
+}
+
+// RemoveRoutes removes the routes for which match returns true from the route
+// table, and returns the number of routes removed.
+func (s *Stack) RemoveRoutes(match func(tcpip.Route) bool) int {
+	removed := 0
+	s.updateRouteTable(func(table []tcpip.Route) []tcpip.Route {
+		kept := table[:0]
+		for _, r := range table {
+			if match(r) {
+				removed++
+				continue
+			}
+			kept = append(kept, r)
+		}
+		return kept
+	})
+
+	return removed
+}
+
+// SetDefaultGateway replaces the default route for addresses of the same length
+// as gateway, if any, with one that sends packets to gateway through the given
+// NIC. The default route is kept at the end of the route table, so that all
+// other routes take precedence over it.
+func (s *Stack) SetDefaultGateway(nicID tcpip.NICID, gateway tcpip.Address) error {
+	s.mu.RLock()
+	nic := s.nics[nicID]
+	s.mu.RUnlock()
+
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	zero := tcpip.Address(strings.Repeat("\x00", len(gateway)))
+	s.updateRouteTable(func(table []tcpip.Route) []tcpip.Route {
+		kept := table[:0]
+		for _, r := range table {
+			if !isDefaultRoute(r, len(gateway)) {
+				kept = append(kept, r)
+			}
+		}
+		return append(kept, tcpip.Route{Destination: zero, Mask: zero, Gateway: gateway, NIC: nicID})
+	})
+
+	return nil
+}
+
+// DefaultGateway returns the first default route for addresses of the given
+// size, e.g., header.IPv4AddressSize, if there's one.
+func (s *Stack) DefaultGateway(addrSize int) (tcpip.Route, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, r := range s.routeTable {
+		if isDefaultRoute(r, addrSize) {
+			return r, true
+		}
+	}
+
+	return tcpip.Route{}, false
+}
+
+// SubscribeRouteTable registers h to be called whenever the route table
+// changes. It returns a function that unregisters h.
+//
+// Handlers are called synchronously from the goroutine that changed the route
+// table, after the change, so they can call RouteTable to get the new table.
+func (s *Stack) SubscribeRouteTable(h func()) (cancel func()) {
+	s.routeTableMu.Lock()
+	id := s.nextRouteTableID
+	s.nextRouteTableID++
+	s.routeTableHandlers[id] = h
+	s.routeTableMu.Unlock()
+
+	return func() {
+		s.routeTableMu.Lock()
+		delete(s.routeTableHandlers, id)
+		s.routeTableMu.Unlock()
+	}
+}
+
+// updateRouteTable replaces the route table with the one returned by f, which
+// is passed a copy of the current table, then notifies the subscribers.
+func (s *Stack) updateRouteTable(f func(table []tcpip.Route) []tcpip.Route) {
+	s.mu.Lock()
+	s.routeTable = f(append([]tcpip.Route(nil), s.routeTable...))
+	s.mu.Unlock()
+
+	s.routeTableChanged()
+}
+
+// routeTableChanged invalidates the cached routes and notifies the subscribers
+// after the route table changed.
+func (s *Stack) routeTableChanged() {
+	s.routes.invalidate()
+
+	s.routeTableMu.Lock()
+	handlers := make([]func(), 0, len(s.routeTableHandlers))
+	for _, h := range s.routeTableHandlers {
+		handlers = append(handlers, h)
+	}
+	s.routeTableMu.Unlock()
+
+	for _, h := range handlers {
+		h()
+	}
+
+	s.emit(Event{Type: EventRouteTableChanged})
+}
+
+// isDefaultRoute returns whether r is a default route for addresses of the
+// given size.
+func isDefaultRoute(r tcpip.Route, addrSize int) bool {
+	return len(r.Destination) == addrSize && prefixLength(r.Mask) == 0
+}
+
+// prefixLength returns the number of bits set in mask.
+func prefixLength(mask tcpip.Address) int {
+	bits := 0
+	for i := 0; i < len(mask); i++ {
+		for b := mask[i]; b != 0; b &= b - 1 {
+			bits++
+		}
+	}
+	return bits
+}
@@ -11,13 +11,20 @@
 // For protocol implementers, RegisterTransportProtocol() and
 // RegisterNetworkProtocol() are used to register protocols with the stack,
 // which will then be instantiated when consumers interact with the stack.
+// Protocols that keep per-stack state, including ones outside of this
+// repository, use RegisterTransportProtocolFactory() and
+// RegisterNetworkProtocolFactory() instead.
 package stack
 
 import (
+	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip/ports"
 	"github.com/google/netstack/waiter"
 )
@@ -25,6 +32,135 @@ import (
 type transportProtocolState struct {
 	proto          TransportProtocol
 	defaultHandler func(*Route, TransportEndpointID, buffer.View) bool
+
+	// defaults holds the settings set with Stack.SetEndpointDefaults, if
+	// any. It is protected by the stack's mu.
+	defaults *EndpointDefaults
+}
+
+// ProtocolAddress is an address along with the network protocol it belongs to
+// and the length of the prefix of its subnet.
+type ProtocolAddress struct {
+	Protocol  tcpip.NetworkProtocolNumber
+	Address   tcpip.Address
+	PrefixLen int
+}
+
+// NICStateFlags holds the state flags of a NIC.
+type NICStateFlags struct {
+	// Up indicates whether the NIC is enabled, that is, attached to its
+	// link endpoint.
+	Up bool
+
+	// Running indicates whether the carrier of the link endpoint is up.
+	Running bool
+
+	// Promiscuous indicates whether the NIC is in promiscuous mode.
+	Promiscuous bool
+
+	// Spoofing indicates whether the NIC allows endpoints to use local
+	// addresses that aren't assigned to it.
+	Spoofing bool
+
+	// Loopback indicates whether the link endpoint loops packets back.
+	Loopback bool
+
+	// GRO indicates whether generic receive offload is enabled.
+	GRO bool
+}
+
+// NICConfig holds the settings of a NIC that control how the packets it
+// receives are processed, like the per-interface sysctls of Linux.
+type NICConfig struct {
+	// Forwarding indicates whether packets received by the NIC that
+	// aren't addressed to the stack are forwarded according to the route
+	// table.
+	Forwarding bool
+
+	// AcceptRedirects indicates whether ICMP redirects received by the
+	// NIC are honored, by the network protocols that support them.
+	AcceptRedirects bool
+
+	// AcceptRouterAdvertisements indicates whether router advertisements
+	// received by the NIC are processed, by the network protocols that
+	// support them.
+	AcceptRouterAdvertisements bool
+
+	// DADTransmits is the number of neighbor solicitations sent by
+	// duplicate address detection for IPv6 addresses added to the NIC,
+	// which are tentative until it completes. Zero disables it.
+	DADTransmits uint8
+
+	// DADRetransmitTimer is the time waited after each neighbor
+	// solicitation. Zero means DefaultDADRetransmitTimer.
+	DADRetransmitTimer time.Duration
+}
+
+// NICDirectionStats holds the packet and byte counters of a NIC for one
+// direction.
+type NICDirectionStats struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+// NICStats holds the counters of a NIC. Byte counters include the network and
+// link layer headers.
+type NICStats struct {
+	// Rx counts the packets delivered by the link endpoint.
+	Rx NICDirectionStats
+
+	// Tx counts the packets successfully written to the link endpoint.
+	Tx NICDirectionStats
+
+	// RxErrors is the number of received packets that couldn't be handed
+	// to a network endpoint: unknown protocols, malformed packets or
+	// unknown destinations.
+	RxErrors uint64
+
+	// TxErrors is the number of packets that couldn't be written.
+	TxErrors uint64
+}
+
+// NICInfo holds the interface information of a NIC, as returned by
+// Stack.NICInfo.
+type NICInfo struct {
+	// LinkAddress is the link address of the NIC, if its link endpoint
+	// implements LinkAddresser.
+	LinkAddress tcpip.LinkAddress
+
+	// MTU is the current MTU of the NIC.
+	MTU uint32
+
+	// Flags holds the state flags of the NIC.
+	Flags NICStateFlags
+
+	// Config holds the settings of the NIC.
+	Config NICConfig
+
+	// Addresses holds the addresses assigned to the NIC.
+	Addresses []ProtocolAddress
+
+	// Stats is a snapshot of the counters of the NIC.
+	Stats NICStats
+}
+
+// TransportEndpointInfo describes a registered transport endpoint, as returned
+// by Stack.TransportEndpoints.
+type TransportEndpointInfo struct {
+	// NIC is the NIC the endpoint is registered with, or zero if it is
+	// registered with the stack.
+	NIC tcpip.NICID
+
+	// Protocol is the transport protocol of the endpoint.
+	Protocol tcpip.TransportProtocolNumber
+
+	// ID is the id the endpoint is registered with; unspecified fields
+	// are empty.
+	ID TransportEndpointID
+
+	// State is the state of the endpoint. It is empty if the endpoint
+	// doesn't implement InspectableEndpoint.
+	State TransportEndpointState
 }
 
 // Stack is a networking stack, with all supported protocols, NICs, and route
@@ -33,48 +169,140 @@ type Stack struct {
 	transportProtocols map[tcpip.TransportProtocolNumber]*transportProtocolState
 	networkProtocols   map[tcpip.NetworkProtocolNumber]NetworkProtocol
 
+	// networkProtocolNames holds the names the network protocols were
+	// registered with.
+	networkProtocolNames map[tcpip.NetworkProtocolNumber]string
+
 	demux *transportDemuxer
 
 	stats tcpip.Stats
 
+	// clock is the source of time used by the stack's protocols.
+	clock tcpip.Clock
+
+	// logger holds the *loggerState set by SetLogger.
+	logger atomic.Value
+
+	// memUsed is the number of bytes held in the queues of all endpoints,
+	// and memLimit is the maximum allowed, or zero if there is no limit.
+	// They are only accessed atomically.
+	memUsed  int64
+	memLimit int64
+
+	// defaultTTL is the TTL of the packets sent by the stack. It is only
+	// accessed atomically.
+	defaultTTL uint32
+
+	// icmpLimiter limits the rate at which ICMP messages are sent.
+	icmpLimiter icmpRateLimiter
+
 	mu   sync.RWMutex
 	nics map[tcpip.NICID]*NIC
 
+	// closed is set when Close is called, after which no NICs or endpoints
+	// can be created. It is protected by mu.
+	closed bool
+
+	// workers tracks the goroutines started by protocols through Go.
+	workers sync.WaitGroup
+
 	// route is the route table passed in by the user via SetRouteTable(),
 	// it is used by FindRoute() to build a route for a specific
-	// destination.
+	// destination. It is protected by mu, and replaced rather than
+	// modified in place when it changes.
 	routeTable []tcpip.Route
 
+	// routes caches the routes returned by FindRoute.
+	routes routeCache
+
 	*ports.PortManager
+
+	// ownersMu protects owners, which holds the owners endpoints were
+	// attributed to, indexed by name.
+	ownersMu sync.Mutex
+	owners   map[string]*Owner
+
+	// routeTableMu protects the route table handlers below.
+	routeTableMu       sync.Mutex
+	routeTableHandlers map[int]func()
+	nextRouteTableID   int
+
+	// linkStateMu protects the link state handlers below.
+	linkStateMu       sync.Mutex
+	linkStateHandlers map[int]func(tcpip.NICID, bool)
+	nextLinkStateID   int
+
+	// eventMu protects the event handlers below.
+	eventMu       sync.Mutex
+	eventHandlers map[int]func(Event)
+	nextEventID   int
+
+	// dadMu protects the duplicate address detection handlers below.
+	dadMu       sync.Mutex
+	dadHandlers map[int]func(tcpip.NICID, tcpip.Address, AddressState)
+	nextDADID   int
+
+	// traceMu protects the trace hooks below. traceSnapshot holds a
+	// []func(*TracePacket) copy of traceHooks, which is read without
+	// locking when packets are traced.
+	traceMu       sync.Mutex
+	traceHooks    map[int]func(*TracePacket)
+	nextTraceID   int
+	traceSnapshot atomic.Value
+
+	// faultMu protects the faults below. faultSnapshot holds a []*fault
+	// copy of faults, which is read without locking.
+	faultMu       sync.Mutex
+	faults        map[int]*fault
+	nextFaultID   int
+	faultSnapshot atomic.Value
+
+	// profiling is set by SetProfiling. It is only accessed atomically.
+	profiling uint32
 }
 
 // New allocates a new networking stack with only the requested networking and
 // transport protocols.
 func New(network []string, transport []string) tcpip.Stack {
 	s := &Stack{
-		transportProtocols: make(map[tcpip.TransportProtocolNumber]*transportProtocolState),
-		networkProtocols:   make(map[tcpip.NetworkProtocolNumber]NetworkProtocol),
-		nics:               make(map[tcpip.NICID]*NIC),
-		PortManager:        ports.NewPortManager(),
+		transportProtocols:   make(map[tcpip.TransportProtocolNumber]*transportProtocolState),
+		networkProtocols:     make(map[tcpip.NetworkProtocolNumber]NetworkProtocol),
+		networkProtocolNames: make(map[tcpip.NetworkProtocolNumber]string),
+		nics:                 make(map[tcpip.NICID]*NIC),
+		linkStateHandlers:    make(map[int]func(tcpip.NICID, bool)),
+		dadHandlers:          make(map[int]func(tcpip.NICID, tcpip.Address, AddressState)),
+		eventHandlers:        make(map[int]func(Event)),
+		routeTableHandlers:   make(map[int]func()),
+		traceHooks:           make(map[int]func(*TracePacket)),
+		faults:               make(map[int]*fault),
+		owners:               make(map[string]*Owner),
+		PortManager:          ports.NewPortManager(),
+		clock:                tcpip.StdClock{},
+		defaultTTL:           DefaultTTL,
 	}
 
 	// Add specified network protocols.
 	for _, name := range network {
-		netProto, ok := networkProtocols[name]
+		f, ok := findNetworkProtocolFactory(name)
 		if !ok {
 			continue
 		}
 
+		netProto := f(s)
+
 		s.networkProtocols[netProto.Number()] = netProto
+		s.networkProtocolNames[netProto.Number()] = name
 	}
 
 	// Add specified transport protocols.
 	for _, name := range transport {
-		transProto, ok := transportProtocols[name]
+		f, ok := findTransportProtocolFactory(name)
 		if !ok {
 			continue
 		}
 
+		transProto := f(s)
+
 		s.transportProtocols[transProto.Number()] = &transportProtocolState{
 			proto: transProto,
 		}
@@ -98,22 +326,116 @@ func (s *Stack) SetTransportProtocolHandler(p tcpip.TransportProtocolNumber, h f
 	}
 }
 
-// Stats returns a snapshot of the current stats.
+// SetTransportProtocolOption sets an option of the given transport protocol.
+// The type of the option is defined by the protocol, which must implement
+// ConfigurableTransportProtocol.
+func (s *Stack) SetTransportProtocolOption(p tcpip.TransportProtocolNumber, option interface{}) error {
+	t, ok := s.transportProtocols[p]
+	if !ok {
+		return tcpip.ErrUnknownProtocol
+	}
+
+	c, ok := t.proto.(ConfigurableTransportProtocol)
+	if !ok {
+		return tcpip.ErrUnknownProtocolOption
+	}
+
+	return c.SetOption(option)
+}
+
+// TransportProtocolOption reads an option of the given transport protocol into
+// option, which must be a pointer to an option type defined by the protocol.
+func (s *Stack) TransportProtocolOption(p tcpip.TransportProtocolNumber, option interface{}) error {
+	t, ok := s.transportProtocols[p]
+	if !ok {
+		return tcpip.ErrUnknownProtocol
+	}
+
+	c, ok := t.proto.(ConfigurableTransportProtocol)
+	if !ok {
+		return tcpip.ErrUnknownProtocolOption
+	}
+
+	return c.Option(option)
+}
+
+// SetNetworkProtocolOption sets an option of the given network protocol. The
+// type of the option is defined by the protocol, which must implement
+// ConfigurableNetworkProtocol.
+func (s *Stack) SetNetworkProtocolOption(p tcpip.NetworkProtocolNumber, option interface{}) error {
+	netProto, ok := s.networkProtocols[p]
+	if !ok {
+		return tcpip.ErrUnknownProtocol
+	}
+
+	c, ok := netProto.(ConfigurableNetworkProtocol)
+	if !ok {
+		return tcpip.ErrUnknownProtocolOption
+	}
+
+	return c.SetOption(option)
+}
+
+// NetworkProtocolOption reads an option of the given network protocol into
+// option, which must be a pointer to an option type defined by the protocol.
+func (s *Stack) NetworkProtocolOption(p tcpip.NetworkProtocolNumber, option interface{}) error {
+	netProto, ok := s.networkProtocols[p]
+	if !ok {
+		return tcpip.ErrUnknownProtocol
+	}
+
+	c, ok := netProto.(ConfigurableNetworkProtocol)
+	if !ok {
+		return tcpip.ErrUnknownProtocolOption
+	}
+
+	return c.Option(option)
+}
+
+// Stats returns a snapshot of the current stats. Each counter is read
+// atomically, but they aren't all read at once, so counters that are updated
+// together may be slightly inconsistent.
 func (s *Stack) Stats() tcpip.Stats {
-	return s.stats
+	var stats tcpip.Stats
+	loadCounters(reflect.ValueOf(&stats).Elem(), reflect.ValueOf(&s.stats).Elem())
+	return stats
+}
+
+// loadCounters atomically loads the uint64 counters of src, a struct that may
+// contain other structs of counters, into dst.
+func loadCounters(dst, src reflect.Value) {
+	for i := 0; i < src.NumField(); i++ {
+		f := src.Field(i)
+		if f.Kind() == reflect.Struct {
+			loadCounters(dst.Field(i), f)
+			continue
+		}
+
+		dst.Field(i).SetUint(atomic.LoadUint64(f.Addr().Interface().(*uint64)))
+	}
 }
 
 // SetRouteTable assigns the route table to be used by this stack. It
-// specifies which NIC to use for a given destination address mask.
+// specifies which NIC to use for a given destination address mask. The table is
+// copied, so the caller may modify it afterwards.
 func (s *Stack) SetRouteTable(table []tcpip.Route) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.routeTable = append([]tcpip.Route(nil), table...)
+	s.mu.Unlock()
 
-	s.routeTable = table
+	s.routeTableChanged()
 }
 
 // NewEndpoint creates a new transport layer endpoint of the given protocol.
 func (s *Stack) NewEndpoint(transport tcpip.TransportProtocolNumber, network tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) (tcpip.Endpoint, error) {
+	s.mu.RLock()
+	closed := s.closed
+	s.mu.RUnlock()
+
+	if closed {
+		return nil, tcpip.ErrStackClosed
+	}
+
 	t, ok := s.transportProtocols[transport]
 	if !ok {
 		return nil, tcpip.ErrUnknownProtocol
@@ -131,20 +453,34 @@ func (s *Stack) createNIC(id tcpip.NICID, linkEP tcpip.LinkEndpointID, enabled b
 	}
 
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	if s.closed {
+		s.mu.Unlock()
+		return tcpip.ErrStackClosed
+	}
 
 	// Make sure id is unique.
 	if _, ok := s.nics[id]; ok {
+		s.mu.Unlock()
 		return tcpip.ErrDuplicateNICID
 	}
 
-	n := newNIC(s, id, ep)
+	n := newNIC(s, id, linkEP, ep)
 
 	s.nics[id] = n
 	if enabled {
 		n.attachLinkEndpoint()
 	}
 
+	// Routes that skipped entries of the route table for lack of a NIC
+	// may now go through the new one.
+	s.routes.invalidate()
+	s.mu.Unlock()
+
+	s.emit(Event{Type: EventNICAdded, NIC: id})
+	if enabled {
+		s.emit(Event{Type: EventNICEnabled, NIC: id})
+	}
+
 	return nil
 }
 
@@ -164,81 +500,436 @@ func (s *Stack) CreateDisabledNIC(id tcpip.NICID, linkEP tcpip.LinkEndpointID) e
 // delivering packets to it.
 func (s *Stack) EnableNIC(id tcpip.NICID) error {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
+	nic := s.nics[id]
+	if nic != nil {
+		nic.attachLinkEndpoint()
+	}
+	s.mu.RUnlock()
+
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	s.emit(Event{Type: EventNICEnabled, NIC: id})
+
+	return nil
+}
 
+// RemoveNIC removes the NIC with the given id from the stack. Its addresses are
+// removed, routes through it become invalid, and transport endpoints using it
+// are aborted. Its link endpoint is closed if it implements
+// ClosableLinkEndpoint; otherwise, the packets it delivers afterwards are
+// dropped, and it can be reused to create another NIC.
+func (s *Stack) RemoveNIC(id tcpip.NICID) error {
+	s.mu.Lock()
 	nic := s.nics[id]
 	if nic == nil {
+		s.mu.Unlock()
 		return tcpip.ErrUnknownNICID
 	}
+	delete(s.nics, id)
+	s.mu.Unlock()
 
-	nic.attachLinkEndpoint()
+	s.removeNIC(nic)
+	s.emit(Event{Type: EventNICRemoved, NIC: id})
 
 	return nil
 }
 
-// AddAddress adds a new network-layer address to the specified NIC.
+// removeNIC tears down a NIC that has already been removed from the NIC table,
+// closes its link endpoint if it can be closed, and notifies the transport
+// endpoints that may be using it.
+func (s *Stack) removeNIC(nic *NIC) {
+	nic.remove()
+	if cep, ok := nic.linkEP.(ClosableLinkEndpoint); ok {
+		cep.Close()
+	}
+	s.routes.invalidate()
+
+	for _, ep := range s.transportEndpoints(nic) {
+		if rep, ok := ep.(NICRemovalAwareEndpoint); ok {
+			rep.HandleNICRemoved(nic.id)
+		}
+	}
+}
+
+// Close shuts the stack down. All NICs are removed, stopping the link endpoints
+// that implement ClosableLinkEndpoint, and all transport endpoints that
+// implement AbortableEndpoint are aborted. No NICs or endpoints can be created
+// afterwards.
+//
+// Close doesn't wait for the goroutines of the transport protocols to exit;
+// Wait must be called for that. Endpoints must still be closed by their users
+// to release their resources.
+func (s *Stack) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	nics := s.nics
+	s.nics = make(map[tcpip.NICID]*NIC)
+	s.mu.Unlock()
+
+	eps := s.demux.appendEndpoints(nil)
+	for _, nic := range nics {
+		eps = nic.demux.appendEndpoints(eps)
+
+		s.removeNIC(nic)
+	}
+
+	for _, ep := range eps {
+		if aep, ok := ep.(AbortableEndpoint); ok {
+			aep.Abort()
+		}
+	}
+}
+
+// Wait waits for all the goroutines started by the transport protocols through
+// Go to exit. It is normally called after Close.
+func (s *Stack) Wait() {
+	s.workers.Wait()
+}
+
+// Go runs f in a new goroutine that Wait waits for. Protocols use it to start
+// the goroutines that serve their endpoints, or GoWithLabels.
+func (s *Stack) Go(f func()) {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		f()
+	}()
+}
+
+// NICInfo returns the interface information of all NICs, indexed by their ids.
+func (s *Stack) NICInfo() map[tcpip.NICID]NICInfo {
+	s.mu.RLock()
+	nics := make([]*NIC, 0, len(s.nics))
+	for _, nic := range s.nics {
+		nics = append(nics, nic)
+	}
+	s.mu.RUnlock()
+
+	infos := make(map[tcpip.NICID]NICInfo, len(nics))
+	for _, nic := range nics {
+		infos[nic.id] = nic.info()
+	}
+
+	return infos
+}
+
+// AddAddress adds a new network-layer address to the specified NIC. The address
+// has no subnet, as if it were added with a prefix as long as the address.
 func (s *Stack) AddAddress(id tcpip.NICID, protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) error {
+	return s.AddAddressWithPrefix(id, protocol, tcpip.AddressWithPrefix{addr, len(addr) * 8})
+}
+
+// AddAddressWithPrefix adds a new network-layer address to the specified NIC,
+// along with the prefix of its subnet. Other addresses in the subnet are
+// on-link: routes to them go directly through the NIC, from the address, and
+// don't need an entry in the route table. Packets to the directed broadcast
+// address of IPv4 subnets are received as well.
+func (s *Stack) AddAddressWithPrefix(id tcpip.NICID, protocol tcpip.NetworkProtocolNumber, addr tcpip.AddressWithPrefix) error {
+	s.mu.RLock()
+	nic := s.nics[id]
+	s.mu.RUnlock()
+
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	state, err := nic.addAddress(protocol, addr)
+	if err != nil {
+		return err
+	}
+
+	// Duplicate address detection may complete, and report the new state
+	// of the address, before this event is reported.
+	s.emit(Event{
+		Type:    EventAddressAdded,
+		NIC:     id,
+		Address: ProtocolAddress{protocol, addr.Address, addr.PrefixLen},
+		State:   state,
+	})
+
+	return nil
+}
+
+// GetMainNICAddress returns the primary address of the given NIC for the given
+// protocol, along with the prefix of its subnet. It is the address routes
+// through the NIC use unless they specify one or another address is in the
+// subnet of their next hop. Addresses are preferred in the order they were
+// added, unless changed with SetPrimaryAddress, and tentative or duplicated
+// ones are skipped. It returns tcpip.ErrNoAddress if there are none.
+func (s *Stack) GetMainNICAddress(id tcpip.NICID, protocol tcpip.NetworkProtocolNumber) (tcpip.AddressWithPrefix, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	nic := s.nics[id]
+	if nic == nil {
+		return tcpip.AddressWithPrefix{}, tcpip.ErrUnknownNICID
+	}
+
+	addr, ok := nic.mainAddress(protocol)
+	if !ok {
+		return tcpip.AddressWithPrefix{}, tcpip.ErrNoAddress
+	}
+
+	return addr, nil
+}
+
+// SetPrimaryAddress makes addr the most preferred address of its protocol in
+// the given NIC, so that it becomes its primary address once usable. Calling it
+// for each address, from the least to the most preferred, sets their order.
+func (s *Stack) SetPrimaryAddress(id tcpip.NICID, addr tcpip.Address) error {
+	s.mu.RLock()
+	nic := s.nics[id]
+	s.mu.RUnlock()
+
 	if nic == nil {
 		return tcpip.ErrUnknownNICID
 	}
 
-	return nic.AddAddress(protocol, addr)
+	if err := nic.setPrimaryAddress(addr); err != nil {
+		return err
+	}
+
+	s.emit(Event{Type: EventPrimaryAddressChanged, NIC: id})
+
+	return nil
 }
 
 // RemoveAddress removes an existing network-layer address from the specified
-// NIC.
+// NIC. It can be called at any time: routes that use the address can't be used
+// to send packets anymore, and transport endpoints bound to or connected
+// through it are notified so that they can fail.
 func (s *Stack) RemoveAddress(id tcpip.NICID, addr tcpip.Address) error {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
+	nic := s.nics[id]
+	s.mu.RUnlock()
+
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	return s.removeAddress(nic, addr, nil)
+}
 
+// removeAddress implements RemoveAddress. If expiry isn't nil, the address is
+// only removed if its lifetime expires, i.e., if expiry is the stop channel of
+// its expiry and it wasn't reset since.
+func (s *Stack) removeAddress(nic *NIC, addr tcpip.Address, expiry chan struct{}) error {
+	protocol, prefixLen, err := nic.removeAddress(addr, expiry)
+	if err != nil {
+		return err
+	}
+
+	s.emit(Event{
+		Type:    EventAddressRemoved,
+		NIC:     nic.id,
+		Address: ProtocolAddress{protocol, addr, prefixLen},
+	})
+
+	for _, ep := range s.transportEndpoints(nic) {
+		if aep, ok := ep.(AddressRemovalAwareEndpoint); ok {
+			aep.HandleAddressRemoved(nic.id, addr)
+		}
+	}
+
+	return nil
+}
+
+// JoinGroup joins the multicast group addr on the specified NIC, so that it
+// starts accepting packets sent to the group. A group can be joined several
+// times, e.g., by different applications; it is left once LeaveGroup has been
+// called as many times. Groups aren't addresses of the NIC: they are never used
+// as source addresses, nor reported by NICInfo.
+func (s *Stack) JoinGroup(protocol tcpip.NetworkProtocolNumber, id tcpip.NICID, addr tcpip.Address) error {
+	if !isMulticastAddress(addr) {
+		return tcpip.ErrBadAddress
+	}
+
+	s.mu.RLock()
 	nic := s.nics[id]
+	s.mu.RUnlock()
+
 	if nic == nil {
 		return tcpip.ErrUnknownNICID
 	}
 
-	return nic.RemoveAddress(addr)
+	return nic.joinGroup(protocol, addr)
+}
+
+// LeaveGroup leaves the multicast group addr on the specified NIC, which must
+// have been joined with JoinGroup.
+func (s *Stack) LeaveGroup(id tcpip.NICID, addr tcpip.Address) error {
+	s.mu.RLock()
+	nic := s.nics[id]
+	s.mu.RUnlock()
+
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	return nic.leaveGroup(addr)
+}
+
+// isMulticastAddress returns whether addr is an IPv4 or IPv6 multicast address.
+func isMulticastAddress(addr tcpip.Address) bool {
+	return header.IsV4MulticastAddress(addr) || header.IsV6MulticastAddress(addr)
 }
 
 // FindRoute creates a route to the given destination address, leaving through
 // the given nic and local address (if provided).
 func (s *Stack) FindRoute(id tcpip.NICID, localAddr, remoteAddr tcpip.Address, netProto tcpip.NetworkProtocolNumber) (Route, error) {
+	key := routeCacheKey{id, localAddr, remoteAddr, netProto}
+	if r, ok := s.routes.lookup(key); ok {
+		return r, nil
+	}
+
+	gen := s.routes.generation()
+	r, cacheable, err := s.findRoute(id, localAddr, remoteAddr, netProto)
+	if err != nil {
+		return r, err
+	}
+	r.gen = gen
+
+	if cacheable {
+		s.routes.insert(key, gen, &r)
+	}
+
+	return r, nil
+}
+
+// findRoute looks up the route table for a route to remoteAddr. It also
+// returns whether the route can be cached, which isn't the case of routes
+// through temporary endpoints of spoofing NICs, as caching them would keep the
+// endpoints alive.
+func (s *Stack) findRoute(id tcpip.NICID, localAddr, remoteAddr tcpip.Address, netProto tcpip.NetworkProtocolNumber) (Route, bool, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	if id != 0 && isMulticastAddress(remoteAddr) {
+		return s.findMulticastRouteLocked(id, localAddr, remoteAddr, netProto)
+	}
+
+	if r, ok := s.findOnLinkRouteLocked(id, localAddr, remoteAddr, netProto); ok {
+		return r, true, nil
+	}
+
 	for i := range s.routeTable {
 		if id != 0 && id != s.routeTable[i].NIC || !s.routeTable[i].Match(remoteAddr) {
 			continue
 		}
 
 		nic := s.nics[s.routeTable[i].NIC]
-		if nic == nil {
+		if nic == nil || !nic.isLinkUp() {
 			continue
 		}
 
 		var ref *referencedNetworkEndpoint
+		cacheable := true
 		if len(localAddr) != 0 {
 			ref = nic.findEndpoint(localAddr)
+			if ref == nil && nic.isSpoofing() {
+				ref = nic.getRefOrCreateTemp(netProto, localAddr)
+				cacheable = false
+			}
 		} else {
-			ref = nic.primaryEndpoint(netProto)
+			// Prefer an address in the subnet of the next hop.
+			nextHop := s.routeTable[i].Gateway
+			if len(nextHop) == 0 {
+				nextHop = remoteAddr
+			}
+
+			ref = nic.subnetEndpoint(netProto, nextHop)
+			if ref == nil {
+				ref = nic.primaryEndpoint(netProto)
+			}
+		}
+
+		if ref == nil {
+			continue
+		}
+
+		r := makeRoute(netProto, ref.ep.ID().LocalAddress, remoteAddr, ref)
+		r.NextHop = s.routeTable[i].Gateway
+		return r, cacheable, nil
+	}
+
+	return Route{}, false, tcpip.ErrNoRoute
+}
+
+// findMulticastRouteLocked returns a route directly to the multicast group
+// remoteAddr through the given NIC, from localAddr if given, or from its primary
+// address otherwise.
+func (s *Stack) findMulticastRouteLocked(id tcpip.NICID, localAddr, remoteAddr tcpip.Address, netProto tcpip.NetworkProtocolNumber) (Route, bool, error) {
+	nic := s.nics[id]
+	if nic == nil || !nic.isLinkUp() {
+		return Route{}, false, tcpip.ErrNoRoute
+	}
+
+	var ref *referencedNetworkEndpoint
+	if len(localAddr) != 0 {
+		ref = nic.findEndpoint(localAddr)
+	} else {
+		ref = nic.primaryEndpoint(netProto)
+	}
+	if ref == nil {
+		return Route{}, false, tcpip.ErrNoRoute
+	}
+
+	return makeRoute(netProto, ref.ep.ID().LocalAddress, remoteAddr, ref), true, nil
+}
+
+// findOnLinkRouteLocked looks for a NIC with an address whose subnet includes
+// remoteAddr, and returns a route from it, or from localAddr if given, directly
+// to remoteAddr. If there are several, the one with the longest prefix is
+// picked, and then the one of the NIC with the lowest id.
+func (s *Stack) findOnLinkRouteLocked(id tcpip.NICID, localAddr, remoteAddr tcpip.Address, netProto tcpip.NetworkProtocolNumber) (Route, bool) {
+	var best *referencedNetworkEndpoint
+	bestPrefixLen := -1
+	for _, nic := range s.nics {
+		if id != 0 && id != nic.id || !nic.isLinkUp() {
+			continue
 		}
 
+		ref := nic.subnetEndpoint(netProto, remoteAddr)
 		if ref == nil {
 			continue
 		}
 
-		return makeRoute(netProto, ref.ep.ID().LocalAddress, remoteAddr, ref), nil
+		prefixLen := ref.prefixLen
+		if len(localAddr) != 0 && ref.ep.ID().LocalAddress != localAddr {
+			ref.decRef()
+			if ref = nic.findEndpoint(localAddr); ref == nil {
+				continue
+			}
+		}
+
+		if prefixLen < bestPrefixLen || prefixLen == bestPrefixLen && nic.id > best.nic.id {
+			ref.decRef()
+			continue
+		}
+
+		if best != nil {
+			best.decRef()
+		}
+		best = ref
+		bestPrefixLen = prefixLen
 	}
 
-	return Route{}, tcpip.ErrNoRoute
+	if best == nil {
+		return Route{}, false
+	}
+
+	return makeRoute(netProto, best.ep.ID().LocalAddress, remoteAddr, best), true
 }
 
 // CheckLocalAddress determines if the given local address exists, and if it
 // does, returns the id of the NIC it's bound to. Returns 0 if the address
-// does not exist.
+// does not exist. Any address is considered to exist on NICs in spoofing mode.
 func (s *Stack) CheckLocalAddress(nicid tcpip.NICID, addr tcpip.Address) tcpip.NICID {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -252,6 +943,9 @@ func (s *Stack) CheckLocalAddress(nicid tcpip.NICID, addr tcpip.Address) tcpip.N
 
 		ref := nic.findEndpoint(addr)
 		if ref == nil {
+			if nic.isSpoofing() {
+				return nic.id
+			}
 			return 0
 		}
 
@@ -269,7 +963,34 @@ func (s *Stack) CheckLocalAddress(nicid tcpip.NICID, addr tcpip.Address) tcpip.N
 		}
 	}
 
-	return 0
+	// Fall back to a NIC in spoofing mode, if there's one. The lowest id is
+	// picked so that the result doesn't depend on map iteration order.
+	var id tcpip.NICID
+	for _, nic := range s.nics {
+		if nic.isSpoofing() && (id == 0 || nic.id < id) {
+			id = nic.id
+		}
+	}
+
+	return id
+}
+
+// SetSpoofing enables or disables address spoofing in the given NIC. While it
+// is enabled, endpoints may bind to and send from local addresses that aren't
+// assigned to the NIC, which allows the stack to originate traffic on behalf
+// of arbitrary hosts, e.g., when acting as a middlebox.
+func (s *Stack) SetSpoofing(nicID tcpip.NICID, enable bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicID]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	nic.setSpoofing(enable)
+
+	return nil
 }
 
 // SetPromiscuousMode enables or disables promiscuous mode in the given NIC.
@@ -287,6 +1008,307 @@ func (s *Stack) SetPromiscuousMode(nicID tcpip.NICID, enable bool) error {
 	return nil
 }
 
+// SetGRO enables or disables generic receive offload in the given NIC. When
+// enabled, consecutive segments of the same TCP flow received in a batch by the
+// NIC's link endpoint are coalesced into larger segments before they are
+// handed to the transport layer.
+func (s *Stack) SetGRO(nicID tcpip.NICID, enable bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicID]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	nic.setGRO(enable)
+
+	return nil
+}
+
+// SetNICWorkers enables the worker-pool mode of the given NIC: instead of being
+// processed by the goroutine of the link endpoint that receives them, packets
+// are steered by a hash of their flow to one of the given number of goroutines,
+// each with a queue of queueSize packets. The packets of a flow are processed
+// in order, while different flows are processed in parallel. When a queue is
+// full, the link endpoint blocks until there is room in it.
+//
+// The NIC must have been created with CreateDisabledNIC and not enabled yet.
+// The goroutines exit when the NIC is removed.
+func (s *Stack) SetNICWorkers(nicID tcpip.NICID, workers, queueSize int) error {
+	if workers < 1 || queueSize < 0 {
+		return tcpip.ErrInvalidOptionValue
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicID]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	return nic.setWorkers(workers, queueSize)
+}
+
+// SetNICConfig replaces the settings of the given NIC. NICs are created with the
+// zero value of NICConfig.
+func (s *Stack) SetNICConfig(nicID tcpip.NICID, config NICConfig) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicID]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	nic.setConfig(config)
+
+	return nil
+}
+
+// NICConfig returns the settings of the given NIC.
+func (s *Stack) NICConfig(nicID tcpip.NICID) (NICConfig, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicID]
+	if nic == nil {
+		return NICConfig{}, tcpip.ErrUnknownNICID
+	}
+
+	return nic.getConfig(), nil
+}
+
+// findLocalEndpoint returns the endpoint of the given address in any NIC of the
+// stack, if any.
+func (s *Stack) findLocalEndpoint(addr tcpip.Address) *referencedNetworkEndpoint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, nic := range s.nics {
+		if ref := nic.findEndpoint(addr); ref != nil {
+			return ref
+		}
+	}
+
+	return nil
+}
+
+// SubscribeLinkState registers h to be called whenever the carrier of the link
+// endpoint of a NIC goes up or down. It returns a function that unregisters h.
+//
+// Handlers are called synchronously from the goroutine of the link endpoint
+// that reported the change, so they must not block.
+func (s *Stack) SubscribeLinkState(h func(nicID tcpip.NICID, up bool)) (cancel func()) {
+	s.linkStateMu.Lock()
+	id := s.nextLinkStateID
+	s.nextLinkStateID++
+	s.linkStateHandlers[id] = h
+	s.linkStateMu.Unlock()
+
+	return func() {
+		s.linkStateMu.Lock()
+		delete(s.linkStateHandlers, id)
+		s.linkStateMu.Unlock()
+	}
+}
+
+// IsLinkUp returns whether the carrier of the link endpoint of the given NIC
+// is up.
+func (s *Stack) IsLinkUp(id tcpip.NICID) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[id]
+	if nic == nil {
+		return false, tcpip.ErrUnknownNICID
+	}
+
+	return nic.isLinkUp(), nil
+}
+
+// linkStateChanged is called by a NIC when the carrier of its link endpoint
+// changes. It notifies the subscribers and, if the link went down, the
+// transport endpoints.
+func (s *Stack) linkStateChanged(nic *NIC, up bool) {
+	s.routes.invalidate()
+
+	s.linkStateMu.Lock()
+	handlers := make([]func(tcpip.NICID, bool), 0, len(s.linkStateHandlers))
+	for _, h := range s.linkStateHandlers {
+		handlers = append(handlers, h)
+	}
+	s.linkStateMu.Unlock()
+
+	for _, h := range handlers {
+		h(nic.id, up)
+	}
+
+	e := Event{Type: EventLinkUp, NIC: nic.id}
+	if !up {
+		e.Type = EventLinkDown
+	}
+	s.emit(e)
+
+	if up {
+		return
+	}
+
+	for _, ep := range s.transportEndpoints(nic) {
+		if lep, ok := ep.(LinkStateAwareEndpoint); ok {
+			lep.HandleLinkDown(nic.id)
+		}
+	}
+}
+
+// transportEndpoints returns the transport endpoints that may be using the
+// given NIC, that is, the ones registered with it and the ones registered with
+// the stack. Endpoints are collected before being returned so that callers
+// don't hold demuxer locks while they use them.
+func (s *Stack) transportEndpoints(nic *NIC) []TransportEndpoint {
+	eps := nic.demux.appendEndpoints(nil)
+	return s.demux.appendEndpoints(eps)
+}
+
+// SetMemoryLimit sets the maximum number of bytes that may be held in the
+// receive and send queues of all the stack's endpoints combined. Zero means no
+// limit. Lowering the limit below the current usage doesn't free memory, but
+// prevents more from being reserved until usage drops below the new limit.
+func (s *Stack) SetMemoryLimit(limit int) {
+	atomic.StoreInt64(&s.memLimit, int64(limit))
+}
+
+// MemoryUsage returns the number of bytes currently held in the receive and
+// send queues of all the stack's endpoints.
+func (s *Stack) MemoryUsage() int {
+	return int(atomic.LoadInt64(&s.memUsed))
+}
+
+// ReserveMemory is called by endpoints before they queue n bytes. It returns
+// false, without reserving anything, if doing so would exceed the stack's
+// memory limit, in which case the data must be dropped.
+func (s *Stack) ReserveMemory(n int) bool {
+	return reserveMemory(&s.memUsed, &s.memLimit, n)
+}
+
+// reserveMemory adds n to the counter pointed to by used, unless doing so would
+// exceed the limit pointed to by limit. Both are only accessed atomically.
+func reserveMemory(used, limit *int64, n int) bool {
+	for {
+		u := atomic.LoadInt64(used)
+		l := atomic.LoadInt64(limit)
+		if l > 0 && u+int64(n) > l {
+			return false
+		}
+
+		if atomic.CompareAndSwapInt64(used, u, u+int64(n)) {
+			return true
+		}
+	}
+}
+
+// ReleaseMemory is called by endpoints when n bytes previously reserved with
+// ReserveMemory are no longer held in their queues.
+func (s *Stack) ReleaseMemory(n int) {
+	atomic.AddInt64(&s.memUsed, -int64(n))
+}
+
+// SetClock replaces the clock used by the stack's protocols, e.g., with one
+// whose time is driven by a test. It must be called before any endpoints are
+// created.
+func (s *Stack) SetClock(c tcpip.Clock) {
+	s.clock = c
+}
+
+// Clock returns the clock used by the stack's protocols.
+func (s *Stack) Clock() tcpip.Clock {
+	return s.clock
+}
+
+// TransportEndpoints returns information about all the transport endpoints that
+// are registered with the stack or any of its NICs, e.g., to show the
+// connections it holds for debugging purposes.
+func (s *Stack) TransportEndpoints() []TransportEndpointInfo {
+	s.mu.RLock()
+	nics := make([]*NIC, 0, len(s.nics))
+	for _, nic := range s.nics {
+		nics = append(nics, nic)
+	}
+	s.mu.RUnlock()
+
+	var infos []TransportEndpointInfo
+	add := func(nicID tcpip.NICID, eps []registeredEndpoint) {
+		// Endpoints are inspected without holding the demuxer locks,
+		// as they may hold their own locks while registering.
+		for _, r := range eps {
+			info := TransportEndpointInfo{
+				NIC:      nicID,
+				Protocol: r.protocol,
+				ID:       r.id,
+			}
+			if iep, ok := r.ep.(InspectableEndpoint); ok {
+				info.State = iep.Inspect()
+			}
+			infos = append(infos, info)
+		}
+	}
+
+	add(0, s.demux.appendRegistered(nil))
+	for _, nic := range nics {
+		add(nic.id, nic.demux.appendRegistered(nil))
+	}
+
+	return infos
+}
+
+// SetNICMTU changes the MTU of the given NIC at runtime. Transport endpoints
+// using the NIC are notified so that they can adapt the size of the segments
+// they send. An MTU of zero restores the MTU reported by the NIC's link
+// endpoint, which other values can't exceed. Values smaller than the minimum
+// MTU of the network protocols of the stack, e.g., 1280 for IPv6, are rejected
+// as well.
+func (s *Stack) SetNICMTU(id tcpip.NICID, mtu uint32) error {
+	s.mu.RLock()
+	nic := s.nics[id]
+	s.mu.RUnlock()
+
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	if err := nic.setMTU(mtu); err != nil {
+		return err
+	}
+
+	for _, ep := range s.transportEndpoints(nic) {
+		if mep, ok := ep.(MTUAwareEndpoint); ok {
+			mep.HandleMTUChange(id)
+		}
+	}
+
+	return nil
+}
+
+// minimumMTU returns the smallest MTU that all the network protocols of the
+// stack can work with.
+func (s *Stack) minimumMTU() uint32 {
+	var mtu uint32
+	for number := range s.networkProtocols {
+		var min uint32
+		switch number {
+		case header.IPv4ProtocolNumber:
+			min = header.IPv4MinimumMTU
+		case header.IPv6ProtocolNumber:
+			min = header.IPv6MinimumMTU
+		}
+		if min > mtu {
+			mtu = min
+		}
+	}
+	return mtu
+}
+
 // RegisterTransportEndpoint registers the given endpoint with the stack
 // transport dispatcher. Received packets that match the provided id will be
 // delivered to the given endpoint; specifying a nic is optinal, but
@@ -307,6 +1329,44 @@ func (s *Stack) RegisterTransportEndpoint(nicID tcpip.NICID, protocol tcpip.Tran
 	return nic.demux.registerEndpoint(protocol, id, ep)
 }
 
+// RegisterReusePortEndpoint is like RegisterTransportEndpoint, but the id may be
+// shared by multiple endpoints registered with this method, like with
+// SO_REUSEPORT: the packets that match it are distributed among them by a hash
+// of their source address and port, e.g., so that the connections to a port
+// are spread among listening endpoints served by different goroutines.
+func (s *Stack) RegisterReusePortEndpoint(nicID tcpip.NICID, protocol tcpip.TransportProtocolNumber, id TransportEndpointID, ep TransportEndpoint) error {
+	if nicID == 0 {
+		return s.demux.registerReusePortEndpoint(protocol, id, ep)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicID]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	return nic.demux.registerReusePortEndpoint(protocol, id, ep)
+}
+
+// UnregisterReusePortEndpoint removes ep from the endpoints registered with the
+// given id with RegisterReusePortEndpoint.
+func (s *Stack) UnregisterReusePortEndpoint(nicID tcpip.NICID, protocol tcpip.TransportProtocolNumber, id TransportEndpointID, ep TransportEndpoint) {
+	if nicID == 0 {
+		s.demux.unregisterReusePortEndpoint(protocol, id, ep)
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicID]
+	if nic != nil {
+		nic.demux.unregisterReusePortEndpoint(protocol, id, ep)
+	}
+}
+
 // UnregisterTransportEndpoint removes the endpoint with the given id from the
 // stack transport dispatcher.
 func (s *Stack) UnregisterTransportEndpoint(nicID tcpip.NICID, protocol tcpip.TransportProtocolNumber, id TransportEndpointID) {
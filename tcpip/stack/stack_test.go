@@ -8,13 +8,25 @@
 package stack_test
 
 import (
+	"bytes"
+	"log"
 	"math"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/faketime"
+	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/link/loopback"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/network/ipv6"
 	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/waiter"
 )
 
 const (
@@ -54,16 +66,16 @@ func (f *fakeNetworkEndpoint) ID() *stack.NetworkEndpointID {
 	return &f.id
 }
 
-func (f *fakeNetworkEndpoint) HandlePacket(r *stack.Route, v buffer.View) {
+func (f *fakeNetworkEndpoint) HandlePacket(r *stack.Route, vv buffer.VectorisedView) {
 	// Increment the received packet count in the protocol descriptor.
 	f.proto.packetCount[int(f.id.LocalAddress[0])%len(f.proto.packetCount)]++
 
 	// Consume the network header.
-	b := v
-	v.TrimFront(fakeNetHeaderLen)
+	b := vv.First()
+	vv.TrimFront(fakeNetHeaderLen)
 
 	// Dispatch the packet to the transport protocol.
-	f.dispatcher.DeliverTransportPacket(r, tcpip.TransportProtocolNumber(b[2]), v)
+	f.dispatcher.DeliverTransportPacket(r, tcpip.TransportProtocolNumber(b[2]), vv)
 }
 
 func (f *fakeNetworkEndpoint) MaxHeaderLength() uint16 {
@@ -74,7 +86,7 @@ func (f *fakeNetworkEndpoint) PseudoHeaderChecksum(protocol tcpip.TransportProto
 	return 0
 }
 
-func (f *fakeNetworkEndpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.TransportProtocolNumber) error {
+func (f *fakeNetworkEndpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.TransportProtocolNumber) error {
 	// Increment the sent packet count in the protocol descriptor.
 	f.proto.sendPacketCount[int(r.RemoteAddress[0])%len(f.proto.sendPacketCount)]++
 
@@ -107,6 +119,12 @@ func (*fakeNetworkProtocol) ParseAddresses(v buffer.View) (src, dst tcpip.Addres
 	return tcpip.Address(v[1:2]), tcpip.Address(v[0:1])
 }
 
+// PrepareForward implements stack.ForwardingNetworkProtocol.PrepareForward. The
+// fake protocol has no TTL, so packets are always forwarded.
+func (*fakeNetworkProtocol) PrepareForward(buffer.View) bool {
+	return true
+}
+
 func (f *fakeNetworkProtocol) NewEndpoint(nicid tcpip.NICID, addr tcpip.Address, dispatcher stack.TransportDispatcher, linkEP stack.LinkEndpoint) (stack.NetworkEndpoint, error) {
 	return &fakeNetworkEndpoint{
 		nicid:      nicid,
@@ -196,7 +214,7 @@ func sendTo(t *testing.T, s *stack.Stack, addr tcpip.Address) {
 	defer r.Release()
 
 	hdr := buffer.NewPrependable(int(r.MaxHeaderLength()))
-	err = r.WritePacket(&hdr, nil, fakeTransNumber)
+	err = r.WritePacket(&hdr, buffer.VectorisedView{}, fakeTransNumber)
 	if err != nil {
 		t.Errorf("WritePacket failed: %v", err)
 		return
@@ -372,6 +390,123 @@ func TestRoutes(t *testing.T) {
 	testNoRoute(t, s, 1, "\x03", "\x06")
 }
 
+func TestCachedRoutesInvalidated(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
+
+	id1, _ := channel.New(10, defaultMTU)
+	if err := s.CreateNIC(1, id1); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	id2, _ := channel.New(10, defaultMTU)
+	if err := s.CreateNIC(2, id2); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(2, fakeNetNumber, "\x02"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{{"\x00", "\x00", "\x00", 1}})
+
+	// Look the route up twice, so that the second lookup is served from
+	// the cache.
+	testRoute(t, s, 0, "", "\x05", "\x01")
+	testRoute(t, s, 0, "", "\x05", "\x01")
+
+	// Changing the route table invalidates the cached route.
+	s.SetRouteTable([]tcpip.Route{{"\x00", "\x00", "\x00", 2}})
+	testRoute(t, s, 0, "", "\x05", "\x02")
+
+	// Adding an address invalidates it too; the new address isn't primary,
+	// but it can now be used as the source.
+	if err := s.AddAddress(2, fakeNetNumber, "\x04"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	testRoute(t, s, 0, "\x04", "\x05", "\x04")
+
+	// So does removing one.
+	if err := s.RemoveAddress(2, "\x04"); err != nil {
+		t.Fatalf("RemoveAddress failed: %v", err)
+	}
+	testNoRoute(t, s, 0, "\x04", "\x05")
+
+	// And removing the NIC.
+	if err := s.RemoveNIC(2); err != nil {
+		t.Fatalf("RemoveNIC failed: %v", err)
+	}
+	testNoRoute(t, s, 0, "", "\x05")
+}
+
+func TestRouteTableAdministration(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
+
+	id, _ := channel.New(10, defaultMTU)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	changes := 0
+	cancel := s.SubscribeRouteTable(func() { changes++ })
+	defer cancel()
+
+	if err := s.SetDefaultGateway(2, "\x09"); err != tcpip.ErrUnknownNICID {
+		t.Errorf("SetDefaultGateway on unknown NIC returned %v, want %v", err, tcpip.ErrUnknownNICID)
+	}
+
+	if err := s.SetDefaultGateway(1, "\x09"); err != nil {
+		t.Fatalf("SetDefaultGateway failed: %v", err)
+	}
+
+	if err := s.AddRoute(tcpip.Route{Destination: "\x04", Mask: "\xfc", NIC: 1}); err != nil {
+		t.Fatalf("AddRoute failed: %v", err)
+	}
+
+	if err := s.AddRoute(tcpip.Route{Destination: "\x04", Mask: "", NIC: 1}); err != tcpip.ErrInvalidRoute {
+		t.Errorf("AddRoute with bad mask returned %v, want %v", err, tcpip.ErrInvalidRoute)
+	}
+
+	// The more specific route is inserted before the default one.
+	want := []tcpip.Route{
+		{Destination: "\x04", Mask: "\xfc", NIC: 1},
+		{Destination: "\x00", Mask: "\x00", Gateway: "\x09", NIC: 1},
+	}
+	if got := s.RouteTable(); !reflect.DeepEqual(got, want) {
+		t.Errorf("RouteTable returned %v, want %v", got, want)
+	}
+
+	if gw, ok := s.DefaultGateway(1); !ok || gw.Gateway != "\x09" {
+		t.Errorf("DefaultGateway returned (%v, %v), want gateway %v", gw, ok, tcpip.Address("\x09"))
+	}
+
+	// Routes through the default gateway go to it first.
+	r, err := s.FindRoute(0, "", "\x10", fakeNetNumber)
+	if err != nil {
+		t.Fatalf("FindRoute failed: %v", err)
+	}
+	if r.NextHop != "\x09" {
+		t.Errorf("FindRoute returned next hop %v, want %v", r.NextHop, tcpip.Address("\x09"))
+	}
+	r.Release()
+
+	if n := s.RemoveRoutes(func(r tcpip.Route) bool { return r.Gateway != "" }); n != 1 {
+		t.Errorf("RemoveRoutes removed %d routes, want 1", n)
+	}
+	testNoRoute(t, s, 0, "", "\x10")
+
+	if changes != 3 {
+		t.Errorf("Got %d route table notifications, want 3", changes)
+	}
+}
+
 func TestAddressRemoval(t *testing.T) {
 	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
 
@@ -472,6 +607,62 @@ func TestDelayedRemovalDueToRoute(t *testing.T) {
 	}
 }
 
+func TestRouteInvalidatedByAddressRemoval(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
+
+	id, _ := channel.New(10, defaultMTU)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{
+		{"\x00", "\x00", "\x00", 1},
+	})
+
+	r, err := s.FindRoute(0, "", "\x03", fakeNetNumber)
+	if err != nil {
+		t.Fatalf("FindRoute failed: %v", err)
+	}
+	defer r.Release()
+
+	hdr := buffer.NewPrependable(int(r.MaxHeaderLength()))
+	if err := r.WritePacket(&hdr, buffer.VectorisedView{}, fakeTransNumber); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+
+	// Remove the address, then check that the route can't be used to send
+	// packets anymore.
+	if err := s.RemoveAddress(1, "\x01"); err != nil {
+		t.Fatalf("RemoveAddress failed: %v", err)
+	}
+
+	hdr = buffer.NewPrependable(int(r.MaxHeaderLength()))
+	if err := r.WritePacket(&hdr, buffer.VectorisedView{}, fakeTransNumber); err != tcpip.ErrBadLocalAddress {
+		t.Fatalf("WritePacket returned unexpected status: expected %v, got %v", tcpip.ErrBadLocalAddress, err)
+	}
+
+	// Check that the address can be added back while the old route is
+	// still alive, and that new routes work.
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	nr, err := s.FindRoute(0, "", "\x03", fakeNetNumber)
+	if err != nil {
+		t.Fatalf("FindRoute failed: %v", err)
+	}
+	defer nr.Release()
+
+	hdr = buffer.NewPrependable(int(nr.MaxHeaderLength()))
+	if err := nr.WritePacket(&hdr, buffer.VectorisedView{}, fakeTransNumber); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+}
+
 func TestPromiscuousMode(t *testing.T) {
 	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
 
@@ -523,8 +714,1551 @@ func TestPromiscuousMode(t *testing.T) {
 	}
 }
 
-var fakeNet fakeNetworkProtocol
+func TestSpoofing(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
 
-func init() {
-	stack.RegisterNetworkProtocol("fakeNet", &fakeNet)
+	id, _ := channel.New(10, defaultMTU)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{
+		{"\x00", "\x00", "\x00", 1},
+	})
+
+	// Check that we can't get a route or bind to an address that isn't
+	// assigned to the NIC.
+	testNoRoute(t, s, 0, "\x03", "\x02")
+	if nic := s.CheckLocalAddress(0, "\x03"); nic != 0 {
+		t.Fatalf("CheckLocalAddress returned %v, want 0", nic)
+	}
+
+	// Enable spoofing, then check that the address can be used.
+	if err := s.SetSpoofing(1, true); err != nil {
+		t.Fatalf("SetSpoofing failed: %v", err)
+	}
+
+	if nic := s.CheckLocalAddress(0, "\x03"); nic != 1 {
+		t.Fatalf("CheckLocalAddress returned %v, want 1", nic)
+	}
+
+	r, err := s.FindRoute(0, "\x03", "\x02", fakeNetNumber)
+	if err != nil {
+		t.Fatalf("FindRoute failed: %v", err)
+	}
+
+	if r.LocalAddress != "\x03" {
+		t.Fatalf("Bad local address: got %v, want %v", r.LocalAddress, "\x03")
+	}
+
+	// The spoofed address is temporary, so it isn't reported as one of the
+	// NIC's addresses.
+	info := s.NICInfo()[1]
+	if !info.Flags.Spoofing {
+		t.Errorf("Flags.Spoofing = false, want true")
+	}
+	if len(info.Addresses) != 1 {
+		t.Errorf("len(Addresses) = %d, want 1", len(info.Addresses))
+	}
+
+	r.Release()
+
+	// Disable spoofing, then check that the address can't be used anymore.
+	if err := s.SetSpoofing(1, false); err != nil {
+		t.Fatalf("SetSpoofing failed: %v", err)
+	}
+
+	testNoRoute(t, s, 0, "\x03", "\x02")
+}
+
+func TestRemoveNIC(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
+
+	id, linkEP := channel.New(10, defaultMTU)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{
+		{"\x00", "\x00", "\x00", 1},
+	})
+
+	r, err := s.FindRoute(0, "", "\x02", fakeNetNumber)
+	if err != nil {
+		t.Fatalf("FindRoute failed: %v", err)
+	}
+	defer r.Release()
+
+	if err := s.RemoveNIC(1); err != nil {
+		t.Fatalf("RemoveNIC failed: %v", err)
+	}
+
+	// Check that packets aren't delivered anymore, even though the route
+	// still references the address.
+	fakeNet.packetCount[1] = 0
+	buf := buffer.NewView(30)
+	buf[0] = 1
+	linkEP.Inject(fakeNetNumber, buf)
+	if fakeNet.packetCount[1] != 0 {
+		t.Errorf("packetCount[1] = %d, want %d", fakeNet.packetCount[1], 0)
+	}
+
+	// Check that the route can't be used anymore, and that no new routes
+	// can be found.
+	hdr := buffer.NewPrependable(int(r.MaxHeaderLength()))
+	if err := r.WritePacket(&hdr, buffer.VectorisedView{}, fakeTransNumber); err != tcpip.ErrNoRoute {
+		t.Errorf("WritePacket returned unexpected status: expected %v, got %v", tcpip.ErrNoRoute, err)
+	}
+
+	if _, err := s.FindRoute(0, "", "\x02", fakeNetNumber); err != tcpip.ErrNoRoute {
+		t.Errorf("FindRoute returned unexpected status: expected %v, got %v", tcpip.ErrNoRoute, err)
+	}
+
+	if err := s.RemoveNIC(1); err != tcpip.ErrUnknownNICID {
+		t.Errorf("RemoveNIC returned unexpected status: expected %v, got %v", tcpip.ErrUnknownNICID, err)
+	}
+
+	// Check that the link endpoint can be used by a new NIC with the same
+	// id.
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	linkEP.Inject(fakeNetNumber, buf)
+	if fakeNet.packetCount[1] != 1 {
+		t.Errorf("packetCount[1] = %d, want %d", fakeNet.packetCount[1], 1)
+	}
+}
+
+func TestNICInfo(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
+
+	id, linkEP := channel.New(10, 1500)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{
+		{"\x00", "\x00", "\x00", 1},
+	})
+
+	// Receive a packet for the address and one for an unknown address.
+	buf := buffer.NewView(30)
+	buf[0] = 1
+	linkEP.Inject(fakeNetNumber, buf)
+	buf[0] = 9
+	linkEP.Inject(fakeNetNumber, buf)
+
+	// Send a packet.
+	r, err := s.FindRoute(0, "", "\x03", fakeNetNumber)
+	if err != nil {
+		t.Fatalf("FindRoute failed: %v", err)
+	}
+	defer r.Release()
+
+	hdr := buffer.NewPrependable(int(r.MaxHeaderLength()))
+	if err := r.WritePacket(&hdr, buffer.NewView(10).ToVectorisedView(), fakeTransNumber); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+
+	info, ok := s.NICInfo()[1]
+	if !ok {
+		t.Fatalf("NICInfo doesn't include NIC 1")
+	}
+
+	if info.MTU != 1500 {
+		t.Errorf("MTU = %v, want %v", info.MTU, 1500)
+	}
+
+	if !info.Flags.Up || !info.Flags.Running || info.Flags.Promiscuous {
+		t.Errorf("Flags = %+v, want up and running only", info.Flags)
+	}
+
+	want := []stack.ProtocolAddress{{fakeNetNumber, "\x01", 8}}
+	if len(info.Addresses) != 1 || info.Addresses[0] != want[0] {
+		t.Errorf("Addresses = %v, want %v", info.Addresses, want)
+	}
+
+	wantStats := stack.NICStats{
+		Rx:       stack.NICDirectionStats{Packets: 2, Bytes: 60},
+		Tx:       stack.NICDirectionStats{Packets: 1, Bytes: fakeNetHeaderLen + 10},
+		RxErrors: 1,
+	}
+	if info.Stats != wantStats {
+		t.Errorf("Stats = %+v, want %+v", info.Stats, wantStats)
+	}
+}
+
+func TestJoinGroup(t *testing.T) {
+	const (
+		addr  = "\x0a\x00\x00\x01"
+		group = "\xe0\x00\x00\xfb"
+	)
+
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+	id, linkEP := channel.New(10, defaultMTU)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, addr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	rcv, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer rcv.Close()
+	if err := rcv.Bind(tcpip.FullAddress{Port: 1000}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	snd, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer snd.Close()
+
+	// Don't loop the datagrams back, so that rcv only receives the ones
+	// injected.
+	if err := snd.SetSockOpt(tcpip.MulticastLoopOption(0)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+
+	// received sends a datagram to the group through the NIC, which needs
+	// no route, injects it back, and returns whether rcv received it.
+	received := func() bool {
+		t.Helper()
+		if _, err := snd.Write(buffer.View("hello"), &tcpip.FullAddress{NIC: 1, Addr: group, Port: 1000}); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+
+		var p channel.PacketInfo
+		select {
+		case p = <-linkEP.C:
+		default:
+			t.Fatalf("no packet was written")
+		}
+		b := append(append(buffer.View(nil), p.Header...), p.Payload...)
+		if ip := header.IPv4(b); ip.SourceAddress() != addr || ip.DestinationAddress() != group {
+			t.Fatalf("got packet from %v to %v, want from %v to %v", ip.SourceAddress(), ip.DestinationAddress(), addr, group)
+		}
+
+		linkEP.Inject(ipv4.ProtocolNumber, b)
+		_, err := rcv.Read(nil)
+		return err == nil
+	}
+
+	if received() {
+		t.Errorf("datagram received before joining the group")
+	}
+
+	// The group is left once it has been left as many times as it was
+	// joined.
+	for i := 0; i < 2; i++ {
+		if err := s.JoinGroup(ipv4.ProtocolNumber, 1, group); err != nil {
+			t.Fatalf("JoinGroup failed: %v", err)
+		}
+	}
+	if !received() {
+		t.Errorf("datagram not received after joining the group")
+	}
+	if err := s.LeaveGroup(1, group); err != nil {
+		t.Fatalf("LeaveGroup failed: %v", err)
+	}
+	if !received() {
+		t.Errorf("datagram not received after leaving the group once")
+	}
+
+	// Groups aren't addresses of the NIC.
+	want := []stack.ProtocolAddress{{ipv4.ProtocolNumber, addr, 32}}
+	if got := s.NICInfo()[1].Addresses; !reflect.DeepEqual(got, want) {
+		t.Errorf("got addresses %v, want %v", got, want)
+	}
+	if err := s.RemoveAddress(1, group); err != tcpip.ErrBadLocalAddress {
+		t.Errorf("RemoveAddress returned %v, want %v", err, tcpip.ErrBadLocalAddress)
+	}
+
+	if err := s.LeaveGroup(1, group); err != nil {
+		t.Fatalf("LeaveGroup failed: %v", err)
+	}
+	if received() {
+		t.Errorf("datagram received after leaving the group")
+	}
+	if err := s.LeaveGroup(1, group); err != tcpip.ErrBadLocalAddress {
+		t.Errorf("LeaveGroup returned %v, want %v", err, tcpip.ErrBadLocalAddress)
+	}
+
+	if err := s.JoinGroup(ipv4.ProtocolNumber, 1, addr); err != tcpip.ErrBadAddress {
+		t.Errorf("JoinGroup with a unicast address returned %v, want %v", err, tcpip.ErrBadAddress)
+	}
+}
+
+func TestMulticastFanOut(t *testing.T) {
+	const (
+		addr  = "\x0a\x00\x00\x01"
+		group = "\xe0\x00\x00\xfb"
+	)
+
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+	if err := s.CreateNIC(1, loopback.New()); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, addr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	if err := s.JoinGroup(ipv4.ProtocolNumber, 1, group); err != nil {
+		t.Fatalf("JoinGroup failed: %v", err)
+	}
+
+	// Both endpoints bound to the port of the group receive its datagrams.
+	var rcvs []tcpip.Endpoint
+	for _, a := range []tcpip.Address{"", group} {
+		ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %v", err)
+		}
+		defer ep.Close()
+		if err := ep.SetSockOpt(tcpip.ReuseAddressOption(1)); err != nil {
+			t.Fatalf("SetSockOpt failed: %v", err)
+		}
+		if err := ep.Bind(tcpip.FullAddress{Addr: a, Port: 1000}, nil); err != nil {
+			t.Fatalf("Bind to %v failed: %v", a, err)
+		}
+		rcvs = append(rcvs, ep)
+	}
+
+	snd, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer snd.Close()
+	if _, err := snd.Write(buffer.View("hello"), &tcpip.FullAddress{NIC: 1, Addr: group, Port: 1000}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// The datagram read by one endpoint may be modified without affecting
+	// the other.
+	for i, ep := range rcvs {
+		v, err := ep.Read(nil)
+		if err != nil {
+			t.Fatalf("Read by endpoint %d failed: %v", i, err)
+		}
+		if string(v) != "hello" {
+			t.Errorf("endpoint %d read %q, want %q", i, v, "hello")
+		}
+		copy(v, "HELLO")
+	}
+}
+
+func TestSaveRestoreState(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
+
+	id, _ := channel.New(10, defaultMTU)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	for _, addr := range []tcpip.Address{"\x01", "\x02"} {
+		if err := s.AddAddress(1, fakeNetNumber, addr); err != nil {
+			t.Fatalf("AddAddress failed: %v", err)
+		}
+	}
+
+	if err := s.SetPromiscuousMode(1, true); err != nil {
+		t.Fatalf("SetPromiscuousMode failed: %v", err)
+	}
+
+	if err := s.SetNICMTU(1, 1000); err != nil {
+		t.Fatalf("SetNICMTU failed: %v", err)
+	}
+
+	routes := []tcpip.Route{{"\x00", "\x00", "\x00", 1}}
+	s.SetRouteTable(routes)
+
+	st, err := s.SaveState(nil)
+	if err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+
+	// Restore the state in a new stack, with a new link endpoint.
+	rs := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
+	id, _ = channel.New(10, defaultMTU)
+	st.NICs[0].LinkEndpoint = id
+	if _, err := rs.RestoreState(st, nil); err != nil {
+		t.Fatalf("RestoreState failed: %v", err)
+	}
+
+	info, ok := rs.NICInfo()[1]
+	if !ok {
+		t.Fatalf("NICInfo doesn't include NIC 1")
+	}
+
+	if !info.Flags.Up || !info.Flags.Promiscuous {
+		t.Errorf("Flags = %+v, want up and promiscuous", info.Flags)
+	}
+
+	if info.MTU != 1000 {
+		t.Errorf("MTU = %v, want %v", info.MTU, 1000)
+	}
+
+	if len(info.Addresses) != 2 {
+		t.Errorf("Addresses = %v, want 2 addresses", info.Addresses)
+	}
+
+	// The first address is still the primary one.
+	testRoute(t, rs, 0, "", "\x03", "\x01")
+}
+
+func TestSetNICMTU(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		protos  []string
+		mtu     uint32
+		wantErr error
+	}{
+		{"IPv4 minimum", []string{ipv4.ProtocolName}, header.IPv4MinimumMTU, nil},
+		{"below IPv4 minimum", []string{ipv4.ProtocolName}, header.IPv4MinimumMTU - 1, tcpip.ErrInvalidOptionValue},
+		{"IPv6 minimum", []string{ipv4.ProtocolName, ipv6.ProtocolName}, header.IPv6MinimumMTU, nil},
+		{"below IPv6 minimum", []string{ipv4.ProtocolName, ipv6.ProtocolName}, header.IPv6MinimumMTU - 1, tcpip.ErrInvalidOptionValue},
+		{"link MTU", []string{ipv4.ProtocolName}, 1500, nil},
+		{"above link MTU", []string{ipv4.ProtocolName}, 1501, tcpip.ErrInvalidOptionValue},
+		{"link default", []string{ipv6.ProtocolName}, 0, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := stack.New(test.protos, nil).(*stack.Stack)
+			id, _ := channel.New(10, 1500)
+			if err := s.CreateNIC(1, id); err != nil {
+				t.Fatalf("CreateNIC failed: %v", err)
+			}
+			if err := s.SetNICMTU(1, 1400); err != nil {
+				t.Fatalf("SetNICMTU failed: %v", err)
+			}
+
+			if err := s.SetNICMTU(1, test.mtu); err != test.wantErr {
+				t.Fatalf("SetNICMTU(%d) returned %v, want %v", test.mtu, err, test.wantErr)
+			}
+
+			// Rejected values leave the MTU unchanged.
+			want := test.mtu
+			if test.wantErr != nil {
+				want = 1400
+			} else if want == 0 {
+				want = 1500
+			}
+			if got := s.NICInfo()[1].MTU; got != want {
+				t.Errorf("Got MTU %d, want %d", got, want)
+			}
+		})
+	}
+
+	s := stack.New([]string{ipv4.ProtocolName}, nil).(*stack.Stack)
+	if err := s.SetNICMTU(1, 1500); err != tcpip.ErrUnknownNICID {
+		t.Errorf("SetNICMTU on an unknown NIC returned %v, want %v", err, tcpip.ErrUnknownNICID)
+	}
+}
+
+func TestNICForwarding(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
+
+	id1, linkEP1 := channel.New(10, defaultMTU)
+	if err := s.CreateNIC(1, id1); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	id2, linkEP2 := channel.New(10, defaultMTU)
+	if err := s.CreateNIC(2, id2); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(2, fakeNetNumber, "\x02"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{
+		{"\x03", "\xff", "\x00", 2},
+	})
+
+	buf := buffer.NewView(30)
+	buf[0] = 3
+
+	// Packets aren't forwarded by default.
+	linkEP1.Inject(fakeNetNumber, buf)
+	if n := linkEP2.Drain(); n != 0 {
+		t.Fatalf("%d packets forwarded, want 0", n)
+	}
+
+	if err := s.SetNICConfig(1, stack.NICConfig{Forwarding: true}); err != nil {
+		t.Fatalf("SetNICConfig failed: %v", err)
+	}
+
+	linkEP1.Inject(fakeNetNumber, buf)
+	select {
+	case p := <-linkEP2.C:
+		if len(p.Payload) != len(buf) || p.Payload[0] != 3 {
+			t.Errorf("forwarded packet = %v, want %v", p.Payload, buf)
+		}
+	default:
+		t.Fatalf("packet wasn't forwarded")
+	}
+
+	if got := s.Stats().IP.PacketsForwarded; got != 1 {
+		t.Errorf("PacketsForwarded = %d, want 1", got)
+	}
+
+	// Packets addressed to another NIC are delivered locally.
+	fakeNet.packetCount[2] = 0
+	buf[0] = 2
+	linkEP1.Inject(fakeNetNumber, buf)
+	if fakeNet.packetCount[2] != 1 {
+		t.Errorf("packetCount[2] = %d, want 1", fakeNet.packetCount[2])
+	}
+	if n := linkEP2.Drain(); n != 0 {
+		t.Errorf("%d packets forwarded, want 0", n)
+	}
+
+	// The setting is per-NIC.
+	buf[0] = 3
+	linkEP2.Inject(fakeNetNumber, buf)
+	if n := linkEP2.Drain(); n != 0 {
+		t.Errorf("%d packets forwarded by NIC 2, want 0", n)
+	}
+
+	config, err := s.NICConfig(1)
+	if err != nil {
+		t.Fatalf("NICConfig failed: %v", err)
+	}
+	if !config.Forwarding || config.AcceptRedirects || config.AcceptRouterAdvertisements {
+		t.Errorf("NICConfig(1) = %+v, want forwarding only", config)
+	}
+
+	if _, err := s.NICConfig(3); err != tcpip.ErrUnknownNICID {
+		t.Errorf("NICConfig(3) returned %v, want %v", err, tcpip.ErrUnknownNICID)
+	}
+}
+
+func TestAddressPrefix(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
+
+	id1, linkEP1 := channel.New(10, defaultMTU)
+	if err := s.CreateNIC(1, id1); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddressWithPrefix(1, fakeNetNumber, tcpip.AddressWithPrefix{"\x11", 4}); err != nil {
+		t.Fatalf("AddAddressWithPrefix failed: %v", err)
+	}
+
+	id2, _ := channel.New(10, defaultMTU)
+	if err := s.CreateNIC(2, id2); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(2, fakeNetNumber, "\x02"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	if err := s.AddAddressWithPrefix(2, fakeNetNumber, tcpip.AddressWithPrefix{"\x21", 4}); err != nil {
+		t.Fatalf("AddAddressWithPrefix failed: %v", err)
+	}
+
+	if err := s.AddAddressWithPrefix(2, fakeNetNumber, tcpip.AddressWithPrefix{"\x03", 9}); err != tcpip.ErrInvalidPrefix {
+		t.Errorf("AddAddressWithPrefix with a prefix longer than the address returned %v, want %v", err, tcpip.ErrInvalidPrefix)
+	}
+
+	s.SetRouteTable([]tcpip.Route{
+		{"\x00", "\x00", "\x25", 2},
+	})
+
+	for _, tc := range []struct {
+		remote  tcpip.Address
+		nic     tcpip.NICID
+		local   tcpip.Address
+		nextHop tcpip.Address
+	}{
+		// On-link destinations don't need the route table.
+		{"\x13", 1, "\x11", ""},
+		{"\x2f", 2, "\x21", ""},
+
+		// The address in the subnet of the gateway is preferred.
+		{"\x50", 2, "\x21", "\x25"},
+	} {
+		r, err := s.FindRoute(0, "", tc.remote, fakeNetNumber)
+		if err != nil {
+			t.Errorf("FindRoute(%v) failed: %v", tc.remote, err)
+			continue
+		}
+
+		if r.NICID() != tc.nic || r.LocalAddress != tc.local || r.NextHop != tc.nextHop {
+			t.Errorf("FindRoute(%v) = NIC %v, local address %v, next hop %v, want %v, %v, %v", tc.remote, r.NICID(), r.LocalAddress, r.NextHop, tc.nic, tc.local, tc.nextHop)
+		}
+		r.Release()
+	}
+
+	// Packets to the directed broadcast address of the subnet are
+	// received.
+	fakeNet.packetCount[7] = 0
+	buf := buffer.NewView(30)
+	buf[0] = 0x1f
+	linkEP1.Inject(fakeNetNumber, buf)
+	if fakeNet.packetCount[7] != 1 {
+		t.Errorf("packetCount[7] = %d, want 1", fakeNet.packetCount[7])
+	}
+
+	info := s.NICInfo()[2]
+	want := []stack.ProtocolAddress{{fakeNetNumber, "\x02", 8}, {fakeNetNumber, "\x21", 4}}
+	if len(info.Addresses) != 2 || !reflect.DeepEqual(info.Addresses, want) && !reflect.DeepEqual(info.Addresses, []stack.ProtocolAddress{want[1], want[0]}) {
+		t.Errorf("Addresses = %v, want %v", info.Addresses, want)
+	}
+}
+
+func TestMainNICAddress(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
+
+	id, _ := channel.New(10, defaultMTU)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if _, err := s.GetMainNICAddress(1, fakeNetNumber); err != tcpip.ErrNoAddress {
+		t.Errorf("GetMainNICAddress returned %v, want %v", err, tcpip.ErrNoAddress)
+	}
+
+	if _, err := s.GetMainNICAddress(2, fakeNetNumber); err != tcpip.ErrUnknownNICID {
+		t.Errorf("GetMainNICAddress returned %v, want %v", err, tcpip.ErrUnknownNICID)
+	}
+
+	s.SetRouteTable([]tcpip.Route{{"\x00", "\x00", "", 1}})
+
+	for _, addr := range []tcpip.AddressWithPrefix{{"\x01", 8}, {"\x02", 6}, {"\x03", 8}} {
+		if err := s.AddAddressWithPrefix(1, fakeNetNumber, addr); err != nil {
+			t.Fatalf("AddAddressWithPrefix(%v) failed: %v", addr, err)
+		}
+	}
+
+	checkMain := func(want tcpip.AddressWithPrefix) {
+		t.Helper()
+
+		addr, err := s.GetMainNICAddress(1, fakeNetNumber)
+		if err != nil || addr != want {
+			t.Fatalf("GetMainNICAddress = %v, %v, want %v", addr, err, want)
+		}
+
+		r, err := s.FindRoute(0, "", "\x50", fakeNetNumber)
+		if err != nil {
+			t.Fatalf("FindRoute failed: %v", err)
+		}
+		defer r.Release()
+
+		if r.LocalAddress != want.Address {
+			t.Fatalf("route local address = %v, want %v", r.LocalAddress, want.Address)
+		}
+	}
+
+	checkMain(tcpip.AddressWithPrefix{"\x01", 8})
+
+	// Set the order to 3, 2, 1.
+	for _, addr := range []tcpip.Address{"\x02", "\x03"} {
+		if err := s.SetPrimaryAddress(1, addr); err != nil {
+			t.Fatalf("SetPrimaryAddress(%v) failed: %v", addr, err)
+		}
+	}
+	checkMain(tcpip.AddressWithPrefix{"\x03", 8})
+
+	if err := s.RemoveAddress(1, "\x03"); err != nil {
+		t.Fatalf("RemoveAddress failed: %v", err)
+	}
+	checkMain(tcpip.AddressWithPrefix{"\x02", 6})
+
+	if err := s.SetPrimaryAddress(1, "\x03"); err != tcpip.ErrBadLocalAddress {
+		t.Errorf("SetPrimaryAddress of a removed address returned %v, want %v", err, tcpip.ErrBadLocalAddress)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
+
+	var events []stack.Event
+	cancel := s.Subscribe(func(e stack.Event) {
+		events = append(events, e)
+	})
+
+	id, _ := channel.New(10, defaultMTU)
+	if err := s.CreateDisabledNIC(1, id); err != nil {
+		t.Fatalf("CreateDisabledNIC failed: %v", err)
+	}
+
+	if err := s.EnableNIC(1); err != nil {
+		t.Fatalf("EnableNIC failed: %v", err)
+	}
+
+	if err := s.AddAddressWithPrefix(1, fakeNetNumber, tcpip.AddressWithPrefix{"\x01", 4}); err != nil {
+		t.Fatalf("AddAddressWithPrefix failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, fakeNetNumber, "\x02"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	if err := s.SetPrimaryAddress(1, "\x02"); err != nil {
+		t.Fatalf("SetPrimaryAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{{"\x00", "\x00", "", 1}})
+
+	if err := s.RemoveAddress(1, "\x01"); err != nil {
+		t.Fatalf("RemoveAddress failed: %v", err)
+	}
+
+	if err := s.RemoveNIC(1); err != nil {
+		t.Fatalf("RemoveNIC failed: %v", err)
+	}
+
+	// Events aren't reported once cancelled.
+	cancel()
+	s.SetRouteTable(nil)
+
+	want := []stack.Event{
+		{Type: stack.EventNICAdded, NIC: 1},
+		{Type: stack.EventNICEnabled, NIC: 1},
+		{Type: stack.EventAddressAdded, NIC: 1, Address: stack.ProtocolAddress{fakeNetNumber, "\x01", 4}},
+		{Type: stack.EventAddressAdded, NIC: 1, Address: stack.ProtocolAddress{fakeNetNumber, "\x02", 8}},
+		{Type: stack.EventPrimaryAddressChanged, NIC: 1},
+		{Type: stack.EventRouteTableChanged},
+		{Type: stack.EventAddressRemoved, NIC: 1, Address: stack.ProtocolAddress{fakeNetNumber, "\x01", 4}},
+		{Type: stack.EventNICRemoved, NIC: 1},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("got events %+v, want %+v", events, want)
+	}
+}
+
+func TestAddressLifetime(t *testing.T) {
+	clock := faketime.NewManualClock(time.Unix(0, 0))
+	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
+	s.SetClock(clock)
+
+	id, _ := channel.New(10, defaultMTU)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	removed := make(chan stack.Event, 1)
+	cancel := s.Subscribe(func(e stack.Event) {
+		if e.Type == stack.EventAddressRemoved {
+			removed <- e
+		}
+	})
+	defer cancel()
+
+	if err := s.SetAddressLifetime(1, "\x02", time.Minute); err != tcpip.ErrBadLocalAddress {
+		t.Errorf("SetAddressLifetime of an unknown address returned %v, want %v", err, tcpip.ErrBadLocalAddress)
+	}
+	if err := s.SetAddressLifetime(1, "\x01", -time.Minute); err != tcpip.ErrInvalidOptionValue {
+		t.Errorf("SetAddressLifetime with a negative lifetime returned %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+
+	// Setting the lifetime again extends it.
+	if err := s.SetAddressLifetime(1, "\x01", time.Minute); err != nil {
+		t.Fatalf("SetAddressLifetime failed: %v", err)
+	}
+	clock.Advance(50 * time.Second)
+	if err := s.SetAddressLifetime(1, "\x01", time.Minute); err != nil {
+		t.Fatalf("SetAddressLifetime failed: %v", err)
+	}
+	clock.Advance(50 * time.Second)
+	select {
+	case e := <-removed:
+		t.Fatalf("address removed before its lifetime expired: %+v", e)
+	default:
+	}
+
+	clock.Advance(10 * time.Second)
+	select {
+	case e := <-removed:
+		want := stack.Event{Type: stack.EventAddressRemoved, NIC: 1, Address: stack.ProtocolAddress{fakeNetNumber, "\x01", 8}}
+		if e != want {
+			t.Errorf("got event %+v, want %+v", e, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("address not removed once its lifetime expired")
+	}
+	if addrs := s.NICInfo()[1].Addresses; len(addrs) != 0 {
+		t.Errorf("got addresses %v after expiry, want none", addrs)
+	}
+
+	// Addresses whose lifetime is reset to zero are permanent.
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	if err := s.SetAddressLifetime(1, "\x01", time.Minute); err != nil {
+		t.Fatalf("SetAddressLifetime failed: %v", err)
+	}
+	if err := s.SetAddressLifetime(1, "\x01", 0); err != nil {
+		t.Fatalf("SetAddressLifetime failed: %v", err)
+	}
+	clock.Advance(time.Hour)
+	if addrs := s.NICInfo()[1].Addresses; len(addrs) != 1 {
+		t.Errorf("got addresses %v, want the permanent address", addrs)
+	}
+}
+
+func TestNetworkProtocolFactory(t *testing.T) {
+	// Each stack gets its own instance of the protocol, which receives the
+	// packets of that stack only.
+	var protos []*fakeNetworkProtocol
+	newStack := func() (tcpip.Stack, *channel.Endpoint) {
+		s := stack.New([]string{"fakeNetPerStack"}, nil)
+		protos = append(protos, perStackNet[len(perStackNet)-1])
+
+		id, linkEP := channel.New(10, defaultMTU)
+		if err := s.CreateNIC(1, id); err != nil {
+			t.Fatalf("CreateNIC failed: %v", err)
+		}
+
+		if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+			t.Fatalf("AddAddress failed: %v", err)
+		}
+
+		return s, linkEP
+	}
+
+	s1, linkEP := newStack()
+	newStack()
+
+	buf := buffer.NewView(30)
+	buf[0] = 1
+	linkEP.Inject(fakeNetNumber, buf)
+
+	if protos[0] == protos[1] {
+		t.Fatalf("stacks share the same protocol instance")
+	}
+	if protos[0].packetCount[1] != 1 || protos[1].packetCount[1] != 0 {
+		t.Errorf("packetCount[1] = %d, %d, want 1, 0", protos[0].packetCount[1], protos[1].packetCount[1])
+	}
+
+	if err := s1.(*stack.Stack).SetNetworkProtocolOption(fakeNetNumber, 1); err != tcpip.ErrUnknownProtocolOption {
+		t.Errorf("SetNetworkProtocolOption returned %v, want %v", err, tcpip.ErrUnknownProtocolOption)
+	}
+
+	found := false
+	for _, name := range stack.RegisteredNetworkProtocols() {
+		if name == "fakeNetPerStack" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("RegisteredNetworkProtocols returned %v, want it to include fakeNetPerStack", stack.RegisteredNetworkProtocols())
+	}
+}
+
+func TestRemoveNICClosesLinkEndpoint(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
+
+	id, ep := channel.NewClosable(10, defaultMTU)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.RemoveNIC(1); err != nil {
+		t.Fatalf("RemoveNIC failed: %v", err)
+	}
+	if !ep.Closed() {
+		t.Errorf("Link endpoint wasn't closed when its NIC was removed")
+	}
+}
+
+var fakeNet fakeNetworkProtocol
+
+// perStackNet holds the instances of fakeNetPerStack, in creation order.
+var perStackNet []*fakeNetworkProtocol
+
+func init() {
+	stack.RegisterNetworkProtocol("fakeNet", &fakeNet)
+	stack.RegisterNetworkProtocolFactory("fakeNetPerStack", func(*stack.Stack) stack.NetworkProtocol {
+		p := &fakeNetworkProtocol{}
+		perStackNet = append(perStackNet, p)
+		return p
+	})
+}
+
+type logRecord struct {
+	level  stack.LogLevel
+	msg    string
+	fields []interface{}
+}
+
+type recordingLogger struct {
+	records []logRecord
+}
+
+func (l *recordingLogger) Log(level stack.LogLevel, msg string, fields ...interface{}) {
+	l.records = append(l.records, logRecord{level, msg, fields})
+}
+
+func TestLogger(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
+	s.SetMemoryLimit(10)
+	o := s.Owner("tenant")
+
+	// Logging is off by default.
+	if s.LogEnabled(stack.LogError) {
+		t.Fatalf("LogEnabled(%v) = true before SetLogger", stack.LogError)
+	}
+	if s.ReserveMemoryFor(o, 20) {
+		t.Fatalf("ReserveMemoryFor succeeded beyond the limit")
+	}
+
+	var l recordingLogger
+	s.SetLogger(&l, stack.LogDebug)
+	if s.ReserveMemoryFor(o, 20) {
+		t.Fatalf("ReserveMemoryFor succeeded beyond the limit")
+	}
+
+	want := []logRecord{{stack.LogDebug, "memory limit reached", []interface{}{"owner", "tenant", "bytes", 20, "usage", 0}}}
+	if !reflect.DeepEqual(l.records, want) {
+		t.Fatalf("got records %v, want %v", l.records, want)
+	}
+
+	// Records below the level aren't logged.
+	l.records = nil
+	s.SetLogger(&l, stack.LogInfo)
+	s.ReserveMemoryFor(o, 20)
+	s.Log(stack.LogWarning, "warning")
+	if want := []logRecord{{stack.LogWarning, "warning", nil}}; !reflect.DeepEqual(l.records, want) {
+		t.Fatalf("got records %v, want %v", l.records, want)
+	}
+
+	l.records = nil
+	s.SetLogger(nil, stack.LogDebug)
+	s.Log(stack.LogError, "error")
+	if len(l.records) != 0 {
+		t.Fatalf("got records %v after SetLogger(nil)", l.records)
+	}
+}
+
+func TestStdLogger(t *testing.T) {
+	var b bytes.Buffer
+	l := stack.NewStdLogger(log.New(&b, "", 0))
+	l.Log(stack.LogWarning, "duplicate address detected", "nic", tcpip.NICID(1), "addr", tcpip.Address("\x0a\x00\x00\x01"), "extra")
+
+	if got, want := b.String(), "warning: duplicate address detected nic=1 addr=10.0.0.1 extra\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// newUDPLoopbackStack returns a stack with a loopback NIC using the given clock,
+// if not nil, and UDP endpoints receiving on loopbackAddr:1000, with the given
+// waiter queue, and sending from the same address.
+func newUDPLoopbackStack(t *testing.T, clock tcpip.Clock) (s *stack.Stack, rcv, snd tcpip.Endpoint, wq *waiter.Queue) {
+	s = stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+	if clock != nil {
+		s.SetClock(clock)
+	}
+	if err := s.CreateNIC(1, loopback.New()); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, loopbackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00\x00\x00\x00", Mask: "\x00\x00\x00\x00", NIC: 1}})
+
+	wq = &waiter.Queue{}
+	rcv, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := rcv.Bind(tcpip.FullAddress{Addr: loopbackAddr, Port: 1000}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	snd, err = s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+
+	return s, rcv, snd, wq
+}
+
+const loopbackAddr = "\x7f\x00\x00\x01"
+
+func TestTraceHooks(t *testing.T) {
+	s, rcv, snd, _ := newUDPLoopbackStack(t, nil)
+	defer rcv.Close()
+	defer snd.Close()
+	const addr = loopbackAddr
+
+	// Attribute the sender, and another receiver, to owners.
+	if err := snd.SetSockOpt(tcpip.OwnerOption("sender")); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	owned, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer owned.Close()
+	if err := owned.SetSockOpt(tcpip.OwnerOption("receiver")); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	if err := owned.Bind(tcpip.FullAddress{Addr: addr, Port: 1002}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	type trace struct {
+		point   stack.TracePoint
+		verdict stack.TraceVerdict
+		owner   string
+	}
+	var traces []trace
+	remove := s.AddTraceHook(func(p *stack.TracePacket) {
+		if p.NIC != 1 || p.NetProto != ipv4.ProtocolNumber {
+			t.Errorf("got packet on NIC %d with protocol %d at %v", p.NIC, p.NetProto, p.Point)
+		}
+		if p.Point != stack.TraceLinkIn && (p.Src != addr || p.Dst != addr) {
+			t.Errorf("got addresses %v -> %v at %v", p.Src, p.Dst, p.Point)
+		}
+		traces = append(traces, trace{p.Point, p.Verdict, p.Owner})
+	})
+
+	// Send to the bound endpoint, to an unused port, then to the owned
+	// endpoint. The loopback link endpoint delivers packets as they are
+	// written, so they are received before being reported as sent.
+	for _, port := range []uint16{1000, 1001, 1002} {
+		if _, err := snd.Write(buffer.View("hello"), &tcpip.FullAddress{Addr: addr, Port: port}); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	received := []trace{
+		{stack.TraceLinkIn, stack.VerdictAccepted, ""},
+		{stack.TraceNetworkIn, stack.VerdictAccepted, ""},
+	}
+	sent := []trace{
+		{stack.TraceLinkOut, stack.VerdictSent, ""},
+		{stack.TraceTransportOut, stack.VerdictSent, "sender"},
+	}
+	var want []trace
+	want = append(want, received...)
+	want = append(want, trace{stack.TraceTransportIn, stack.VerdictAccepted, ""})
+	want = append(want, sent...)
+	want = append(want, received...)
+	want = append(want, trace{stack.TraceTransportIn, stack.VerdictNoEndpoint, ""})
+	want = append(want, sent...)
+	want = append(want, received...)
+	want = append(want, trace{stack.TraceTransportIn, stack.VerdictAccepted, "receiver"})
+	want = append(want, sent...)
+	if !reflect.DeepEqual(traces, want) {
+		t.Fatalf("got traces %v, want %v", traces, want)
+	}
+
+	remove()
+	traces = nil
+	if _, err := snd.Write(buffer.View("hello"), &tcpip.FullAddress{Addr: addr, Port: 1000}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if len(traces) != 0 {
+		t.Fatalf("got traces %v after removing the hook", traces)
+	}
+}
+
+func TestInjectFault(t *testing.T) {
+	clock := faketime.NewManualClock(time.Unix(0, 0))
+	s, rcv, snd, wq := newUDPLoopbackStack(t, clock)
+	defer rcv.Close()
+	defer snd.Close()
+
+	to := &tcpip.FullAddress{Addr: loopbackAddr, Port: 1000}
+	send := func(data string) {
+		t.Helper()
+		if _, err := snd.Write(buffer.View(data), to); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	received := func() string {
+		v, err := rcv.Read(nil)
+		if err == tcpip.ErrWouldBlock {
+			return ""
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		return string(v)
+	}
+
+	if _, err := s.InjectFault(stack.Fault{Point: stack.TraceNetworkIn}); err != tcpip.ErrNotSupported {
+		t.Fatalf("InjectFault at %v returned %v, want %v", stack.TraceNetworkIn, err, tcpip.ErrNotSupported)
+	}
+
+	// Drop every second datagram.
+	remove, err := s.InjectFault(stack.Fault{
+		Point:  stack.TraceTransportOut,
+		Nth:    2,
+		Repeat: true,
+		Action: stack.FaultDrop,
+	})
+	if err != nil {
+		t.Fatalf("InjectFault failed: %v", err)
+	}
+	for _, data := range []string{"a", "b", "c", "d", "e"} {
+		send(data)
+	}
+	remove()
+
+	var got []string
+	for v := received(); v != ""; v = received() {
+		got = append(got, v)
+	}
+	if want := []string{"a", "c", "e"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got datagrams %v, want %v", got, want)
+	}
+
+	// Corrupt the version of the IPv4 header of the first packet, which
+	// must then be rejected as malformed.
+	remove, err = s.InjectFault(stack.Fault{
+		Point:  stack.TraceLinkIn,
+		Action: stack.FaultCorrupt,
+	})
+	if err != nil {
+		t.Fatalf("InjectFault failed: %v", err)
+	}
+	send("f")
+	send("g")
+	remove()
+
+	if v := received(); v != "g" {
+		t.Fatalf("got datagram %q, want %q", v, "g")
+	}
+	if got := s.Stats().IP.MalformedPacketsReceived; got != 1 {
+		t.Fatalf("got %d malformed packets, want 1", got)
+	}
+
+	// Delay the UDP datagrams received.
+	remove, err = s.InjectFault(stack.Fault{
+		Point:  stack.TraceTransportIn,
+		Filter: func(p *stack.TracePacket) bool { return p.TransProto == udp.ProtocolNumber },
+		Action: stack.FaultDelay,
+		Delay:  time.Second,
+	})
+	if err != nil {
+		t.Fatalf("InjectFault failed: %v", err)
+	}
+	defer remove()
+
+	waitEntry, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&waitEntry, waiter.EventIn)
+	defer wq.EventUnregister(&waitEntry)
+
+	send("h")
+	if v := received(); v != "" {
+		t.Fatalf("got datagram %q before the delay elapsed", v)
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the delayed datagram")
+	}
+	if v := received(); v != "h" {
+		t.Fatalf("got datagram %q, want %q", v, "h")
+	}
+}
+
+func TestConcurrentTransportEndpointRegistration(t *testing.T) {
+	const (
+		addr       = "\x7f\x00\x00\x01"
+		goroutines = 8
+		perG       = 32
+		firstPort  = 2000
+	)
+
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+	if err := s.CreateNIC(1, loopback.New()); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, addr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         1,
+	}})
+
+	// Endpoints are bound to distinct ports from several goroutines, which
+	// register them with the demuxer concurrently.
+	eps := make([]tcpip.Endpoint, goroutines*perG)
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g * perG; i < (g+1)*perG; i++ {
+				ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+				if err != nil {
+					t.Errorf("NewEndpoint failed: %v", err)
+					return
+				}
+				if err := ep.Bind(tcpip.FullAddress{Addr: addr, Port: uint16(firstPort + i)}, nil); err != nil {
+					t.Errorf("Bind failed: %v", err)
+					return
+				}
+				eps[i] = ep
+			}
+		}(g)
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	if got, want := len(s.TransportEndpoints()), len(eps); got != want {
+		t.Fatalf("TransportEndpoints returned %d endpoints, want %d", got, want)
+	}
+
+	snd, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer snd.Close()
+
+	for i, ep := range eps {
+		to := tcpip.FullAddress{NIC: 1, Addr: addr, Port: uint16(firstPort + i)}
+		if _, err := snd.Write(buffer.View{byte(i)}, &to); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		v, err := ep.Read(nil)
+		if err != nil {
+			t.Fatalf("Read from endpoint %d failed: %v", i, err)
+		}
+		if len(v) != 1 || v[0] != byte(i) {
+			t.Fatalf("endpoint %d read %v, want %v", i, v, []byte{byte(i)})
+		}
+	}
+
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for _, ep := range eps[g*perG : (g+1)*perG] {
+				ep.Close()
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// Only the sender is left.
+	if got := len(s.TransportEndpoints()); got != 1 {
+		t.Fatalf("TransportEndpoints returned %d endpoints, want 1", got)
+	}
+}
+
+// udpPacket builds an IPv4 packet carrying a UDP datagram with the given
+// payload, without a UDP checksum.
+func udpPacket(src, dst tcpip.Address, srcPort, dstPort uint16, payload []byte) buffer.View {
+	v := buffer.NewView(header.IPv4MinimumSize + header.UDPMinimumSize + len(payload))
+	copy(v[header.IPv4MinimumSize+header.UDPMinimumSize:], payload)
+
+	ip := header.IPv4(v)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(v)),
+		TTL:         64,
+		Protocol:    uint8(udp.ProtocolNumber),
+		SrcAddr:     src,
+		DstAddr:     dst,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	header.UDP(v[header.IPv4MinimumSize:]).Encode(&header.UDPFields{
+		SrcPort: srcPort,
+		DstPort: dstPort,
+		Length:  uint16(header.UDPMinimumSize + len(payload)),
+	})
+	return v
+}
+
+func TestNICWorkers(t *testing.T) {
+	const (
+		localAddr  = "\x0a\x00\x00\x01"
+		remoteAddr = "\x0a\x00\x00\x02"
+		flows      = 8
+		packets    = 20
+	)
+
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+	id, linkEP := channel.New(0, defaultMTU)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.SetNICWorkers(1, 4, 16); err != tcpip.ErrInvalidEndpointState {
+		t.Errorf("SetNICWorkers on an enabled NIC returned %v, want %v", err, tcpip.ErrInvalidEndpointState)
+	}
+
+	if err := s.CreateDisabledNIC(2, id); err != nil {
+		t.Fatalf("CreateDisabledNIC failed: %v", err)
+	}
+	if err := s.RemoveNIC(1); err != nil {
+		t.Fatalf("RemoveNIC failed: %v", err)
+	}
+	if err := s.SetNICWorkers(2, 0, 16); err != tcpip.ErrInvalidOptionValue {
+		t.Errorf("SetNICWorkers with no workers returned %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+	if err := s.SetNICWorkers(2, 4, 16); err != nil {
+		t.Fatalf("SetNICWorkers failed: %v", err)
+	}
+	if err := s.EnableNIC(2); err != nil {
+		t.Fatalf("EnableNIC failed: %v", err)
+	}
+	if err := s.AddAddress(2, ipv4.ProtocolNumber, localAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Addr: localAddr, Port: 1000}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventIn)
+	defer wq.EventUnregister(&we)
+
+	// The datagrams of each flow are received in order, whichever worker
+	// processed them.
+	for i := 0; i < packets; i++ {
+		for f := 0; f < flows; f++ {
+			linkEP.Inject(ipv4.ProtocolNumber, udpPacket(remoteAddr, localAddr, uint16(2000+f), 1000, []byte{byte(i)}))
+		}
+	}
+	next := make(map[uint16]byte)
+	for n := 0; n < flows*packets; {
+		var from tcpip.FullAddress
+		v, err := ep.Read(&from)
+		if err == tcpip.ErrWouldBlock {
+			select {
+			case <-ch:
+				continue
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out after %d datagrams, want %d", n, flows*packets)
+			}
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if len(v) != 1 || v[0] != next[from.Port] {
+			t.Fatalf("got datagram %v of flow %d, want %d", v, from.Port, next[from.Port])
+		}
+		next[from.Port]++
+		n++
+	}
+
+	// Removing the NIC stops the workers.
+	s.Close()
+	s.Wait()
+}
+
+func TestProfiling(t *testing.T) {
+	id, linkEP := channel.New(10, defaultMTU)
+	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	// Labels are only computed once profiling is enabled.
+	for _, enabled := range []bool{false, true} {
+		s.SetProfiling(enabled)
+		if got := s.Profiling(); got != enabled {
+			t.Fatalf("Profiling() = %v, want %v", got, enabled)
+		}
+
+		labelled := false
+		done := make(chan struct{})
+		s.GoWithLabels(func() []string {
+			labelled = true
+			return []string{stack.ProfileLabelProtocol, "fake"}
+		}, func() {
+			close(done)
+		})
+		<-done
+		if labelled != enabled {
+			t.Errorf("labels computed = %v with profiling enabled = %v", labelled, enabled)
+		}
+	}
+
+	// Packets are still delivered with profiling enabled.
+	before := fakeNet.packetCount[1]
+	buf := buffer.NewView(30)
+	buf[0] = 1
+	linkEP.Inject(fakeNetNumber, buf)
+	if got, want := fakeNet.packetCount[1], before+1; got != want {
+		t.Errorf("packetCount[1] = %d, want %d", got, want)
+	}
+
+	for _, test := range []struct {
+		id   stack.TransportEndpointID
+		want string
+	}{
+		{stack.TransportEndpointID{LocalAddress: "\x0a\x00\x00\x01", LocalPort: 80}, "10.0.0.1:80"},
+		{stack.TransportEndpointID{LocalAddress: "\x0a\x00\x00\x01", LocalPort: 80, RemoteAddress: "\x0a\x00\x00\x02", RemotePort: 4096}, "10.0.0.1:80->10.0.0.2:4096"},
+	} {
+		if got := stack.FlowLabel(test.id); got != test.want {
+			t.Errorf("FlowLabel(%+v) = %q, want %q", test.id, got, test.want)
+		}
+	}
+}
+
+func TestLinkStateSubscription(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
+	id, linkEP := channel.New(10, defaultMTU)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	type change struct {
+		nicID tcpip.NICID
+		up    bool
+	}
+	var changes []change
+	cancel := s.SubscribeLinkState(func(nicID tcpip.NICID, up bool) {
+		changes = append(changes, change{nicID, up})
+	})
+
+	// Reports that don't change the state aren't passed on.
+	linkEP.SetLinkUp(true)
+	linkEP.SetLinkUp(false)
+	linkEP.SetLinkUp(false)
+	if up, err := s.IsLinkUp(1); err != nil || up {
+		t.Errorf("IsLinkUp = %t, %v, want false, nil", up, err)
+	}
+	linkEP.SetLinkUp(true)
+	if up, err := s.IsLinkUp(1); err != nil || !up {
+		t.Errorf("IsLinkUp = %t, %v, want true, nil", up, err)
+	}
+
+	cancel()
+	linkEP.SetLinkUp(false)
+
+	if want := []change{{1, false}, {1, true}}; !reflect.DeepEqual(changes, want) {
+		t.Errorf("Got changes %v, want %v", changes, want)
+	}
+}
+
+func TestFindRouteSkipsLinkDown(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
+	var linkEPs [2]*channel.Endpoint
+	for i := range linkEPs {
+		var id tcpip.LinkEndpointID
+		id, linkEPs[i] = channel.New(10, defaultMTU)
+		nicID := tcpip.NICID(i + 1)
+		if err := s.CreateNIC(nicID, id); err != nil {
+			t.Fatalf("CreateNIC failed: %v", err)
+		}
+		if err := s.AddAddress(nicID, fakeNetNumber, tcpip.Address([]byte{byte(nicID)})); err != nil {
+			t.Fatalf("AddAddress failed: %v", err)
+		}
+	}
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: "\x00", Mask: "\x00", NIC: 1},
+		{Destination: "\x00", Mask: "\x00", NIC: 2},
+	})
+
+	for _, test := range []struct {
+		up      [2]bool
+		wantNIC tcpip.NICID
+		wantErr error
+	}{
+		{[2]bool{true, true}, 1, nil},
+		{[2]bool{false, true}, 2, nil},
+		{[2]bool{false, false}, 0, tcpip.ErrNoRoute},
+		{[2]bool{true, false}, 1, nil},
+	} {
+		for i, up := range test.up {
+			linkEPs[i].SetLinkUp(up)
+		}
+
+		r, err := s.FindRoute(0, "", "\x10", fakeNetNumber)
+		if err != test.wantErr {
+			t.Errorf("Links up %v: FindRoute returned %v, want %v", test.up, err, test.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := r.NICID(); got != test.wantNIC {
+			t.Errorf("Links up %v: got route through NIC %d, want %d", test.up, got, test.wantNIC)
+		}
+		r.Release()
+	}
+}
+
+func TestRouteWritePacketLinkDown(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil).(*stack.Stack)
+	id, linkEP := channel.New(10, defaultMTU)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00", Mask: "\x00", NIC: 1}})
+
+	r, err := s.FindRoute(0, "", "\x10", fakeNetNumber)
+	if err != nil {
+		t.Fatalf("FindRoute failed: %v", err)
+	}
+	defer r.Release()
+
+	write := func() error {
+		hdr := buffer.NewPrependable(int(r.MaxHeaderLength()))
+		return r.WritePacket(&hdr, buffer.View("data").ToVectorisedView(), fakeTransNumber)
+	}
+
+	// Routes found before the link went down fail to write.
+	linkEP.SetLinkUp(false)
+	if err := write(); err != tcpip.ErrLinkDown {
+		t.Errorf("WritePacket with the link down returned %v, want %v", err, tcpip.ErrLinkDown)
+	}
+	if n := linkEP.Drain(); n != 0 {
+		t.Errorf("Got %d packets written with the link down, want 0", n)
+	}
+
+	linkEP.SetLinkUp(true)
+	if err := write(); err != nil {
+		t.Errorf("WritePacket with the link back up failed: %v", err)
+	}
+	if n := linkEP.Drain(); n != 1 {
+		t.Errorf("Got %d packets written with the link back up, want 1", n)
+	}
 }
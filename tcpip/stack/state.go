@@ -0,0 +1,262 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/waiter"
+)
+
+// State is a snapshot of the state of a stack, as returned by Stack.SaveState.
+// All its fields are exported and made of plain data, so it can be serialized
+// with encoding/gob, e.g., to checkpoint an application that embeds the stack
+// and restore it in another process.
+type State struct {
+	// NICs holds the state of the NICs of the stack, in increasing id
+	// order.
+	NICs []NICState
+
+	// Routes is the route table of the stack.
+	Routes []tcpip.Route
+
+	// MemoryLimit is the limit set with Stack.SetMemoryLimit.
+	MemoryLimit int
+
+	// DefaultTTL is the TTL set with Stack.SetDefaultTTL.
+	DefaultTTL uint8
+
+	// FirstEphemeral and LastEphemeral are the range of ephemeral ports
+	// of the stack.
+	FirstEphemeral uint16
+	LastEphemeral  uint16
+
+	// Endpoints holds the state of the transport endpoints passed to
+	// Stack.SaveState, in the same order.
+	Endpoints []SavedEndpoint
+}
+
+// NICState is the saved state of a NIC.
+type NICState struct {
+	ID tcpip.NICID
+
+	// LinkEndpoint is the id of the link endpoint of the NIC. Link
+	// endpoints can't be saved, so when restoring a stack in another
+	// process, it must be replaced with the id of an equivalent endpoint
+	// before calling Stack.RestoreState.
+	LinkEndpoint tcpip.LinkEndpointID
+
+	Enabled     bool
+	Promiscuous bool
+	Spoofing    bool
+	GRO         bool
+	Config      NICConfig
+
+	// MTU is the MTU set with Stack.SetNICMTU, or zero if it wasn't
+	// overridden.
+	MTU uint32
+
+	// Addresses holds the addresses of the NIC, in the order they were
+	// added.
+	Addresses []ProtocolAddress
+}
+
+// SavedEndpoint is the saved state of a transport endpoint.
+type SavedEndpoint struct {
+	// Protocol is the transport protocol of the endpoint, which is used to
+	// restore it.
+	Protocol tcpip.TransportProtocolNumber
+
+	// Data is the protocol-specific state of the endpoint.
+	Data []byte
+}
+
+// save returns the state of n.
+func (n *NIC) save() NICState {
+	st := NICState{
+		ID:           n.id,
+		LinkEndpoint: n.linkEPID,
+		MTU:          atomic.LoadUint32(&n.sender.mtu),
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	st.Enabled = n.enabled
+	st.Promiscuous = n.promiscuous
+	st.Spoofing = n.spoofing
+	st.GRO = n.gro
+	st.Config = n.config
+
+	// The primary lists hold the addresses in the order they were added,
+	// which determines the address picked by routes that don't specify
+	// one.
+	for protocol, l := range n.primary {
+		for e := l.Front(); e != nil; e = e.Next() {
+			r := e.(*referencedNetworkEndpoint)
+			if r.holdsInsertRef {
+				st.Addresses = append(st.Addresses, ProtocolAddress{protocol, r.ep.ID().LocalAddress, r.prefixLen})
+			}
+		}
+	}
+
+	return st
+}
+
+// SaveState returns a snapshot of the configuration of s, that is, its NICs,
+// addresses, and route table, and of the state of the given transport
+// endpoints, which must implement SaveableEndpoint.
+//
+// The endpoints keep running while they are saved, so applications should
+// stop using them, and ideally stop the link endpoints, before saving the
+// stack to get a consistent snapshot. Endpoints that aren't passed in aren't
+// saved.
+func (s *Stack) SaveState(eps []tcpip.Endpoint) (*State, error) {
+	st := &State{
+		MemoryLimit: int(atomic.LoadInt64(&s.memLimit)),
+		DefaultTTL:  s.DefaultTTL(),
+	}
+	st.FirstEphemeral, st.LastEphemeral = s.EphemeralPortRange()
+
+	s.mu.RLock()
+	for _, nic := range s.nics {
+		st.NICs = append(st.NICs, nic.save())
+	}
+	st.Routes = append([]tcpip.Route(nil), s.routeTable...)
+	s.mu.RUnlock()
+
+	// Sort the NICs by id so that they're restored in a deterministic
+	// order.
+	sort.Slice(st.NICs, func(i, j int) bool {
+		return st.NICs[i].ID < st.NICs[j].ID
+	})
+
+	for _, ep := range eps {
+		sep, ok := ep.(SaveableEndpoint)
+		if !ok {
+			return nil, tcpip.ErrNotSupported
+		}
+
+		saved, err := sep.SaveState()
+		if err != nil {
+			return nil, err
+		}
+
+		st.Endpoints = append(st.Endpoints, saved)
+	}
+
+	return st, nil
+}
+
+// RestoreState reconstructs the stack and endpoints saved in st into s, which
+// must be a fresh stack with the same protocols as the saved one. The restored
+// endpoints are returned in the same order as st.Endpoints, and use the
+// waiter queue at the same position of waiterQueues to notify their readiness.
+//
+// If an error is returned, s may be partially restored and should be closed.
+func (s *Stack) RestoreState(st *State, waiterQueues []*waiter.Queue) ([]tcpip.Endpoint, error) {
+	if len(waiterQueues) != len(st.Endpoints) {
+		return nil, tcpip.ErrInvalidEndpointState
+	}
+
+	s.SetMemoryLimit(st.MemoryLimit)
+	s.SetDefaultTTL(st.DefaultTTL)
+	if st.FirstEphemeral != 0 {
+		if err := s.SetEphemeralPortRange(st.FirstEphemeral, st.LastEphemeral); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range st.NICs {
+		if err := s.restoreNIC(&st.NICs[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	s.SetRouteTable(append([]tcpip.Route(nil), st.Routes...))
+
+	eps := make([]tcpip.Endpoint, 0, len(st.Endpoints))
+	for i, saved := range st.Endpoints {
+		ep, err := s.RestoreEndpoint(saved, waiterQueues[i])
+		if err != nil {
+			return nil, err
+		}
+
+		eps = append(eps, ep)
+	}
+
+	return eps, nil
+}
+
+// DetachEndpoint detaches ep, which must implement DetachableEndpoint, from s,
+// and returns its state, so that it can be restored by RestoreEndpoint in
+// another stack, e.g., one embedded by the next version of a program, with the
+// same addresses. The peers of the endpoint don't notice the handoff, as long
+// as the endpoint is restored before they time out.
+//
+// Packets received for the endpoint once it is detached are dropped, or
+// answered with resets once it is unregistered, so the link endpoint of s
+// should be stopped before detaching endpoints.
+func (s *Stack) DetachEndpoint(ep tcpip.Endpoint) (SavedEndpoint, error) {
+	dep, ok := ep.(DetachableEndpoint)
+	if !ok {
+		return SavedEndpoint{}, tcpip.ErrNotSupported
+	}
+	return dep.Detach()
+}
+
+// RestoreEndpoint recreates the endpoint saved or detached from another stack
+// in s, which must have the addresses and routes the endpoint uses, and
+// registers it so that it starts handling the packets of its peers. The
+// endpoint uses waiterQueue to notify its readiness.
+func (s *Stack) RestoreEndpoint(saved SavedEndpoint, waiterQueue *waiter.Queue) (tcpip.Endpoint, error) {
+	t, ok := s.transportProtocols[saved.Protocol]
+	if !ok {
+		return nil, tcpip.ErrUnknownProtocol
+	}
+
+	rp, ok := t.proto.(RestorableTransportProtocol)
+	if !ok {
+		return nil, tcpip.ErrNotSupported
+	}
+
+	return rp.RestoreEndpoint(s, saved, waiterQueue)
+}
+
+// restoreNIC creates a NIC from its saved state.
+func (s *Stack) restoreNIC(st *NICState) error {
+	// The NIC is only enabled once its addresses have been added back, so
+	// that packets received in between aren't dropped for lack of a
+	// matching endpoint.
+	if err := s.createNIC(st.ID, st.LinkEndpoint, false); err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	nic := s.nics[st.ID]
+	s.mu.RUnlock()
+
+	for _, a := range st.Addresses {
+		if err := nic.AddAddressWithPrefix(a.Protocol, tcpip.AddressWithPrefix{a.Address, a.PrefixLen}); err != nil {
+			return err
+		}
+	}
+
+	nic.setPromiscuousMode(st.Promiscuous)
+	nic.setSpoofing(st.Spoofing)
+	nic.setGRO(st.GRO)
+	nic.setConfig(st.Config)
+	if err := nic.setMTU(st.MTU); err != nil {
+		return err
+	}
+
+	if st.Enabled {
+		nic.attachLinkEndpoint()
+	}
+
+	return nil
+}
@@ -0,0 +1,282 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+)
+
+// TracePoint is a point of the path of packets through a stack where they are
+// reported to trace hooks.
+type TracePoint int
+
+// The following are the points where packets are traced.
+const (
+	// TraceLinkIn is where link endpoints deliver packets to NICs.
+	TraceLinkIn TracePoint = iota
+
+	// TraceNetworkIn is where NICs dispatch received packets to network
+	// endpoints, or forward them.
+	TraceNetworkIn
+
+	// TraceTransportIn is where network endpoints dispatch received
+	// packets to transport endpoints.
+	TraceTransportIn
+
+	// TraceTransportOut is where transport endpoints write packets to
+	// routes.
+	TraceTransportOut
+
+	// TraceLinkOut is where network endpoints, or forwarding NICs, write
+	// packets to link endpoints.
+	TraceLinkOut
+)
+
+// String implements fmt.Stringer.String.
+func (p TracePoint) String() string {
+	switch p {
+	case TraceLinkIn:
+		return "link-in"
+	case TraceNetworkIn:
+		return "network-in"
+	case TraceTransportIn:
+		return "transport-in"
+	case TraceTransportOut:
+		return "transport-out"
+	case TraceLinkOut:
+		return "link-out"
+	default:
+		return "unknown"
+	}
+}
+
+// TraceVerdict is the outcome of the handling of a packet at a trace point.
+type TraceVerdict int
+
+// The following are the verdicts reported to trace hooks.
+const (
+	// VerdictAccepted indicates that the packet was handed to the next
+	// layer, or, at TraceTransportIn, to a transport endpoint or handler.
+	VerdictAccepted TraceVerdict = iota
+
+	// VerdictForwarded indicates that a NIC with forwarding enabled
+	// forwarded the packet, or dropped it if it couldn't be routed.
+	VerdictForwarded
+
+	// VerdictUnknownProtocol indicates that the packet was dropped because
+	// its protocol isn't supported by the stack.
+	VerdictUnknownProtocol
+
+	// VerdictMalformed indicates that the packet was dropped because it
+	// is too short or its header is invalid.
+	VerdictMalformed
+
+	// VerdictNoEndpoint indicates that no endpoint matched the destination
+	// of the packet. At TraceTransportIn, the packet is then handled by
+	// the protocol, e.g., with a TCP reset.
+	VerdictNoEndpoint
+
+	// VerdictSent indicates that the packet was written successfully.
+	VerdictSent
+
+	// VerdictError indicates that the packet couldn't be written.
+	// TracePacket.Err holds the error.
+	VerdictError
+)
+
+// String implements fmt.Stringer.String.
+func (v TraceVerdict) String() string {
+	switch v {
+	case VerdictAccepted:
+		return "accepted"
+	case VerdictForwarded:
+		return "forwarded"
+	case VerdictUnknownProtocol:
+		return "unknown-protocol"
+	case VerdictMalformed:
+		return "malformed"
+	case VerdictNoEndpoint:
+		return "no-endpoint"
+	case VerdictSent:
+		return "sent"
+	case VerdictError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// TracePacket describes a packet reported to trace hooks.
+type TracePacket struct {
+	// Point is where the packet was traced.
+	Point TracePoint
+
+	// Time is the time, according to the stack's clock, at which the
+	// packet reached the trace point.
+	Time time.Time
+
+	// NIC is the NIC the packet was received or sent through.
+	NIC tcpip.NICID
+
+	// NetProto is the network protocol of the packet.
+	NetProto tcpip.NetworkProtocolNumber
+
+	// TransProto is the transport protocol of the packet. It is only set
+	// at TraceTransportIn and TraceTransportOut.
+	TransProto tcpip.TransportProtocolNumber
+
+	// Owner is the name of the owner of the transport endpoint the packet
+	// was delivered to, at TraceTransportIn, or sent by, at
+	// TraceTransportOut, if the endpoint is attributed to one.
+	Owner string
+
+	// Src and Dst are the network addresses of the packet. They are not
+	// set at TraceLinkIn, nor at TraceNetworkIn for packets of unknown
+	// protocols or malformed ones.
+	Src tcpip.Address
+	Dst tcpip.Address
+
+	// Header holds the headers that were prepended to outbound packets
+	// when they were traced, and Data the rest of the packet. Received
+	// packets are entirely in Data. The bytes must not be modified, nor
+	// retained after the hook returns.
+	Header buffer.View
+	Data   buffer.View
+
+	// Verdict is the outcome of the handling of the packet at the trace
+	// point, and Err the error of packets that couldn't be written.
+	Verdict TraceVerdict
+	Err     error
+}
+
+// AddTraceHook adds a hook that is called synchronously for every packet that
+// goes through one of the trace points of the stack, e.g., to build tcpdump-like
+// tools or measure latencies. Hooks are called from the goroutines of link
+// endpoints and protocols, so they must be fast and must not block; they must
+// not retain the TracePacket. Calling the returned function removes the hook.
+//
+// Inbound packets are reported to the TraceTransportIn hooks once they have
+// been handled, and outbound packets once they have been written, so the hooks
+// aren't called in the order of the packets through the layers; TracePacket.Time
+// holds the time at which each packet reached each point.
+func (s *Stack) AddTraceHook(h func(*TracePacket)) (remove func()) {
+	s.traceMu.Lock()
+	id := s.nextTraceID
+	s.nextTraceID++
+	s.traceHooks[id] = h
+	s.updateTraceHooksLocked()
+	s.traceMu.Unlock()
+
+	return func() {
+		s.traceMu.Lock()
+		delete(s.traceHooks, id)
+		s.updateTraceHooksLocked()
+		s.traceMu.Unlock()
+	}
+}
+
+// updateTraceHooksLocked publishes the current trace hooks, so that they can be
+// read without locking by trace.
+func (s *Stack) updateTraceHooksLocked() {
+	hooks := make([]func(*TracePacket), 0, len(s.traceHooks))
+	for _, h := range s.traceHooks {
+		hooks = append(hooks, h)
+	}
+	s.traceSnapshot.Store(hooks)
+}
+
+// tracing returns whether any trace hooks are set. Callers should check it
+// before building TracePackets.
+func (s *Stack) tracing() bool {
+	hooks, _ := s.traceSnapshot.Load().([]func(*TracePacket))
+	return len(hooks) != 0
+}
+
+// trace reports p to the trace hooks of s.
+func (s *Stack) trace(p *TracePacket) {
+	hooks, _ := s.traceSnapshot.Load().([]func(*TracePacket))
+	for _, h := range hooks {
+		h(p)
+	}
+}
+
+// packetTrace builds the TracePacket of a packet at a trace point. Its zero
+// value, used when no hooks are set, reports nothing.
+type packetTrace struct {
+	s *Stack
+	p TracePacket
+}
+
+// startTrace starts tracing a packet at the given point, recording the time
+// at which it reached it.
+func (s *Stack) startTrace(point TracePoint, nicID tcpip.NICID, netProto tcpip.NetworkProtocolNumber, hdr buffer.View, data buffer.VectorisedView) packetTrace {
+	if !s.tracing() {
+		return packetTrace{}
+	}
+
+	return packetTrace{
+		s: s,
+		p: TracePacket{
+			Point:    point,
+			Time:     s.clock.Now(),
+			NIC:      nicID,
+			NetProto: netProto,
+			Header:   hdr,
+			Data:     data.ToView(),
+		},
+	}
+}
+
+// setAddresses sets the network addresses of the traced packet.
+func (t *packetTrace) setAddresses(src, dst tcpip.Address) {
+	if t.s != nil {
+		t.p.Src = src
+		t.p.Dst = dst
+	}
+}
+
+// setOwner sets the owner of the transport endpoint that packets with the
+// given id are delivered to, on the given NIC, as the owner of the traced
+// packet. The endpoint is only looked up if the packet is being traced.
+func (t *packetTrace) setOwner(nic *NIC, protocol tcpip.TransportProtocolNumber, id TransportEndpointID) {
+	if t.s == nil {
+		return
+	}
+
+	ep := nic.demux.findEndpoint(protocol, id)
+	if ep == nil {
+		ep = t.s.demux.findEndpoint(protocol, id)
+	}
+	if o, ok := ep.(OwnedEndpoint); ok {
+		t.p.Owner = o.Owner().Name()
+	}
+}
+
+// done reports the traced packet with the given verdict.
+func (t *packetTrace) done(verdict TraceVerdict) {
+	if t.s != nil {
+		// Report a copy, so that t doesn't escape to the heap on the
+		// paths where no hooks are set.
+		p := t.p
+		p.Verdict = verdict
+		t.s.trace(&p)
+	}
+}
+
+// sent reports the traced outbound packet, which was written with the given
+// result.
+func (t *packetTrace) sent(err error) {
+	if t.s != nil {
+		t.p.Err = err
+		if err != nil {
+			t.done(VerdictError)
+		} else {
+			t.done(VerdictSent)
+		}
+	}
+}
@@ -5,33 +5,100 @@
 package stack
 
 import (
+	"crypto/rand"
+	"encoding/binary"
 	"sync"
 
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip"
 )
 
-// transportEndpoints manages all endpoints of a given protocol. It has its own
-// mutex so as to reduce interference between protocols.
+// numEndpointShards is the number of shards the endpoints of each protocol are
+// split into.
+const numEndpointShards = 16
+
+// transportEndpoints manages all endpoints of a given protocol. They are sharded
+// by a hash of their ids, and each shard has its own mutex, so that registering
+// and unregistering endpoints and delivering packets to them rarely contend on
+// many-core machines, whether the endpoints are of the same protocol or not.
+//
+// Endpoints are indexed by the full id they're registered with, where unset
+// fields act as wildcards, so finding the endpoint of a packet takes at most
+// four hash lookups regardless of the number of endpoints (see deliverPacket).
 type transportEndpoints struct {
+	// seed is the key of the hash that distributes endpoints among the
+	// shards.
+	seed   uint32
+	shards [numEndpointShards]endpointsShard
+}
+
+// endpointsShard holds the endpoints of a protocol whose ids hash to it.
+type endpointsShard struct {
 	mu        sync.RWMutex
 	endpoints map[TransportEndpointID]TransportEndpoint
 }
 
+func newTransportEndpoints(seed uint32) *transportEndpoints {
+	eps := &transportEndpoints{seed: seed}
+	for i := range eps.shards {
+		eps.shards[i].endpoints = make(map[TransportEndpointID]TransportEndpoint)
+	}
+	return eps
+}
+
+// fnv1aString continues the FNV-1a hash h with the bytes of s.
+func fnv1aString(h uint32, s string) uint32 {
+	for i := 0; i < len(s); i++ {
+		h = (h ^ uint32(s[i])) * 16777619
+	}
+	return h
+}
+
+// fnv1aPort continues the FNV-1a hash h with the bytes of port.
+func fnv1aPort(h uint32, port uint16) uint32 {
+	h = (h ^ uint32(port>>8)) * 16777619
+	return (h ^ uint32(port&0xff)) * 16777619
+}
+
+// shardIndex returns the index of the shard holding the endpoint registered
+// with id, if any.
+func (eps *transportEndpoints) shardIndex(id TransportEndpointID) int {
+	// This is FNV-1a, keyed by the seed.
+	h := uint32(2166136261) ^ eps.seed
+	h = fnv1aString(h, string(id.LocalAddress))
+	h = fnv1aPort(h, id.LocalPort)
+	h = fnv1aString(h, string(id.RemoteAddress))
+	h = fnv1aPort(h, id.RemotePort)
+	return int(h % numEndpointShards)
+}
+
+// shard returns the shard holding the endpoint registered with id, if any.
+func (eps *transportEndpoints) shard(id TransportEndpointID) *endpointsShard {
+	return &eps.shards[eps.shardIndex(id)]
+}
+
 // transportDemuxer demultiplexes packets targeted at a transport endpoint
 // (i.e., after they've been parsed by the network layer). It does two levels
 // of demultiplexing: first based on the transport protocol, then based on
 // endpoints IDs.
 type transportDemuxer struct {
 	protocol map[tcpip.TransportProtocolNumber]*transportEndpoints
+
+	// seed is the key of the hash that distributes packets among the
+	// endpoints of reuse port groups.
+	seed uint32
 }
 
 func newTransportDemuxer(stack *Stack) *transportDemuxer {
 	d := &transportDemuxer{protocol: make(map[tcpip.TransportProtocolNumber]*transportEndpoints)}
 
+	var b [4]byte
+	rand.Read(b[:])
+	d.seed = binary.LittleEndian.Uint32(b[:])
+
 	// Add each transport to the demuxer.
 	for proto := range stack.transportProtocols {
-		d.protocol[proto] = &transportEndpoints{endpoints: make(map[TransportEndpointID]TransportEndpoint)}
+		d.protocol[proto] = newTransportEndpoints(d.seed)
 	}
 
 	return d
@@ -45,14 +112,15 @@ func (d *transportDemuxer) registerEndpoint(protocol tcpip.TransportProtocolNumb
 		return tcpip.ErrUnknownProtocol
 	}
 
-	eps.mu.Lock()
-	defer eps.mu.Unlock()
+	sh := eps.shard(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	if _, ok := eps.endpoints[id]; ok {
+	if _, ok := sh.endpoints[id]; ok {
 		return tcpip.ErrDuplicateAddress
 	}
 
-	eps.endpoints[id] = ep
+	sh.endpoints[id] = ep
 
 	return nil
 }
@@ -65,26 +133,170 @@ func (d *transportDemuxer) unregisterEndpoint(protocol tcpip.TransportProtocolNu
 		return
 	}
 
-	eps.mu.Lock()
-	defer eps.mu.Unlock()
+	sh := eps.shard(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	delete(sh.endpoints, id)
+}
+
+// reusePortGroup holds the endpoints registered with the same id with
+// registerReusePortEndpoint. It's stored in the endpoints map of their protocol,
+// in place of an endpoint, and distributes the packets among them.
+type reusePortGroup struct {
+	seed uint32
+
+	// eps is only modified with the mutex of the shard holding the group
+	// held for writing.
+	eps []TransportEndpoint
+}
+
+// HandlePacket implements TransportEndpoint.HandlePacket. The packet is handled
+// by an endpoint picked by a hash of its source address and port, so that all
+// the packets of a flow go to the same endpoint.
+func (g *reusePortGroup) HandlePacket(r *Route, id TransportEndpointID, vv buffer.VectorisedView) {
+	g.pick(id).HandlePacket(r, id, vv)
+}
+
+// pick returns the endpoint of the group that handles the packets with the
+// given id.
+func (g *reusePortGroup) pick(id TransportEndpointID) TransportEndpoint {
+	// This is FNV-1a, keyed by the seed.
+	h := uint32(2166136261) ^ g.seed
+	h = fnv1aString(h, string(id.RemoteAddress))
+	h = fnv1aPort(h, id.RemotePort)
+
+	return g.eps[h%uint32(len(g.eps))]
+}
+
+// registerReusePortEndpoint adds ep to the reuse port group registered with the
+// given id, creating it if needed. It fails if the id is registered by an
+// endpoint outside of a group.
+func (d *transportDemuxer) registerReusePortEndpoint(protocol tcpip.TransportProtocolNumber, id TransportEndpointID, ep TransportEndpoint) error {
+	eps, ok := d.protocol[protocol]
+	if !ok {
+		return tcpip.ErrUnknownProtocol
+	}
+
+	sh := eps.shard(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	delete(eps.endpoints, id)
+	if e, ok := sh.endpoints[id]; !ok {
+		sh.endpoints[id] = &reusePortGroup{seed: d.seed, eps: []TransportEndpoint{ep}}
+	} else if g, ok := e.(*reusePortGroup); ok {
+		g.eps = append(g.eps, ep)
+	} else {
+		return tcpip.ErrDuplicateAddress
+	}
+
+	return nil
+}
+
+// unregisterReusePortEndpoint removes ep from the reuse port group registered
+// with the given id, which is unregistered once empty.
+func (d *transportDemuxer) unregisterReusePortEndpoint(protocol tcpip.TransportProtocolNumber, id TransportEndpointID, ep TransportEndpoint) {
+	eps, ok := d.protocol[protocol]
+	if !ok {
+		return
+	}
+
+	sh := eps.shard(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	g, ok := sh.endpoints[id].(*reusePortGroup)
+	if !ok {
+		return
+	}
+
+	for i, e := range g.eps {
+		if e == ep {
+			// The slice is copied, as the order of the endpoints
+			// must be kept for the flows to keep going to the
+			// same endpoints as much as possible.
+			g.eps = append(g.eps[:i:i], g.eps[i+1:]...)
+			break
+		}
+	}
+
+	if len(g.eps) == 0 {
+		delete(sh.endpoints, id)
+	}
+}
+
+// appendEndpoints appends all registered endpoints of all protocols to eps and
+// returns the result.
+func (d *transportDemuxer) appendEndpoints(eps []TransportEndpoint) []TransportEndpoint {
+	for _, p := range d.protocol {
+		for i := range p.shards {
+			sh := &p.shards[i]
+			sh.mu.RLock()
+			for _, ep := range sh.endpoints {
+				if g, ok := ep.(*reusePortGroup); ok {
+					eps = append(eps, g.eps...)
+					continue
+				}
+				eps = append(eps, ep)
+			}
+			sh.mu.RUnlock()
+		}
+	}
+
+	return eps
+}
+
+// registeredEndpoint is a transport endpoint along with the protocol and id it
+// is registered with.
+type registeredEndpoint struct {
+	protocol tcpip.TransportProtocolNumber
+	id       TransportEndpointID
+	ep       TransportEndpoint
+}
+
+// appendRegistered appends all registered endpoints of all protocols, along
+// with their registrations, to eps and returns the result.
+func (d *transportDemuxer) appendRegistered(eps []registeredEndpoint) []registeredEndpoint {
+	for proto, p := range d.protocol {
+		for i := range p.shards {
+			sh := &p.shards[i]
+			sh.mu.RLock()
+			for id, ep := range sh.endpoints {
+				if g, ok := ep.(*reusePortGroup); ok {
+					for _, ep := range g.eps {
+						eps = append(eps, registeredEndpoint{proto, id, ep})
+					}
+					continue
+				}
+				eps = append(eps, registeredEndpoint{proto, id, ep})
+			}
+			sh.mu.RUnlock()
+		}
+	}
+
+	return eps
 }
 
 // deliverPacket attempts to deliver the given packet. Returns true if it found
 // an endpoint, false otherwise.
-func (d *transportDemuxer) deliverPacket(r *Route, protocol tcpip.TransportProtocolNumber, v buffer.View, id TransportEndpointID) bool {
+//
+// The most specific endpoint is chosen, by looking up, in order: the full
+// 4-tuple (connected endpoints), the 4-tuple without the local address
+// (endpoints connected without binding to an address), the local address and
+// port (endpoints bound to an address), and the local port alone (endpoints
+// bound to all addresses).
+func (d *transportDemuxer) deliverPacket(r *Route, protocol tcpip.TransportProtocolNumber, vv buffer.VectorisedView, id TransportEndpointID) bool {
 	eps, ok := d.protocol[protocol]
 	if !ok {
 		return false
 	}
 
-	eps.mu.RLock()
-	defer eps.mu.RUnlock()
+	if isMulticastAddress(id.LocalAddress) {
+		return eps.deliverMulticastPacket(r, vv, id)
+	}
 
 	// Try to find a match with the id as provided.
-	if ep := eps.endpoints[id]; ep != nil {
-		ep.HandlePacket(r, id, v)
+	if eps.deliver(r, vv, id, id) {
 		return true
 	}
 
@@ -92,8 +304,7 @@ func (d *transportDemuxer) deliverPacket(r *Route, protocol tcpip.TransportProto
 	nid := id
 
 	nid.LocalAddress = ""
-	if ep := eps.endpoints[nid]; ep != nil {
-		ep.HandlePacket(r, id, v)
+	if eps.deliver(r, vv, id, nid) {
 		return true
 	}
 
@@ -101,17 +312,120 @@ func (d *transportDemuxer) deliverPacket(r *Route, protocol tcpip.TransportProto
 	nid.LocalAddress = id.LocalAddress
 	nid.RemoteAddress = ""
 	nid.RemotePort = 0
-	if ep := eps.endpoints[nid]; ep != nil {
-		ep.HandlePacket(r, id, v)
+	if eps.deliver(r, vv, id, nid) {
 		return true
 	}
 
 	// Try to find a match with only the local port.
 	nid.LocalAddress = ""
-	if ep := eps.endpoints[nid]; ep != nil {
-		ep.HandlePacket(r, id, v)
-		return true
+	return eps.deliver(r, vv, id, nid)
+}
+
+// findEndpoint returns the endpoint deliverPacket would deliver a packet with
+// the given id to, or nil if there is none. Packets sent to multicast groups,
+// which may be delivered to several endpoints, aren't attributed to any.
+func (d *transportDemuxer) findEndpoint(protocol tcpip.TransportProtocolNumber, id TransportEndpointID) TransportEndpoint {
+	eps, ok := d.protocol[protocol]
+	if !ok || isMulticastAddress(id.LocalAddress) {
+		return nil
+	}
+
+	// The same ids as deliverPacket are tried, in the same order.
+	nid := id
+	for _, f := range [...]struct{ local, remote bool }{{true, true}, {false, true}, {true, false}, {false, false}} {
+		nid.LocalAddress, nid.RemoteAddress, nid.RemotePort = "", "", 0
+		if f.local {
+			nid.LocalAddress = id.LocalAddress
+		}
+		if f.remote {
+			nid.RemoteAddress, nid.RemotePort = id.RemoteAddress, id.RemotePort
+		}
+
+		sh := eps.shard(nid)
+		sh.mu.RLock()
+		ep := sh.endpoints[nid]
+		if g, ok := ep.(*reusePortGroup); ok {
+			ep = g.pick(id)
+		}
+		sh.mu.RUnlock()
+
+		if ep != nil {
+			return ep
+		}
+	}
+
+	return nil
+}
+
+// deliver delivers the packet with the given id to the endpoint registered with
+// nid, if any, and returns whether there is one. The mutex of its shard is held
+// for reading while it handles the packet, so that it isn't unregistered
+// meanwhile.
+func (eps *transportEndpoints) deliver(r *Route, vv buffer.VectorisedView, id, nid TransportEndpointID) bool {
+	sh := eps.shard(nid)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	ep := sh.endpoints[nid]
+	if ep == nil {
+		return false
+	}
+
+	ep.HandlePacket(r, id, vv)
+	return true
+}
+
+// deliverMulticastPacket delivers a packet sent to a multicast group to all the
+// endpoints it matches, which share it.
+func (eps *transportEndpoints) deliverMulticastPacket(r *Route, vv buffer.VectorisedView, id TransportEndpointID) bool {
+	// The same ids as deliverPacket are tried, from the most specific to
+	// the least.
+	var nids [4]TransportEndpointID
+	var shards [4]int
+	for i, f := range [...]struct{ local, remote bool }{{true, true}, {false, true}, {true, false}, {false, false}} {
+		nid := id
+		nid.LocalAddress, nid.RemoteAddress, nid.RemotePort = "", "", 0
+		if f.local {
+			nid.LocalAddress = id.LocalAddress
+		}
+		if f.remote {
+			nid.RemoteAddress, nid.RemotePort = id.RemoteAddress, id.RemotePort
+		}
+		nids[i] = nid
+		shards[i] = eps.shardIndex(nid)
+	}
+
+	// The shards of the ids are held for reading until the packet has
+	// been delivered. They are locked in ascending order, so that
+	// concurrent deliveries can't deadlock with writers.
+	var locked [numEndpointShards]bool
+	for _, i := range shards {
+		locked[i] = true
+	}
+	for i := range locked {
+		if locked[i] {
+			eps.shards[i].mu.RLock()
+			defer eps.shards[i].mu.RUnlock()
+		}
+	}
+
+	var matched [4]TransportEndpoint
+	n := 0
+	for i, nid := range nids {
+		if ep := eps.shards[shards[i]].endpoints[nid]; ep != nil {
+			matched[n] = ep
+			n++
+		}
+	}
+
+	// Each endpoint but the last gets a clone of vv, made before vv is
+	// handed to the last one, which may trim it.
+	for i := 0; i < n-1; i++ {
+		matched[i].HandlePacket(r, id, vv.Clone())
+	}
+	if n > 0 {
+		matched[n-1].HandlePacket(r, id, vv)
 	}
 
-	return false
+	return n > 0
 }
@@ -57,7 +57,7 @@ func (f *fakeTransportEndpoint) Write(v buffer.View, _ *tcpip.FullAddress) (uint
 	}
 
 	hdr := buffer.NewPrependable(int(f.route.MaxHeaderLength()))
-	err := f.route.WritePacket(&hdr, v, fakeTransNumber)
+	err := f.route.WritePacket(&hdr, v.ToVectorisedView(), fakeTransNumber)
 	if err != nil {
 		return 0, err
 	}
@@ -144,7 +144,7 @@ func (*fakeTransportEndpoint) GetRemoteAddress() (tcpip.FullAddress, error) {
 	return tcpip.FullAddress{}, nil
 }
 
-func (f *fakeTransportEndpoint) HandlePacket(*stack.Route, stack.TransportEndpointID, buffer.View) {
+func (f *fakeTransportEndpoint) HandlePacket(*stack.Route, stack.TransportEndpointID, buffer.VectorisedView) {
 	// Increment the number of received packets.
 	f.proto.packetCount++
 }
@@ -264,8 +264,129 @@ func TestTransportSend(t *testing.T) {
 	}
 }
 
+func TestTransportEndpoints(t *testing.T) {
+	id, _ := channel.New(10, defaultMTU)
+	s := stack.New([]string{"fakeNet"}, []string{"fakeTrans"}).(*stack.Stack)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{{"\x00", "\x00", "\x00", 1}})
+
+	if infos := s.TransportEndpoints(); len(infos) != 0 {
+		t.Fatalf("TransportEndpoints returned %d endpoints, want 0", len(infos))
+	}
+
+	wq := waiter.Queue{}
+	ep, err := s.NewEndpoint(fakeTransNumber, fakeNetNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+
+	if err := ep.Connect(tcpip.FullAddress{0, "\x03", 0}); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	infos := s.TransportEndpoints()
+	if len(infos) != 1 {
+		t.Fatalf("TransportEndpoints returned %d endpoints, want 1", len(infos))
+	}
+
+	info := infos[0]
+	if info.NIC != 0 || info.Protocol != fakeTransNumber || info.ID.RemoteAddress != "\x03" {
+		t.Errorf("TransportEndpoints returned %+v, want NIC 0, protocol %v and remote address %v", info, fakeTransNumber, tcpip.Address("\x03"))
+	}
+}
+
+// fakeOption is the option type of fakeConfigurableProtocol.
+type fakeOption int
+
+// fakeConfigurableProtocol is a fake transport protocol with per-stack options.
+type fakeConfigurableProtocol struct {
+	fakeTransportProtocol
+	option fakeOption
+}
+
+func (f *fakeConfigurableProtocol) SetOption(option interface{}) error {
+	switch v := option.(type) {
+	case fakeOption:
+		f.option = v
+		return nil
+	default:
+		return tcpip.ErrUnknownProtocolOption
+	}
+}
+
+func (f *fakeConfigurableProtocol) Option(option interface{}) error {
+	switch v := option.(type) {
+	case *fakeOption:
+		*v = f.option
+		return nil
+	default:
+		return tcpip.ErrUnknownProtocolOption
+	}
+}
+
+func TestTransportProtocolOption(t *testing.T) {
+	s1 := stack.New([]string{"fakeNet"}, []string{"fakeConfigurableTrans"}).(*stack.Stack)
+	s2 := stack.New([]string{"fakeNet"}, []string{"fakeConfigurableTrans"}).(*stack.Stack)
+
+	if err := s1.SetTransportProtocolOption(fakeTransNumber, fakeOption(5)); err != nil {
+		t.Fatalf("SetTransportProtocolOption failed: %v", err)
+	}
+
+	if err := s1.SetTransportProtocolOption(fakeTransNumber, 5); err != tcpip.ErrUnknownProtocolOption {
+		t.Errorf("SetTransportProtocolOption with unknown option returned %v, want %v", err, tcpip.ErrUnknownProtocolOption)
+	}
+
+	var v fakeOption
+	if err := s1.TransportProtocolOption(fakeTransNumber, &v); err != nil {
+		t.Fatalf("TransportProtocolOption failed: %v", err)
+	}
+	if v != 5 {
+		t.Errorf("option = %d, want %d", v, 5)
+	}
+
+	// The option is per-stack.
+	if err := s2.TransportProtocolOption(fakeTransNumber, &v); err != nil {
+		t.Fatalf("TransportProtocolOption failed: %v", err)
+	}
+	if v != 0 {
+		t.Errorf("option of second stack = %d, want %d", v, 0)
+	}
+
+	// Protocols that aren't configurable have no options.
+	s3 := stack.New([]string{"fakeNet"}, []string{"fakeTrans"}).(*stack.Stack)
+	if err := s3.SetTransportProtocolOption(fakeTransNumber, fakeOption(5)); err != tcpip.ErrUnknownProtocolOption {
+		t.Errorf("SetTransportProtocolOption returned %v, want %v", err, tcpip.ErrUnknownProtocolOption)
+	}
+
+	if err := s3.SetTransportProtocolOption(fakeTransNumber+1, fakeOption(5)); err != tcpip.ErrUnknownProtocol {
+		t.Errorf("SetTransportProtocolOption with unknown protocol returned %v, want %v", err, tcpip.ErrUnknownProtocol)
+	}
+}
+
+func TestRegisteredTransportProtocols(t *testing.T) {
+	found := 0
+	for _, name := range stack.RegisteredTransportProtocols() {
+		if name == "fakeTrans" || name == "fakeConfigurableTrans" {
+			found++
+		}
+	}
+	if found != 2 {
+		t.Errorf("RegisteredTransportProtocols returned %v, want fakeTrans and fakeConfigurableTrans", stack.RegisteredTransportProtocols())
+	}
+}
+
 var fakeTrans fakeTransportProtocol
 
 func init() {
 	stack.RegisterTransportProtocol("fakeTrans", &fakeTrans)
+	stack.RegisterTransportProtocolFactory("fakeConfigurableTrans", func(*stack.Stack) stack.TransportProtocol {
+		return &fakeConfigurableProtocol{}
+	})
 }
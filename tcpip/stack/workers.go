@@ -0,0 +1,167 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"sync"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+)
+
+// maxWorkerBatchSize is the maximum number of packets a worker hands to the NIC
+// at once.
+const maxWorkerBatchSize = 32
+
+// workerPool implements the worker-pool mode of NICs. It is attached to the
+// link endpoint in place of the NIC, and steers the packets it delivers to a
+// fixed set of goroutines by a hash of their flow, so the packets of a flow are
+// processed in order while different flows are processed in parallel.
+type workerPool struct {
+	nic    *NIC
+	queues []chan InboundPacket
+
+	// mu protects closed below. It is held for reading while packets are
+	// queued, so that queues aren't closed under a delivering goroutine.
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newWorkerPool(nic *NIC, workers, queueSize int) *workerPool {
+	p := &workerPool{
+		nic:    nic,
+		queues: make([]chan InboundPacket, workers),
+	}
+	for i := range p.queues {
+		p.queues[i] = make(chan InboundPacket, queueSize)
+	}
+	return p
+}
+
+// start starts the workers. Stack.Wait waits for them to exit once the pool is
+// closed.
+func (p *workerPool) start() {
+	for _, q := range p.queues {
+		q := q
+		p.nic.stack.Go(func() {
+			p.work(q)
+		})
+	}
+}
+
+// close makes the workers exit once they have handed the packets already queued
+// to the NIC. The packets delivered from then on are dropped.
+func (p *workerPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+	for _, q := range p.queues {
+		close(q)
+	}
+}
+
+// DeliverNetworkPacket implements NetworkDispatcher.DeliverNetworkPacket. It
+// queues the packet for the worker selected by its flow; when the queue is
+// full, it blocks until there is room in it.
+func (p *workerPool) DeliverNetworkPacket(linkEP LinkEndpoint, protocol tcpip.NetworkProtocolNumber, v buffer.View) {
+	q := p.queues[FlowHash(protocol, v)%uint32(len(p.queues))]
+
+	p.mu.RLock()
+	if !p.closed {
+		q <- InboundPacket{Protocol: protocol, Data: v}
+	}
+	p.mu.RUnlock()
+}
+
+// DeliverNetworkPackets implements
+// BatchNetworkDispatcher.DeliverNetworkPackets.
+func (p *workerPool) DeliverNetworkPackets(linkEP LinkEndpoint, pkts []InboundPacket) {
+	for i := range pkts {
+		p.DeliverNetworkPacket(linkEP, pkts[i].Protocol, pkts[i].Data)
+	}
+}
+
+// LinkStateChanged implements NetworkDispatcher.LinkStateChanged. It just
+// forwards the notification to the NIC.
+func (p *workerPool) LinkStateChanged(linkEP LinkEndpoint, up bool) {
+	p.nic.LinkStateChanged(linkEP, up)
+}
+
+// work hands the packets of the given queue over to the NIC, in batches so that
+// the segments of a flow can be coalesced by generic receive offload.
+func (p *workerPool) work(q chan InboundPacket) {
+	batch := make([]InboundPacket, 0, maxWorkerBatchSize)
+	for pkt := range q {
+		batch = append(batch[:0], pkt)
+	drain:
+		for len(batch) < maxWorkerBatchSize {
+			select {
+			case pkt, ok := <-q:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, pkt)
+			default:
+				break drain
+			}
+		}
+
+		p.nic.DeliverNetworkPackets(p.nic.linkEP, batch)
+	}
+}
+
+// FlowHash computes a hash of the addresses and, for unfragmented TCP and UDP
+// packets, the ports of the given packet, to steer the packets of a flow to the
+// same queue. Packets that can't be parsed hash to zero.
+func FlowHash(protocol tcpip.NetworkProtocolNumber, v buffer.View) uint32 {
+	var addrs []byte
+	var transProto tcpip.TransportProtocolNumber
+	var transport []byte
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		h := header.IPv4(v)
+		if !h.IsValid() {
+			return 0
+		}
+		addrs = v[12:20] // Source and destination addresses.
+		if h.FragmentOffset() == 0 && h.Flags()&header.IPv4FlagMoreFragments == 0 {
+			transProto = h.TransportProtocol()
+			transport = v[h.HeaderLength():]
+		}
+
+	case header.IPv6ProtocolNumber:
+		h := header.IPv6(v)
+		if !h.IsValid() {
+			return 0
+		}
+		addrs = v[8:40] // Source and destination addresses.
+		transProto = h.TransportProtocol()
+		transport = v[header.IPv6MinimumSize:]
+
+	default:
+		return 0
+	}
+
+	h := uint32(2166136261)
+	for _, c := range addrs {
+		h = (h ^ uint32(c)) * 16777619
+	}
+
+	switch transProto {
+	case header.TCPProtocolNumber, header.UDPProtocolNumber:
+		if len(transport) >= 4 {
+			for _, c := range transport[:4] {
+				h = (h ^ uint32(c)) * 16777619
+			}
+		}
+	}
+
+	return h
+}
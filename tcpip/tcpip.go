@@ -22,6 +22,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/waiter"
@@ -29,37 +30,101 @@ import (
 
 // Errors that can be returned by the network stack.
 var (
-	ErrUnknownProtocol      = errors.New("unknown protocol")
-	ErrUnknownNICID         = errors.New("unknown nic id")
-	ErrDuplicateNICID       = errors.New("duplicate nic id")
-	ErrDuplicateAddress     = errors.New("duplicate address")
-	ErrNoRoute              = errors.New("no route")
-	ErrBadLinkEndpoint      = errors.New("bad link layer endpoint")
-	ErrAlreadyBound         = errors.New("endpoint already bound")
-	ErrInvalidEndpointState = errors.New("endpoint is in invalid state")
-	ErrAlreadyConnecting    = errors.New("endpoint is already connecting")
-	ErrAlreadyConnected     = errors.New("endpoint is already connected")
-	ErrNoPortAvailable      = errors.New("no ports are available")
-	ErrPortInUse            = errors.New("port is in use")
-	ErrBadLocalAddress      = errors.New("bad local address")
-	ErrClosedForSend        = errors.New("endpoint is closed for send")
-	ErrClosedForReceive     = errors.New("endpoint is closed for receive")
-	ErrWouldBlock           = errors.New("operation would block")
-	ErrConnectionRefused    = errors.New("connection was refused")
-	ErrTimeout              = errors.New("operation timed out")
-	ErrAborted              = errors.New("operation aborted")
-	ErrConnectStarted       = errors.New("connection attempt started")
-	ErrDestinationRequired  = errors.New("destination address is required")
-	ErrNotSupported         = errors.New("operation not supported")
-	ErrNotConnected         = errors.New("endpoint not connected")
-	ErrConnectionReset      = errors.New("connection reset by peer")
-	ErrConnectionAborted    = errors.New("connection aborted")
+	ErrUnknownProtocol       = errors.New("unknown protocol")
+	ErrUnknownNICID          = errors.New("unknown nic id")
+	ErrDuplicateNICID        = errors.New("duplicate nic id")
+	ErrDuplicateAddress      = errors.New("duplicate address")
+	ErrNoRoute               = errors.New("no route")
+	ErrBadLinkEndpoint       = errors.New("bad link layer endpoint")
+	ErrAlreadyBound          = errors.New("endpoint already bound")
+	ErrInvalidEndpointState  = errors.New("endpoint is in invalid state")
+	ErrAlreadyConnecting     = errors.New("endpoint is already connecting")
+	ErrAlreadyConnected      = errors.New("endpoint is already connected")
+	ErrNoPortAvailable       = errors.New("no ports are available")
+	ErrPortInUse             = errors.New("port is in use")
+	ErrBadLocalAddress       = errors.New("bad local address")
+	ErrClosedForSend         = errors.New("endpoint is closed for send")
+	ErrClosedForReceive      = errors.New("endpoint is closed for receive")
+	ErrWouldBlock            = errors.New("operation would block")
+	ErrConnectionRefused     = errors.New("connection was refused")
+	ErrTimeout               = errors.New("operation timed out")
+	ErrAborted               = errors.New("operation aborted")
+	ErrConnectStarted        = errors.New("connection attempt started")
+	ErrDestinationRequired   = errors.New("destination address is required")
+	ErrNotSupported          = errors.New("operation not supported")
+	ErrNotConnected          = errors.New("endpoint not connected")
+	ErrConnectionReset       = errors.New("connection reset by peer")
+	ErrConnectionAborted     = errors.New("connection aborted")
+	ErrLinkDown              = errors.New("link is down")
+	ErrStackClosed           = errors.New("stack is closed")
+	ErrNoBufferSpace         = errors.New("no buffer space available")
+	ErrInvalidPortRange      = errors.New("invalid port range")
+	ErrInvalidOptionValue    = errors.New("invalid option value")
+	ErrInvalidRoute          = errors.New("invalid route")
+	ErrUnknownProtocolOption = errors.New("unknown option for protocol")
+	ErrInvalidPrefix         = errors.New("invalid address prefix")
+	ErrNoAddress             = errors.New("no address available")
+	ErrBadAddress            = errors.New("bad address")
+	ErrMessageTooLong        = errors.New("message too long")
 )
 
 // Address is a byte slice cast as a string that represents the address of a
 // network node. Or, in the case of unix endpoints, it may represent a path.
 type Address string
 
+// AddressWithPrefix is an address along with the length of the prefix of its
+// subnet, e.g., 10.0.0.1/24.
+type AddressWithPrefix struct {
+	Address   Address
+	PrefixLen int
+}
+
+// Contains returns whether addr is in the subnet of a.
+func (a AddressWithPrefix) Contains(addr Address) bool {
+	if len(addr) != len(a.Address) {
+		return false
+	}
+
+	for i := 0; i < len(addr); i++ {
+		bits := a.PrefixLen - i*8
+		if bits <= 0 {
+			break
+		}
+
+		mask := byte(0xff)
+		if bits < 8 {
+			mask = ^byte(0xff >> uint(bits))
+		}
+
+		if (addr[i]^a.Address[i])&mask != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Broadcast returns the directed broadcast address of the subnet of a, that is,
+// its address with all the host bits set.
+func (a AddressWithPrefix) Broadcast() Address {
+	b := []byte(a.Address)
+	for i := range b {
+		bits := a.PrefixLen - i*8
+		switch {
+		case bits <= 0:
+			b[i] = 0xff
+		case bits < 8:
+			b[i] |= 0xff >> uint(bits)
+		}
+	}
+
+	return Address(b)
+}
+
+// LinkAddress is a byte slice cast as a string that represents a link address.
+// It is typically a 6-byte MAC address.
+type LinkAddress string
+
 // NICID is a number that uniquely identifies a NIC.
 type NICID int32
 
@@ -101,6 +166,37 @@ type ControlMessages interface {
 	CloneCreds() ControlMessages
 }
 
+// IPControlMessages holds the fields of the network header of a received packet
+// that RecvMsg reports when they are requested with the corresponding options.
+type IPControlMessages struct {
+	// HasTTL is set if TTL is valid, per ReceiveTTLOption.
+	HasTTL bool
+
+	// TTL is the TTL, or hop limit, of the packet.
+	TTL uint8
+
+	// HasTOS is set if TOS is valid, per ReceiveTOSOption.
+	HasTOS bool
+
+	// TOS is the type of service, or traffic class, of the packet,
+	// including its ECN bits.
+	TOS uint8
+}
+
+// ECN returns the ECN codepoint of the packet, which is valid if HasTOS is set.
+func (cm *IPControlMessages) ECN() uint8 {
+	return cm.TOS & ECNMask
+}
+
+// Release implements ControlMessages.Release.
+func (*IPControlMessages) Release() {}
+
+// CloneCreds implements ControlMessages.CloneCreds. IP control messages don't
+// hold credentials.
+func (*IPControlMessages) CloneCreds() ControlMessages {
+	return nil
+}
+
 // Endpoint is the interface implemented by transport protocols (e.g., tcp, udp)
 // that exposes functionality like read, write, connect, etc. to users of the
 // networking stack.
@@ -221,6 +317,126 @@ type NoDelayOption int
 // should allow reuse of local address.
 type ReuseAddressOption int
 
+// ReusePortOption is used by SetSockOpt/GetSockOpt to specify whether Bind()
+// should allow other endpoints that set it to bind to the same address and
+// port, like SO_REUSEPORT. Listening endpoints bound this way share the
+// incoming connections.
+type ReusePortOption int
+
+// OwnerOption is used by SetSockOpt/GetSockOpt to specify the name of the owner
+// an endpoint is attributed to, e.g., a tenant of a multi-tenant application.
+// The traffic and memory of the endpoint are accounted for by the owner, which
+// can be retrieved with Stack.Owner. It must be set before the endpoint is
+// bound or connected; connections accepted by a listening endpoint inherit its
+// owner.
+type OwnerOption string
+
+// ReceiveDeadlineOption is used by SetSockOpt/GetSockOpt to specify the time
+// after which Read, and Accept on listening endpoints, fail with ErrTimeout,
+// like with net.Conn.SetReadDeadline. Waiters are notified with
+// waiter.EventIn when the deadline expires, so that blocked callers wake up.
+// The zero time means no deadline.
+type ReceiveDeadlineOption time.Time
+
+// SendDeadlineOption is used by SetSockOpt/GetSockOpt to specify the time after
+// which Write fails with ErrTimeout, like with net.Conn.SetWriteDeadline.
+// Waiters are notified with waiter.EventOut when the deadline expires. The
+// zero time means no deadline.
+type SendDeadlineOption time.Time
+
+// TTLOption is used by SetSockOpt/GetSockOpt to specify the TTL, or hop limit,
+// of the packets sent by the endpoint, like IP_TTL and IPV6_UNICAST_HOPS. Zero
+// means the default TTL of the stack.
+type TTLOption uint8
+
+// MulticastTTLOption is used by SetSockOpt/GetSockOpt to specify the TTL, or
+// hop limit, of the multicast packets sent by the endpoint, like
+// IP_MULTICAST_TTL and IPV6_MULTICAST_HOPS. Zero means the same as other
+// packets; unlike with BSD sockets, it isn't 1 by default.
+type MulticastTTLOption uint8
+
+// TOSOption is used by SetSockOpt/GetSockOpt to specify the type of service, or
+// traffic class, of the packets sent by the endpoint, like IP_TOS and
+// IPV6_TCLASS. Its two low-order bits are the ECN codepoint of the packets, one
+// of the ECN constants.
+type TOSOption uint8
+
+// The ECN codepoints of the type of service, or traffic class, of IP packets,
+// per RFC 3168, section 5.
+const (
+	// ECNNotECT marks packets whose transport doesn't support ECN.
+	ECNNotECT = 0
+
+	// ECNECT1 and ECNECT0 mark packets whose transport supports ECN.
+	ECNECT1 = 1
+	ECNECT0 = 2
+
+	// ECNCE marks packets that experienced congestion.
+	ECNCE = 3
+
+	// ECNMask is the mask of the ECN codepoint.
+	ECNMask = 3
+)
+
+// ReceiveTTLOption is used by SetSockOpt/GetSockOpt to specify whether RecvMsg
+// reports the TTL, or hop limit, of the received packets in IPControlMessages,
+// like IP_RECVTTL and IPV6_RECVHOPLIMIT. Nonzero means it does.
+type ReceiveTTLOption int
+
+// ReceiveTOSOption is used by SetSockOpt/GetSockOpt to specify whether RecvMsg
+// reports the type of service, or traffic class, of the received packets in
+// IPControlMessages, like IP_RECVTOS and IPV6_RECVTCLASS. Nonzero means it
+// does.
+type ReceiveTOSOption int
+
+// V6OnlyOption is used by SetSockOpt/GetSockOpt to specify whether IPv6
+// endpoints only exchange IPv6 packets, like IPV6_V6ONLY. The stack doesn't map
+// IPv4 addresses into IPv6 ones, so they always do: it is always nonzero, and
+// can't be set to zero. IPv4 endpoints don't support it.
+type V6OnlyOption int
+
+// MulticastLoopOption is used by SetSockOpt/GetSockOpt to specify whether the
+// multicast packets sent by the endpoint are looped back to the members of their
+// group on the same stack, like IP_MULTICAST_LOOP. Nonzero means they are,
+// which is the default.
+type MulticastLoopOption int
+
+// MulticastInterfaceOption is used by SetSockOpt/GetSockOpt to specify the NIC
+// through which the endpoint sends multicast packets, and optionally their
+// source address, regardless of the route table, like IP_MULTICAST_IF and
+// IPV6_MULTICAST_IF. If NIC is zero, it's the NIC InterfaceAddr is assigned to.
+// The zero value means multicast packets are routed like others. The NIC and
+// address the endpoint is bound to, and the NICs specified in writes, take
+// precedence.
+type MulticastInterfaceOption struct {
+	NIC           NICID
+	InterfaceAddr Address
+}
+
+// ListenerStatsOption is used in GetSockOpt to get the state of the queues of a
+// listening TCP endpoint, so that callers can tell when connection attempts are
+// dropped.
+type ListenerStatsOption struct {
+	// SynBacklog is the number of connections in the SYN-RCVD state, that
+	// is, whose handshake is in progress.
+	SynBacklog int
+
+	// AcceptQueued is the number of connections waiting to be accepted,
+	// and AcceptQueueLimit is the maximum, i.e., the listen backlog.
+	AcceptQueued     int
+	AcceptQueueLimit int
+
+	// AcceptOverflows is the number of established connections that were
+	// reset because the accept queue was full.
+	AcceptOverflows uint64
+
+	// CookiesSent is the number of SYN cookies sent because too many
+	// connections were in the SYN-RCVD state, and CookiesAccepted is the
+	// number of connections established with a valid cookie.
+	CookiesSent     uint64
+	CookiesAccepted uint64
+}
+
 // PasscredOption is used by SetSockOpt/GetSockOpt to specify whether
 // SCM_CREDENTIALS socket control messages are enabled.
 //
@@ -284,11 +500,22 @@ type Stack interface {
 	// CreateNIC creates a NIC with the provided id and link-layer sender.
 	CreateNIC(id NICID, linkEndpoint LinkEndpointID) error
 
+	// RemoveNIC removes the NIC with the provided id, its addresses and the
+	// routes through it, and aborts the endpoints using it.
+	RemoveNIC(id NICID) error
+
 	// AddAddress adds a new network-layer address to the specified NIC.
 	AddAddress(id NICID, protocol NetworkProtocolNumber, addr Address) error
 
 	// Stats returns a snapshot of the current stats.
 	Stats() Stats
+
+	// Close shuts the stack down, removing all NICs and aborting all
+	// endpoints.
+	Close()
+
+	// Wait waits for the goroutines of the stack to exit after Close.
+	Wait()
 }
 
 // Stats holds statistics about the networking stack.
@@ -305,6 +532,251 @@ type Stats struct {
 	// MalformedRcvPackets is the number of packets received by the stack
 	// that were deemed malformed.
 	MalformedRcvdPackets uint64
+
+	// IP holds IP statistics.
+	IP IPStats
+
+	// TCP holds TCP statistics.
+	TCP TCPStats
+
+	// UDP holds UDP statistics.
+	UDP UDPStats
+
+	// SCTP holds SCTP statistics.
+	SCTP SCTPStats
+
+	// DCCP holds DCCP statistics.
+	DCCP DCCPStats
+
+	// ICMP holds ICMP statistics.
+	ICMP ICMPStats
+}
+
+// IPStats holds statistics about IP (both IPv4 and IPv6) packets.
+type IPStats struct {
+	// PacketsReceived is the number of packets received from NICs and
+	// handed to the network layer.
+	PacketsReceived uint64
+
+	// MalformedPacketsReceived is the number of packets received with
+	// invalid IP headers.
+	MalformedPacketsReceived uint64
+
+	// PacketsDropped is the number of valid packets that were dropped
+	// because they use unsupported features, e.g., fragmentation.
+	PacketsDropped uint64
+
+	// PacketsDelivered is the number of packets delivered to transport
+	// protocols.
+	PacketsDelivered uint64
+
+	// PacketsSent is the number of packets sent through NICs.
+	PacketsSent uint64
+
+	// OutgoingPacketErrors is the number of packets that couldn't be
+	// sent.
+	OutgoingPacketErrors uint64
+
+	// PacketsForwarded is the number of packets forwarded by NICs with
+	// forwarding enabled.
+	PacketsForwarded uint64
+}
+
+// TCPStats holds statistics about TCP.
+type TCPStats struct {
+	// ActiveConnectionOpenings is the number of connections initiated by
+	// calls to Connect.
+	ActiveConnectionOpenings uint64
+
+	// PassiveConnectionOpenings is the number of connections accepted by
+	// listening endpoints.
+	PassiveConnectionOpenings uint64
+
+	// FailedConnectionAttempts is the number of active connection
+	// attempts that failed.
+	FailedConnectionAttempts uint64
+
+	// SegmentsReceived is the number of valid segments received.
+	SegmentsReceived uint64
+
+	// MalformedSegmentsReceived is the number of segments received with
+	// invalid headers.
+	MalformedSegmentsReceived uint64
+
+	// ChecksumErrors is the number of segments received with bad
+	// checksums.
+	ChecksumErrors uint64
+
+	// SegmentsSent is the number of segments sent, including
+	// retransmissions.
+	SegmentsSent uint64
+
+	// Retransmits is the number of segments that were retransmitted.
+	Retransmits uint64
+
+	// ResetsSent is the number of RST segments sent.
+	ResetsSent uint64
+
+	// ResetsReceived is the number of RST segments received.
+	ResetsReceived uint64
+
+	// ListenOverflows is the number of connections reset by listening
+	// endpoints because their accept queue was full.
+	ListenOverflows uint64
+
+	// OutOfOrderDrops is the number of out-of-order segments dropped
+	// because the out-of-order queue of their endpoint, or the memory of
+	// the stack, was full.
+	OutOfOrderDrops uint64
+
+	// FastPathSegments is the number of segments of established
+	// connections handled by the header prediction fast path.
+	FastPathSegments uint64
+
+	// HyStartExits is the number of times HyStart ended slow start before
+	// a loss occurred.
+	HyStartExits uint64
+}
+
+// UDPStats holds statistics about UDP.
+type UDPStats struct {
+	// PacketsReceived is the number of datagrams queued to endpoints.
+	PacketsReceived uint64
+
+	// UnknownPortErrors is the number of datagrams received for ports
+	// without endpoints.
+	UnknownPortErrors uint64
+
+	// ReceiveBufferErrors is the number of datagrams dropped because the
+	// receive buffer of the endpoint was full.
+	ReceiveBufferErrors uint64
+
+	// ReceiveQueueOverflows is the number of datagrams dropped because the
+	// receive queue of the endpoint held as many datagrams as it can, even
+	// though its receive buffer wasn't full. They are also counted in
+	// ReceiveBufferErrors.
+	ReceiveQueueOverflows uint64
+
+	// MalformedPacketsReceived is the number of datagrams received with
+	// invalid headers.
+	MalformedPacketsReceived uint64
+
+	// ChecksumErrors is the number of datagrams received with bad
+	// checksums.
+	ChecksumErrors uint64
+
+	// PacketsSent is the number of datagrams sent.
+	PacketsSent uint64
+}
+
+// SCTPStats holds statistics about SCTP.
+type SCTPStats struct {
+	// ActiveAssociationOpenings is the number of associations initiated
+	// by calls to Connect.
+	ActiveAssociationOpenings uint64
+
+	// PassiveAssociationOpenings is the number of associations accepted
+	// by listening endpoints.
+	PassiveAssociationOpenings uint64
+
+	// PacketsReceived is the number of packets handed to endpoints.
+	PacketsReceived uint64
+
+	// PacketsSent is the number of packets sent.
+	PacketsSent uint64
+
+	// ChecksumErrors is the number of packets received with bad
+	// checksums.
+	ChecksumErrors uint64
+
+	// MalformedPacketsReceived is the number of packets received with
+	// invalid headers or chunks.
+	MalformedPacketsReceived uint64
+
+	// OutOfTheBluePackets is the number of packets received that didn't
+	// belong to any association or listening endpoint.
+	OutOfTheBluePackets uint64
+
+	// Retransmits is the number of DATA chunks retransmitted.
+	Retransmits uint64
+}
+
+// DCCPStats holds statistics about DCCP.
+type DCCPStats struct {
+	// ActiveConnectionOpenings is the number of connections initiated by
+	// calls to Connect.
+	ActiveConnectionOpenings uint64
+
+	// PassiveConnectionOpenings is the number of connections accepted by
+	// listening endpoints.
+	PassiveConnectionOpenings uint64
+
+	// PacketsReceived is the number of packets handed to endpoints.
+	PacketsReceived uint64
+
+	// PacketsSent is the number of packets sent.
+	PacketsSent uint64
+
+	// ChecksumErrors is the number of packets received with bad
+	// checksums.
+	ChecksumErrors uint64
+
+	// MalformedPacketsReceived is the number of packets received with
+	// invalid headers or options.
+	MalformedPacketsReceived uint64
+
+	// InvalidSequencePackets is the number of packets received whose
+	// sequence or acknowledgement number was out of the window of their
+	// connection.
+	InvalidSequencePackets uint64
+
+	// ResetsSent is the number of Reset packets sent.
+	ResetsSent uint64
+
+	// ResetsReceived is the number of Reset packets received that closed
+	// a connection.
+	ResetsReceived uint64
+
+	// PacketsLost is the number of data packets that congestion control
+	// found lost.
+	PacketsLost uint64
+
+	// ReceiveBufferErrors is the number of datagrams dropped because the
+	// receive buffer of their endpoint was full.
+	ReceiveBufferErrors uint64
+}
+
+// ICMPStats holds statistics about ICMP.
+type ICMPStats struct {
+	// EchoRequestsReceived is the number of echo requests received, which
+	// the stack answers.
+	EchoRequestsReceived uint64
+
+	// EchoRepliesSent is the number of echo replies sent.
+	EchoRepliesSent uint64
+
+	// EchoRequestsSent is the number of echo requests sent by endpoints.
+	EchoRequestsSent uint64
+
+	// EchoRepliesReceived is the number of echo replies queued to
+	// endpoints.
+	EchoRepliesReceived uint64
+
+	// ErrorsReceived is the number of destination unreachable and time
+	// exceeded errors about echo requests queued to endpoints.
+	ErrorsReceived uint64
+
+	// ReceiveBufferErrors is the number of echo replies and errors
+	// dropped because the receive buffer of the endpoint was full.
+	ReceiveBufferErrors uint64
+
+	// ChecksumErrors is the number of messages received with bad
+	// checksums.
+	ChecksumErrors uint64
+
+	// RateLimited is the number of messages the stack didn't send because
+	// their type exceeded its rate limit.
+	RateLimited uint64
 }
 
 // String implements the fmt.Stringer interface.
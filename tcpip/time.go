@@ -0,0 +1,61 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcpip
+
+import (
+	"time"
+)
+
+// Clock is the source of time used by a stack and its protocols, for example,
+// to schedule retransmissions. Replacing the real clock allows tests to drive
+// time deterministically, and simulations to run faster than real time.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTimer creates a new timer that sends the current time on its
+	// channel after at least duration d.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a timer created by a Clock. It has the same semantics as
+// time.Timer.
+type Timer interface {
+	// C returns the channel on which the time is sent when the timer
+	// fires.
+	C() <-chan time.Time
+
+	// Stop prevents the timer from firing. It returns false if the timer
+	// has already fired or been stopped.
+	Stop() bool
+
+	// Reset changes the timer to fire after duration d. It returns true
+	// if the timer had been active.
+	Reset(d time.Duration) bool
+}
+
+// StdClock is a Clock that uses the real time, as provided by the time
+// package. It is the clock used by stacks unless told otherwise.
+type StdClock struct{}
+
+// Now implements Clock.Now.
+func (StdClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer implements Clock.NewTimer.
+func (StdClock) NewTimer(d time.Duration) Timer {
+	return stdTimer{time.NewTimer(d)}
+}
+
+// stdTimer is a Timer backed by a time.Timer.
+type stdTimer struct {
+	*time.Timer
+}
+
+// C implements Timer.C.
+func (t stdTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
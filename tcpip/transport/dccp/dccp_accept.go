@@ -0,0 +1,158 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import (
+	"sync/atomic"
+
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/waiter"
+)
+
+// protocolListenLoop is the main loop of a listening DCCP endpoint. It creates
+// the endpoints of the Request packets it receives, which complete their
+// handshake in their own goroutine.
+func (e *endpoint) protocolListenLoop() {
+	defer func() {
+		// Mark endpoint as closed. This will prevent goroutines running
+		// handleRequest() from attempting to queue new connections to
+		// the endpoint.
+		e.mu.Lock()
+		e.state = stateClosed
+		e.mu.Unlock()
+
+		// Notify waiters that the endpoint is shutdown.
+		e.waiterQueue.Notify(waiter.EventIn | waiter.EventOut)
+
+		// Do cleanup if needed.
+		e.completeWorker()
+	}()
+
+	for {
+		select {
+		case p := <-e.segmentChan:
+			e.handleListenPacket(p)
+			p.route.Release()
+
+		case <-e.notifyChan:
+			if e.fetchNotifications()&(notifyClose|notifyAbort) != 0 {
+				return
+			}
+		}
+	}
+}
+
+// handleListenPacket handles a packet received by a listening endpoint. Request
+// packets with the service code of the endpoint get a new endpoint, and the
+// other packets, which belong to no connection, are reset.
+func (e *endpoint) handleListenPacket(p *packet) {
+	h := p.header()
+	switch h.Type() {
+	case header.DCCPRequest:
+	case header.DCCPReset:
+		return
+	default:
+		replyReset(&p.route, p.id, h, header.DCCPResetNoConnection)
+		return
+	}
+
+	e.mu.RLock()
+	serviceCode := e.serviceCode
+	e.mu.RUnlock()
+
+	if h.ServiceCode() != serviceCode {
+		replyReset(&p.route, p.id, h, header.DCCPResetBadServiceCode)
+		return
+	}
+	if len(e.acceptedChan) == cap(e.acceptedChan) {
+		replyReset(&p.route, p.id, h, header.DCCPResetTooBusy)
+		return
+	}
+
+	n, err := e.createEndpoint(p)
+	if err != nil {
+		return
+	}
+	e.stack.GoWithLabels(n.profileLabels, func() { e.handleRequest(n) })
+}
+
+// createEndpoint creates a new endpoint in connecting state, for the Request
+// packet p.
+func (e *endpoint) createEndpoint(p *packet) (*endpoint, error) {
+	iss, err := randomSeqnum()
+	if err != nil {
+		return nil, err
+	}
+
+	n := newEndpoint(e.stack, p.route.NetProto, nil)
+	n.id = p.id
+	n.boundNICID = p.route.NICID()
+	n.route = p.route.Clone()
+
+	e.mu.RLock()
+	n.serviceCode = e.serviceCode
+	e.mu.RUnlock()
+
+	e.rcvMu.Lock()
+	n.rcvBufSize = e.rcvBufSize
+	e.rcvMu.Unlock()
+
+	e.sndMu.Lock()
+	n.sndBufSize = e.sndBufSize
+	e.sndMu.Unlock()
+
+	// Register new endpoint so that packets are routed to it.
+	if err := n.stack.RegisterTransportEndpoint(n.boundNICID, ProtocolNumber, n.id, n); err != nil {
+		n.Close()
+		return nil, err
+	}
+
+	n.isRegistered = true
+	n.state = stateConnecting
+	n.conn = newConnection(n, iss.add(-1))
+	n.conn.iss = iss
+	n.conn.setPeer(seqnum48(p.header().SequenceNumber()))
+
+	return n, nil
+}
+
+// handleRequest completes the handshake of the new endpoint n, and queues it to
+// be accepted.
+func (e *endpoint) handleRequest(n *endpoint) {
+	if err := n.passiveHandshake(); err != nil {
+		n.conn.stop()
+		n.cleanup()
+		return
+	}
+
+	n.mu.Lock()
+	n.state = stateConnected
+	n.mu.Unlock()
+
+	atomic.AddUint64(&n.route.Stats().DCCP.PassiveConnectionOpenings, 1)
+
+	// Send new connection to the listening endpoint if it's still
+	// listening. Otherwise reset it.
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.state == stateListen {
+		select {
+		case e.acceptedChan <- n:
+			e.waiterQueue.Notify(waiter.EventIn)
+			return
+		default:
+		}
+	}
+	n.abortUnaccepted()
+}
+
+// abortUnaccepted resets the connection of an endpoint its listener set up, but
+// that was never accepted, and cleans the endpoint up.
+func (e *endpoint) abortUnaccepted() {
+	e.conn.sendReset(header.DCCPResetAborted)
+	e.conn.stop()
+	e.cleanup()
+}
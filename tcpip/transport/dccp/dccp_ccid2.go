@@ -0,0 +1,303 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+const (
+	// numDupAck is the number of packets sent after a data packet that
+	// must be acknowledged before it's considered lost, per RFC 4341,
+	// section 5.
+	numDupAck = 3
+
+	// maxCwnd is the largest congestion window, in packets. The sequence
+	// window isn't negotiated, and the acknowledgements of packets older
+	// than it would be invalid.
+	maxCwnd = sequenceWindow / 2
+)
+
+// sentPacket is a data packet sent, until it's acknowledged or found lost.
+type sentPacket struct {
+	seq    seqnum48
+	sentAt time.Time
+	acked  bool
+	lost   bool
+}
+
+// ccid2 is the state of the TCP-like congestion control of the data packets a
+// connection sends, per RFC 4341. The congestion window counts packets, and the
+// receiver reports the packets it received in Ack Vector options.
+type ccid2 struct {
+	clock tcpip.Clock
+
+	// cwnd and ssthresh are the congestion window and the slow start
+	// threshold, and pipe is the number of data packets in flight, which
+	// are the ones of sent that are neither acknowledged nor lost.
+	cwnd     int
+	ssthresh int
+	pipe     int
+	sent     []sentPacket
+
+	// ackedInWindow counts the packets acknowledged in congestion
+	// avoidance, until a whole window is.
+	ackedInWindow int
+
+	// recoveryPoint is the greatest sequence number sent when the
+	// congestion window was last reduced; losses of the packets sent
+	// before it belong to the same congestion event.
+	recoveryPoint seqnum48
+
+	// The following fields hold the round trip time estimation and the
+	// retransmission timeout, whose timer runs while packets are in
+	// flight.
+	srtt         time.Duration
+	rttvar       time.Duration
+	rttMeasured  bool
+	rto          time.Duration
+	timer        tcpip.Timer
+	timerEnabled bool
+}
+
+// newCCID2 returns the congestion control state of a connection sending packets
+// of the given size at most, whose initial sequence number is iss.
+func newCCID2(clock tcpip.Clock, mss int, iss seqnum48) *ccid2 {
+	timer := clock.NewTimer(time.Hour)
+	timer.Stop()
+	return &ccid2{
+		clock: clock,
+		// The initial congestion window of RFC 4341, section 5.
+		cwnd:          min(4, max(2, 4380/mss)),
+		ssthresh:      maxCwnd,
+		recoveryPoint: iss,
+		rto:           initialRTO,
+		timer:         timer,
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// stop stops the timer.
+func (c *ccid2) stop() {
+	c.timer.Stop()
+}
+
+// canSend returns whether the congestion window allows one more data packet
+// in flight.
+func (c *ccid2) canSend() bool {
+	return c.pipe < c.cwnd
+}
+
+// onSent records the data packet seq, which was just sent.
+func (c *ccid2) onSent(seq seqnum48) {
+	c.sent = append(c.sent, sentPacket{seq: seq, sentAt: c.clock.Now()})
+	c.pipe++
+	if !c.timerEnabled {
+		c.timerEnabled = true
+		c.timer.Reset(c.rto)
+	}
+}
+
+// find returns the data packet seq, or nil if it's not in flight anymore.
+func (c *ccid2) find(seq seqnum48) *sentPacket {
+	i := sort.Search(len(c.sent), func(i int) bool {
+		return !c.sent[i].seq.lessThan(seq)
+	})
+	if i == len(c.sent) || c.sent[i].seq != seq {
+		return nil
+	}
+	return &c.sent[i]
+}
+
+// onAck handles the acknowledgement of the packets the Ack Vector options of h
+// report as received, and detects the losses they reveal. r is the route the
+// losses are counted in the stats of.
+func (c *ccid2) onAck(r *stack.Route, h header.DCCP) {
+	ack := seqnum48(h.AckNumber())
+	progress := false
+
+	for opts := h.Options(); len(opts) > 0; {
+		t, v, rest, ok := header.NextDCCPOption(opts)
+		if !ok {
+			break
+		}
+		opts = rest
+		if t != header.DCCPOptionAckVector0 && t != header.DCCPOptionAckVector1 {
+			continue
+		}
+
+		// Each byte describes a run of packets, from the
+		// acknowledgement number backwards.
+		seq := ack
+		for _, b := range v {
+			state, runLength := header.ParseDCCPAckVectorByte(b)
+			for i := 0; i <= int(runLength); i++ {
+				if state != header.DCCPAckVectorNotReceived && c.acked(seq, seq == ack) {
+					progress = true
+				}
+				seq = seq.add(-1)
+			}
+		}
+	}
+
+	if !progress {
+		return
+	}
+	c.detectLosses(r)
+
+	// Restart the timer, since the peer is making progress.
+	c.stopTimer()
+	if c.pipe > 0 {
+		c.timerEnabled = true
+		c.timer.Reset(c.rto)
+	}
+}
+
+// acked handles the acknowledgement of the data packet seq, which measures the
+// round trip time if it was the latest packet the peer received. It returns
+// false if the packet wasn't in flight.
+func (c *ccid2) acked(seq seqnum48, latest bool) bool {
+	p := c.find(seq)
+	if p == nil || p.acked || p.lost {
+		return false
+	}
+	p.acked = true
+	c.pipe--
+
+	if latest {
+		c.updateRTO(c.clock.Now().Sub(p.sentAt))
+	}
+
+	// Grow the congestion window, per RFC 4341, section 5.1.
+	if c.cwnd < c.ssthresh {
+		c.cwnd++
+	} else {
+		c.ackedInWindow++
+		if c.ackedInWindow >= c.cwnd {
+			c.ackedInWindow = 0
+			c.cwnd++
+		}
+	}
+	if c.cwnd > maxCwnd {
+		c.cwnd = maxCwnd
+	}
+	return true
+}
+
+// detectLosses finds the data packets lost: the ones at least numDupAck later
+// packets were acknowledged after. The congestion window is halved once per
+// congestion event.
+func (c *ccid2) detectLosses(r *stack.Route) {
+	acked := 0
+	for i := len(c.sent) - 1; i >= 0; i-- {
+		p := &c.sent[i]
+		switch {
+		case p.acked:
+			acked++
+
+		case !p.lost && acked >= numDupAck:
+			p.lost = true
+			c.pipe--
+			atomic.AddUint64(&r.Stats().DCCP.PacketsLost, 1)
+
+			if c.recoveryPoint.lessThan(p.seq) {
+				c.ssthresh = max(c.cwnd/2, 2)
+				c.cwnd = c.ssthresh
+				c.ackedInWindow = 0
+				c.recoveryPoint = c.sent[len(c.sent)-1].seq
+			}
+		}
+	}
+
+	// Forget the packets at the front that aren't in flight anymore.
+	i := 0
+	for i < len(c.sent) && (c.sent[i].acked || c.sent[i].lost) {
+		i++
+	}
+	c.sent = c.sent[i:]
+}
+
+// timeout handles the expiration of the timer: all the packets in flight are
+// considered lost, and the congestion window starts over from one packet, per
+// RFC 4341, section 5.
+func (c *ccid2) timeout(r *stack.Route) {
+	c.timerEnabled = false
+	if c.pipe == 0 {
+		return
+	}
+
+	atomic.AddUint64(&r.Stats().DCCP.PacketsLost, uint64(c.pipe))
+	c.ssthresh = max(c.cwnd/2, 2)
+	c.cwnd = 1
+	c.ackedInWindow = 0
+	c.pipe = 0
+	c.recoveryPoint = c.sent[len(c.sent)-1].seq
+	c.sent = nil
+	c.rto = minDuration(2*c.rto, maxRTO)
+}
+
+// stopTimer stops the timer, and drains its channel.
+func (c *ccid2) stopTimer() {
+	if !c.timerEnabled {
+		return
+	}
+	c.timerEnabled = false
+	c.timer.Stop()
+	select {
+	case <-c.timer.C():
+	default:
+	}
+}
+
+// updateRTO updates the retransmission timeout with the round trip time
+// measurement r, as TCP does.
+func (c *ccid2) updateRTO(r time.Duration) {
+	if !c.rttMeasured {
+		c.rttMeasured = true
+		c.srtt = r
+		c.rttvar = r / 2
+	} else {
+		delta := c.srtt - r
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttvar = (3*c.rttvar + delta) / 4
+		c.srtt = (7*c.srtt + r) / 8
+	}
+
+	c.rto = c.srtt + 4*c.rttvar
+	if c.rto < minRTO {
+		c.rto = minRTO
+	}
+	if c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,379 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	// ackRatio is the number of data packets received after which an Ack
+	// packet is sent, at most, per RFC 4341, section 6.1.2.
+	ackRatio = 2
+
+	// ackHistorySize is the number of packets, up to the greatest one
+	// received, whose reception the Ack Vector options report.
+	ackHistorySize = 256
+
+	// maxAckVectorSize is the largest size of the Ack Vector options sent,
+	// without their header.
+	maxAckVectorSize = 64
+)
+
+// ackHistory records which packets were received among the ackHistorySize
+// packets up to the greatest sequence number received, for the Ack Vector
+// options of the Ack packets. Bit i of the history is the packet i before the
+// greatest sequence number.
+type ackHistory [ackHistorySize / 64]uint64
+
+// advance moves the greatest sequence number n packets forward.
+func (h *ackHistory) advance(n int64) {
+	if n >= ackHistorySize {
+		*h = ackHistory{}
+		return
+	}
+	words, shift := int(n/64), uint(n%64)
+	for i := len(h) - 1; i >= 0; i-- {
+		var v uint64
+		if j := i - words; j >= 0 {
+			v = h[j] << shift
+			if shift != 0 && j > 0 {
+				v |= h[j-1] >> (64 - shift)
+			}
+		}
+		h[i] = v
+	}
+}
+
+// set records that packet i was received.
+func (h *ackHistory) set(i int64) {
+	if i >= 0 && i < ackHistorySize {
+		h[i/64] |= 1 << uint(i%64)
+	}
+}
+
+// get returns whether packet i was received.
+func (h *ackHistory) get(i int) bool {
+	return h[i/64]&(1<<uint(i%64)) != 0
+}
+
+// ackVector returns the Ack Vector option describing the first n packets of
+// the history.
+func (h *ackHistory) ackVector(n int) []byte {
+	opt := []byte{header.DCCPOptionAckVector0, 2}
+	for i := 0; i < n && len(opt)-2 < maxAckVectorSize; {
+		received := h.get(i)
+		run := 1
+		for i+run < n && run <= header.DCCPAckVectorMaxRunLength && h.get(i+run) == received {
+			run++
+		}
+
+		state := uint8(header.DCCPAckVectorReceived)
+		if !received {
+			state = header.DCCPAckVectorNotReceived
+		}
+		opt = append(opt, header.DCCPAckVectorByte(state, uint8(run-1)))
+		i += run
+	}
+	opt[1] = uint8(len(opt))
+	return opt
+}
+
+// connection is the state of a DCCP connection, from the point of view of one
+// of its endpoints.
+type connection struct {
+	e *endpoint
+
+	// The sequence numbers of RFC 4340, section 7.1: the initial ones of
+	// both ends, the greatest one sent and received, and the greatest
+	// acknowledgement number received.
+	iss seqnum48
+	isr seqnum48
+	gss seqnum48
+	gsr seqnum48
+	gar seqnum48
+
+	// partOpen is set on the client until it receives a packet other than
+	// a Response, which tells it the server got its acknowledgement; its
+	// data packets carry acknowledgements until then, per RFC 4340,
+	// section 8.1.5.
+	partOpen bool
+
+	// history records the packets received, and unacked is the number
+	// of data packets received since the last Ack packet.
+	history ackHistory
+	unacked int
+
+	// cc is the congestion control of the data packets sent.
+	cc *ccid2
+
+	// closing is set once the connection sent its Close packet, and
+	// closeTimer is the timer of the retransmissions of the packet.
+	closing          bool
+	closeTimer       tcpip.Timer
+	closeRTO         time.Duration
+	closeRetransmits int
+}
+
+// randomSeqnum returns a random initial sequence number.
+func randomSeqnum() (seqnum48, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return seqnum48(binary.BigEndian.Uint64(b[:]) & seqnum48Mask), nil
+}
+
+// newConnection returns the state of a connection of e, whose initial sequence
+// number is iss. The initial sequence number of the peer is set once it's
+// known.
+func newConnection(e *endpoint, iss seqnum48) *connection {
+	mss := int(e.route.MTU()) - header.DCCPHeaderSize(header.DCCPData)
+	closeTimer := e.stack.Clock().NewTimer(time.Hour)
+	closeTimer.Stop()
+	return &connection{
+		e:          e,
+		iss:        iss,
+		gss:        iss,
+		gar:        iss,
+		cc:         newCCID2(e.stack.Clock(), mss, iss),
+		closeTimer: closeTimer,
+		closeRTO:   initialRTO,
+	}
+}
+
+// setPeer sets the initial sequence number of the peer.
+func (c *connection) setPeer(isr seqnum48) {
+	c.isr = isr
+	c.gsr = isr
+	c.history = ackHistory{}
+	c.history.set(0)
+}
+
+// stop stops the timers of the connection.
+func (c *connection) stop() {
+	c.cc.stop()
+	c.closeTimer.Stop()
+}
+
+// send sends a packet with the fields f, options and payload to the peer, with
+// the next sequence number.
+func (c *connection) send(f *header.DCCPFields, options []byte, payload buffer.View) seqnum48 {
+	c.gss = c.gss.add(1)
+	f.SeqNum = uint64(c.gss)
+	sendPacket(&c.e.route, c.e.id, f, options, payload)
+	return c.gss
+}
+
+// sendAck sends an Ack packet, with an Ack Vector option reporting the recent
+// packets received.
+func (c *connection) sendAck() {
+	c.unacked = 0
+	n := int(c.gsr.sub(c.isr)) + 1
+	if n > ackHistorySize {
+		n = ackHistorySize
+	}
+	c.send(&header.DCCPFields{Type: header.DCCPAck, AckNum: uint64(c.gsr)}, c.history.ackVector(n), nil)
+}
+
+// sendReset sends a Reset packet with the given code.
+func (c *connection) sendReset(code header.DCCPResetCode) {
+	c.send(&header.DCCPFields{Type: header.DCCPReset, AckNum: uint64(c.gsr), ResetCode: code}, nil, nil)
+}
+
+// sendClose sends the Close packet of the connection, and starts the timer of
+// its retransmissions. Both ends close connections with Close packets: servers
+// don't ask clients to with CloseReq packets, since endpoints don't hold the
+// TIMEWAIT state.
+func (c *connection) sendClose() {
+	c.send(&header.DCCPFields{Type: header.DCCPClose, AckNum: uint64(c.gsr)}, nil, nil)
+	c.closing = true
+	c.closeTimer.Reset(c.closeRTO)
+}
+
+// closeTimerExpired retransmits the Close packet the peer didn't answer. It
+// returns false if the peer must be considered unreachable instead.
+func (c *connection) closeTimerExpired() bool {
+	c.closeRetransmits++
+	if c.closeRetransmits > maxRetransmits {
+		return false
+	}
+	c.closeRTO = minDuration(2*c.closeRTO, maxRTO)
+	c.sendClose()
+	return true
+}
+
+// sendData sends the datagrams queued by the endpoint as the congestion window
+// allows.
+func (c *connection) sendData() {
+	e := c.e
+	sent := false
+	for c.cc.canSend() {
+		e.sndMu.Lock()
+		if len(e.sndQueue) == 0 {
+			e.sndMu.Unlock()
+			break
+		}
+		v := e.sndQueue[0]
+		e.sndQueue[0] = nil
+		e.sndQueue = e.sndQueue[1:]
+		e.sndBufUsed -= len(v)
+		e.sndMu.Unlock()
+
+		f := header.DCCPFields{Type: header.DCCPData}
+		if c.partOpen {
+			f.Type = header.DCCPDataAck
+			f.AckNum = uint64(c.gsr)
+		}
+		c.cc.onSent(c.send(&f, nil, v))
+		sent = true
+	}
+
+	if sent {
+		e.waiterQueue.Notify(waiter.EventOut)
+	}
+}
+
+// sendQueueEmpty returns whether all the datagrams the endpoint queued were
+// sent.
+func (c *connection) sendQueueEmpty() bool {
+	c.e.sndMu.Lock()
+	defer c.e.sndMu.Unlock()
+	return len(c.e.sndQueue) == 0
+}
+
+// validSeq returns whether seq is in the range of valid sequence numbers of
+// the packets of the peer, per RFC 4340, section 7.5.1.
+func (c *connection) validSeq(seq seqnum48) bool {
+	swl := max48(c.gsr.add(1-sequenceWindow/4), c.isr)
+	swh := c.gsr.add((3*sequenceWindow + 3) / 4)
+	return seq.inRange(swl, swh)
+}
+
+// validAck returns whether ack is in the range of valid acknowledgement
+// numbers of the packets of the peer, per RFC 4340, section 7.5.1.
+func (c *connection) validAck(ack seqnum48) bool {
+	awl := max48(c.gss.add(1-sequenceWindow), c.iss)
+	return ack.inRange(awl, c.gss)
+}
+
+// received records the reception of the valid packet seq.
+func (c *connection) received(seq seqnum48) {
+	if d := seq.sub(c.gsr); d > 0 {
+		c.history.advance(d)
+		c.gsr = seq
+		c.history.set(0)
+	} else {
+		c.history.set(-d)
+	}
+}
+
+// handlePacket handles a packet of the peer, per RFC 4340, section 8.5. It
+// returns true once the connection is closed, with the error that reset it, if
+// any.
+func (c *connection) handlePacket(p *packet) (bool, error) {
+	h := p.header()
+	t := h.Type()
+	seq := seqnum48(h.SequenceNumber())
+	hasAck := t != header.DCCPRequest && t != header.DCCPData
+	ack := seqnum48(h.AckNumber())
+	stats := &p.route.Stats().DCCP
+
+	// Sync and SyncAck packets only need a valid acknowledgement number,
+	// and resynchronize the sequence numbers of the peer.
+	if t == header.DCCPSync || t == header.DCCPSyncAck {
+		if !c.validAck(ack) || seq.lessThan(max48(c.gsr.add(1-sequenceWindow/4), c.isr)) {
+			atomic.AddUint64(&stats.InvalidSequencePackets, 1)
+			return false, nil
+		}
+		c.received(seq)
+		c.gar = max48(c.gar, ack)
+		if t == header.DCCPSync {
+			c.send(&header.DCCPFields{Type: header.DCCPSyncAck, AckNum: uint64(seq)}, nil, nil)
+		}
+		return false, nil
+	}
+
+	if !c.validSeq(seq) || hasAck && !c.validAck(ack) {
+		// Tell the peer which sequence numbers we expect.
+		atomic.AddUint64(&stats.InvalidSequencePackets, 1)
+		c.send(&header.DCCPFields{Type: header.DCCPSync, AckNum: uint64(seq)}, nil, nil)
+		return false, nil
+	}
+
+	c.received(seq)
+	if hasAck {
+		c.gar = max48(c.gar, ack)
+	}
+	if t != header.DCCPResponse {
+		c.partOpen = false
+	}
+
+	switch t {
+	case header.DCCPData, header.DCCPDataAck:
+		c.unacked++
+		if payload := h.Payload(); len(payload) > 0 {
+			c.e.queueReceived(p, payload)
+		}
+		if t == header.DCCPDataAck {
+			c.cc.onAck(&p.route, h)
+		}
+
+	case header.DCCPAck:
+		c.cc.onAck(&p.route, h)
+
+	case header.DCCPResponse:
+		// The server didn't get our acknowledgement.
+		if c.partOpen {
+			c.sendAck()
+		}
+
+	case header.DCCPCloseReq:
+		if !c.closing {
+			c.sendClose()
+		}
+
+	case header.DCCPClose:
+		c.sendReset(header.DCCPResetClosed)
+		return true, nil
+
+	case header.DCCPReset:
+		if c.closing && h.ResetCode() == header.DCCPResetClosed {
+			return true, nil
+		}
+		atomic.AddUint64(&stats.ResetsReceived, 1)
+		return true, tcpip.ErrConnectionReset
+	}
+
+	return false, nil
+}
+
+// queueReceived queues the payload of the data packet p for reading, unless
+// the receive buffer is full, and notifies the waiters.
+func (e *endpoint) queueReceived(p *packet, payload []byte) {
+	e.rcvMu.Lock()
+	if e.rcvClosed {
+		e.rcvMu.Unlock()
+		return
+	}
+	if e.rcvBufUsed+len(payload) > e.rcvBufSize {
+		e.rcvMu.Unlock()
+		atomic.AddUint64(&p.route.Stats().DCCP.ReceiveBufferErrors, 1)
+		return
+	}
+	e.rcvList = append(e.rcvList, buffer.View(payload))
+	e.rcvBufUsed += len(payload)
+	e.rcvMu.Unlock()
+
+	e.waiterQueue.Notify(waiter.EventIn)
+}
@@ -0,0 +1,289 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import (
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/waiter"
+)
+
+// completeWorker is called by the worker goroutine when it's about to exit. It
+// marks the worker as completed and performs cleanup work if requested by
+// Close().
+func (e *endpoint) completeWorker() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.workerRunning = false
+	if e.workerCleanup {
+		e.cleanup()
+	}
+}
+
+// protocolMainLoop is the main loop of the protocol goroutine of an endpoint's
+// connection. Active endpoints set their connection up first, while the ones of
+// passive endpoints were set up when they were accepted.
+func (e *endpoint) protocolMainLoop(passive bool) {
+	defer func() {
+		e.waiterQueue.Notify(waiter.EventIn | waiter.EventOut | waiter.EventErr | waiter.EventHUp)
+		e.completeWorker()
+	}()
+
+	if !passive {
+		c, err := e.handshake()
+		if err != nil {
+			e.lastErrorMu.Lock()
+			e.lastError = err
+			e.lastErrorMu.Unlock()
+
+			e.mu.Lock()
+			e.state = stateError
+			e.hardError = err
+			e.mu.Unlock()
+			return
+		}
+
+		// Tell waiters that the endpoint is connected and writable.
+		e.mu.Lock()
+		e.conn = c
+		e.state = stateConnected
+		e.mu.Unlock()
+
+		e.waiterQueue.Notify(waiter.EventOut)
+	}
+
+	c := e.conn
+	err := c.run()
+	c.stop()
+
+	e.rcvMu.Lock()
+	e.rcvClosed = true
+	e.rcvMu.Unlock()
+
+	e.mu.Lock()
+	if err != nil {
+		e.state = stateError
+		e.hardError = err
+	} else {
+		e.state = stateClosed
+	}
+	e.mu.Unlock()
+}
+
+// handshake sets the connection of an active endpoint up, per RFC 4340,
+// section 8.1.1: it sends Request packets until the peer answers with a
+// Response packet, and acknowledges it.
+func (e *endpoint) handshake() (*connection, error) {
+	iss, err := randomSeqnum()
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.RLock()
+	serviceCode := e.serviceCode
+	e.mu.RUnlock()
+
+	// Each Request packet has its own sequence number, starting with the
+	// initial one.
+	c := newConnection(e, iss.add(-1))
+	c.iss = iss
+
+	request := func() {
+		c.send(&header.DCCPFields{Type: header.DCCPRequest, ServiceCode: serviceCode}, nil, nil)
+	}
+	request()
+
+	rto := initialRTO
+	retransmits := 0
+	timer := e.stack.Clock().NewTimer(rto)
+	defer timer.Stop()
+
+	for {
+		select {
+		case p := <-e.segmentChan:
+			h := p.header()
+			p.route.Release()
+
+			// The packets of the peer must acknowledge one of our
+			// Request packets.
+			t := h.Type()
+			if t == header.DCCPRequest || t == header.DCCPData || !seqnum48(h.AckNumber()).inRange(c.iss, c.gss) {
+				continue
+			}
+
+			switch t {
+			case header.DCCPResponse:
+				if h.ServiceCode() != serviceCode {
+					c.setPeer(seqnum48(h.SequenceNumber()))
+					c.sendReset(header.DCCPResetBadServiceCode)
+					c.stop()
+					return nil, tcpip.ErrConnectionRefused
+				}
+
+				c.setPeer(seqnum48(h.SequenceNumber()))
+				c.gar = seqnum48(h.AckNumber())
+				c.partOpen = true
+				c.sendAck()
+				return c, nil
+
+			case header.DCCPReset:
+				c.stop()
+				return nil, tcpip.ErrConnectionRefused
+			}
+
+		case <-timer.C():
+			retransmits++
+			if retransmits > maxRetransmits {
+				c.stop()
+				return nil, tcpip.ErrTimeout
+			}
+
+			rto = minDuration(2*rto, maxRTO)
+			request()
+			timer.Reset(rto)
+
+		case <-e.notifyChan:
+			n := e.fetchNotifications()
+			if n&notifyAbort != 0 {
+				c.stop()
+				return nil, tcpip.ErrConnectionAborted
+			}
+			if n&notifyClose != 0 {
+				c.stop()
+				return nil, tcpip.ErrAborted
+			}
+		}
+	}
+}
+
+// passiveHandshake completes the setting up of the connection of an endpoint
+// its listener created for a Request packet, per RFC 4340, section 8.1.2: it
+// sends Response packets until the peer acknowledges one.
+func (e *endpoint) passiveHandshake() error {
+	c := e.conn
+	response := func() {
+		c.send(&header.DCCPFields{Type: header.DCCPResponse, AckNum: uint64(c.gsr), ServiceCode: e.serviceCode}, nil, nil)
+	}
+	response()
+
+	rto := initialRTO
+	retransmits := 0
+	timer := e.stack.Clock().NewTimer(rto)
+	defer timer.Stop()
+
+	for {
+		select {
+		case p := <-e.segmentChan:
+			h := p.header()
+			switch t := h.Type(); t {
+			case header.DCCPRequest:
+				// The peer didn't get our Response packet.
+				if seq := seqnum48(h.SequenceNumber()); c.gsr.lessThan(seq) {
+					c.received(seq)
+					response()
+				}
+				p.route.Release()
+
+			case header.DCCPAck, header.DCCPDataAck:
+				if !c.validAck(seqnum48(h.AckNumber())) {
+					p.route.Release()
+					continue
+				}
+
+				// The packet is handled again once the connection
+				// is accepted, since it may carry data.
+				select {
+				case e.segmentChan <- p:
+				default:
+					p.route.Release()
+				}
+				return nil
+
+			case header.DCCPReset:
+				p.route.Release()
+				if c.validAck(seqnum48(h.AckNumber())) {
+					return tcpip.ErrConnectionReset
+				}
+
+			default:
+				p.route.Release()
+			}
+
+		case <-timer.C():
+			retransmits++
+			if retransmits > maxRetransmits {
+				return tcpip.ErrTimeout
+			}
+
+			rto = minDuration(2*rto, maxRTO)
+			response()
+			timer.Reset(rto)
+		}
+	}
+}
+
+// run handles the established connection until it's closed or reset. It
+// returns the error that reset it, if any.
+func (c *connection) run() error {
+	e := c.e
+
+	// Datagrams may have been queued, and the write end shut down, before
+	// the goroutine started.
+	c.sendData()
+	e.sndMu.Lock()
+	closePending := e.sndClosed
+	e.sndMu.Unlock()
+
+	for {
+		// The connection is closed once the queued datagrams are sent.
+		if closePending && !c.closing && c.sendQueueEmpty() {
+			c.sendClose()
+		}
+
+		select {
+		case p := <-e.segmentChan:
+			done, err := c.handlePacket(p)
+			p.route.Release()
+			if done {
+				return err
+			}
+
+			// Acknowledge the data packets once there are enough of
+			// them, or once there are no more to handle.
+			if c.unacked >= ackRatio || c.unacked > 0 && len(e.segmentChan) == 0 {
+				c.sendAck()
+			}
+
+			// The acknowledgements may have opened the congestion
+			// window.
+			c.sendData()
+
+		case <-e.sndChan:
+			c.sendData()
+
+		case <-e.notifyChan:
+			n := e.fetchNotifications()
+			if n&notifyAbort != 0 {
+				// The route to the peer is gone, so the Reset
+				// packet couldn't be sent either.
+				return tcpip.ErrConnectionAborted
+			}
+			if n&(notifyShutdownWrite|notifyClose) != 0 {
+				closePending = true
+			}
+
+		case <-c.cc.timer.C():
+			c.cc.timeout(&e.route)
+			c.sendData()
+
+		case <-c.closeTimer.C():
+			if !c.closeTimerExpired() {
+				c.sendReset(header.DCCPResetAborted)
+				return tcpip.ErrTimeout
+			}
+		}
+	}
+}
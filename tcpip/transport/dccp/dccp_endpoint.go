@@ -0,0 +1,863 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/ports"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/waiter"
+)
+
+type endpointState int
+
+const (
+	stateInitial endpointState = iota
+	stateBound
+	stateListen
+	stateConnecting
+	stateConnected
+	stateClosed
+	stateError
+)
+
+// String implements fmt.Stringer.String.
+func (s endpointState) String() string {
+	switch s {
+	case stateInitial:
+		return "initial"
+	case stateBound:
+		return "bound"
+	case stateListen:
+		return "listen"
+	case stateConnecting:
+		return "connecting"
+	case stateConnected:
+		return "connected"
+	case stateClosed:
+		return "closed"
+	case stateError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// Flags that can be passed to the protocol goroutine with
+// notifyProtocolGoroutine.
+const (
+	notifyClose = 1 << iota
+	notifyShutdownWrite
+	notifyAbort
+)
+
+// segmentChanSize is the number of received packets queued to an endpoint
+// until its protocol goroutine handles them; more packets are dropped.
+const segmentChanSize = 128
+
+// endpoint represents a DCCP endpoint. This struct serves as the interface
+// between users of the endpoint and the protocol implementation; it is legal to
+// have concurrent goroutines make calls into the endpoint, they are properly
+// synchronized. The protocol implementation, however, runs in a single
+// goroutine.
+type endpoint struct {
+	// The following fields are initialized at creation time and do not
+	// change throughout the lifetime of the endpoint.
+	stack       *stack.Stack
+	netProto    tcpip.NetworkProtocolNumber
+	waiterQueue *waiter.Queue
+
+	// The following fields are used to manage the receive queue, and are
+	// protected by rcvMu. rcvBufUsed is the size of the queued datagrams.
+	rcvMu      sync.Mutex
+	rcvList    []buffer.View
+	rcvBufSize int
+	rcvBufUsed int
+	rcvClosed  bool
+
+	// The following fields are used to manage the send queue, and are
+	// protected by sndMu. sndBufUsed is the size of the datagrams queued
+	// until the congestion window lets them be sent.
+	sndMu      sync.Mutex
+	sndQueue   []buffer.View
+	sndBufSize int
+	sndBufUsed int
+	sndClosed  bool
+
+	// The following fields are protected by mu.
+	mu             sync.RWMutex
+	id             stack.TransportEndpointID
+	state          endpointState
+	boundNICID     tcpip.NICID
+	route          stack.Route
+	reuseAddr      bool
+	isRegistered   bool
+	isPortReserved bool
+	reservedAddr   tcpip.Address
+	hardError      error
+	serviceCode    uint32
+
+	// acceptedChan is used by a listening endpoint to send newly accepted
+	// connections to the endpoint so that they can be read by Accept()
+	// calls.
+	acceptedChan chan *endpoint
+
+	// workerRunning specifies if a worker goroutine is running, and
+	// workerCleanup whether it must clean the endpoint up when it stops.
+	workerRunning bool
+	workerCleanup bool
+
+	// lastError is the error of the failed connection attempt, reported
+	// once by GetSockOpt(tcpip.ErrorOption).
+	lastErrorMu sync.Mutex
+	lastError   error
+
+	// The following channels are used to wake the protocol goroutine up:
+	// segmentChan for received packets, sndChan for queued datagrams and
+	// notifyChan for the flags set with notifyProtocolGoroutine.
+	segmentChan chan *packet
+	sndChan     chan struct{}
+	notifyChan  chan struct{}
+	notifyFlags uint32
+
+	// conn is the state of the connection, which is only accessed by the
+	// protocol goroutine, once it's started.
+	conn *connection
+}
+
+func newEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) *endpoint {
+	d := endpointDefaults(stack)
+	return &endpoint{
+		stack:       stack,
+		netProto:    netProto,
+		waiterQueue: waiterQueue,
+		rcvBufSize:  d.ReceiveBufferSize.Default,
+		sndBufSize:  d.SendBufferSize.Default,
+		reuseAddr:   d.ReuseAddress,
+		segmentChan: make(chan *packet, segmentChanSize),
+		sndChan:     make(chan struct{}, 1),
+		notifyChan:  make(chan struct{}, 1),
+	}
+}
+
+func (e *endpoint) fetchNotifications() uint32 {
+	return atomic.SwapUint32(&e.notifyFlags, 0)
+}
+
+func (e *endpoint) notifyProtocolGoroutine(n uint32) {
+	for {
+		v := atomic.LoadUint32(&e.notifyFlags)
+		if v&n == n {
+			// The flags are already set.
+			return
+		}
+
+		if atomic.CompareAndSwapUint32(&e.notifyFlags, v, v|n) {
+			if v == 0 {
+				// We are causing a transition from no flags to
+				// at least one flag set, so we must cause the
+				// protocol goroutine to wake up.
+				select {
+				case e.notifyChan <- struct{}{}:
+				default:
+				}
+			}
+			return
+		}
+	}
+}
+
+// Close puts the endpoint in a closed state and frees all resources associated
+// with it. An established connection is closed gracefully first, once the
+// datagrams queued for sending are sent. It must be called only once and with
+// no other concurrent calls to the endpoint.
+func (e *endpoint) Close() {
+	e.Shutdown(tcpip.ShutdownWrite | tcpip.ShutdownRead)
+
+	// While we hold the lock, determine if the cleanup should happen
+	// inline or if we should tell the worker (if any) to do the cleanup.
+	e.mu.Lock()
+	worker := e.workerRunning
+	if worker {
+		e.workerCleanup = true
+	}
+	e.mu.Unlock()
+
+	if !worker {
+		e.cleanup()
+	} else {
+		e.notifyProtocolGoroutine(notifyClose)
+	}
+}
+
+// cleanup frees all resources associated with the endpoint. It is called after
+// Close() is called and the worker goroutine (if any) is done with its work.
+func (e *endpoint) cleanup() {
+	// Reset the connections that were set up by the listener but not
+	// accepted.
+	if e.acceptedChan != nil {
+		close(e.acceptedChan)
+		for n := range e.acceptedChan {
+			n.abortUnaccepted()
+		}
+	}
+
+	e.rcvMu.Lock()
+	e.rcvList = nil
+	e.rcvBufUsed = 0
+	e.rcvMu.Unlock()
+
+	e.sndMu.Lock()
+	e.sndQueue = nil
+	e.sndBufUsed = 0
+	e.sndMu.Unlock()
+
+	if e.isPortReserved {
+		e.stack.ReleasePort(e.netProto, ProtocolNumber, e.reservedAddr, e.id.LocalPort)
+	}
+
+	if e.isRegistered {
+		e.stack.UnregisterTransportEndpoint(e.boundNICID, ProtocolNumber, e.id)
+	}
+
+	e.route.Release()
+
+	// Drop the packets that were never handled.
+	for {
+		select {
+		case p := <-e.segmentChan:
+			p.route.Release()
+		default:
+			return
+		}
+	}
+}
+
+// Read reads the next datagram from the endpoint. This method does not block if
+// there is no datagram pending.
+func (e *endpoint) Read(*tcpip.FullAddress) (buffer.View, error) {
+	e.mu.RLock()
+	state, hardError := e.state, e.hardError
+	e.mu.RUnlock()
+
+	switch state {
+	case stateConnected, stateClosed, stateError:
+	default:
+		return buffer.View{}, tcpip.ErrInvalidEndpointState
+	}
+
+	e.rcvMu.Lock()
+	defer e.rcvMu.Unlock()
+
+	if len(e.rcvList) == 0 {
+		switch {
+		case state == stateError:
+			return buffer.View{}, hardError
+		case e.rcvClosed || state == stateClosed:
+			return buffer.View{}, tcpip.ErrClosedForReceive
+		}
+		return buffer.View{}, tcpip.ErrWouldBlock
+	}
+
+	v := e.rcvList[0]
+	e.rcvList[0] = nil
+	e.rcvList = e.rcvList[1:]
+	e.rcvBufUsed -= len(v)
+
+	return v, nil
+}
+
+// RecvMsg implements tcpip.RecvMsg.
+func (e *endpoint) RecvMsg(addr *tcpip.FullAddress) (buffer.View, tcpip.ControlMessages, error) {
+	v, err := e.Read(addr)
+	return v, nil, err
+}
+
+// Write queues v as a datagram, sent once the congestion window allows. This
+// method does not block if the datagram cannot be queued.
+func (e *endpoint) Write(v buffer.View, to *tcpip.FullAddress) (uintptr, error) {
+	if to != nil {
+		return 0, tcpip.ErrAlreadyConnected
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	// The endpoint cannot be written to if it's not connected.
+	if e.state != stateConnected {
+		switch e.state {
+		case stateError:
+			return 0, e.hardError
+		case stateClosed:
+			return 0, tcpip.ErrClosedForSend
+		default:
+			return 0, tcpip.ErrInvalidEndpointState
+		}
+	}
+
+	// Datagrams can't be empty, and must fit in a single Data packet.
+	if len(v) == 0 {
+		return 0, tcpip.ErrInvalidEndpointState
+	}
+	if len(v) > int(e.route.MTU())-header.DCCPHeaderSize(header.DCCPData) {
+		return 0, tcpip.ErrMessageTooLong
+	}
+
+	e.sndMu.Lock()
+	defer e.sndMu.Unlock()
+
+	switch {
+	case e.sndClosed:
+		return 0, tcpip.ErrClosedForSend
+	case len(v) > e.sndBufSize:
+		return 0, tcpip.ErrMessageTooLong
+	case e.sndBufUsed+len(v) > e.sndBufSize:
+		return 0, tcpip.ErrWouldBlock
+	}
+
+	e.sndQueue = append(e.sndQueue, v)
+	e.sndBufUsed += len(v)
+
+	// Wake up the protocol goroutine.
+	select {
+	case e.sndChan <- struct{}{}:
+	default:
+	}
+
+	return uintptr(len(v)), nil
+}
+
+// SendMsg implements tcpip.SendMsg.
+func (e *endpoint) SendMsg(v buffer.View, c tcpip.ControlMessages, to *tcpip.FullAddress) (uintptr, error) {
+	// Reject control messages.
+	if c != nil {
+		// tcpip.ErrInvalidEndpointState turns into syscall.EINVAL.
+		return 0, tcpip.ErrInvalidEndpointState
+	}
+	return e.Write(v, to)
+}
+
+// Peek writes the next datagram to w without consuming it.
+func (e *endpoint) Peek(w io.Writer) (uintptr, error) {
+	e.rcvMu.Lock()
+	defer e.rcvMu.Unlock()
+
+	if len(e.rcvList) == 0 {
+		if e.rcvClosed {
+			return 0, tcpip.ErrClosedForReceive
+		}
+		return 0, tcpip.ErrWouldBlock
+	}
+
+	n, err := w.Write(e.rcvList[0])
+	return uintptr(n), err
+}
+
+// Readiness returns the current readiness of the endpoint. For example, if
+// waiter.EventIn is set, the endpoint is immediately readable.
+func (e *endpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
+	result := waiter.EventMask(0)
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if (mask & waiter.EventErr) != 0 {
+		e.lastErrorMu.Lock()
+		if e.lastError != nil {
+			result |= waiter.EventErr
+		}
+		e.lastErrorMu.Unlock()
+	}
+
+	switch e.state {
+	case stateInitial, stateBound, stateConnecting:
+		// Ready for nothing.
+
+	case stateClosed, stateError:
+		// Ready for anything, but only failed connections report an
+		// error.
+		result |= mask &^ waiter.EventErr
+		if e.state == stateError {
+			result |= mask & waiter.EventErr
+		}
+
+	case stateListen:
+		// Check if there's anything in the accepted channel.
+		if (mask&waiter.EventIn) != 0 && len(e.acceptedChan) > 0 {
+			result |= waiter.EventIn
+		}
+
+	case stateConnected:
+		if (mask & waiter.EventOut) != 0 {
+			e.sndMu.Lock()
+			if e.sndClosed || e.sndBufUsed < e.sndBufSize {
+				result |= waiter.EventOut
+			}
+			e.sndMu.Unlock()
+		}
+
+		if (mask & waiter.EventIn) != 0 {
+			e.rcvMu.Lock()
+			if len(e.rcvList) > 0 || e.rcvClosed {
+				result |= waiter.EventIn
+			}
+			e.rcvMu.Unlock()
+		}
+	}
+
+	return result
+}
+
+// SetSockOpt sets a socket option. Only tcpip.ReuseAddressOption, the buffer
+// size options and ServiceCodeOption are supported; other options are ignored.
+func (e *endpoint) SetSockOpt(opt interface{}) error {
+	switch v := opt.(type) {
+	case tcpip.ReuseAddressOption:
+		e.mu.Lock()
+		e.reuseAddr = v != 0
+		e.mu.Unlock()
+
+	case tcpip.ReceiveBufferSizeOption:
+		size := endpointDefaults(e.stack).ReceiveBufferSize.Clamp(int(v))
+		e.rcvMu.Lock()
+		e.rcvBufSize = size
+		e.rcvMu.Unlock()
+
+	case tcpip.SendBufferSizeOption:
+		size := endpointDefaults(e.stack).SendBufferSize.Clamp(int(v))
+		e.sndMu.Lock()
+		e.sndBufSize = size
+		e.sndMu.Unlock()
+
+	case ServiceCodeOption:
+		if v == invalidServiceCode {
+			return tcpip.ErrInvalidOptionValue
+		}
+
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		// The service code is sent when the connection is set up.
+		if e.state != stateInitial && e.state != stateBound {
+			return tcpip.ErrInvalidEndpointState
+		}
+		e.serviceCode = uint32(v)
+	}
+
+	return nil
+}
+
+// GetSockOpt implements tcpip.Endpoint.GetSockOpt.
+func (e *endpoint) GetSockOpt(opt interface{}) error {
+	switch o := opt.(type) {
+	case tcpip.ErrorOption:
+		e.lastErrorMu.Lock()
+		err := e.lastError
+		e.lastError = nil
+		e.lastErrorMu.Unlock()
+		return err
+
+	case *tcpip.SendBufferSizeOption:
+		e.sndMu.Lock()
+		*o = tcpip.SendBufferSizeOption(e.sndBufSize)
+		e.sndMu.Unlock()
+		return nil
+
+	case *tcpip.ReceiveBufferSizeOption:
+		e.rcvMu.Lock()
+		*o = tcpip.ReceiveBufferSizeOption(e.rcvBufSize)
+		e.rcvMu.Unlock()
+		return nil
+
+	case *tcpip.ReceiveQueueSizeOption:
+		e.rcvMu.Lock()
+		*o = tcpip.ReceiveQueueSizeOption(e.rcvBufUsed)
+		e.rcvMu.Unlock()
+		return nil
+
+	case *tcpip.ReuseAddressOption:
+		e.mu.RLock()
+		v := e.reuseAddr
+		e.mu.RUnlock()
+
+		*o = 0
+		if v {
+			*o = 1
+		}
+		return nil
+
+	case *ServiceCodeOption:
+		e.mu.RLock()
+		*o = ServiceCodeOption(e.serviceCode)
+		e.mu.RUnlock()
+		return nil
+	}
+
+	return tcpip.ErrUnknownProtocolOption
+}
+
+// Connect connects the endpoint to its peer, by sending it a Request packet.
+func (e *endpoint) Connect(addr tcpip.FullAddress) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	nicid := addr.NIC
+	switch e.state {
+	case stateBound:
+		// If we're already bound to a NIC but the caller is requesting
+		// that we use a different one now, we cannot proceed.
+		if e.boundNICID == 0 {
+			break
+		}
+
+		if nicid != 0 && nicid != e.boundNICID {
+			return tcpip.ErrNoRoute
+		}
+
+		nicid = e.boundNICID
+
+	case stateInitial:
+		// Nothing to do. We'll eventually fill-in the gaps in the ID
+		// (if any) when we find a route.
+
+	case stateConnecting:
+		// A connection request has already been issued but hasn't
+		// completed yet.
+		return tcpip.ErrAlreadyConnecting
+
+	case stateConnected:
+		// The endpoint is already connected.
+		return tcpip.ErrAlreadyConnected
+
+	default:
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	// Find a route to the desired destination.
+	r, err := e.stack.FindRoute(nicid, e.id.LocalAddress, addr.Addr, e.netProto)
+	if err != nil {
+		return err
+	}
+	defer r.Release()
+
+	e.id.LocalAddress = r.LocalAddress
+	e.id.RemoteAddress = addr.Addr
+	e.id.RemotePort = addr.Port
+
+	if e.id.LocalPort != 0 {
+		// The endpoint is bound to a port, attempt to register it.
+		if err := e.stack.RegisterTransportEndpoint(nicid, ProtocolNumber, e.id, e); err != nil {
+			return err
+		}
+	} else {
+		// The endpoint doesn't have a local port yet, so try to get
+		// one. The port is reserved for the local address so that
+		// it can't be bound to by other endpoints while in use.
+		_, err := e.stack.ReserveEphemeralPort(e.netProto, ProtocolNumber, e.id.LocalAddress, e.portFlags(), e.id.RemoteAddress, e.id.RemotePort, func(p uint16) (bool, error) {
+			e.id.LocalPort = p
+			switch err := e.stack.RegisterTransportEndpoint(nicid, ProtocolNumber, e.id, e); err {
+			case nil:
+				return true, nil
+			case tcpip.ErrDuplicateAddress:
+				return false, nil
+			default:
+				return false, err
+			}
+		})
+		if err != nil {
+			return err
+		}
+
+		e.isPortReserved = true
+		e.reservedAddr = e.id.LocalAddress
+	}
+
+	e.isRegistered = true
+	e.state = stateConnecting
+	e.route = r.Clone()
+	e.boundNICID = nicid
+	e.workerRunning = true
+
+	e.stack.GoWithLabels(e.profileLabels, func() { e.protocolMainLoop(false) })
+
+	atomic.AddUint64(&r.Stats().DCCP.ActiveConnectionOpenings, 1)
+
+	return tcpip.ErrConnectStarted
+}
+
+// ConnectEndpoint is not supported.
+func (*endpoint) ConnectEndpoint(tcpip.Endpoint) error {
+	return tcpip.ErrInvalidEndpointState
+}
+
+// Shutdown closes the read and/or write end of the endpoint's connection. DCCP
+// connections can't be half-closed: closing the write end closes the whole
+// connection once the datagrams queued for sending are sent.
+func (e *endpoint) Shutdown(flags tcpip.ShutdownFlags) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch e.state {
+	case stateConnecting, stateConnected:
+		if flags&tcpip.ShutdownRead != 0 {
+			e.rcvMu.Lock()
+			wasClosed := e.rcvClosed
+			e.rcvClosed = true
+			e.rcvMu.Unlock()
+
+			if !wasClosed {
+				e.waiterQueue.Notify(waiter.EventIn)
+			}
+		}
+
+		if flags&tcpip.ShutdownWrite != 0 {
+			e.sndMu.Lock()
+			wasClosed := e.sndClosed
+			e.sndClosed = true
+			e.sndMu.Unlock()
+
+			if !wasClosed {
+				e.notifyProtocolGoroutine(notifyShutdownWrite)
+			}
+		}
+
+	case stateListen:
+		// Tell protocolListenLoop to stop.
+		if flags&tcpip.ShutdownRead != 0 {
+			e.notifyProtocolGoroutine(notifyClose)
+		}
+
+	case stateClosed, stateError:
+		// The connection is already gone.
+
+	default:
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	return nil
+}
+
+// Listen puts the endpoint in "listen" mode, which allows it to accept
+// new connections.
+func (e *endpoint) Listen(backlog int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// Endpoint must be bound before it can transition to listen mode.
+	if e.state != stateBound {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	if err := e.stack.RegisterTransportEndpoint(e.boundNICID, ProtocolNumber, e.id, e); err != nil {
+		return err
+	}
+
+	e.isRegistered = true
+	e.state = stateListen
+	e.acceptedChan = make(chan *endpoint, backlog)
+	e.workerRunning = true
+
+	e.stack.GoWithLabels(e.profileLabels, e.protocolListenLoop)
+
+	return nil
+}
+
+// profileLabels returns the pprof labels of the goroutine serving e, for
+// Stack.GoWithLabels.
+func (e *endpoint) profileLabels() []string {
+	return []string{stack.ProfileLabelProtocol, ProtocolName, stack.ProfileLabelFlow, stack.FlowLabel(e.id)}
+}
+
+// Accept returns a new endpoint if a peer has established a connection to an
+// endpoint previously set to listen mode.
+func (e *endpoint) Accept() (tcpip.Endpoint, *waiter.Queue, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	// Endpoint must be in listen state before it can accept connections.
+	if e.state != stateListen {
+		return nil, nil, tcpip.ErrInvalidEndpointState
+	}
+
+	// Get the new accepted endpoint.
+	var n *endpoint
+	select {
+	case n = <-e.acceptedChan:
+	default:
+		return nil, nil, tcpip.ErrWouldBlock
+	}
+
+	// Start the protocol goroutine.
+	wq := &waiter.Queue{}
+	n.startAcceptedLoop(wq)
+
+	return n, wq, nil
+}
+
+// startAcceptedLoop sets up required state and starts a goroutine with the
+// main loop for accepted connections.
+func (e *endpoint) startAcceptedLoop(waiterQueue *waiter.Queue) {
+	e.mu.Lock()
+	e.waiterQueue = waiterQueue
+	e.workerRunning = true
+	e.mu.Unlock()
+
+	e.stack.GoWithLabels(e.profileLabels, func() { e.protocolMainLoop(true) })
+}
+
+// Bind binds the endpoint to a specific local port and optionally address.
+func (e *endpoint) Bind(addr tcpip.FullAddress, commit func() error) (retErr error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// Don't allow binding once endpoint is not in the initial state
+	// anymore.
+	if e.state != stateInitial {
+		return tcpip.ErrAlreadyBound
+	}
+
+	port, err := e.stack.ReservePort(e.netProto, ProtocolNumber, addr.Addr, addr.Port, e.portFlags())
+	if err != nil {
+		return err
+	}
+
+	e.isPortReserved = true
+	e.reservedAddr = addr.Addr
+	e.id.LocalPort = port
+
+	// Any failures beyond this point must remove the port registration.
+	defer func() {
+		if retErr != nil {
+			e.stack.ReleasePort(e.netProto, ProtocolNumber, addr.Addr, port)
+			e.isPortReserved = false
+			e.reservedAddr = ""
+			e.id.LocalPort = 0
+			e.id.LocalAddress = ""
+			e.boundNICID = 0
+		}
+	}()
+
+	// If an address is specified, we must ensure that it's one of our
+	// local addresses.
+	if len(addr.Addr) != 0 {
+		nic := e.stack.CheckLocalAddress(addr.NIC, addr.Addr)
+		if nic == 0 {
+			return tcpip.ErrBadLocalAddress
+		}
+
+		e.boundNICID = nic
+		e.id.LocalAddress = addr.Addr
+	}
+
+	// Check the commit function.
+	if commit != nil {
+		if err := commit(); err != nil {
+			// The defer takes care of unwind.
+			return err
+		}
+	}
+
+	// Mark endpoint as bound.
+	e.state = stateBound
+
+	return nil
+}
+
+// portFlags returns the flags the endpoint reserves its port with. It must be
+// called with e.mu held.
+func (e *endpoint) portFlags() ports.Flags {
+	return ports.Flags{ReuseAddr: e.reuseAddr}
+}
+
+// GetLocalAddress returns the address to which the endpoint is bound.
+func (e *endpoint) GetLocalAddress() (tcpip.FullAddress, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return tcpip.FullAddress{
+		Addr: e.id.LocalAddress,
+		Port: e.id.LocalPort,
+		NIC:  e.boundNICID,
+	}, nil
+}
+
+// GetRemoteAddress returns the address to which the endpoint is connected.
+func (e *endpoint) GetRemoteAddress() (tcpip.FullAddress, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.state != stateConnected {
+		return tcpip.FullAddress{}, tcpip.ErrNotConnected
+	}
+
+	return tcpip.FullAddress{
+		Addr: e.id.RemoteAddress,
+		Port: e.id.RemotePort,
+		NIC:  e.boundNICID,
+	}, nil
+}
+
+// HandlePacket is called by the stack when new packets arrive to this transport
+// endpoint. They are queued to the protocol goroutine.
+func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, vv buffer.VectorisedView) {
+	v := vv.ToOwnedView()
+	if !validPacket(r, v) {
+		return
+	}
+
+	p := &packet{route: r.Clone(), id: id, data: v}
+	select {
+	case e.segmentChan <- p:
+		atomic.AddUint64(&r.Stats().DCCP.PacketsReceived, 1)
+	default:
+		// The protocol goroutine is falling behind; the packet is
+		// lost, like any other.
+		p.route.Release()
+	}
+}
+
+// HandleNICRemoved implements stack.NICRemovalAwareEndpoint.HandleNICRemoved.
+// It aborts connections through the given NIC, with tcpip.ErrConnectionAborted,
+// and listening endpoints bound to it.
+func (e *endpoint) HandleNICRemoved(nicID tcpip.NICID) {
+	e.mu.RLock()
+	var abort bool
+	switch e.state {
+	case stateConnecting, stateConnected:
+		abort = e.route.NICID() == nicID
+	case stateListen:
+		abort = e.boundNICID == nicID
+	}
+	e.mu.RUnlock()
+
+	if abort {
+		e.notifyProtocolGoroutine(notifyAbort)
+	}
+}
+
+// HandleAddressRemoved implements
+// stack.AddressRemovalAwareEndpoint.HandleAddressRemoved. It aborts connections
+// that use the given address, with tcpip.ErrConnectionAborted, and listening
+// endpoints bound to it.
+func (e *endpoint) HandleAddressRemoved(nicID tcpip.NICID, addr tcpip.Address) {
+	e.mu.RLock()
+	var abort bool
+	switch e.state {
+	case stateConnecting, stateConnected:
+		abort = e.route.NICID() == nicID && e.route.LocalAddress == addr
+	case stateListen:
+		abort = (e.boundNICID == 0 || e.boundNICID == nicID) && e.id.LocalAddress == addr
+	}
+	e.mu.RUnlock()
+
+	if abort {
+		e.notifyProtocolGoroutine(notifyAbort)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import (
+	"sync/atomic"
+
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// seqnum48 is a 48-bit DCCP sequence number, whose arithmetic wraps around.
+type seqnum48 uint64
+
+const seqnum48Mask = 1<<48 - 1
+
+// add returns v+n.
+func (v seqnum48) add(n int64) seqnum48 {
+	return seqnum48(uint64(int64(v)+n) & seqnum48Mask)
+}
+
+// sub returns the signed distance from w to v, which is negative if v is
+// before w.
+func (v seqnum48) sub(w seqnum48) int64 {
+	d := (uint64(v) - uint64(w)) & seqnum48Mask
+	if d >= 1<<47 {
+		return int64(d) - 1<<48
+	}
+	return int64(d)
+}
+
+// lessThan returns whether v is before w.
+func (v seqnum48) lessThan(w seqnum48) bool {
+	return v.sub(w) < 0
+}
+
+// inRange returns whether v is in the range [lo, hi].
+func (v seqnum48) inRange(lo, hi seqnum48) bool {
+	return !v.lessThan(lo) && !hi.lessThan(v)
+}
+
+// max48 returns the later of the sequence numbers a and b.
+func max48(a, b seqnum48) seqnum48 {
+	if a.lessThan(b) {
+		return b
+	}
+	return a
+}
+
+// packet is a dccp packet received by an endpoint, and queued to its protocol
+// goroutine.
+type packet struct {
+	// route is the route of the packet, which the receiver releases.
+	route stack.Route
+	id    stack.TransportEndpointID
+
+	// data is the whole packet, header included.
+	data buffer.View
+}
+
+// header returns the header of the packet.
+func (p *packet) header() header.DCCP {
+	return header.DCCP(p.data)
+}
+
+// sendPacket sends a packet with the fields f, options and payload through r,
+// from id.LocalPort to id.RemotePort. The options are padded as needed.
+func sendPacket(r *stack.Route, id stack.TransportEndpointID, f *header.DCCPFields, options []byte, payload buffer.View) error {
+	f.SrcPort = id.LocalPort
+	f.DstPort = id.RemotePort
+	f.DataOffset = (header.DCCPHeaderSize(f.Type) + len(options) + 3) &^ 3
+
+	// The header is sent with the payload, which the checksum covers.
+	b := make(buffer.View, f.DataOffset+len(payload))
+	h := header.DCCP(b)
+	h.Encode(f)
+	copy(b[header.DCCPHeaderSize(f.Type):], options)
+	copy(b[f.DataOffset:], payload)
+
+	// Only calculate the checksum if the link endpoint needs it.
+	if r.Capabilities()&stack.CapabilityTXChecksumOffload == 0 {
+		h.SetChecksum(^h.CalculateChecksum(r.PseudoHeaderChecksum(ProtocolNumber)))
+	}
+
+	hdr := buffer.NewPrependable(int(r.MaxHeaderLength()))
+	if err := r.WritePacket(&hdr, b.ToVectorisedView(), ProtocolNumber); err != nil {
+		return err
+	}
+
+	atomic.AddUint64(&r.Stats().DCCP.PacketsSent, 1)
+	if f.Type == header.DCCPReset {
+		atomic.AddUint64(&r.Stats().DCCP.ResetsSent, 1)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dccp contains the implementation of the DCCP transport protocol (RFC
+// 4340). To use it in the networking stack, this package must be added to the
+// project, and activated on the stack by passing dccp.ProtocolName (or "dccp")
+// as one of the transport protocols when calling stack.New(). Then endpoints
+// can be created by passing dccp.ProtocolNumber as the transport protocol
+// number when calling Stack.NewEndpoint().
+//
+// DCCP connections carry unreliable datagrams, under the TCP-like congestion
+// control of CCID 2 (RFC 4341): datagrams are sent as the congestion window
+// allows, and the lost ones are not retransmitted. Features are not
+// negotiated: connections always use CCID 2, 48-bit sequence numbers and the
+// default sequence window, and the Ack Vectors of the receivers cover the
+// recent packets only.
+package dccp
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	// ProtocolName is the string representation of the dccp protocol name.
+	ProtocolName = "dccp"
+
+	// ProtocolNumber is the dccp protocol number.
+	ProtocolNumber = header.DCCPProtocolNumber
+)
+
+const (
+	// initialRTO, minRTO and maxRTO are the initial, minimum and maximum
+	// retransmission timeouts of the Request, Response and Close packets,
+	// and of the congestion control of the data packets.
+	initialRTO = 1 * time.Second
+	minRTO     = 200 * time.Millisecond
+	maxRTO     = 60 * time.Second
+
+	// maxRetransmits is the number of times Request, Response and Close
+	// packets are retransmitted before giving up.
+	maxRetransmits = 6
+
+	// sequenceWindow is the value of the Sequence Window feature, which
+	// sets the range of valid sequence and acknowledgement numbers, per
+	// RFC 4340, section 7.5.1.
+	sequenceWindow = 100
+)
+
+// defaultEndpointDefaults are the settings new endpoints are created with,
+// unless they are overridden with stack.Stack.SetEndpointDefaults.
+var defaultEndpointDefaults = stack.EndpointDefaults{
+	SendBufferSize:    stack.BufferSizeRange{Min: 1, Default: 64 << 10, Max: 4 << 20},
+	ReceiveBufferSize: stack.BufferSizeRange{Min: 1, Default: 64 << 10, Max: 4 << 20},
+}
+
+// endpointDefaults returns the settings new endpoints of the given stack are
+// created with.
+func endpointDefaults(s *stack.Stack) stack.EndpointDefaults {
+	if d, ok := s.EndpointDefaults(ProtocolNumber); ok {
+		return d
+	}
+	return defaultEndpointDefaults
+}
+
+// ServiceCodeOption is used by SetSockOpt/GetSockOpt to specify the service
+// code of an endpoint. Connecting endpoints send it in their Request packet,
+// and listening endpoints only accept the requests with their own service
+// code, per RFC 4340, section 8.1.2.
+type ServiceCodeOption uint32
+
+// invalidServiceCode is the service code endpoints can't use.
+const invalidServiceCode = 4294967295
+
+type protocol struct{}
+
+// Number returns the dccp protocol number.
+func (*protocol) Number() tcpip.TransportProtocolNumber {
+	return ProtocolNumber
+}
+
+// NewEndpoint creates a new dccp endpoint.
+func (*protocol) NewEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) (tcpip.Endpoint, error) {
+	return newEndpoint(stack, netProto, waiterQueue), nil
+}
+
+// MinimumPacketSize returns the minimum valid dccp packet size.
+func (*protocol) MinimumPacketSize() int {
+	return header.DCCPMinimumSize
+}
+
+// ParsePorts returns the source and destination ports stored in the given dccp
+// packet.
+func (*protocol) ParsePorts(v buffer.View) (src, dst uint16, err error) {
+	h := header.DCCP(v)
+	return h.SourcePort(), h.DestinationPort(), nil
+}
+
+// HandleUnknownDestinationPacket handles packets targeted at this protocol but
+// that don't match any existing endpoint. They are answered with a Reset
+// packet, unless they are Reset packets themselves, per RFC 4340, section
+// 8.3.1.
+func (*protocol) HandleUnknownDestinationPacket(r *stack.Route, id stack.TransportEndpointID, v buffer.View) {
+	if !validPacket(r, v) {
+		return
+	}
+	h := header.DCCP(v)
+	if h.Type() != header.DCCPReset {
+		replyReset(r, id, h, header.DCCPResetNoConnection)
+	}
+}
+
+// validPacket returns whether v, received through r, is a dccp packet with a
+// valid header and checksum, and counts it in the stats if it isn't.
+func validPacket(r *stack.Route, v buffer.View) bool {
+	h := header.DCCP(v)
+	if !h.IsValid() {
+		atomic.AddUint64(&r.Stats().DCCP.MalformedPacketsReceived, 1)
+		return false
+	}
+
+	// Verify the checksum unless the link endpoint already did.
+	if r.Capabilities()&stack.CapabilityRXChecksumOffload == 0 {
+		xsum := r.PseudoHeaderChecksum(ProtocolNumber)
+		if ^h.CalculateChecksum(xsum) != h.Checksum() {
+			atomic.AddUint64(&r.Stats().DCCP.ChecksumErrors, 1)
+			return false
+		}
+	}
+	return true
+}
+
+// replyReset answers the packet h, received through r for id, with a Reset
+// packet with the given code. The Reset acknowledges h, and its sequence number
+// follows the acknowledgement number of h, if any, per RFC 4340, section 8.1.1.
+func replyReset(r *stack.Route, id stack.TransportEndpointID, h header.DCCP, code header.DCCPResetCode) {
+	var seq seqnum48
+	if t := h.Type(); t != header.DCCPRequest && t != header.DCCPData {
+		seq = seqnum48(h.AckNumber()).add(1)
+	}
+	sendPacket(r, id, &header.DCCPFields{
+		Type:      header.DCCPReset,
+		SeqNum:    uint64(seq),
+		AckNum:    h.SequenceNumber(),
+		ResetCode: code,
+	}, nil, nil)
+}
+
+func init() {
+	stack.RegisterTransportProtocol(ProtocolName, &protocol{})
+}
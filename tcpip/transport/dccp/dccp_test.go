@@ -0,0 +1,287 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dccp_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/link/loopback"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/dccp"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	stackAddr   = "\x7f\x00\x00\x01"
+	listenPort  = 9000
+	serviceCode = 42
+)
+
+// newLoopbackStack returns a stack with a loopback NIC, whose address is
+// stackAddr.
+func newLoopbackStack(t *testing.T) *stack.Stack {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{dccp.ProtocolName}).(*stack.Stack)
+
+	if err := s.CreateNIC(1, loopback.New()); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, stackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         1,
+	}})
+
+	return s
+}
+
+// waitFor waits until wq reports one of the events of mask and done returns
+// true, or fails the test after a while.
+func waitFor(t *testing.T, wq *waiter.Queue, mask waiter.EventMask, done func() bool) {
+	t.Helper()
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, mask)
+	defer wq.EventUnregister(&we)
+
+	timeout := time.After(5 * time.Second)
+	for !done() {
+		select {
+		case <-ch:
+		case <-timeout:
+			t.Fatalf("timed out waiting for events %#x", mask)
+		}
+	}
+}
+
+// newEndpoint returns a new endpoint with the given service code.
+func newEndpoint(t *testing.T, s *stack.Stack, code dccp.ServiceCodeOption) (tcpip.Endpoint, *waiter.Queue) {
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(dccp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := ep.SetSockOpt(code); err != nil {
+		t.Fatalf("SetSockOpt(%d) failed: %v", code, err)
+	}
+	return ep, &wq
+}
+
+// listen returns an endpoint listening on listenPort, with serviceCode.
+func listen(t *testing.T, s *stack.Stack) (tcpip.Endpoint, *waiter.Queue) {
+	ep, wq := newEndpoint(t, s, serviceCode)
+	if err := ep.Bind(tcpip.FullAddress{Port: listenPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := ep.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	return ep, wq
+}
+
+// startConnect returns a new endpoint with the given service code, which
+// starts connecting to listenPort.
+func startConnect(t *testing.T, s *stack.Stack, code dccp.ServiceCodeOption) (tcpip.Endpoint, *waiter.Queue) {
+	ep, wq := newEndpoint(t, s, code)
+	if err := ep.Connect(tcpip.FullAddress{Addr: stackAddr, Port: listenPort}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("Connect returned %v, want %v", err, tcpip.ErrConnectStarted)
+	}
+	return ep, wq
+}
+
+// connect connects a new endpoint to the listener, and returns it, with the
+// endpoint the listener accepted.
+func connect(t *testing.T, s *stack.Stack, l tcpip.Endpoint, lwq *waiter.Queue) (c tcpip.Endpoint, cwq *waiter.Queue, a tcpip.Endpoint, awq *waiter.Queue) {
+	c, cwq = startConnect(t, s, serviceCode)
+	waitFor(t, cwq, waiter.EventOut, func() bool {
+		return c.Readiness(waiter.EventOut) != 0
+	})
+	if err := c.GetSockOpt(tcpip.ErrorOption{}); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	var err error
+	waitFor(t, lwq, waiter.EventIn, func() bool {
+		a, awq, err = l.Accept()
+		return err != tcpip.ErrWouldBlock
+	})
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	return c, cwq, a, awq
+}
+
+// recv waits for the next datagram of ep.
+func recv(t *testing.T, ep tcpip.Endpoint, wq *waiter.Queue) buffer.View {
+	t.Helper()
+
+	var v buffer.View
+	var err error
+	waitFor(t, wq, waiter.EventIn, func() bool {
+		v, err = ep.Read(nil)
+		return err != tcpip.ErrWouldBlock
+	})
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	return v
+}
+
+func TestDatagrams(t *testing.T) {
+	s := newLoopbackStack(t)
+	l, lwq := listen(t, s)
+	defer l.Close()
+	c, cwq, a, awq := connect(t, s, l, lwq)
+	defer c.Close()
+	defer a.Close()
+
+	// More datagrams than the initial congestion window are sent in both
+	// directions, as the acknowledgements open it.
+	const count = 100
+	for _, test := range []struct {
+		name     string
+		from, to tcpip.Endpoint
+		fwq, twq *waiter.Queue
+	}{
+		{"client", c, a, cwq, awq},
+		{"server", a, c, awq, cwq},
+	} {
+		for i := 0; i < count; i++ {
+			v := buffer.View(fmt.Sprintf("%s datagram %d", test.name, i))
+			waitFor(t, test.fwq, waiter.EventOut, func() bool {
+				_, err := test.from.Write(v, nil)
+				if err != nil && err != tcpip.ErrWouldBlock {
+					t.Fatalf("Write failed: %v", err)
+				}
+				return err == nil
+			})
+		}
+		for i := 0; i < count; i++ {
+			want := fmt.Sprintf("%s datagram %d", test.name, i)
+			if v := recv(t, test.to, test.twq); string(v) != want {
+				t.Fatalf("got datagram %q, want %q", v, want)
+			}
+		}
+	}
+
+	if got := s.Stats().DCCP.PacketsLost; got != 0 {
+		t.Errorf("got %d lost packets, want 0", got)
+	}
+
+	// Datagrams must fit in a packet.
+	if _, err := c.Write(make(buffer.View, 1<<16), nil); err != tcpip.ErrMessageTooLong {
+		t.Errorf("Write of a large datagram returned %v, want %v", err, tcpip.ErrMessageTooLong)
+	}
+}
+
+func TestClose(t *testing.T) {
+	s := newLoopbackStack(t)
+	l, lwq := listen(t, s)
+	defer l.Close()
+	c, cwq, a, awq := connect(t, s, l, lwq)
+	defer a.Close()
+
+	if _, err := c.Write(buffer.View("last"), nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	c.Close()
+
+	// The datagram sent before the close is delivered, and then the
+	// connection is closed.
+	if v := recv(t, a, awq); string(v) != "last" {
+		t.Fatalf("got datagram %q, want %q", v, "last")
+	}
+	waitFor(t, awq, waiter.EventIn, func() bool {
+		_, err := a.Read(nil)
+		return err == tcpip.ErrClosedForReceive
+	})
+	if _, err := a.Write(buffer.View("late"), nil); err != tcpip.ErrClosedForSend {
+		t.Fatalf("Write after close returned %v, want %v", err, tcpip.ErrClosedForSend)
+	}
+
+	// The client gets the Reset packet, and releases the port.
+	waitFor(t, cwq, waiter.EventHUp, func() bool {
+		return c.Readiness(waiter.EventHUp) != 0
+	})
+}
+
+func TestNICRemoval(t *testing.T) {
+	s := newLoopbackStack(t)
+	l, lwq := listen(t, s)
+	defer l.Close()
+	c, cwq, a, awq := connect(t, s, l, lwq)
+	defer c.Close()
+	defer a.Close()
+
+	if err := s.RemoveNIC(1); err != nil {
+		t.Fatalf("RemoveNIC failed: %v", err)
+	}
+
+	// Both ends of the connection are aborted, without waiting for the peer.
+	for _, test := range []struct {
+		name string
+		ep   tcpip.Endpoint
+		wq   *waiter.Queue
+	}{
+		{"client", c, cwq},
+		{"server", a, awq},
+	} {
+		waitFor(t, test.wq, waiter.EventErr, func() bool {
+			return test.ep.Readiness(waiter.EventErr) != 0
+		})
+		if _, err := test.ep.Read(nil); err != tcpip.ErrConnectionAborted {
+			t.Errorf("%s: Read returned %v, want %v", test.name, err, tcpip.ErrConnectionAborted)
+		}
+		if _, err := test.ep.Write(buffer.View("late"), nil); err != tcpip.ErrConnectionAborted {
+			t.Errorf("%s: Write returned %v, want %v", test.name, err, tcpip.ErrConnectionAborted)
+		}
+	}
+
+	// The listener isn't bound to the NIC, so it keeps listening.
+	if _, _, err := l.Accept(); err != tcpip.ErrWouldBlock {
+		t.Errorf("Accept returned %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+}
+
+func TestConnectionRefused(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		listen bool
+		code   dccp.ServiceCodeOption
+	}{
+		{"no listener", false, serviceCode},
+		{"bad service code", true, serviceCode + 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newLoopbackStack(t)
+			if test.listen {
+				l, _ := listen(t, s)
+				defer l.Close()
+			}
+
+			ep, wq := startConnect(t, s, test.code)
+			defer ep.Close()
+
+			waitFor(t, wq, waiter.EventErr, func() bool {
+				return ep.Readiness(waiter.EventErr) != 0
+			})
+			if err := ep.GetSockOpt(tcpip.ErrorOption{}); err != tcpip.ErrConnectionRefused {
+				t.Fatalf("Connect failed with %v, want %v", err, tcpip.ErrConnectionRefused)
+			}
+			if got := s.Stats().DCCP.ResetsSent; got != 1 {
+				t.Errorf("got %d resets sent, want 1", got)
+			}
+		})
+	}
+}
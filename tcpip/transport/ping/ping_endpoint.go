@@ -0,0 +1,809 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/ports"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/waiter"
+)
+
+type pingPacket struct {
+	pingPacketEntry
+	senderAddress tcpip.FullAddress
+	view          buffer.View
+}
+
+type endpointState int
+
+const (
+	stateInitial endpointState = iota
+	stateBound
+	stateConnected
+	stateClosed
+	stateError
+)
+
+// String implements fmt.Stringer.String.
+func (s endpointState) String() string {
+	switch s {
+	case stateInitial:
+		return "initial"
+	case stateBound:
+		return "bound"
+	case stateConnected:
+		return "connected"
+	case stateClosed:
+		return "closed"
+	case stateError:
+		return "error"
+	}
+	return "unknown"
+}
+
+var errRetryPrepare = errors.New("prepare operation must be retried")
+
+// endpoint represents an ICMPv4 or ICMPv6 echo endpoint. Like the ping sockets
+// of Linux, it sends the echo requests written to it, setting their identifier
+// to the local port of the endpoint, and receives the echo replies carrying that
+// identifier. Both are read and written with their ICMP header, unless
+// DatagramOption is set. Endpoints also receive the errors about their
+// requests, e.g., destination unreachable and time exceeded errors, from any
+// host if they aren't connected, e.g., to trace routes.
+//
+// It is legal to have concurrent goroutines make calls into the endpoint, they
+// are properly synchronized.
+type endpoint struct {
+	// The following fields are initialized at creation time and do not
+	// change throughout the lifetime of the endpoint.
+	stack       *stack.Stack
+	netProto    tcpip.NetworkProtocolNumber
+	transProto  tcpip.TransportProtocolNumber
+	waiterQueue *waiter.Queue
+
+	// datagram is set, to 1, when DatagramOption is set. It is only
+	// accessed atomically.
+	datagram uint32
+
+	// seq is the sequence number of the last echo request built by the
+	// endpoint in datagram mode. It is only accessed atomically.
+	seq uint32
+
+	// The following fields are used to manage the receive queue, and are
+	// protected by rcvMu.
+	rcvMu         sync.Mutex
+	rcvReady      bool
+	rcvList       pingPacketList
+	rcvBufSizeMax int
+	rcvBufSize    int
+	rcvClosed     bool
+
+	// rcvErr is the error returned by reads once the queued datagrams are
+	// read, after the endpoint has been aborted.
+	rcvErr error
+
+	// The following fields are protected by the mu mutex.
+	mu         sync.RWMutex
+	sndBufSize int
+	id         stack.TransportEndpointID
+	state      endpointState
+	bindNICID  tcpip.NICID
+	bindAddr   tcpip.Address
+	regNICID   tcpip.NICID
+	route      stack.Route
+
+	// ttl is the TTL set with tcpip.TTLOption, or zero. It is also set in
+	// route.
+	ttl uint8
+
+	// isPortReserved is set when the local port, which is the identifier
+	// of the echo requests, is reserved with the stack's port manager, for
+	// reservedAddr.
+	isPortReserved bool
+	reservedAddr   tcpip.Address
+
+	// rcvDeadline and sndDeadline are the deadlines set with
+	// tcpip.ReceiveDeadlineOption and tcpip.SendDeadlineOption.
+	rcvDeadline stack.Deadline
+	sndDeadline stack.Deadline
+}
+
+func newEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, transProto tcpip.TransportProtocolNumber, waiterQueue *waiter.Queue) *endpoint {
+	d := endpointDefaults(stack, transProto)
+	return &endpoint{
+		stack:         stack,
+		netProto:      netProto,
+		transProto:    transProto,
+		waiterQueue:   waiterQueue,
+		rcvBufSizeMax: d.ReceiveBufferSize.Default,
+		sndBufSize:    d.SendBufferSize.Default,
+	}
+}
+
+// Close puts the endpoint in a closed state and frees all resources
+// associated with it.
+func (e *endpoint) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch e.state {
+	case stateBound, stateConnected:
+		e.stack.UnregisterTransportEndpoint(e.regNICID, e.transProto, e.id)
+	}
+
+	e.releasePortLocked(e.id.LocalPort)
+
+	// Close the receive list and drain it.
+	e.rcvMu.Lock()
+	e.rcvClosed = true
+	e.rcvBufSize = 0
+	for !e.rcvList.Empty() {
+		p := e.rcvList.Front()
+		e.rcvList.Remove(p)
+	}
+	e.rcvMu.Unlock()
+
+	e.route.Release()
+
+	e.rcvDeadline.Stop()
+	e.sndDeadline.Stop()
+
+	// Update the state.
+	e.state = stateClosed
+}
+
+// Read reads an echo reply, including its ICMP header unless DatagramOption is
+// set, from the endpoint. This method does not block if there is no reply
+// pending.
+func (e *endpoint) Read(addr *tcpip.FullAddress) (buffer.View, error) {
+	if e.rcvDeadline.Expired() {
+		return buffer.View{}, tcpip.ErrTimeout
+	}
+
+	e.rcvMu.Lock()
+
+	if e.rcvList.Empty() {
+		err := tcpip.ErrWouldBlock
+		switch {
+		case e.rcvErr != nil:
+			err = e.rcvErr
+		case e.rcvClosed:
+			err = tcpip.ErrClosedForReceive
+		}
+		e.rcvMu.Unlock()
+		return buffer.View{}, err
+	}
+
+	p := e.rcvList.Front()
+	e.rcvList.Remove(p)
+	e.rcvBufSize -= len(p.view)
+
+	e.rcvMu.Unlock()
+
+	if addr != nil {
+		*addr = p.senderAddress
+	}
+
+	return p.view, nil
+}
+
+// RecvMsg implements tcpip.RecvMsg.
+func (e *endpoint) RecvMsg(addr *tcpip.FullAddress) (buffer.View, tcpip.ControlMessages, error) {
+	v, err := e.Read(addr)
+	return v, nil, err
+}
+
+// prepareForWrite prepares the endpoint for sending data. In particular, it
+// binds it if it's still in the initial state. To do so, it must first
+// reacquire the mutex in exclusive mode.
+//
+// Returns errRetryPrepare if preparation should be retried.
+func (e *endpoint) prepareForWrite(to *tcpip.FullAddress) error {
+	switch e.state {
+	case stateInitial:
+	case stateConnected:
+		return nil
+
+	case stateBound:
+		if to == nil {
+			return tcpip.ErrDestinationRequired
+		}
+		return nil
+	case stateError:
+		return tcpip.ErrConnectionAborted
+	default:
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	e.mu.RUnlock()
+	defer e.mu.RLock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// The state changed when we released the shared locked and re-acquired
+	// it in exclusive mode. Try again.
+	if e.state != stateInitial {
+		return errRetryPrepare
+	}
+
+	// The state is still 'initial', so try to bind the endpoint.
+	if err := e.bindLocked(tcpip.FullAddress{}, nil); err != nil {
+		return err
+	}
+
+	return errRetryPrepare
+}
+
+// Write writes an echo request to the endpoint's peer, or to the given address.
+// v must hold the ICMP header of the request, whose identifier and checksum are
+// set by the endpoint, followed by its data; if DatagramOption is set, v only
+// holds the data, and the endpoint builds the header, numbering the requests in
+// sequence. This method does not block if the request cannot be written.
+func (e *endpoint) Write(v buffer.View, to *tcpip.FullAddress) (uintptr, error) {
+	if e.sndDeadline.Expired() {
+		return 0, tcpip.ErrTimeout
+	}
+
+	request, _ := echoTypes(e.transProto)
+	datagram := atomic.LoadUint32(&e.datagram) != 0
+	if !datagram && (len(v) < header.ICMPv4MinimumSize || uint8(header.ICMPv4(v).Type()) != request || header.ICMPv4(v).Code() != 0) {
+		// tcpip.ErrInvalidEndpointState turns into syscall.EINVAL.
+		return 0, tcpip.ErrInvalidEndpointState
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	// Prepare for write.
+	for {
+		err := e.prepareForWrite(to)
+		if err == nil {
+			break
+		}
+
+		if err != errRetryPrepare {
+			return 0, err
+		}
+	}
+
+	route := &e.route
+	if to != nil {
+		// Reject destination address if it goes through a different
+		// NIC than the endpoint was bound to.
+		nicid := to.NIC
+		if e.bindNICID != 0 {
+			if nicid != 0 && nicid != e.bindNICID {
+				return 0, tcpip.ErrNoRoute
+			}
+
+			nicid = e.bindNICID
+		}
+
+		r, err := e.stack.FindRoute(nicid, e.bindAddr, to.Addr, e.netProto)
+		if err != nil {
+			return 0, err
+		}
+		defer r.Release()
+
+		r.TTL = e.ttl
+		route = &r
+	}
+
+	// The request is copied, as its header is modified.
+	var req buffer.View
+	if datagram {
+		req = buffer.NewView(header.ICMPv4MinimumSize + len(v))
+		copy(req[header.ICMPv4MinimumSize:], v)
+		header.ICMPv4(req).SetType(header.ICMPv4Type(request))
+		header.ICMPv4(req).SetSequence(uint16(atomic.AddUint32(&e.seq, 1)))
+	} else {
+		req = append(buffer.View(nil), v...)
+	}
+	header.ICMPv4(req).SetIdent(e.id.LocalPort)
+	if err := sendICMP(route, e.transProto, req); err != nil {
+		return 0, err
+	}
+
+	atomic.AddUint64(&route.Stats().ICMP.EchoRequestsSent, 1)
+	return uintptr(len(v)), nil
+}
+
+// SendMsg implements tcpip.SendMsg.
+func (e *endpoint) SendMsg(v buffer.View, c tcpip.ControlMessages, to *tcpip.FullAddress) (uintptr, error) {
+	// Reject control messages.
+	if c != nil {
+		// tcpip.ErrInvalidEndpointState turns into syscall.EINVAL.
+		return 0, tcpip.ErrInvalidEndpointState
+	}
+	return e.Write(v, to)
+}
+
+// Peek only returns data from a single datagram, so do nothing here.
+func (e *endpoint) Peek(io.Writer) (uintptr, error) {
+	return 0, nil
+}
+
+// SetSockOpt sets a socket option. Only DatagramOption, tcpip.TTLOption, and the
+// buffer size and deadline options are currently supported; other options are
+// ignored.
+func (e *endpoint) SetSockOpt(opt interface{}) error {
+	switch v := opt.(type) {
+	case DatagramOption:
+		var datagram uint32
+		if v != 0 {
+			datagram = 1
+		}
+		atomic.StoreUint32(&e.datagram, datagram)
+
+	case tcpip.SendBufferSizeOption:
+		size := endpointDefaults(e.stack, e.transProto).SendBufferSize.Clamp(int(v))
+		e.mu.Lock()
+		e.sndBufSize = size
+		e.mu.Unlock()
+
+	case tcpip.ReceiveBufferSizeOption:
+		size := endpointDefaults(e.stack, e.transProto).ReceiveBufferSize.Clamp(int(v))
+		e.rcvMu.Lock()
+		e.rcvBufSizeMax = size
+		e.rcvMu.Unlock()
+
+	case tcpip.TTLOption:
+		e.mu.Lock()
+		e.ttl = uint8(v)
+		e.route.TTL = e.ttl
+		e.mu.Unlock()
+
+	case tcpip.ReceiveDeadlineOption:
+		e.rcvDeadline.Set(e.stack.Clock(), time.Time(v), func() {
+			e.waiterQueue.Notify(waiter.EventIn)
+		})
+
+	case tcpip.SendDeadlineOption:
+		e.sndDeadline.Set(e.stack.Clock(), time.Time(v), func() {
+			e.waiterQueue.Notify(waiter.EventOut)
+		})
+	}
+
+	return nil
+}
+
+// GetSockOpt implements tcpip.Endpoint.GetSockOpt.
+func (e *endpoint) GetSockOpt(opt interface{}) error {
+	switch o := opt.(type) {
+	case tcpip.ErrorOption:
+		return nil
+
+	case *tcpip.SendBufferSizeOption:
+		e.mu.Lock()
+		*o = tcpip.SendBufferSizeOption(e.sndBufSize)
+		e.mu.Unlock()
+		return nil
+
+	case *tcpip.ReceiveBufferSizeOption:
+		e.rcvMu.Lock()
+		*o = tcpip.ReceiveBufferSizeOption(e.rcvBufSizeMax)
+		e.rcvMu.Unlock()
+		return nil
+
+	case *DatagramOption:
+		*o = DatagramOption(atomic.LoadUint32(&e.datagram))
+		return nil
+
+	case *tcpip.TTLOption:
+		e.mu.RLock()
+		*o = tcpip.TTLOption(e.ttl)
+		e.mu.RUnlock()
+		return nil
+
+	case *tcpip.ReceiveDeadlineOption:
+		*o = tcpip.ReceiveDeadlineOption(e.rcvDeadline.Get())
+		return nil
+
+	case *tcpip.SendDeadlineOption:
+		*o = tcpip.SendDeadlineOption(e.sndDeadline.Get())
+		return nil
+	}
+
+	return tcpip.ErrInvalidEndpointState
+}
+
+// Connect connects the endpoint to its peer, whose port is ignored. Specifying
+// a NIC is optional.
+func (e *endpoint) Connect(addr tcpip.FullAddress) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	nicid := addr.NIC
+	localPort := uint16(0)
+	switch e.state {
+	case stateInitial:
+	case stateBound, stateConnected:
+		localPort = e.id.LocalPort
+		if e.bindNICID == 0 {
+			break
+		}
+
+		if nicid != 0 && nicid != e.bindNICID {
+			return tcpip.ErrInvalidEndpointState
+		}
+
+		nicid = e.bindNICID
+	default:
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	// Find a route to the desired destination.
+	r, err := e.stack.FindRoute(nicid, e.bindAddr, addr.Addr, e.netProto)
+	if err != nil {
+		return err
+	}
+	defer r.Release()
+
+	id := stack.TransportEndpointID{
+		LocalAddress:  r.LocalAddress,
+		LocalPort:     localPort,
+		RemoteAddress: addr.Addr,
+	}
+
+	id, err = e.registerWithStack(nicid, id)
+	if err != nil {
+		return err
+	}
+
+	// Remove the old registration.
+	if e.id.LocalPort != 0 {
+		e.stack.UnregisterTransportEndpoint(e.regNICID, e.transProto, e.id)
+	}
+
+	e.id = id
+	e.route.Release()
+	e.route = r.Clone()
+	e.route.TTL = e.ttl
+	e.regNICID = nicid
+
+	e.state = stateConnected
+
+	e.rcvMu.Lock()
+	e.rcvReady = true
+	e.rcvMu.Unlock()
+
+	return nil
+}
+
+// ConnectEndpoint is not supported.
+func (*endpoint) ConnectEndpoint(tcpip.Endpoint) error {
+	return tcpip.ErrInvalidEndpointState
+}
+
+// Shutdown closes the read and/or write end of the endpoint connection
+// to its peer.
+func (e *endpoint) Shutdown(flags tcpip.ShutdownFlags) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.state != stateConnected {
+		return tcpip.ErrNotConnected
+	}
+
+	if flags&tcpip.ShutdownRead != 0 {
+		e.rcvMu.Lock()
+		wasClosed := e.rcvClosed
+		e.rcvClosed = true
+		e.rcvMu.Unlock()
+
+		if !wasClosed {
+			e.waiterQueue.Notify(waiter.EventIn)
+		}
+	}
+
+	return nil
+}
+
+// Listen is not supported by ICMP, it just fails.
+func (*endpoint) Listen(int) error {
+	return tcpip.ErrNotSupported
+}
+
+// Accept is not supported by ICMP, it just fails.
+func (*endpoint) Accept() (tcpip.Endpoint, *waiter.Queue, error) {
+	return nil, nil, tcpip.ErrNotSupported
+}
+
+func (e *endpoint) registerWithStack(nicid tcpip.NICID, id stack.TransportEndpointID) (stack.TransportEndpointID, error) {
+	if id.LocalPort != 0 {
+		// The endpoint already has a local port, just attempt to
+		// register it.
+		err := e.stack.RegisterTransportEndpoint(nicid, e.transProto, id, e)
+		return id, err
+	}
+
+	// We need to find an identifier for the endpoint. It is reserved for
+	// the local address so that it can't be bound to by other endpoints
+	// while in use.
+	_, err := e.stack.ReserveEphemeralPort(e.netProto, e.transProto, id.LocalAddress, ports.Flags{}, "", 0, func(p uint16) (bool, error) {
+		id.LocalPort = p
+		switch err := e.stack.RegisterTransportEndpoint(nicid, e.transProto, id, e); err {
+		case nil:
+			return true, nil
+		case tcpip.ErrDuplicateAddress:
+			return false, nil
+		default:
+			return false, err
+		}
+	})
+	if err == nil {
+		e.isPortReserved = true
+		e.reservedAddr = id.LocalAddress
+	}
+
+	return id, err
+}
+
+func (e *endpoint) bindLocked(addr tcpip.FullAddress, commit func() error) error {
+	// Don't allow binding once endpoint is not in the initial state
+	// anymore.
+	if e.state != stateInitial {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	if len(addr.Addr) != 0 {
+		// A local address was specified, verify that it's valid.
+		if e.stack.CheckLocalAddress(addr.NIC, addr.Addr) == 0 {
+			return tcpip.ErrBadLocalAddress
+		}
+	}
+
+	// Reserve the requested identifier; ephemeral ones are reserved while
+	// registering.
+	if addr.Port != 0 {
+		if _, err := e.stack.ReservePort(e.netProto, e.transProto, addr.Addr, addr.Port, ports.Flags{}); err != nil {
+			return err
+		}
+
+		e.isPortReserved = true
+		e.reservedAddr = addr.Addr
+	}
+
+	id := stack.TransportEndpointID{
+		LocalPort:    addr.Port,
+		LocalAddress: addr.Addr,
+	}
+	id, err := e.registerWithStack(addr.NIC, id)
+	if err != nil {
+		e.releasePortLocked(addr.Port)
+		return err
+	}
+	if commit != nil {
+		if err := commit(); err != nil {
+			// Unregister, the commit failed.
+			e.stack.UnregisterTransportEndpoint(addr.NIC, e.transProto, id)
+			e.releasePortLocked(id.LocalPort)
+			return err
+		}
+	}
+
+	e.id = id
+	e.regNICID = addr.NIC
+
+	// Mark endpoint as bound.
+	e.state = stateBound
+
+	e.rcvMu.Lock()
+	e.rcvReady = true
+	e.rcvMu.Unlock()
+
+	return nil
+}
+
+// releasePortLocked releases the reservation of the given port, if any. It must
+// be called with e.mu held.
+func (e *endpoint) releasePortLocked(port uint16) {
+	if e.isPortReserved {
+		e.stack.ReleasePort(e.netProto, e.transProto, e.reservedAddr, port)
+		e.isPortReserved = false
+		e.reservedAddr = ""
+	}
+}
+
+// Bind binds the endpoint to a specific local address and identifier.
+// Specifying a NIC is optional.
+func (e *endpoint) Bind(addr tcpip.FullAddress, commit func() error) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	err := e.bindLocked(addr, commit)
+	if err != nil {
+		return err
+	}
+
+	e.bindNICID = addr.NIC
+	e.bindAddr = addr.Addr
+
+	return nil
+}
+
+// GetLocalAddress returns the address to which the endpoint is bound. Its port
+// is the identifier of the echo requests sent by the endpoint.
+func (e *endpoint) GetLocalAddress() (tcpip.FullAddress, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return tcpip.FullAddress{
+		NIC:  e.regNICID,
+		Addr: e.id.LocalAddress,
+		Port: e.id.LocalPort,
+	}, nil
+}
+
+// GetRemoteAddress returns the address to which the endpoint is connected.
+func (e *endpoint) GetRemoteAddress() (tcpip.FullAddress, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.state != stateConnected {
+		return tcpip.FullAddress{}, tcpip.ErrInvalidEndpointState
+	}
+
+	return tcpip.FullAddress{
+		NIC:  e.regNICID,
+		Addr: e.id.RemoteAddress,
+	}, nil
+}
+
+// Readiness returns the current readiness of the endpoint. For example, if
+// waiter.EventIn is set, the endpoint is immediately readable.
+func (e *endpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
+	// The endpoint is always writable.
+	result := waiter.EventOut & mask
+
+	// Determine if the endpoint is readable if requested.
+	if (mask & waiter.EventIn) != 0 {
+		e.rcvMu.Lock()
+		if !e.rcvList.Empty() || e.rcvClosed {
+			result |= waiter.EventIn
+		}
+		e.rcvMu.Unlock()
+	}
+
+	// The endpoint is hung up once it's closed, and in error once it's
+	// aborted. Other errors aren't queued for the endpoint.
+	if (mask & (waiter.EventHUp | waiter.EventErr)) != 0 {
+		e.mu.RLock()
+		switch e.state {
+		case stateClosed:
+			result |= waiter.EventHUp & mask
+		case stateError:
+			result |= waiter.EventErr & mask
+		}
+		e.mu.RUnlock()
+	}
+
+	return result
+}
+
+// HandlePacket is called by the stack when echo replies carrying the identifier
+// of this endpoint, or errors about its requests, arrive.
+func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, vv buffer.VectorisedView) {
+	v := vv.ToView()
+	h := header.ICMPv4(v)
+	if !verifyChecksum(r, e.transProto, v) {
+		atomic.AddUint64(&r.Stats().ICMP.ChecksumErrors, 1)
+		return
+	}
+
+	_, reply := echoTypes(e.transProto)
+	isReply := uint8(h.Type()) == reply
+	if atomic.LoadUint32(&e.datagram) != 0 {
+		// Only the data of replies is delivered in datagram mode.
+		if !isReply {
+			return
+		}
+		v = v[header.ICMPv4MinimumSize:]
+	}
+
+	e.rcvMu.Lock()
+
+	// Drop the packet if our buffer is currently full.
+	if !e.rcvReady || e.rcvClosed || e.rcvBufSize >= e.rcvBufSizeMax {
+		e.rcvMu.Unlock()
+		atomic.AddUint64(&r.Stats().ICMP.ReceiveBufferErrors, 1)
+		return
+	}
+
+	wasEmpty := e.rcvBufSize == 0
+
+	// Push new packet into receive list and increment the buffer size.
+	e.rcvList.PushBack(&pingPacket{
+		view: v,
+		senderAddress: tcpip.FullAddress{
+			NIC:  r.NICID(),
+			Addr: id.RemoteAddress,
+		},
+	})
+	e.rcvBufSize += len(v)
+
+	e.rcvMu.Unlock()
+
+	if isReply {
+		atomic.AddUint64(&r.Stats().ICMP.EchoRepliesReceived, 1)
+	} else {
+		atomic.AddUint64(&r.Stats().ICMP.ErrorsReceived, 1)
+	}
+
+	// Notify any waiters that there's data to be read now.
+	if wasEmpty {
+		e.waiterQueue.Notify(waiter.EventIn)
+	}
+}
+
+// HandleNICRemoved implements stack.NICRemovalAwareEndpoint.HandleNICRemoved.
+// It aborts the endpoint if it's bound to the given NIC, or connected through
+// it.
+func (e *endpoint) HandleNICRemoved(nicID tcpip.NICID) {
+	e.mu.Lock()
+	var abort bool
+	switch e.state {
+	case stateBound:
+		abort = e.regNICID == nicID
+	case stateConnected:
+		abort = e.regNICID == nicID || e.route.NICID() == nicID
+	}
+	if abort {
+		e.abortLocked()
+	}
+	e.mu.Unlock()
+
+	if abort {
+		e.waiterQueue.Notify(waiter.EventIn | waiter.EventOut | waiter.EventErr)
+	}
+}
+
+// HandleAddressRemoved implements
+// stack.AddressRemovalAwareEndpoint.HandleAddressRemoved. It aborts the endpoint
+// if it's bound to the given address, or connected with it.
+func (e *endpoint) HandleAddressRemoved(nicID tcpip.NICID, addr tcpip.Address) {
+	e.mu.Lock()
+	var abort bool
+	switch e.state {
+	case stateBound:
+		abort = (e.regNICID == 0 || e.regNICID == nicID) && e.id.LocalAddress == addr
+	case stateConnected:
+		abort = e.route.NICID() == nicID && e.id.LocalAddress == addr
+	}
+	if abort {
+		e.abortLocked()
+	}
+	e.mu.Unlock()
+
+	if abort {
+		e.waiterQueue.Notify(waiter.EventIn | waiter.EventOut | waiter.EventErr)
+	}
+}
+
+// abortLocked aborts the endpoint after the NIC or the address it used was
+// removed: it's unregistered from the stack, its port and route are released,
+// and reads and writes fail with tcpip.ErrConnectionAborted, once the queued
+// replies are read. It must be called with e.mu held exclusively.
+func (e *endpoint) abortLocked() {
+	e.stack.UnregisterTransportEndpoint(e.regNICID, e.transProto, e.id)
+	e.releasePortLocked(e.id.LocalPort)
+	e.route.Release()
+	e.state = stateError
+
+	e.rcvMu.Lock()
+	e.rcvClosed = true
+	e.rcvErr = tcpip.ErrConnectionAborted
+	e.rcvMu.Unlock()
+}
@@ -0,0 +1,248 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ping contains the implementation of ICMPv4 and ICMPv6 echo, as used
+// by ping. To use it in the networking stack, this package must be added to the
+// project, and activated on the stack by passing ping.ProtocolName (or "icmp4")
+// and ping.ProtocolName6 (or "icmp6") as transport protocols when calling
+// stack.New(). The stack then answers echo requests, and endpoints sending echo
+// requests and receiving the replies can be created by passing
+// ping.ProtocolNumber or ping.ProtocolNumber6 as the transport protocol number
+// when calling Stack.NewEndpoint(), along with the matching network protocol.
+// They are the equivalent of the ping sockets of Linux, which don't require
+// raw-socket privileges since the stack manages their identifier. Ping and
+// Traceroute use ICMPv4 endpoints to check that hosts are reachable, and to
+// discover the routes to them.
+package ping
+
+import (
+	"sync/atomic"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	// ProtocolName is the string representation of the icmp4 protocol
+	// name.
+	ProtocolName = "icmp4"
+
+	// ProtocolNumber is the icmp4 protocol number.
+	ProtocolNumber = header.ICMPv4ProtocolNumber
+
+	// ProtocolName6 is the string representation of the icmp6 protocol
+	// name.
+	ProtocolName6 = "icmp6"
+
+	// ProtocolNumber6 is the icmp6 protocol number.
+	ProtocolNumber6 = header.ICMPv6ProtocolNumber
+)
+
+// defaultEndpointDefaults are the settings new endpoints are created with,
+// unless they are overridden with stack.Stack.SetEndpointDefaults.
+var defaultEndpointDefaults = stack.EndpointDefaults{
+	SendBufferSize:    stack.BufferSizeRange{Min: 1, Default: 32 << 10, Max: 4 << 20},
+	ReceiveBufferSize: stack.BufferSizeRange{Min: 1, Default: 32 << 10, Max: 4 << 20},
+}
+
+// endpointDefaults returns the settings new endpoints of the given protocol and
+// stack are created with.
+func endpointDefaults(s *stack.Stack, transProto tcpip.TransportProtocolNumber) stack.EndpointDefaults {
+	if d, ok := s.EndpointDefaults(transProto); ok {
+		return d
+	}
+	return defaultEndpointDefaults
+}
+
+// DatagramOption is used by SetSockOpt/GetSockOpt to make an endpoint read and
+// write the data of echo messages only, without their ICMP header: the endpoint
+// builds the header of the requests written to it, numbering them in sequence,
+// and strips it from the replies. Errors about the requests aren't delivered to
+// such endpoints.
+type DatagramOption int
+
+// protocol is the icmp4 or icmp6 protocol, depending on number.
+type protocol struct {
+	number tcpip.TransportProtocolNumber
+}
+
+// Number returns the icmp4 or icmp6 protocol number.
+func (p *protocol) Number() tcpip.TransportProtocolNumber {
+	return p.number
+}
+
+// NewEndpoint creates a new icmp4 or icmp6 endpoint. They only support IPv4 and
+// IPv6, respectively.
+func (p *protocol) NewEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) (tcpip.Endpoint, error) {
+	if netProto != networkProtocol(p.number) {
+		return nil, tcpip.ErrUnknownProtocol
+	}
+	return newEndpoint(stack, netProto, p.number, waiterQueue), nil
+}
+
+// MinimumPacketSize returns the minimum valid icmp4 or icmp6 packet size. The
+// messages handled by endpoints have a header of this size.
+func (*protocol) MinimumPacketSize() int {
+	return header.ICMPv4MinimumSize
+}
+
+// networkProtocol returns the network protocol the messages of transProto are
+// carried by.
+func networkProtocol(transProto tcpip.TransportProtocolNumber) tcpip.NetworkProtocolNumber {
+	if transProto == ProtocolNumber6 {
+		return header.IPv6ProtocolNumber
+	}
+	return header.IPv4ProtocolNumber
+}
+
+// echoTypes returns the types of the echo requests and replies of transProto.
+func echoTypes(transProto tcpip.TransportProtocolNumber) (request, reply uint8) {
+	if transProto == ProtocolNumber6 {
+		return uint8(header.ICMPv6EchoRequest), uint8(header.ICMPv6EchoReply)
+	}
+	return uint8(header.ICMPv4Echo), uint8(header.ICMPv4EchoReply)
+}
+
+// isError returns whether messages of type typ of transProto are errors about
+// echo requests that endpoints receive.
+func isError(transProto tcpip.TransportProtocolNumber, typ uint8) bool {
+	if transProto == ProtocolNumber6 {
+		switch header.ICMPv6Type(typ) {
+		case header.ICMPv6DstUnreachable, header.ICMPv6PacketTooBig, header.ICMPv6TimeExceeded, header.ICMPv6ParamProblem:
+			return true
+		}
+		return false
+	}
+
+	switch header.ICMPv4Type(typ) {
+	case header.ICMPv4DstUnreachable, header.ICMPv4TimeExceeded:
+		return true
+	}
+	return false
+}
+
+// ParsePorts returns the identifier of echo replies, and of the echo requests
+// quoted by errors, as their destination port, which is the local port of the
+// endpoints they are delivered to. Other messages, including echo requests,
+// have no ports, so that they are handled by HandleUnknownDestinationPacket.
+//
+// Echo messages of ICMPv4 and ICMPv6 have the same layout, so their fields are
+// accessed through header.ICMPv4.
+func (p *protocol) ParsePorts(v buffer.View) (src, dst uint16, err error) {
+	h := header.ICMPv4(v)
+	_, reply := echoTypes(p.number)
+	switch typ := uint8(h.Type()); {
+	case typ == reply:
+		if h.Code() == 0 {
+			return 0, h.Ident(), nil
+		}
+
+	case isError(p.number, typ):
+		if req, ok := quotedEcho(p.number, h); ok {
+			return 0, req.Ident(), nil
+		}
+	}
+	return 0, 0, nil
+}
+
+// quotedEcho returns the header of the echo request whose IP packet is quoted
+// by the error h, if any. Errors quote the IP header and at least the first 8
+// bytes of the packets that caused them.
+func quotedEcho(transProto tcpip.TransportProtocolNumber, h header.ICMPv4) (header.ICMPv4, bool) {
+	var quoted buffer.View
+	if transProto == ProtocolNumber6 {
+		ip := header.IPv6(h[header.ICMPv6EchoMinimumSize:])
+		if len(ip) < header.IPv6MinimumSize || ip.NextHeader() != uint8(transProto) {
+			return nil, false
+		}
+		quoted = buffer.View(ip[header.IPv6MinimumSize:])
+	} else {
+		ip := header.IPv4(h[header.ICMPv4MinimumSize:])
+		if len(ip) < header.IPv4MinimumSize || ip.Protocol() != uint8(transProto) {
+			return nil, false
+		}
+
+		hlen := int(ip.HeaderLength())
+		if hlen < header.IPv4MinimumSize || len(ip) < hlen {
+			return nil, false
+		}
+		quoted = buffer.View(ip[hlen:])
+	}
+
+	req := header.ICMPv4(quoted)
+	if request, _ := echoTypes(transProto); len(req) < header.ICMPv4MinimumSize || uint8(req.Type()) != request {
+		return nil, false
+	}
+	return req, true
+}
+
+// HandleUnknownDestinationPacket handles packets targeted at this protocol but
+// that don't match any existing endpoint. Echo requests are answered, within
+// the rate limit of echo replies set on the stack; other messages are ignored.
+func (p *protocol) HandleUnknownDestinationPacket(r *stack.Route, _ stack.TransportEndpointID, v buffer.View) {
+	h := header.ICMPv4(v)
+	request, reply := echoTypes(p.number)
+	if uint8(h.Type()) != request || h.Code() != 0 {
+		return
+	}
+
+	if !verifyChecksum(r, p.number, v) {
+		atomic.AddUint64(&r.Stats().ICMP.ChecksumErrors, 1)
+		return
+	}
+	atomic.AddUint64(&r.Stats().ICMP.EchoRequestsReceived, 1)
+
+	if !r.Stack().AllowICMP(stack.ICMPType{NetProto: networkProtocol(p.number), Type: reply}) {
+		return
+	}
+
+	// The reply carries the identifier, sequence number and data of the
+	// request.
+	msg := append(buffer.View(nil), v...)
+	msg[0] = reply
+	if err := sendICMP(r, p.number, msg); err != nil {
+		return
+	}
+
+	atomic.AddUint64(&r.Stats().ICMP.EchoRepliesSent, 1)
+}
+
+// verifyChecksum returns whether the checksum of the received message v of
+// transProto is valid, or was already verified by the link endpoint.
+func verifyChecksum(r *stack.Route, transProto tcpip.TransportProtocolNumber, v buffer.View) bool {
+	if r.Capabilities()&stack.CapabilityRXChecksumOffload != 0 {
+		return true
+	}
+	if transProto == ProtocolNumber6 {
+		return header.ICMPv6Checksum(header.ICMPv6(v), r.RemoteAddress, r.LocalAddress) == 0
+	}
+	return header.ICMPv4Checksum(header.ICMPv4(v)) == 0
+}
+
+// sendICMP sends the message v of transProto via the provided route, setting
+// its checksum.
+func sendICMP(r *stack.Route, transProto tcpip.TransportProtocolNumber, v buffer.View) error {
+	hdr := buffer.NewPrependable(int(r.MaxHeaderLength()))
+
+	// Only calculate the checksum if the link endpoint needs it.
+	h := header.ICMPv4(v)
+	h.SetChecksum(0)
+	if r.Capabilities()&stack.CapabilityTXChecksumOffload == 0 {
+		if transProto == ProtocolNumber6 {
+			h.SetChecksum(header.ICMPv6Checksum(header.ICMPv6(v), r.LocalAddress, r.RemoteAddress))
+		} else {
+			h.SetChecksum(header.ICMPv4Checksum(h))
+		}
+	}
+
+	return r.WritePacket(&hdr, v.ToVectorisedView(), transProto)
+}
+
+func init() {
+	stack.RegisterTransportProtocol(ProtocolName, &protocol{number: ProtocolNumber})
+	stack.RegisterTransportProtocol(ProtocolName6, &protocol{number: ProtocolNumber6})
+}
@@ -0,0 +1,512 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/faketime"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/link/loopback"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/network/ipv6"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/ping"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	stackAddr = "\x0a\x00\x00\x01"
+	testAddr  = "\x0a\x00\x00\x02"
+)
+
+// newStack returns a stack with a channel NIC, whose address is stackAddr and
+// which is the route to all destinations.
+func newStack(t *testing.T) (*stack.Stack, *channel.Endpoint) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{ping.ProtocolName}).(*stack.Stack)
+
+	id, linkEP := channel.New(256, 1500)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, stackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         1,
+	}})
+
+	return s, linkEP
+}
+
+// icmpPacket builds an IPv4 packet carrying the given ICMP message, setting its
+// checksum.
+func icmpPacket(src, dst tcpip.Address, icmp buffer.View) buffer.View {
+	buf := buffer.NewView(header.IPv4MinimumSize + len(icmp))
+	copy(buf[header.IPv4MinimumSize:], icmp)
+
+	ip := header.IPv4(buf)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(buf)),
+		TTL:         65,
+		Protocol:    uint8(ping.ProtocolNumber),
+		SrcAddr:     src,
+		DstAddr:     dst,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	h := header.ICMPv4(buf[header.IPv4MinimumSize:])
+	h.SetChecksum(0)
+	h.SetChecksum(header.ICMPv4Checksum(h))
+
+	return buf
+}
+
+// echo returns an echo message of the given type, identifier and sequence
+// number, carrying data.
+func echo(typ header.ICMPv4Type, ident, seq uint16, data []byte) buffer.View {
+	v := buffer.NewView(header.ICMPv4MinimumSize + len(data))
+	copy(v[header.ICMPv4MinimumSize:], data)
+
+	h := header.ICMPv4(v)
+	h.SetType(typ)
+	h.SetIdent(ident)
+	h.SetSequence(seq)
+
+	return v
+}
+
+// readICMP reads the next packet written to linkEP, and returns the ICMP
+// message it carries.
+func readICMP(t *testing.T, linkEP *channel.Endpoint) header.ICMPv4 {
+	t.Helper()
+
+	select {
+	case p := <-linkEP.C:
+		b := append(append(buffer.View(nil), p.Header...), p.Payload...)
+		ip := header.IPv4(b)
+		if ip.Protocol() != uint8(ping.ProtocolNumber) {
+			t.Fatalf("got packet of protocol %d, want %d", ip.Protocol(), ping.ProtocolNumber)
+		}
+		return header.ICMPv4(b[ip.HeaderLength():])
+	case <-time.After(time.Second):
+		t.Fatalf("no packet was written")
+	}
+	return nil
+}
+
+func TestEchoReply(t *testing.T) {
+	s, linkEP := newStack(t)
+
+	data := []byte{1, 2, 3, 4}
+	linkEP.Inject(ipv4.ProtocolNumber, icmpPacket(testAddr, stackAddr, echo(header.ICMPv4Echo, 1234, 5, data)))
+
+	h := readICMP(t, linkEP)
+	if h.Type() != header.ICMPv4EchoReply {
+		t.Errorf("got type %d, want %d", h.Type(), header.ICMPv4EchoReply)
+	}
+	if h.Ident() != 1234 || h.Sequence() != 5 {
+		t.Errorf("got ident %d and sequence %d, want 1234 and 5", h.Ident(), h.Sequence())
+	}
+	if !bytes.Equal(h[header.ICMPv4MinimumSize:], data) {
+		t.Errorf("got data %v, want %v", h[header.ICMPv4MinimumSize:], data)
+	}
+	if xsum := header.ICMPv4Checksum(h); xsum != 0 {
+		t.Errorf("got bad checksum %#x", h.Checksum())
+	}
+
+	stats := s.Stats().ICMP
+	if stats.EchoRequestsReceived != 1 || stats.EchoRepliesSent != 1 {
+		t.Errorf("got %d echo requests received and %d replies sent, want 1 and 1", stats.EchoRequestsReceived, stats.EchoRepliesSent)
+	}
+
+	// Requests with bad checksums aren't answered.
+	p := icmpPacket(testAddr, stackAddr, echo(header.ICMPv4Echo, 1234, 6, data))
+	p[len(p)-1]++
+	linkEP.Inject(ipv4.ProtocolNumber, p)
+	if n := len(linkEP.C); n != 0 {
+		t.Errorf("got %d packets written in reply to a corrupted request", n)
+	}
+	if got := s.Stats().ICMP.ChecksumErrors; got != 1 {
+		t.Errorf("got %d checksum errors, want 1", got)
+	}
+}
+
+func TestEchoReplyRateLimit(t *testing.T) {
+	s, linkEP := newStack(t)
+	clock := faketime.NewManualClock(time.Unix(0, 0))
+	s.SetClock(clock)
+
+	replies := stack.ICMPType{NetProto: header.IPv4ProtocolNumber, Type: uint8(header.ICMPv4EchoReply)}
+	if got := s.ICMPRateLimit(replies); got != (stack.ICMPRateLimit{}) {
+		t.Errorf("got echo reply limit %+v, want none", got)
+	}
+	unreachables := stack.ICMPType{NetProto: header.IPv4ProtocolNumber, Type: uint8(header.ICMPv4DstUnreachable)}
+	if err := s.SetICMPRateLimit(unreachables, stack.ICMPRateLimit{Rate: 1, Burst: 1}); err != tcpip.ErrNotSupported {
+		t.Errorf("SetICMPRateLimit for destination unreachables returned %v, want %v", err, tcpip.ErrNotSupported)
+	}
+	if got := s.ICMPRateLimit(unreachables); got != (stack.ICMPRateLimit{}) {
+		t.Errorf("got destination unreachable limit %+v, want none", got)
+	}
+
+	for _, l := range []stack.ICMPRateLimit{{Rate: -1, Burst: 1}, {Rate: 1, Burst: -1}, {Rate: 1}, {Burst: 1}} {
+		if err := s.SetICMPRateLimit(replies, l); err != tcpip.ErrInvalidOptionValue {
+			t.Errorf("SetICMPRateLimit(%+v) returned %v, want %v", l, err, tcpip.ErrInvalidOptionValue)
+		}
+	}
+
+	// A burst of two replies is allowed, then one per second.
+	if err := s.SetICMPRateLimit(replies, stack.ICMPRateLimit{Rate: 1, Burst: 2}); err != nil {
+		t.Fatalf("SetICMPRateLimit failed: %v", err)
+	}
+
+	request := icmpPacket(testAddr, stackAddr, echo(header.ICMPv4Echo, 1234, 5, nil))
+	for i := 0; i < 3; i++ {
+		linkEP.Inject(ipv4.ProtocolNumber, request)
+	}
+	if n := len(linkEP.C); n != 2 {
+		t.Errorf("got %d replies to a burst of 3 requests, want 2", n)
+	}
+	for len(linkEP.C) != 0 {
+		readICMP(t, linkEP)
+	}
+
+	clock.Advance(time.Second)
+	linkEP.Inject(ipv4.ProtocolNumber, request)
+	linkEP.Inject(ipv4.ProtocolNumber, request)
+	if n := len(linkEP.C); n != 1 {
+		t.Errorf("got %d replies one second later, want 1", n)
+	}
+
+	stats := s.Stats().ICMP
+	if stats.EchoRepliesSent != 3 || stats.RateLimited != 2 {
+		t.Errorf("got %d replies sent and %d rate limited, want 3 and 2", stats.EchoRepliesSent, stats.RateLimited)
+	}
+
+	// Removing the limit lets all requests be answered.
+	if err := s.SetICMPRateLimit(replies, stack.ICMPRateLimit{}); err != nil {
+		t.Fatalf("SetICMPRateLimit failed: %v", err)
+	}
+	readICMP(t, linkEP)
+	for i := 0; i < 3; i++ {
+		linkEP.Inject(ipv4.ProtocolNumber, request)
+	}
+	if n := len(linkEP.C); n != 3 {
+		t.Errorf("got %d replies without limit, want 3", n)
+	}
+}
+
+func TestPingLoopback(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{ping.ProtocolName}).(*stack.Stack)
+	if err := s.CreateNIC(1, loopback.New()); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, "\x7f\x00\x00\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x7f\x00\x00\x00",
+		Mask:        "\xff\x00\x00\x00",
+		NIC:         1,
+	}})
+
+	st, err := ping.Ping(s, "\x7f\x00\x00\x01", ping.Options{Count: 3})
+	if err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+	if st.Sent != 3 || st.Received != 3 || len(st.RTTs) != 3 {
+		t.Errorf("got %d requests sent, %d replies received and %d round-trip times, want 3, 3 and 3", st.Sent, st.Received, len(st.RTTs))
+	}
+	if st.MinRTT > st.AvgRTT || st.AvgRTT > st.MaxRTT {
+		t.Errorf("got round-trip times min %v, avg %v and max %v, want min <= avg <= max", st.MinRTT, st.AvgRTT, st.MaxRTT)
+	}
+}
+
+func TestEndpoint6(t *testing.T) {
+	const addr = tcpip.Address("\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+
+	s := stack.New([]string{ipv6.ProtocolName}, []string{ping.ProtocolName6}).(*stack.Stack)
+	if err := s.CreateNIC(1, loopback.New()); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv6.ProtocolNumber, addr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: addr,
+		Mask:        tcpip.Address(bytes.Repeat([]byte{0xff}, 16)),
+		NIC:         1,
+	}})
+
+	if _, err := s.NewEndpoint(ping.ProtocolNumber6, ipv4.ProtocolNumber, &waiter.Queue{}); err != tcpip.ErrUnknownProtocol {
+		t.Errorf("NewEndpoint of icmp6 over IPv4 returned %v, want %v", err, tcpip.ErrUnknownProtocol)
+	}
+
+	newEndpoint := func() *tcpip.BlockingEndpoint {
+		var wq waiter.Queue
+		ep, err := s.NewEndpoint(ping.ProtocolNumber6, ipv6.ProtocolNumber, &wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %v", err)
+		}
+		if err := ep.Connect(tcpip.FullAddress{Addr: addr}); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		return tcpip.NewBlockingEndpoint(ep, &wq)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	data := []byte{1, 2, 3, 4}
+
+	// Requests are written and replies read with their ICMP header by
+	// default, and the stack sets the identifier of requests.
+	ep := newEndpoint()
+	defer ep.Close()
+	local, err := ep.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("GetLocalAddress failed: %v", err)
+	}
+
+	req := buffer.NewView(header.ICMPv6EchoMinimumSize + len(data))
+	copy(req[header.ICMPv6EchoMinimumSize:], data)
+	header.ICMPv6(req).SetType(header.ICMPv6EchoRequest)
+	header.ICMPv6(req).SetSequence(7)
+	if _, err := ep.Write(req, nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	v, err := ep.ReadContext(ctx, nil)
+	if err != nil {
+		t.Fatalf("ReadContext failed: %v", err)
+	}
+	h := header.ICMPv6(v)
+	if h.Type() != header.ICMPv6EchoReply || h.Ident() != local.Port || h.Sequence() != 7 {
+		t.Errorf("got type %d, ident %d and sequence %d, want %d, %d and 7", h.Type(), h.Ident(), h.Sequence(), header.ICMPv6EchoReply, local.Port)
+	}
+	if !bytes.Equal(h[header.ICMPv6EchoMinimumSize:], data) {
+		t.Errorf("got data %v, want %v", h[header.ICMPv6EchoMinimumSize:], data)
+	}
+
+	// ICMPv4 requests are rejected.
+	header.ICMPv4(req).SetType(header.ICMPv4Echo)
+	if _, err := ep.Write(req, nil); err != tcpip.ErrInvalidEndpointState {
+		t.Errorf("Write of an ICMPv4 request returned %v, want %v", err, tcpip.ErrInvalidEndpointState)
+	}
+
+	// In datagram mode, only the data is written and read.
+	dep := newEndpoint()
+	defer dep.Close()
+	if err := dep.SetSockOpt(ping.DatagramOption(1)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	var opt ping.DatagramOption
+	if err := dep.GetSockOpt(&opt); err != nil || opt != 1 {
+		t.Fatalf("GetSockOpt returned %d, %v, want 1, nil", opt, err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := dep.WriteContext(ctx, append(buffer.View(nil), data...), nil); err != nil {
+			t.Fatalf("WriteContext failed: %v", err)
+		}
+		v, err := dep.ReadContext(ctx, nil)
+		if err != nil {
+			t.Fatalf("ReadContext failed: %v", err)
+		}
+		if !bytes.Equal(v, data) {
+			t.Errorf("got reply %v, want %v", v, data)
+		}
+	}
+
+	if got := s.Stats().ICMP.EchoRepliesReceived; got != 3 {
+		t.Errorf("got %d echo replies received, want 3", got)
+	}
+}
+
+func TestRemovalAbortsEndpoint(t *testing.T) {
+	const ident = 1234
+
+	for _, test := range []struct {
+		name    string
+		connect bool
+		remove  func(*stack.Stack) error
+	}{
+		{"bound, NIC removed", false, func(s *stack.Stack) error { return s.RemoveNIC(1) }},
+		{"connected, NIC removed", true, func(s *stack.Stack) error { return s.RemoveNIC(1) }},
+		{"bound, address removed", false, func(s *stack.Stack) error { return s.RemoveAddress(1, stackAddr) }},
+		{"connected, address removed", true, func(s *stack.Stack) error { return s.RemoveAddress(1, stackAddr) }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s, linkEP := newStack(t)
+
+			var wq waiter.Queue
+			ep, err := s.NewEndpoint(ping.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+			if err != nil {
+				t.Fatalf("NewEndpoint failed: %v", err)
+			}
+			defer ep.Close()
+			if err := ep.Bind(tcpip.FullAddress{NIC: 1, Addr: stackAddr, Port: ident}, nil); err != nil {
+				t.Fatalf("Bind failed: %v", err)
+			}
+			var to *tcpip.FullAddress
+			if test.connect {
+				if err := ep.Connect(tcpip.FullAddress{Addr: testAddr}); err != nil {
+					t.Fatalf("Connect failed: %v", err)
+				}
+			} else {
+				to = &tcpip.FullAddress{Addr: testAddr}
+			}
+
+			data := []byte{1, 2, 3, 4}
+			linkEP.Inject(ipv4.ProtocolNumber, icmpPacket(testAddr, stackAddr, echo(header.ICMPv4EchoReply, ident, 1, data)))
+
+			we, ch := waiter.NewChannelEntry(nil)
+			wq.EventRegister(&we, waiter.EventErr)
+			defer wq.EventUnregister(&we)
+
+			if err := test.remove(s); err != nil {
+				t.Fatalf("Removal failed: %v", err)
+			}
+
+			select {
+			case <-ch:
+			default:
+				t.Errorf("Waiters weren't notified of the error")
+			}
+			if got := ep.Readiness(waiter.EventErr | waiter.EventHUp); got != waiter.EventErr {
+				t.Errorf("Readiness returned %v, want %v", got, waiter.EventErr)
+			}
+
+			// The reply received before the removal can still be
+			// read, then reads and writes fail.
+			if v, err := ep.Read(nil); err != nil || header.ICMPv4(v).Type() != header.ICMPv4EchoReply {
+				t.Errorf("Read returned %v, %v, want the echo reply", v, err)
+			}
+			if _, err := ep.Read(nil); err != tcpip.ErrConnectionAborted {
+				t.Errorf("Read returned %v, want %v", err, tcpip.ErrConnectionAborted)
+			}
+			if _, err := ep.Write(echo(header.ICMPv4Echo, 0, 2, data), to); err != tcpip.ErrConnectionAborted {
+				t.Errorf("Write returned %v, want %v", err, tcpip.ErrConnectionAborted)
+			}
+		})
+	}
+}
+
+func TestPingLoss(t *testing.T) {
+	s, linkEP := newStack(t)
+
+	// Answer all requests but the second one.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case p := <-linkEP.C:
+				b := append(append(buffer.View(nil), p.Header...), p.Payload...)
+				h := header.ICMPv4(b[header.IPv4(b).HeaderLength():])
+				if h.Sequence() == 1 {
+					continue
+				}
+				reply := echo(header.ICMPv4EchoReply, h.Ident(), h.Sequence(), h[header.ICMPv4MinimumSize:])
+				linkEP.Inject(ipv4.ProtocolNumber, icmpPacket(testAddr, stackAddr, reply))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	st, err := ping.Ping(s, testAddr, ping.Options{
+		NIC:     1,
+		Count:   3,
+		Timeout: 100 * time.Millisecond,
+		Size:    8,
+	})
+	if err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+	if st.Sent != 3 || st.Received != 2 {
+		t.Errorf("got %d requests sent and %d replies received, want 3 and 2", st.Sent, st.Received)
+	}
+	if got, want := st.Loss(), 1.0/3; got != want {
+		t.Errorf("got loss %v, want %v", got, want)
+	}
+}
+
+func TestPingTimeout(t *testing.T) {
+	s, _ := newStack(t)
+
+	st, err := ping.Ping(s, testAddr, ping.Options{
+		Count:   2,
+		Timeout: 10 * time.Millisecond,
+	})
+	if err != tcpip.ErrTimeout {
+		t.Fatalf("Ping returned %v, want %v", err, tcpip.ErrTimeout)
+	}
+	if st.Sent != 2 || st.Received != 0 || st.Loss() != 1 {
+		t.Errorf("got %d requests sent, %d replies received and loss %v, want 2, 0 and 1", st.Sent, st.Received, st.Loss())
+	}
+}
+
+func TestTraceroute(t *testing.T) {
+	s, linkEP := newStack(t)
+
+	// Act as two routers, which drop the requests whose TTL expires, and
+	// then testAddr, which answers them.
+	routers := []tcpip.Address{"\x0a\x00\x01\x01", "\x0a\x00\x02\x01"}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case p := <-linkEP.C:
+				b := append(append(buffer.View(nil), p.Header...), p.Payload...)
+				ip := header.IPv4(b)
+				h := header.ICMPv4(b[ip.HeaderLength():])
+				if int(ip.TTL()) > len(routers) {
+					reply := echo(header.ICMPv4EchoReply, h.Ident(), h.Sequence(), h[header.ICMPv4MinimumSize:])
+					linkEP.Inject(ipv4.ProtocolNumber, icmpPacket(testAddr, stackAddr, reply))
+					continue
+				}
+
+				// Time exceeded errors quote the IP header and
+				// the first 8 bytes of the dropped packet.
+				quoted := b[:int(ip.HeaderLength())+header.ICMPv4MinimumSize]
+				msg := buffer.NewView(header.ICMPv4MinimumSize + len(quoted))
+				header.ICMPv4(msg).SetType(header.ICMPv4TimeExceeded)
+				copy(msg[header.ICMPv4MinimumSize:], quoted)
+				linkEP.Inject(ipv4.ProtocolNumber, icmpPacket(routers[ip.TTL()-1], stackAddr, msg))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	hops, err := ping.Traceroute(s, testAddr, ping.TracerouteOptions{Probes: 2})
+	if err != nil {
+		t.Fatalf("Traceroute failed: %v", err)
+	}
+
+	want := append(routers, testAddr)
+	if len(hops) != len(want) {
+		t.Fatalf("got %d hops, want %d", len(hops), len(want))
+	}
+	for i, hop := range hops {
+		if hop.TTL != uint8(i+1) || hop.Addr != want[i] || len(hop.RTTs) != 2 || hop.Unreachable {
+			t.Errorf("got hop %+v, want TTL %d, address %v and 2 round-trip times", hop, i+1, want[i])
+		}
+	}
+
+	if got := s.Stats().ICMP.ErrorsReceived; got != 4 {
+		t.Errorf("got %d errors received, want 4", got)
+	}
+}
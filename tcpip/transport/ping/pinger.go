@@ -0,0 +1,206 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"math"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	// DefaultTimeout is how long Ping waits for each reply when
+	// Options.Timeout is zero.
+	DefaultTimeout = time.Second
+
+	// DefaultSize is the number of data bytes of the echo requests sent by
+	// Ping when Options.Size is zero.
+	DefaultSize = 56
+)
+
+// Options are the settings of Ping.
+type Options struct {
+	// NIC is the NIC the echo requests are sent through, or zero to let
+	// the route table of the stack choose it.
+	NIC tcpip.NICID
+
+	// Count is the number of echo requests sent. Zero is treated as one.
+	Count int
+
+	// Interval is the minimum time between the sending of two echo
+	// requests. Requests are sent one at a time, so the next one is never
+	// sent before the reply to the previous one is received, or times
+	// out.
+	Interval time.Duration
+
+	// Timeout is how long to wait for the reply to each echo request, or
+	// DefaultTimeout if it is zero. Later replies are ignored.
+	Timeout time.Duration
+
+	// Size is the number of data bytes of the echo requests, or
+	// DefaultSize if it is zero.
+	Size int
+}
+
+// Statistics are the results of Ping. Round-trip times are measured with the
+// clock of the stack.
+type Statistics struct {
+	// Sent and Received are the numbers of echo requests sent, and of
+	// replies received in time.
+	Sent     int
+	Received int
+
+	// RTTs holds the round-trip time of each reply received, in order.
+	RTTs []time.Duration
+
+	// MinRTT, AvgRTT, MaxRTT and StdDevRTT summarize RTTs. They are zero
+	// if no replies were received.
+	MinRTT    time.Duration
+	AvgRTT    time.Duration
+	MaxRTT    time.Duration
+	StdDevRTT time.Duration
+}
+
+// Loss returns the fraction of the echo requests that went unanswered.
+func (st *Statistics) Loss() float64 {
+	if st.Sent == 0 {
+		return 0
+	}
+	return float64(st.Sent-st.Received) / float64(st.Sent)
+}
+
+// summarize sets the summary of the round-trip times of st.
+func (st *Statistics) summarize() {
+	st.Received = len(st.RTTs)
+	if st.Received == 0 {
+		return
+	}
+
+	st.MinRTT, st.MaxRTT = st.RTTs[0], st.RTTs[0]
+	var sum time.Duration
+	for _, rtt := range st.RTTs {
+		if rtt < st.MinRTT {
+			st.MinRTT = rtt
+		}
+		if rtt > st.MaxRTT {
+			st.MaxRTT = rtt
+		}
+		sum += rtt
+	}
+	st.AvgRTT = sum / time.Duration(st.Received)
+
+	var variance float64
+	for _, rtt := range st.RTTs {
+		d := float64(rtt - st.AvgRTT)
+		variance += d * d
+	}
+	st.StdDevRTT = time.Duration(math.Sqrt(variance / float64(st.Received)))
+}
+
+// Ping sends echo requests to addr through an endpoint of s, and gathers the
+// round-trip times of the replies, e.g., to check the health of the links of
+// the stack. The stack must have been created with the icmp4 protocol. Ping
+// blocks until all the requests have been answered or have timed out.
+//
+// If no replies were received, Ping returns tcpip.ErrTimeout along with the
+// statistics. If a request can't be sent, it returns the error along with the
+// statistics of the previous requests.
+func Ping(s *stack.Stack, addr tcpip.Address, opts Options) (*Statistics, error) {
+	count := opts.Count
+	if count <= 0 {
+		count = 1
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	size := opts.Size
+	if size <= 0 {
+		size = DefaultSize
+	}
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(ProtocolNumber, header.IPv4ProtocolNumber, &wq)
+	if err != nil {
+		return nil, err
+	}
+	defer ep.Close()
+
+	if err := ep.Connect(tcpip.FullAddress{NIC: opts.NIC, Addr: addr}); err != nil {
+		return nil, err
+	}
+
+	waitEntry, notifyCh := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&waitEntry, waiter.EventIn)
+	defer wq.EventUnregister(&waitEntry)
+
+	req := buffer.NewView(header.ICMPv4MinimumSize + size)
+	for i := header.ICMPv4MinimumSize; i < len(req); i++ {
+		req[i] = byte(i)
+	}
+	header.ICMPv4(req).SetType(header.ICMPv4Echo)
+
+	clock := s.Clock()
+	st := &Statistics{}
+	for i := 0; i < count; i++ {
+		seq := uint16(i)
+		header.ICMPv4(req).SetSequence(seq)
+
+		start := clock.Now()
+		if _, err := ep.Write(req, nil); err != nil {
+			st.summarize()
+			return st, err
+		}
+		st.Sent++
+
+		if waitReply(ep, notifyCh, clock, seq, timeout) {
+			st.RTTs = append(st.RTTs, clock.Now().Sub(start))
+		}
+
+		if i+1 < count {
+			if d := opts.Interval - clock.Now().Sub(start); d > 0 {
+				<-clock.NewTimer(d).C()
+			}
+		}
+	}
+
+	st.summarize()
+	if st.Received == 0 {
+		return st, tcpip.ErrTimeout
+	}
+	return st, nil
+}
+
+// waitReply waits for the reply to the echo request with the given sequence
+// number to be received by ep, discarding the replies to earlier requests and
+// errors. It returns false if the reply isn't received within timeout.
+func waitReply(ep tcpip.Endpoint, notifyCh <-chan interface{}, clock tcpip.Clock, seq uint16, timeout time.Duration) bool {
+	t := clock.NewTimer(timeout)
+	defer t.Stop()
+
+	for {
+		v, err := ep.Read(nil)
+		if err == tcpip.ErrWouldBlock {
+			select {
+			case <-notifyCh:
+				continue
+			case <-t.C():
+				return false
+			}
+		}
+		if err != nil {
+			return false
+		}
+
+		if h := header.ICMPv4(v); h.Type() == header.ICMPv4EchoReply && h.Sequence() == seq {
+			return true
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	// DefaultMaxHops is the maximum TTL of the probes sent by Traceroute
+	// when TracerouteOptions.MaxHops is zero.
+	DefaultMaxHops = 30
+
+	// DefaultProbes is the number of probes sent by Traceroute for each
+	// hop when TracerouteOptions.Probes is zero.
+	DefaultProbes = 3
+)
+
+// TracerouteOptions are the settings of Traceroute.
+type TracerouteOptions struct {
+	// NIC is the NIC the probes are sent through, or zero to let the route
+	// table of the stack choose it.
+	NIC tcpip.NICID
+
+	// MaxHops is the maximum TTL of the probes, or DefaultMaxHops if it is
+	// zero.
+	MaxHops int
+
+	// Probes is the number of probes sent for each hop, or DefaultProbes
+	// if it is zero.
+	Probes int
+
+	// Timeout is how long to wait for the answer to each probe, or
+	// DefaultTimeout if it is zero.
+	Timeout time.Duration
+}
+
+// Hop describes the answers to the probes sent with a TTL by Traceroute.
+type Hop struct {
+	// TTL is the TTL of the probes.
+	TTL uint8
+
+	// Addr is the address of the host that answered the probes, or is
+	// empty if none was answered. If different hosts answered, it is the
+	// last one.
+	Addr tcpip.Address
+
+	// RTTs holds the round-trip time of each probe answered, in order.
+	RTTs []time.Duration
+
+	// Unreachable is set if the host reported the destination as
+	// unreachable.
+	Unreachable bool
+}
+
+// Traceroute discovers the route to addr from s, by sending ICMP echo requests
+// with increasing TTLs, and collecting the time exceeded errors of the routers
+// that drop them. It stops once addr answers, a host reports it unreachable, or
+// the TTL reaches the maximum number of hops. The stack must have been created
+// with the icmp4 protocol. Traceroute blocks until all the probes have been
+// answered or have timed out.
+//
+// The destination was reached if the Addr of the last hop is addr.
+func Traceroute(s *stack.Stack, addr tcpip.Address, opts TracerouteOptions) ([]Hop, error) {
+	maxHops := opts.MaxHops
+	if maxHops <= 0 || maxHops > 0xff {
+		maxHops = DefaultMaxHops
+	}
+	probes := opts.Probes
+	if probes <= 0 {
+		probes = DefaultProbes
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	// The endpoint isn't connected, so that it receives the errors of
+	// routers.
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(ProtocolNumber, header.IPv4ProtocolNumber, &wq)
+	if err != nil {
+		return nil, err
+	}
+	defer ep.Close()
+
+	if err := ep.Bind(tcpip.FullAddress{NIC: opts.NIC}, nil); err != nil {
+		return nil, err
+	}
+
+	waitEntry, notifyCh := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&waitEntry, waiter.EventIn)
+	defer wq.EventUnregister(&waitEntry)
+
+	req := buffer.NewView(header.ICMPv4MinimumSize)
+	header.ICMPv4(req).SetType(header.ICMPv4Echo)
+	to := &tcpip.FullAddress{NIC: opts.NIC, Addr: addr}
+
+	clock := s.Clock()
+	var hops []Hop
+	var seq uint16
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		if err := ep.SetSockOpt(tcpip.TTLOption(ttl)); err != nil {
+			return hops, err
+		}
+
+		hop := Hop{TTL: uint8(ttl)}
+		for i := 0; i < probes; i++ {
+			seq++
+			header.ICMPv4(req).SetSequence(seq)
+
+			start := clock.Now()
+			if _, err := ep.Write(req, to); err != nil {
+				return hops, err
+			}
+
+			from, typ, ok := waitAnswer(ep, notifyCh, clock, seq, timeout)
+			if !ok {
+				continue
+			}
+
+			hop.Addr = from
+			hop.RTTs = append(hop.RTTs, clock.Now().Sub(start))
+			if typ == header.ICMPv4DstUnreachable {
+				hop.Unreachable = true
+			}
+		}
+
+		hops = append(hops, hop)
+		if hop.Addr == addr || hop.Unreachable {
+			break
+		}
+	}
+
+	return hops, nil
+}
+
+// waitAnswer waits for the answer to the probe with the given sequence number
+// to be received by ep: an echo reply or an error quoting the probe. It returns
+// the address of the host that sent it and its type, or false if no answer is
+// received within timeout.
+func waitAnswer(ep tcpip.Endpoint, notifyCh <-chan interface{}, clock tcpip.Clock, seq uint16, timeout time.Duration) (tcpip.Address, header.ICMPv4Type, bool) {
+	t := clock.NewTimer(timeout)
+	defer t.Stop()
+
+	for {
+		var from tcpip.FullAddress
+		v, err := ep.Read(&from)
+		if err == tcpip.ErrWouldBlock {
+			select {
+			case <-notifyCh:
+				continue
+			case <-t.C():
+				return "", 0, false
+			}
+		}
+		if err != nil {
+			return "", 0, false
+		}
+
+		h := header.ICMPv4(v)
+		switch h.Type() {
+		case header.ICMPv4EchoReply:
+			if h.Sequence() == seq {
+				return from.Addr, h.Type(), true
+			}
+
+		case header.ICMPv4DstUnreachable, header.ICMPv4TimeExceeded:
+			if req, ok := quotedEcho(ProtocolNumber, h); ok && req.Sequence() == seq {
+				return from.Addr, h.Type(), true
+			}
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sctp
+
+import (
+	"sync/atomic"
+
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/waiter"
+)
+
+// protocolListenLoop is the main loop of a listening SCTP endpoint. Listeners
+// keep no state for the associations being set up: they send it to the peers in
+// state cookies, which the peers echo back.
+func (e *endpoint) protocolListenLoop() {
+	defer func() {
+		// Mark endpoint as closed.
+		e.mu.Lock()
+		e.state = stateClosed
+		e.mu.Unlock()
+
+		// Notify waiters that the endpoint is shutdown.
+		e.waiterQueue.Notify(waiter.EventIn | waiter.EventOut)
+
+		// Do cleanup if needed.
+		e.completeWorker()
+	}()
+
+	for {
+		select {
+		case p := <-e.segmentChan:
+			e.handleListenPacket(p)
+			p.route.Release()
+
+		case <-e.notifyChan:
+			if e.fetchNotifications()&(notifyClose|notifyAbort) != 0 {
+				return
+			}
+		}
+	}
+}
+
+// handleListenPacket handles a packet received by a listening endpoint, which
+// holds no association. It answers INIT chunks with INIT ACK chunks, and sets
+// the associations of valid COOKIE ECHO chunks up.
+func (e *endpoint) handleListenPacket(p *packet) {
+	h := p.header()
+	c, rest, ok := header.NextSCTPChunk(h.Chunks())
+	if !ok {
+		atomic.AddUint64(&p.route.Stats().SCTP.MalformedPacketsReceived, 1)
+		return
+	}
+
+	switch c.Type() {
+	case header.SCTPChunkInit:
+		// INIT chunks are alone in their packet, whose verification tag
+		// is zero.
+		if h.VerificationTag() != 0 || len(rest) != 0 || len(c.Value()) < header.SCTPInitSize {
+			atomic.AddUint64(&p.route.Stats().SCTP.MalformedPacketsReceived, 1)
+			return
+		}
+		e.handleInit(p, header.SCTPInit(c.Value()).Fields())
+
+	case header.SCTPChunkCookieEcho:
+		ck, ok := decodeCookie(e.protocol, p.id, c.Value(), e.stack.Clock().Now())
+		if !ok || h.VerificationTag() != ck.localTag {
+			return
+		}
+
+		// Drop the cookie if the accept queue is full; the peer will
+		// echo it again.
+		if len(e.acceptedChan) == cap(e.acceptedChan) {
+			return
+		}
+
+		n, err := e.createEndpointFromCookie(p, &ck)
+		if err != nil {
+			return
+		}
+		n.assoc.sendControl(header.SCTPChunkCookieAck)
+
+		// The chunks bundled after the COOKIE ECHO chunk are handled
+		// by the new endpoint.
+		if len(rest) != 0 {
+			data := make([]byte, 0, header.SCTPMinimumSize+len(rest))
+			data = append(data, p.data[:header.SCTPMinimumSize]...)
+			data = append(data, rest...)
+			n.segmentChan <- &packet{route: p.route.Clone(), id: p.id, data: data}
+		}
+
+		e.acceptedChan <- n
+		e.waiterQueue.Notify(waiter.EventIn)
+
+	default:
+		replyOutOfTheBlue(&p.route, p.id, h)
+	}
+}
+
+// handleInit answers the INIT chunk of the packet p with an INIT ACK chunk,
+// whose state cookie holds the parameters of the association.
+func (e *endpoint) handleInit(p *packet, f header.SCTPInitFields) {
+	if f.InitiateTag == 0 || f.OutboundStreams == 0 || f.InboundStreams == 0 {
+		sendControl(&p.route, p.id, f.InitiateTag, header.SCTPChunkAbort, 0)
+		return
+	}
+
+	localTag, err := randomTag()
+	if err != nil {
+		return
+	}
+	localTSN, err := randomUint32()
+	if err != nil {
+		return
+	}
+
+	e.mu.RLock()
+	streams := e.streams
+	e.mu.RUnlock()
+
+	e.rcvMu.Lock()
+	window := e.rcvBufSize
+	e.rcvMu.Unlock()
+
+	ck := cookie{
+		created:    e.stack.Clock().Now(),
+		localTag:   localTag,
+		peerTag:    f.InitiateTag,
+		localTSN:   localTSN,
+		peerTSN:    f.InitialTSN,
+		peerWindow: f.Window,
+		outStreams: min16(streams.Outbound, f.InboundStreams),
+		inStreams:  min16(streams.Inbound, f.OutboundStreams),
+	}
+	b := ck.encode(e.protocol, p.id)
+
+	size := header.SCTPInitSize + header.SCTPParamSize(len(b))
+	r := newPacketBuilder(header.SCTPMinimumSize + header.SCTPChunkSize(size))
+	v := r.chunk(header.SCTPChunkInitAck, 0, size)
+	header.SCTPInit(v).Encode(&header.SCTPInitFields{
+		InitiateTag:     localTag,
+		Window:          uint32(window),
+		OutboundStreams: ck.outStreams,
+		InboundStreams:  streams.Inbound,
+		InitialTSN:      localTSN,
+	})
+	copy(header.EncodeSCTPParam(v[header.SCTPInitSize:], header.SCTPParamStateCookie, len(b)), b)
+	r.send(&p.route, p.id, f.InitiateTag)
+}
+
+// createEndpointFromCookie creates a new endpoint in connected state, with the
+// association of the state cookie ck, echoed in the packet p.
+func (e *endpoint) createEndpointFromCookie(p *packet, ck *cookie) (*endpoint, error) {
+	n := newEndpoint(e.stack, e.protocol, p.route.NetProto, nil)
+	n.id = p.id
+	n.boundNICID = p.route.NICID()
+	n.route = p.route.Clone()
+
+	e.rcvMu.Lock()
+	n.rcvBufSize = e.rcvBufSize
+	e.rcvMu.Unlock()
+
+	e.sndMu.Lock()
+	n.sndBufSize = e.sndBufSize
+	e.sndMu.Unlock()
+
+	// Register new endpoint so that packets are routed to it.
+	if err := n.stack.RegisterTransportEndpoint(n.boundNICID, ProtocolNumber, n.id, n); err != nil {
+		n.Close()
+		return nil, err
+	}
+
+	n.isRegistered = true
+	n.state = stateConnected
+	n.streams = StreamsOption{Outbound: ck.outStreams, Inbound: ck.inStreams}
+	n.assoc = newAssociation(n, ck.localTag, ck.peerTag, ck.localTSN, ck.peerTSN, ck.peerWindow, ck.outStreams, ck.inStreams)
+
+	atomic.AddUint64(&n.route.Stats().SCTP.PassiveAssociationOpenings, 1)
+
+	return n, nil
+}
+
+// abortUnaccepted aborts the association of an endpoint its listener set up,
+// but that was never accepted, and cleans the endpoint up.
+func (e *endpoint) abortUnaccepted() {
+	e.assoc.sendControl(header.SCTPChunkAbort)
+	e.assoc.stop()
+	e.cleanup()
+}
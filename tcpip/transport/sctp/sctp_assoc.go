@@ -0,0 +1,752 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sctp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/seqnum"
+	"github.com/google/netstack/waiter"
+)
+
+// outChunk is a DATA chunk of the sender, which holds a message or a fragment
+// of one.
+type outChunk struct {
+	tsn    seqnum.Value
+	flags  uint8
+	stream uint16
+	ssn    uint16
+	ppid   uint32
+	data   buffer.View
+
+	// inFlight is set while the chunk is sent and neither acknowledged
+	// nor considered lost.
+	inFlight bool
+
+	// gapAcked is set once a gap block of the peer acknowledged the
+	// chunk, and retransmit while it waits to be retransmitted.
+	gapAcked   bool
+	retransmit bool
+
+	// transmissions is the number of times the chunk was sent, and
+	// missing the number of SACKs that reported it missing since.
+	transmissions int
+	missing       int
+}
+
+// inChunk is a DATA chunk received from the peer, waiting to be reassembled and
+// delivered.
+type inChunk struct {
+	tsn    seqnum.Value
+	flags  uint8
+	stream uint16
+	ssn    uint16
+	ppid   uint32
+	data   []byte
+}
+
+// association holds the state of an established association. It is only
+// accessed by the protocol goroutine of its endpoint.
+type association struct {
+	e *endpoint
+
+	// localTag and peerTag are the verification tags of the packets the
+	// endpoint receives and sends.
+	localTag uint32
+	peerTag  uint32
+
+	// mtu is the maximum size of the packets of the association.
+	mtu int
+
+	// The following fields hold the state of the sender. ackedTSN is the
+	// last cumulative TSN ack of the peer, outstanding holds the chunks
+	// sent after it, in TSN order, and pending the chunks that weren't
+	// sent yet. retransmits is the number of outstanding chunks marked for
+	// retransmission.
+	nextTSN     seqnum.Value
+	ackedTSN    seqnum.Value
+	outSSN      []uint16
+	outstanding []*outChunk
+	pending     []*outChunk
+	retransmits int
+
+	// The following fields hold the state of the congestion control, per
+	// RFC 4960, section 7.2. peerWindow is the receive window of the peer,
+	// minus the data in flight.
+	flightSize        int
+	peerWindow        int
+	cwnd              int
+	ssthresh          int
+	partialBytesAcked int
+	fastRecovery      bool
+	recoveryTSN       seqnum.Value
+
+	// The following fields hold the state of the retransmission timer,
+	// per RFC 4960, section 6.3. rttTSN is the TSN of the chunk whose round
+	// trip time is being measured, if rttMeasuring is set.
+	rto          time.Duration
+	srtt         time.Duration
+	rttvar       time.Duration
+	rttMeasured  bool
+	rttMeasuring bool
+	rttTSN       seqnum.Value
+	rttStart     time.Time
+	t3           tcpip.Timer
+	t3Enabled    bool
+
+	// errorCount is the number of consecutive retransmission timeouts.
+	errorCount int
+
+	// shutdown is the state of the graceful shutdown of the association,
+	// and t2 the timer of its retransmissions.
+	shutdown  shutdownState
+	t2        tcpip.Timer
+	t2Enabled bool
+
+	// The following fields hold the state of the receiver. cumTSN is the
+	// last TSN received in sequence, received holds the TSNs received
+	// after it, and reasm the chunks waiting to be delivered, in TSN order.
+	cumTSN     seqnum.Value
+	received   map[seqnum.Value]struct{}
+	reasm      []*inChunk
+	reasmBytes int
+	inSSN      []uint16
+}
+
+// randomUint32 returns a random number, which may be zero.
+func randomUint32() (uint32, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+// randomTag returns a random verification tag, which can't be zero.
+func randomTag() (uint32, error) {
+	for {
+		t, err := randomUint32()
+		if err != nil || t != 0 {
+			return t, err
+		}
+	}
+}
+
+// newAssociation returns the state of an association of e, with the given
+// verification tags, initial TSNs, peer receive window and numbers of streams.
+func newAssociation(e *endpoint, localTag, peerTag, localTSN, peerTSN, peerWindow uint32, outStreams, inStreams uint16) *association {
+	mtu := int(e.route.MTU())
+	t3 := e.stack.Clock().NewTimer(time.Hour)
+	t3.Stop()
+	t2 := e.stack.Clock().NewTimer(time.Hour)
+	t2.Stop()
+	return &association{
+		e:          e,
+		localTag:   localTag,
+		peerTag:    peerTag,
+		mtu:        mtu,
+		nextTSN:    seqnum.Value(localTSN),
+		ackedTSN:   seqnum.Value(localTSN) - 1,
+		outSSN:     make([]uint16, outStreams),
+		peerWindow: int(peerWindow),
+		// The initial congestion window of RFC 4960, section 7.2.1.
+		cwnd:     min(4*mtu, max(2*mtu, 4380)),
+		ssthresh: int(peerWindow),
+		rto:      initialRTO,
+		t3:       t3,
+		t2:       t2,
+		cumTSN:   seqnum.Value(peerTSN) - 1,
+		received: make(map[seqnum.Value]struct{}),
+		inSSN:    make([]uint16, inStreams),
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// stop stops the timers of the association.
+func (a *association) stop() {
+	a.t3.Stop()
+	a.t2.Stop()
+}
+
+// send sends the packet built by p to the peer.
+func (a *association) send(p *packetBuilder) {
+	p.send(&a.e.route, a.e.id, a.peerTag)
+}
+
+// sendControl sends a chunk of the given type with no value to the peer.
+func (a *association) sendControl(t header.SCTPChunkType) {
+	sendControl(&a.e.route, a.e.id, a.peerTag, t, 0)
+}
+
+// maxFragmentSize returns the maximum size of the user data of the DATA chunks
+// the association sends. It is a multiple of 4, so that the padding of the
+// chunks doesn't overflow the MTU.
+func (a *association) maxFragmentSize() int {
+	return (a.mtu - header.SCTPMinimumSize - header.SCTPChunkHeaderSize - header.SCTPDataHeaderSize) &^ 3
+}
+
+// handleWrite moves the messages queued by the endpoint to the pending chunks,
+// fragmenting them as needed, and assigns their TSNs and stream sequence
+// numbers.
+func (a *association) handleWrite() {
+	e := a.e
+	e.sndMu.Lock()
+	queue := e.sndQueue
+	e.sndQueue = nil
+	e.sndMu.Unlock()
+
+	maxSize := a.maxFragmentSize()
+	for _, m := range queue {
+		var flags uint8
+		var ssn uint16
+		if m.info.Unordered {
+			flags |= header.SCTPFlagUnordered
+		} else {
+			ssn = a.outSSN[m.info.Stream]
+			a.outSSN[m.info.Stream]++
+		}
+
+		flags |= header.SCTPFlagBeginning
+		for data := m.data; len(data) > 0; {
+			n := min(len(data), maxSize)
+			c := &outChunk{
+				tsn:    a.nextTSN,
+				flags:  flags,
+				stream: m.info.Stream,
+				ssn:    ssn,
+				ppid:   m.info.PPID,
+				data:   data[:n],
+			}
+			data = data[n:]
+			if len(data) == 0 {
+				c.flags |= header.SCTPFlagEnd
+			}
+			a.pending = append(a.pending, c)
+			a.nextTSN++
+			flags &^= header.SCTPFlagBeginning
+		}
+	}
+}
+
+// nextChunk returns the next chunk to send: the first one marked for
+// retransmission, or the first pending one. It returns nil if there is none.
+func (a *association) nextChunk() *outChunk {
+	if a.retransmits > 0 {
+		for _, c := range a.outstanding {
+			if c.retransmit {
+				return c
+			}
+		}
+	}
+	if len(a.pending) > 0 {
+		return a.pending[0]
+	}
+	return nil
+}
+
+// sendData sends the chunks marked for retransmission and the pending ones, as
+// far as the congestion window and the receive window of the peer allow,
+// bundling as many as fit in each packet.
+func (a *association) sendData() {
+	p := newPacketBuilder(a.mtu)
+	for {
+		c := a.nextChunk()
+		if c == nil || a.flightSize >= a.cwnd {
+			break
+		}
+
+		// A single chunk probes a closed window when nothing is in
+		// flight.
+		if a.flightSize > 0 && len(c.data) > a.peerWindow {
+			break
+		}
+
+		if p.len()+header.SCTPChunkSize(header.SCTPDataHeaderSize+len(c.data)) > a.mtu {
+			a.send(p)
+			p = newPacketBuilder(a.mtu)
+		}
+		v := p.chunk(header.SCTPChunkData, c.flags, header.SCTPDataHeaderSize+len(c.data))
+		header.SCTPData(v).Encode(uint32(c.tsn), c.stream, c.ssn, c.ppid)
+		copy(v[header.SCTPDataHeaderSize:], c.data)
+
+		if c.retransmit {
+			c.retransmit = false
+			a.retransmits--
+			atomic.AddUint64(&a.e.route.Stats().SCTP.Retransmits, 1)
+
+			// Karn's algorithm: retransmitted chunks don't measure
+			// the round trip time.
+			if a.rttMeasuring && a.rttTSN == c.tsn {
+				a.rttMeasuring = false
+			}
+		} else {
+			a.pending[0] = nil
+			a.pending = a.pending[1:]
+			a.outstanding = append(a.outstanding, c)
+			if !a.rttMeasuring {
+				a.rttMeasuring = true
+				a.rttTSN = c.tsn
+				a.rttStart = a.e.stack.Clock().Now()
+			}
+		}
+
+		c.inFlight = true
+		c.transmissions++
+		c.missing = 0
+		a.flightSize += len(c.data)
+		a.peerWindow = max(a.peerWindow-len(c.data), 0)
+	}
+
+	if !p.empty() {
+		a.send(p)
+	}
+
+	if a.flightSize > 0 && !a.t3Enabled {
+		a.t3Enabled = true
+		a.t3.Reset(a.rto)
+	}
+}
+
+// removeFromFlight takes c out of the data in flight, if it's in it.
+func (a *association) removeFromFlight(c *outChunk) {
+	if c.inFlight {
+		c.inFlight = false
+		a.flightSize -= len(c.data)
+	}
+}
+
+// markForRetransmit marks c for retransmission.
+func (a *association) markForRetransmit(c *outChunk) {
+	a.removeFromFlight(c)
+	if !c.retransmit {
+		c.retransmit = true
+		a.retransmits++
+	}
+}
+
+// handleSack handles the SACK s of the peer, which must hold its gap blocks.
+func (a *association) handleSack(s header.SCTPSack) {
+	cum := seqnum.Value(s.CumulativeTSNAck())
+	if cum.LessThan(a.ackedTSN) || a.ackedTSN.Add(seqnum.Size(len(a.outstanding))).LessThan(cum) {
+		// The SACK is older than the last one, or acknowledges
+		// chunks that were never sent.
+		return
+	}
+
+	advanced := cum != a.ackedTSN
+	newlyAcked := 0
+	released := 0
+
+	// Remove the chunks acknowledged cumulatively.
+	n := 0
+	for ; n < len(a.outstanding) && !cum.LessThan(a.outstanding[n].tsn); n++ {
+		c := a.outstanding[n]
+		a.removeFromFlight(c)
+		if !c.gapAcked {
+			newlyAcked += len(c.data)
+		}
+		if c.retransmit {
+			a.retransmits--
+		}
+		if a.rttMeasuring && c.tsn == a.rttTSN {
+			a.rttMeasuring = false
+			if c.transmissions == 1 {
+				a.updateRTO(a.e.stack.Clock().Now().Sub(a.rttStart))
+			}
+		}
+		released += len(c.data)
+		a.outstanding[n] = nil
+	}
+	a.outstanding = a.outstanding[n:]
+	a.ackedTSN = cum
+
+	// Mark the chunks acknowledged by gap blocks. The outstanding chunks
+	// have consecutive TSNs, starting right after the cumulative TSN ack.
+	highest := cum
+	for i := 0; i < s.GapBlocks() && len(s) >= header.SCTPSackSize+4*(i+1); i++ {
+		start, end := s.GapBlock(i)
+		for j := int(start) - 1; j < int(end) && j < len(a.outstanding); j++ {
+			if j < 0 {
+				continue
+			}
+			c := a.outstanding[j]
+			if !c.gapAcked {
+				c.gapAcked = true
+				newlyAcked += len(c.data)
+				a.removeFromFlight(c)
+				if c.retransmit {
+					c.retransmit = false
+					a.retransmits--
+				}
+			}
+		}
+		if t := cum.Add(seqnum.Size(end)); highest.LessThan(t) {
+			highest = t
+		}
+	}
+
+	// Chunks reported missing by three SACKs are retransmitted right away,
+	// per RFC 4960, section 7.2.4.
+	fastRetransmit := false
+	for _, c := range a.outstanding {
+		if !c.tsn.LessThan(highest) {
+			break
+		}
+		if c.gapAcked || c.retransmit {
+			continue
+		}
+		c.missing++
+		if c.missing == 3 {
+			a.markForRetransmit(c)
+			fastRetransmit = true
+		}
+	}
+	if a.fastRecovery && !cum.LessThan(a.recoveryTSN) {
+		a.fastRecovery = false
+	}
+	if fastRetransmit && !a.fastRecovery {
+		a.fastRecovery = true
+		a.recoveryTSN = a.nextTSN - 1
+		a.ssthresh = max(a.cwnd/2, 4*a.mtu)
+		a.cwnd = a.ssthresh
+		a.partialBytesAcked = 0
+	}
+
+	// Grow the congestion window, in slow start or congestion avoidance.
+	if advanced {
+		a.errorCount = 0
+		if !a.fastRecovery {
+			if a.cwnd <= a.ssthresh {
+				a.cwnd += min(newlyAcked, a.mtu)
+			} else {
+				a.partialBytesAcked += newlyAcked
+				if a.partialBytesAcked >= a.cwnd {
+					a.partialBytesAcked -= a.cwnd
+					a.cwnd += a.mtu
+				}
+			}
+		}
+	}
+
+	a.peerWindow = max(int(s.Window())-a.flightSize, 0)
+
+	// The retransmission timer runs while data is in flight, and restarts
+	// when the earliest outstanding chunk is acknowledged.
+	if a.flightSize == 0 {
+		a.stopT3()
+	} else if advanced {
+		a.t3Enabled = true
+		a.t3.Reset(a.rto)
+	}
+
+	a.e.releaseSendBuffer(released)
+}
+
+// stopT3 stops the retransmission timer, and drains its channel.
+func (a *association) stopT3() {
+	if !a.t3Enabled {
+		return
+	}
+	a.t3Enabled = false
+	a.t3.Stop()
+	select {
+	case <-a.t3.C():
+	default:
+	}
+}
+
+// updateRTO updates the retransmission timeout with the round trip time
+// measurement r, per RFC 4960, section 6.3.1.
+func (a *association) updateRTO(r time.Duration) {
+	if !a.rttMeasured {
+		a.rttMeasured = true
+		a.srtt = r
+		a.rttvar = r / 2
+	} else {
+		delta := a.srtt - r
+		if delta < 0 {
+			delta = -delta
+		}
+		a.rttvar = (3*a.rttvar + delta) / 4
+		a.srtt = (7*a.srtt + r) / 8
+	}
+
+	a.rto = a.srtt + 4*a.rttvar
+	if a.rto < minRTO {
+		a.rto = minRTO
+	}
+	if a.rto > maxRTO {
+		a.rto = maxRTO
+	}
+}
+
+// t3Expired handles the expiration of the retransmission timer, per RFC 4960,
+// section 6.3.3: the chunks in flight are retransmitted, starting over from a
+// congestion window of one packet. It returns false if the peer must be
+// considered unreachable instead.
+func (a *association) t3Expired() bool {
+	a.t3Enabled = false
+	a.errorCount++
+	if a.errorCount > maxAssociationRetransmits {
+		return false
+	}
+
+	a.ssthresh = max(a.cwnd/2, 4*a.mtu)
+	a.cwnd = a.mtu
+	a.partialBytesAcked = 0
+	a.fastRecovery = false
+	a.rttMeasuring = false
+	a.rto = minDuration(2*a.rto, maxRTO)
+
+	for _, c := range a.outstanding {
+		if !c.gapAcked {
+			a.markForRetransmit(c)
+		}
+	}
+
+	a.sendData()
+	return true
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// handleData handles the DATA chunk c of the peer. It returns false if the chunk
+// is malformed.
+func (a *association) handleData(c header.SCTPChunk) bool {
+	if len(c.Value()) <= header.SCTPDataHeaderSize {
+		return false
+	}
+	d := header.SCTPData(c.Value())
+	tsn := seqnum.Value(d.TSN())
+
+	// Drop duplicates.
+	if !a.cumTSN.LessThan(tsn) {
+		return true
+	}
+	if _, ok := a.received[tsn]; ok {
+		return true
+	}
+
+	// Chunks of streams the peer may not use are acknowledged, for the
+	// peer to stop sending them, but discarded.
+	stream := d.StreamID()
+	if int(stream) >= len(a.inSSN) {
+		a.markReceived(tsn)
+		return true
+	}
+
+	// Drop chunks that don't fit in the receive buffer, unless they fill
+	// the first hole.
+	size := len(d.UserData())
+	if tsn != a.cumTSN+1 && a.receiveWindow() < size {
+		return true
+	}
+
+	ic := &inChunk{
+		tsn:    tsn,
+		flags:  c.Flags(),
+		stream: stream,
+		ssn:    d.StreamSequence(),
+		ppid:   d.PayloadProtocol(),
+		data:   d.UserData(),
+	}
+	i := sort.Search(len(a.reasm), func(i int) bool { return tsn.LessThan(a.reasm[i].tsn) })
+	a.reasm = append(a.reasm, nil)
+	copy(a.reasm[i+1:], a.reasm[i:])
+	a.reasm[i] = ic
+	a.reasmBytes += size
+
+	a.markReceived(tsn)
+	return true
+}
+
+// markReceived records that the chunk of the given TSN was received.
+func (a *association) markReceived(tsn seqnum.Value) {
+	if tsn != a.cumTSN+1 {
+		a.received[tsn] = struct{}{}
+		return
+	}
+
+	a.cumTSN++
+	for {
+		if _, ok := a.received[a.cumTSN+1]; !ok {
+			break
+		}
+		delete(a.received, a.cumTSN+1)
+		a.cumTSN++
+	}
+}
+
+// receiveWindow returns the space left in the receive buffer, for messages
+// being reassembled or queued to the endpoint.
+func (a *association) receiveWindow() int {
+	e := a.e
+	e.rcvMu.Lock()
+	w := e.rcvBufSize - e.rcvBufUsed - a.reasmBytes
+	e.rcvMu.Unlock()
+	return max(w, 0)
+}
+
+// deliver queues the messages whose chunks were all received to the endpoint.
+// Ordered messages are only delivered after the previous messages of their
+// stream, but independently of the other streams.
+func (a *association) deliver() {
+	var msgs []message
+	for progress := true; progress; {
+		progress = false
+		for i := 0; i < len(a.reasm); {
+			first := a.reasm[i]
+			if first.flags&header.SCTPFlagBeginning == 0 {
+				i++
+				continue
+			}
+
+			// Find the last fragment of the message, which must
+			// follow the first one without gaps.
+			j, complete := i, false
+			for ; j < len(a.reasm); j++ {
+				c := a.reasm[j]
+				if j > i && (c.tsn != a.reasm[j-1].tsn+1 || c.flags&header.SCTPFlagBeginning != 0) {
+					break
+				}
+				if c.flags&header.SCTPFlagEnd != 0 {
+					complete = true
+					break
+				}
+			}
+			if !complete {
+				i = j
+				continue
+			}
+
+			ordered := first.flags&header.SCTPFlagUnordered == 0
+			if ordered && first.ssn != a.inSSN[first.stream] {
+				i = j + 1
+				continue
+			}
+
+			size := 0
+			for _, c := range a.reasm[i : j+1] {
+				size += len(c.data)
+			}
+			data := make(buffer.View, 0, size)
+			for _, c := range a.reasm[i : j+1] {
+				data = append(data, c.data...)
+			}
+			msgs = append(msgs, message{
+				data: data,
+				info: Info{
+					Stream:    first.stream,
+					SSN:       first.ssn,
+					PPID:      first.ppid,
+					Unordered: !ordered,
+					TSN:       uint32(first.tsn),
+				},
+			})
+			if ordered {
+				a.inSSN[first.stream]++
+			}
+
+			a.reasm = append(a.reasm[:i], a.reasm[j+1:]...)
+			a.reasmBytes -= size
+			progress = true
+		}
+	}
+
+	if len(msgs) > 0 {
+		a.e.queueReceived(msgs)
+	}
+}
+
+// sendSack acknowledges the chunks received, with gap blocks for the ones
+// received out of order, and advertises the receive window.
+func (a *association) sendSack() {
+	offsets := make([]int, 0, len(a.received))
+	for tsn := range a.received {
+		offsets = append(offsets, int(tsn-a.cumTSN))
+	}
+	sort.Ints(offsets)
+
+	// Merge the TSNs into blocks, as many as fit in a packet.
+	maxBlocks := (a.mtu - header.SCTPMinimumSize - header.SCTPChunkHeaderSize - header.SCTPSackSize) / 4
+	var blocks [][2]int
+	for _, o := range offsets {
+		if o > 0xffff {
+			break
+		}
+		if n := len(blocks); n > 0 && blocks[n-1][1] == o-1 {
+			blocks[n-1][1] = o
+			continue
+		}
+		if len(blocks) == maxBlocks {
+			break
+		}
+		blocks = append(blocks, [2]int{o, o})
+	}
+
+	size := header.SCTPSackSize + 4*len(blocks)
+	p := newPacketBuilder(header.SCTPMinimumSize + header.SCTPChunkSize(size))
+	s := header.SCTPSack(p.chunk(header.SCTPChunkSack, 0, size))
+	s.Encode(uint32(a.cumTSN), uint32(a.receiveWindow()), len(blocks))
+	for i, b := range blocks {
+		s.SetGapBlock(i, uint16(b[0]), uint16(b[1]))
+	}
+	a.send(p)
+}
+
+// queueReceived queues the messages to the receive list, and notifies the
+// readers if it was empty.
+func (e *endpoint) queueReceived(msgs []message) {
+	e.rcvMu.Lock()
+	wasEmpty := len(e.rcvList) == 0
+	for _, m := range msgs {
+		e.rcvList = append(e.rcvList, m)
+		e.rcvBufUsed += len(m.data)
+	}
+	e.rcvMu.Unlock()
+
+	if wasEmpty {
+		e.waiterQueue.Notify(waiter.EventIn)
+	}
+}
+
+// releaseSendBuffer releases the given size of the send buffer, once its data
+// is acknowledged, and notifies the writers.
+func (e *endpoint) releaseSendBuffer(size int) {
+	if size == 0 {
+		return
+	}
+
+	e.sndMu.Lock()
+	e.sndBufUsed -= size
+	e.sndMu.Unlock()
+
+	e.waiterQueue.Notify(waiter.EventOut)
+}
@@ -0,0 +1,531 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sctp
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/waiter"
+)
+
+// closeTimeout is how long a closed endpoint waits for the graceful shutdown of
+// its association before aborting it.
+const closeTimeout = 2 * time.Minute
+
+// shutdownState is the state of the graceful shutdown of an association, per
+// RFC 4960, section 9.2.
+type shutdownState int
+
+const (
+	shutdownNone shutdownState = iota
+
+	// shutdownPending is the state of an association whose write end was
+	// shut down, until the peer acknowledges all of its data.
+	shutdownPending
+
+	// shutdownSent is the state of an association that sent a SHUTDOWN
+	// chunk, until the peer answers with a SHUTDOWN ACK chunk.
+	shutdownSent
+
+	// shutdownReceived is the state of an association that received a
+	// SHUTDOWN chunk, until the peer acknowledges all of its data.
+	shutdownReceived
+
+	// shutdownAckSent is the state of an association that sent a SHUTDOWN
+	// ACK chunk, until the peer answers with a SHUTDOWN COMPLETE chunk.
+	shutdownAckSent
+)
+
+// completeWorker is called by the worker goroutine when it's about to exit. It
+// marks the worker as completed and performs cleanup work if requested by
+// Close().
+func (e *endpoint) completeWorker() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.workerRunning = false
+	if e.workerCleanup {
+		e.cleanup()
+	}
+}
+
+// protocolMainLoop is the main loop of the protocol goroutine of an endpoint's
+// association. Active endpoints set their association up first, while the ones
+// of passive endpoints were set up by their listener.
+func (e *endpoint) protocolMainLoop(passive bool) {
+	defer func() {
+		e.waiterQueue.Notify(waiter.EventIn | waiter.EventOut | waiter.EventErr | waiter.EventHUp)
+		e.completeWorker()
+	}()
+
+	if !passive {
+		a, err := e.handshake()
+		if err != nil {
+			e.lastErrorMu.Lock()
+			e.lastError = err
+			e.lastErrorMu.Unlock()
+
+			e.mu.Lock()
+			e.state = stateError
+			e.hardError = err
+			e.mu.Unlock()
+			return
+		}
+
+		// Tell waiters that the endpoint is connected and writable.
+		e.mu.Lock()
+		e.assoc = a
+		e.state = stateConnected
+		e.streams = StreamsOption{Outbound: uint16(len(a.outSSN)), Inbound: uint16(len(a.inSSN))}
+		e.mu.Unlock()
+
+		e.waiterQueue.Notify(waiter.EventOut)
+	}
+
+	a := e.assoc
+	err := a.run()
+	a.stop()
+
+	e.rcvMu.Lock()
+	e.rcvClosed = true
+	e.rcvMu.Unlock()
+
+	e.mu.Lock()
+	if err != nil {
+		e.state = stateError
+		e.hardError = err
+	} else {
+		e.state = stateClosed
+	}
+	e.mu.Unlock()
+}
+
+// handshake sets the association of an active endpoint up, per RFC 4960,
+// section 5.1: it sends an INIT chunk, echoes the state cookie of the INIT ACK
+// chunk the peer answers with, and waits for its COOKIE ACK chunk.
+func (e *endpoint) handshake() (*association, error) {
+	localTag, err := randomTag()
+	if err != nil {
+		return nil, err
+	}
+	localTSN, err := randomUint32()
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.RLock()
+	streams := e.streams
+	e.mu.RUnlock()
+
+	e.rcvMu.Lock()
+	window := e.rcvBufSize
+	e.rcvMu.Unlock()
+
+	// p is the packet of the INIT chunk, and then the one of the COOKIE
+	// ECHO chunk, which is retransmitted until the peer answers.
+	p := newPacketBuilder(header.SCTPMinimumSize + header.SCTPChunkSize(header.SCTPInitSize))
+	header.SCTPInit(p.chunk(header.SCTPChunkInit, 0, header.SCTPInitSize)).Encode(&header.SCTPInitFields{
+		InitiateTag:     localTag,
+		Window:          uint32(window),
+		OutboundStreams: streams.Outbound,
+		InboundStreams:  streams.Inbound,
+		InitialTSN:      localTSN,
+	})
+	p.send(&e.route, e.id, 0)
+
+	// a is set once the peer answered with its INIT ACK chunk.
+	var a *association
+	rto := initialRTO
+	retransmits := 0
+	timer := e.stack.Clock().NewTimer(rto)
+	defer timer.Stop()
+
+	for {
+		select {
+		case s := <-e.segmentChan:
+			h := s.header()
+			tag := h.VerificationTag()
+			s.route.Release()
+
+			c, _, ok := header.NextSCTPChunk(h.Chunks())
+			if !ok {
+				continue
+			}
+
+			switch c.Type() {
+			case header.SCTPChunkAbort:
+				if c.Flags()&header.SCTPFlagNoTCB == 0 && tag == localTag || c.Flags()&header.SCTPFlagNoTCB != 0 && a != nil && tag == a.peerTag {
+					if a != nil {
+						a.stop()
+					}
+					return nil, tcpip.ErrConnectionRefused
+				}
+
+			case header.SCTPChunkInitAck:
+				if a != nil || tag != localTag || len(c.Value()) < header.SCTPInitSize {
+					continue
+				}
+				init := header.SCTPInit(c.Value())
+				f := init.Fields()
+				cookie, ok := init.Param(header.SCTPParamStateCookie)
+				if !ok || f.InitiateTag == 0 || f.OutboundStreams == 0 || f.InboundStreams == 0 {
+					continue
+				}
+
+				a = newAssociation(e, localTag, f.InitiateTag, localTSN, f.InitialTSN, f.Window, min16(streams.Outbound, f.InboundStreams), min16(streams.Inbound, f.OutboundStreams))
+				p = newPacketBuilder(header.SCTPMinimumSize + header.SCTPChunkSize(len(cookie)))
+				copy(p.chunk(header.SCTPChunkCookieEcho, 0, len(cookie)), cookie)
+				a.send(p)
+
+				// The COOKIE ECHO chunk has its own retransmissions.
+				rto = initialRTO
+				retransmits = 0
+				timer.Stop()
+				select {
+				case <-timer.C():
+				default:
+				}
+				timer.Reset(rto)
+
+			case header.SCTPChunkCookieAck:
+				if a != nil && tag == localTag {
+					return a, nil
+				}
+			}
+
+		case <-timer.C():
+			retransmits++
+			if retransmits > maxInitRetransmits {
+				if a != nil {
+					a.stop()
+				}
+				return nil, tcpip.ErrTimeout
+			}
+
+			rto = minDuration(2*rto, maxRTO)
+			if a == nil {
+				p.send(&e.route, e.id, 0)
+			} else {
+				a.send(p)
+			}
+			timer.Reset(rto)
+
+		case <-e.notifyChan:
+			n := e.fetchNotifications()
+			if n&notifyAbort != 0 {
+				if a != nil {
+					a.stop()
+				}
+				return nil, tcpip.ErrConnectionAborted
+			}
+			if n&notifyClose != 0 {
+				if a != nil {
+					a.sendControl(header.SCTPChunkAbort)
+					a.stop()
+				}
+				return nil, tcpip.ErrAborted
+			}
+		}
+	}
+}
+
+func min16(a, b uint16) uint16 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// run handles the established association until it's shut down or aborted. It
+// returns the error that aborted it, if any.
+func (a *association) run() error {
+	e := a.e
+
+	// Messages may have been queued, and the write end shut down, before
+	// the goroutine started.
+	a.handleWrite()
+	a.sendData()
+	e.sndMu.Lock()
+	if e.sndClosed {
+		a.shutdown = shutdownPending
+	}
+	e.sndMu.Unlock()
+
+	var closeTimer tcpip.Timer
+	var closeTimerChan <-chan time.Time
+	defer func() {
+		if closeTimer != nil {
+			closeTimer.Stop()
+		}
+	}()
+
+	for {
+		a.advanceShutdown()
+
+		select {
+		case p := <-e.segmentChan:
+			done, err := a.handlePacket(p)
+			p.route.Release()
+			if done {
+				return err
+			}
+
+		case <-e.sndChan:
+			a.handleWrite()
+			a.sendData()
+
+		case <-e.notifyChan:
+			n := e.fetchNotifications()
+			if n&notifyAbort != 0 {
+				// The route to the peer is gone, so the ABORT
+				// chunk couldn't be sent either.
+				return tcpip.ErrConnectionAborted
+			}
+
+			if n&notifyWindowUpdate != 0 {
+				a.sendSack()
+			}
+
+			if n&notifyShutdownWrite != 0 && a.shutdown == shutdownNone {
+				// The messages queued before the write end was
+				// shut down are still sent.
+				a.handleWrite()
+				a.sendData()
+				a.shutdown = shutdownPending
+			}
+
+			if n&notifyClose != 0 && closeTimer == nil {
+				// Abort the association if it doesn't shut
+				// down in time once the endpoint is closed.
+				closeTimer = e.stack.Clock().NewTimer(closeTimeout)
+				closeTimerChan = closeTimer.C()
+			}
+
+		case <-a.t3.C():
+			if !a.t3Expired() {
+				a.sendControl(header.SCTPChunkAbort)
+				return tcpip.ErrTimeout
+			}
+
+		case <-a.t2.C():
+			if !a.t2Expired() {
+				a.sendControl(header.SCTPChunkAbort)
+				return tcpip.ErrTimeout
+			}
+
+		case <-closeTimerChan:
+			a.sendControl(header.SCTPChunkAbort)
+			return tcpip.ErrConnectionAborted
+		}
+	}
+}
+
+// handlePacket handles a packet of the peer. It returns true once the
+// association is gone, with the error that aborted it, if any.
+func (a *association) handlePacket(p *packet) (bool, error) {
+	h := p.header()
+	tag := h.VerificationTag()
+	hasData := false
+
+	for chunks := h.Chunks(); len(chunks) > 0; {
+		c, rest, ok := header.NextSCTPChunk(chunks)
+		if !ok {
+			atomic.AddUint64(&p.route.Stats().SCTP.MalformedPacketsReceived, 1)
+			break
+		}
+		chunks = rest
+
+		// The packets of ABORT and SHUTDOWN COMPLETE chunks may carry the
+		// verification tag of the peer, per RFC 4960, section 8.5.1.
+		switch c.Type() {
+		case header.SCTPChunkAbort:
+			if !a.validTag(tag, c.Flags()) {
+				return false, nil
+			}
+			return true, tcpip.ErrConnectionReset
+
+		case header.SCTPChunkShutdownComplete:
+			if !a.validTag(tag, c.Flags()) {
+				return false, nil
+			}
+			if a.shutdown == shutdownAckSent {
+				return true, nil
+			}
+			continue
+
+		case header.SCTPChunkInit:
+			// Restarts and INIT collisions aren't supported.
+			return false, nil
+		}
+
+		if tag != a.localTag {
+			return false, nil
+		}
+
+		switch c.Type() {
+		case header.SCTPChunkData:
+			if !a.handleData(c) {
+				atomic.AddUint64(&p.route.Stats().SCTP.MalformedPacketsReceived, 1)
+			}
+			hasData = true
+
+		case header.SCTPChunkSack:
+			if len(c.Value()) >= header.SCTPSackSize {
+				a.handleSack(header.SCTPSack(c.Value()))
+			}
+
+		case header.SCTPChunkHeartbeat:
+			// The HEARTBEAT ACK chunk echoes the heartbeat
+			// information.
+			r := newPacketBuilder(header.SCTPMinimumSize + header.SCTPChunkSize(len(c.Value())))
+			copy(r.chunk(header.SCTPChunkHeartbeatAck, 0, len(c.Value())), c.Value())
+			a.send(r)
+
+		case header.SCTPChunkShutdown:
+			if len(c.Value()) < 4 {
+				atomic.AddUint64(&p.route.Stats().SCTP.MalformedPacketsReceived, 1)
+				continue
+			}
+			a.handleShutdown(binary.BigEndian.Uint32(c.Value()))
+
+		case header.SCTPChunkShutdownAck:
+			if a.shutdown == shutdownSent || a.shutdown == shutdownAckSent {
+				a.sendControl(header.SCTPChunkShutdownComplete)
+				return true, nil
+			}
+
+		case header.SCTPChunkCookieEcho:
+			// The peer didn't get the COOKIE ACK chunk.
+			a.sendControl(header.SCTPChunkCookieAck)
+
+		case header.SCTPChunkInitAck, header.SCTPChunkCookieAck, header.SCTPChunkHeartbeatAck, header.SCTPChunkError:
+			// Nothing to do.
+
+		default:
+			// The highest bit of the type of unknown chunks tells
+			// whether to skip them, or to stop processing the
+			// packet, per RFC 4960, section 3.2.
+			if c.Type()&0x80 == 0 {
+				chunks = nil
+			}
+		}
+	}
+
+	if hasData {
+		a.deliver()
+		a.sendSack()
+	}
+
+	// The SACKs may have opened the windows.
+	a.sendData()
+	return false, nil
+}
+
+// validTag returns whether tag is the verification tag of a packet holding an
+// ABORT or SHUTDOWN COMPLETE chunk with the given flags: the one of the peer if
+// the chunk has the T flag, and ours otherwise.
+func (a *association) validTag(tag uint32, flags uint8) bool {
+	if flags&header.SCTPFlagNoTCB != 0 {
+		return tag == a.peerTag
+	}
+	return tag == a.localTag
+}
+
+// handleShutdown handles the SHUTDOWN chunk of the peer, which acknowledges the
+// chunks up to cum: the peer won't send any more messages, nor accept new ones.
+func (a *association) handleShutdown(cum uint32) {
+	var b [header.SCTPSackSize]byte
+	s := header.SCTPSack(b[:])
+	s.Encode(cum, uint32(a.peerWindow+a.flightSize), 0)
+	a.handleSack(s)
+
+	e := a.e
+	e.rcvMu.Lock()
+	e.rcvClosed = true
+	e.rcvMu.Unlock()
+
+	e.sndMu.Lock()
+	e.sndClosed = true
+	e.sndMu.Unlock()
+
+	e.waiterQueue.Notify(waiter.EventIn | waiter.EventOut)
+
+	switch a.shutdown {
+	case shutdownNone, shutdownPending:
+		// The messages queued until now are still sent.
+		a.handleWrite()
+		a.shutdown = shutdownReceived
+
+	case shutdownSent:
+		a.sendControl(header.SCTPChunkShutdownAck)
+		a.shutdown = shutdownAckSent
+		a.startT2()
+	}
+}
+
+// advanceShutdown sends the SHUTDOWN or SHUTDOWN ACK chunk of the graceful
+// shutdown of the association, once the peer acknowledged all of its data.
+func (a *association) advanceShutdown() {
+	if len(a.pending) != 0 || len(a.outstanding) != 0 {
+		return
+	}
+
+	switch a.shutdown {
+	case shutdownPending:
+		a.sendShutdown()
+		a.shutdown = shutdownSent
+		a.startT2()
+
+	case shutdownReceived:
+		a.sendControl(header.SCTPChunkShutdownAck)
+		a.shutdown = shutdownAckSent
+		a.startT2()
+	}
+}
+
+// sendShutdown sends a SHUTDOWN chunk, which acknowledges the chunks received.
+func (a *association) sendShutdown() {
+	p := newPacketBuilder(header.SCTPMinimumSize + header.SCTPChunkSize(4))
+	binary.BigEndian.PutUint32(p.chunk(header.SCTPChunkShutdown, 0, 4), uint32(a.cumTSN))
+	a.send(p)
+}
+
+// startT2 starts the timer of the retransmissions of the SHUTDOWN and SHUTDOWN
+// ACK chunks.
+func (a *association) startT2() {
+	if a.t2Enabled {
+		a.t2.Stop()
+		select {
+		case <-a.t2.C():
+		default:
+		}
+	}
+	a.t2Enabled = true
+	a.t2.Reset(a.rto)
+}
+
+// t2Expired retransmits the SHUTDOWN or SHUTDOWN ACK chunk the peer didn't
+// answer. It returns false if the peer must be considered unreachable instead.
+func (a *association) t2Expired() bool {
+	a.t2Enabled = false
+	a.errorCount++
+	if a.errorCount > maxAssociationRetransmits {
+		return false
+	}
+
+	a.rto = minDuration(2*a.rto, maxRTO)
+	switch a.shutdown {
+	case shutdownSent:
+		a.sendShutdown()
+	case shutdownAckSent:
+		a.sendControl(header.SCTPChunkShutdownAck)
+	}
+	a.startT2()
+	return true
+}
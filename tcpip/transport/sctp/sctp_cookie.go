@@ -0,0 +1,95 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sctp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"time"
+
+	"github.com/google/netstack/tcpip/stack"
+)
+
+const (
+	// cookieStateSize is the size of the state held in a cookie, and
+	// cookieSize the size of the whole cookie, MAC included.
+	cookieStateSize = 32
+	cookieSize      = cookieStateSize + sha1.Size
+)
+
+// cookie is the state of an association a listening endpoint sends to the
+// peer in its INIT ACK chunk, instead of keeping it. The peer echoes it back in
+// a COOKIE ECHO chunk, which sets the association up. The cookie is
+// authenticated by a MAC, which also covers the addresses and ports of the
+// association.
+type cookie struct {
+	created    time.Time
+	localTag   uint32
+	peerTag    uint32
+	localTSN   uint32
+	peerTSN    uint32
+	peerWindow uint32
+	outStreams uint16
+	inStreams  uint16
+}
+
+// encode returns the cookie, authenticated for id with the secret of p.
+func (c *cookie) encode(p *protocol, id stack.TransportEndpointID) []byte {
+	b := make([]byte, cookieStateSize, cookieSize)
+	binary.BigEndian.PutUint64(b[0:], uint64(c.created.UnixNano()))
+	binary.BigEndian.PutUint32(b[8:], c.localTag)
+	binary.BigEndian.PutUint32(b[12:], c.peerTag)
+	binary.BigEndian.PutUint32(b[16:], c.localTSN)
+	binary.BigEndian.PutUint32(b[20:], c.peerTSN)
+	binary.BigEndian.PutUint32(b[24:], c.peerWindow)
+	binary.BigEndian.PutUint16(b[28:], c.outStreams)
+	binary.BigEndian.PutUint16(b[30:], c.inStreams)
+	return cookieMAC(p, id, b)
+}
+
+// decodeCookie returns the cookie encoded in b, or false if it isn't a cookie
+// that p issued for id, or if it expired at the given time.
+func decodeCookie(p *protocol, id stack.TransportEndpointID, b []byte, now time.Time) (cookie, bool) {
+	if len(b) != cookieSize {
+		return cookie{}, false
+	}
+	// Limit the capacity of the state, for cookieMAC not to overwrite the
+	// MAC of b.
+	state := b[:cookieStateSize:cookieStateSize]
+	if !hmac.Equal(cookieMAC(p, id, state)[cookieStateSize:], b[cookieStateSize:]) {
+		return cookie{}, false
+	}
+
+	c := cookie{
+		created:    time.Unix(0, int64(binary.BigEndian.Uint64(state[0:]))),
+		localTag:   binary.BigEndian.Uint32(state[8:]),
+		peerTag:    binary.BigEndian.Uint32(state[12:]),
+		localTSN:   binary.BigEndian.Uint32(state[16:]),
+		peerTSN:    binary.BigEndian.Uint32(state[20:]),
+		peerWindow: binary.BigEndian.Uint32(state[24:]),
+		outStreams: binary.BigEndian.Uint16(state[28:]),
+		inStreams:  binary.BigEndian.Uint16(state[30:]),
+	}
+	if now.Sub(c.created) > cookieLifetime {
+		return cookie{}, false
+	}
+	return c, true
+}
+
+// cookieMAC appends the MAC of the cookie state for id to state, and returns
+// the result.
+func cookieMAC(p *protocol, id stack.TransportEndpointID, state []byte) []byte {
+	var ports [4]byte
+	binary.BigEndian.PutUint16(ports[0:], id.LocalPort)
+	binary.BigEndian.PutUint16(ports[2:], id.RemotePort)
+
+	h := hmac.New(sha1.New, p.secret[:])
+	h.Write(state)
+	h.Write(ports[:])
+	h.Write([]byte(id.LocalAddress))
+	h.Write([]byte(id.RemoteAddress))
+	return h.Sum(state)
+}
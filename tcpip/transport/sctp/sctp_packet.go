@@ -0,0 +1,88 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sctp
+
+import (
+	"sync/atomic"
+
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// packet is an sctp packet received by an endpoint, and queued to its protocol
+// goroutine.
+type packet struct {
+	// route is the route of the packet, which the receiver releases.
+	route stack.Route
+	id    stack.TransportEndpointID
+
+	// data is the whole packet, common header included.
+	data buffer.View
+}
+
+// header returns the common header of the packet.
+func (p *packet) header() header.SCTP {
+	return header.SCTP(p.data)
+}
+
+// packetBuilder builds an outgoing sctp packet, one chunk after the other.
+type packetBuilder struct {
+	b buffer.View
+}
+
+// newPacketBuilder returns a builder of packets of the given size at most,
+// which only holds room for the common header.
+func newPacketBuilder(size int) *packetBuilder {
+	return &packetBuilder{b: make(buffer.View, header.SCTPMinimumSize, size)}
+}
+
+// len returns the size of the packet built so far.
+func (p *packetBuilder) len() int {
+	return len(p.b)
+}
+
+// empty returns whether the packet holds no chunk.
+func (p *packetBuilder) empty() bool {
+	return len(p.b) == header.SCTPMinimumSize
+}
+
+// chunk appends a chunk with a value of the given size to the packet, and
+// returns its value for the caller to fill in.
+func (p *packetBuilder) chunk(t header.SCTPChunkType, flags uint8, valueSize int) []byte {
+	n := len(p.b)
+	size := header.SCTPChunkSize(valueSize)
+	if cap(p.b)-n < size {
+		b := make(buffer.View, n, n+size)
+		copy(b, p.b)
+		p.b = b
+	}
+	p.b = p.b[:n+size]
+	return header.EncodeSCTPChunk(p.b[n:], t, flags, valueSize)[:valueSize]
+}
+
+// send sends the packet through r, from id.LocalPort to id.RemotePort, with the
+// given verification tag.
+func (p *packetBuilder) send(r *stack.Route, id stack.TransportEndpointID, tag uint32) error {
+	h := header.SCTP(p.b)
+	h.EncodeHeader(id.LocalPort, id.RemotePort, tag)
+	h.SetChecksum(h.CalculateChecksum())
+
+	hdr := buffer.NewPrependable(int(r.MaxHeaderLength()))
+	if err := r.WritePacket(&hdr, p.b.ToVectorisedView(), ProtocolNumber); err != nil {
+		return err
+	}
+
+	atomic.AddUint64(&r.Stats().SCTP.PacketsSent, 1)
+	return nil
+}
+
+// sendControl sends a packet holding a single chunk of the given type with no
+// value, such as ABORT or COOKIE ACK chunks.
+func sendControl(r *stack.Route, id stack.TransportEndpointID, tag uint32, t header.SCTPChunkType, flags uint8) error {
+	p := newPacketBuilder(header.SCTPMinimumSize + header.SCTPChunkHeaderSize)
+	p.chunk(t, flags, 0)
+	return p.send(r, id, tag)
+}
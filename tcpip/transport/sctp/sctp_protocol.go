@@ -0,0 +1,203 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sctp contains the implementation of the SCTP transport protocol
+// (RFC 4960). To use it in the networking stack, this package must be added to
+// the project, and activated on the stack by passing sctp.ProtocolName (or
+// "sctp") as one of the transport protocols when calling stack.New(). Then
+// endpoints can be created by passing sctp.ProtocolNumber as the transport
+// protocol number when calling Stack.NewEndpoint().
+//
+// Endpoints are one-to-one style sockets: each one holds a single association,
+// which carries messages on several streams. Messages of a stream are delivered
+// in order, independently of the other streams. Associations are single-homed,
+// and don't support restarts or the collision of INIT chunks.
+package sctp
+
+import (
+	"crypto/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	// ProtocolName is the string representation of the sctp protocol name.
+	ProtocolName = "sctp"
+
+	// ProtocolNumber is the sctp protocol number.
+	ProtocolNumber = header.SCTPProtocolNumber
+)
+
+const (
+	// defaultStreams is the default number of outbound and inbound
+	// streams endpoints request.
+	defaultStreams = 10
+
+	// initialRTO, minRTO and maxRTO are the initial, minimum and maximum
+	// retransmission timeouts, per RFC 4960, section 15.
+	initialRTO = 3 * time.Second
+	minRTO     = 1 * time.Second
+	maxRTO     = 60 * time.Second
+
+	// maxInitRetransmits is the number of times INIT and COOKIE ECHO
+	// chunks are retransmitted before the association attempt fails.
+	maxInitRetransmits = 8
+
+	// maxAssociationRetransmits is the number of consecutive
+	// retransmission timeouts after which the peer is considered
+	// unreachable.
+	maxAssociationRetransmits = 10
+
+	// cookieLifetime is how long the state cookies sent by listening
+	// endpoints stay valid.
+	cookieLifetime = 60 * time.Second
+)
+
+// defaultEndpointDefaults are the settings new endpoints are created with,
+// unless they are overridden with stack.Stack.SetEndpointDefaults.
+var defaultEndpointDefaults = stack.EndpointDefaults{
+	SendBufferSize:    stack.BufferSizeRange{Min: 4096, Default: 208 << 10, Max: 4 << 20},
+	ReceiveBufferSize: stack.BufferSizeRange{Min: 4096, Default: 208 << 10, Max: 4 << 20},
+}
+
+// endpointDefaults returns the settings new endpoints of the given stack are
+// created with.
+func endpointDefaults(s *stack.Stack) stack.EndpointDefaults {
+	if d, ok := s.EndpointDefaults(ProtocolNumber); ok {
+		return d
+	}
+	return defaultEndpointDefaults
+}
+
+// StreamsOption is used by SetSockOpt/GetSockOpt to specify the number of
+// outbound and inbound streams the endpoint requests when its association is
+// set up. Once the association is established, GetSockOpt returns the numbers
+// of streams both ends agreed on.
+type StreamsOption struct {
+	Outbound uint16
+	Inbound  uint16
+}
+
+// Info holds the SCTP-specific information of a message. SendMsg accepts it as
+// control message, to choose the stream and the payload protocol identifier of
+// the message and whether it's unordered, and RecvMsg returns it for received
+// messages, with their stream sequence number and the TSN of their first
+// chunk.
+type Info struct {
+	Stream    uint16
+	SSN       uint16
+	PPID      uint32
+	Unordered bool
+	TSN       uint32
+}
+
+// Release implements tcpip.ControlMessages.Release.
+func (*Info) Release() {}
+
+// CloneCreds implements tcpip.ControlMessages.CloneCreds. Info holds no
+// credentials.
+func (*Info) CloneCreds() tcpip.ControlMessages {
+	return nil
+}
+
+type protocol struct {
+	// secret is the key of the MACs of the state cookies.
+	secret [32]byte
+}
+
+// Number returns the sctp protocol number.
+func (*protocol) Number() tcpip.TransportProtocolNumber {
+	return ProtocolNumber
+}
+
+// NewEndpoint creates a new sctp endpoint.
+func (p *protocol) NewEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) (tcpip.Endpoint, error) {
+	return newEndpoint(stack, p, netProto, waiterQueue), nil
+}
+
+// MinimumPacketSize returns the minimum valid sctp packet size.
+func (*protocol) MinimumPacketSize() int {
+	return header.SCTPMinimumSize
+}
+
+// ParsePorts returns the source and destination ports stored in the given sctp
+// packet.
+func (*protocol) ParsePorts(v buffer.View) (src, dst uint16, err error) {
+	h := header.SCTP(v)
+	return h.SourcePort(), h.DestinationPort(), nil
+}
+
+// HandleUnknownDestinationPacket handles packets targeted at this protocol but
+// that don't match any existing endpoint. They are "out of the blue" packets,
+// answered as described in RFC 4960, section 8.4.
+func (*protocol) HandleUnknownDestinationPacket(r *stack.Route, id stack.TransportEndpointID, v buffer.View) {
+	atomic.AddUint64(&r.Stats().SCTP.OutOfTheBluePackets, 1)
+	if !validPacket(r, v) {
+		return
+	}
+	replyOutOfTheBlue(r, id, header.SCTP(v))
+}
+
+// validPacket returns whether v, received through r, is an sctp packet with at
+// least one chunk and a valid checksum, and counts it in the stats if it isn't.
+func validPacket(r *stack.Route, v buffer.View) bool {
+	if len(v) < header.SCTPMinimumSize+header.SCTPChunkHeaderSize {
+		atomic.AddUint64(&r.Stats().SCTP.MalformedPacketsReceived, 1)
+		return false
+	}
+
+	// Verify the checksum unless the link endpoint already did.
+	h := header.SCTP(v)
+	if r.Capabilities()&stack.CapabilityRXChecksumOffload == 0 && h.Checksum() != h.CalculateChecksum() {
+		atomic.AddUint64(&r.Stats().SCTP.ChecksumErrors, 1)
+		return false
+	}
+	return true
+}
+
+// replyOutOfTheBlue answers the out of the blue packet h, received through r
+// for id: INIT chunks are aborted, SHUTDOWN ACK chunks are completed, and the
+// other chunks are aborted too, except ABORT and SHUTDOWN COMPLETE chunks.
+func replyOutOfTheBlue(r *stack.Route, id stack.TransportEndpointID, h header.SCTP) {
+	c, _, ok := header.NextSCTPChunk(h.Chunks())
+	if !ok {
+		atomic.AddUint64(&r.Stats().SCTP.MalformedPacketsReceived, 1)
+		return
+	}
+
+	switch c.Type() {
+	case header.SCTPChunkAbort, header.SCTPChunkShutdownComplete, header.SCTPChunkCookieAck:
+		return
+
+	case header.SCTPChunkInit:
+		// The peer has no verification tag for us yet, so the ABORT
+		// carries its initiate tag.
+		if len(c.Value()) < header.SCTPInitSize {
+			atomic.AddUint64(&r.Stats().SCTP.MalformedPacketsReceived, 1)
+			return
+		}
+		tag := header.SCTPInit(c.Value()).Fields().InitiateTag
+		sendControl(r, id, tag, header.SCTPChunkAbort, 0)
+
+	case header.SCTPChunkShutdownAck:
+		sendControl(r, id, h.VerificationTag(), header.SCTPChunkShutdownComplete, header.SCTPFlagNoTCB)
+
+	default:
+		sendControl(r, id, h.VerificationTag(), header.SCTPChunkAbort, header.SCTPFlagNoTCB)
+	}
+}
+
+func init() {
+	p := &protocol{}
+	if _, err := rand.Read(p.secret[:]); err != nil {
+		panic(err)
+	}
+	stack.RegisterTransportProtocol(ProtocolName, p)
+}
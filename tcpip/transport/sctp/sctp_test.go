@@ -0,0 +1,318 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sctp_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/link/loopback"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/sctp"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	stackAddr  = "\x7f\x00\x00\x01"
+	listenPort = 9000
+)
+
+// newLoopbackStack returns a stack with a loopback NIC, whose address is
+// stackAddr.
+func newLoopbackStack(t *testing.T) *stack.Stack {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{sctp.ProtocolName}).(*stack.Stack)
+
+	if err := s.CreateNIC(1, loopback.New()); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, stackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         1,
+	}})
+
+	return s
+}
+
+// waitFor waits until wq reports one of the events of mask and done returns
+// true, or fails the test after a while.
+func waitFor(t *testing.T, wq *waiter.Queue, mask waiter.EventMask, done func() bool) {
+	t.Helper()
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, mask)
+	defer wq.EventUnregister(&we)
+
+	timeout := time.After(5 * time.Second)
+	for !done() {
+		select {
+		case <-ch:
+		case <-timeout:
+			t.Fatalf("timed out waiting for events %#x", mask)
+		}
+	}
+}
+
+// listen returns an endpoint listening on listenPort, with the given streams.
+func listen(t *testing.T, s *stack.Stack, streams sctp.StreamsOption) (tcpip.Endpoint, *waiter.Queue) {
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(sctp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := ep.SetSockOpt(streams); err != nil {
+		t.Fatalf("SetSockOpt(%+v) failed: %v", streams, err)
+	}
+	if err := ep.Bind(tcpip.FullAddress{Port: listenPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := ep.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	return ep, &wq
+}
+
+// connect connects a new endpoint with the given streams to the listener, and
+// returns it, with the endpoint the listener accepted.
+func connect(t *testing.T, s *stack.Stack, l tcpip.Endpoint, lwq *waiter.Queue, streams sctp.StreamsOption) (c tcpip.Endpoint, cwq *waiter.Queue, a tcpip.Endpoint, awq *waiter.Queue) {
+	cwq = &waiter.Queue{}
+	c, err := s.NewEndpoint(sctp.ProtocolNumber, ipv4.ProtocolNumber, cwq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := c.SetSockOpt(streams); err != nil {
+		t.Fatalf("SetSockOpt(%+v) failed: %v", streams, err)
+	}
+
+	if err := c.Connect(tcpip.FullAddress{Addr: stackAddr, Port: listenPort}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("Connect returned %v, want %v", err, tcpip.ErrConnectStarted)
+	}
+	waitFor(t, cwq, waiter.EventOut, func() bool {
+		return c.Readiness(waiter.EventOut) != 0
+	})
+	if err := c.GetSockOpt(tcpip.ErrorOption{}); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	waitFor(t, lwq, waiter.EventIn, func() bool {
+		a, awq, err = l.Accept()
+		return err != tcpip.ErrWouldBlock
+	})
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	return c, cwq, a, awq
+}
+
+// recv waits for the next message of ep.
+func recv(t *testing.T, ep tcpip.Endpoint, wq *waiter.Queue) (buffer.View, *sctp.Info) {
+	t.Helper()
+
+	var v buffer.View
+	var cm tcpip.ControlMessages
+	var err error
+	waitFor(t, wq, waiter.EventIn, func() bool {
+		v, cm, err = ep.RecvMsg(nil)
+		return err != tcpip.ErrWouldBlock
+	})
+	if err != nil {
+		t.Fatalf("RecvMsg failed: %v", err)
+	}
+	return v, cm.(*sctp.Info)
+}
+
+func TestMessages(t *testing.T) {
+	s := newLoopbackStack(t)
+	streams := sctp.StreamsOption{Outbound: 3, Inbound: 3}
+	l, lwq := listen(t, s, streams)
+	defer l.Close()
+	c, _, a, awq := connect(t, s, l, lwq, streams)
+	defer c.Close()
+	defer a.Close()
+
+	// The large message is fragmented.
+	large := bytes.Repeat([]byte("0123456789abcdef"), 10000)
+	msgs := []struct {
+		data []byte
+		info sctp.Info
+	}{
+		{[]byte("first"), sctp.Info{Stream: 0, PPID: 1}},
+		{[]byte("second"), sctp.Info{Stream: 2, PPID: 2}},
+		{large, sctp.Info{Stream: 1, PPID: 3}},
+		{[]byte("third"), sctp.Info{Stream: 2, PPID: 4}},
+		{[]byte("unordered"), sctp.Info{Stream: 1, PPID: 5, Unordered: true}},
+	}
+	for _, m := range msgs {
+		info := m.info
+		if _, err := c.SendMsg(buffer.View(m.data), &info, nil); err != nil {
+			t.Fatalf("SendMsg(%+v) failed: %v", m.info, err)
+		}
+	}
+
+	// Messages of different streams may be delivered out of order, but
+	// the ordered messages of each stream are delivered in order.
+	want := make(map[uint32]sctp.Info)
+	ssns := make(map[uint16]uint16)
+	for _, m := range msgs {
+		info := m.info
+		if !info.Unordered {
+			info.SSN = ssns[info.Stream]
+			ssns[info.Stream]++
+		}
+		want[info.PPID] = info
+	}
+	next := make(map[uint16]uint16)
+	for range msgs {
+		v, info := recv(t, a, awq)
+		if m := msgs[info.PPID-1]; !bytes.Equal(v, m.data) {
+			t.Fatalf("got message of %d bytes with PPID %d, want %d", len(v), info.PPID, len(m.data))
+		}
+		info.TSN = 0
+		if *info != want[info.PPID] {
+			t.Fatalf("got info %+v, want %+v", *info, want[info.PPID])
+		}
+		if !info.Unordered {
+			if info.SSN != next[info.Stream] {
+				t.Fatalf("got message %d of stream %d, want %d", info.SSN, info.Stream, next[info.Stream])
+			}
+			next[info.Stream]++
+		}
+	}
+
+	// Messages on streams the peer doesn't accept are rejected.
+	if _, err := c.SendMsg(buffer.View("x"), &sctp.Info{Stream: 3}, nil); err != tcpip.ErrInvalidEndpointState {
+		t.Fatalf("SendMsg on stream 3 returned %v, want %v", err, tcpip.ErrInvalidEndpointState)
+	}
+}
+
+func TestStreamsNegotiation(t *testing.T) {
+	s := newLoopbackStack(t)
+	l, lwq := listen(t, s, sctp.StreamsOption{Outbound: 2, Inbound: 4})
+	defer l.Close()
+	c, _, a, _ := connect(t, s, l, lwq, sctp.StreamsOption{Outbound: 8, Inbound: 1})
+	defer c.Close()
+	defer a.Close()
+
+	for _, test := range []struct {
+		name string
+		ep   tcpip.Endpoint
+		want sctp.StreamsOption
+	}{
+		{"client", c, sctp.StreamsOption{Outbound: 4, Inbound: 1}},
+		{"server", a, sctp.StreamsOption{Outbound: 1, Inbound: 4}},
+	} {
+		var got sctp.StreamsOption
+		if err := test.ep.GetSockOpt(&got); err != nil {
+			t.Fatalf("GetSockOpt failed: %v", err)
+		}
+		if got != test.want {
+			t.Errorf("%s streams are %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s := newLoopbackStack(t)
+	streams := sctp.StreamsOption{Outbound: 1, Inbound: 1}
+	l, lwq := listen(t, s, streams)
+	defer l.Close()
+	c, cwq, a, awq := connect(t, s, l, lwq, streams)
+	defer a.Close()
+
+	if _, err := c.Write(buffer.View("last"), nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	c.Close()
+
+	// The message sent before the shutdown is delivered, and then the
+	// association shuts down.
+	if v, _ := recv(t, a, awq); string(v) != "last" {
+		t.Fatalf("got message %q, want %q", v, "last")
+	}
+	waitFor(t, awq, waiter.EventIn, func() bool {
+		_, err := a.Read(nil)
+		return err == tcpip.ErrClosedForReceive
+	})
+	if _, err := a.Write(buffer.View("late"), nil); err != tcpip.ErrClosedForSend {
+		t.Fatalf("Write after shutdown returned %v, want %v", err, tcpip.ErrClosedForSend)
+	}
+
+	// The client gets the SHUTDOWN ACK chunk, and releases the port.
+	waitFor(t, cwq, waiter.EventHUp, func() bool {
+		return c.Readiness(waiter.EventHUp) != 0
+	})
+}
+
+func TestNICRemoval(t *testing.T) {
+	s := newLoopbackStack(t)
+	streams := sctp.StreamsOption{Outbound: 1, Inbound: 1}
+	l, lwq := listen(t, s, streams)
+	defer l.Close()
+	c, cwq, a, awq := connect(t, s, l, lwq, streams)
+	defer c.Close()
+	defer a.Close()
+
+	if err := s.RemoveNIC(1); err != nil {
+		t.Fatalf("RemoveNIC failed: %v", err)
+	}
+
+	// Both ends of the association are aborted, without waiting for the peer.
+	for _, test := range []struct {
+		name string
+		ep   tcpip.Endpoint
+		wq   *waiter.Queue
+	}{
+		{"client", c, cwq},
+		{"server", a, awq},
+	} {
+		waitFor(t, test.wq, waiter.EventErr, func() bool {
+			return test.ep.Readiness(waiter.EventErr) != 0
+		})
+		if _, err := test.ep.Read(nil); err != tcpip.ErrConnectionAborted {
+			t.Errorf("%s: Read returned %v, want %v", test.name, err, tcpip.ErrConnectionAborted)
+		}
+		if _, err := test.ep.Write(buffer.View("late"), nil); err != tcpip.ErrConnectionAborted {
+			t.Errorf("%s: Write returned %v, want %v", test.name, err, tcpip.ErrConnectionAborted)
+		}
+	}
+
+	// The listener isn't bound to the NIC, so it keeps listening.
+	if _, _, err := l.Accept(); err != tcpip.ErrWouldBlock {
+		t.Errorf("Accept returned %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+}
+
+func TestConnectionRefused(t *testing.T) {
+	s := newLoopbackStack(t)
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(sctp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	if err := ep.Connect(tcpip.FullAddress{Addr: stackAddr, Port: listenPort}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("Connect returned %v, want %v", err, tcpip.ErrConnectStarted)
+	}
+	waitFor(t, &wq, waiter.EventErr, func() bool {
+		return ep.Readiness(waiter.EventErr) != 0
+	})
+	if err := ep.GetSockOpt(tcpip.ErrorOption{}); err != tcpip.ErrConnectionRefused {
+		t.Fatalf("Connect failed with %v, want %v", err, tcpip.ErrConnectionRefused)
+	}
+	if got := s.Stats().SCTP.OutOfTheBluePackets; got != 1 {
+		t.Errorf("got %d out of the blue packets, want 1", got)
+	}
+}
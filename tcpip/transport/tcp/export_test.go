@@ -0,0 +1,23 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcp
+
+import (
+	"sync/atomic"
+)
+
+// LiveSegments returns the number of segments that weren't released yet, and in
+// race builds, the stacks they were allocated from.
+func LiveSegments() (int64, []string) {
+	n := atomic.LoadInt64(&liveSegments.count)
+
+	liveSegments.mu.Lock()
+	defer liveSegments.mu.Unlock()
+	var stacks []string
+	for _, st := range liveSegments.stacks {
+		stacks = append(stacks, st)
+	}
+	return n, stacks
+}
@@ -11,8 +11,10 @@ import (
 	"hash"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/seqnum"
 	"github.com/google/netstack/tcpip/stack"
 	"github.com/google/netstack/waiter"
@@ -59,13 +61,26 @@ type listenContext struct {
 	rcvWnd seqnum.Size
 	nonce  [2][sha1.BlockSize]byte
 
+	// owner is the owner new endpoints are attributed to, if any,
+	// optionHandler is their option handler, and rcvWndClamp their
+	// receive window clamp.
+	owner         *stack.Owner
+	optionHandler OptionHandler
+	rcvWndClamp   int
+
+	// synRcvdTimeout and maxSynRcvd are the SYN-RCVD timeout and limit
+	// set in the endpoint defaults of the stack, or zero.
+	synRcvdTimeout time.Duration
+	maxSynRcvd     int64
+
 	hasherMu sync.Mutex
 	hasher   hash.Hash
 }
 
-// timeStamp returns an 8-bit timestamp with a granularity of 64 seconds.
-func timeStamp() uint32 {
-	return uint32(time.Now().Unix()>>6) & tsMask
+// timeStamp returns an 8-bit timestamp with a granularity of 64 seconds, based
+// on the stack's clock.
+func (l *listenContext) timeStamp() uint32 {
+	return uint32(l.stack.Clock().Now().Unix()>>6) & tsMask
 }
 
 // incSynRcvdCount tries to increment the global number of endpoints in SYN-RCVD
@@ -96,10 +111,13 @@ func decSynRcvdCount() {
 
 // newListenContext creates a new listen context.
 func newListenContext(stack *stack.Stack, rcvWnd seqnum.Size) *listenContext {
+	d := endpointDefaults(stack)
 	l := &listenContext{
-		stack:  stack,
-		rcvWnd: rcvWnd,
-		hasher: sha1.New(),
+		stack:          stack,
+		rcvWnd:         rcvWnd,
+		hasher:         sha1.New(),
+		synRcvdTimeout: d.SynRcvdTimeout,
+		maxSynRcvd:     int64(d.MaxSynRcvd),
 	}
 
 	rand.Read(l.nonce[0][:])
@@ -137,7 +155,7 @@ func (l *listenContext) cookieHash(id stack.TransportEndpointID, ts uint32, nonc
 // createCookie creates a SYN cookie for the given id and incoming sequence
 // number.
 func (l *listenContext) createCookie(id stack.TransportEndpointID, seq seqnum.Value) seqnum.Value {
-	ts := timeStamp()
+	ts := l.timeStamp()
 	v := l.cookieHash(id, 0, 0) + uint32(seq) + (ts << tsOffset)
 	v += l.cookieHash(id, ts, 1) & hashMask
 	return seqnum.Value(v)
@@ -146,7 +164,7 @@ func (l *listenContext) createCookie(id stack.TransportEndpointID, seq seqnum.Va
 // isCookieValid checks if the supplied cookie if valid for the given id and
 // sequence number.
 func (l *listenContext) isCookieValid(id stack.TransportEndpointID, cookie seqnum.Value, seq seqnum.Value) bool {
-	ts := timeStamp()
+	ts := l.timeStamp()
 	v := uint32(cookie) - l.cookieHash(id, 0, 0) - uint32(seq)
 	cookieTS := v >> tsOffset
 	if ((ts - cookieTS) & tsMask) > maxTSDiff {
@@ -161,6 +179,9 @@ func (l *listenContext) isCookieValid(id stack.TransportEndpointID, cookie seqnu
 func (l *listenContext) createConnectedEndpoint(s *segment, iss seqnum.Value, irs seqnum.Value) (*endpoint, error) {
 	// Create a new endpoint.
 	n := newEndpoint(l.stack, s.route.NetProto, nil)
+	n.owner = l.owner
+	n.optionHandler = l.optionHandler
+	n.rcvWndClamp = l.rcvWndClamp
 	n.id = s.id
 	n.boundNICID = s.route.NICID()
 	n.route = s.route.Clone()
@@ -173,11 +194,14 @@ func (l *listenContext) createConnectedEndpoint(s *segment, iss seqnum.Value, ir
 
 	n.isRegistered = true
 	n.state = stateConnected
+	n.handleOptions(s)
 
 	// Create sender and receiver.
-	n.snd = newSender(n, iss, s.window)
+	n.snd = newSender(n, iss, s.window, s.mss)
 	n.rcv = newReceiver(n, irs, l.rcvWnd)
 
+	atomic.AddUint64(&n.route.Stats().TCP.PassiveConnectionOpenings, 1)
+
 	return n, nil
 }
 
@@ -200,6 +224,7 @@ func (l *listenContext) createEndpointAndPerformHandshake(s *segment) (*endpoint
 	}
 
 	h.resetToSynRcvd(cookie, irs)
+	h.timeout = l.synRcvdTimeout
 	if err := h.execute(); err != nil {
 		ep.Close()
 		return nil, err
@@ -212,13 +237,14 @@ func (l *listenContext) createEndpointAndPerformHandshake(s *segment) (*endpoint
 // endpoint receives a SYN segment. It is responsible for completing the
 // handshake and queueing the new endpoint for acceptance.
 //
-// A limited number of these goroutines are allowed before TCP starts using
-// SYN cookies to accept connections.
+// A limited number of these goroutines are allowed, globally and per listening
+// endpoint, before TCP starts using SYN cookies to accept connections.
 func (e *endpoint) handleSynSegment(ctx *listenContext, s *segment) {
 	defer decSynRcvdCount()
 	defer s.decRef()
 
 	n, err := ctx.createEndpointAndPerformHandshake(s)
+	atomic.AddInt64(&e.listenStats.synRcvd, -1)
 	if err != nil {
 		return
 	}
@@ -229,24 +255,49 @@ func (e *endpoint) handleSynSegment(ctx *listenContext, s *segment) {
 	defer e.mu.RUnlock()
 
 	if e.state == stateListen {
-		e.acceptedChan <- n
-		e.waiterQueue.Notify(waiter.EventIn)
+		e.deliverAccepted(n)
 	} else {
 		n.Close()
 	}
 }
 
+// deliverAccepted queues a new connection to be returned by Accept, and
+// notifies potential waiters. If the accept queue is full, the connection is
+// reset instead.
+func (e *endpoint) deliverAccepted(n *endpoint) {
+	select {
+	case e.acceptedChan <- n:
+		e.waiterQueue.Notify(waiter.EventIn)
+	default:
+		atomic.AddUint64(&e.listenStats.acceptOverflows, 1)
+		atomic.AddUint64(&n.route.Stats().TCP.ListenOverflows, 1)
+		n.resetConnection(tcpip.ErrConnectionAborted)
+		n.Close()
+	}
+}
+
+// synRcvdAllowed returns whether e may hold one more connection in the SYN-RCVD
+// state, according to the limit of the listen context.
+func (l *listenContext) synRcvdAllowed(e *endpoint) bool {
+	return l.maxSynRcvd == 0 || atomic.LoadInt64(&e.listenStats.synRcvd) < l.maxSynRcvd
+}
+
 // handleListenSegment is called when a listening endpoint receives a segment
 // and needs to handle it.
 func (e *endpoint) handleListenSegment(ctx *listenContext, s *segment) {
 	switch s.flags {
 	case flagSyn:
-		if incSynRcvdCount() {
+		if ctx.synRcvdAllowed(e) && incSynRcvdCount() {
+			atomic.AddInt64(&e.listenStats.synRcvd, 1)
 			s.incRef()
-			go e.handleSynSegment(ctx, s)
+			e.stack.GoWithLabels(e.profileLabels, func() { e.handleSynSegment(ctx, s) })
 		} else {
+			if e.stack.LogEnabled(stack.LogDebug) {
+				e.stack.Log(stack.LogDebug, "tcp syn-rcvd limit reached, sending syn cookie", "local_addr", s.id.LocalAddress, "local_port", s.id.LocalPort, "remote_addr", s.id.RemoteAddress, "remote_port", s.id.RemotePort)
+			}
+			atomic.AddUint64(&e.listenStats.cookiesSent, 1)
 			cookie := ctx.createCookie(s.id, s.sequenceNumber)
-			sendTCP(&s.route, s.id, nil, flagSyn|flagAck, cookie, s.sequenceNumber+1, ctx.rcvWnd)
+			sendTCP(&s.route, s.id, nil, flagSyn|flagAck, cookie, s.sequenceNumber+1, ctx.rcvWnd, nil)
 		}
 
 	case flagAck:
@@ -255,8 +306,8 @@ func (e *endpoint) handleListenSegment(ctx *listenContext, s *segment) {
 			// potential waiters.
 			n, err := ctx.createConnectedEndpoint(s, s.ackNumber-1, s.sequenceNumber-1)
 			if err == nil {
-				e.acceptedChan <- n
-				e.waiterQueue.Notify(waiter.EventIn)
+				atomic.AddUint64(&e.listenStats.cookiesAccepted, 1)
+				e.deliverAccepted(n)
 			}
 		}
 	}
@@ -281,6 +332,9 @@ func (e *endpoint) protocolListenLoop(rcvWnd seqnum.Size) error {
 	}()
 
 	ctx := newListenContext(e.stack, rcvWnd)
+	ctx.owner = e.owner
+	ctx.optionHandler = e.optionHandler
+	ctx.rcvWndClamp = e.windowClamp()
 
 	for {
 		select {
@@ -290,7 +344,7 @@ func (e *endpoint) protocolListenLoop(rcvWnd seqnum.Size) error {
 
 		case <-e.notifyChan:
 			n := e.fetchNotifications()
-			if n&notifyClose != 0 {
+			if n&(notifyClose|notifyAbort) != 0 {
 				return nil
 			}
 		}
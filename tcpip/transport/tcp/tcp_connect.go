@@ -6,6 +6,7 @@ package tcp
 
 import (
 	"crypto/rand"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/netstack/tcpip"
@@ -43,10 +44,22 @@ type handshake struct {
 
 	// sndWnd is the send window, as defined in RFC 793.
 	sndWnd seqnum.Size
+
+	// sndMSS is the maximum segment size advertised by the peer in its
+	// SYN segment, or zero if it didn't advertise one.
+	sndMSS uint16
+
+	// retries is the number of times the SYN or SYN-ACK segment is
+	// retransmitted before the handshake fails with tcpip.ErrTimeout.
+	retries int
+
+	// timeout is how long the handshake may take before it fails with
+	// tcpip.ErrTimeout regardless, or zero for no limit.
+	timeout time.Duration
 }
 
 func newHandshake(ep *endpoint, rcvWnd seqnum.Size) (handshake, error) {
-	h := handshake{ep: ep, active: true, rcvWnd: rcvWnd}
+	h := handshake{ep: ep, active: true, rcvWnd: rcvWnd, retries: defaultSynRetries}
 	if err := h.resetState(); err != nil {
 		return handshake{}, err
 	}
@@ -119,9 +132,10 @@ func (h *handshake) synSentState(s *segment) error {
 		return nil
 	}
 
-	// Remember the sequence we'll ack from now on.
+	// Remember the sequence we'll ack from now on, and the peer's MSS.
 	h.ackNum = s.sequenceNumber + 1
 	h.flags |= flagAck
+	h.sndMSS = s.mss
 
 	// If this is a SYN ACK response, we only need to acknowledge the SYN
 	// and the handshake is completed.
@@ -131,9 +145,10 @@ func (h *handshake) synSentState(s *segment) error {
 		return nil
 	}
 
-	// A SYN segment was received, but no ACK in it. We acknowledge the SYN
-	// but resend our own SYN and wait for it to be acknowledged in the
-	// SYN-RCVD state.
+	// A SYN segment was received, but no ACK in it: the peer is opening
+	// the connection at the same time (RFC 793, figure 8). We acknowledge
+	// the SYN but resend our own SYN and wait for it to be acknowledged in
+	// the SYN-RCVD state.
 	h.state = handshakeSynRcvd
 	h.ep.sendRaw(nil, h.flags, h.iss, h.ackNum, h.rcvWnd)
 
@@ -179,6 +194,15 @@ func (h *handshake) synRcvdState(s *segment) error {
 		return nil
 	}
 
+	// A retransmission of the peer's SYN means that our SYN-ACK was lost,
+	// or, on a simultaneous open, that the peer hasn't received our SYN
+	// yet, so the SYN-ACK is resent right away rather than when the timer
+	// fires.
+	if s.flagIsSet(flagSyn) && !s.flagIsSet(flagAck) {
+		h.ep.sendRaw(nil, h.flags, h.iss, h.ackNum, h.rcvWnd)
+		return nil
+	}
+
 	// We have previously received (and acknowledged) the peer's SYN. If the
 	// peer acknowledges our SYN, the handshake is completed.
 	if s.flagIsSet(flagAck) {
@@ -191,9 +215,28 @@ func (h *handshake) synRcvdState(s *segment) error {
 
 // execute executes the TCP 3-way handshake.
 func (h *handshake) execute() error {
-	// Initialize the resend timer.
+	// Initialize the resend timer, which also fires when the handshake
+	// times out.
+	clock := h.ep.stack.Clock()
+	var deadline time.Time
+	if h.timeout > 0 {
+		deadline = clock.Now().Add(h.timeout)
+	}
+
+	// nextTimeout returns d, or the time left until the deadline if it
+	// is sooner.
+	nextTimeout := func(d time.Duration) time.Duration {
+		if !deadline.IsZero() {
+			if left := deadline.Sub(clock.Now()); left < d {
+				return left
+			}
+		}
+		return d
+	}
+
 	timeOut := time.Duration(time.Second)
-	rt := time.NewTimer(timeOut)
+	retransmits := 0
+	rt := clock.NewTimer(nextTimeout(timeOut))
 	defer rt.Stop()
 
 	// Send the initial SYN segment and loop until the handshake is
@@ -201,15 +244,20 @@ func (h *handshake) execute() error {
 	h.ep.sendRaw(nil, h.flags, h.iss, h.ackNum, h.rcvWnd)
 	for h.state != handshakeCompleted {
 		select {
-		case <-rt.C:
-			timeOut *= 2
-			if timeOut > 60*time.Second {
+		case <-rt.C():
+			if !deadline.IsZero() && !clock.Now().Before(deadline) {
+				return tcpip.ErrTimeout
+			}
+			if retransmits == h.retries {
 				return tcpip.ErrTimeout
 			}
-			rt.Reset(timeOut)
+			retransmits++
+			timeOut *= 2
+			rt.Reset(nextTimeout(timeOut))
 			h.ep.sendRaw(nil, h.flags, h.iss, h.ackNum, h.rcvWnd)
 
 		case s := <-h.ep.segmentChan:
+			h.ep.handleOptions(s)
 			h.sndWnd = s.window
 			var err error
 			switch h.state {
@@ -228,49 +276,96 @@ func (h *handshake) execute() error {
 			if n&notifyClose != 0 {
 				return tcpip.ErrAborted
 			}
+			if n&notifyLinkDown != 0 {
+				return tcpip.ErrLinkDown
+			}
+			if n&notifyAbort != 0 {
+				return tcpip.ErrConnectionAborted
+			}
 		}
 	}
 
 	return nil
 }
 
+// advertisedMSS returns the maximum segment size advertised to peers reached
+// through the given route, which is derived from the route MTU.
+func advertisedMSS(r *stack.Route) uint16 {
+	mss := r.MTU() - header.TCPMinimumSize
+	if mss > 0xffff {
+		mss = 0xffff
+	}
+	return uint16(mss)
+}
+
 // sendTCP sends a TCP segment via the provided network endpoint and under the
-// provided identity.
-func sendTCP(r *stack.Route, id stack.TransportEndpointID, data buffer.View, flags byte, seq, ack seqnum.Value, rcvWnd seqnum.Size) error {
+// provided identity. SYN segments carry the MSS option, otherwise peers would
+// assume the 536-byte default and never use larger MTUs. opts are additional
+// options, already padded to a multiple of 4 bytes.
+func sendTCP(r *stack.Route, id stack.TransportEndpointID, data buffer.View, flags byte, seq, ack seqnum.Value, rcvWnd seqnum.Size, opts []byte) error {
+	optLen := len(opts)
+	if flags&flagSyn != 0 {
+		optLen += header.TCPOptionMSSLength
+	}
+	hdrLen := header.TCPMinimumSize + optLen
+
 	// Allocate a buffer for the TCP header.
-	hdr := buffer.NewPrependable(header.TCPMinimumSize + int(r.MaxHeaderLength()))
+	hdr := buffer.NewPooledPrependable(hdrLen + int(r.MaxHeaderLength()))
 
 	if rcvWnd > 0xffff {
 		rcvWnd = 0xffff
 	}
 
 	// Initialize the header.
-	tcp := header.TCP(hdr.Prepend(header.TCPMinimumSize))
+	tcp := header.TCP(hdr.Prepend(hdrLen))
 	tcp.Encode(&header.TCPFields{
 		SrcPort:    id.LocalPort,
 		DstPort:    id.RemotePort,
 		SeqNum:     uint32(seq),
 		AckNum:     uint32(ack),
-		DataOffset: header.TCPMinimumSize,
+		DataOffset: uint8(hdrLen),
 		Flags:      flags,
 		WindowSize: uint16(rcvWnd),
 	})
 
-	length := uint16(hdr.UsedLength())
-	xsum := r.PseudoHeaderChecksum(ProtocolNumber)
-	if data != nil {
-		length += uint16(len(data))
-		xsum = header.Checksum(data, xsum)
+	if flags&flagSyn != 0 {
+		header.EncodeMSSOption(advertisedMSS(r), tcp.Options())
 	}
+	copy(tcp.Options()[optLen-len(opts):], opts)
+
+	// Only calculate the checksum if the link endpoint needs it.
+	if r.Capabilities()&stack.CapabilityTXChecksumOffload == 0 {
+		length := uint16(hdr.UsedLength())
+		xsum := r.PseudoHeaderChecksum(ProtocolNumber)
+		if data != nil {
+			length += uint16(len(data))
+			xsum = header.Checksum(data, xsum)
+		}
 
-	tcp.SetChecksum(^tcp.CalculateChecksum(xsum, length))
+		tcp.SetChecksum(^tcp.CalculateChecksum(xsum, length))
+	}
 
-	return r.WritePacket(&hdr, data, ProtocolNumber)
+	err := r.WritePacket(&hdr, data.ToVectorisedView(), ProtocolNumber)
+	hdr.Release()
+	if err != nil {
+		return err
+	}
+
+	atomic.AddUint64(&r.Stats().TCP.SegmentsSent, 1)
+	if flags&flagRst != 0 {
+		atomic.AddUint64(&r.Stats().TCP.ResetsSent, 1)
+		if s := r.Stack(); s.LogEnabled(stack.LogDebug) {
+			s.Log(stack.LogDebug, "tcp reset sent", "local_addr", id.LocalAddress, "local_port", id.LocalPort, "remote_addr", id.RemoteAddress, "remote_port", id.RemotePort)
+		}
+	}
+
+	return nil
 }
 
 // sendRaw sends a TCP segment to the endpoint's peer.
 func (e *endpoint) sendRaw(data buffer.View, flags byte, seq, ack seqnum.Value, rcvWnd seqnum.Size) error {
-	return sendTCP(&e.route, e.id, data, flags, seq, ack, rcvWnd)
+	e.owner.CountSent(header.TCPMinimumSize + len(data))
+	return sendTCP(&e.route, e.id, data, flags, seq, ack, rcvWnd, e.appendOptions(flags))
 }
 
 func (e *endpoint) handleWrite(ok bool) {
@@ -331,12 +426,64 @@ func (e *endpoint) completeWorker() {
 	}
 }
 
+// handleSegmentFast handles the segments of bulk transfers, i.e., in-sequence
+// segments which either only acknowledge new data or only carry in-window data,
+// and don't change the send window, without going through the full processing
+// of the receiver and the sender, like the header prediction of BSD TCP. It
+// returns false if s isn't such a segment, in which case it must be handled by
+// the slow path.
+func (e *endpoint) handleSegmentFast(s *segment) bool {
+	r, snd := e.rcv, e.snd
+	if s.flags&^flagPsh != flagAck || s.sequenceNumber != r.rcvNxt || s.window != snd.sndWnd ||
+		r.closed || r.pendingRcvdSegments.Len() != 0 || snd.fr.active {
+		return false
+	}
+
+	ack := s.ackNumber
+	if len(s.data) == 0 {
+		// A pure ack for new data, the common case of the sending
+		// side of a bulk transfer.
+		if !(ack - 1).InRange(snd.sndUna, snd.sndNxt) {
+			return false
+		}
+
+		atomic.AddUint64(&e.route.Stats().TCP.FastPathSegments, 1)
+		if snd.rttMeasureSeqNum.LessThan(ack) {
+			snd.updateRTO(e.stack.Clock().Now().Sub(snd.rttMeasureTime))
+			snd.rttMeasureSeqNum = snd.sndNxt
+		}
+		snd.dupAckCount = 0
+		snd.handleNewAck(ack)
+		snd.sendData()
+	} else {
+		// In-window data which doesn't acknowledge anything new, the
+		// common case of the receiving side of a bulk transfer.
+		segLen := seqnum.Size(len(s.data))
+		if ack != snd.sndUna || snd.rttMeasureSeqNum.LessThan(ack) || r.rcvNxt.Size(r.rcvAcc) < segLen {
+			return false
+		}
+
+		if !e.stack.ReserveMemoryFor(e.owner, len(s.data)) {
+			return false
+		}
+
+		atomic.AddUint64(&e.route.Stats().TCP.FastPathSegments, 1)
+		snd.dupAckCount = 0
+		e.readyToRead(s)
+		r.rcvNxt = r.rcvNxt.Add(segLen)
+		snd.sendAck(true)
+	}
+
+	return true
+}
+
 // protocolMainLoop is the main loop of the TCP protocol. It runs in its own
 // goroutine and is responsible for sending segments and handling received
 // segments.
 func (e *endpoint) protocolMainLoop(passive bool) error {
 	defer func() {
-		e.waiterQueue.Notify(waiter.EventIn | waiter.EventOut)
+		close(e.mainLoopDone)
+		e.waiterQueue.Notify(waiter.EventIn | waiter.EventOut | waiter.EventErr | waiter.EventHUp)
 		e.completeWorker()
 	}()
 
@@ -344,11 +491,17 @@ func (e *endpoint) protocolMainLoop(passive bool) error {
 		// This is an active connection, so we must initiate the 3-way
 		// handshake, and then inform potential waiters about its
 		// completion.
-		h, err := newHandshake(e, seqnum.Size(e.rcvBufSize))
+		h, err := newHandshake(e, seqnum.Size(e.receiveWindow()))
+		e.mu.RLock()
+		h.retries = e.synRetries
+		h.timeout = e.connectTimeout
+		e.mu.RUnlock()
 		if err == nil {
 			err = h.execute()
 		}
 		if err != nil {
+			atomic.AddUint64(&e.route.Stats().TCP.FailedConnectionAttempts, 1)
+
 			e.lastErrorMu.Lock()
 			e.lastError = err
 			e.lastErrorMu.Unlock()
@@ -362,7 +515,7 @@ func (e *endpoint) protocolMainLoop(passive bool) error {
 		}
 
 		// Transfer handshake state to TCP connection.
-		e.snd = newSender(e, h.iss, h.sndWnd)
+		e.snd = newSender(e, h.iss, h.sndWnd, h.sndMSS)
 		e.rcv = newReceiver(e, h.ackNum-1, h.rcvWnd)
 	}
 
@@ -375,7 +528,16 @@ func (e *endpoint) protocolMainLoop(passive bool) error {
 
 	// Main loop. Handle segments until both send and receive ends of the
 	// connection have completed.
-	var closeTimer <-chan time.Time
+	var closeTimer tcpip.Timer
+	var closeTimerChan <-chan time.Time
+	finWait2 := false
+	defer func() {
+		if closeTimer != nil {
+			closeTimer.Stop()
+		}
+		e.snd.resendTimer.Stop()
+		e.rcv.dropPending()
+	}()
 
 	for !e.rcv.closed || !e.snd.closed || e.snd.sndUna != e.snd.sndNxtList {
 		select {
@@ -398,8 +560,11 @@ func (e *endpoint) protocolMainLoop(passive bool) error {
 				// RFC 793, page 41 states that "once in the ESTABLISHED
 				// state all segments must carry current acknowledgment
 				// information."
-				e.rcv.handleRcvdSegment(s)
-				e.snd.handleRcvdSegment(s)
+				e.handleOptions(s)
+				if !e.handleSegmentFast(s) {
+					e.rcv.handleRcvdSegment(s)
+					e.snd.handleRcvdSegment(s)
+				}
 			}
 			s.decRef()
 
@@ -416,22 +581,73 @@ func (e *endpoint) protocolMainLoop(passive bool) error {
 				e.rcv.pendingBufSize = seqnum.Size(e.receiveBufferSize())
 			}
 
+			if n&notifyMTUChanged != 0 {
+				e.snd.updateMaxPayloadSize()
+			}
+
+			if n&notifyLinkDown != 0 {
+				// The peer can't be reached anymore, so there
+				// is no point in sending a RST.
+				e.mu.Lock()
+				e.state = stateError
+				e.hardError = tcpip.ErrLinkDown
+				e.mu.Unlock()
+				return nil
+			}
+
+			if n&notifyAbort != 0 {
+				// The route to the peer is gone, so the RST
+				// couldn't be sent either.
+				e.mu.Lock()
+				e.state = stateError
+				e.hardError = tcpip.ErrConnectionAborted
+				e.mu.Unlock()
+				return nil
+			}
+
 			if n&notifyClose != 0 && closeTimer == nil {
-				// Reset the connection 3 seconds after the
-				// endpoint has been closed.
-				closeTimer = time.After(3 * time.Second)
+				// Reset the connection if it doesn't close in
+				// time once the endpoint has been closed.
+				closeTimer = e.stack.Clock().NewTimer(e.closeTimeout)
+				closeTimerChan = closeTimer.C()
 			}
 
-		case <-closeTimer:
+		case reply := <-e.saveChan:
+			reply <- e.saveConnection()
+
+		case reply := <-e.detachChan:
+			// The connection is handed off to another stack, so
+			// it stops here, and the peer must not notice.
+			reply <- e.saveConnection()
+			e.mu.Lock()
+			e.state = stateClosed
+			e.mu.Unlock()
+			return nil
+
+		case <-closeTimerChan:
 			e.resetConnection(tcpip.ErrConnectionAborted)
 			return nil
 
-		case <-e.snd.resendTimer.C:
+		case <-e.snd.resendTimer.C():
 			if !e.snd.retransmitTimerExpired() {
 				e.resetConnection(tcpip.ErrTimeout)
 				return nil
 			}
 		}
+
+		// Wake waiters up once for all the events the work above
+		// caused.
+		e.notifyPendingEvents()
+
+		// Once the peer acknowledged our FIN, a closed endpoint only
+		// waits for the peer's, in the FIN_WAIT_2 state, which has its
+		// own timeout. The close timer is reused for it.
+		if closeTimer != nil && !finWait2 && e.snd.closed && e.snd.sndUna == e.snd.sndNxtList && !e.rcv.closed {
+			finWait2 = true
+			enabled := true
+			stopAndDrainTimer(closeTimer, &enabled)
+			closeTimer.Reset(e.finWait2Timeout)
+		}
 	}
 
 	// Mark endpoint as closed.
@@ -8,9 +8,11 @@ import (
 	"io"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/ports"
 	"github.com/google/netstack/tcpip/seqnum"
 	"github.com/google/netstack/tcpip/stack"
 	"github.com/google/netstack/waiter"
@@ -28,19 +30,60 @@ const (
 	stateError
 )
 
+// String implements fmt.Stringer.String.
+func (s endpointState) String() string {
+	switch s {
+	case stateInitial:
+		return "initial"
+	case stateBound:
+		return "bound"
+	case stateListen:
+		return "listen"
+	case stateConnecting:
+		return "connecting"
+	case stateConnected:
+		return "connected"
+	case stateClosed:
+		return "closed"
+	case stateError:
+		return "error"
+	}
+	return "unknown"
+}
+
 // Reasons for notifying the protocol goroutine.
 const (
 	notifyNonZeroReceiveWindow = 1 << iota
 	notifyReceiveWindowChanged
 	notifyClose
+	notifyLinkDown
+	notifyMTUChanged
+	notifyAbort
 )
 
+// maxCoalescedSize is the maximum size of the chunks of data in the receive
+// queue into which in-order segments are coalesced.
+const maxCoalescedSize = 64 << 10
+
+// listenStats are the counters of a listening endpoint, returned with
+// tcpip.ListenerStatsOption. They are only accessed atomically.
+type listenStats struct {
+	synRcvd         int64
+	acceptOverflows uint64
+	cookiesSent     uint64
+	cookiesAccepted uint64
+}
+
 // endpoint represents a TCP endpoint. This struct serves as the interface
 // between users of the endpoint and the protocol implementation; it is legal to
 // have concurrent goroutines make calls into the endpoint, they are properly
 // synchronized. The protocol implementation, however, runs in a single
 // goroutine.
 type endpoint struct {
+	// listenStats holds the counters of a listening endpoint. It is first
+	// so that it is 64-bit aligned, as its fields are accessed atomically.
+	listenStats listenStats
+
 	// The following fields are initialized at creation time and do not
 	// change throughout the lifetime of the endpoint.
 	stack       *stack.Stack
@@ -58,21 +101,36 @@ type endpoint struct {
 	//
 	// Once the peer has closed the its send side, rcvClosed is set to true
 	// to indicate to users that no more data is coming.
-	rcvListMu  sync.Mutex
-	rcvList    segmentList
-	rcvClosed  bool
-	rcvBufSize int
-	rcvBufUsed int
+	//
+	// rcvWndClamp, if non-zero, is the maximum receive window advertised
+	// to the peer, set with WindowClampOption.
+	//
+	// The data of segments is coalesced into the last segment of rcvList
+	// when it fits, in which case the data of the last segment is a chunk
+	// allocated by the endpoint, and rcvTailOwned is set.
+	rcvListMu    sync.Mutex
+	rcvList      segmentList
+	rcvTailOwned bool
+	rcvClosed    bool
+	rcvBufSize   int
+	rcvBufUsed   int
+	rcvWndClamp  int
 
 	// The following fields are protected by the mutex.
 	mu             sync.RWMutex
 	id             stack.TransportEndpointID
 	state          endpointState
 	isPortReserved bool
+	reservedAddr   tcpip.Address
 	isRegistered   bool
 	boundNICID     tcpip.NICID
 	route          stack.Route
 
+	// isReusePortRegistered is set if the endpoint is registered as part
+	// of a reuse port group, which listening endpoints with reusePort set
+	// are.
+	isReusePortRegistered bool
+
 	// hardError is meaningful only when state is stateError, it stores the
 	// error to be returned when read/write syscalls are called and the
 	// endpoint is in this state.
@@ -92,6 +150,33 @@ type endpoint struct {
 	noDelay   bool
 	reuseAddr bool
 
+	// reusePort allows the endpoint to share its address and port with
+	// other endpoints that set it, and, once listening, the incoming
+	// connections.
+	reusePort bool
+
+	// closeTimeout and finWait2Timeout are how long the connection may
+	// take to close once the endpoint is closed, and how long it may then
+	// stay in the FIN_WAIT_2 state. They are set at creation time.
+	closeTimeout    time.Duration
+	finWait2Timeout time.Duration
+
+	// synRetries and connectTimeout are the limits of connection
+	// attempts, set with SynRetriesOption and ConnectTimeoutOption. They
+	// are protected by the mutex.
+	synRetries     int
+	connectTimeout time.Duration
+
+	// owner is the owner the endpoint is attributed to, or nil. It can only
+	// be changed in the initial state, so it can be read without holding
+	// the mutex once the endpoint is bound or connected.
+	owner *stack.Owner
+
+	// optionHandler is the handler of the TCP options the stack doesn't
+	// implement, or nil. Like owner, it can only be changed in the
+	// initial state.
+	optionHandler OptionHandler
+
 	// segmentChan is used to hand received segments to the protocol
 	// goroutine. Segments are queued in the channel as long as it is not
 	// full, and dropped when it is.
@@ -118,6 +203,27 @@ type endpoint struct {
 	// goroutine what it was notified; this is only accessed atomically.
 	notifyFlags uint32
 
+	// pendingEvents holds the events waiters are notified of once the
+	// protocol goroutine is done handling the segment or notification at
+	// hand, so that they're woken up once for all of them. It's only
+	// accessed by the protocol goroutine.
+	pendingEvents waiter.EventMask
+
+	// saveChan is used to ask the protocol goroutine of a connected
+	// endpoint for a snapshot of the connection, which is sent on the
+	// given channel. mainLoopDone is closed when the protocol main loop
+	// exits, after which requests aren't served anymore. Requests sent
+	// on detachChan also make the protocol goroutine stop right after the
+	// snapshot, without notifying the peer.
+	saveChan     chan chan *savedConnection
+	detachChan   chan chan *savedConnection
+	mainLoopDone chan struct{}
+
+	// rcvDeadline and sndDeadline are the deadlines set with
+	// tcpip.ReceiveDeadlineOption and tcpip.SendDeadlineOption.
+	rcvDeadline stack.Deadline
+	sndDeadline stack.Deadline
+
 	// acceptedChan is used by a listening endpoint protocol goroutine to
 	// send newly accepted connections to the endpoint so that they can be
 	// read by Accept() calls.
@@ -130,35 +236,79 @@ type endpoint struct {
 }
 
 func newEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) *endpoint {
+	d := endpointDefaults(stack)
+	closeTimeout := d.CloseTimeout
+	if closeTimeout == 0 {
+		closeTimeout = defaultCloseTimeout
+	}
+	finWait2Timeout := d.FinWait2Timeout
+	if finWait2Timeout == 0 {
+		finWait2Timeout = closeTimeout
+	}
+
 	return &endpoint{
-		stack:       stack,
-		netProto:    netProto,
-		waiterQueue: waiterQueue,
-		segmentChan: make(chan *segment, 10),
-		rcvBufSize:  208 * 1024,
-		sndBufSize:  208 * 1024,
-		sndChan:     make(chan struct{}, 1),
-		notifyChan:  make(chan struct{}, 1),
-		noDelay:     true,
-		reuseAddr:   true,
+		stack:        stack,
+		netProto:     netProto,
+		waiterQueue:  waiterQueue,
+		segmentChan:  make(chan *segment, 10),
+		rcvBufSize:   d.ReceiveBufferSize.Default,
+		sndBufSize:   d.SendBufferSize.Default,
+		sndChan:      make(chan struct{}, 1),
+		notifyChan:   make(chan struct{}, 1),
+		saveChan:     make(chan chan *savedConnection),
+		detachChan:   make(chan chan *savedConnection),
+		mainLoopDone: make(chan struct{}),
+		noDelay:      d.NoDelay,
+		reuseAddr:    d.ReuseAddress,
+
+		closeTimeout:    closeTimeout,
+		finWait2Timeout: finWait2Timeout,
+		synRetries:      synRetries(d),
+		connectTimeout:  d.ConnectTimeout,
+	}
+}
+
+// synRetries returns the number of SYN retransmissions of connection attempts
+// set in the endpoint defaults d, or the protocol default.
+func synRetries(d stack.EndpointDefaults) int {
+	if d.SynRetries == 0 {
+		return defaultSynRetries
 	}
+	return d.SynRetries
 }
 
 // Readiness returns the current readiness of the endpoint. For example, if
 // waiter.EventIn is set, the endpoint is immediately readable.
+//
+// waiter.EventErr is set when the connection failed or was reset, or when an
+// error is pending (see tcpip.ErrorOption), and waiter.EventHUp is set once
+// the connection is closed in both directions, so that callers can tell them
+// apart from plain readability.
 func (e *endpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
 	result := waiter.EventMask(0)
 
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 
+	if (mask & waiter.EventErr) != 0 {
+		e.lastErrorMu.Lock()
+		if e.lastError != nil {
+			result |= waiter.EventErr
+		}
+		e.lastErrorMu.Unlock()
+	}
+
 	switch e.state {
 	case stateInitial, stateBound, stateConnecting:
 		// Ready for nothing.
 
 	case stateClosed, stateError:
-		// Ready for anything.
-		result = mask
+		// Ready for anything, but only failed connections report an
+		// error.
+		result |= mask &^ waiter.EventErr
+		if e.state == stateError {
+			result |= mask & waiter.EventErr
+		}
 
 	case stateListen:
 		// Check if there's anything in the accepted channel.
@@ -179,18 +329,32 @@ func (e *endpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
 		}
 
 		// Determine if the endpoint is readable if requested.
-		if (mask & waiter.EventIn) != 0 {
+		if (mask & (waiter.EventIn | waiter.EventHUp)) != 0 {
 			e.rcvListMu.Lock()
 			if e.rcvBufUsed > 0 || e.rcvClosed {
-				result |= waiter.EventIn
+				result |= mask & waiter.EventIn
 			}
+			rcvClosed := e.rcvClosed
 			e.rcvListMu.Unlock()
+
+			// The connection is hung up once the peer closed its
+			// send side and ours is shut down too.
+			if rcvClosed && (mask&waiter.EventHUp) != 0 && e.sendClosed() {
+				result |= waiter.EventHUp
+			}
 		}
 	}
 
 	return result
 }
 
+// sendClosed returns whether the send side of the endpoint is shut down.
+func (e *endpoint) sendClosed() bool {
+	e.sndBufMu.Lock()
+	defer e.sndBufMu.Unlock()
+	return e.sndBufSize < 0
+}
+
 func (e *endpoint) fetchNotifications() uint32 {
 	return atomic.SwapUint32(&e.notifyFlags, 0)
 }
@@ -257,14 +421,34 @@ func (e *endpoint) cleanup() {
 		}
 	}
 
+	// Release the memory still held in the receive and send queues.
+	e.rcvListMu.Lock()
+	for s := e.rcvList.Front(); s != nil; s = e.rcvList.Front() {
+		e.rcvList.Remove(s)
+		s.decRef()
+	}
+	e.stack.ReleaseMemoryFor(e.owner, e.rcvBufUsed)
+	e.rcvBufUsed = 0
+	e.rcvListMu.Unlock()
+
+	e.sndBufMu.Lock()
+	e.stack.ReleaseMemoryFor(e.owner, e.sndBufUsed)
+	e.sndBufUsed = 0
+	e.sndBufMu.Unlock()
+
 	if e.isPortReserved {
-		e.stack.ReleasePort(e.netProto, ProtocolNumber, e.id.LocalPort)
+		e.stack.ReleasePort(e.netProto, ProtocolNumber, e.reservedAddr, e.id.LocalPort)
 	}
 
-	if e.isRegistered {
+	if e.isReusePortRegistered {
+		e.stack.UnregisterReusePortEndpoint(e.boundNICID, ProtocolNumber, e.id, e)
+	} else if e.isRegistered {
 		e.stack.UnregisterTransportEndpoint(e.boundNICID, ProtocolNumber, e.id)
 	}
 
+	e.rcvDeadline.Stop()
+	e.sndDeadline.Stop()
+
 	e.route.Release()
 }
 
@@ -285,6 +469,10 @@ func (e *endpoint) Read(*tcpip.FullAddress) (buffer.View, error) {
 		}
 	}
 
+	if e.rcvDeadline.Expired() {
+		return buffer.View{}, tcpip.ErrTimeout
+	}
+
 	e.rcvListMu.Lock()
 	defer e.rcvListMu.Unlock()
 
@@ -301,6 +489,7 @@ func (e *endpoint) Read(*tcpip.FullAddress) (buffer.View, error) {
 	e.rcvList.Remove(s)
 	wasZero := e.rcvBufUsed >= e.rcvBufSize
 	e.rcvBufUsed -= len(s.data)
+	e.stack.ReleaseMemoryFor(e.owner, len(s.data))
 	if wasZero && e.rcvBufUsed < e.rcvBufSize {
 		e.notifyProtocolGoroutine(notifyNonZeroReceiveWindow)
 	}
@@ -334,6 +523,10 @@ func (e *endpoint) Write(v buffer.View, to *tcpip.FullAddress) (uintptr, error)
 		}
 	}
 
+	if e.sndDeadline.Expired() {
+		return 0, tcpip.ErrTimeout
+	}
+
 	s := newSegment(&e.route, e.id, v)
 
 	e.sndBufMu.Lock()
@@ -352,6 +545,13 @@ func (e *endpoint) Write(v buffer.View, to *tcpip.FullAddress) (uintptr, error)
 		return 0, tcpip.ErrWouldBlock
 	}
 
+	// Check if the stack's memory limit allows the data to be queued.
+	if !e.stack.ReserveMemoryFor(e.owner, len(v)) {
+		e.sndBufMu.Unlock()
+		s.decRef()
+		return 0, tcpip.ErrNoBufferSpace
+	}
+
 	// Add data to the send queue.
 	e.sndBufUsed += len(v)
 	e.sndBufInQueue += seqnum.Size(len(v))
@@ -435,12 +635,79 @@ func (e *endpoint) SetSockOpt(opt interface{}) error {
 		e.mu.Unlock()
 		return nil
 
+	case tcpip.ReusePortOption:
+		e.mu.Lock()
+		e.reusePort = v != 0
+		e.mu.Unlock()
+		return nil
+
+	case tcpip.OwnerOption:
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		if e.state != stateInitial {
+			return tcpip.ErrInvalidEndpointState
+		}
+
+		e.owner = nil
+		if v != "" {
+			e.owner = e.stack.Owner(string(v))
+		}
+		return nil
+
+	case OptionHandlerOption:
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		if e.state != stateInitial {
+			return tcpip.ErrInvalidEndpointState
+		}
+
+		e.optionHandler = v.Handler
+		return nil
+
+	case SynRetriesOption:
+		if v < 0 {
+			return tcpip.ErrInvalidOptionValue
+		}
+
+		n := int(v)
+		if n == 0 {
+			n = synRetries(endpointDefaults(e.stack))
+		}
+
+		e.mu.Lock()
+		e.synRetries = n
+		e.mu.Unlock()
+		return nil
+
+	case ConnectTimeoutOption:
+		if v < 0 {
+			return tcpip.ErrInvalidOptionValue
+		}
+
+		e.mu.Lock()
+		e.connectTimeout = time.Duration(v)
+		e.mu.Unlock()
+		return nil
+
+	case WindowClampOption:
+		if v < 0 {
+			return tcpip.ErrInvalidOptionValue
+		}
+
+		e.rcvListMu.Lock()
+		e.rcvWndClamp = int(v)
+		e.rcvListMu.Unlock()
+		return nil
+
 	case tcpip.ReceiveBufferSizeOption:
 		mask := uint32(notifyReceiveWindowChanged)
+		size := endpointDefaults(e.stack).ReceiveBufferSize.Clamp(int(v))
 
 		e.rcvListMu.Lock()
 		wasZero := e.rcvBufUsed >= e.rcvBufSize
-		e.rcvBufSize = int(v)
+		e.rcvBufSize = size
 		if wasZero && e.rcvBufUsed < e.rcvBufSize {
 			mask |= notifyNonZeroReceiveWindow
 		}
@@ -448,6 +715,36 @@ func (e *endpoint) SetSockOpt(opt interface{}) error {
 
 		e.notifyProtocolGoroutine(mask)
 		return nil
+
+	case tcpip.SendBufferSizeOption:
+		size := endpointDefaults(e.stack).SendBufferSize.Clamp(int(v))
+
+		// The size is left alone once the send side is closed, which is
+		// when it is set to -1.
+		e.sndBufMu.Lock()
+		wasFull := e.sndBufSize >= 0 && e.sndBufUsed > e.sndBufSize
+		if e.sndBufSize >= 0 {
+			e.sndBufSize = size
+		}
+		notify := wasFull && e.sndBufUsed <= e.sndBufSize
+		e.sndBufMu.Unlock()
+
+		if notify {
+			e.waiterQueue.Notify(waiter.EventOut)
+		}
+		return nil
+
+	case tcpip.ReceiveDeadlineOption:
+		e.rcvDeadline.Set(e.stack.Clock(), time.Time(v), func() {
+			e.waiterQueue.Notify(waiter.EventIn)
+		})
+		return nil
+
+	case tcpip.SendDeadlineOption:
+		e.sndDeadline.Set(e.stack.Clock(), time.Time(v), func() {
+			e.waiterQueue.Notify(waiter.EventOut)
+		})
+		return nil
 	}
 
 	return nil
@@ -500,6 +797,24 @@ func (e *endpoint) GetSockOpt(opt interface{}) error {
 		*o = tcpip.ReceiveQueueSizeOption(v)
 		return nil
 
+	case *tcpip.ListenerStatsOption:
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+
+		if e.state != stateListen {
+			return tcpip.ErrInvalidEndpointState
+		}
+
+		*o = tcpip.ListenerStatsOption{
+			SynBacklog:       int(atomic.LoadInt64(&e.listenStats.synRcvd)),
+			AcceptQueued:     len(e.acceptedChan),
+			AcceptQueueLimit: cap(e.acceptedChan),
+			AcceptOverflows:  atomic.LoadUint64(&e.listenStats.acceptOverflows),
+			CookiesSent:      atomic.LoadUint64(&e.listenStats.cookiesSent),
+			CookiesAccepted:  atomic.LoadUint64(&e.listenStats.cookiesAccepted),
+		}
+		return nil
+
 	case *tcpip.NoDelayOption:
 		e.mu.RLock()
 		v := e.noDelay
@@ -521,6 +836,53 @@ func (e *endpoint) GetSockOpt(opt interface{}) error {
 			*o = 1
 		}
 		return nil
+
+	case *tcpip.ReusePortOption:
+		e.mu.RLock()
+		v := e.reusePort
+		e.mu.RUnlock()
+
+		*o = 0
+		if v {
+			*o = 1
+		}
+		return nil
+
+	case *tcpip.OwnerOption:
+		e.mu.RLock()
+		*o = tcpip.OwnerOption(e.owner.Name())
+		e.mu.RUnlock()
+		return nil
+
+	case *OptionHandlerOption:
+		e.mu.RLock()
+		o.Handler = e.optionHandler
+		e.mu.RUnlock()
+		return nil
+
+	case *WindowClampOption:
+		*o = WindowClampOption(e.windowClamp())
+		return nil
+
+	case *SynRetriesOption:
+		e.mu.RLock()
+		*o = SynRetriesOption(e.synRetries)
+		e.mu.RUnlock()
+		return nil
+
+	case *ConnectTimeoutOption:
+		e.mu.RLock()
+		*o = ConnectTimeoutOption(e.connectTimeout)
+		e.mu.RUnlock()
+		return nil
+
+	case *tcpip.ReceiveDeadlineOption:
+		*o = tcpip.ReceiveDeadlineOption(e.rcvDeadline.Get())
+		return nil
+
+	case *tcpip.SendDeadlineOption:
+		*o = tcpip.SendDeadlineOption(e.sndDeadline.Get())
+		return nil
 	}
 
 	return tcpip.ErrInvalidEndpointState
@@ -582,11 +944,11 @@ func (e *endpoint) Connect(addr tcpip.FullAddress) error {
 		}
 	} else {
 		// The endpoint doesn't have a local port yet, so try to get
-		// one.
-		_, err := e.stack.PickEphemeralPort(func(p uint16) (bool, error) {
+		// one. The port is reserved for the local address so that
+		// it can't be bound to by other endpoints while in use.
+		_, err := e.stack.ReserveEphemeralPort(e.netProto, ProtocolNumber, e.id.LocalAddress, e.portFlags(), e.id.RemoteAddress, e.id.RemotePort, func(p uint16) (bool, error) {
 			e.id.LocalPort = p
-			err := e.stack.RegisterTransportEndpoint(nicid, ProtocolNumber, e.id, e)
-			switch err {
+			switch err := e.stack.RegisterTransportEndpoint(nicid, ProtocolNumber, e.id, e); err {
 			case nil:
 				return true, nil
 			case tcpip.ErrDuplicateAddress:
@@ -598,6 +960,9 @@ func (e *endpoint) Connect(addr tcpip.FullAddress) error {
 		if err != nil {
 			return err
 		}
+
+		e.isPortReserved = true
+		e.reservedAddr = e.id.LocalAddress
 	}
 
 	e.isRegistered = true
@@ -606,7 +971,9 @@ func (e *endpoint) Connect(addr tcpip.FullAddress) error {
 	e.boundNICID = nicid
 	e.workerRunning = true
 
-	go e.protocolMainLoop(false)
+	e.stack.GoWithLabels(e.profileLabels, func() { e.protocolMainLoop(false) })
+
+	atomic.AddUint64(&r.Stats().TCP.ActiveConnectionOpenings, 1)
 
 	return tcpip.ErrConnectStarted
 }
@@ -632,12 +999,29 @@ func (e *endpoint) Shutdown(flags tcpip.ShutdownFlags) error {
 			if e.sndBufSize >= 0 {
 				e.sndBufSize = -1
 				close(e.sndChan)
+
+				// The connection is hung up if the peer
+				// already closed its send side.
+				e.rcvListMu.Lock()
+				rcvClosed := e.rcvClosed
+				e.rcvListMu.Unlock()
+				if rcvClosed {
+					e.waiterQueue.Notify(waiter.EventHUp)
+				}
 			}
 		}
 
 	case stateListen:
 		// Tell protocolListenLoop to stop.
 		if flags&tcpip.ShutdownRead != 0 {
+			// A listener sharing its port leaves its group right
+			// away, for the others to get the new connections
+			// while its own handshakes complete.
+			if e.isReusePortRegistered {
+				e.stack.UnregisterReusePortEndpoint(e.boundNICID, ProtocolNumber, e.id, e)
+				e.isReusePortRegistered = false
+				e.isRegistered = false
+			}
 			e.notifyProtocolGoroutine(notifyClose)
 		}
 
@@ -659,8 +1043,14 @@ func (e *endpoint) Listen(backlog int) error {
 		return tcpip.ErrInvalidEndpointState
 	}
 
-	// Register the endpoint.
-	if err := e.stack.RegisterTransportEndpoint(e.boundNICID, ProtocolNumber, e.id, e); err != nil {
+	// Register the endpoint. Listening endpoints that reuse their port
+	// share the incoming connections.
+	if e.reusePort {
+		if err := e.stack.RegisterReusePortEndpoint(e.boundNICID, ProtocolNumber, e.id, e); err != nil {
+			return err
+		}
+		e.isReusePortRegistered = true
+	} else if err := e.stack.RegisterTransportEndpoint(e.boundNICID, ProtocolNumber, e.id, e); err != nil {
 		return err
 	}
 
@@ -669,17 +1059,24 @@ func (e *endpoint) Listen(backlog int) error {
 	e.acceptedChan = make(chan *endpoint, backlog)
 	e.workerRunning = true
 
-	go e.protocolListenLoop(seqnum.Size(e.rcvBufSize))
+	rcvWnd := seqnum.Size(e.receiveWindow())
+	e.stack.GoWithLabels(e.profileLabels, func() { e.protocolListenLoop(rcvWnd) })
 
 	return nil
 }
 
+// profileLabels returns the pprof labels of the goroutine serving e, for
+// Stack.GoWithLabels.
+func (e *endpoint) profileLabels() []string {
+	return []string{stack.ProfileLabelProtocol, ProtocolName, stack.ProfileLabelFlow, stack.FlowLabel(e.id)}
+}
+
 // startAcceptedLoop sets up required state and starts a goroutine with the
 // main loop for accepted connections.
 func (e *endpoint) startAcceptedLoop(waiterQueue *waiter.Queue) {
 	e.waiterQueue = waiterQueue
 	e.workerRunning = true
-	go e.protocolMainLoop(true)
+	e.stack.GoWithLabels(e.profileLabels, func() { e.protocolMainLoop(true) })
 }
 
 // Accept returns a new endpoint if a peer has established a connection
@@ -693,6 +1090,10 @@ func (e *endpoint) Accept() (tcpip.Endpoint, *waiter.Queue, error) {
 		return nil, nil, tcpip.ErrInvalidEndpointState
 	}
 
+	if e.rcvDeadline.Expired() {
+		return nil, nil, tcpip.ErrTimeout
+	}
+
 	// Get the new accepted endpoint.
 	var n *endpoint
 	select {
@@ -720,20 +1121,23 @@ func (e *endpoint) Bind(addr tcpip.FullAddress, commit func() error) (retErr err
 		return tcpip.ErrAlreadyBound
 	}
 
-	// Reserve the port.
-	port, err := e.stack.ReservePort(e.netProto, ProtocolNumber, addr.Port)
+	// Reserve the port for the requested address; conflicts with other
+	// endpoints are resolved by the port manager.
+	port, err := e.stack.ReservePort(e.netProto, ProtocolNumber, addr.Addr, addr.Port, e.portFlags())
 	if err != nil {
 		return err
 	}
 
 	e.isPortReserved = true
+	e.reservedAddr = addr.Addr
 	e.id.LocalPort = port
 
 	// Any failures beyond this point must remove the port registration.
 	defer func() {
 		if retErr != nil {
-			e.stack.ReleasePort(e.netProto, ProtocolNumber, port)
+			e.stack.ReleasePort(e.netProto, ProtocolNumber, addr.Addr, port)
 			e.isPortReserved = false
+			e.reservedAddr = ""
 			e.id.LocalPort = 0
 			e.id.LocalAddress = ""
 			e.boundNICID = 0
@@ -766,6 +1170,12 @@ func (e *endpoint) Bind(addr tcpip.FullAddress, commit func() error) (retErr err
 	return nil
 }
 
+// portFlags returns the flags the endpoint reserves its port with. It must be
+// called with e.mu held.
+func (e *endpoint) portFlags() ports.Flags {
+	return ports.Flags{ReuseAddr: e.reuseAddr, ReusePort: e.reusePort}
+}
+
 // GetLocalAddress returns the address to which the endpoint is bound.
 func (e *endpoint) GetLocalAddress() (tcpip.FullAddress, error) {
 	e.mu.RLock()
@@ -794,10 +1204,43 @@ func (e *endpoint) GetRemoteAddress() (tcpip.FullAddress, error) {
 	}, nil
 }
 
+// Owner implements stack.OwnedEndpoint.Owner. The owner can't change once the
+// endpoint leaves the initial state, so it's read without locking, as packets
+// may be traced while e.mu is held.
+func (e *endpoint) Owner() *stack.Owner {
+	return e.owner
+}
+
+// Inspect implements stack.InspectableEndpoint.Inspect.
+func (e *endpoint) Inspect() stack.TransportEndpointState {
+	e.mu.RLock()
+	state := e.state
+	owner := e.owner.Name()
+	e.mu.RUnlock()
+
+	s := stack.TransportEndpointState{State: state.String(), Owner: owner}
+	if state == stateListen {
+		s.RcvQueued = len(e.acceptedChan)
+		return s
+	}
+
+	e.rcvListMu.Lock()
+	s.RcvQueued = e.rcvBufUsed
+	e.rcvListMu.Unlock()
+
+	e.sndBufMu.Lock()
+	s.SndQueued = e.sndBufUsed
+	e.sndBufMu.Unlock()
+
+	return s
+}
+
 // HandlePacket is called by the stack when new packets arrive to this transport
 // endpoint.
-func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, v buffer.View) {
-	s := newSegment(r, id, v)
+func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, vv buffer.VectorisedView) {
+	e.owner.CountReceived(vv.Size())
+
+	s := newSegment(r, id, vv.ToView())
 	if !s.parse() {
 		// TODO: Inform the stack that the packet is malformed.
 		s.decRef()
@@ -814,6 +1257,81 @@ func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, v
 	}
 }
 
+// HandleLinkDown implements stack.LinkStateAwareEndpoint.HandleLinkDown. It
+// causes connections through the given NIC to fail with tcpip.ErrLinkDown.
+func (e *endpoint) HandleLinkDown(nicID tcpip.NICID) {
+	e.mu.RLock()
+	down := (e.state == stateConnecting || e.state == stateConnected) && e.route.NICID() == nicID
+	e.mu.RUnlock()
+
+	if down {
+		e.notifyProtocolGoroutine(notifyLinkDown)
+	}
+}
+
+// HandleNICRemoved implements stack.NICRemovalAwareEndpoint.HandleNICRemoved.
+// It aborts connections through the given NIC, with tcpip.ErrConnectionAborted,
+// and listening endpoints bound to it.
+func (e *endpoint) HandleNICRemoved(nicID tcpip.NICID) {
+	e.mu.RLock()
+	var abort bool
+	switch e.state {
+	case stateConnecting, stateConnected:
+		abort = e.route.NICID() == nicID
+	case stateListen:
+		abort = e.boundNICID == nicID
+	}
+	e.mu.RUnlock()
+
+	if abort {
+		e.notifyProtocolGoroutine(notifyAbort)
+	}
+}
+
+// Abort implements stack.AbortableEndpoint.Abort. It aborts connections, with
+// tcpip.ErrConnectionAborted, and listening endpoints.
+func (e *endpoint) Abort() {
+	e.mu.RLock()
+	abort := e.state == stateConnecting || e.state == stateConnected || e.state == stateListen
+	e.mu.RUnlock()
+
+	if abort {
+		e.notifyProtocolGoroutine(notifyAbort)
+	}
+}
+
+// HandleAddressRemoved implements
+// stack.AddressRemovalAwareEndpoint.HandleAddressRemoved. It aborts connections
+// that use the given address, with tcpip.ErrConnectionAborted, and listening
+// endpoints bound to it.
+func (e *endpoint) HandleAddressRemoved(nicID tcpip.NICID, addr tcpip.Address) {
+	e.mu.RLock()
+	var abort bool
+	switch e.state {
+	case stateConnecting, stateConnected:
+		abort = e.route.NICID() == nicID && e.route.LocalAddress == addr
+	case stateListen:
+		abort = (e.boundNICID == 0 || e.boundNICID == nicID) && e.id.LocalAddress == addr
+	}
+	e.mu.RUnlock()
+
+	if abort {
+		e.notifyProtocolGoroutine(notifyAbort)
+	}
+}
+
+// HandleMTUChange implements stack.MTUAwareEndpoint.HandleMTUChange. It causes
+// connections through the given NIC to recompute their maximum segment size.
+func (e *endpoint) HandleMTUChange(nicID tcpip.NICID) {
+	e.mu.RLock()
+	changed := e.state == stateConnected && e.route.NICID() == nicID
+	e.mu.RUnlock()
+
+	if changed {
+		e.notifyProtocolGoroutine(notifyMTUChanged)
+	}
+}
+
 // updateSndBufferUsage is called by the protocol goroutine when room opens up
 // in the send buffer. The number of newly available bytes is v.
 func (e *endpoint) updateSndBufferUsage(v int) {
@@ -823,34 +1341,75 @@ func (e *endpoint) updateSndBufferUsage(v int) {
 	notify = notify && e.sndBufUsed <= e.sndBufSize
 	e.sndBufMu.Unlock()
 
+	e.stack.ReleaseMemoryFor(e.owner, v)
+
 	if notify {
-		e.waiterQueue.Notify(waiter.EventOut)
+		e.queueEvents(waiter.EventOut)
+	}
+}
+
+// queueEvents is called by the protocol goroutine to notify waiters of the
+// events in mask once it's done with the work at hand, with
+// notifyPendingEvents.
+func (e *endpoint) queueEvents(mask waiter.EventMask) {
+	e.pendingEvents |= mask
+}
+
+// notifyPendingEvents notifies waiters of the events queued with queueEvents,
+// with a single call to Notify.
+func (e *endpoint) notifyPendingEvents() {
+	if mask := e.pendingEvents; mask != 0 {
+		e.pendingEvents = 0
+		e.waiterQueue.Notify(mask)
 	}
 }
 
 // readyToRead is called by the protocol goroutine when a new segment is ready
 // to be read, or when the connection is closed for receiving (in which case
-// s will be nil).
+// s will be nil). Waiters are only notified when the endpoint becomes readable,
+// so that a burst of segments wakes them up once until the reader drains the
+// receive list.
 func (e *endpoint) readyToRead(s *segment) {
 	e.rcvListMu.Lock()
+	wasEmpty := e.rcvList.Empty()
 	if s != nil {
-		s.incRef()
 		e.rcvBufUsed += len(s.data)
-		e.rcvList.PushBack(s)
+		if tail := e.rcvList.Back(); tail != nil && len(tail.data)+len(s.data) <= maxCoalescedSize {
+			// The data of the tail may be shared with the link
+			// endpoint, so it's only appended to once copied.
+			if !e.rcvTailOwned {
+				tail.data = append(make(buffer.View, 0, len(tail.data)+len(s.data)), tail.data...)
+				e.rcvTailOwned = true
+			}
+			tail.data = append(tail.data, s.data...)
+		} else {
+			s.incRef()
+			e.rcvList.PushBack(s)
+			e.rcvTailOwned = false
+		}
 	} else {
 		e.rcvClosed = true
 	}
 	e.rcvListMu.Unlock()
 
-	e.waiterQueue.Notify(waiter.EventIn)
+	if s == nil {
+		events := waiter.EventIn
+		if e.sendClosed() {
+			events |= waiter.EventHUp
+		}
+		e.queueEvents(events)
+	} else if wasEmpty {
+		e.queueEvents(waiter.EventIn)
+	}
 }
 
-// receiveBufferAvailable calculates how many bytes are still available in the
-// receive buffer.
-func (e *endpoint) receiveBufferAvailable() int {
+// receiveWindow calculates the receive window to advertise, that is, how many
+// bytes are still available in the receive buffer, up to the window clamp.
+func (e *endpoint) receiveWindow() int {
 	e.rcvListMu.Lock()
 	size := e.rcvBufSize
 	used := e.rcvBufUsed
+	clamp := e.rcvWndClamp
 	e.rcvListMu.Unlock()
 
 	// We may use more bytes than the buffer size when the receive buffer
@@ -859,9 +1418,21 @@ func (e *endpoint) receiveBufferAvailable() int {
 		return 0
 	}
 
+	if clamp != 0 && size-used > clamp {
+		return clamp
+	}
+
 	return size - used
 }
 
+// windowClamp returns the receive window clamp set with WindowClampOption.
+func (e *endpoint) windowClamp() int {
+	e.rcvListMu.Lock()
+	defer e.rcvListMu.Unlock()
+
+	return e.rcvWndClamp
+}
+
 func (e *endpoint) receiveBufferSize() int {
 	e.rcvListMu.Lock()
 	size := e.rcvBufSize
@@ -66,6 +66,9 @@ func (f *Forwarder) HandlePacket(r *stack.Route, id stack.TransportEndpointID, v
 
 	// Ignore the segment if we're beyond the limit.
 	if len(f.inFlight) >= f.maxInFlight {
+		if s := r.Stack(); s.LogEnabled(stack.LogDebug) {
+			s.Log(stack.LogDebug, "tcp forwarder in-flight limit reached, dropping syn", "remote_addr", id.RemoteAddress, "remote_port", id.RemotePort)
+		}
 		return true
 	}
 
@@ -0,0 +1,171 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build gofuzz
+// +build gofuzz
+
+package tcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/seqnum"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/waiter"
+)
+
+// This file contains entry points for coverage-guided fuzzers such as go-fuzz
+// and libFuzzer, which exercise the segment parsing and the reassembly of
+// out-of-order segments without going through the network layer. It is only
+// built with the gofuzz tag, which go-fuzz-build sets, e.g.:
+//
+//	go-fuzz-build -func FuzzReceive github.com/google/netstack/tcpip/transport/tcp
+
+const (
+	fuzzLocalAddr  = "\x0a\x00\x00\x01"
+	fuzzRemoteAddr = "\x0a\x00\x00\x02"
+
+	// fuzzRecordSize is the size of the records FuzzReceive splits its
+	// input into: a 2-byte sequence number offset, a 1-byte payload length
+	// and a 1-byte set of flags.
+	fuzzRecordSize = 4
+
+	fuzzIRS    = seqnum.Value(0xfffff000)
+	fuzzRcvWnd = seqnum.Size(0xffff)
+)
+
+var (
+	fuzzOnce  sync.Once
+	fuzzStack *stack.Stack
+	fuzzRoute stack.Route
+)
+
+// fuzzSetup creates the stack the fuzzed segments are received from. Packets
+// sent by the endpoints, e.g., acknowledgements, are dropped by the link
+// endpoint once its queue is full.
+func fuzzSetup() {
+	fuzzOnce.Do(func() {
+		fuzzStack = stack.New([]string{ipv4.ProtocolName}, nil).(*stack.Stack)
+
+		id, _ := channel.New(1, 65536)
+		if err := fuzzStack.CreateNIC(1, id); err != nil {
+			panic(err)
+		}
+		if err := fuzzStack.AddAddress(1, ipv4.ProtocolNumber, fuzzLocalAddr); err != nil {
+			panic(err)
+		}
+		fuzzStack.SetRouteTable([]tcpip.Route{{
+			Destination: "\x00\x00\x00\x00",
+			Mask:        "\x00\x00\x00\x00",
+			NIC:         1,
+		}})
+
+		var err error
+		fuzzRoute, err = fuzzStack.FindRoute(1, fuzzLocalAddr, fuzzRemoteAddr, ipv4.ProtocolNumber)
+		if err != nil {
+			panic(err)
+		}
+	})
+}
+
+// FuzzSegment parses data as a received TCP segment. The checksum of the
+// segment is fixed up first, so that the fuzzer doesn't need to find it.
+func FuzzSegment(data []byte) int {
+	if len(data) < header.TCPMinimumSize {
+		return 0
+	}
+
+	fuzzSetup()
+
+	v := buffer.NewView(len(data))
+	copy(v, data)
+	h := header.TCP(v)
+	h.SetChecksum(0)
+	xsum := fuzzRoute.PseudoHeaderChecksum(ProtocolNumber)
+	xsum = header.ChecksumCombine(xsum, uint16(len(v)))
+	h.SetChecksum(^header.Checksum(v, xsum))
+
+	s := newSegment(&fuzzRoute, stack.TransportEndpointID{}, v)
+	defer s.decRef()
+	if !s.parse() {
+		return 0
+	}
+
+	return 1
+}
+
+// FuzzReceive feeds the segments described by data to the receiver of a
+// connected endpoint, and checks that the bytes made available to the reader
+// form the stream that was sent. data is split into records of four bytes
+// holding the offset of the segment from the initial sequence number, its
+// payload length and its flags. The payload of the segments is derived from
+// their offsets, so that overlapping segments carry the same bytes.
+func FuzzReceive(data []byte) int {
+	if len(data) < fuzzRecordSize {
+		return 0
+	}
+
+	fuzzSetup()
+
+	e := newEndpoint(fuzzStack, ipv4.ProtocolNumber, &waiter.Queue{})
+	e.route = fuzzRoute.Clone()
+	e.id = stack.TransportEndpointID{
+		LocalPort:     1,
+		LocalAddress:  fuzzLocalAddr,
+		RemotePort:    2,
+		RemoteAddress: fuzzRemoteAddr,
+	}
+	e.state = stateConnected
+	e.rcv = newReceiver(e, fuzzIRS, fuzzRcvWnd)
+	e.snd = newSender(e, 0, fuzzRcvWnd, 536)
+	defer e.route.Release()
+
+	for ; len(data) >= fuzzRecordSize; data = data[fuzzRecordSize:] {
+		off := binary.BigEndian.Uint16(data)
+		v := buffer.NewView(int(data[2]))
+		for i := range v {
+			v[i] = byte(int(off) + i)
+		}
+
+		s := newSegment(&fuzzRoute, e.id, v)
+		s.sequenceNumber = fuzzIRS.Add(1 + seqnum.Size(off))
+		s.flags = data[3]&flagFin | flagAck
+		e.rcv.handleRcvdSegment(s)
+		s.decRef()
+	}
+
+	// Drain the receive queue and check the stream.
+	var n int
+	for {
+		v, err := e.Read(nil)
+		if err != nil {
+			break
+		}
+		for _, b := range v {
+			if b != byte(n) {
+				panic(fmt.Sprintf("got byte %#x at offset %d, want %#x", b, n, byte(n)))
+			}
+			n++
+		}
+	}
+
+	want := int(fuzzIRS.Add(1).Size(e.rcv.rcvNxt))
+	if e.rcv.closed {
+		want--
+	}
+	if n != want {
+		panic(fmt.Sprintf("read %d bytes, want %d", n, want))
+	}
+
+	e.rcv.dropPending()
+
+	return 1
+}
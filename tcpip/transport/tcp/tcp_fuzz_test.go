@@ -0,0 +1,56 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build gofuzz
+// +build gofuzz
+
+package tcp_test
+
+import (
+	"testing"
+
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/transport/tcp"
+)
+
+func FuzzSegment(f *testing.F) {
+	b := header.TCP(make([]byte, header.TCPMinimumSize+header.TCPOptionMSSLength+4))
+	b.Encode(&header.TCPFields{
+		SrcPort:    testPort,
+		DstPort:    stackPort,
+		SeqNum:     1,
+		DataOffset: header.TCPMinimumSize + header.TCPOptionMSSLength,
+		Flags:      header.TCPFlagSyn,
+		WindowSize: 0xffff,
+	})
+	header.EncodeMSSOption(1460, b[header.TCPMinimumSize:])
+	if tcp.FuzzSegment(b) != 1 {
+		f.Fatalf("FuzzSegment rejected a valid segment")
+	}
+
+	f.Add([]byte(b))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		tcp.FuzzSegment(data)
+	})
+}
+
+func FuzzReceive(f *testing.F) {
+	// Three overlapping segments received out of order, the last of which
+	// carries a FIN, followed by a duplicate.
+	seeds := [][]byte{
+		{0, 100, 50, 0, 0, 0, 120, 0, 0, 200, 10, 1, 0, 0, 10, 0},
+		{0, 0, 255, 1},
+		{0xff, 0xff, 255, 0, 0, 0, 0, 1},
+	}
+	for _, s := range seeds {
+		if tcp.FuzzReceive(s) != 1 {
+			f.Fatalf("FuzzReceive(%v) rejected its input", s)
+		}
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		tcp.FuzzReceive(data)
+	})
+}
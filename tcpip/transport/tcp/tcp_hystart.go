@@ -0,0 +1,155 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcp
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/google/netstack/tcpip/seqnum"
+)
+
+const (
+	// hystartLowWindow is the congestion window, in packets, below which
+	// HyStart doesn't try to end slow start.
+	hystartLowWindow = 16
+
+	// hystartMinSamples is the number of RTT samples taken at the start of
+	// each round to detect delay increases.
+	hystartMinSamples = 8
+
+	// hystartAckDelta is the maximum interval between two acks for them
+	// to be considered part of the same ACK train.
+	hystartAckDelta = 2 * time.Millisecond
+
+	// hystartMinDelayThresh and hystartMaxDelayThresh bound the RTT
+	// increase that ends slow start.
+	hystartMinDelayThresh = 4 * time.Millisecond
+	hystartMaxDelayThresh = 16 * time.Millisecond
+)
+
+// hystart holds the state of HyStart, as described in "Taming the elephants:
+// New TCP slow start" by Ha and Rhee, which ends slow start when the congestion
+// window approaches the capacity of the path, rather than when it overshoots it
+// and causes massive losses. It does so by watching, during each round, i.e.,
+// each window of data, for either:
+//
+//   - an ACK train, i.e., closely spaced acks, which lasts longer than half the
+//     minimum RTT, meaning that the window fills the path;
+//   - an increase of the RTT over the minimum RTT, meaning that queues are
+//     building up along the path.
+type hystart struct {
+	// endSeq is the sequence number whose acknowledgement ends the current
+	// round.
+	endSeq seqnum.Value
+
+	// roundStart is the time when the current round started.
+	roundStart time.Time
+
+	// lastAck is the time when the last ack of the ACK train was received.
+	lastAck time.Time
+
+	// delayMin is the minimum RTT observed, or zero if none has been.
+	delayMin time.Duration
+
+	// currRTT is the minimum RTT observed during the current round, out of
+	// the first samples.
+	currRTT time.Duration
+
+	// samples is the number of RTT samples taken during the current round.
+	samples int
+
+	// found is set once slow start was ended, until the next loss.
+	found bool
+}
+
+// reset resets the state of HyStart, so that it watches slow start again, e.g.,
+// after a retransmit timeout.
+func (h *hystart) reset() {
+	*h = hystart{delayMin: h.delayMin}
+}
+
+// startRound starts a new round, which ends when sndNxt is acknowledged.
+func (h *hystart) startRound(now time.Time, sndNxt seqnum.Value) {
+	h.endSeq = sndNxt
+	h.roundStart = now
+	h.lastAck = now
+	h.currRTT = 0
+	h.samples = 0
+}
+
+// delayThresh returns the RTT increase over delayMin that ends slow start.
+func (h *hystart) delayThresh() time.Duration {
+	t := h.delayMin / 8
+	if t < hystartMinDelayThresh {
+		t = hystartMinDelayThresh
+	}
+	if t > hystartMaxDelayThresh {
+		t = hystartMaxDelayThresh
+	}
+	return t
+}
+
+// sample records an RTT sample.
+func (h *hystart) sample(rtt time.Duration) {
+	if h.delayMin == 0 || rtt < h.delayMin {
+		h.delayMin = rtt
+	}
+}
+
+// update is called for each ack of new data during slow start, with an RTT
+// sample, or zero if none could be taken. It returns true if slow start must
+// end.
+func (h *hystart) update(now time.Time, ack, sndNxt seqnum.Value, rtt time.Duration) bool {
+	if h.roundStart.IsZero() || h.endSeq.LessThan(ack) {
+		h.startRound(now, sndNxt)
+	}
+
+	if h.delayMin == 0 {
+		return false
+	}
+
+	// Look for an ACK train lasting longer than half the minimum RTT.
+	if now.Sub(h.lastAck) <= hystartAckDelta {
+		h.lastAck = now
+		if now.Sub(h.roundStart) > h.delayMin/2 {
+			return true
+		}
+	}
+
+	// Look for an increase of the RTT over the minimum RTT.
+	if rtt == 0 {
+		return false
+	}
+	if h.samples < hystartMinSamples {
+		if h.currRTT == 0 || rtt < h.currRTT {
+			h.currRTT = rtt
+		}
+		h.samples++
+		return false
+	}
+
+	return h.currRTT > h.delayMin+h.delayThresh()
+}
+
+// updateHyStart is called by the sender when ack acknowledges new data, before
+// the congestion window is updated, with an RTT sample, or zero if none could
+// be taken; it ends slow start if HyStart detects that the congestion window
+// approaches the capacity of the path.
+func (s *sender) updateHyStart(ack seqnum.Value, rtt time.Duration) {
+	if rtt > 0 {
+		s.hs.sample(rtt)
+	}
+
+	if s.hs.found || s.sndCwnd >= s.sndSsthresh || s.sndCwnd < hystartLowWindow {
+		return
+	}
+
+	if s.hs.update(s.ep.stack.Clock().Now(), ack, s.sndNxt, rtt) {
+		s.hs.found = true
+		s.sndSsthresh = s.sndCwnd
+		atomic.AddUint64(&s.ep.route.Stats().TCP.HyStartExits, 1)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcp
+
+import (
+	"github.com/google/netstack/tcpip/header"
+)
+
+// OptionHandler handles the TCP options that the stack doesn't implement,
+// e.g., to experiment with new options. It is set on an endpoint with
+// OptionHandlerOption, and its methods are called from the goroutine of the
+// connection, so they must not block.
+type OptionHandler interface {
+	// HandleOption is called for each option of the segments received by
+	// the endpoint whose kind the stack doesn't know, with the data of
+	// the option, i.e., the bytes that follow its kind and length bytes.
+	// syn is set if the segment is a SYN segment. data must not be
+	// retained after HandleOption returns.
+	HandleOption(kind uint8, data []byte, syn bool)
+
+	// AppendOptions appends the options to include in a segment sent by
+	// the endpoint to b, complete with their kind and length bytes, and
+	// returns the result. syn is set if the segment is a SYN segment, and
+	// room is the number of bytes the options may take; segments are sent
+	// without the appended options if they don't fit.
+	AppendOptions(b []byte, syn bool, room int) []byte
+}
+
+// OptionHandlerOption is used by SetSockOpt/GetSockOpt to specify the handler
+// of the TCP options that the stack doesn't implement. It must be set before
+// the endpoint is bound or connected; connections accepted by a listening
+// endpoint inherit its handler.
+type OptionHandlerOption struct {
+	Handler OptionHandler
+}
+
+// handleOptions passes the options of s that the stack doesn't know to the
+// option handler of the endpoint, if any.
+func (e *endpoint) handleOptions(s *segment) {
+	h := e.optionHandler
+	if h == nil || len(s.options) == 0 {
+		return
+	}
+
+	syn := s.flagIsSet(flagSyn)
+	header.ForEachTCPOption(s.options, func(kind uint8, data []byte) {
+		if kind != header.TCPOptionMSS {
+			h.HandleOption(kind, data, syn)
+		}
+	})
+}
+
+// appendOptions returns the options added by the option handler of the
+// endpoint, if any, to a segment with the given flags, padded to a multiple of
+// 4 bytes.
+func (e *endpoint) appendOptions(flags byte) []byte {
+	h := e.optionHandler
+	if h == nil {
+		return nil
+	}
+
+	room := header.TCPMaxOptionsLength
+	if flags&flagSyn != 0 {
+		room -= header.TCPOptionMSSLength
+	}
+
+	opts := h.AppendOptions(nil, flags&flagSyn != 0, room)
+	if len(opts) > room {
+		return nil
+	}
+
+	// Pad with EOL options, which are zeros.
+	for len(opts)%4 != 0 {
+		opts = append(opts, header.TCPOptionEOL)
+	}
+
+	return opts
+}
@@ -11,6 +11,8 @@
 package tcp
 
 import (
+	"time"
+
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
@@ -27,6 +29,54 @@ const (
 	ProtocolNumber = header.TCPProtocolNumber
 )
 
+// defaultCloseTimeout is how long connections closed by their user may take to
+// complete their close sequence, unless it is changed in the endpoint defaults
+// of the stack.
+const defaultCloseTimeout = 3 * time.Second
+
+// defaultSynRetries is the number of times the SYN or SYN-ACK segment of
+// handshakes is retransmitted before they fail, unless it is changed in the
+// endpoint defaults of the stack or with SynRetriesOption. With the backoff
+// starting at a second, handshakes fail after 63 seconds.
+const defaultSynRetries = 5
+
+// SynRetriesOption is used by SetSockOpt/GetSockOpt to specify the number of
+// times the SYN segment of a connection attempt is retransmitted before the
+// attempt fails with tcpip.ErrTimeout, like TCP_SYNCNT. The retransmissions
+// back off exponentially, starting at a second. Zero restores the default of
+// the stack.
+type SynRetriesOption int
+
+// ConnectTimeoutOption is used by SetSockOpt/GetSockOpt to specify how long a
+// connection attempt may take before it fails with tcpip.ErrTimeout, regardless
+// of SynRetriesOption. Zero means no timeout.
+type ConnectTimeoutOption time.Duration
+
+// WindowClampOption is used by SetSockOpt/GetSockOpt to specify the maximum
+// receive window the endpoint advertises, regardless of the size of its receive
+// buffer, like TCP_WINDOW_CLAMP. Zero means no clamp. Lowering it doesn't
+// shrink the window already advertised. Connections accepted by a listening
+// endpoint inherit its clamp.
+type WindowClampOption int
+
+// defaultEndpointDefaults are the settings new endpoints are created with,
+// unless they are overridden with stack.Stack.SetEndpointDefaults.
+var defaultEndpointDefaults = stack.EndpointDefaults{
+	SendBufferSize:    stack.BufferSizeRange{Min: 1, Default: 208 << 10, Max: 4 << 20},
+	ReceiveBufferSize: stack.BufferSizeRange{Min: 1, Default: 208 << 10, Max: 4 << 20},
+	NoDelay:           true,
+	ReuseAddress:      true,
+}
+
+// endpointDefaults returns the settings new endpoints of the given stack are
+// created with.
+func endpointDefaults(s *stack.Stack) stack.EndpointDefaults {
+	if d, ok := s.EndpointDefaults(ProtocolNumber); ok {
+		return d
+	}
+	return defaultEndpointDefaults
+}
+
 type protocol struct{}
 
 // Number returns the tcp protocol number.
@@ -85,7 +135,7 @@ func replyWithReset(s *segment) {
 
 	ack := s.sequenceNumber.Add(s.logicalLen())
 
-	sendTCP(&s.route, s.id, nil, flagRst|flagAck, seq, ack, 0)
+	sendTCP(&s.route, s.id, nil, flagRst|flagAck, seq, ack, 0, nil)
 }
 
 func init() {
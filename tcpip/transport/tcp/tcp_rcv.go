@@ -6,10 +6,16 @@ package tcp
 
 import (
 	"container/heap"
+	"sync/atomic"
 
 	"github.com/google/netstack/tcpip/seqnum"
 )
 
+// maxPendingSegments is the maximum number of out-of-order segments an endpoint
+// holds. It bounds the memory held by tiny segments, whose buffers are much
+// larger than their data.
+const maxPendingSegments = 1024
+
 // receiver holds the state necessary to receive TCP segments and turn them
 // into a stream of bytes.
 type receiver struct {
@@ -27,6 +33,10 @@ type receiver struct {
 
 	closed bool
 
+	// pendingRcvdSegments holds the out-of-order segments, whose data is
+	// reserved from the memory of the stack, until they can be consumed.
+	// Their total length is limited to pendingBufSize, and their number to
+	// maxPendingSegments.
 	pendingRcvdSegments segmentHeap
 	pendingBufUsed      seqnum.Size
 	pendingBufSize      seqnum.Size
@@ -57,7 +67,7 @@ func (r *receiver) acceptable(segSeq seqnum.Value, segLen seqnum.Size) bool {
 // segments to send.
 func (r *receiver) getSendParams() (rcvNxt seqnum.Value, rcvWnd seqnum.Size) {
 	// Calculate the window size based on the current buffer size.
-	n := r.ep.receiveBufferAvailable()
+	n := r.ep.receiveWindow()
 	acc := r.rcvNxt.Add(seqnum.Size(n))
 	if r.rcvAcc.LessThan(acc) {
 		r.rcvAcc = acc
@@ -104,6 +114,14 @@ func (r *receiver) consumeSegment(s *segment, segSeq seqnum.Value, segLen seqnum
 			s.data.TrimFront(int(diff))
 		}
 
+		// The segment is treated as missing if the stack is out of
+		// memory for receive queues, so that the peer retransmits it.
+		// Out-of-order segments are dropped first to make room for it,
+		// as they're useless until it's consumed.
+		if !r.reserveMemory(len(s.data)) {
+			return false
+		}
+
 		// Move segment to ready-to-deliver list. Wakeup any waiters.
 		r.ep.readyToRead(s)
 
@@ -123,23 +141,65 @@ func (r *receiver) consumeSegment(s *segment, segSeq seqnum.Value, segLen seqnum
 		r.closed = true
 		r.ep.readyToRead(nil)
 
-		// Flush out any pending segments, except the very first one if
-		// it happens to be the one we're handling now because the
-		// caller is using it.
-		first := 0
-		if len(r.pendingRcvdSegments) != 0 && r.pendingRcvdSegments[0] == s {
-			first = 1
-		}
-
-		for i := first; i < len(r.pendingRcvdSegments); i++ {
-			r.pendingRcvdSegments[i].decRef()
-		}
-		r.pendingRcvdSegments = r.pendingRcvdSegments[:first]
+		// Flush out any pending segments.
+		r.dropPending()
 	}
 
 	return true
 }
 
+// reserveMemory reserves n bytes for in-order data, dropping the pending
+// segments if that's needed to stay within the memory limits.
+func (r *receiver) reserveMemory(n int) bool {
+	if r.ep.stack.ReserveMemoryFor(r.ep.owner, n) {
+		return true
+	}
+
+	if len(r.pendingRcvdSegments) == 0 {
+		return false
+	}
+
+	atomic.AddUint64(&r.ep.route.Stats().TCP.OutOfOrderDrops, uint64(len(r.pendingRcvdSegments)))
+	r.dropPending()
+	return r.ep.stack.ReserveMemoryFor(r.ep.owner, n)
+}
+
+// storePending stores the out-of-order segment s until it can be consumed, if
+// neither the limits of the endpoint nor the memory of the stack are exceeded.
+// Otherwise, s is dropped, and the peer will have to retransmit it.
+func (r *receiver) storePending(s *segment) {
+	if r.pendingBufUsed+s.logicalLen() > r.pendingBufSize ||
+		r.pendingRcvdSegments.Len() >= maxPendingSegments ||
+		!r.ep.stack.ReserveMemoryFor(r.ep.owner, len(s.data)) {
+		atomic.AddUint64(&r.ep.route.Stats().TCP.OutOfOrderDrops, 1)
+		return
+	}
+
+	r.pendingBufUsed += s.logicalLen()
+	s.incRef()
+	heap.Push(&r.pendingRcvdSegments, s)
+}
+
+// popPending removes the first pending segment, releasing its memory, and
+// returns it. The caller must call decRef on it.
+func (r *receiver) popPending() *segment {
+	s := heap.Pop(&r.pendingRcvdSegments).(*segment)
+	r.pendingBufUsed -= s.logicalLen()
+	r.ep.stack.ReleaseMemoryFor(r.ep.owner, len(s.data))
+	return s
+}
+
+// dropPending drops all the pending segments, e.g., once no more data will be
+// received.
+func (r *receiver) dropPending() {
+	for _, s := range r.pendingRcvdSegments {
+		r.ep.stack.ReleaseMemoryFor(r.ep.owner, len(s.data))
+		s.decRef()
+	}
+	r.pendingRcvdSegments = nil
+	r.pendingBufUsed = 0
+}
+
 // handleRcvdSegment handles TCP segments directed at the connection managed by
 // r as they arrive. It is called by the protocol main loop.
 func (r *receiver) handleRcvdSegment(s *segment) {
@@ -163,13 +223,7 @@ func (r *receiver) handleRcvdSegment(s *segment) {
 	originalRcvNxt := r.rcvNxt
 	if !r.consumeSegment(s, segSeq, segLen) {
 		if segLen > 0 || s.flagIsSet(flagFin) {
-			// We only store the segment if it's within our buffer
-			// size limit.
-			if r.pendingBufUsed < r.pendingBufSize {
-				r.pendingBufUsed += s.logicalLen()
-				s.incRef()
-				heap.Push(&r.pendingRcvdSegments, s)
-			}
+			r.storePending(s)
 
 			// Immediately send an ack so that the peer knows it may
 			// have to retransmit.
@@ -186,14 +240,19 @@ func (r *receiver) handleRcvdSegment(s *segment) {
 		segLen := seqnum.Size(len(s.data))
 		segSeq := s.sequenceNumber
 
-		// Skip segment altogether if it has already been acknowledged.
-		if !segSeq.Add(segLen-1).LessThan(r.rcvNxt) &&
-			!r.consumeSegment(s, segSeq, segLen) {
+		// Stop at the next gap.
+		if r.rcvNxt.LessThan(segSeq) {
 			break
 		}
 
-		heap.Pop(&r.pendingRcvdSegments)
-		r.pendingBufUsed -= s.logicalLen()
+		// The memory of the segment is released before it's consumed,
+		// as it's then reserved for the receive queue; if that fails,
+		// the segment is dropped and the peer will retransmit it. Skip
+		// segment altogether if it has already been acknowledged.
+		r.popPending()
+		if !segSeq.Add(segLen - 1).LessThan(r.rcvNxt) {
+			r.consumeSegment(s, segSeq, segLen)
+		}
 		s.decRef()
 	}
 
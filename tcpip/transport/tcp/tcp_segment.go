@@ -5,7 +5,10 @@
 package tcp
 
 import (
+	"runtime"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
@@ -36,37 +39,112 @@ type segment struct {
 	ackNumber      seqnum.Value
 	flags          uint8
 	window         seqnum.Size
+
+	// mss is the maximum segment size option of SYN segments, or zero if
+	// the segment doesn't carry one.
+	mss uint16
+
+	// options are the raw options of the segment.
+	options []byte
+
+	// xmitTime is the time when the segment was last sent, and xmitCount
+	// the number of times it was sent. They are only used for segments
+	// in the write list.
+	xmitTime  time.Time
+	xmitCount int
 }
 
-func newSegment(r *stack.Route, id stack.TransportEndpointID, v buffer.View) *segment {
-	return &segment{
-		refCnt: 1,
-		data:   v,
-		id:     id,
-		route:  r.Clone(),
+// segmentPool holds the segments that aren't referenced anymore, so that the
+// segments of long-lived connections don't churn the garbage collector.
+var segmentPool = sync.Pool{
+	New: func() interface{} {
+		return new(segment)
+	},
+}
+
+// liveSegments tracks the segments taken from segmentPool that weren't released
+// yet, so that tests can check that none leaks. count is only accessed
+// atomically. stacks holds the stacks the segments were taken from, but only
+// when segmentLeakCheck is set, in race builds.
+var liveSegments struct {
+	count int64
+
+	mu     sync.Mutex
+	stacks map[*segment]string
+}
+
+// getSegment takes a segment from segmentPool. The caller holds its only
+// reference.
+func getSegment() *segment {
+	s := segmentPool.Get().(*segment)
+	s.refCnt = 1
+	atomic.AddInt64(&liveSegments.count, 1)
+	if segmentLeakCheck {
+		buf := make([]byte, 4096)
+		buf = buf[:runtime.Stack(buf, false)]
+		liveSegments.mu.Lock()
+		if liveSegments.stacks == nil {
+			liveSegments.stacks = make(map[*segment]string)
+		}
+		liveSegments.stacks[s] = string(buf)
+		liveSegments.mu.Unlock()
 	}
+	return s
 }
 
-func (s *segment) clone() *segment {
-	return &segment{
-		refCnt:         1,
-		data:           s.data,
-		id:             s.id,
-		sequenceNumber: s.sequenceNumber,
-		ackNumber:      s.ackNumber,
-		flags:          s.flags,
-		window:         s.window,
-		route:          s.route.Clone(),
+// putSegment returns s, which isn't referenced anymore, to segmentPool. Segments
+// aren't reused when segmentLeakCheck is set, so that releasing them more times
+// than they're referenced panics rather than releasing a segment that's been
+// reused.
+func putSegment(s *segment) {
+	atomic.AddInt64(&liveSegments.count, -1)
+	if segmentLeakCheck {
+		liveSegments.mu.Lock()
+		delete(liveSegments.stacks, s)
+		liveSegments.mu.Unlock()
+		return
 	}
+	*s = segment{}
+	segmentPool.Put(s)
+}
+
+func newSegment(r *stack.Route, id stack.TransportEndpointID, v buffer.View) *segment {
+	s := getSegment()
+	s.data = v
+	s.id = id
+	s.route = r.Clone()
+	return s
+}
+
+func (s *segment) clone() *segment {
+	c := getSegment()
+	c.data = s.data
+	c.id = s.id
+	c.sequenceNumber = s.sequenceNumber
+	c.ackNumber = s.ackNumber
+	c.flags = s.flags
+	c.window = s.window
+	c.mss = s.mss
+	c.options = s.options
+	c.route = s.route.Clone()
+	c.xmitTime = s.xmitTime
+	c.xmitCount = s.xmitCount
+	return c
 }
 
 func (s *segment) flagIsSet(flag uint8) bool {
 	return (s.flags & flag) != 0
 }
 
+// decRef releases a reference to the segment, and returns it to the pool once
+// it isn't referenced anymore; it must not be used by the caller afterwards.
 func (s *segment) decRef() {
-	if atomic.AddInt32(&s.refCnt, -1) == 0 {
+	switch n := atomic.AddInt32(&s.refCnt, -1); {
+	case n == 0:
 		s.route.Release()
+		putSegment(s)
+	case n < 0:
+		panic("tcp: segment released more times than it was referenced")
 	}
 }
 
@@ -104,15 +182,37 @@ func (s *segment) parse() bool {
 	//      minimum TCP size before reaching here, so it's safe to read the
 	//      fields.
 	if offset := int(h.DataOffset()); offset < header.TCPMinimumSize || offset > len(h) {
+		atomic.AddUint64(&s.route.Stats().TCP.MalformedSegmentsReceived, 1)
 		return false
 	}
 
-	s.data.TrimFront(int(h.DataOffset()))
+	// Verify the checksum unless the link endpoint already did.
+	if s.route.Capabilities()&stack.CapabilityRXChecksumOffload == 0 {
+		xsum := s.route.PseudoHeaderChecksum(ProtocolNumber)
+		xsum = header.ChecksumCombine(xsum, uint16(len(h)))
+		if header.Checksum(h, xsum) != 0xffff {
+			atomic.AddUint64(&s.route.Stats().TCP.ChecksumErrors, 1)
+			return false
+		}
+	}
 
 	s.sequenceNumber = seqnum.Value(h.SequenceNumber())
 	s.ackNumber = seqnum.Value(h.AckNumber())
 	s.flags = h.Flags()
 	s.window = seqnum.Size(h.WindowSize())
 
+	// Only SYN segments may carry the MSS option.
+	s.options = h.Options()
+	if s.flagIsSet(flagSyn) {
+		s.mss, _ = header.ParseMSSOption(s.options)
+	}
+
+	s.data.TrimFront(int(h.DataOffset()))
+
+	atomic.AddUint64(&s.route.Stats().TCP.SegmentsReceived, 1)
+	if s.flagIsSet(flagRst) {
+		atomic.AddUint64(&s.route.Stats().TCP.ResetsReceived, 1)
+	}
+
 	return true
 }
@@ -0,0 +1,11 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !race
+// +build !race
+
+package tcp
+
+// segmentLeakCheck is only set in race builds. See tcp_segment_race.go.
+const segmentLeakCheck = false
@@ -0,0 +1,13 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build race
+// +build race
+
+package tcp
+
+// segmentLeakCheck makes segments record the stacks they're allocated from, and
+// keeps released segments from being reused, so that leaks and extra releases
+// can be found. It's only set in race builds, as it's costly.
+const segmentLeakCheck = true
@@ -6,8 +6,10 @@ package tcp
 
 import (
 	"math"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip/seqnum"
@@ -75,7 +77,7 @@ type sender struct {
 	closed        bool
 	writeNext     *segment
 	writeList     segmentList
-	resendTimer   *time.Timer
+	resendTimer   tcpip.Timer
 	resendTimerEn bool
 
 	// srtt, rttvar & rto are the "smoothed round-trip time", "round-trip
@@ -89,6 +91,13 @@ type sender struct {
 	// maxPayloadSize is the maximum size of the payload of a given segment.
 	// It is initialized on demand.
 	maxPayloadSize int
+
+	// sndMSS is the maximum segment size advertised by the peer in its SYN
+	// segment, or zero if it didn't advertise one.
+	sndMSS int
+
+	// hs is the state of HyStart, which may end slow start early.
+	hs hystart
 }
 
 // fastRecovery holds information related to fast recovery from a packet loss.
@@ -111,7 +120,7 @@ type fastRecovery struct {
 
 // stopAndDrainTimer stops the given timer, and drains its channel if the timer
 // is enabled.
-func stopAndDrainTimer(t *time.Timer, enabled *bool) {
+func stopAndDrainTimer(t tcpip.Timer, enabled *bool) {
 	if !*enabled {
 		return
 	}
@@ -120,15 +129,17 @@ func stopAndDrainTimer(t *time.Timer, enabled *bool) {
 	t.Stop()
 
 	select {
-	case <-t.C:
+	case <-t.C():
 	default:
 	}
 }
 
-func newSender(ep *endpoint, iss seqnum.Value, sndWnd seqnum.Size) *sender {
+func newSender(ep *endpoint, iss seqnum.Value, sndWnd seqnum.Size, sndMSS uint16) *sender {
+	clock := ep.stack.Clock()
 	s := &sender{
 		ep:               ep,
-		resendTimer:      time.NewTimer(time.Hour),
+		sndMSS:           int(sndMSS),
+		resendTimer:      clock.NewTimer(time.Hour),
 		sndCwnd:          initialCwnd,
 		sndSsthresh:      math.MaxInt64,
 		sndWnd:           sndWnd,
@@ -137,7 +148,7 @@ func newSender(ep *endpoint, iss seqnum.Value, sndWnd seqnum.Size) *sender {
 		sndNxtList:       iss + 1,
 		rto:              1 * time.Second,
 		rttMeasureSeqNum: iss + 1,
-		lastSendTime:     time.Now(),
+		lastSendTime:     clock.Now(),
 	}
 
 	s.resendTimer.Stop()
@@ -145,17 +156,57 @@ func newSender(ep *endpoint, iss seqnum.Value, sndWnd seqnum.Size) *sender {
 	return s
 }
 
-// payloadLimit returns the maximum size of the payload. The value first
-// calculated based on the route MTU, then cached.
+// payloadLimit returns the maximum size of the payload. The value is first
+// calculated based on the route MTU and the MSS advertised by the peer, then
+// cached.
+//
+// Peers that don't advertise an MSS are limited by the route MTU only, rather
+// than by the 536-byte default of RFC 1122: connections accepted with SYN
+// cookies don't keep the options of the SYN, and limiting them would be
+// needlessly slow on links with large MTUs.
 func (s *sender) payloadLimit() int {
 	if s.maxPayloadSize == 0 {
-		// TODO: Take MSS in SYN packet into account here.
-		m := s.ep.route.MTU() - uint32(header.TCPMinimumSize)
-		s.maxPayloadSize = int(m)
+		m := int(s.ep.route.MTU()) - header.TCPMinimumSize
+		if s.sndMSS != 0 && s.sndMSS < m {
+			m = s.sndMSS
+		}
+		// Leave room for the options added by the option handler, if
+		// any, which the MSS doesn't account for.
+		if s.ep.optionHandler != nil {
+			m -= header.TCPMaxOptionsLength
+		}
+		// Always make progress, even if the MTU leaves no room for
+		// data, rather than looping forever over empty segments.
+		if m < 1 {
+			m = 1
+		}
+		s.maxPayloadSize = m
 	}
 	return s.maxPayloadSize
 }
 
+// updateMaxPayloadSize recomputes the maximum payload size after the route MTU
+// changes. Segments that were sent but not acknowledged yet are split if they
+// no longer fit, so that they can be retransmitted.
+func (s *sender) updateMaxPayloadSize() {
+	s.maxPayloadSize = 0
+	limit := s.payloadLimit()
+
+	for seg := s.writeList.Front(); seg != nil && seg != s.writeNext; seg = seg.Next() {
+		if len(seg.data) <= limit {
+			continue
+		}
+
+		nSeg := seg.clone()
+		nSeg.data.TrimFront(limit)
+		nSeg.sequenceNumber.UpdateForward(seqnum.Size(limit))
+		s.writeList.InsertAfter(seg, nSeg)
+
+		seg.data.CapLength(limit)
+		s.outstanding++
+	}
+}
+
 // sendAck sends an ACK segment. If canDelay is true, the ACK may be delayed by
 // up to 500ms, in the hopes that a data segment will be sent soon and thus
 // avoid the ACK-only segment; if canDelay is false, an ACK segment is sent
@@ -203,9 +254,11 @@ func (s *sender) resendSegment() {
 	s.rttMeasureSeqNum = s.sndNxt
 
 	// Resend the segment.
+	atomic.AddUint64(&s.ep.route.Stats().TCP.Retransmits, 1)
 	if seg := s.writeList.Front(); seg == nil {
 		s.sendSegment(nil, flagAck|flagFin, s.sndUna)
 	} else {
+		seg.xmitCount++
 		s.sendSegment(seg.data, flagAck|flagPsh, s.sndUna)
 	}
 }
@@ -246,6 +299,7 @@ func (s *sender) retransmitTimerExpired() bool {
 
 	// Reduce the congestion window to 1, i.e., enter slow-start.
 	s.sndCwnd = 1
+	s.hs.reset()
 
 	// Mark the next segment to be sent as the first unacknowledged one and
 	// start sending again. Set the number of outstanding packets to 0 so
@@ -269,7 +323,7 @@ func (s *sender) sendData() {
 	// "A TCP SHOULD set cwnd to no more than RW before beginning
 	// transmission if the TCP has not sent data in the interval exceeding
 	// the retrasmission timeout."
-	if !s.fr.active && time.Now().Sub(s.lastSendTime) > s.rto {
+	if !s.fr.active && s.ep.stack.Clock().Now().Sub(s.lastSendTime) > s.rto {
 		if s.sndCwnd > initialCwnd {
 			s.sndCwnd = initialCwnd
 		}
@@ -307,8 +361,14 @@ func (s *sender) sendData() {
 			seg.data.CapLength(available)
 		}
 
+		if seg.sequenceNumber.LessThan(s.sndNxt) {
+			atomic.AddUint64(&s.ep.route.Stats().TCP.Retransmits, 1)
+		}
+
 		s.outstanding++
+		seg.xmitCount++
 		s.sendSegment(seg.data, flagAck|flagPsh, seg.sequenceNumber)
+		seg.xmitTime = s.lastSendTime
 
 		// Update sndNxt if we actually sent new data (as opposed to
 		// retransmitting some previously sent data).
@@ -441,12 +501,66 @@ func (s *sender) updateCwnd(packetsAcked int) {
 	}
 }
 
+// handleNewAck removes the data acknowledged by ack, which must acknowledge new
+// data, from the write list, and updates the congestion window accordingly.
+func (s *sender) handleNewAck(ack seqnum.Value) {
+	// When an ack is received we must reset the timer. We stop it
+	// here and it will be restarted later if needed.
+	stopAndDrainTimer(s.resendTimer, &s.resendTimerEn)
+
+	// Remove all acknowledged data from the write list.
+	acked := s.sndUna.Size(ack)
+	s.sndUna = ack
+
+	// Segments that were sent only once and are fully acknowledged give an
+	// RTT sample for HyStart; the last one is the most recent.
+	var rtt time.Duration
+	ackLeft := acked
+	originalOutsanding := s.outstanding
+	for s.writeList.Front() != nil {
+		seg := s.writeList.Front()
+		datalen := seqnum.Size(len(seg.data))
+
+		if datalen > ackLeft {
+			seg.data.TrimFront(int(ackLeft))
+			break
+		}
+
+		if s.writeNext == seg {
+			s.writeNext = seg.Next()
+		}
+		if seg.xmitCount == 1 {
+			rtt = s.ep.stack.Clock().Now().Sub(seg.xmitTime)
+		}
+		s.writeList.Remove(seg)
+		s.outstanding--
+		seg.decRef()
+		ackLeft -= datalen
+	}
+
+	// Update the send buffer usage and notify potential waiters.
+	s.ep.updateSndBufferUsage(int(acked))
+
+	// Update the congestion window based on the number of
+	// acknowledged packets, after giving HyStart a chance to end slow
+	// start.
+	s.updateHyStart(ack, rtt)
+	s.updateCwnd(originalOutsanding - s.outstanding)
+
+	// It is possible for s.outstanding to drop below zero if we get
+	// a retransmit timeout, reset outstanding to zero but later
+	// get an ack that cover previously sent data.
+	if s.outstanding < 0 {
+		s.outstanding = 0
+	}
+}
+
 // handleRcvdSegment is called when a segment is received; it is responsible for
 // updating the send-related state.
 func (s *sender) handleRcvdSegment(seg *segment) {
 	// Check if we can extract an RTT measurement from this ack.
 	if s.rttMeasureSeqNum.LessThan(seg.ackNumber) {
-		s.updateRTO(time.Now().Sub(s.rttMeasureTime))
+		s.updateRTO(s.ep.stack.Clock().Now().Sub(s.rttMeasureTime))
 		s.rttMeasureSeqNum = s.sndNxt
 	}
 
@@ -459,47 +573,7 @@ func (s *sender) handleRcvdSegment(seg *segment) {
 	// Ignore ack if it doesn't acknowledge any new data.
 	ack := seg.ackNumber
 	if (ack - 1).InRange(s.sndUna, s.sndNxt) {
-		// When an ack is received we must reset the timer. We stop it
-		// here and it will be restarted later if needed.
-		stopAndDrainTimer(s.resendTimer, &s.resendTimerEn)
-
-		// Remove all acknowledged data from the write list.
-		acked := s.sndUna.Size(ack)
-		s.sndUna = ack
-
-		ackLeft := acked
-		originalOutsanding := s.outstanding
-		for s.writeList.Front() != nil {
-			seg := s.writeList.Front()
-			datalen := seqnum.Size(len(seg.data))
-
-			if datalen > ackLeft {
-				seg.data.TrimFront(int(ackLeft))
-				break
-			}
-
-			if s.writeNext == seg {
-				s.writeNext = seg.Next()
-			}
-			s.writeList.Remove(seg)
-			s.outstanding--
-			seg.decRef()
-			ackLeft -= datalen
-		}
-
-		// Update the send buffer usage and notify potential waiters.
-		s.ep.updateSndBufferUsage(int(acked))
-
-		// Update the congestion window based on the number of
-		// acknowledged packets.
-		s.updateCwnd(originalOutsanding - s.outstanding)
-
-		// It is possible for s.outstanding to drop below zero if we get
-		// a retransmit timeout, reset outstanding to zero but later
-		// get an ack that cover previously sent data.
-		if s.outstanding < 0 {
-			s.outstanding = 0
-		}
+		s.handleNewAck(ack)
 	}
 
 	// Now that we've popped all acknowledged data from the retransmit
@@ -518,7 +592,7 @@ func (s *sender) handleRcvdSegment(seg *segment) {
 // sendSegment sends a new segment containing the given payload, flags and
 // sequence number.
 func (s *sender) sendSegment(data buffer.View, flags byte, seq seqnum.Value) error {
-	s.lastSendTime = time.Now()
+	s.lastSendTime = s.ep.stack.Clock().Now()
 	if seq == s.rttMeasureSeqNum {
 		s.rttMeasureTime = s.lastSendTime
 	}
@@ -0,0 +1,383 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcp
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/seqnum"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/waiter"
+)
+
+// savedEndpoint is the state of an endpoint, as encoded in the data of
+// stack.SavedEndpoint.
+type savedEndpoint struct {
+	NetProto  tcpip.NetworkProtocolNumber
+	State     endpointState
+	HardError string
+
+	ID             stack.TransportEndpointID
+	BoundNIC       tcpip.NICID
+	IsPortReserved bool
+	ReservedAddr   tcpip.Address
+
+	NoDelay    bool
+	ReuseAddr  bool
+	ReusePort  bool
+	RcvBufSize int
+	SndBufSize int
+	Owner      string
+
+	SynRetries     int
+	ConnectTimeout time.Duration
+	RcvWndClamp    int
+
+	// Backlog is the size of the accept queue of listening endpoints.
+	Backlog int
+
+	// RouteNIC and Conn are only meaningful for connected endpoints.
+	RouteNIC tcpip.NICID
+	Conn     *savedConnection
+}
+
+// savedConnection is the state of a connection. It is saved by the protocol
+// goroutine, which owns the sender and receiver.
+type savedConnection struct {
+	// SndUna is the first unacknowledged sequence number, and SndNxtList
+	// is one beyond the last sequence number queued for sending, including
+	// the FIN if the send side is closed.
+	SndUna     seqnum.Value
+	SndNxtList seqnum.Value
+	SndWnd     seqnum.Size
+	SndMSS     int
+	SndClosed  bool
+
+	// SndData holds the data that wasn't acknowledged yet, whether it was
+	// already sent or not, starting at SndUna.
+	SndData [][]byte
+
+	RcvNxt    seqnum.Value
+	RcvAcc    seqnum.Value
+	RcvClosed bool
+
+	// RcvData holds the data that is ready to be read.
+	RcvData [][]byte
+}
+
+// hardErrors are the errors connections can fail with, which are restored by
+// matching their text.
+var hardErrors = []error{
+	tcpip.ErrConnectionReset,
+	tcpip.ErrConnectionAborted,
+	tcpip.ErrConnectionRefused,
+	tcpip.ErrTimeout,
+	tcpip.ErrLinkDown,
+	tcpip.ErrAborted,
+}
+
+func lookupHardError(s string) error {
+	for _, err := range hardErrors {
+		if err.Error() == s {
+			return err
+		}
+	}
+	return tcpip.ErrConnectionAborted
+}
+
+// SaveState implements stack.SaveableEndpoint.SaveState.
+//
+// Connecting endpoints are saved with their destination, and restored by
+// starting a new handshake. Out-of-order segments aren't saved, as the peer
+// retransmits them, and neither are connections waiting to be accepted by a
+// listening endpoint.
+func (e *endpoint) SaveState() (stack.SavedEndpoint, error) {
+	return encodeState(e.save(e.saveChan))
+}
+
+// Detach implements stack.DetachableEndpoint.Detach.
+//
+// The protocol goroutine of connected endpoints stops once it has saved the
+// state of the connection, so that no segment is sent or acknowledged after
+// the snapshot. The endpoint is then closed, which aborts the connections
+// waiting to be accepted by listening endpoints, as they aren't saved.
+func (e *endpoint) Detach() (stack.SavedEndpoint, error) {
+	st := e.save(e.detachChan)
+	e.Close()
+	return encodeState(st)
+}
+
+// encodeState returns the saved endpoint holding st.
+func encodeState(st *savedEndpoint) (stack.SavedEndpoint, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(st); err != nil {
+		return stack.SavedEndpoint{}, err
+	}
+
+	return stack.SavedEndpoint{Protocol: ProtocolNumber, Data: b.Bytes()}, nil
+}
+
+// save returns the state of e. Connected endpoints ask their protocol goroutine
+// for the state of the connection by sending a request on requests; if the
+// connection terminates in the meantime, the state of e is read again.
+func (e *endpoint) save(requests chan chan *savedConnection) *savedEndpoint {
+	for {
+		st := &savedEndpoint{NetProto: e.netProto}
+
+		e.mu.RLock()
+		st.State = e.state
+		if e.hardError != nil {
+			st.HardError = e.hardError.Error()
+		}
+		st.ID = e.id
+		st.BoundNIC = e.boundNICID
+		st.IsPortReserved = e.isPortReserved
+		st.ReservedAddr = e.reservedAddr
+		st.NoDelay = e.noDelay
+		st.ReuseAddr = e.reuseAddr
+		st.ReusePort = e.reusePort
+		st.SynRetries = e.synRetries
+		st.ConnectTimeout = e.connectTimeout
+		st.Owner = e.owner.Name()
+		st.Backlog = cap(e.acceptedChan)
+		if st.State == stateConnected {
+			st.RouteNIC = e.route.NICID()
+		}
+		e.mu.RUnlock()
+
+		e.rcvListMu.Lock()
+		st.RcvBufSize = e.rcvBufSize
+		st.RcvWndClamp = e.rcvWndClamp
+		e.rcvListMu.Unlock()
+
+		e.sndBufMu.Lock()
+		st.SndBufSize = e.sndBufSize
+		e.sndBufMu.Unlock()
+
+		if st.State != stateConnected {
+			return st
+		}
+
+		reply := make(chan *savedConnection, 1)
+		select {
+		case requests <- reply:
+			st.Conn = <-reply
+			return st
+		case <-e.mainLoopDone:
+		}
+	}
+}
+
+// saveConnection returns the state of the connection of e.
+// This method must only be called from the protocol goroutine.
+func (e *endpoint) saveConnection() *savedConnection {
+	c := &savedConnection{
+		SndUna:     e.snd.sndUna,
+		SndNxtList: e.snd.sndNxtList,
+		SndWnd:     e.snd.sndWnd,
+		SndMSS:     e.snd.sndMSS,
+		SndClosed:  e.snd.closed,
+		RcvNxt:     e.rcv.rcvNxt,
+		RcvAcc:     e.rcv.rcvAcc,
+		RcvClosed:  e.rcv.closed,
+	}
+
+	for s := e.snd.writeList.Front(); s != nil; s = s.Next() {
+		c.SndData = append(c.SndData, append([]byte(nil), s.data...))
+	}
+
+	// Data written but not moved to the write list yet is in the send
+	// queue, and so is the FIN if the send side was just closed.
+	e.sndBufMu.Lock()
+	for s := e.sndQueue.Front(); s != nil; s = s.Next() {
+		c.SndData = append(c.SndData, append([]byte(nil), s.data...))
+	}
+	c.SndNxtList.UpdateForward(e.sndBufInQueue)
+	if e.sndBufSize < 0 && !c.SndClosed {
+		c.SndClosed = true
+		c.SndNxtList++
+	}
+	e.sndBufMu.Unlock()
+
+	e.rcvListMu.Lock()
+	for s := e.rcvList.Front(); s != nil; s = s.Next() {
+		c.RcvData = append(c.RcvData, append([]byte(nil), s.data...))
+	}
+	e.rcvListMu.Unlock()
+
+	return c
+}
+
+// RestoreEndpoint implements stack.RestorableTransportProtocol.RestoreEndpoint.
+func (*protocol) RestoreEndpoint(s *stack.Stack, saved stack.SavedEndpoint, waiterQueue *waiter.Queue) (tcpip.Endpoint, error) {
+	var st savedEndpoint
+	if err := gob.NewDecoder(bytes.NewReader(saved.Data)).Decode(&st); err != nil {
+		return nil, err
+	}
+
+	e := newEndpoint(s, st.NetProto, waiterQueue)
+	e.noDelay = st.NoDelay
+	e.reuseAddr = st.ReuseAddr
+	e.reusePort = st.ReusePort
+	if st.SynRetries != 0 {
+		e.synRetries = st.SynRetries
+	}
+	e.connectTimeout = st.ConnectTimeout
+	e.rcvBufSize = st.RcvBufSize
+	e.rcvWndClamp = st.RcvWndClamp
+	e.sndBufSize = st.SndBufSize
+	if st.Owner != "" {
+		e.owner = s.Owner(st.Owner)
+	}
+
+	if err := e.restore(&st); err != nil {
+		e.Close()
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// restore puts e, a new endpoint, in the saved state.
+func (e *endpoint) restore(st *savedEndpoint) error {
+	local := tcpip.FullAddress{NIC: st.BoundNIC, Addr: st.ID.LocalAddress, Port: st.ID.LocalPort}
+	switch st.State {
+	case stateInitial:
+		return nil
+
+	case stateBound:
+		return e.Bind(local, nil)
+
+	case stateListen:
+		if err := e.Bind(local, nil); err != nil {
+			return err
+		}
+		return e.Listen(st.Backlog)
+
+	case stateConnecting:
+		if st.IsPortReserved {
+			local.Addr = st.ReservedAddr
+			if err := e.Bind(local, nil); err != nil {
+				return err
+			}
+		}
+
+		err := e.Connect(tcpip.FullAddress{NIC: st.BoundNIC, Addr: st.ID.RemoteAddress, Port: st.ID.RemotePort})
+		if err != tcpip.ErrConnectStarted {
+			return err
+		}
+		return nil
+
+	case stateConnected:
+		return e.restoreConnection(st)
+
+	case stateError:
+		e.state = stateError
+		e.hardError = lookupHardError(st.HardError)
+		return nil
+
+	default:
+		e.state = stateClosed
+		return nil
+	}
+}
+
+// restoreConnection restores a connected endpoint and starts its protocol
+// goroutine. All the unacknowledged data is considered as sent, so that it is
+// retransmitted once the retransmit timer expires.
+func (e *endpoint) restoreConnection(st *savedEndpoint) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	c := st.Conn
+	e.id = st.ID
+	e.boundNICID = st.BoundNIC
+
+	if st.IsPortReserved {
+		if _, err := e.stack.ReservePort(e.netProto, ProtocolNumber, st.ReservedAddr, st.ID.LocalPort, e.portFlags()); err != nil {
+			return err
+		}
+
+		e.isPortReserved = true
+		e.reservedAddr = st.ReservedAddr
+	}
+
+	r, err := e.stack.FindRoute(st.RouteNIC, st.ID.LocalAddress, st.ID.RemoteAddress, e.netProto)
+	if err != nil {
+		return err
+	}
+	e.route = r
+
+	if err := e.stack.RegisterTransportEndpoint(e.boundNICID, ProtocolNumber, e.id, e); err != nil {
+		return err
+	}
+	e.isRegistered = true
+
+	// Reserve the memory of the queues at once so that nothing needs to be
+	// undone if the stack is out of memory.
+	rcvUsed, sndUsed := 0, 0
+	for _, b := range c.RcvData {
+		rcvUsed += len(b)
+	}
+	for _, b := range c.SndData {
+		sndUsed += len(b)
+	}
+	if !e.stack.ReserveMemoryFor(e.owner, rcvUsed+sndUsed) {
+		return tcpip.ErrNoBufferSpace
+	}
+
+	for _, b := range c.RcvData {
+		e.rcvList.PushBack(newSegment(&e.route, e.id, b))
+	}
+	e.rcvBufUsed = rcvUsed
+	e.rcvClosed = c.RcvClosed
+
+	e.snd = newSender(e, c.SndUna-1, c.SndWnd, uint16(c.SndMSS))
+	e.rcv = newReceiver(e, c.RcvNxt-1, c.RcvNxt.Size(c.RcvAcc))
+	e.rcv.pendingBufSize = seqnum.Size(e.rcvBufSize)
+	e.rcv.closed = c.RcvClosed
+
+	// Queue the unacknowledged data in segments that fit in the route.
+	limit := e.snd.payloadLimit()
+	seq := c.SndUna
+	for _, b := range c.SndData {
+		for v := buffer.View(b); len(v) > 0; {
+			n := len(v)
+			if n > limit {
+				n = limit
+			}
+
+			s := newSegment(&e.route, e.id, v[:n])
+			s.flags = flagAck
+			s.sequenceNumber = seq
+			e.snd.writeList.PushBack(s)
+			e.snd.outstanding++
+
+			seq.UpdateForward(seqnum.Size(n))
+			v = v[n:]
+		}
+	}
+	e.sndBufUsed = sndUsed
+
+	e.snd.sndNxt = c.SndNxtList
+	e.snd.sndNxtList = c.SndNxtList
+	e.snd.rttMeasureSeqNum = c.SndNxtList
+	if c.SndClosed {
+		e.snd.closed = true
+		e.sndBufSize = -1
+		e.sndChan = nil
+	}
+	e.snd.enableResendTimer()
+
+	e.state = stateConnected
+	e.workerRunning = true
+	e.stack.GoWithLabels(e.profileLabels, func() { e.protocolMainLoop(true) })
+
+	return nil
+}
@@ -6,12 +6,19 @@ package tcp_test
 
 import (
 	"bytes"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/checker"
+	"github.com/google/netstack/tcpip/faketime"
 	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip/link/channel"
 	"github.com/google/netstack/tcpip/link/sniffer"
@@ -36,6 +43,7 @@ type headers struct {
 	ackNum  seqnum.Value
 	flags   int
 	rcvWnd  seqnum.Size
+	tcpOpts []byte
 }
 
 type testContext struct {
@@ -130,7 +138,8 @@ func (c *testContext) getPacket() []byte {
 
 func (c *testContext) sendPacket(payload []byte, h *headers) {
 	// Allocate a buffer for data and headers.
-	buf := buffer.NewView(header.TCPMinimumSize + header.IPv4MinimumSize + len(payload))
+	tcpLen := header.TCPMinimumSize + len(h.tcpOpts)
+	buf := buffer.NewView(tcpLen + header.IPv4MinimumSize + len(payload))
 	copy(buf[len(buf)-len(payload):], payload)
 
 	// Initialize the IP header.
@@ -152,10 +161,11 @@ func (c *testContext) sendPacket(payload []byte, h *headers) {
 		DstPort:    h.dstPort,
 		SeqNum:     uint32(h.seqNum),
 		AckNum:     uint32(h.ackNum),
-		DataOffset: header.TCPMinimumSize,
+		DataOffset: uint8(tcpLen),
 		Flags:      uint8(h.flags),
 		WindowSize: uint16(h.rcvWnd),
 	})
+	copy(t.Options(), h.tcpOpts)
 
 	// Calculate the TCP pseudo-header checksum.
 	xsum := header.Checksum([]byte(testAddr), 0)
@@ -163,7 +173,7 @@ func (c *testContext) sendPacket(payload []byte, h *headers) {
 	xsum = header.Checksum([]byte{0, uint8(tcp.ProtocolNumber)}, xsum)
 
 	// Calculate the TCP checksum and set it.
-	length := uint16(header.TCPMinimumSize + len(payload))
+	length := uint16(tcpLen + len(payload))
 	xsum = header.Checksum(payload, xsum)
 	t.SetChecksum(^t.CalculateChecksum(xsum, length))
 
@@ -202,6 +212,12 @@ func (c *testContext) receiveAndCheckPacket(data []byte, offset, size int) {
 
 // createConnected creates a connected TCP endpoint.
 func (c *testContext) createConnected(iss seqnum.Value, rcvWnd seqnum.Size, epRcvBuf *tcpip.ReceiveBufferSizeOption) {
+	c.createConnectedWithOptions(iss, rcvWnd, epRcvBuf, nil)
+}
+
+// createConnectedWithOptions creates a connected TCP endpoint, whose peer
+// includes the given options in its SYN-ACK segment.
+func (c *testContext) createConnectedWithOptions(iss seqnum.Value, rcvWnd seqnum.Size, epRcvBuf *tcpip.ReceiveBufferSizeOption, synOpts []byte) {
 	// Create TCP endpoint.
 	var err error
 	c.ep, err = c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
@@ -225,12 +241,20 @@ func (c *testContext) createConnected(iss seqnum.Value, rcvWnd seqnum.Size, epRc
 		c.t.Fatalf("Unexpected return value from Connect: %v", err)
 	}
 
-	// Receive SYN packet.
+	// Receive SYN packet. It must advertise an MSS derived from the MTU,
+	// which IPv4 limits to the maximum size of a packet.
+	mtu := c.linkEP.MTU()
+	if mtu > 0xffff {
+		mtu = 0xffff
+	}
+	mss := mtu - header.IPv4MinimumSize - header.TCPMinimumSize
+
 	b := c.getPacket()
 	checker.IPv4(c.t, b,
 		checker.TCP(
 			checker.DstPort(testPort),
 			checker.TCPFlags(header.TCPFlagSyn),
+			checker.TCPMSS(uint16(mss)),
 		),
 	)
 
@@ -244,6 +268,7 @@ func (c *testContext) createConnected(iss seqnum.Value, rcvWnd seqnum.Size, epRc
 		seqNum:  iss,
 		ackNum:  c.irs.Add(1),
 		rcvWnd:  rcvWnd,
+		tcpOpts: synOpts,
 	})
 
 	// Receive ACK packet.
@@ -298,6 +323,146 @@ func TestGiveUpConnect(t *testing.T) {
 	err = ep.GetSockOpt(tcpip.ErrorOption{})
 }
 
+func TestConnectTimeoutWithManualClock(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	clock := faketime.NewManualClock(time.Unix(0, 0))
+	c.s.(*stack.Stack).SetClock(clock)
+
+	var wq waiter.Queue
+	ep, err := c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	c.ep = ep
+
+	waitEntry, notifyCh := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&waitEntry, waiter.EventOut)
+	defer wq.EventUnregister(&waitEntry)
+
+	if err := ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("Unexpected return value from Connect: %v", err)
+	}
+
+	// The SYN is retransmitted with exponential backoff, but only when the
+	// clock is advanced.
+	timeout := time.Second
+	for i := 0; timeout < 60*time.Second; i++ {
+		checker.IPv4(t, c.getPacket(), checker.TCP(checker.TCPFlags(header.TCPFlagSyn)))
+		c.checkNoPacketTimeout("SYN retransmitted before the clock was advanced", 50*time.Millisecond)
+
+		clock.Advance(timeout)
+		timeout *= 2
+	}
+
+	// The connection attempt is given up on the last expiration.
+	select {
+	case <-notifyCh:
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for the connection attempt to fail")
+	}
+
+	if err := ep.GetSockOpt(tcpip.ErrorOption{}); err != tcpip.ErrTimeout {
+		t.Fatalf("Connect returned %v, want %v", err, tcpip.ErrTimeout)
+	}
+}
+
+func TestConnectSynRetries(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		opt     interface{}
+		backoff []time.Duration
+	}{
+		// The SYN is retransmitted twice, and the attempt fails once
+		// the last retransmission times out.
+		{"SynRetries", tcp.SynRetriesOption(2), []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}},
+		// The attempt fails before the second retransmission.
+		{"ConnectTimeout", tcp.ConnectTimeoutOption(1500 * time.Millisecond), []time.Duration{time.Second, 500 * time.Millisecond}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			clock := faketime.NewManualClock(time.Unix(0, 0))
+			c.s.(*stack.Stack).SetClock(clock)
+
+			var wq waiter.Queue
+			ep, err := c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+			if err != nil {
+				t.Fatalf("NewEndpoint failed: %v", err)
+			}
+			c.ep = ep
+
+			if err := ep.SetSockOpt(test.opt); err != nil {
+				t.Fatalf("SetSockOpt failed: %v", err)
+			}
+
+			waitEntry, notifyCh := waiter.NewChannelEntry(nil)
+			wq.EventRegister(&waitEntry, waiter.EventOut)
+			defer wq.EventUnregister(&waitEntry)
+
+			if err := ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != tcpip.ErrConnectStarted {
+				t.Fatalf("Unexpected return value from Connect: %v", err)
+			}
+
+			for _, d := range test.backoff {
+				checker.IPv4(t, c.getPacket(), checker.TCP(checker.TCPFlags(header.TCPFlagSyn)))
+				clock.Advance(d)
+			}
+
+			select {
+			case <-notifyCh:
+			case <-time.After(time.Second):
+				t.Fatalf("Timed out waiting for the connection attempt to fail")
+			}
+			c.checkNoPacketTimeout("SYN retransmitted after the connection attempt failed", 50*time.Millisecond)
+
+			if err := ep.GetSockOpt(tcpip.ErrorOption{}); err != tcpip.ErrTimeout {
+				t.Fatalf("Connect returned %v, want %v", err, tcpip.ErrTimeout)
+			}
+		})
+	}
+}
+
+func TestSynRetriesOption(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.setEndpointDefaults(stack.EndpointDefaults{SynRetries: 3})
+
+	ep, err := c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	check := func(want tcp.SynRetriesOption) {
+		var v tcp.SynRetriesOption
+		if err := ep.GetSockOpt(&v); err != nil {
+			t.Fatalf("GetSockOpt failed: %v", err)
+		}
+		if v != want {
+			t.Fatalf("got SynRetriesOption = %d, want %d", v, want)
+		}
+	}
+
+	// Zero restores the default of the stack.
+	check(3)
+	if err := ep.SetSockOpt(tcp.SynRetriesOption(1)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	check(1)
+	if err := ep.SetSockOpt(tcp.SynRetriesOption(0)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	check(3)
+
+	if err := ep.SetSockOpt(tcp.SynRetriesOption(-1)); err != tcpip.ErrInvalidOptionValue {
+		t.Fatalf("SetSockOpt returned %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+}
+
 func TestActiveHandshake(t *testing.T) {
 	c := newTestContext(t, defaultMTU)
 	defer c.cleanup()
@@ -305,6 +470,177 @@ func TestActiveHandshake(t *testing.T) {
 	c.createConnected(789, 30000, nil)
 }
 
+func TestSimultaneousOpen(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var err error
+	c.ep, err = c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	c.wq.EventRegister(&we, waiter.EventOut)
+	defer c.wq.EventUnregister(&we)
+
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("Unexpected return value from Connect: %v", err)
+	}
+
+	b := c.getPacket()
+	checker.IPv4(t, b, checker.TCP(checker.TCPFlags(header.TCPFlagSyn)))
+	tcpHdr := header.TCP(header.IPv4(b).Payload())
+	c.irs = seqnum.Value(tcpHdr.SequenceNumber())
+	c.port = tcpHdr.SourcePort()
+
+	// The peer connects at the same time, so its SYN crosses ours. It must
+	// be acknowledged with our SYN, even when retransmitted.
+	for i := 0; i < 2; i++ {
+		c.sendPacket(nil, &headers{
+			srcPort: testPort,
+			dstPort: c.port,
+			flags:   header.TCPFlagSyn,
+			seqNum:  789,
+			rcvWnd:  30000,
+		})
+
+		checker.IPv4(t, c.getPacket(),
+			checker.TCP(
+				checker.DstPort(testPort),
+				checker.TCPFlags(header.TCPFlagSyn|header.TCPFlagAck),
+				checker.SeqNum(uint32(c.irs)),
+				checker.AckNum(790),
+			),
+		)
+	}
+
+	// The peer's SYN-ACK completes the handshake.
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagSyn | header.TCPFlagAck,
+		seqNum:  789,
+		ackNum:  c.irs.Add(1),
+		rcvWnd:  30000,
+	})
+
+	select {
+	case <-ch:
+		if err := c.ep.GetSockOpt(tcpip.ErrorOption{}); err != nil {
+			t.Fatalf("Unexpected error when connecting: %v", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timed out waiting for connection")
+	}
+
+	// Data can now be sent.
+	data := []byte{1, 2, 3}
+	if _, err := c.ep.Write(buffer.View(data), nil); err != nil {
+		t.Fatalf("Unexpected error from Write: %v", err)
+	}
+
+	checker.IPv4(t, c.getPacket(),
+		checker.PayloadLen(len(data)+header.TCPMinimumSize),
+		checker.TCP(
+			checker.DstPort(testPort),
+			checker.SeqNum(uint32(c.irs)+1),
+			checker.AckNum(790),
+		),
+	)
+}
+
+// testOptionHandler is a tcp.OptionHandler that records the options it
+// receives, and adds an experimental option to the segments it sends.
+type testOptionHandler struct {
+	mu       sync.Mutex
+	received []string
+}
+
+// testOptionKind is the kind of the experimental option used in the tests.
+const testOptionKind = 253
+
+func (h *testOptionHandler) HandleOption(kind uint8, data []byte, syn bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.received = append(h.received, fmt.Sprintf("%d:%x:%t", kind, data, syn))
+}
+
+func (h *testOptionHandler) AppendOptions(b []byte, syn bool, room int) []byte {
+	v := byte(0)
+	if syn {
+		v = 1
+	}
+	return append(b, testOptionKind, 3, v)
+}
+
+func TestOptionHandler(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var err error
+	c.ep, err = c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+
+	h := &testOptionHandler{}
+	if err := c.ep.SetSockOpt(tcp.OptionHandlerOption{Handler: h}); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("Unexpected return value from Connect: %v", err)
+	}
+
+	// The SYN carries both the MSS option and the added one.
+	mtu := c.linkEP.MTU()
+	if mtu > 0xffff {
+		mtu = 0xffff
+	}
+	b := c.getPacket()
+	checker.IPv4(t, b,
+		checker.TCP(
+			checker.TCPFlags(header.TCPFlagSyn),
+			checker.TCPMSS(uint16(mtu-header.IPv4MinimumSize-header.TCPMinimumSize)),
+			checker.TCPOption(testOptionKind, []byte{1}),
+		),
+	)
+	tcpHdr := header.TCP(header.IPv4(b).Payload())
+	c.irs = seqnum.Value(tcpHdr.SequenceNumber())
+	c.port = tcpHdr.SourcePort()
+
+	// Reply with unknown options, which are passed to the handler.
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagSyn | header.TCPFlagAck,
+		seqNum:  789,
+		ackNum:  c.irs.Add(1),
+		rcvWnd:  30000,
+		tcpOpts: []byte{testOptionKind, 4, 0xab, 0xcd},
+	})
+
+	checker.IPv4(t, c.getPacket(),
+		checker.TCP(
+			checker.TCPFlags(header.TCPFlagAck),
+			checker.TCPOption(testOptionKind, []byte{0}),
+		),
+	)
+
+	h.mu.Lock()
+	got := h.received
+	h.mu.Unlock()
+	if want := []string{"253:abcd:true"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Options received by the handler: got %v, want %v", got, want)
+	}
+
+	// The handler can't be changed once the endpoint is connected.
+	if err := c.ep.SetSockOpt(tcp.OptionHandlerOption{}); err != tcpip.ErrInvalidEndpointState {
+		t.Fatalf("SetSockOpt returned %v, want %v", err, tcpip.ErrInvalidEndpointState)
+	}
+}
+
 func TestNonBlockingClose(t *testing.T) {
 	c := newTestContext(t, defaultMTU)
 	defer c.cleanup()
@@ -413,6 +749,125 @@ func TestSimpleReceive(t *testing.T) {
 	)
 }
 
+func TestReceiveDeadline(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	clock := faketime.NewManualClock(time.Unix(0, 0))
+	c.s.(*stack.Stack).SetClock(clock)
+
+	c.createConnected(789, 30000, nil)
+
+	we, ch := waiter.NewChannelEntry(nil)
+	c.wq.EventRegister(&we, waiter.EventIn)
+	defer c.wq.EventUnregister(&we)
+
+	deadline := clock.Now().Add(time.Second)
+	if err := c.ep.SetSockOpt(tcpip.ReceiveDeadlineOption(deadline)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+
+	var v tcpip.ReceiveDeadlineOption
+	if err := c.ep.GetSockOpt(&v); err != nil {
+		t.Fatalf("GetSockOpt failed: %v", err)
+	}
+	if !time.Time(v).Equal(deadline) {
+		t.Fatalf("GetSockOpt returned deadline %v, want %v", time.Time(v), deadline)
+	}
+
+	if _, err := c.ep.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("Unexpected error from Read: %v", err)
+	}
+
+	// Waiters are notified when the deadline expires.
+	clock.Advance(time.Second)
+	select {
+	case <-ch:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timed out waiting for the deadline to expire")
+	}
+
+	if _, err := c.ep.Read(nil); err != tcpip.ErrTimeout {
+		t.Fatalf("Read returned %v, want %v", err, tcpip.ErrTimeout)
+	}
+
+	// Removing the deadline makes reads block again.
+	if err := c.ep.SetSockOpt(tcpip.ReceiveDeadlineOption(time.Time{})); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+
+	if _, err := c.ep.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("Unexpected error from Read: %v", err)
+	}
+}
+
+func TestStackMemoryLimit(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	s := c.s.(*stack.Stack)
+	s.SetMemoryLimit(4)
+
+	c.createConnected(789, 30000, nil)
+
+	we, ch := waiter.NewChannelEntry(nil)
+	c.wq.EventRegister(&we, waiter.EventIn)
+	defer c.wq.EventUnregister(&we)
+
+	first := []byte{1, 2, 3}
+	second := []byte{4, 5, 6}
+	sendAt := func(data []byte, seq seqnum.Value) {
+		c.sendPacket(data, &headers{
+			srcPort: testPort,
+			dstPort: c.port,
+			flags:   header.TCPFlagAck,
+			seqNum:  seq,
+			ackNum:  c.irs.Add(1),
+			rcvWnd:  30000,
+		})
+	}
+	checkAck := func(ack uint32) {
+		checker.IPv4(c.t, c.getPacket(),
+			checker.TCP(
+				checker.DstPort(testPort),
+				checker.AckNum(ack),
+				checker.TCPFlags(header.TCPFlagAck),
+			),
+		)
+	}
+
+	sendAt(first, 790)
+	checkAck(793)
+	if got := s.MemoryUsage(); got != len(first) {
+		t.Fatalf("MemoryUsage() = %d, want %d", got, len(first))
+	}
+
+	// The second segment doesn't fit in the limit, so it isn't
+	// acknowledged.
+	sendAt(second, 793)
+	checkAck(793)
+
+	// Reading makes room for the retransmission.
+	if v, err := c.ep.Read(nil); err != nil || !bytes.Equal(v, first) {
+		t.Fatalf("Read returned (%v, %v), want (%v, nil)", v, err, first)
+	}
+	if got := s.MemoryUsage(); got != 0 {
+		t.Fatalf("MemoryUsage() = %d, want 0", got)
+	}
+
+	sendAt(second, 793)
+	select {
+	case <-ch:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timed out waiting for data to arrive")
+	}
+	checkAck(796)
+
+	if v, err := c.ep.Read(nil); err != nil || !bytes.Equal(v, second) {
+		t.Fatalf("Read returned (%v, %v), want (%v, nil)", v, err, second)
+	}
+}
+
 func TestOutOfOrderReceive(t *testing.T) {
 	c := newTestContext(t, defaultMTU)
 	defer c.cleanup()
@@ -500,22 +955,117 @@ func TestOutOfOrderReceive(t *testing.T) {
 	)
 }
 
-func TestOutOfOrderFlood(t *testing.T) {
+func TestReceiveCoalescing(t *testing.T) {
 	c := newTestContext(t, defaultMTU)
 	defer c.cleanup()
 
-	// Create a new connection with initial window size of 10.
-	opt := tcpip.ReceiveBufferSizeOption(10)
-	c.createConnected(789, 30000, &opt)
-
-	if _, err := c.ep.Read(nil); err != tcpip.ErrWouldBlock {
-		t.Fatalf("Unexpected error from Read: %v", err)
-	}
+	c.createConnected(789, 30000, nil)
 
-	// Send 100 packets before the actual one that is expected.
-	data := []byte{1, 2, 3, 4, 5, 6}
-	for i := 0; i < 100; i++ {
-		c.sendPacket(data[3:], &headers{
+	// Send a few in-order segments, waiting for each one to be acked.
+	var data []byte
+	for i := 0; i < 3; i++ {
+		b := []byte{byte(3 * i), byte(3*i + 1), byte(3*i + 2)}
+		c.sendPacket(b, &headers{
+			srcPort: testPort,
+			dstPort: c.port,
+			flags:   header.TCPFlagAck,
+			seqNum:  seqnum.Value(790 + len(data)),
+			ackNum:  c.irs.Add(1),
+			rcvWnd:  30000,
+		})
+		data = append(data, b...)
+		checker.IPv4(c.t, c.getPacket(),
+			checker.TCP(
+				checker.DstPort(testPort),
+				checker.AckNum(uint32(790+len(data))),
+			),
+		)
+	}
+
+	// Check that they're all returned by a single read.
+	v, err := c.ep.Read(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Read: %v", err)
+	}
+	if bytes.Compare(data, v) != 0 {
+		t.Fatalf("Data is different: expected %v, got %v", data, v)
+	}
+	if _, err := c.ep.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("Unexpected error from Read: %v", err)
+	}
+}
+
+func TestReceiveNotificationCoalescing(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createConnected(789, 30000, nil)
+
+	var notified int32
+	we := waiter.Entry{Callback: func(*waiter.Entry) {
+		atomic.AddInt32(&notified, 1)
+	}}
+	c.wq.EventRegister(&we, waiter.EventIn)
+	defer c.wq.EventUnregister(&we)
+
+	waitNotified := func(want int32) {
+		for start := time.Now(); atomic.LoadInt32(&notified) < want && time.Since(start) < time.Second; {
+			time.Sleep(time.Millisecond)
+		}
+		if got := atomic.LoadInt32(&notified); got != want {
+			t.Fatalf("Waiters were notified %d times, want %d", got, want)
+		}
+	}
+
+	// Send a few segments, waiting for each one to be acked. The waiter is
+	// only woken up by the first one, as the data isn't read.
+	seq := seqnum.Value(790)
+	send := func(b []byte) {
+		c.sendPacket(b, &headers{
+			srcPort: testPort,
+			dstPort: c.port,
+			flags:   header.TCPFlagAck,
+			seqNum:  seq,
+			ackNum:  c.irs.Add(1),
+			rcvWnd:  30000,
+		})
+		seq = seq.Add(seqnum.Size(len(b)))
+		checker.IPv4(c.t, c.getPacket(),
+			checker.TCP(
+				checker.DstPort(testPort),
+				checker.AckNum(uint32(seq)),
+			),
+		)
+	}
+	for i := 0; i < 3; i++ {
+		send([]byte{byte(i)})
+	}
+	waitNotified(1)
+
+	// Once the data is read, the next segment wakes the waiter up again.
+	if _, err := c.ep.Read(nil); err != nil {
+		t.Fatalf("Unexpected error from Read: %v", err)
+	}
+	send([]byte{3})
+	waitNotified(2)
+}
+
+func TestOutOfOrderFlood(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	// Create a new connection with initial window size of 10.
+	opt := tcpip.ReceiveBufferSizeOption(10)
+	c.createConnected(789, 30000, &opt)
+
+	if _, err := c.ep.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("Unexpected error from Read: %v", err)
+	}
+
+	// Send 100 packets before the actual one that is expected.
+	data := []byte{1, 2, 3, 4, 5, 6}
+	for i := 0; i < 100; i++ {
+		c.sendPacket(data[3:], &headers{
 			srcPort: testPort,
 			dstPort: c.port,
 			flags:   header.TCPFlagAck,
@@ -575,6 +1125,179 @@ func TestOutOfOrderFlood(t *testing.T) {
 	)
 }
 
+func TestOutOfOrderMemoryLimit(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	s := c.s.(*stack.Stack)
+	s.SetMemoryLimit(4)
+
+	c.createConnected(789, 30000, nil)
+
+	data := []byte{1, 2, 3}
+	sendAt := func(seq seqnum.Value) {
+		c.sendPacket(data, &headers{
+			srcPort: testPort,
+			dstPort: c.port,
+			flags:   header.TCPFlagAck,
+			seqNum:  seq,
+			ackNum:  c.irs.Add(1),
+			rcvWnd:  30000,
+		})
+	}
+	checkAck := func(ack uint32) {
+		checker.IPv4(c.t, c.getPacket(),
+			checker.TCP(
+				checker.DstPort(testPort),
+				checker.AckNum(ack),
+				checker.TCPFlags(header.TCPFlagAck),
+			),
+		)
+	}
+
+	// Out-of-order segments are held within the memory limit.
+	sendAt(793)
+	checkAck(790)
+	if got := s.MemoryUsage(); got != len(data) {
+		t.Fatalf("MemoryUsage() = %d, want %d", got, len(data))
+	}
+	sendAt(796)
+	checkAck(790)
+	if got := s.MemoryUsage(); got != len(data) {
+		t.Fatalf("MemoryUsage() = %d, want %d", got, len(data))
+	}
+	if got := c.s.Stats().TCP.OutOfOrderDrops; got != 1 {
+		t.Fatalf("got OutOfOrderDrops = %d, want 1", got)
+	}
+
+	// They're dropped to make room for in-order data.
+	sendAt(790)
+	checkAck(793)
+	if got := s.MemoryUsage(); got != len(data) {
+		t.Fatalf("MemoryUsage() = %d, want %d", got, len(data))
+	}
+	if got := c.s.Stats().TCP.OutOfOrderDrops; got != 2 {
+		t.Fatalf("got OutOfOrderDrops = %d, want 2", got)
+	}
+
+	// The memory of in-order segments is released once they're read.
+	if v, err := c.ep.Read(nil); err != nil || !bytes.Equal(v, data) {
+		t.Fatalf("Read returned (%v, %v), want (%v, nil)", v, err, data)
+	}
+	if got := s.MemoryUsage(); got != 0 {
+		t.Fatalf("MemoryUsage() = %d, want 0", got)
+	}
+
+	// So is the memory of out-of-order segments once the connection is
+	// gone.
+	sendAt(796)
+	checkAck(793)
+	if got := s.MemoryUsage(); got != len(data) {
+		t.Fatalf("MemoryUsage() = %d, want %d", got, len(data))
+	}
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagRst,
+		seqNum:  793,
+	})
+	for i := 0; s.MemoryUsage() != 0; i++ {
+		if i == 100 {
+			t.Fatalf("MemoryUsage() = %d, want 0", s.MemoryUsage())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWindowClamp(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	const clamp = 1000
+
+	wq := &waiter.Queue{}
+	ep, err := c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	if err := ep.SetSockOpt(tcp.WindowClampOption(clamp)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	if err := ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := ep.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	// The SYN-ACK advertises the clamped window.
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: stackPort,
+		flags:   header.TCPFlagSyn,
+		seqNum:  789,
+		rcvWnd:  30000,
+	})
+	b := c.getPacket()
+	checker.IPv4(t, b,
+		checker.TCP(
+			checker.TCPFlags(header.TCPFlagSyn|header.TCPFlagAck),
+			checker.Window(clamp),
+		),
+	)
+	iss := seqnum.Value(header.TCP(header.IPv4(b).Payload()).SequenceNumber())
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventIn)
+	defer wq.EventUnregister(&we)
+
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: stackPort,
+		flags:   header.TCPFlagAck,
+		seqNum:  790,
+		ackNum:  iss.Add(1),
+		rcvWnd:  30000,
+	})
+	select {
+	case <-ch:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timed out waiting for the connection")
+	}
+	n, _, err := ep.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer n.Close()
+
+	var v tcp.WindowClampOption
+	if err := n.GetSockOpt(&v); err != nil || v != clamp {
+		t.Fatalf("GetSockOpt returned (%d, %v), want (%d, nil)", v, err, clamp)
+	}
+
+	// So do the ACKs of the accepted connection, even though its receive
+	// buffer is much larger.
+	c.sendPacket([]byte{1, 2, 3}, &headers{
+		srcPort: testPort,
+		dstPort: stackPort,
+		flags:   header.TCPFlagAck,
+		seqNum:  790,
+		ackNum:  iss.Add(1),
+		rcvWnd:  30000,
+	})
+	checker.IPv4(t, c.getPacket(),
+		checker.TCP(
+			checker.AckNum(793),
+			checker.Window(clamp),
+		),
+	)
+
+	if err := n.SetSockOpt(tcp.WindowClampOption(-1)); err != tcpip.ErrInvalidOptionValue {
+		t.Fatalf("SetSockOpt returned %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+}
+
 func TestFullWindowReceive(t *testing.T) {
 	c := newTestContext(t, defaultMTU)
 	defer c.cleanup()
@@ -704,12 +1427,8 @@ func TestNoWindowShrinking(t *testing.T) {
 		rcvWnd:  30000,
 	})
 
-	select {
-	case <-ch:
-	case <-time.After(5 * time.Second):
-		t.Fatalf("Timed out waiting for data to arrive")
-	}
-
+	// Waiters aren't notified again, as the data that was already there
+	// wasn't read.
 	checker.IPv4(c.t, c.getPacket(),
 		checker.TCP(
 			checker.DstPort(testPort),
@@ -789,136 +1508,849 @@ func TestSimpleSend(t *testing.T) {
 	})
 }
 
-func TestZeroWindowSend(t *testing.T) {
+func TestSegmentLeaks(t *testing.T) {
 	c := newTestContext(t, defaultMTU)
 	defer c.cleanup()
 
-	c.createConnected(789, 0, nil)
+	c.createConnected(789, 30000, nil)
+
+	// Wait for the segments of the handshake to be released.
+	before, _ := tcp.LiveSegments()
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		if n, _ := tcp.LiveSegments(); n == before {
+			break
+		}
+		before, _ = tcp.LiveSegments()
+	}
 
+	// Exchange data both ways. The segments are released once the data is
+	// acknowledged and read.
 	data := []byte{1, 2, 3}
 	view := buffer.NewView(len(data))
 	copy(view, data)
-
-	_, err := c.ep.Write(view, nil)
-	if err != nil {
+	if _, err := c.ep.Write(view, nil); err != nil {
 		t.Fatalf("Unexpected error from Write: %v", err)
 	}
+	c.getPacket()
 
-	// Since the window is currently zero, check that no packet is received.
-	c.checkNoPacket("Packet received when window is zero")
-
-	// Open up the window. Data should be received now.
-	c.sendPacket(nil, &headers{
+	c.sendPacket(data, &headers{
 		srcPort: testPort,
 		dstPort: c.port,
 		flags:   header.TCPFlagAck,
 		seqNum:  790,
-		ackNum:  c.irs.Add(1),
+		ackNum:  c.irs.Add(1 + seqnum.Size(len(data))),
 		rcvWnd:  30000,
 	})
-
-	// Check that data is received.
-	b := c.getPacket()
-	checker.IPv4(c.t, b,
-		checker.PayloadLen(len(data)+header.TCPMinimumSize),
+	checker.IPv4(c.t, c.getPacket(),
 		checker.TCP(
 			checker.DstPort(testPort),
-			checker.SeqNum(uint32(c.irs)+1),
-			checker.AckNum(790),
-			checker.TCPFlagsMatch(header.TCPFlagAck, ^uint8(header.TCPFlagPsh)),
+			checker.AckNum(uint32(790+len(data))),
 		),
 	)
 
-	if p := b[header.IPv4MinimumSize+header.TCPMinimumSize:]; bytes.Compare(data, p) != 0 {
-		t.Fatalf("Data is different: expected %v, got %v", data, p)
+	if _, err := c.ep.Read(nil); err != nil {
+		t.Fatalf("Unexpected error from Read: %v", err)
 	}
 
-	// Acknowledge the data.
-	c.sendPacket(nil, &headers{
-		srcPort: testPort,
-		dstPort: c.port,
-		flags:   header.TCPFlagAck,
-		seqNum:  790,
-		ackNum:  c.irs.Add(1 + seqnum.Size(len(data))),
-		rcvWnd:  30000,
-	})
+	n, stacks := tcp.LiveSegments()
+	for start := time.Now(); n != before && time.Since(start) < time.Second; n, stacks = tcp.LiveSegments() {
+		time.Sleep(time.Millisecond)
+	}
+	if n != before {
+		t.Fatalf("%d segments leaked, allocated from:\n%s", n-before, strings.Join(stacks, "\n"))
+	}
 }
 
-func TestSendGreaterThanMTU(t *testing.T) {
-	maxPayload := 100
-	c := newTestContext(t, uint32(header.TCPMinimumSize+header.IPv4MinimumSize+maxPayload))
+func TestHeaderPrediction(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
 	defer c.cleanup()
 
 	c.createConnected(789, 30000, nil)
 
-	packetCount := 3
-	data := make([]byte, packetCount*maxPayload)
-	for i := range data {
-		data[i] = byte(i)
+	// In-sequence data is handled by the fast path.
+	data := []byte{1, 2, 3}
+	c.sendPacket(data, &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagAck | header.TCPFlagPsh,
+		seqNum:  790,
+		ackNum:  c.irs.Add(1),
+		rcvWnd:  30000,
+	})
+	checker.IPv4(c.t, c.getPacket(),
+		checker.TCP(
+			checker.DstPort(testPort),
+			checker.SeqNum(uint32(c.irs)+1),
+			checker.AckNum(793),
+			checker.TCPFlags(header.TCPFlagAck),
+		),
+	)
+	if got := c.s.Stats().TCP.FastPathSegments; got != 1 {
+		t.Fatalf("got FastPathSegments = %d, want 1", got)
+	}
+
+	v, err := c.ep.Read(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Read: %v", err)
+	}
+	if bytes.Compare(data, v) != 0 {
+		t.Fatalf("Data is different: expected %v, got %v", data, v)
 	}
 
+	// So is a pure ack of new data.
 	view := buffer.NewView(len(data))
 	copy(view, data)
-
 	if _, err := c.ep.Write(view, nil); err != nil {
 		t.Fatalf("Unexpected error from Write: %v", err)
 	}
-
-	// Check that data is received in chunks.
-	for i := 0; i < packetCount; i++ {
-		b := c.getPacket()
-		checker.IPv4(c.t, b,
-			checker.PayloadLen(maxPayload+header.TCPMinimumSize),
-			checker.TCP(
-				checker.DstPort(testPort),
-				checker.SeqNum(uint32(c.irs)+1+uint32(i*maxPayload)),
-				checker.AckNum(790),
+	checker.IPv4(c.t, c.getPacket(),
+		checker.PayloadLen(len(data)+header.TCPMinimumSize),
+		checker.TCP(
+			checker.DstPort(testPort),
+			checker.SeqNum(uint32(c.irs)+1),
+			checker.AckNum(793),
+		),
+	)
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagAck,
+		seqNum:  793,
+		ackNum:  c.irs.Add(1 + seqnum.Size(len(data))),
+		rcvWnd:  30000,
+	})
+
+	// Out-of-order data isn't, nor is data that changes the window.
+	c.sendPacket(data, &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagAck,
+		seqNum:  796,
+		ackNum:  c.irs.Add(1 + seqnum.Size(len(data))),
+		rcvWnd:  30000,
+	})
+	checker.IPv4(c.t, c.getPacket(),
+		checker.TCP(
+			checker.DstPort(testPort),
+			checker.AckNum(793),
+		),
+	)
+	c.sendPacket(data, &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagAck,
+		seqNum:  793,
+		ackNum:  c.irs.Add(1 + seqnum.Size(len(data))),
+		rcvWnd:  20000,
+	})
+	checker.IPv4(c.t, c.getPacket(),
+		checker.TCP(
+			checker.DstPort(testPort),
+			checker.AckNum(799),
+		),
+	)
+	if got := c.s.Stats().TCP.FastPathSegments; got != 2 {
+		t.Fatalf("got FastPathSegments = %d, want 2", got)
+	}
+
+	// The data of both paths is received in order.
+	var read []byte
+	for len(read) < 2*len(data) {
+		v, err := c.ep.Read(nil)
+		if err != nil {
+			t.Fatalf("Unexpected error from Read: %v", err)
+		}
+		read = append(read, v...)
+	}
+	if want := append(append([]byte(nil), data...), data...); bytes.Compare(want, read) != 0 {
+		t.Fatalf("Data is different: expected %v, got %v", want, read)
+	}
+}
+
+func TestZeroWindowSend(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createConnected(789, 0, nil)
+
+	data := []byte{1, 2, 3}
+	view := buffer.NewView(len(data))
+	copy(view, data)
+
+	_, err := c.ep.Write(view, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Write: %v", err)
+	}
+
+	// Since the window is currently zero, check that no packet is received.
+	c.checkNoPacket("Packet received when window is zero")
+
+	// Open up the window. Data should be received now.
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagAck,
+		seqNum:  790,
+		ackNum:  c.irs.Add(1),
+		rcvWnd:  30000,
+	})
+
+	// Check that data is received.
+	b := c.getPacket()
+	checker.IPv4(c.t, b,
+		checker.PayloadLen(len(data)+header.TCPMinimumSize),
+		checker.TCP(
+			checker.DstPort(testPort),
+			checker.SeqNum(uint32(c.irs)+1),
+			checker.AckNum(790),
+			checker.TCPFlagsMatch(header.TCPFlagAck, ^uint8(header.TCPFlagPsh)),
+		),
+	)
+
+	if p := b[header.IPv4MinimumSize+header.TCPMinimumSize:]; bytes.Compare(data, p) != 0 {
+		t.Fatalf("Data is different: expected %v, got %v", data, p)
+	}
+
+	// Acknowledge the data.
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagAck,
+		seqNum:  790,
+		ackNum:  c.irs.Add(1 + seqnum.Size(len(data))),
+		rcvWnd:  30000,
+	})
+}
+
+func TestSendGreaterThanMTU(t *testing.T) {
+	maxPayload := 100
+	c := newTestContext(t, uint32(header.TCPMinimumSize+header.IPv4MinimumSize+maxPayload))
+	defer c.cleanup()
+
+	c.createConnected(789, 30000, nil)
+
+	packetCount := 3
+	data := make([]byte, packetCount*maxPayload)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	view := buffer.NewView(len(data))
+	copy(view, data)
+
+	if _, err := c.ep.Write(view, nil); err != nil {
+		t.Fatalf("Unexpected error from Write: %v", err)
+	}
+
+	// Check that data is received in chunks.
+	for i := 0; i < packetCount; i++ {
+		b := c.getPacket()
+		checker.IPv4(c.t, b,
+			checker.PayloadLen(maxPayload+header.TCPMinimumSize),
+			checker.TCP(
+				checker.DstPort(testPort),
+				checker.SeqNum(uint32(c.irs)+1+uint32(i*maxPayload)),
+				checker.AckNum(790),
 				checker.TCPFlagsMatch(header.TCPFlagAck, ^uint8(header.TCPFlagPsh)),
 			),
 		)
 
-		pdata := data[i*maxPayload:][:maxPayload]
-		if p := b[header.IPv4MinimumSize+header.TCPMinimumSize:]; bytes.Compare(pdata, p) != 0 {
-			t.Fatalf("Data is different: expected %v, got %v", pdata, p)
-		}
+		pdata := data[i*maxPayload:][:maxPayload]
+		if p := b[header.IPv4MinimumSize+header.TCPMinimumSize:]; bytes.Compare(pdata, p) != 0 {
+			t.Fatalf("Data is different: expected %v, got %v", pdata, p)
+		}
+
+		// Acknowledge the data.
+		c.sendPacket(nil, &headers{
+			srcPort: testPort,
+			dstPort: c.port,
+			flags:   header.TCPFlagAck,
+			seqNum:  790,
+			ackNum:  c.irs.Add(1 + seqnum.Size((i+1)*maxPayload)),
+			rcvWnd:  30000,
+		})
+	}
+}
+
+func TestJumboSegments(t *testing.T) {
+	const mtu = 9000
+	maxPayload := mtu - header.IPv4MinimumSize - header.TCPMinimumSize
+	c := newTestContext(t, mtu)
+	defer c.cleanup()
+
+	c.createConnected(789, 30000, nil)
+
+	we, ch := waiter.NewChannelEntry(nil)
+	c.wq.EventRegister(&we, waiter.EventIn)
+	defer c.wq.EventUnregister(&we)
+
+	// Send a full-sized segment to the stack.
+	data := make([]byte, maxPayload)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	c.sendPacket(data, &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagAck,
+		seqNum:  790,
+		ackNum:  c.irs.Add(1),
+		rcvWnd:  30000,
+	})
+
+	select {
+	case <-ch:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timed out waiting for data to arrive")
+	}
+
+	v, err := c.ep.Read(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Read: %v", err)
+	}
+
+	if bytes.Compare(data, v) != 0 {
+		t.Fatalf("Data is different: expected %v, got %v", data, v)
+	}
+
+	checker.IPv4(c.t, c.getPacket(),
+		checker.TCP(
+			checker.DstPort(testPort),
+			checker.AckNum(uint32(790+len(data))),
+			checker.TCPFlags(header.TCPFlagAck),
+		),
+	)
+
+	// Write two full-sized segments and check that they are sent as such.
+	view := buffer.NewView(2 * maxPayload)
+	copy(view, data)
+	copy(view[maxPayload:], data)
+
+	if _, err := c.ep.Write(view, nil); err != nil {
+		t.Fatalf("Unexpected error from Write: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		b := c.getPacket()
+		checker.IPv4(c.t, b,
+			checker.PayloadLen(maxPayload+header.TCPMinimumSize),
+			checker.TCP(
+				checker.DstPort(testPort),
+				checker.SeqNum(uint32(c.irs)+1+uint32(i*maxPayload)),
+			),
+		)
+
+		if p := b[header.IPv4MinimumSize+header.TCPMinimumSize:]; bytes.Compare(data, p) != 0 {
+			t.Fatalf("Data is different: expected %v, got %v", data, p)
+		}
+
+		// Acknowledge the data.
+		c.sendPacket(nil, &headers{
+			srcPort: testPort,
+			dstPort: c.port,
+			flags:   header.TCPFlagAck,
+			seqNum:  seqnum.Value(790 + len(data)),
+			ackNum:  c.irs.Add(1 + seqnum.Size((i+1)*maxPayload)),
+			rcvWnd:  30000,
+		})
+	}
+}
+
+func TestPeerMSS(t *testing.T) {
+	const peerMSS = 1460
+	c := newTestContext(t, 9000)
+	defer c.cleanup()
+
+	opts := make([]byte, header.TCPOptionMSSLength)
+	header.EncodeMSSOption(peerMSS, opts)
+	c.createConnectedWithOptions(789, 30000, nil, opts)
+
+	// Even though the link MTU is larger, segments must not be larger than
+	// the MSS advertised by the peer.
+	packetCount := 3
+	data := make([]byte, packetCount*peerMSS)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	view := buffer.NewView(len(data))
+	copy(view, data)
+
+	if _, err := c.ep.Write(view, nil); err != nil {
+		t.Fatalf("Unexpected error from Write: %v", err)
+	}
+
+	for i := 0; i < packetCount; i++ {
+		c.receiveAndCheckPacket(data, i*peerMSS, peerMSS)
+
+		// Acknowledge the data.
+		c.sendAck(790, (i+1)*peerMSS)
+	}
+}
+
+func TestCloseListener(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	// Create listener.
+	var wq waiter.Queue
+	ep, err := c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+
+	if err := ep.Bind(tcpip.FullAddress{}, nil); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+
+	if err := ep.Listen(10); err != nil {
+		c.t.Fatalf("Listen failed: %v", err)
+	}
+
+	// Close the listener and measure how long it takes.
+	t0 := time.Now()
+	ep.Close()
+	if diff := time.Now().Sub(t0); diff > 3*time.Second {
+		c.t.Fatalf("Took too long to close: %v", diff)
+	}
+}
+
+// createListener creates an endpoint listening on stackPort with the given
+// backlog.
+func (c *testContext) createListener(backlog int) (tcpip.Endpoint, *waiter.Queue) {
+	wq := &waiter.Queue{}
+	ep, err := c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+
+	if err := ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+
+	if err := ep.Listen(backlog); err != nil {
+		c.t.Fatalf("Listen failed: %v", err)
+	}
+
+	return ep, wq
+}
+
+// sendSyn sends a SYN segment from the given port to stackPort, and returns
+// the initial sequence number of the SYN-ACK segment sent in reply.
+func (c *testContext) sendSyn(port uint16) seqnum.Value {
+	c.sendPacket(nil, &headers{
+		srcPort: port,
+		dstPort: stackPort,
+		flags:   header.TCPFlagSyn,
+		seqNum:  789,
+		rcvWnd:  30000,
+	})
+
+	b := c.getPacket()
+	checker.IPv4(c.t, b,
+		checker.TCP(
+			checker.DstPort(port),
+			checker.TCPFlags(header.TCPFlagSyn|header.TCPFlagAck),
+			checker.AckNum(790),
+		),
+	)
+	return seqnum.Value(header.TCP(header.IPv4(b).Payload()).SequenceNumber())
+}
+
+// listenerStats returns the counters of the listening endpoint ep.
+func (c *testContext) listenerStats(ep tcpip.Endpoint) tcpip.ListenerStatsOption {
+	var st tcpip.ListenerStatsOption
+	if err := ep.GetSockOpt(&st); err != nil {
+		c.t.Fatalf("GetSockOpt failed: %v", err)
+	}
+	return st
+}
+
+func TestListenerStats(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	// Create a listener whose accept queue holds a single connection.
+	ep, wq := c.createListener(1)
+	defer ep.Close()
+
+	// handshake completes a connection from the given port.
+	handshake := func(port uint16) {
+		iss := c.sendSyn(port)
+		c.sendPacket(nil, &headers{
+			srcPort: port,
+			dstPort: stackPort,
+			flags:   header.TCPFlagAck,
+			seqNum:  790,
+			ackNum:  iss.Add(1),
+			rcvWnd:  30000,
+		})
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventIn)
+	defer wq.EventUnregister(&we)
+
+	handshake(testPort)
+	select {
+	case <-ch:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timed out waiting for the connection to be queued")
+	}
+
+	// The accept queue is full, so the second connection is reset.
+	handshake(testPort + 1)
+	checker.IPv4(c.t, c.getPacket(),
+		checker.TCP(
+			checker.DstPort(testPort+1),
+			checker.TCPFlags(header.TCPFlagAck|header.TCPFlagRst),
+		),
+	)
+
+	got := c.listenerStats(ep)
+	want := tcpip.ListenerStatsOption{
+		AcceptQueued:     1,
+		AcceptQueueLimit: 1,
+		AcceptOverflows:  1,
+	}
+	if got != want {
+		t.Fatalf("GetSockOpt returned %+v, want %+v", got, want)
+	}
+
+	if got := c.s.Stats().TCP.ListenOverflows; got != 1 {
+		t.Fatalf("ListenOverflows = %d, want 1", got)
+	}
+}
+
+// setEndpointDefaults sets the settings the TCP endpoints created by the stack
+// start with to d, along with the default buffer sizes.
+func (c *testContext) setEndpointDefaults(d stack.EndpointDefaults) {
+	r := stack.BufferSizeRange{Min: 1, Default: 208 << 10, Max: 4 << 20}
+	d.SendBufferSize = r
+	d.ReceiveBufferSize = r
+	if err := c.s.(*stack.Stack).SetEndpointDefaults(tcp.ProtocolNumber, d); err != nil {
+		c.t.Fatalf("SetEndpointDefaults failed: %v", err)
+	}
+}
+
+func TestReusePortListeners(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	// The clock doesn't advance, so the SYN-ACKs aren't retransmitted.
+	c.s.(*stack.Stack).SetClock(faketime.NewManualClock(time.Unix(0, 0)))
+
+	newEndpoint := func(reusePort bool) tcpip.Endpoint {
+		ep, err := c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %v", err)
+		}
+		if reusePort {
+			if err := ep.SetSockOpt(tcpip.ReusePortOption(1)); err != nil {
+				t.Fatalf("SetSockOpt failed: %v", err)
+			}
+		}
+		return ep
+	}
+
+	var eps [2]tcpip.Endpoint
+	for i := range eps {
+		eps[i] = newEndpoint(true)
+		if err := eps[i].Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+			t.Fatalf("Bind failed: %v", err)
+		}
+		if err := eps[i].Listen(10); err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+	}
+
+	defer eps[1].Close()
+
+	// Endpoints that don't reuse the port can't bind to it.
+	ep := newEndpoint(false)
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != tcpip.ErrPortInUse {
+		t.Fatalf("Bind returned %v, want %v", err, tcpip.ErrPortInUse)
+	}
+
+	// The connections are spread among the listeners.
+	const conns = 16
+	for i := 0; i < conns; i++ {
+		c.sendSyn(testPort + uint16(i))
+	}
+	total := 0
+	for i, ep := range eps {
+		n := c.listenerStats(ep).SynBacklog
+		if n == 0 {
+			t.Errorf("listener %d got no connections", i)
+		}
+		total += n
+	}
+	if total != conns {
+		t.Errorf("got %d connections, want %d", total, conns)
+	}
+
+	// Once a listener is closed, the others get all the connections.
+	eps[0].Close()
+	before := c.listenerStats(eps[1]).SynBacklog
+	for i := 0; i < conns; i++ {
+		c.sendSyn(testPort + conns + uint16(i))
+	}
+	if got, want := c.listenerStats(eps[1]).SynBacklog, before+conns; got != want {
+		t.Errorf("got SynBacklog = %d, want %d", got, want)
+	}
+}
+
+func TestSynRcvdTimeout(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	clock := faketime.NewManualClock(time.Unix(0, 0))
+	c.s.(*stack.Stack).SetClock(clock)
+	c.setEndpointDefaults(stack.EndpointDefaults{SynRcvdTimeout: 3 * time.Second})
+
+	ep, _ := c.createListener(10)
+	defer ep.Close()
+
+	// The SYN-ACK is retransmitted once, after a second, and the
+	// connection is dropped two seconds later.
+	c.sendSyn(testPort)
+	clock.Advance(time.Second)
+	checker.IPv4(t, c.getPacket(), checker.TCP(checker.TCPFlags(header.TCPFlagSyn|header.TCPFlagAck)))
+	clock.Advance(2 * time.Second)
+
+	for start := time.Now(); c.listenerStats(ep).SynBacklog != 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("Timed out waiting for the connection to be dropped")
+		}
+	}
+	c.checkNoPacketTimeout("Packet sent after the connection was dropped", 50*time.Millisecond)
+}
+
+func TestMaxSynRcvd(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.setEndpointDefaults(stack.EndpointDefaults{MaxSynRcvd: 1})
+
+	ep, _ := c.createListener(10)
+	defer ep.Close()
+
+	// The second connection is over the limit, so it's answered with a
+	// SYN cookie instead of holding state.
+	c.sendSyn(testPort)
+	c.sendSyn(testPort + 1)
+
+	got := c.listenerStats(ep)
+	if got.SynBacklog != 1 || got.CookiesSent != 1 {
+		t.Fatalf("GetSockOpt returned %+v, want SynBacklog 1 and CookiesSent 1", got)
+	}
+}
+
+func TestSetEndpointDefaultsInvalidTimeouts(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	r := stack.BufferSizeRange{Min: 1, Default: 1, Max: 1}
+	for _, d := range []stack.EndpointDefaults{
+		{SendBufferSize: r, ReceiveBufferSize: r, SynRcvdTimeout: -time.Second},
+		{SendBufferSize: r, ReceiveBufferSize: r, MaxSynRcvd: -1},
+		{SendBufferSize: r, ReceiveBufferSize: r, CloseTimeout: -time.Second},
+		{SendBufferSize: r, ReceiveBufferSize: r, FinWait2Timeout: -time.Second},
+		{SendBufferSize: r, ReceiveBufferSize: r, SynRetries: -1},
+		{SendBufferSize: r, ReceiveBufferSize: r, ConnectTimeout: -time.Second},
+	} {
+		if err := c.s.(*stack.Stack).SetEndpointDefaults(tcp.ProtocolNumber, d); err != tcpip.ErrInvalidOptionValue {
+			t.Errorf("SetEndpointDefaults(%+v) returned %v, want %v", d, err, tcpip.ErrInvalidOptionValue)
+		}
+	}
+}
+
+func TestCloseStack(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createConnected(789, 30000, nil)
+
+	// Create a listener, which is only registered with the stack.
+	var wq waiter.Queue
+	ep, err := c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	if err := ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+
+	if err := ep.Listen(10); err != nil {
+		c.t.Fatalf("Listen failed: %v", err)
+	}
+
+	c.s.Close()
+
+	done := make(chan struct{})
+	go func() {
+		c.s.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timed out waiting for the stack goroutines to exit")
+	}
+
+	// The connection is aborted without sending a RST.
+	if _, err := c.ep.Read(nil); err != tcpip.ErrConnectionAborted {
+		t.Fatalf("Read returned %v, want %v", err, tcpip.ErrConnectionAborted)
+	}
+	c.checkNoPacketTimeout("Packet sent after the stack was closed", 100*time.Millisecond)
+
+	if _, err := c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq); err != tcpip.ErrStackClosed {
+		t.Fatalf("NewEndpoint returned %v, want %v", err, tcpip.ErrStackClosed)
+	}
+}
+
+func TestSaveRestoreConnected(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createConnected(789, 30000, nil)
+
+	we, ch := waiter.NewChannelEntry(nil)
+	c.wq.EventRegister(&we, waiter.EventIn)
+
+	// Receive data that isn't read before the endpoint is saved.
+	rcvData := []byte{1, 2, 3}
+	c.sendPacket(rcvData, &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagAck,
+		seqNum:  790,
+		ackNum:  c.irs.Add(1),
+		rcvWnd:  30000,
+	})
+
+	select {
+	case <-ch:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timed out waiting for data to arrive")
+	}
+	c.wq.EventUnregister(&we)
+	c.getPacket()
+
+	// Send data that isn't acknowledged before the endpoint is saved.
+	sndData := []byte{4, 5, 6}
+	view := buffer.NewView(len(sndData))
+	copy(view, sndData)
+	if _, err := c.ep.Write(view, nil); err != nil {
+		t.Fatalf("Unexpected error from Write: %v", err)
+	}
+	c.getPacket()
+
+	st, err := c.s.(*stack.Stack).SaveState([]tcpip.Endpoint{c.ep})
+	if err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+
+	c.s.Close()
+	c.ep.Close()
+
+	// The state can be serialized, e.g., to restore it in another process.
+	var enc bytes.Buffer
+	if err := gob.NewEncoder(&enc).Encode(st); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	st = &stack.State{}
+	if err := gob.NewDecoder(&enc).Decode(st); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	// Restore the state in a new stack, with a new link endpoint.
+	s := stack.New([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName}).(*stack.Stack)
+	id, linkEP := channel.New(256, defaultMTU)
+	st.NICs[0].LinkEndpoint = id
+
+	var wq waiter.Queue
+	eps, err := s.RestoreState(st, []*waiter.Queue{&wq})
+	if err != nil {
+		t.Fatalf("RestoreState failed: %v", err)
+	}
+
+	c.s = s
+	c.linkEP = linkEP
+	c.ep = eps[0]
+
+	// The received data can be read from the restored endpoint.
+	v, err := c.ep.Read(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Read: %v", err)
+	}
+
+	if bytes.Compare(rcvData, v) != 0 {
+		t.Fatalf("Data is different: expected %v, got %v", rcvData, v)
+	}
 
-		// Acknowledge the data.
-		c.sendPacket(nil, &headers{
-			srcPort: testPort,
-			dstPort: c.port,
-			flags:   header.TCPFlagAck,
-			seqNum:  790,
-			ackNum:  c.irs.Add(1 + seqnum.Size((i+1)*maxPayload)),
-			rcvWnd:  30000,
-		})
+	// The unacknowledged data is retransmitted.
+	b := c.getPacket()
+	checker.IPv4(c.t, b,
+		checker.PayloadLen(len(sndData)+header.TCPMinimumSize),
+		checker.TCP(
+			checker.DstPort(testPort),
+			checker.SeqNum(uint32(c.irs)+1),
+			checker.AckNum(uint32(790+len(rcvData))),
+			checker.TCPFlagsMatch(header.TCPFlagAck, ^uint8(header.TCPFlagPsh)),
+		),
+	)
+
+	if p := b[header.IPv4MinimumSize+header.TCPMinimumSize:]; bytes.Compare(sndData, p) != 0 {
+		t.Fatalf("Data is different: expected %v, got %v", sndData, p)
 	}
 }
 
-func TestCloseListener(t *testing.T) {
+func TestDetachConnected(t *testing.T) {
 	c := newTestContext(t, defaultMTU)
 	defer c.cleanup()
 
-	// Create listener.
-	var wq waiter.Queue
-	ep, err := c.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
-	if err != nil {
-		c.t.Fatalf("NewEndpoint failed: %v", err)
-	}
+	c.createConnected(789, 30000, nil)
 
-	if err := ep.Bind(tcpip.FullAddress{}, nil); err != nil {
-		c.t.Fatalf("Bind failed: %v", err)
+	// Send data that isn't acknowledged before the endpoint is detached.
+	view := buffer.NewView(3)
+	if _, err := c.ep.Write(view, nil); err != nil {
+		t.Fatalf("Unexpected error from Write: %v", err)
 	}
+	c.getPacket()
 
-	if err := ep.Listen(10); err != nil {
-		c.t.Fatalf("Listen failed: %v", err)
+	saved, err := c.s.(*stack.Stack).DetachEndpoint(c.ep)
+	if err != nil {
+		t.Fatalf("DetachEndpoint failed: %v", err)
+	}
+	if saved.Protocol != tcp.ProtocolNumber {
+		t.Errorf("got saved protocol %d, want %d", saved.Protocol, tcp.ProtocolNumber)
 	}
 
-	// Close the listener and measure how long it takes.
-	t0 := time.Now()
-	ep.Close()
-	if diff := time.Now().Sub(t0); diff > 3*time.Second {
-		c.t.Fatalf("Took too long to close: %v", diff)
+	// The detached endpoint neither retransmits its data nor notifies the
+	// peer that it's closed.
+	c.checkNoPacketTimeout("Packet sent after the endpoint was detached", 2*time.Second)
+
+	// Its port is released, so that it can be restored in the stack.
+	var wq waiter.Queue
+	if c.ep, err = c.s.(*stack.Stack).RestoreEndpoint(saved, &wq); err != nil {
+		t.Fatalf("RestoreEndpoint failed: %v", err)
 	}
+
+	// The restored endpoint retransmits the unacknowledged data.
+	checker.IPv4(c.t, c.getPacket(),
+		checker.PayloadLen(len(view)+header.TCPMinimumSize),
+		checker.TCP(
+			checker.DstPort(testPort),
+			checker.SeqNum(uint32(c.irs)+1),
+		),
+	)
 }
 
 func TestReceiveOnResetConnection(t *testing.T) {
@@ -986,6 +2418,111 @@ func TestSendOnResetConnection(t *testing.T) {
 	}
 }
 
+func TestLinkDownAbortsConnection(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createConnected(789, 30000, nil)
+
+	we, ch := waiter.NewChannelEntry(nil)
+	c.wq.EventRegister(&we, waiter.EventErr)
+	defer c.wq.EventUnregister(&we)
+
+	c.linkEP.SetLinkUp(false)
+
+	select {
+	case <-ch:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timed out waiting for the connection to be aborted")
+	}
+
+	if _, err := c.ep.Read(nil); err != tcpip.ErrLinkDown {
+		t.Errorf("Unexpected error from Read: want %v, got %v", tcpip.ErrLinkDown, err)
+	}
+	if _, err := c.ep.Write(buffer.NewView(10), nil); err != tcpip.ErrLinkDown {
+		t.Errorf("Unexpected error from Write: want %v, got %v", tcpip.ErrLinkDown, err)
+	}
+
+	// The peer can't be reached anymore, so no RST is sent.
+	c.checkNoPacketTimeout("Packet sent after the link went down", 100*time.Millisecond)
+}
+
+func TestReadinessOnResetConnection(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createConnected(789, 30000, nil)
+
+	if got := c.ep.Readiness(waiter.EventErr | waiter.EventHUp); got != 0 {
+		t.Fatalf("Unexpected readiness before reset: got %#x, want 0", got)
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	c.wq.EventRegister(&we, waiter.EventErr)
+	defer c.wq.EventUnregister(&we)
+
+	// Send RST segment.
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagRst,
+		seqNum:  790,
+		rcvWnd:  30000,
+	})
+
+	select {
+	case <-ch:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timed out waiting for reset to arrive")
+	}
+
+	want := waiter.EventIn | waiter.EventErr | waiter.EventHUp
+	if got := c.ep.Readiness(want); got != want {
+		t.Fatalf("Unexpected readiness after reset: got %#x, want %#x", got, want)
+	}
+}
+
+func TestReadinessOnHangUp(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createConnected(789, 30000, nil)
+
+	we, ch := waiter.NewChannelEntry(nil)
+	c.wq.EventRegister(&we, waiter.EventIn)
+	defer c.wq.EventUnregister(&we)
+
+	// Send FIN, the connection is only half closed.
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagAck | header.TCPFlagFin,
+		seqNum:  790,
+		ackNum:  c.irs.Add(1),
+		rcvWnd:  30000,
+	})
+
+	select {
+	case <-ch:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timed out waiting for FIN to arrive")
+	}
+
+	mask := waiter.EventIn | waiter.EventErr | waiter.EventHUp
+	if got := c.ep.Readiness(mask); got != waiter.EventIn {
+		t.Fatalf("Unexpected readiness after FIN: got %#x, want %#x", got, waiter.EventIn)
+	}
+
+	// Shutdown the send side as well, which hangs up the connection.
+	if err := c.ep.Shutdown(tcpip.ShutdownWrite); err != nil {
+		t.Fatalf("Unexpected error from Shutdown: %v", err)
+	}
+
+	if got, want := c.ep.Readiness(mask), waiter.EventIn|waiter.EventHUp; got != want {
+		t.Fatalf("Unexpected readiness after Shutdown: got %#x, want %#x", got, want)
+	}
+}
+
 func TestFinImmediately(t *testing.T) {
 	c := newTestContext(t, defaultMTU)
 	defer c.cleanup()
@@ -1186,6 +2723,81 @@ func TestFinWithPendingData(t *testing.T) {
 	)
 }
 
+func TestCloseTimeout(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	clock := faketime.NewManualClock(time.Unix(0, 0))
+	c.s.(*stack.Stack).SetClock(clock)
+	c.setEndpointDefaults(stack.EndpointDefaults{CloseTimeout: 500 * time.Millisecond})
+
+	c.createConnected(789, 30000, nil)
+
+	// Close the endpoint, and never acknowledge its FIN.
+	c.ep.Close()
+	checker.IPv4(c.t, c.getPacket(),
+		checker.TCP(
+			checker.DstPort(testPort),
+			checker.TCPFlags(header.TCPFlagAck|header.TCPFlagFin),
+		),
+	)
+
+	clock.Advance(500 * time.Millisecond)
+	checker.IPv4(c.t, c.getPacket(),
+		checker.TCP(
+			checker.DstPort(testPort),
+			checker.TCPFlags(header.TCPFlagAck|header.TCPFlagRst),
+		),
+	)
+}
+
+func TestFinWait2Timeout(t *testing.T) {
+	c := newTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	clock := faketime.NewManualClock(time.Unix(0, 0))
+	c.s.(*stack.Stack).SetClock(clock)
+	c.setEndpointDefaults(stack.EndpointDefaults{
+		CloseTimeout:    time.Second,
+		FinWait2Timeout: 10 * time.Second,
+	})
+
+	c.createConnected(789, 30000, nil)
+
+	// Close the endpoint, and acknowledge its FIN without sending ours.
+	c.ep.Close()
+	checker.IPv4(c.t, c.getPacket(),
+		checker.TCP(
+			checker.DstPort(testPort),
+			checker.SeqNum(uint32(c.irs)+1),
+			checker.TCPFlags(header.TCPFlagAck|header.TCPFlagFin),
+		),
+	)
+
+	c.sendPacket(nil, &headers{
+		srcPort: testPort,
+		dstPort: c.port,
+		flags:   header.TCPFlagAck,
+		seqNum:  790,
+		ackNum:  c.irs.Add(2),
+		rcvWnd:  30000,
+	})
+	c.checkNoPacketTimeout("Packet sent after the FIN was acknowledged", 50*time.Millisecond)
+
+	// The connection is in FIN_WAIT_2, so it outlives the close timeout
+	// until the FIN_WAIT_2 timeout expires.
+	clock.Advance(5 * time.Second)
+	c.checkNoPacketTimeout("Connection reset before the FIN_WAIT_2 timeout", 50*time.Millisecond)
+
+	clock.Advance(5 * time.Second)
+	checker.IPv4(c.t, c.getPacket(),
+		checker.TCP(
+			checker.DstPort(testPort),
+			checker.TCPFlags(header.TCPFlagAck|header.TCPFlagRst),
+		),
+	)
+}
+
 func TestExponentialIncreaseDuringSlowStart(t *testing.T) {
 	maxPayload := 10
 	c := newTestContext(t, uint32(header.TCPMinimumSize+header.IPv4MinimumSize+maxPayload))
@@ -1317,6 +2929,62 @@ func TestCongestionAvoidance(t *testing.T) {
 	}
 }
 
+func TestHyStartDelayIncrease(t *testing.T) {
+	maxPayload := 10
+	c := newTestContext(t, uint32(header.TCPMinimumSize+header.IPv4MinimumSize+maxPayload))
+	defer c.cleanup()
+
+	// The RTT is controlled by advancing the clock before acknowledging
+	// the packets of each round.
+	clock := faketime.NewManualClock(time.Unix(0, 0))
+	c.s.(*stack.Stack).SetClock(clock)
+
+	c.createConnected(789, 30000, nil)
+
+	data := buffer.NewView(100 * maxPayload)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	if _, err := c.ep.Write(data, nil); err != nil {
+		t.Fatalf("Unexpected error from Write: %v", err)
+	}
+
+	// Slow start with an RTT of 10ms until cwnd reaches 16 packets, then
+	// with an RTT of 30ms, which makes HyStart end slow start once the
+	// first samples of the round are taken: each ack then releases a
+	// single packet instead of two.
+	c.receiveAndCheckPacket(data, 0, maxPayload)
+	bytesRead := maxPayload
+	bytesAcked := 0
+	round := 1
+	for _, rtt := range []time.Duration{10, 10, 10, 10, 30} {
+		clock.Advance(rtt * time.Millisecond)
+
+		next := 0
+		for j := 0; j < round; j++ {
+			bytesAcked += maxPayload
+			c.sendAck(790, bytesAcked)
+
+			released := 2
+			if round >= 16 && j >= 8 {
+				released = 1
+			}
+			for k := 0; k < released; k++ {
+				c.receiveAndCheckPacket(data, bytesRead, maxPayload)
+				bytesRead += maxPayload
+			}
+			next += released
+		}
+		c.checkNoPacketTimeout("More packets received than expected for this cwnd.", 50*time.Millisecond)
+		round = next
+	}
+
+	if got := c.s.Stats().TCP.HyStartExits; got != 1 {
+		t.Fatalf("got HyStartExits = %d, want 1", got)
+	}
+}
+
 func TestFastRecovery(t *testing.T) {
 	maxPayload := 10
 	c := newTestContext(t, uint32(header.TCPMinimumSize+header.IPv4MinimumSize+maxPayload))
@@ -1417,6 +3085,89 @@ func TestFastRecovery(t *testing.T) {
 	}
 }
 
+func TestMTUDecreaseSegmentSize(t *testing.T) {
+	const (
+		mtu    = 1500
+		newMTU = 1000
+	)
+	c := newTestContext(t, mtu)
+	defer c.cleanup()
+
+	c.createConnected(789, 30000, nil)
+
+	maxPayload := mtu - header.IPv4MinimumSize - header.TCPMinimumSize
+	newMaxPayload := newMTU - header.IPv4MinimumSize - header.TCPMinimumSize
+	data := buffer.NewView(newMaxPayload + maxPayload + 10)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	if err := c.s.(*stack.Stack).SetNICMTU(1, newMTU); err != nil {
+		t.Fatalf("SetNICMTU failed: %v", err)
+	}
+
+	// Give the protocol goroutine time to handle the change.
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := c.ep.Write(data[:newMaxPayload+10], nil); err != nil {
+		t.Fatalf("Unexpected error from Write: %v", err)
+	}
+	c.receiveAndCheckPacket(data, 0, newMaxPayload)
+	c.sendAck(790, newMaxPayload)
+	c.receiveAndCheckPacket(data, newMaxPayload, 10)
+	c.sendAck(790, newMaxPayload+10)
+
+	// Restoring the MTU of the link endpoint makes segments grow again.
+	if err := c.s.(*stack.Stack).SetNICMTU(1, 0); err != nil {
+		t.Fatalf("SetNICMTU failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := c.ep.Write(data[newMaxPayload+10:], nil); err != nil {
+		t.Fatalf("Unexpected error from Write: %v", err)
+	}
+	c.receiveAndCheckPacket(data, newMaxPayload+10, maxPayload)
+}
+
+func TestMTUDecreaseSplitsOutstandingSegments(t *testing.T) {
+	const (
+		mtu    = 1500
+		newMTU = 1000
+	)
+	c := newTestContext(t, mtu)
+	defer c.cleanup()
+
+	c.createConnected(789, 30000, nil)
+
+	maxPayload := mtu - header.IPv4MinimumSize - header.TCPMinimumSize
+	newMaxPayload := newMTU - header.IPv4MinimumSize - header.TCPMinimumSize
+	data := buffer.NewView(maxPayload + 540)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	if _, err := c.ep.Write(data, nil); err != nil {
+		t.Fatalf("Unexpected error from Write: %v", err)
+	}
+
+	// Only one segment fits in the initial congestion window.
+	c.receiveAndCheckPacket(data, 0, maxPayload)
+
+	if err := c.s.(*stack.Stack).SetNICMTU(1, newMTU); err != nil {
+		t.Fatalf("SetNICMTU failed: %v", err)
+	}
+
+	// The outstanding segment no longer fits, so it is split, and the
+	// first part is retransmitted when the retransmit timer fires.
+	c.receiveAndCheckPacket(data, 0, newMaxPayload)
+
+	// The rest of it, and the segment that wasn't sent yet, follow once the
+	// first part is acknowledged.
+	c.sendAck(790, newMaxPayload)
+	c.receiveAndCheckPacket(data, newMaxPayload, maxPayload-newMaxPayload)
+	c.receiveAndCheckPacket(data, maxPayload, len(data)-maxPayload)
+}
+
 func TestRetransmit(t *testing.T) {
 	maxPayload := 10
 	c := newTestContext(t, uint32(header.TCPMinimumSize+header.IPv4MinimumSize+maxPayload))
@@ -1467,6 +3218,10 @@ func TestRetransmit(t *testing.T) {
 	rtxOffset := bytesRead - maxPayload*expected
 	c.receiveAndCheckPacket(data, rtxOffset, maxPayload)
 
+	if got := c.s.Stats().TCP.Retransmits; got != 1 {
+		t.Errorf("Retransmits = %v, want %v", got, 1)
+	}
+
 	// Acknowledge half of the pending data.
 	rtxOffset = bytesRead - expected*maxPayload/2
 	c.sendAck(790, rtxOffset)
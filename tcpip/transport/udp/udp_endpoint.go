@@ -8,18 +8,28 @@ import (
 	"errors"
 	"io"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/ports"
 	"github.com/google/netstack/tcpip/stack"
 	"github.com/google/netstack/waiter"
 )
 
 type udpPacket struct {
-	udpPacketEntry
 	senderAddress tcpip.FullAddress
-	view          buffer.View
+
+	// ttl and tos are the TTL, or hop limit, and the type of service, or
+	// traffic class, of the packet, or zero if they are unknown.
+	ttl uint8
+	tos uint8
+
+	// data is the payload of the packet, whose bytes may be shared with
+	// other endpoints the packet was delivered to.
+	data buffer.VectorisedView
 }
 
 type endpointState int
@@ -29,8 +39,26 @@ const (
 	stateBound
 	stateConnected
 	stateClosed
+	stateError
 )
 
+// String implements fmt.Stringer.String.
+func (s endpointState) String() string {
+	switch s {
+	case stateInitial:
+		return "initial"
+	case stateBound:
+		return "bound"
+	case stateConnected:
+		return "connected"
+	case stateClosed:
+		return "closed"
+	case stateError:
+		return "error"
+	}
+	return "unknown"
+}
+
 var errRetryPrepare = errors.New("prepare operation must be retried")
 
 // endpoint represents a UDP endpoint. This struct serves as the interface
@@ -48,11 +76,20 @@ type endpoint struct {
 	// protected by rcvMu.
 	rcvMu         sync.Mutex
 	rcvReady      bool
-	rcvList       udpPacketList
+	rcvList       udpPacketRing
 	rcvBufSizeMax int
 	rcvBufSize    int
 	rcvClosed     bool
 
+	// rcvErr is the error returned by reads once the queued datagrams are
+	// read, after the endpoint has been aborted.
+	rcvErr error
+
+	// rcvTTL and rcvTOS are set with tcpip.ReceiveTTLOption and
+	// tcpip.ReceiveTOSOption.
+	rcvTTL bool
+	rcvTOS bool
+
 	// The following fields are protected by the mu mutex.
 	mu         sync.RWMutex
 	sndBufSize int
@@ -63,16 +100,48 @@ type endpoint struct {
 	regNICID   tcpip.NICID
 	route      stack.Route
 	dstPort    uint16
+	reuseAddr  bool
+
+	// ttl, multicastTTL, tos and multicastLoop are set with
+	// tcpip.TTLOption, tcpip.MulticastTTLOption, tcpip.TOSOption and
+	// tcpip.MulticastLoopOption. They are also set in route, by
+	// setRouteOptions.
+	ttl           uint8
+	multicastTTL  uint8
+	tos           uint8
+	multicastLoop bool
+
+	// multicastNICID and multicastAddr are set with
+	// tcpip.MulticastInterfaceOption.
+	multicastNICID tcpip.NICID
+	multicastAddr  tcpip.Address
+
+	// owner is the owner the endpoint is attributed to, or nil. It can
+	// only be changed in the initial state.
+	owner *stack.Owner
+
+	// isPortReserved is set when the local port is reserved with the
+	// stack's port manager, for reservedAddr.
+	isPortReserved bool
+	reservedAddr   tcpip.Address
+
+	// rcvDeadline and sndDeadline are the deadlines set with
+	// tcpip.ReceiveDeadlineOption and tcpip.SendDeadlineOption.
+	rcvDeadline stack.Deadline
+	sndDeadline stack.Deadline
 }
 
 func newEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) *endpoint {
 	// TODO: Use the send buffer size initialized here.
+	d := endpointDefaults(stack)
 	return &endpoint{
 		stack:         stack,
 		netProto:      netProto,
 		waiterQueue:   waiterQueue,
-		rcvBufSizeMax: 32 * 1024,
-		sndBufSize:    32 * 1024,
+		rcvBufSizeMax: d.ReceiveBufferSize.Default,
+		sndBufSize:    d.SendBufferSize.Default,
+		reuseAddr:     d.ReuseAddress,
+		multicastLoop: true,
 	}
 }
 
@@ -89,11 +158,16 @@ func NewConnectedEndpoint(stack *stack.Stack, r *stack.Route, id stack.Transport
 
 	ep.id = id
 	ep.route = r.Clone()
+	ep.setRouteOptions(&ep.route)
 	ep.dstPort = id.RemotePort
 	ep.regNICID = r.NICID()
 
 	ep.state = stateConnected
 
+	ep.rcvMu.Lock()
+	ep.rcvReady = true
+	ep.rcvMu.Unlock()
+
 	return ep, nil
 }
 
@@ -108,18 +182,27 @@ func (e *endpoint) Close() {
 		e.stack.UnregisterTransportEndpoint(e.regNICID, ProtocolNumber, e.id)
 	}
 
+	if e.isPortReserved {
+		e.stack.ReleasePort(e.netProto, ProtocolNumber, e.reservedAddr, e.id.LocalPort)
+		e.isPortReserved = false
+	}
+
 	// Close the receive list and drain it.
 	e.rcvMu.Lock()
 	e.rcvClosed = true
+	e.stack.ReleaseMemoryFor(e.owner, e.rcvBufSize)
 	e.rcvBufSize = 0
 	for !e.rcvList.Empty() {
-		p := e.rcvList.Front()
-		e.rcvList.Remove(p)
+		p := e.rcvList.PopFront()
+		p.data.Release()
 	}
 	e.rcvMu.Unlock()
 
 	e.route.Release()
 
+	e.rcvDeadline.Stop()
+	e.sndDeadline.Stop()
+
 	// Update the state.
 	e.state = stateClosed
 }
@@ -127,20 +210,48 @@ func (e *endpoint) Close() {
 // Read reads data from the endpoint. This method does not block if
 // there is no data pending.
 func (e *endpoint) Read(addr *tcpip.FullAddress) (buffer.View, error) {
+	v, _, err := e.read(addr)
+	return v, err
+}
+
+// read implements Read and RecvMsg. It also returns the control messages
+// requested with options, if any.
+func (e *endpoint) read(addr *tcpip.FullAddress) (buffer.View, tcpip.ControlMessages, error) {
+	if e.rcvDeadline.Expired() {
+		return buffer.View{}, nil, tcpip.ErrTimeout
+	}
+
 	e.rcvMu.Lock()
 
 	if e.rcvList.Empty() {
 		err := tcpip.ErrWouldBlock
-		if e.rcvClosed {
+		switch {
+		case e.rcvErr != nil:
+			err = e.rcvErr
+		case e.rcvClosed:
 			err = tcpip.ErrClosedForReceive
 		}
 		e.rcvMu.Unlock()
-		return buffer.View{}, err
+		return buffer.View{}, nil, err
 	}
 
-	p := e.rcvList.Front()
-	e.rcvList.Remove(p)
-	e.rcvBufSize -= len(p.view)
+	p := e.rcvList.PopFront()
+	e.rcvBufSize -= p.data.Size()
+	e.stack.ReleaseMemoryFor(e.owner, p.data.Size())
+
+	var cm tcpip.ControlMessages
+	if e.rcvTTL || e.rcvTOS {
+		ipcm := &tcpip.IPControlMessages{}
+		if e.rcvTTL {
+			ipcm.HasTTL = true
+			ipcm.TTL = p.ttl
+		}
+		if e.rcvTOS {
+			ipcm.HasTOS = true
+			ipcm.TOS = p.tos
+		}
+		cm = ipcm
+	}
 
 	e.rcvMu.Unlock()
 
@@ -148,31 +259,36 @@ func (e *endpoint) Read(addr *tcpip.FullAddress) (buffer.View, error) {
 		*addr = p.senderAddress
 	}
 
-	return p.view, nil
+	return p.data.ToOwnedView(), cm, nil
 }
 
-// RecvMsg implements tcpip.RecvMsg.
+// RecvMsg implements tcpip.RecvMsg. The control messages it returns, if any,
+// are IPControlMessages.
 func (e *endpoint) RecvMsg(addr *tcpip.FullAddress) (buffer.View, tcpip.ControlMessages, error) {
-	v, err := e.Read(addr)
-	return v, nil, err
+	return e.read(addr)
 }
 
 // prepareForWrite prepares the endpoint for sending data. In particular, it
-// binds it if it's still in the initial state. To do so, it must first
-// reacquire the mutex in exclusive mode.
+// binds it if it's still in the initial state, and finds the route of connected
+// endpoints again if it's stale. To do so, it must first reacquire the mutex in
+// exclusive mode.
 //
 // Returns errRetryPrepare if preparation should be retried.
 func (e *endpoint) prepareForWrite(to *tcpip.FullAddress) error {
 	switch e.state {
 	case stateInitial:
 	case stateConnected:
-		return nil
+		if to != nil || !e.route.Stale() {
+			return nil
+		}
 
 	case stateBound:
 		if to == nil {
 			return tcpip.ErrDestinationRequired
 		}
 		return nil
+	case stateError:
+		return tcpip.ErrConnectionAborted
 	default:
 		return tcpip.ErrInvalidEndpointState
 	}
@@ -183,6 +299,14 @@ func (e *endpoint) prepareForWrite(to *tcpip.FullAddress) error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
+	if e.state == stateConnected {
+		// The route of the connected endpoint is stale.
+		if err := e.refreshRouteLocked(); err != nil {
+			return err
+		}
+		return errRetryPrepare
+	}
+
 	// The state changed when we released the shared locked and re-acquired
 	// it in exclusive mode. Try again.
 	if e.state != stateInitial {
@@ -200,6 +324,17 @@ func (e *endpoint) prepareForWrite(to *tcpip.FullAddress) error {
 // Write writes data to the endpoint's peer. This method does not block
 // if the data cannot be written.
 func (e *endpoint) Write(v buffer.View, to *tcpip.FullAddress) (uintptr, error) {
+	return e.write(v, nil, to)
+}
+
+// write writes data to the endpoint's peer, or to the given address. The TTL
+// and type of service set in cm, if any, override the ones of the endpoint for
+// this datagram.
+func (e *endpoint) write(v buffer.View, cm *tcpip.IPControlMessages, to *tcpip.FullAddress) (uintptr, error) {
+	if e.sndDeadline.Expired() {
+		return 0, tcpip.ErrTimeout
+	}
+
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 
@@ -230,28 +365,51 @@ func (e *endpoint) Write(v buffer.View, to *tcpip.FullAddress) (uintptr, error)
 		}
 
 		// Find the enpoint.
-		r, err := e.stack.FindRoute(nicid, e.bindAddr, to.Addr, e.netProto)
+		nicid, localAddr := e.sendInterface(nicid, to.Addr)
+		r, err := e.stack.FindRoute(nicid, localAddr, to.Addr, e.netProto)
 		if err != nil {
 			return 0, err
 		}
 		defer r.Release()
 
+		e.setRouteOptions(&r)
 		route = &r
 		dstPort = to.Port
 	}
 
-	sendUDP(route, v, e.id.LocalPort, dstPort)
+	if cm != nil && (cm.HasTTL || cm.HasTOS) {
+		// Don't modify the route of the endpoint.
+		r := *route
+		if cm.HasTTL {
+			r.TTL = cm.TTL
+		}
+		if cm.HasTOS {
+			r.TOS = cm.TOS
+		}
+		route = &r
+	}
+
+	if err := sendUDP(route, v, e.id.LocalPort, dstPort); err != nil {
+		return 0, err
+	}
+	e.owner.CountSent(header.UDPMinimumSize + len(v))
 	return uintptr(len(v)), nil
 }
 
-// SendMsg implements tcpip.SendMsg.
+// SendMsg implements tcpip.SendMsg. The only control messages accepted are
+// IPControlMessages, which set the TTL, or hop limit, and the type of service,
+// or traffic class, of the datagram, like IP_TTL and IP_TOS control messages do.
 func (e *endpoint) SendMsg(v buffer.View, c tcpip.ControlMessages, to *tcpip.FullAddress) (uintptr, error) {
-	// Reject control messages.
+	var cm *tcpip.IPControlMessages
 	if c != nil {
-		// tcpip.ErrInvalidEndpointState turns into syscall.EINVAL.
-		return 0, tcpip.ErrInvalidEndpointState
+		var ok bool
+		if cm, ok = c.(*tcpip.IPControlMessages); !ok {
+			// tcpip.ErrInvalidEndpointState turns into
+			// syscall.EINVAL.
+			return 0, tcpip.ErrInvalidEndpointState
+		}
 	}
-	return e.Write(v, to)
+	return e.write(v, cm, to)
 }
 
 // Peek only returns data from a single datagram, so do nothing here.
@@ -259,9 +417,109 @@ func (e *endpoint) Peek(io.Writer) (uintptr, error) {
 	return 0, nil
 }
 
-// SetSockOpt sets a socket option. Currently not supported.
-func (*endpoint) SetSockOpt(interface{}) error {
-	// TODO: Actually implement this.
+// SetSockOpt sets a socket option. Only tcpip.ReuseAddressOption,
+// tcpip.OwnerOption, the TTL, TOS, multicast and IPv6 options, and the buffer size
+// and deadline options are currently supported; other options are ignored.
+func (e *endpoint) SetSockOpt(opt interface{}) error {
+	// TODO: Actually implement the other options.
+	switch v := opt.(type) {
+	case tcpip.ReuseAddressOption:
+		e.mu.Lock()
+		e.reuseAddr = v != 0
+		e.mu.Unlock()
+
+	case tcpip.SendBufferSizeOption:
+		size := endpointDefaults(e.stack).SendBufferSize.Clamp(int(v))
+		e.mu.Lock()
+		e.sndBufSize = size
+		e.mu.Unlock()
+
+	case tcpip.TTLOption:
+		e.mu.Lock()
+		e.ttl = uint8(v)
+		e.setRouteOptions(&e.route)
+		e.mu.Unlock()
+
+	case tcpip.MulticastTTLOption:
+		e.mu.Lock()
+		e.multicastTTL = uint8(v)
+		e.setRouteOptions(&e.route)
+		e.mu.Unlock()
+
+	case tcpip.TOSOption:
+		e.mu.Lock()
+		e.tos = uint8(v)
+		e.setRouteOptions(&e.route)
+		e.mu.Unlock()
+
+	case tcpip.ReceiveTTLOption:
+		e.rcvMu.Lock()
+		e.rcvTTL = v != 0
+		e.rcvMu.Unlock()
+
+	case tcpip.ReceiveTOSOption:
+		e.rcvMu.Lock()
+		e.rcvTOS = v != 0
+		e.rcvMu.Unlock()
+
+	case tcpip.V6OnlyOption:
+		if e.netProto != header.IPv6ProtocolNumber {
+			return tcpip.ErrUnknownProtocolOption
+		}
+		if v == 0 {
+			return tcpip.ErrNotSupported
+		}
+
+	case tcpip.MulticastLoopOption:
+		e.mu.Lock()
+		e.multicastLoop = v != 0
+		e.setRouteOptions(&e.route)
+		e.mu.Unlock()
+
+	case tcpip.MulticastInterfaceOption:
+		nicid := v.NIC
+		if v.InterfaceAddr != "" {
+			nicid = e.stack.CheckLocalAddress(v.NIC, v.InterfaceAddr)
+			if nicid == 0 {
+				return tcpip.ErrBadLocalAddress
+			}
+		}
+
+		e.mu.Lock()
+		e.multicastNICID = nicid
+		e.multicastAddr = v.InterfaceAddr
+		e.mu.Unlock()
+
+	case tcpip.ReceiveBufferSizeOption:
+		size := endpointDefaults(e.stack).ReceiveBufferSize.Clamp(int(v))
+		e.rcvMu.Lock()
+		e.rcvBufSizeMax = size
+		e.rcvMu.Unlock()
+
+	case tcpip.OwnerOption:
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		if e.state != stateInitial {
+			return tcpip.ErrInvalidEndpointState
+		}
+
+		e.owner = nil
+		if v != "" {
+			e.owner = e.stack.Owner(string(v))
+		}
+
+	case tcpip.ReceiveDeadlineOption:
+		e.rcvDeadline.Set(e.stack.Clock(), time.Time(v), func() {
+			e.waiterQueue.Notify(waiter.EventIn)
+		})
+
+	case tcpip.SendDeadlineOption:
+		e.sndDeadline.Set(e.stack.Clock(), time.Time(v), func() {
+			e.waiterQueue.Notify(waiter.EventOut)
+		})
+	}
+
 	return nil
 }
 
@@ -282,6 +540,98 @@ func (e *endpoint) GetSockOpt(opt interface{}) error {
 		*o = tcpip.ReceiveBufferSizeOption(e.rcvBufSizeMax)
 		e.rcvMu.Unlock()
 		return nil
+
+	case *tcpip.ReuseAddressOption:
+		e.mu.RLock()
+		v := e.reuseAddr
+		e.mu.RUnlock()
+
+		*o = 0
+		if v {
+			*o = 1
+		}
+		return nil
+
+	case *tcpip.OwnerOption:
+		e.mu.RLock()
+		*o = tcpip.OwnerOption(e.owner.Name())
+		e.mu.RUnlock()
+		return nil
+
+	case *tcpip.TTLOption:
+		e.mu.RLock()
+		*o = tcpip.TTLOption(e.ttl)
+		e.mu.RUnlock()
+		return nil
+
+	case *tcpip.MulticastTTLOption:
+		e.mu.RLock()
+		*o = tcpip.MulticastTTLOption(e.multicastTTL)
+		e.mu.RUnlock()
+		return nil
+
+	case *tcpip.TOSOption:
+		e.mu.RLock()
+		*o = tcpip.TOSOption(e.tos)
+		e.mu.RUnlock()
+		return nil
+
+	case *tcpip.ReceiveTTLOption:
+		e.rcvMu.Lock()
+		v := e.rcvTTL
+		e.rcvMu.Unlock()
+
+		*o = 0
+		if v {
+			*o = 1
+		}
+		return nil
+
+	case *tcpip.ReceiveTOSOption:
+		e.rcvMu.Lock()
+		v := e.rcvTOS
+		e.rcvMu.Unlock()
+
+		*o = 0
+		if v {
+			*o = 1
+		}
+		return nil
+
+	case *tcpip.V6OnlyOption:
+		if e.netProto != header.IPv6ProtocolNumber {
+			return tcpip.ErrUnknownProtocolOption
+		}
+		*o = 1
+		return nil
+
+	case *tcpip.MulticastInterfaceOption:
+		e.mu.RLock()
+		*o = tcpip.MulticastInterfaceOption{
+			NIC:           e.multicastNICID,
+			InterfaceAddr: e.multicastAddr,
+		}
+		e.mu.RUnlock()
+		return nil
+
+	case *tcpip.MulticastLoopOption:
+		e.mu.RLock()
+		v := e.multicastLoop
+		e.mu.RUnlock()
+
+		*o = 0
+		if v {
+			*o = 1
+		}
+		return nil
+
+	case *tcpip.ReceiveDeadlineOption:
+		*o = tcpip.ReceiveDeadlineOption(e.rcvDeadline.Get())
+		return nil
+
+	case *tcpip.SendDeadlineOption:
+		*o = tcpip.SendDeadlineOption(e.sndDeadline.Get())
+		return nil
 	}
 
 	return tcpip.ErrInvalidEndpointState
@@ -291,27 +641,83 @@ func (e *endpoint) GetSockOpt(opt interface{}) error {
 // provided identity.
 func sendUDP(r *stack.Route, data buffer.View, localPort, remotePort uint16) error {
 	// Allocate a buffer for the UDP header.
-	hdr := buffer.NewPrependable(header.UDPMinimumSize + int(r.MaxHeaderLength()))
+	hdr := buffer.NewPooledPrependable(header.UDPMinimumSize + int(r.MaxHeaderLength()))
 
 	// Initialize the header.
 	udp := header.UDP(hdr.Prepend(header.UDPMinimumSize))
 
-	length := uint16(hdr.UsedLength())
-	xsum := r.PseudoHeaderChecksum(ProtocolNumber)
-	if data != nil {
-		length += uint16(len(data))
-		xsum = header.Checksum(data, xsum)
-	}
-
+	length := uint16(hdr.UsedLength()) + uint16(len(data))
 	udp.Encode(&header.UDPFields{
 		SrcPort: localPort,
 		DstPort: remotePort,
 		Length:  length,
 	})
 
-	udp.SetChecksum(^udp.CalculateChecksum(xsum, length))
+	// Only calculate the checksum if the link endpoint needs it.
+	if r.Capabilities()&stack.CapabilityTXChecksumOffload == 0 {
+		xsum := r.PseudoHeaderChecksum(ProtocolNumber)
+		if data != nil {
+			xsum = header.Checksum(data, xsum)
+		}
+
+		udp.SetChecksum(^udp.CalculateChecksum(xsum, length))
+	}
+
+	err := r.WritePacket(&hdr, data.ToVectorisedView(), ProtocolNumber)
+	hdr.Release()
+	if err != nil {
+		return err
+	}
+
+	atomic.AddUint64(&r.Stats().UDP.PacketsSent, 1)
+	return nil
+}
+
+// refreshRouteLocked finds the route of the connected endpoint again, after the
+// route table, the addresses or the NICs of the stack changed. The local address
+// is kept, as the endpoint is registered with it. It must be called with e.mu
+// held exclusively.
+func (e *endpoint) refreshRouteLocked() error {
+	if !e.route.Stale() {
+		return nil
+	}
+
+	nicid, _ := e.sendInterface(e.regNICID, e.id.RemoteAddress)
+	r, err := e.stack.FindRoute(nicid, e.id.LocalAddress, e.id.RemoteAddress, e.netProto)
+	if err != nil {
+		return err
+	}
 
-	return r.WritePacket(&hdr, data, ProtocolNumber)
+	e.route.Release()
+	e.route = r
+	e.setRouteOptions(&e.route)
+	return nil
+}
+
+// setRouteOptions sets the fields of r that implement the options of the
+// endpoint. It must be called with e.mu held.
+func (e *endpoint) setRouteOptions(r *stack.Route) {
+	r.TTL = e.ttl
+	r.MulticastTTL = e.multicastTTL
+	r.TOS = e.tos
+	r.MulticastLoop = e.multicastLoop
+}
+
+// sendInterface returns the NIC, or zero, and the local address, or the empty
+// address, from which the endpoint sends packets to addr through the given NIC,
+// which is zero unless one was specified or the endpoint is bound to one: the
+// ones set with tcpip.MulticastInterfaceOption if addr is a multicast address
+// and no NIC was, and nicid and the address the endpoint is bound to otherwise.
+// It must be called with e.mu held.
+func (e *endpoint) sendInterface(nicid tcpip.NICID, addr tcpip.Address) (tcpip.NICID, tcpip.Address) {
+	localAddr := e.bindAddr
+	if nicid == 0 && (header.IsV4MulticastAddress(addr) || header.IsV6MulticastAddress(addr)) {
+		nicid = e.multicastNICID
+		if localAddr == "" {
+			localAddr = e.multicastAddr
+		}
+	}
+	return nicid, localAddr
 }
 
 // Connect connects the endpoint to its peer. Specifying a NIC is optional.
@@ -344,7 +750,8 @@ func (e *endpoint) Connect(addr tcpip.FullAddress) error {
 	}
 
 	// Find a route to the desired destination.
-	r, err := e.stack.FindRoute(nicid, e.bindAddr, addr.Addr, e.netProto)
+	routeNICID, localAddr := e.sendInterface(nicid, addr.Addr)
+	r, err := e.stack.FindRoute(routeNICID, localAddr, addr.Addr, e.netProto)
 	if err != nil {
 		return err
 	}
@@ -368,7 +775,9 @@ func (e *endpoint) Connect(addr tcpip.FullAddress) error {
 	}
 
 	e.id = id
+	e.route.Release()
 	e.route = r.Clone()
+	e.setRouteOptions(&e.route)
 	e.dstPort = addr.Port
 	e.regNICID = nicid
 
@@ -428,11 +837,12 @@ func (e *endpoint) registerWithStack(nicid tcpip.NICID, id stack.TransportEndpoi
 		return id, err
 	}
 
-	// We need to find a port for the endpoint.
-	_, err := e.stack.PickEphemeralPort(func(p uint16) (bool, error) {
+	// We need to find a port for the endpoint. Connected endpoints pick it
+	// based on their destination. The port is reserved for the local
+	// address so that it can't be bound to by other endpoints while in use.
+	_, err := e.stack.ReserveEphemeralPort(e.netProto, ProtocolNumber, id.LocalAddress, e.portFlags(), id.RemoteAddress, id.RemotePort, func(p uint16) (bool, error) {
 		id.LocalPort = p
-		err := e.stack.RegisterTransportEndpoint(nicid, ProtocolNumber, id, e)
-		switch err {
+		switch err := e.stack.RegisterTransportEndpoint(nicid, ProtocolNumber, id, e); err {
 		case nil:
 			return true, nil
 		case tcpip.ErrDuplicateAddress:
@@ -441,6 +851,10 @@ func (e *endpoint) registerWithStack(nicid tcpip.NICID, id stack.TransportEndpoi
 			return false, err
 		}
 	})
+	if err == nil {
+		e.isPortReserved = true
+		e.reservedAddr = id.LocalAddress
+	}
 
 	return id, err
 }
@@ -459,18 +873,31 @@ func (e *endpoint) bindLocked(addr tcpip.FullAddress, commit func() error) error
 		}
 	}
 
+	// Reserve the requested port; ephemeral ports are reserved while
+	// registering.
+	if addr.Port != 0 {
+		if _, err := e.stack.ReservePort(e.netProto, ProtocolNumber, addr.Addr, addr.Port, e.portFlags()); err != nil {
+			return err
+		}
+
+		e.isPortReserved = true
+		e.reservedAddr = addr.Addr
+	}
+
 	id := stack.TransportEndpointID{
 		LocalPort:    addr.Port,
 		LocalAddress: addr.Addr,
 	}
 	id, err := e.registerWithStack(addr.NIC, id)
 	if err != nil {
+		e.releasePortLocked(addr.Port)
 		return err
 	}
 	if commit != nil {
 		if err := commit(); err != nil {
 			// Unregister, the commit failed.
 			e.stack.UnregisterTransportEndpoint(addr.NIC, ProtocolNumber, id)
+			e.releasePortLocked(id.LocalPort)
 			return err
 		}
 	}
@@ -488,6 +915,22 @@ func (e *endpoint) bindLocked(addr tcpip.FullAddress, commit func() error) error
 	return nil
 }
 
+// portFlags returns the flags the endpoint reserves its port with. It must be
+// called with e.mu held.
+func (e *endpoint) portFlags() ports.Flags {
+	return ports.Flags{ReuseAddr: e.reuseAddr}
+}
+
+// releasePortLocked releases the reservation of the given port, if any. It must
+// be called with e.mu held.
+func (e *endpoint) releasePortLocked(port uint16) {
+	if e.isPortReserved {
+		e.stack.ReleasePort(e.netProto, ProtocolNumber, e.reservedAddr, port)
+		e.isPortReserved = false
+		e.reservedAddr = ""
+	}
+}
+
 // Bind binds the endpoint to a specific local address and port.
 // Specifying a NIC is optional.
 func (e *endpoint) Bind(addr tcpip.FullAddress, commit func() error) error {
@@ -533,6 +976,32 @@ func (e *endpoint) GetRemoteAddress() (tcpip.FullAddress, error) {
 	}, nil
 }
 
+// Owner implements stack.OwnedEndpoint.Owner. The owner can't change once the
+// endpoint leaves the initial state, so it's read without locking, as packets
+// may be traced while e.mu is held.
+func (e *endpoint) Owner() *stack.Owner {
+	return e.owner
+}
+
+// Inspect implements stack.InspectableEndpoint.Inspect. Datagrams are sent right
+// away, so nothing is ever queued for sending.
+func (e *endpoint) Inspect() stack.TransportEndpointState {
+	e.mu.RLock()
+	state := e.state
+	owner := e.owner.Name()
+	e.mu.RUnlock()
+
+	e.rcvMu.Lock()
+	queued := e.rcvBufSize
+	e.rcvMu.Unlock()
+
+	return stack.TransportEndpointState{
+		State:     state.String(),
+		Owner:     owner,
+		RcvQueued: queued,
+	}
+}
+
 // Readiness returns the current readiness of the endpoint. For example, if
 // waiter.EventIn is set, the endpoint is immediately readable.
 func (e *endpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
@@ -548,46 +1017,169 @@ func (e *endpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
 		e.rcvMu.Unlock()
 	}
 
+	// The endpoint is hung up once it's closed, and in error once it's
+	// aborted. Other errors aren't queued for the endpoint.
+	if (mask & (waiter.EventHUp | waiter.EventErr)) != 0 {
+		e.mu.RLock()
+		switch e.state {
+		case stateClosed:
+			result |= waiter.EventHUp & mask
+		case stateError:
+			result |= waiter.EventErr & mask
+		}
+		e.mu.RUnlock()
+	}
+
 	return result
 }
 
+// receivedFields returns the TTL, or hop limit, and the type of service, or
+// traffic class, of the packet received through r, or zeros if its network
+// header is unknown.
+func receivedFields(r *stack.Route) (ttl, tos uint8) {
+	switch h := r.NetworkHeader; {
+	case r.NetProto == header.IPv4ProtocolNumber && len(h) >= header.IPv4MinimumSize:
+		ip := header.IPv4(h)
+		tos, _ = ip.TOS()
+		return ip.TTL(), tos
+	case r.NetProto == header.IPv6ProtocolNumber && len(h) >= header.IPv6MinimumSize:
+		ip := header.IPv6(h)
+		tos, _ = ip.TOS()
+		return ip.HopLimit(), tos
+	}
+	return 0, 0
+}
+
 // HandlePacket is called by the stack when new packets arrive to this transport
 // endpoint.
-func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, v buffer.View) {
+func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, vv buffer.VectorisedView) {
 	// Get the header then trim it from the view.
+	v := vv.ToView()
 	hdr := header.UDP(v)
 	if int(hdr.Length()) > len(v) {
 		// Malformed packet.
+		atomic.AddUint64(&r.Stats().UDP.MalformedPacketsReceived, 1)
+		vv.Release()
 		return
 	}
 
-	v.TrimFront(header.UDPMinimumSize)
+	// Verify the checksum unless the link endpoint already did. A zero
+	// checksum means the sender didn't compute one.
+	if hdr.Checksum() != 0 && r.Capabilities()&stack.CapabilityRXChecksumOffload == 0 {
+		xsum := r.PseudoHeaderChecksum(ProtocolNumber)
+		xsum = header.ChecksumCombine(xsum, hdr.Length())
+		if header.Checksum(v[:hdr.Length()], xsum) != 0xffff {
+			atomic.AddUint64(&r.Stats().UDP.ChecksumErrors, 1)
+			vv.Release()
+			return
+		}
+	}
+
+	e.owner.CountReceived(len(v))
+	vv.TrimFront(header.UDPMinimumSize)
+	size := vv.Size()
 
 	e.rcvMu.Lock()
 
-	// Drop the packet if our buffer is currently full.
-	if !e.rcvReady || e.rcvClosed || e.rcvBufSize >= e.rcvBufSizeMax {
+	// Drop the packet if our buffer or queue is currently full, or if the
+	// stack is out of memory for receive queues.
+	overflow := e.rcvList.Full()
+	if !e.rcvReady || e.rcvClosed || e.rcvBufSize >= e.rcvBufSizeMax || overflow || !e.stack.ReserveMemoryFor(e.owner, size) {
 		e.rcvMu.Unlock()
+		vv.Release()
+		atomic.AddUint64(&r.Stats().UDP.ReceiveBufferErrors, 1)
+		if overflow {
+			atomic.AddUint64(&r.Stats().UDP.ReceiveQueueOverflows, 1)
+		}
+		if e.stack.LogEnabled(stack.LogDebug) {
+			e.stack.Log(stack.LogDebug, "udp receive buffer full, dropping datagram", "local_addr", id.LocalAddress, "local_port", id.LocalPort, "remote_addr", id.RemoteAddress, "remote_port", id.RemotePort)
+		}
 		return
 	}
 
-	wasEmpty := e.rcvBufSize == 0
+	wasEmpty := e.rcvList.Empty()
 
 	// Push new packet into receive list and increment the buffer size.
-	e.rcvList.PushBack(&udpPacket{
-		view: v,
+	ttl, tos := receivedFields(r)
+	e.rcvList.PushBack(udpPacket{
+		data: vv,
 		senderAddress: tcpip.FullAddress{
 			NIC:  r.NICID(),
 			Addr: id.RemoteAddress,
 			Port: hdr.SourcePort(),
 		},
+		ttl: ttl,
+		tos: tos,
 	})
-	e.rcvBufSize += len(v)
+	e.rcvBufSize += size
 
 	e.rcvMu.Unlock()
 
+	atomic.AddUint64(&r.Stats().UDP.PacketsReceived, 1)
+
 	// Notify any waiters that there's data to be read now.
 	if wasEmpty {
 		e.waiterQueue.Notify(waiter.EventIn)
 	}
 }
+
+// HandleNICRemoved implements stack.NICRemovalAwareEndpoint.HandleNICRemoved.
+// It aborts the endpoint if it's bound to the given NIC, or connected through
+// it and no other route to its peer can be found.
+func (e *endpoint) HandleNICRemoved(nicID tcpip.NICID) {
+	e.mu.Lock()
+	var abort bool
+	switch e.state {
+	case stateBound:
+		abort = e.regNICID == nicID
+	case stateConnected:
+		abort = e.regNICID == nicID || e.route.NICID() == nicID && e.refreshRouteLocked() != nil
+	}
+	if abort {
+		e.abortLocked()
+	}
+	e.mu.Unlock()
+
+	if abort {
+		e.waiterQueue.Notify(waiter.EventIn | waiter.EventOut | waiter.EventErr)
+	}
+}
+
+// HandleAddressRemoved implements
+// stack.AddressRemovalAwareEndpoint.HandleAddressRemoved. It aborts the endpoint
+// if it's bound to the given address, or connected with it and the address
+// isn't found on another NIC.
+func (e *endpoint) HandleAddressRemoved(nicID tcpip.NICID, addr tcpip.Address) {
+	e.mu.Lock()
+	var abort bool
+	switch e.state {
+	case stateBound:
+		abort = (e.regNICID == 0 || e.regNICID == nicID) && e.id.LocalAddress == addr
+	case stateConnected:
+		abort = e.route.NICID() == nicID && e.id.LocalAddress == addr && e.refreshRouteLocked() != nil
+	}
+	if abort {
+		e.abortLocked()
+	}
+	e.mu.Unlock()
+
+	if abort {
+		e.waiterQueue.Notify(waiter.EventIn | waiter.EventOut | waiter.EventErr)
+	}
+}
+
+// abortLocked aborts the endpoint after the NIC or the address it used was
+// removed: it's unregistered from the stack, its port and route are released,
+// and reads and writes fail with tcpip.ErrConnectionAborted, once the queued
+// datagrams are read. It must be called with e.mu held exclusively.
+func (e *endpoint) abortLocked() {
+	e.stack.UnregisterTransportEndpoint(e.regNICID, ProtocolNumber, e.id)
+	e.releasePortLocked(e.id.LocalPort)
+	e.route.Release()
+	e.state = stateError
+
+	e.rcvMu.Lock()
+	e.rcvClosed = true
+	e.rcvErr = tcpip.ErrConnectionAborted
+	e.rcvMu.Unlock()
+}
@@ -0,0 +1,62 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package udp
+
+// rcvQueueCapacity is the maximum number of packets queued to an endpoint,
+// whatever their size. Packets received while the queue is full are dropped,
+// even if the receive buffer isn't.
+const rcvQueueCapacity = 512
+
+// udpPacketRing is a FIFO queue of packets, stored by value in a ring of fixed
+// capacity, so that queuing packets doesn't allocate. The ring is allocated
+// when the first packet is queued.
+//
+// The zero value for udpPacketRing is an empty queue ready to use.
+type udpPacketRing struct {
+	packets []udpPacket
+	head    int
+	len     int
+}
+
+// Empty returns true iff the queue is empty.
+func (q *udpPacketRing) Empty() bool {
+	return q.len == 0
+}
+
+// Full returns true iff the queue holds rcvQueueCapacity packets.
+func (q *udpPacketRing) Full() bool {
+	return q.len == rcvQueueCapacity
+}
+
+// Len returns the number of packets in the queue.
+func (q *udpPacketRing) Len() int {
+	return q.len
+}
+
+// PushBack appends p to the queue, which must not be full.
+func (q *udpPacketRing) PushBack(p udpPacket) {
+	if q.packets == nil {
+		q.packets = make([]udpPacket, rcvQueueCapacity)
+	}
+	q.packets[(q.head+q.len)%rcvQueueCapacity] = p
+	q.len++
+}
+
+// PopFront removes the packet at the front of the queue, which must not be
+// empty, and returns it.
+func (q *udpPacketRing) PopFront() udpPacket {
+	p := q.packets[q.head]
+	// Don't keep references to the data of the packet.
+	q.packets[q.head] = udpPacket{}
+	q.head = (q.head + 1) % rcvQueueCapacity
+	q.len--
+	return p
+}
+
+// At returns the i-th packet of the queue, which must have more than i
+// packets.
+func (q *udpPacketRing) At(i int) *udpPacket {
+	return &q.packets[(q.head+i)%rcvQueueCapacity]
+}
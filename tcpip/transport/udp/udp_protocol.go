@@ -11,6 +11,8 @@
 package udp
 
 import (
+	"sync/atomic"
+
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
@@ -26,6 +28,22 @@ const (
 	ProtocolNumber = header.UDPProtocolNumber
 )
 
+// defaultEndpointDefaults are the settings new endpoints are created with,
+// unless they are overridden with stack.Stack.SetEndpointDefaults.
+var defaultEndpointDefaults = stack.EndpointDefaults{
+	SendBufferSize:    stack.BufferSizeRange{Min: 1, Default: 32 << 10, Max: 4 << 20},
+	ReceiveBufferSize: stack.BufferSizeRange{Min: 1, Default: 32 << 10, Max: 4 << 20},
+}
+
+// endpointDefaults returns the settings new endpoints of the given stack are
+// created with.
+func endpointDefaults(s *stack.Stack) stack.EndpointDefaults {
+	if d, ok := s.EndpointDefaults(ProtocolNumber); ok {
+		return d
+	}
+	return defaultEndpointDefaults
+}
+
 type protocol struct{}
 
 // Number returns the udp protocol number.
@@ -52,7 +70,8 @@ func (*protocol) ParsePorts(v buffer.View) (src, dst uint16, err error) {
 
 // HandleUnknownDestinationPacket handles packets targeted at this protocol but
 // that don't match any existing endpoint.
-func (p *protocol) HandleUnknownDestinationPacket(*stack.Route, stack.TransportEndpointID, buffer.View) {
+func (p *protocol) HandleUnknownDestinationPacket(r *stack.Route, _ stack.TransportEndpointID, _ buffer.View) {
+	atomic.AddUint64(&r.Stats().UDP.UnknownPortErrors, 1)
 }
 
 func init() {
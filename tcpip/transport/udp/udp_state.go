@@ -0,0 +1,190 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package udp
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/waiter"
+)
+
+// savedEndpoint is the state of an endpoint, as encoded in the data of
+// stack.SavedEndpoint.
+type savedEndpoint struct {
+	NetProto tcpip.NetworkProtocolNumber
+	State    endpointState
+
+	ID        stack.TransportEndpointID
+	BindNIC   tcpip.NICID
+	BindAddr  tcpip.Address
+	RegNIC    tcpip.NICID
+	RouteNIC  tcpip.NICID
+	DstPort   uint16
+	ReuseAddr bool
+	Owner     string
+	TTL       uint8
+	TOS       uint8
+
+	IsPortReserved bool
+	ReservedAddr   tcpip.Address
+
+	RcvBufSizeMax int
+	RcvClosed     bool
+
+	// Packets holds the datagrams that are ready to be read.
+	Packets []savedPacket
+}
+
+// savedPacket is a received datagram.
+type savedPacket struct {
+	Sender tcpip.FullAddress
+	Data   []byte
+}
+
+// SaveState implements stack.SaveableEndpoint.SaveState.
+func (e *endpoint) SaveState() (stack.SavedEndpoint, error) {
+	st := savedEndpoint{NetProto: e.netProto}
+
+	e.mu.RLock()
+	st.State = e.state
+	st.ID = e.id
+	st.BindNIC = e.bindNICID
+	st.BindAddr = e.bindAddr
+	st.RegNIC = e.regNICID
+	st.DstPort = e.dstPort
+	st.ReuseAddr = e.reuseAddr
+	st.Owner = e.owner.Name()
+	st.TTL = e.ttl
+	st.TOS = e.tos
+	st.IsPortReserved = e.isPortReserved
+	st.ReservedAddr = e.reservedAddr
+	if e.state == stateConnected {
+		st.RouteNIC = e.route.NICID()
+	}
+	e.mu.RUnlock()
+
+	e.rcvMu.Lock()
+	st.RcvBufSizeMax = e.rcvBufSizeMax
+	st.RcvClosed = e.rcvClosed
+	for i := 0; i < e.rcvList.Len(); i++ {
+		p := e.rcvList.At(i)
+		st.Packets = append(st.Packets, savedPacket{p.senderAddress, append([]byte(nil), p.data.ToView()...)})
+	}
+	e.rcvMu.Unlock()
+
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(&st); err != nil {
+		return stack.SavedEndpoint{}, err
+	}
+
+	return stack.SavedEndpoint{Protocol: ProtocolNumber, Data: b.Bytes()}, nil
+}
+
+// Detach implements stack.DetachableEndpoint.Detach. Datagrams received between
+// the snapshot and the closing of the endpoint are dropped, as they could have
+// been by the network.
+func (e *endpoint) Detach() (stack.SavedEndpoint, error) {
+	saved, err := e.SaveState()
+	e.Close()
+	return saved, err
+}
+
+// RestoreEndpoint implements stack.RestorableTransportProtocol.RestoreEndpoint.
+func (*protocol) RestoreEndpoint(s *stack.Stack, saved stack.SavedEndpoint, waiterQueue *waiter.Queue) (tcpip.Endpoint, error) {
+	var st savedEndpoint
+	if err := gob.NewDecoder(bytes.NewReader(saved.Data)).Decode(&st); err != nil {
+		return nil, err
+	}
+
+	e := newEndpoint(s, st.NetProto, waiterQueue)
+	e.reuseAddr = st.ReuseAddr
+	e.ttl = st.TTL
+	e.tos = st.TOS
+	e.rcvBufSizeMax = st.RcvBufSizeMax
+	if st.Owner != "" {
+		e.owner = s.Owner(st.Owner)
+	}
+
+	if err := e.restore(&st); err != nil {
+		e.Close()
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// restore puts e, a new endpoint, in the saved state.
+func (e *endpoint) restore(st *savedEndpoint) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch st.State {
+	case stateInitial:
+		return nil
+
+	case stateBound, stateConnected:
+		// Restored below.
+
+	default:
+		e.state = stateClosed
+		e.rcvClosed = true
+		return nil
+	}
+
+	e.id = st.ID
+	e.bindNICID = st.BindNIC
+	e.bindAddr = st.BindAddr
+	e.dstPort = st.DstPort
+
+	if st.IsPortReserved {
+		if _, err := e.stack.ReservePort(e.netProto, ProtocolNumber, st.ReservedAddr, st.ID.LocalPort, e.portFlags()); err != nil {
+			return err
+		}
+
+		e.isPortReserved = true
+		e.reservedAddr = st.ReservedAddr
+	}
+
+	if st.State == stateConnected {
+		r, err := e.stack.FindRoute(st.RouteNIC, st.ID.LocalAddress, st.ID.RemoteAddress, e.netProto)
+		if err != nil {
+			return err
+		}
+		e.route = r
+		e.route.TTL = e.ttl
+		e.route.TOS = e.tos
+	}
+
+	size := 0
+	for _, p := range st.Packets {
+		size += len(p.Data)
+	}
+	if !e.stack.ReserveMemoryFor(e.owner, size) {
+		return tcpip.ErrNoBufferSpace
+	}
+
+	if err := e.stack.RegisterTransportEndpoint(st.RegNIC, ProtocolNumber, e.id, e); err != nil {
+		e.stack.ReleaseMemoryFor(e.owner, size)
+		return err
+	}
+
+	e.regNICID = st.RegNIC
+	e.state = st.State
+
+	e.rcvMu.Lock()
+	for _, p := range st.Packets {
+		e.rcvList.PushBack(udpPacket{senderAddress: p.Sender, data: buffer.View(p.Data).ToVectorisedView()})
+	}
+	e.rcvBufSize = size
+	e.rcvReady = true
+	e.rcvClosed = st.RcvClosed
+	e.rcvMu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,1168 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package udp_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/checker"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/network/ipv6"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	stackAddr = "\x0a\x00\x00\x01"
+	proxyAddr = "\x0a\x00\x00\x09"
+	proxyPort = 53
+	testAddr  = "\x0a\x00\x00\x02"
+	testPort  = 4096
+)
+
+// udpPacket builds an IPv4 packet carrying a UDP datagram with the given
+// payload, without a UDP checksum.
+func udpPacket(src, dst tcpip.Address, srcPort, dstPort uint16, payload []byte) buffer.View {
+	buf := buffer.NewView(header.IPv4MinimumSize + header.UDPMinimumSize + len(payload))
+	copy(buf[header.IPv4MinimumSize+header.UDPMinimumSize:], payload)
+
+	ip := header.IPv4(buf)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(buf)),
+		TTL:         65,
+		Protocol:    uint8(udp.ProtocolNumber),
+		SrcAddr:     src,
+		DstAddr:     dst,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	header.UDP(buf[header.IPv4MinimumSize:]).Encode(&header.UDPFields{
+		SrcPort: srcPort,
+		DstPort: dstPort,
+		Length:  uint16(header.UDPMinimumSize + len(payload)),
+	})
+
+	return buf
+}
+
+func TestForwarderWithPromiscuousMode(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+
+	id, linkEP := channel.New(256, 1500)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, stackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	if err := s.SetPromiscuousMode(1, true); err != nil {
+		t.Fatalf("SetPromiscuousMode failed: %v", err)
+	}
+
+	// Create endpoints for all sessions, regardless of their destination.
+	eps := make(chan tcpip.Endpoint, 1)
+	var wq waiter.Queue
+	f := udp.NewForwarder(s, func(r *udp.ForwarderRequest) {
+		ep, err := r.CreateEndpoint(&wq)
+		if err != nil {
+			t.Errorf("CreateEndpoint failed: %v", err)
+			return
+		}
+		eps <- ep
+	})
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, f.HandlePacket)
+
+	payload := []byte{1, 2, 3}
+	linkEP.Inject(ipv4.ProtocolNumber, udpPacket(testAddr, proxyAddr, testPort, proxyPort, payload))
+
+	var ep tcpip.Endpoint
+	select {
+	case ep = <-eps:
+	default:
+		t.Fatalf("Forwarder didn't create an endpoint")
+	}
+	defer ep.Close()
+
+	// The packet that started the session can be read from the endpoint.
+	var from tcpip.FullAddress
+	v, err := ep.Read(&from)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	if !bytes.Equal(v, payload) {
+		t.Errorf("Read returned %v, want %v", v, payload)
+	}
+
+	if from.Addr != testAddr || from.Port != testPort {
+		t.Errorf("Read returned sender %v:%d, want %v:%d", from.Addr, from.Port, tcpip.Address(testAddr), testPort)
+	}
+
+	// Later packets of the session are delivered to the endpoint directly.
+	linkEP.Inject(ipv4.ProtocolNumber, udpPacket(testAddr, proxyAddr, testPort, proxyPort, payload))
+	if _, err := ep.Read(nil); err != nil {
+		t.Errorf("Read of second packet failed: %v", err)
+	}
+	if len(eps) != 0 {
+		t.Errorf("Forwarder created an endpoint for a known session")
+	}
+
+	// Replies are sent from the original destination of the session.
+	if _, err := ep.Write(buffer.View(payload), nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	select {
+	case p := <-linkEP.C:
+		b := append(append([]byte(nil), p.Header...), p.Payload...)
+		checker.IPv4(t, b,
+			checker.SrcAddr(proxyAddr),
+			checker.DstAddr(testAddr),
+			checker.UDP(
+				checker.SrcPort(proxyPort),
+				checker.DstPort(testPort),
+			),
+		)
+	case <-time.After(time.Second):
+		t.Fatalf("Reply wasn't written out")
+	}
+}
+
+func TestOwnerAttribution(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+
+	id, linkEP := channel.New(256, 1500)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, stackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         1,
+	}})
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	if err := ep.SetSockOpt(tcpip.OwnerOption("tenant")); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+
+	if err := ep.Bind(tcpip.FullAddress{Addr: stackAddr, Port: proxyPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	// The owner can't be changed once the endpoint is bound.
+	if err := ep.SetSockOpt(tcpip.OwnerOption("other")); err != tcpip.ErrInvalidEndpointState {
+		t.Errorf("SetSockOpt after Bind returned %v, want %v", err, tcpip.ErrInvalidEndpointState)
+	}
+
+	var o tcpip.OwnerOption
+	if err := ep.GetSockOpt(&o); err != nil || o != "tenant" {
+		t.Errorf("GetSockOpt returned (%q, %v), want (%q, nil)", o, err, "tenant")
+	}
+
+	owner := s.Owner("tenant")
+	owner.SetMemoryLimit(4)
+
+	// The first packet fits in the owner's limit, the second one doesn't.
+	payload := []byte{1, 2, 3}
+	linkEP.Inject(ipv4.ProtocolNumber, udpPacket(testAddr, stackAddr, testPort, proxyPort, payload))
+	linkEP.Inject(ipv4.ProtocolNumber, udpPacket(testAddr, stackAddr, testPort, proxyPort, payload))
+
+	if got := owner.MemoryUsage(); got != len(payload) {
+		t.Errorf("MemoryUsage returned %d, want %d", got, len(payload))
+	}
+
+	if _, err := ep.Read(nil); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if _, err := ep.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Errorf("second Read returned %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+
+	if got := owner.MemoryUsage(); got != 0 {
+		t.Errorf("MemoryUsage after Read returned %d, want 0", got)
+	}
+
+	if _, err := ep.Write(buffer.View(payload), &tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	size := uint64(header.UDPMinimumSize + len(payload))
+	want := stack.OwnerStats{
+		Rx: stack.NICDirectionStats{Packets: 2, Bytes: 2 * size},
+		Tx: stack.NICDirectionStats{Packets: 1, Bytes: size},
+	}
+	if got := owner.Stats(); got != want {
+		t.Errorf("Stats returned %+v, want %+v", got, want)
+	}
+
+	if got := ep.(stack.InspectableEndpoint).Inspect().Owner; got != "tenant" {
+		t.Errorf("Inspect returned owner %q, want %q", got, "tenant")
+	}
+}
+
+func TestEndpointDefaults(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+
+	id, linkEP := channel.New(256, 1500)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, stackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         1,
+	}})
+
+	bad := stack.EndpointDefaults{
+		SendBufferSize:    stack.BufferSizeRange{Min: 100, Default: 10, Max: 1000},
+		ReceiveBufferSize: stack.BufferSizeRange{Min: 100, Default: 500, Max: 1000},
+	}
+	if err := s.SetEndpointDefaults(udp.ProtocolNumber, bad); err != tcpip.ErrInvalidOptionValue {
+		t.Errorf("SetEndpointDefaults with invalid range returned %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+
+	d := stack.EndpointDefaults{
+		SendBufferSize:    stack.BufferSizeRange{Min: 100, Default: 200, Max: 1000},
+		ReceiveBufferSize: stack.BufferSizeRange{Min: 100, Default: 500, Max: 1000},
+		ReuseAddress:      true,
+	}
+	if err := s.SetEndpointDefaults(udp.ProtocolNumber, d); err != nil {
+		t.Fatalf("SetEndpointDefaults failed: %v", err)
+	}
+	s.SetDefaultTTL(32)
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	var snd tcpip.SendBufferSizeOption
+	if err := ep.GetSockOpt(&snd); err != nil || snd != 200 {
+		t.Errorf("GetSockOpt(SendBufferSizeOption) returned (%v, %v), want (200, nil)", snd, err)
+	}
+
+	var reuse tcpip.ReuseAddressOption
+	if err := ep.GetSockOpt(&reuse); err != nil || reuse != 1 {
+		t.Errorf("GetSockOpt(ReuseAddressOption) returned (%v, %v), want (1, nil)", reuse, err)
+	}
+
+	// Sizes are clamped to the range of the defaults.
+	for _, tc := range []struct{ set, want int }{{10, 100}, {300, 300}, {5000, 1000}} {
+		if err := ep.SetSockOpt(tcpip.ReceiveBufferSizeOption(tc.set)); err != nil {
+			t.Fatalf("SetSockOpt(ReceiveBufferSizeOption(%d)) failed: %v", tc.set, err)
+		}
+
+		var rcv tcpip.ReceiveBufferSizeOption
+		if err := ep.GetSockOpt(&rcv); err != nil || int(rcv) != tc.want {
+			t.Errorf("GetSockOpt(ReceiveBufferSizeOption) after setting %d returned (%v, %v), want (%d, nil)", tc.set, rcv, err, tc.want)
+		}
+	}
+
+	// Packets are sent with the default TTL.
+	if _, err := ep.Write(buffer.View{1, 2, 3}, &tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	select {
+	case p := <-linkEP.C:
+		if ttl := header.IPv4(p.Header).TTL(); ttl != 32 {
+			t.Errorf("Packet sent with TTL %d, want 32", ttl)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Packet wasn't written out")
+	}
+}
+
+func TestDeadlines(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+
+	id, linkEP := channel.New(256, 1500)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, stackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         1,
+	}})
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	if err := ep.Bind(tcpip.FullAddress{Addr: stackAddr, Port: proxyPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventIn|waiter.EventOut)
+	defer wq.EventUnregister(&we)
+
+	// A deadline in the past expires immediately, even if a datagram is
+	// ready to be read.
+	linkEP.Inject(ipv4.ProtocolNumber, udpPacket(testAddr, stackAddr, testPort, proxyPort, []byte{1}))
+	<-ch
+
+	past := time.Now().Add(-time.Second)
+	if err := ep.SetSockOpt(tcpip.ReceiveDeadlineOption(past)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatalf("Waiters weren't notified of the expired deadline")
+	}
+
+	if _, err := ep.Read(nil); err != tcpip.ErrTimeout {
+		t.Fatalf("Read returned %v, want %v", err, tcpip.ErrTimeout)
+	}
+
+	if err := ep.SetSockOpt(tcpip.SendDeadlineOption(past)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	if _, err := ep.Write(buffer.View{1}, &tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != tcpip.ErrTimeout {
+		t.Fatalf("Write returned %v, want %v", err, tcpip.ErrTimeout)
+	}
+
+	// Removing the deadlines makes the endpoint usable again.
+	ep.SetSockOpt(tcpip.ReceiveDeadlineOption(time.Time{}))
+	ep.SetSockOpt(tcpip.SendDeadlineOption(time.Time{}))
+
+	if _, err := ep.Read(nil); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if _, err := ep.Write(buffer.View{1}, &tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+}
+
+func TestTTLOption(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+
+	id, linkEP := channel.New(256, 1500)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, stackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         1,
+	}})
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	to := tcpip.FullAddress{Addr: testAddr, Port: testPort}
+	checkTTL := func(write func() error, ttl uint8) {
+		t.Helper()
+		if err := write(); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		select {
+		case p := <-linkEP.C:
+			b := append(append([]byte(nil), p.Header...), p.Payload...)
+			checker.IPv4(t, b, checker.TTL(ttl))
+		case <-time.After(time.Second):
+			t.Fatalf("Packet wasn't written out")
+		}
+	}
+
+	checkTTL(func() error {
+		_, err := ep.Write(buffer.View{1}, &to)
+		return err
+	}, stack.DefaultTTL)
+
+	// The option applies to packets sent to any destination.
+	if err := ep.SetSockOpt(tcpip.TTLOption(7)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	var ttl tcpip.TTLOption
+	if err := ep.GetSockOpt(&ttl); err != nil || ttl != 7 {
+		t.Fatalf("GetSockOpt returned %v, %v, want 7, nil", ttl, err)
+	}
+	checkTTL(func() error {
+		_, err := ep.Write(buffer.View{1}, &to)
+		return err
+	}, 7)
+
+	// And to the peer of connected endpoints, even if it was set before
+	// connecting.
+	if err := ep.Connect(to); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	checkTTL(func() error {
+		_, err := ep.Write(buffer.View{1}, nil)
+		return err
+	}, 7)
+
+	if err := ep.SetSockOpt(tcpip.TTLOption(0)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	checkTTL(func() error {
+		_, err := ep.Write(buffer.View{1}, nil)
+		return err
+	}, stack.DefaultTTL)
+}
+
+// otherControlMessages are control messages UDP endpoints don't support.
+type otherControlMessages struct{}
+
+func (otherControlMessages) Release() {}
+
+func (otherControlMessages) CloneCreds() tcpip.ControlMessages { return nil }
+
+func TestTOSOption(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+
+	id, linkEP := channel.New(256, 1500)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, stackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         1,
+	}})
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	to := tcpip.FullAddress{Addr: testAddr, Port: testPort}
+	check := func(cm tcpip.ControlMessages, checkers ...checker.NetworkChecker) {
+		t.Helper()
+		if _, err := ep.SendMsg(buffer.View{1}, cm, &to); err != nil {
+			t.Fatalf("SendMsg failed: %v", err)
+		}
+		select {
+		case p := <-linkEP.C:
+			b := append(append([]byte(nil), p.Header...), p.Payload...)
+			checker.IPv4(t, b, checkers...)
+		case <-time.After(time.Second):
+			t.Fatalf("Packet wasn't written out")
+		}
+	}
+
+	check(nil, checker.TOS(0, 0))
+
+	if err := ep.SetSockOpt(tcpip.TOSOption(0xb8 | tcpip.ECNECT0)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	var tos tcpip.TOSOption
+	if err := ep.GetSockOpt(&tos); err != nil || tos != 0xba {
+		t.Fatalf("GetSockOpt returned %#x, %v, want 0xba, nil", tos, err)
+	}
+	check(nil, checker.TOS(0xba, 0))
+
+	// Control messages override the options for one datagram.
+	check(&tcpip.IPControlMessages{HasTOS: true, TOS: tcpip.ECNCE}, checker.TOS(tcpip.ECNCE, 0), checker.TTL(stack.DefaultTTL))
+	check(&tcpip.IPControlMessages{HasTTL: true, TTL: 7}, checker.TOS(0xba, 0), checker.TTL(7))
+	check(nil, checker.TOS(0xba, 0), checker.TTL(stack.DefaultTTL))
+
+	// Other control messages are rejected.
+	if _, err := ep.SendMsg(buffer.View{1}, otherControlMessages{}, &to); err != tcpip.ErrInvalidEndpointState {
+		t.Fatalf("SendMsg returned %v, want %v", err, tcpip.ErrInvalidEndpointState)
+	}
+}
+
+func TestConnectedRouteRefresh(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+
+	var linkEPs [2]*channel.Endpoint
+	for i := range linkEPs {
+		id, linkEP := channel.New(256, 1500)
+		nicID := tcpip.NICID(i + 1)
+		if err := s.CreateNIC(nicID, id); err != nil {
+			t.Fatalf("CreateNIC failed: %v", err)
+		}
+		if err := s.AddAddress(nicID, ipv4.ProtocolNumber, stackAddr); err != nil {
+			t.Fatalf("AddAddress failed: %v", err)
+		}
+		linkEPs[i] = linkEP
+	}
+	setRoute := func(nicID tcpip.NICID) {
+		s.SetRouteTable([]tcpip.Route{{
+			Destination: "\x00\x00\x00\x00",
+			Mask:        "\x00\x00\x00\x00",
+			NIC:         nicID,
+		}})
+	}
+	setRoute(1)
+
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	if err := ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	write := func() error {
+		_, err := ep.Write(buffer.View("hello"), nil)
+		return err
+	}
+	checkSent := func(nic int) {
+		t.Helper()
+		for i, linkEP := range linkEPs {
+			want := 0
+			if i == nic {
+				want = 1
+			}
+			if n := len(linkEP.C); n != want {
+				t.Fatalf("got %d packets written to NIC %d, want %d", n, i+1, want)
+			}
+			if n := len(linkEP.C); n != 0 {
+				p := <-linkEP.C
+				checker.IPv4(t, append(append(buffer.View(nil), p.Header...), p.Payload...),
+					checker.SrcAddr(stackAddr),
+					checker.DstAddr(testAddr),
+				)
+			}
+		}
+	}
+
+	if err := write(); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	checkSent(0)
+
+	// The route of the endpoint follows the route table.
+	setRoute(2)
+	if err := write(); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	checkSent(1)
+
+	// Writes fail while there is no route, rather than being dropped.
+	s.SetRouteTable(nil)
+	if err := write(); err != tcpip.ErrNoRoute {
+		t.Fatalf("Write without a route returned %v, want %v", err, tcpip.ErrNoRoute)
+	}
+	checkSent(-1)
+
+	setRoute(1)
+	if err := write(); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	checkSent(0)
+
+	// Removing the NIC of the route moves the endpoint to the other NIC
+	// with its address, rather than aborting it.
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: "\x00\x00\x00\x00", Mask: "\x00\x00\x00\x00", NIC: 1},
+		{Destination: "\x00\x00\x00\x00", Mask: "\x00\x00\x00\x00", NIC: 2},
+	})
+	if err := s.RemoveNIC(1); err != nil {
+		t.Fatalf("RemoveNIC failed: %v", err)
+	}
+	if err := write(); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	checkSent(1)
+}
+
+func TestMulticastLoopOption(t *testing.T) {
+	const groupAddr = "\xe0\x00\x00\x7b"
+
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+
+	id, linkEP := channel.New(256, 1500)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, stackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	if err := s.JoinGroup(ipv4.ProtocolNumber, 1, groupAddr); err != nil {
+		t.Fatalf("JoinGroup failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         1,
+	}})
+
+	var rwq waiter.Queue
+	rep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &rwq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer rep.Close()
+	if err := rep.Bind(tcpip.FullAddress{Port: testPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	var loop tcpip.MulticastLoopOption
+	if err := ep.GetSockOpt(&loop); err != nil || loop != 1 {
+		t.Fatalf("GetSockOpt returned %v, %v, want 1, nil", loop, err)
+	}
+
+	to := tcpip.FullAddress{Addr: groupAddr, Port: testPort}
+	checkLoop := func(to *tcpip.FullAddress, looped bool) {
+		t.Helper()
+		if _, err := ep.Write(buffer.View("hello"), to); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+
+		// The packet is sent on the link either way.
+		select {
+		case p := <-linkEP.C:
+			b := append(append([]byte(nil), p.Header...), p.Payload...)
+			checker.IPv4(t, b, checker.DstAddr(groupAddr))
+		case <-time.After(time.Second):
+			t.Fatalf("Packet wasn't written out")
+		}
+
+		v, err := rep.Read(nil)
+		if !looped {
+			if err != tcpip.ErrWouldBlock {
+				t.Fatalf("Read returned %q, %v, want %v", v, err, tcpip.ErrWouldBlock)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if string(v) != "hello" {
+			t.Fatalf("Read returned %q, want %q", v, "hello")
+		}
+	}
+
+	checkLoop(&to, true)
+
+	if err := ep.SetSockOpt(tcpip.MulticastLoopOption(0)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	checkLoop(&to, false)
+
+	// Connected endpoints follow the option too.
+	if err := ep.Connect(to); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	checkLoop(nil, false)
+
+	if err := ep.SetSockOpt(tcpip.MulticastLoopOption(1)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	checkLoop(nil, true)
+}
+
+func TestMulticastInterfaceOption(t *testing.T) {
+	const (
+		groupAddr = "\xe0\x00\x00\x7b"
+		nic2Addr  = "\x0a\x00\x01\x01"
+	)
+
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+
+	var linkEPs [2]*channel.Endpoint
+	for i, addr := range []tcpip.Address{stackAddr, nic2Addr} {
+		id, linkEP := channel.New(256, 1500)
+		nicID := tcpip.NICID(i + 1)
+		if err := s.CreateNIC(nicID, id); err != nil {
+			t.Fatalf("CreateNIC failed: %v", err)
+		}
+		if err := s.AddAddress(nicID, ipv4.ProtocolNumber, addr); err != nil {
+			t.Fatalf("AddAddress failed: %v", err)
+		}
+		linkEPs[i] = linkEP
+	}
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	to := tcpip.FullAddress{Addr: groupAddr, Port: testPort}
+	checkSent := func(to tcpip.FullAddress, nic int, src tcpip.Address) {
+		t.Helper()
+		if _, err := ep.Write(buffer.View("hello"), &to); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		for i, linkEP := range linkEPs {
+			if i != nic {
+				if n := len(linkEP.C); n != 0 {
+					t.Fatalf("got %d packets written to NIC %d, want 0", n, i+1)
+				}
+				continue
+			}
+			select {
+			case p := <-linkEP.C:
+				b := append(append([]byte(nil), p.Header...), p.Payload...)
+				checker.IPv4(t, b, checker.SrcAddr(src), checker.DstAddr(groupAddr))
+			default:
+				t.Fatalf("Packet wasn't written to NIC %d", i+1)
+			}
+		}
+	}
+
+	// There is no route table, so multicast packets can only be sent
+	// through the NIC set with the option.
+	if _, err := ep.Write(buffer.View("hello"), &to); err != tcpip.ErrNoRoute {
+		t.Fatalf("Write returned %v, want %v", err, tcpip.ErrNoRoute)
+	}
+
+	if err := ep.SetSockOpt(tcpip.MulticastInterfaceOption{NIC: 2}); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	checkSent(to, 1, nic2Addr)
+
+	// NICs specified in writes take precedence.
+	checkSent(tcpip.FullAddress{NIC: 1, Addr: groupAddr, Port: testPort}, 0, stackAddr)
+
+	// The NIC can be given by its address.
+	if err := ep.SetSockOpt(tcpip.MulticastInterfaceOption{InterfaceAddr: stackAddr}); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	var opt tcpip.MulticastInterfaceOption
+	if err := ep.GetSockOpt(&opt); err != nil {
+		t.Fatalf("GetSockOpt failed: %v", err)
+	}
+	if want := (tcpip.MulticastInterfaceOption{NIC: 1, InterfaceAddr: stackAddr}); opt != want {
+		t.Fatalf("GetSockOpt returned %+v, want %+v", opt, want)
+	}
+	checkSent(to, 0, stackAddr)
+
+	if err := ep.SetSockOpt(tcpip.MulticastInterfaceOption{NIC: 2, InterfaceAddr: stackAddr}); err != tcpip.ErrBadLocalAddress {
+		t.Fatalf("SetSockOpt returned %v, want %v", err, tcpip.ErrBadLocalAddress)
+	}
+
+	// Connected endpoints send through the NIC too.
+	if err := ep.SetSockOpt(tcpip.MulticastInterfaceOption{NIC: 2}); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	if err := ep.Connect(to); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if _, err := ep.Write(buffer.View("hello"), nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if n := len(linkEPs[1].C); n != 1 {
+		t.Fatalf("got %d packets written to NIC 2, want 1", n)
+	}
+}
+
+func TestIPv6Options(t *testing.T) {
+	const (
+		stackAddr6 = "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"
+		testAddr6  = "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02"
+		groupAddr6 = "\xff\x0e\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x23"
+	)
+
+	s := stack.New([]string{ipv4.ProtocolName, ipv6.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+
+	id, linkEP := channel.New(256, 1500)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, ipv6.ProtocolNumber, stackAddr6); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+		NIC:         1,
+	}})
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv6.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	// IPv6 endpoints are always IPv6-only; IPv4 ones don't have the option.
+	var v6Only tcpip.V6OnlyOption
+	if err := ep.GetSockOpt(&v6Only); err != nil || v6Only != 1 {
+		t.Fatalf("GetSockOpt returned %v, %v, want 1, nil", v6Only, err)
+	}
+	if err := ep.SetSockOpt(tcpip.V6OnlyOption(1)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	if err := ep.SetSockOpt(tcpip.V6OnlyOption(0)); err != tcpip.ErrNotSupported {
+		t.Fatalf("SetSockOpt returned %v, want %v", err, tcpip.ErrNotSupported)
+	}
+	ep4, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep4.Close()
+	if err := ep4.GetSockOpt(&v6Only); err != tcpip.ErrUnknownProtocolOption {
+		t.Fatalf("GetSockOpt returned %v, want %v", err, tcpip.ErrUnknownProtocolOption)
+	}
+
+	// Multicast packets get their own hop limit, and unicast packets the
+	// one of the TTL option.
+	if err := ep.SetSockOpt(tcpip.TTLOption(30)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	if err := ep.SetSockOpt(tcpip.MulticastTTLOption(5)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	var mttl tcpip.MulticastTTLOption
+	if err := ep.GetSockOpt(&mttl); err != nil || mttl != 5 {
+		t.Fatalf("GetSockOpt returned %v, %v, want 5, nil", mttl, err)
+	}
+	for _, test := range []struct {
+		addr tcpip.Address
+		ttl  uint8
+	}{
+		{groupAddr6, 5},
+		{testAddr6, 30},
+	} {
+		if _, err := ep.Write(buffer.View("hello"), &tcpip.FullAddress{Addr: test.addr, Port: testPort}); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		select {
+		case p := <-linkEP.C:
+			b := append(append([]byte(nil), p.Header...), p.Payload...)
+			checker.IPv6(t, b, checker.DstAddr(test.addr), checker.TTL(test.ttl))
+		case <-time.After(time.Second):
+			t.Fatalf("Packet wasn't written out")
+		}
+	}
+
+	// The hop limit of received packets is reported once requested.
+	addr, err := ep.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("GetLocalAddress failed: %v", err)
+	}
+	inject := func(hopLimit uint8) {
+		payload := []byte("hello")
+		buf := buffer.NewView(header.IPv6MinimumSize + header.UDPMinimumSize + len(payload))
+		copy(buf[header.IPv6MinimumSize+header.UDPMinimumSize:], payload)
+		header.IPv6(buf).Encode(&header.IPv6Fields{
+			PayloadLength: uint16(header.UDPMinimumSize + len(payload)),
+			NextHeader:    uint8(udp.ProtocolNumber),
+			HopLimit:      hopLimit,
+			SrcAddr:       testAddr6,
+			DstAddr:       stackAddr6,
+		})
+		header.UDP(buf[header.IPv6MinimumSize:]).Encode(&header.UDPFields{
+			SrcPort: testPort,
+			DstPort: addr.Port,
+			Length:  uint16(header.UDPMinimumSize + len(payload)),
+		})
+		linkEP.Inject(ipv6.ProtocolNumber, buf)
+	}
+
+	inject(42)
+	if _, cm, err := ep.RecvMsg(nil); err != nil || cm != nil {
+		t.Fatalf("RecvMsg returned %v, %v, want nil, nil", cm, err)
+	}
+
+	if err := ep.SetSockOpt(tcpip.ReceiveTTLOption(1)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	inject(42)
+	_, cm, err := ep.RecvMsg(nil)
+	if err != nil {
+		t.Fatalf("RecvMsg failed: %v", err)
+	}
+	want := &tcpip.IPControlMessages{HasTTL: true, TTL: 42}
+	if got, ok := cm.(*tcpip.IPControlMessages); !ok || *got != *want {
+		t.Fatalf("RecvMsg returned control messages %+v, want %+v", cm, want)
+	}
+}
+
+func TestReceiveTOSOption(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+
+	id, linkEP := channel.New(256, 1500)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, stackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	if err := ep.Bind(tcpip.FullAddress{Addr: stackAddr, Port: proxyPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	// inject injects a datagram with TTL 255 and the given TOS, and returns
+	// the control messages RecvMsg returns with it.
+	inject := func(tos uint8) tcpip.ControlMessages {
+		t.Helper()
+		b := udpPacket(testAddr, stackAddr, testPort, proxyPort, []byte("hello"))
+		ip := header.IPv4(b)
+		ip.SetTTL(255)
+		ip.SetTOS(tos, 0)
+		ip.SetChecksum(0)
+		ip.SetChecksum(^ip.CalculateChecksum())
+		linkEP.Inject(ipv4.ProtocolNumber, b)
+
+		_, cm, err := ep.RecvMsg(nil)
+		if err != nil {
+			t.Fatalf("RecvMsg failed: %v", err)
+		}
+		return cm
+	}
+
+	if cm := inject(0xb8); cm != nil {
+		t.Fatalf("RecvMsg returned control messages %+v, want none", cm)
+	}
+
+	for _, test := range []struct {
+		opts []interface{}
+		want tcpip.IPControlMessages
+	}{
+		{
+			opts: []interface{}{tcpip.ReceiveTOSOption(1)},
+			want: tcpip.IPControlMessages{HasTOS: true, TOS: 0xb8},
+		},
+		{
+			opts: []interface{}{tcpip.ReceiveTTLOption(1)},
+			want: tcpip.IPControlMessages{HasTTL: true, TTL: 255, HasTOS: true, TOS: 0xb8},
+		},
+		{
+			opts: []interface{}{tcpip.ReceiveTOSOption(0)},
+			want: tcpip.IPControlMessages{HasTTL: true, TTL: 255},
+		},
+	} {
+		for _, opt := range test.opts {
+			if err := ep.SetSockOpt(opt); err != nil {
+				t.Fatalf("SetSockOpt(%#v) failed: %v", opt, err)
+			}
+		}
+		cm := inject(0xb8)
+		if got, ok := cm.(*tcpip.IPControlMessages); !ok || *got != test.want {
+			t.Fatalf("RecvMsg returned control messages %+v, want %+v", cm, test.want)
+		}
+	}
+
+	var opt tcpip.ReceiveTOSOption
+	if err := ep.GetSockOpt(&opt); err != nil || opt != 0 {
+		t.Fatalf("GetSockOpt returned %v, %v, want 0, nil", opt, err)
+	}
+}
+
+func TestReceiveQueueOverflow(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+
+	id, linkEP := channel.New(256, 1500)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, stackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	if err := ep.Bind(tcpip.FullAddress{Addr: stackAddr, Port: proxyPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	// Small datagrams fill the queue long before the receive buffer.
+	const sent = 1000
+	for i := 0; i < sent; i++ {
+		linkEP.Inject(ipv4.ProtocolNumber, udpPacket(testAddr, stackAddr, testPort, proxyPort, []byte{byte(i)}))
+	}
+
+	read := 0
+	for {
+		v, err := ep.Read(nil)
+		if err == tcpip.ErrWouldBlock {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if len(v) != 1 || v[0] != byte(read) {
+			t.Fatalf("Read datagram %d returned %v, want [%d]", read, v, byte(read))
+		}
+		read++
+	}
+	if read == 0 || read == sent {
+		t.Fatalf("Read %d datagrams, want fewer than %d", read, sent)
+	}
+
+	stats := s.Stats().UDP
+	if got, want := stats.ReceiveQueueOverflows, uint64(sent-read); got != want {
+		t.Errorf("ReceiveQueueOverflows = %d, want %d", got, want)
+	}
+	if got, want := stats.ReceiveBufferErrors, uint64(sent-read); got != want {
+		t.Errorf("ReceiveBufferErrors = %d, want %d", got, want)
+	}
+
+	// The queue accepts datagrams again once it's been read.
+	linkEP.Inject(ipv4.ProtocolNumber, udpPacket(testAddr, stackAddr, testPort, proxyPort, []byte{1}))
+	if _, err := ep.Read(nil); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+}
+
+func TestRemovalAbortsEndpoint(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		connect bool
+		remove  func(*stack.Stack) error
+	}{
+		{"bound, NIC removed", false, func(s *stack.Stack) error { return s.RemoveNIC(1) }},
+		{"connected, NIC removed", true, func(s *stack.Stack) error { return s.RemoveNIC(1) }},
+		{"bound, address removed", false, func(s *stack.Stack) error { return s.RemoveAddress(1, stackAddr) }},
+		{"connected, address removed", true, func(s *stack.Stack) error { return s.RemoveAddress(1, stackAddr) }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName}).(*stack.Stack)
+			id, linkEP := channel.New(256, 1500)
+			if err := s.CreateNIC(1, id); err != nil {
+				t.Fatalf("CreateNIC failed: %v", err)
+			}
+			if err := s.AddAddress(1, ipv4.ProtocolNumber, stackAddr); err != nil {
+				t.Fatalf("AddAddress failed: %v", err)
+			}
+			s.SetRouteTable([]tcpip.Route{{
+				Destination: "\x00\x00\x00\x00",
+				Mask:        "\x00\x00\x00\x00",
+				NIC:         1,
+			}})
+
+			var wq waiter.Queue
+			ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+			if err != nil {
+				t.Fatalf("NewEndpoint failed: %v", err)
+			}
+			defer ep.Close()
+			if err := ep.Bind(tcpip.FullAddress{NIC: 1, Addr: stackAddr, Port: proxyPort}, nil); err != nil {
+				t.Fatalf("Bind failed: %v", err)
+			}
+			var to *tcpip.FullAddress
+			if test.connect {
+				if err := ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != nil {
+					t.Fatalf("Connect failed: %v", err)
+				}
+			} else {
+				to = &tcpip.FullAddress{Addr: testAddr, Port: testPort}
+			}
+
+			payload := []byte{1, 2, 3}
+			linkEP.Inject(ipv4.ProtocolNumber, udpPacket(testAddr, stackAddr, testPort, proxyPort, payload))
+
+			we, ch := waiter.NewChannelEntry(nil)
+			wq.EventRegister(&we, waiter.EventErr)
+			defer wq.EventUnregister(&we)
+
+			if err := test.remove(s); err != nil {
+				t.Fatalf("Removal failed: %v", err)
+			}
+
+			select {
+			case <-ch:
+			default:
+				t.Errorf("Waiters weren't notified of the error")
+			}
+			if got := ep.Readiness(waiter.EventErr | waiter.EventHUp); got != waiter.EventErr {
+				t.Errorf("Readiness returned %v, want %v", got, waiter.EventErr)
+			}
+
+			// The datagram received before the removal can still be
+			// read, then reads and writes fail.
+			if v, err := ep.Read(nil); err != nil || !bytes.Equal(v, payload) {
+				t.Errorf("Read returned %v, %v, want %v, nil", v, err, payload)
+			}
+			if _, err := ep.Read(nil); err != tcpip.ErrConnectionAborted {
+				t.Errorf("Read returned %v, want %v", err, tcpip.ErrConnectionAborted)
+			}
+			if _, err := ep.Write(buffer.View(payload), to); err != tcpip.ErrConnectionAborted {
+				t.Errorf("Write returned %v, want %v", err, tcpip.ErrConnectionAborted)
+			}
+
+			// The port is free again.
+			ep2, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+			if err != nil {
+				t.Fatalf("NewEndpoint failed: %v", err)
+			}
+			defer ep2.Close()
+			if err := ep2.Bind(tcpip.FullAddress{Port: proxyPort}, nil); err != nil {
+				t.Errorf("Bind to the port of the aborted endpoint failed: %v", err)
+			}
+		})
+	}
+}
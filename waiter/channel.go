@@ -0,0 +1,90 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package waiter
+
+import (
+	"context"
+)
+
+// ChannelEntry is a waiter entry that delivers its notifications on a channel.
+// The channel has room for a single notification, so the ones that happen
+// before it's received are coalesced into it.
+//
+// The zero value of ChannelEntry is ready for use. Like Entry, it can be
+// registered in a single queue at a time, and it must not be copied once
+// registered.
+type ChannelEntry struct {
+	entry Entry
+	c     chan struct{}
+}
+
+// init creates the channel of the entry, if it hasn't been yet.
+func (e *ChannelEntry) init() {
+	if e.c != nil {
+		return
+	}
+
+	e.c = make(chan struct{}, 1)
+	e.entry.Context = e.c
+	e.entry.Callback = func(e *Entry) {
+		select {
+		case e.Context.(chan struct{}) <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Register registers the entry in q, to be notified when one of the events in
+// mask happens.
+func (e *ChannelEntry) Register(q *Queue, mask EventMask) {
+	e.init()
+	q.EventRegister(&e.entry, mask)
+}
+
+// Unregister unregisters the entry from q. A pending notification, if any,
+// stays in the channel.
+func (e *ChannelEntry) Unregister(q *Queue) {
+	q.EventUnregister(&e.entry)
+}
+
+// C returns the channel the notifications of the entry are delivered on.
+func (e *ChannelEntry) C() <-chan struct{} {
+	e.init()
+	return e.c
+}
+
+// Wait waits for the entry to be notified, or for ctx to be done, in which case
+// it returns the error of ctx.
+func (e *ChannelEntry) Wait(ctx context.Context) error {
+	select {
+	case <-e.C():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WaitFor calls try until it returns true, waiting for q to be notified of one
+// of the events in mask between the calls, following the pattern described in
+// the package documentation. If ctx is done first, it returns the error of ctx.
+func (q *Queue) WaitFor(ctx context.Context, mask EventMask, try func() bool) error {
+	if try() {
+		return nil
+	}
+
+	var e ChannelEntry
+	e.Register(q, mask)
+	defer e.Unregister(q)
+
+	// The object may have become ready between the first call and the
+	// registration.
+	for !try() {
+		if err := e.Wait(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
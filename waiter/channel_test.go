@@ -0,0 +1,57 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package waiter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWaitFor(t *testing.T) {
+	o := &object{}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		o.set(EventIn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	calls := 0
+	if err := o.q.WaitFor(ctx, EventIn, func() bool {
+		calls++
+		return o.Readiness(EventIn) != 0
+	}); err != nil {
+		t.Fatalf("WaitFor failed: %v", err)
+	}
+	if calls < 2 {
+		t.Errorf("got %d calls, want at least 2", calls)
+	}
+	if !o.q.IsEmpty() {
+		t.Errorf("entry still registered after WaitFor returned")
+	}
+
+	// Notifications are coalesced.
+	var e ChannelEntry
+	e.Register(&o.q, EventIn)
+	o.set(EventIn)
+	o.set(EventIn)
+	e.Unregister(&o.q)
+	if err := e.Wait(ctx); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	select {
+	case <-e.C():
+		t.Errorf("got a second notification")
+	default:
+	}
+
+	// WaitFor returns the error of its context.
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := o.q.WaitFor(ctx, EventOut, func() bool { return false }); err != context.DeadlineExceeded {
+		t.Errorf("WaitFor returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
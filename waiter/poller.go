@@ -0,0 +1,263 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package waiter
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Errors returned by the methods of Poller.
+var (
+	ErrAlreadyAdded = errors.New("queue already added to the poller")
+	ErrNotAdded     = errors.New("queue not added to the poller")
+)
+
+// EventEdgeTriggered, added to the mask given to Poller.Add or Poller.Modify,
+// makes the poller report the events of an object only once per notification,
+// rather than for as long as the object is ready, like EPOLLET. The events
+// are then typically consumed until the object isn't ready anymore.
+const EventEdgeTriggered EventMask = 0x8000
+
+// Readier is implemented by objects that report what they're ready for, such as
+// tcpip.Endpoint.
+type Readier interface {
+	// Readiness returns what the object is currently ready for, among the
+	// events in mask.
+	Readiness(mask EventMask) EventMask
+}
+
+// PollEvent is the readiness of an object returned by Poller.Wait.
+type PollEvent struct {
+	// Events are the events the object is ready for.
+	Events EventMask
+
+	// Data is the user data the object was added to the poller with.
+	Data interface{}
+}
+
+// pollEntry is the state of an object added to a poller.
+type pollEntry struct {
+	entry Entry
+	p     *Poller
+	q     *Queue
+	r     Readier
+
+	// The following fields are protected by the poller's mutex.
+	mask    EventMask
+	edge    bool
+	data    interface{}
+	queued  bool
+	removed bool
+}
+
+// setMask sets the events waited for by the entry, which mustn't be registered
+// in its queue.
+func (pe *pollEntry) setMask(mask EventMask) {
+	pe.edge = mask&EventEdgeTriggered != 0
+	pe.mask = mask &^ EventEdgeTriggered
+	pe.entry.EdgeTriggered = pe.edge
+}
+
+// Poller multiplexes the readiness of many objects, e.g., netstack endpoints,
+// in the manner of epoll: the objects are added to the poller along with their
+// waiter queue, and a single goroutine waits for the events of all of them,
+// which are returned in batches. Events are level-triggered by default, that
+// is, objects are reported by Wait for as long as they're ready; see
+// EventEdgeTriggered.
+//
+// The zero value of Poller isn't usable; use NewPoller.
+type Poller struct {
+	// notify is written to when entries are queued, to wake up Wait.
+	notify chan struct{}
+
+	mu      sync.Mutex
+	entries map[*Queue]*pollEntry
+
+	// ready holds the entries that may be ready, in the order they were
+	// notified.
+	ready []*pollEntry
+}
+
+// NewPoller returns a new poller, with no objects.
+func NewPoller() *Poller {
+	return &Poller{
+		notify:  make(chan struct{}, 1),
+		entries: make(map[*Queue]*pollEntry),
+	}
+}
+
+// Add adds an object to the poller: r is the object, which notifies q when it
+// becomes ready, mask is the set of events the poller waits for, and data is
+// returned along with the events of the object. The current readiness of the
+// object is checked by the next call to Wait.
+func (p *Poller) Add(q *Queue, r Readier, mask EventMask, data interface{}) error {
+	p.mu.Lock()
+	if _, ok := p.entries[q]; ok {
+		p.mu.Unlock()
+		return ErrAlreadyAdded
+	}
+
+	pe := &pollEntry{p: p, q: q, r: r, data: data}
+	pe.setMask(mask)
+	pe.entry.Context = pe
+	pe.entry.Callback = func(e *Entry) {
+		e.Context.(*pollEntry).notified()
+	}
+	p.entries[q] = pe
+	p.queueLocked(pe)
+	p.mu.Unlock()
+
+	q.EventRegister(&pe.entry, pe.mask|EventErr|EventHUp)
+	return nil
+}
+
+// Modify changes the events the poller waits for, and the user data, of an
+// object already added to it.
+func (p *Poller) Modify(q *Queue, mask EventMask, data interface{}) error {
+	p.mu.Lock()
+	pe, ok := p.entries[q]
+	if !ok {
+		p.mu.Unlock()
+		return ErrNotAdded
+	}
+	pe.data = data
+	p.mu.Unlock()
+
+	q.EventUnregister(&pe.entry)
+	p.mu.Lock()
+	pe.setMask(mask)
+	p.queueLocked(pe)
+	p.mu.Unlock()
+	q.EventRegister(&pe.entry, pe.mask|EventErr|EventHUp)
+	return nil
+}
+
+// Remove removes an object from the poller. Its events are no longer returned
+// by Wait once Remove returns.
+func (p *Poller) Remove(q *Queue) error {
+	p.mu.Lock()
+	pe, ok := p.entries[q]
+	if !ok {
+		p.mu.Unlock()
+		return ErrNotAdded
+	}
+	delete(p.entries, q)
+	pe.removed = true
+	p.mu.Unlock()
+
+	q.EventUnregister(&pe.entry)
+	return nil
+}
+
+// notified is called when the queue of the entry is notified.
+func (pe *pollEntry) notified() {
+	p := pe.p
+	p.mu.Lock()
+	if !pe.removed {
+		p.queueLocked(pe)
+	}
+	p.mu.Unlock()
+}
+
+// queueLocked adds pe to the ready list, if it isn't already in it, and wakes
+// up Wait. p.mu must be held.
+func (p *Poller) queueLocked(pe *pollEntry) {
+	if pe.queued {
+		return
+	}
+	pe.queued = true
+	p.ready = append(p.ready, pe)
+
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Poll stores the events of the ready objects in events, without blocking, and
+// returns how many it stored.
+func (p *Poller) Poll(events []PollEvent) int {
+	if len(events) == 0 {
+		return 0
+	}
+
+	// The readiness of the objects is checked without holding the mutex,
+	// as objects may notify their queue with their own locks held.
+	p.mu.Lock()
+	candidates := p.ready
+	p.ready = nil
+	p.mu.Unlock()
+
+	n := 0
+	for i, pe := range candidates {
+		if n == len(events) {
+			// The remaining candidates are checked by the next
+			// call, before the ones notified meanwhile.
+			p.mu.Lock()
+			p.ready = append(candidates[i:], p.ready...)
+			p.mu.Unlock()
+			break
+		}
+
+		// The entry is dequeued before its readiness is checked, so
+		// that it's queued again if notified meanwhile.
+		p.mu.Lock()
+		pe.queued = false
+		mask, edge, data, removed := pe.mask, pe.edge, pe.data, pe.removed
+		p.mu.Unlock()
+		if removed {
+			continue
+		}
+		if edge {
+			pe.entry.Rearm()
+		}
+
+		// EventErr and EventHUp are always reported, as with epoll.
+		ev := pe.r.Readiness(mask | EventErr | EventHUp)
+		if ev == 0 {
+			continue
+		}
+
+		events[n] = PollEvent{Events: ev, Data: data}
+		n++
+		if edge {
+			continue
+		}
+
+		// Events are level-triggered, so the object is checked again
+		// by the next call, after the ones notified meanwhile so that
+		// none is starved.
+		p.mu.Lock()
+		if !pe.removed {
+			p.queueLocked(pe)
+		}
+		p.mu.Unlock()
+	}
+
+	return n
+}
+
+// Wait stores the events of the ready objects in events, and returns how many
+// it stored. It blocks until at least one object is ready, or ctx is done, in
+// which case it returns the error of ctx.
+func (p *Poller) Wait(ctx context.Context, events []PollEvent) (int, error) {
+	for {
+		if n := p.Poll(events); n != 0 || len(events) == 0 {
+			return n, nil
+		}
+
+		select {
+		case <-p.notify:
+		case <-ctx.Done():
+			// Objects may have become ready meanwhile.
+			if n := p.Poll(events); n != 0 {
+				return n, nil
+			}
+			return 0, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package waiter
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// object is a waitable object whose readiness is set by tests.
+type object struct {
+	q Queue
+
+	mu    sync.Mutex
+	ready EventMask
+}
+
+func (o *object) Readiness(mask EventMask) EventMask {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.ready & mask
+}
+
+func (o *object) set(ready EventMask) {
+	o.mu.Lock()
+	o.ready = ready
+	o.mu.Unlock()
+	o.q.Notify(ready)
+}
+
+func TestPoller(t *testing.T) {
+	p := NewPoller()
+	objs := make([]*object, 3)
+	for i := range objs {
+		objs[i] = &object{}
+		if err := p.Add(&objs[i].q, objs[i], EventIn, i); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+	if err := p.Add(&objs[0].q, objs[0], EventIn, 0); err != ErrAlreadyAdded {
+		t.Errorf("Add of an added queue returned %v, want %v", err, ErrAlreadyAdded)
+	}
+
+	events := make([]PollEvent, 10)
+	if n := p.Poll(events); n != 0 {
+		t.Fatalf("Poll returned %d events before any object was ready", n)
+	}
+
+	// Wait blocks until an object becomes ready.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		objs[1].set(EventIn | EventOut)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n, err := p.Wait(ctx, events)
+	if err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if n != 1 || events[0] != (PollEvent{EventIn, 1}) {
+		t.Fatalf("Wait returned %v, want the input event of object 1", events[:n])
+	}
+
+	// Events are level-triggered, and errors are always reported.
+	objs[2].set(EventErr)
+	if n := p.Poll(events); n != 2 || events[0] != (PollEvent{EventIn, 1}) || events[1] != (PollEvent{EventErr, 2}) {
+		t.Errorf("Poll returned %v, want the events of objects 1 and 2", events[:n])
+	}
+
+	// Objects that aren't ready anymore, or have been removed, aren't
+	// reported.
+	objs[1].set(0)
+	if err := p.Remove(&objs[2].q); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if n := p.Poll(events); n != 0 {
+		t.Errorf("Poll returned %v, want no events", events[:n])
+	}
+
+	// Modify changes the events waited for and the user data.
+	if err := p.Modify(&objs[0].q, EventOut, "zero"); err != nil {
+		t.Fatalf("Modify failed: %v", err)
+	}
+	objs[0].set(EventIn | EventOut)
+	if n := p.Poll(events); n != 1 || events[0] != (PollEvent{EventOut, "zero"}) {
+		t.Errorf("Poll returned %v, want the output event of object 0", events[:n])
+	}
+
+	// Wait returns the error of its context when no object is ready.
+	objs[0].set(0)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.Wait(ctx, events); err != context.DeadlineExceeded {
+		t.Errorf("Wait returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestPollerBatch(t *testing.T) {
+	p := NewPoller()
+	for i := 0; i < 5; i++ {
+		o := &object{ready: EventIn}
+		if err := p.Add(&o.q, o, EventIn, i); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+
+	// Batches are filled in turn, so that all objects are reported.
+	seen := make(map[interface{}]bool)
+	events := make([]PollEvent, 2)
+	for i := 0; i < 3; i++ {
+		n := p.Poll(events)
+		for _, e := range events[:n] {
+			seen[e.Data] = true
+		}
+	}
+	if len(seen) != 5 {
+		t.Errorf("got events of %d objects, want 5", len(seen))
+	}
+}
+
+func TestPollerEdgeTriggered(t *testing.T) {
+	p := NewPoller()
+	o := &object{ready: EventIn}
+	if err := p.Add(&o.q, o, EventIn|EventEdgeTriggered, nil); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+
+	// The object is reported once when added, and once per notification
+	// afterwards, even though it stays ready.
+	events := make([]PollEvent, 10)
+	for i := 0; i < 2; i++ {
+		if n := p.Poll(events); n != 1 || events[0].Events != EventIn {
+			t.Fatalf("Poll returned %v, want the input event", events[:n])
+		}
+		if n := p.Poll(events); n != 0 {
+			t.Fatalf("Poll returned %v without a new notification", events[:n])
+		}
+		o.set(EventIn)
+	}
+
+	// Switching back to level-triggered events reports the object for as
+	// long as it's ready.
+	if err := p.Modify(&o.q, EventIn, nil); err != nil {
+		t.Fatalf("Modify failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if n := p.Poll(events); n != 1 {
+			t.Fatalf("Poll returned %v, want the input event", events[:n])
+		}
+	}
+}
@@ -32,6 +32,9 @@
 //		return err
 //	}
 //
+// Queue.WaitFor implements this pattern, and ChannelEntry provides entries that
+// notify a channel, for callers that need to wait for other events too.
+//
 // Another goroutine needs to notify waiters when events happen. For example:
 //
 //	func (o *object) Write(...) ... {
@@ -49,6 +52,7 @@ package waiter
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"github.com/google/netstack/ilist"
 )
@@ -102,11 +106,45 @@ type Entry struct {
 	// callback is running.
 	Callback func(e *Entry)
 
+	// EdgeTriggered makes the entry be notified only of the events it
+	// hasn't been notified of since it was registered or last rearmed with
+	// Rearm, rather than every time they happen. Waiters typically rearm
+	// the entry once they've found the object not ready anymore, so that
+	// they're not notified over and over while it stays ready.
+	//
+	// It must not be changed while the entry is registered.
+	EdgeTriggered bool
+
+	// pending holds the events an edge-triggered entry was notified of
+	// since it was last armed. It's accessed atomically.
+	pending uint32
+
 	// The following fields are protected by the queue lock.
 	mask EventMask
 	ilist.Entry
 }
 
+// Rearm rearms an edge-triggered entry, so that it's notified again of the
+// events it was already notified of.
+func (e *Entry) Rearm() {
+	atomic.StoreUint32(&e.pending, 0)
+}
+
+// notifyEdge records that an edge-triggered entry is notified of the events in
+// mask, and returns whether one of them wasn't pending.
+func (e *Entry) notifyEdge(mask EventMask) bool {
+	for {
+		old := atomic.LoadUint32(&e.pending)
+		pending := old | uint32(mask)
+		if pending == old {
+			return false
+		}
+		if atomic.CompareAndSwapUint32(&e.pending, old, pending) {
+			return true
+		}
+	}
+}
+
 // NewChannelEntry initializes a new Entry that does a non-blocking write of nil
 // to an interface{} channel when the callback is called. It returns the new
 // Entry instance and the channel being used.
@@ -145,6 +183,7 @@ type Queue struct {
 func (q *Queue) EventRegister(e *Entry, mask EventMask) {
 	q.mu.Lock()
 	e.mask = mask
+	e.Rearm()
 	q.list.PushBack(e)
 	q.mu.Unlock()
 }
@@ -162,7 +201,7 @@ func (q *Queue) Notify(mask EventMask) {
 	q.mu.RLock()
 	for it := q.list.Front(); it != nil; it = it.Next() {
 		e := it.(*Entry)
-		if (mask & e.mask) != 0 {
+		if m := mask & e.mask; m != 0 && (!e.EdgeTriggered || e.notifyEdge(m)) {
 			e.Callback(e)
 		}
 	}
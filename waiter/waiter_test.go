@@ -0,0 +1,43 @@
+// Copyright 2016 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package waiter
+
+import (
+	"testing"
+)
+
+func TestEdgeTriggered(t *testing.T) {
+	var q Queue
+	calls := 0
+	e := Entry{
+		Callback:      func(*Entry) { calls++ },
+		EdgeTriggered: true,
+	}
+	q.EventRegister(&e, EventIn|EventOut)
+	defer q.EventUnregister(&e)
+
+	// The entry is notified of each event once until it's rearmed.
+	for _, c := range []struct {
+		mask  EventMask
+		calls int
+	}{
+		{EventIn, 1},
+		{EventIn, 1},
+		{EventOut, 2},
+		{EventIn | EventOut, 2},
+		{EventErr, 2},
+	} {
+		q.Notify(c.mask)
+		if calls != c.calls {
+			t.Fatalf("got %d calls after notifying %#x, want %d", calls, c.mask, c.calls)
+		}
+	}
+
+	e.Rearm()
+	q.Notify(EventIn)
+	if calls != 3 {
+		t.Errorf("got %d calls after rearming, want 3", calls)
+	}
+}